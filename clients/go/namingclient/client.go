@@ -0,0 +1,1687 @@
+// Code generated by cmd/apigen from api/naming.openapi.json. DO NOT EDIT.
+
+// Package namingclient is a client for the Naming Service API. Zero-valued fields are left
+// out of request bodies.
+package namingclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client calls the Naming Service. The zero value is not usable; set BaseURL.
+type Client struct {
+	BaseURL string
+	HTTP    *http.Client // nil = http.DefaultClient
+	// Header is sent with every request, e.g. Authorization or a session
+	// Cookie.
+	Header http.Header
+}
+
+// New returns a client for the service at baseURL.
+func New(baseURL string) *Client { return &Client{BaseURL: strings.TrimRight(baseURL, "/")} }
+
+// Error is a response with a non-2xx status. Code, Message and RequestID
+// come from the service's error envelope; Body is the raw response.
+type Error struct {
+	Status    int    `json:"-"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Detail    any    `json:"detail"`
+	RequestID string `json:"requestId"`
+	Body      string `json:"-"`
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("%d %s: %s", e.Status, http.StatusText(e.Status), e.Body)
+	}
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// do sends a request and returns the response if it is a success.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body io.Reader, contentType string) (*http.Response, error) {
+	u := c.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.Header {
+		req.Header[k] = v
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	hc := c.HTTP
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		e := &Error{Status: resp.StatusCode, Body: strings.TrimSpace(string(b))}
+		_ = json.Unmarshal(b, e)
+		return nil, e
+	}
+	return resp, nil
+}
+
+// call sends in as JSON, if it is not nil, and decodes the answer into out.
+func (c *Client) call(ctx context.Context, method, path string, query url.Values, in, out any) error {
+	var body io.Reader
+	contentType := ""
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body, contentType = bytes.NewReader(b), "application/json"
+	}
+	resp, err := c.do(ctx, method, path, query, body, contentType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+type ACLEntry struct {
+	Permissions []string `json:"permissions,omitempty"`
+	Subject     string   `json:"subject,omitempty"`
+}
+
+type AccessCount struct {
+	Bytes int64 `json:"bytes,omitempty"`
+	Count int64 `json:"count,omitempty"`
+}
+
+type AlertChannel struct {
+	Disabled    bool     `json:"disabled,omitempty"`
+	From        string   `json:"from,omitempty"`
+	ID          string   `json:"id,omitempty"`
+	Kind        string   `json:"kind,omitempty"`
+	MinSeverity string   `json:"minSeverity,omitempty"`
+	Password    string   `json:"password,omitempty"`
+	SmtpAddr    string   `json:"smtpAddr,omitempty"`
+	To          []string `json:"to,omitempty"`
+	URL         string   `json:"url,omitempty"`
+	Username    string   `json:"username,omitempty"`
+}
+
+type AlertRule struct {
+	Disabled   bool    `json:"disabled,omitempty"`
+	ForSeconds float64 `json:"forSeconds,omitempty"`
+	ID         string  `json:"id,omitempty"`
+	Metric     string  `json:"metric,omitempty"`
+	Op         string  `json:"op,omitempty"`
+	Severity   string  `json:"severity,omitempty"`
+	Threshold  float64 `json:"threshold,omitempty"`
+}
+
+type AllocateRequest struct {
+	Checksum            string   `json:"checksum,omitempty"`
+	ContentType         string   `json:"contentType,omitempty"`
+	DerivedKind         string   `json:"derivedKind,omitempty"`
+	DetectedContentType string   `json:"detectedContentType,omitempty"`
+	FileID              string   `json:"fileId,omitempty"`
+	Filename            string   `json:"filename,omitempty"`
+	Owner               string   `json:"owner,omitempty"`
+	ParentID            string   `json:"parentId,omitempty"`
+	Placement           []string `json:"placement,omitempty"`
+	Size                int64    `json:"size,omitempty"`
+	StorageClass        string   `json:"storageClass,omitempty"`
+}
+
+type AuditRequest struct {
+	Action string `json:"action,omitempty"`
+	Actor  string `json:"actor,omitempty"`
+	Detail string `json:"detail,omitempty"`
+	Target string `json:"target,omitempty"`
+}
+
+type BackupTarget struct {
+	AccessKey string   `json:"accessKey,omitempty"`
+	Bucket    string   `json:"bucket,omitempty"`
+	Disabled  bool     `json:"disabled,omitempty"`
+	Endpoint  string   `json:"endpoint,omitempty"`
+	FileIDs   []string `json:"fileIds,omitempty"`
+	ID        string   `json:"id,omitempty"`
+	KeyPrefix string   `json:"keyPrefix,omitempty"`
+	Kind      string   `json:"kind,omitempty"`
+	Password  string   `json:"password,omitempty"`
+	Path      string   `json:"path,omitempty"`
+	Prefix    string   `json:"prefix,omitempty"`
+	Region    string   `json:"region,omitempty"`
+	SecretKey string   `json:"secretKey,omitempty"`
+	URL       string   `json:"url,omitempty"`
+	Username  string   `json:"username,omitempty"`
+}
+
+type BatchRequest struct {
+	Commit []CommitRequest `json:"commit,omitempty"`
+	Delete []string        `json:"delete,omitempty"`
+}
+
+type CancelOperationRequest struct {
+	ID string `json:"id,omitempty"`
+}
+
+type ChangeClassRequest struct {
+	StorageClass string `json:"storageClass,omitempty"`
+}
+
+type ClusterSnapshot struct {
+	Checksum  string                  `json:"checksum,omitempty"`
+	ClusterID string                  `json:"clusterId,omitempty"`
+	CreatedAt time.Time               `json:"createdAt,omitempty"`
+	Files     map[string]FileMetadata `json:"files,omitempty"`
+	Format    int                     `json:"format,omitempty"`
+	Nodes     map[string]NodeInfo     `json:"nodes,omitempty"`
+	Revision  int64                   `json:"revision,omitempty"`
+}
+
+type CommitRequest struct {
+	FileID     string   `json:"fileId,omitempty"`
+	StoredSize int64    `json:"storedSize,omitempty"`
+	Uploaded   []string `json:"uploaded,omitempty"`
+	Version    int      `json:"version,omitempty"`
+}
+
+type ConflictFile struct {
+	Checksum  string    `json:"checksum,omitempty"`
+	CreatedAt time.Time `json:"createdAt,omitempty"`
+	FileID    string    `json:"fileId,omitempty"`
+	Size      int64     `json:"size,omitempty"`
+	State     string    `json:"state,omitempty"`
+}
+
+type ConflictStatus struct {
+	ConflictID string         `json:"conflictId,omitempty"`
+	CreatedAt  time.Time      `json:"createdAt,omitempty"`
+	FileIDs    []string       `json:"fileIds,omitempty"`
+	Filename   string         `json:"filename,omitempty"`
+	Files      []ConflictFile `json:"files,omitempty"`
+	Owner      string         `json:"owner,omitempty"`
+}
+
+type CopyFileRequest struct {
+	Filename string `json:"filename,omitempty"`
+	Owner    string `json:"owner,omitempty"`
+}
+
+type CreateShareRequest struct {
+	ExpiresIn    string `json:"expiresIn,omitempty"`
+	FileID       string `json:"fileId,omitempty"`
+	MaxDownloads int64  `json:"maxDownloads,omitempty"`
+	Password     string `json:"password,omitempty"`
+}
+
+type DeleteFileRequest struct {
+	FileID string `json:"fileId,omitempty"`
+}
+
+type FileMetadata struct {
+	AccessCount         int64             `json:"accessCount,omitempty"`
+	ACL                 []ACLEntry        `json:"acl,omitempty"`
+	Checksum            string            `json:"checksum,omitempty"`
+	CommittedVersion    int               `json:"committedVersion,omitempty"`
+	ConflictID          string            `json:"conflictId,omitempty"`
+	ContentType         string            `json:"contentType,omitempty"`
+	CreatedAt           time.Time         `json:"createdAt,omitempty"`
+	Derived             map[string]string `json:"derived,omitempty"`
+	DetectedContentType string            `json:"detectedContentType,omitempty"`
+	FileID              string            `json:"fileId,omitempty"`
+	Filename            string            `json:"filename,omitempty"`
+	LastAccessedAt      time.Time         `json:"lastAccessedAt,omitempty"`
+	LastReadAt          time.Time         `json:"lastReadAt,omitempty"`
+	Origin              string            `json:"origin,omitempty"`
+	OverrideServe       bool              `json:"overrideServe,omitempty"`
+	Owner               string            `json:"owner,omitempty"`
+	ParentID            string            `json:"parentId,omitempty"`
+	Placement           []string          `json:"placement,omitempty"`
+	Replicas            []ReplicaInfo     `json:"replicas,omitempty"`
+	ReplicationFactor   int               `json:"replicationFactor,omitempty"`
+	Size                int64             `json:"size,omitempty"`
+	State               string            `json:"state,omitempty"`
+	StorageClass        string            `json:"storageClass,omitempty"`
+	StoredSize          int64             `json:"storedSize,omitempty"`
+	UpdatedAt           time.Time         `json:"updatedAt,omitempty"`
+	Version             int               `json:"version,omitempty"`
+}
+
+type FileSummary struct {
+	ACL               []ACLEntry `json:"acl,omitempty"`
+	ConflictID        string     `json:"conflictId,omitempty"`
+	CreatedAt         time.Time  `json:"createdAt,omitempty"`
+	FileID            string     `json:"fileId,omitempty"`
+	Filename          string     `json:"filename,omitempty"`
+	Owner             string     `json:"owner,omitempty"`
+	ReplicaCount      int        `json:"replicaCount,omitempty"`
+	ReplicationFactor int        `json:"replicationFactor,omitempty"`
+	SavedBytes        int64      `json:"savedBytes,omitempty"`
+	Size              int64      `json:"size,omitempty"`
+	State             string     `json:"state,omitempty"`
+	StorageClass      string     `json:"storageClass,omitempty"`
+	StoredSize        int64      `json:"storedSize,omitempty"`
+}
+
+type GeoPeer struct {
+	Disabled   bool   `json:"disabled,omitempty"`
+	ID         string `json:"id,omitempty"`
+	NamingURL  string `json:"namingUrl,omitempty"`
+	OnConflict string `json:"onConflict,omitempty"`
+	Prefix     string `json:"prefix,omitempty"`
+	Token      string `json:"token,omitempty"`
+}
+
+type GeoReceiveRequest struct {
+	Checksum     string   `json:"checksum,omitempty"`
+	ContentType  string   `json:"contentType,omitempty"`
+	FileID       string   `json:"fileId,omitempty"`
+	Filename     string   `json:"filename,omitempty"`
+	Origin       string   `json:"origin,omitempty"`
+	Overwrite    bool     `json:"overwrite,omitempty"`
+	Owner        string   `json:"owner,omitempty"`
+	Placement    []string `json:"placement,omitempty"`
+	Size         int64    `json:"size,omitempty"`
+	StorageClass string   `json:"storageClass,omitempty"`
+}
+
+type GeoReceiveResponse struct {
+	Action    string       `json:"action,omitempty"`
+	ClusterID string       `json:"clusterId,omitempty"`
+	FileID    string       `json:"fileId,omitempty"`
+	Replicas  []GeoReplica `json:"replicas,omitempty"`
+	Version   int          `json:"version,omitempty"`
+}
+
+type GeoReplica struct {
+	NodeID string `json:"NodeID,omitempty"`
+	Ticket string `json:"Ticket,omitempty"`
+	URL    string `json:"URL,omitempty"`
+}
+
+type HealthTransition struct {
+	At     time.Time `json:"at,omitempty"`
+	From   string    `json:"from,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	To     string    `json:"to,omitempty"`
+}
+
+type HeartbeatRequest struct {
+	Degraded      bool                   `json:"degraded,omitempty"`
+	DiskFreeBytes int64                  `json:"diskFreeBytes,omitempty"`
+	Inventory     InventoryDigest        `json:"inventory,omitempty"`
+	NodeID        string                 `json:"nodeId,omitempty"`
+	ReadOnly      bool                   `json:"readOnly,omitempty"`
+	Reads         map[string]AccessCount `json:"reads,omitempty"`
+	Received      AccessCount            `json:"received,omitempty"`
+	UsedBytes     int64                  `json:"usedBytes,omitempty"`
+}
+
+type InventoryDigest struct {
+	Count int    `json:"count,omitempty"`
+	Hash  string `json:"hash,omitempty"`
+}
+
+type LifecycleRule struct {
+	Action       string  `json:"action,omitempty"`
+	AfterDays    float64 `json:"afterDays,omitempty"`
+	Disabled     bool    `json:"disabled,omitempty"`
+	Factor       int     `json:"factor,omitempty"`
+	FileID       string  `json:"fileId,omitempty"`
+	ID           string  `json:"id,omitempty"`
+	Prefix       string  `json:"prefix,omitempty"`
+	StorageClass string  `json:"storageClass,omitempty"`
+}
+
+type LookupReplica struct {
+	NodeID string `json:"NodeID,omitempty"`
+	URL    string `json:"URL,omitempty"`
+}
+
+type MaintenanceModeRequest struct {
+	Enabled bool `json:"enabled,omitempty"`
+}
+
+type MoveFileRequest struct {
+	Directory string `json:"directory,omitempty"`
+	Filename  string `json:"filename,omitempty"`
+	Owner     string `json:"owner,omitempty"`
+}
+
+type MoveReplicaRequest struct {
+	FileID string `json:"fileId,omitempty"`
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+}
+
+type NodeHistoryResult struct {
+	Flapping    bool               `json:"flapping,omitempty"`
+	NodeID      string             `json:"nodeId,omitempty"`
+	Outages     int                `json:"outages,omitempty"`
+	Status      string             `json:"status,omitempty"`
+	Threshold   int                `json:"threshold,omitempty"`
+	Transitions []HealthTransition `json:"transitions,omitempty"`
+	Window      string             `json:"window,omitempty"`
+}
+
+type NodeInfo struct {
+	CapacityBytes       int64     `json:"capacityBytes,omitempty"`
+	Degraded            bool      `json:"degraded,omitempty"`
+	Discovered          bool      `json:"discovered,omitempty"`
+	DiskFreeBytes       int64     `json:"diskFreeBytes,omitempty"`
+	Flapping            bool      `json:"flapping,omitempty"`
+	HeartbeatIntervalMs int64     `json:"heartbeatIntervalMs,omitempty"`
+	LastChosen          time.Time `json:"lastChosen,omitempty"`
+	LastPeerSeenAt      time.Time `json:"lastPeerSeenAt,omitempty"`
+	LastSeenAt          time.Time `json:"lastSeenAt,omitempty"`
+	Maintenance         bool      `json:"maintenance,omitempty"`
+	NodeID              string    `json:"nodeId,omitempty"`
+	ReadOnly            bool      `json:"readOnly,omitempty"`
+	Status              string    `json:"status,omitempty"`
+	Tags                []string  `json:"tags,omitempty"`
+	URL                 string    `json:"url,omitempty"`
+	UsedBytes           int64     `json:"usedBytes,omitempty"`
+	Version             string    `json:"version,omitempty"`
+	Weight              float64   `json:"weight,omitempty"`
+	Zone                string    `json:"zone,omitempty"`
+}
+
+type NodeMaintenanceRequest struct {
+	Enabled bool   `json:"enabled,omitempty"`
+	NodeID  string `json:"nodeId,omitempty"`
+}
+
+type OpenShareRequest struct {
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+}
+
+type OverrideServeRequest struct {
+	Allow  bool   `json:"allow,omitempty"`
+	FileID string `json:"fileId,omitempty"`
+}
+
+type PeerReportRequest struct {
+	Observations []struct {
+		NodeID    string `json:"nodeId,omitempty"`
+		Reachable bool   `json:"reachable,omitempty"`
+	} `json:"observations,omitempty"`
+	Observer string `json:"observer,omitempty"`
+}
+
+type PermissionsRequest struct {
+	ACL   []ACLEntry `json:"acl,omitempty"`
+	Owner string     `json:"owner,omitempty"`
+}
+
+type PlacementPolicyRequest struct {
+	Policy string `json:"policy,omitempty"`
+}
+
+type RebuildRequest struct {
+	Force bool `json:"force,omitempty"`
+	Merge bool `json:"merge,omitempty"`
+}
+
+type RebuildResult struct {
+	Added         int               `json:"added,omitempty"`
+	Blobs         map[string]int    `json:"blobs,omitempty"`
+	Degraded      int               `json:"degraded,omitempty"`
+	Disagreements int               `json:"disagreements,omitempty"`
+	DryRun        bool              `json:"dryRun,omitempty"`
+	FailedNodes   map[string]string `json:"failedNodes,omitempty"`
+	Files         int               `json:"files,omitempty"`
+	Kept          int               `json:"kept,omitempty"`
+	Revision      int64             `json:"revision,omitempty"`
+	Unidentified  int               `json:"unidentified,omitempty"`
+}
+
+type RegisterNodeRequest struct {
+	CapacityBytes       int64    `json:"capacityBytes,omitempty"`
+	HeartbeatIntervalMs int64    `json:"heartbeatIntervalMs,omitempty"`
+	NodeID              string   `json:"nodeId,omitempty"`
+	Tags                []string `json:"tags,omitempty"`
+	URL                 string   `json:"url,omitempty"`
+	UsedBytes           int64    `json:"usedBytes,omitempty"`
+	Version             string   `json:"version,omitempty"`
+	Weight              float64  `json:"weight,omitempty"`
+	Zone                string   `json:"zone,omitempty"`
+}
+
+type RenameFileRequest struct {
+	FileID   string `json:"fileId,omitempty"`
+	Filename string `json:"filename,omitempty"`
+}
+
+type ReplicaInfo struct {
+	LastVerifiedAt   time.Time `json:"lastVerifiedAt,omitempty"`
+	MismatchChecksum string    `json:"mismatchChecksum,omitempty"`
+	NodeID           string    `json:"nodeId,omitempty"`
+	Status           string    `json:"status,omitempty"`
+	URL              string    `json:"url,omitempty"`
+	Version          int       `json:"version,omitempty"`
+}
+
+type ReportIncidentRequest struct {
+	Detail   string `json:"detail,omitempty"`
+	FileID   string `json:"fileId,omitempty"`
+	Kind     string `json:"kind,omitempty"`
+	NodeID   string `json:"nodeId,omitempty"`
+	NodeURL  string `json:"nodeUrl,omitempty"`
+	Reporter string `json:"reporter,omitempty"`
+}
+
+type ReportMissingRequest struct {
+	FileID   string `json:"fileId,omitempty"`
+	NodeID   string `json:"nodeId,omitempty"`
+	NodeURL  string `json:"nodeUrl,omitempty"`
+	Reporter string `json:"reporter,omitempty"`
+}
+
+type ResolveConflictRequest struct {
+	Keep     string `json:"keep,omitempty"`
+	Strategy string `json:"strategy,omitempty"`
+}
+
+type RestoreRequest struct {
+	Force      bool            `json:"force,omitempty"`
+	NodeURL    string          `json:"nodeUrl,omitempty"`
+	Snapshot   ClusterSnapshot `json:"snapshot,omitempty"`
+	SnapshotID string          `json:"snapshotId,omitempty"`
+}
+
+type RevokeShareRequest struct {
+	Token string `json:"token,omitempty"`
+}
+
+type SetAlertsRequest struct {
+	Channels []AlertChannel `json:"channels,omitempty"`
+	Rules    []AlertRule    `json:"rules,omitempty"`
+}
+
+type SetBackupRequest struct {
+	Targets []BackupTarget `json:"targets,omitempty"`
+}
+
+type SetGeoPeersRequest struct {
+	Peers []GeoPeer `json:"peers,omitempty"`
+}
+
+type SetLifecycleRequest struct {
+	Rules []LifecycleRule `json:"rules,omitempty"`
+}
+
+type SetQuotaRequest struct {
+	MaxBytes int64  `json:"maxBytes,omitempty"`
+	MaxFiles int64  `json:"maxFiles,omitempty"`
+	Owner    string `json:"owner,omitempty"`
+}
+
+type SetReplicationRequest struct {
+	All     bool     `json:"all,omitempty"`
+	Factor  int      `json:"factor,omitempty"`
+	FileID  string   `json:"fileId,omitempty"`
+	FileIDs []string `json:"fileIds,omitempty"`
+}
+
+type Settings struct {
+	DefaultHeartbeatMs int64   `json:"defaultHeartbeatMs,omitempty"`
+	DownAfterBeats     float64 `json:"downAfterBeats,omitempty"`
+	HealIntervalMs     int64   `json:"healIntervalMs,omitempty"`
+	PlacementPolicy    string  `json:"placementPolicy,omitempty"`
+	ReadPolicy         string  `json:"readPolicy,omitempty"`
+	ReplicationFactor  int     `json:"replicationFactor,omitempty"`
+	SuspectAfterBeats  float64 `json:"suspectAfterBeats,omitempty"`
+	WriteQuorum        int     `json:"writeQuorum,omitempty"`
+}
+
+type ShareStatus struct {
+	CreatedAt    time.Time `json:"createdAt,omitempty"`
+	CreatedBy    string    `json:"createdBy,omitempty"`
+	Downloads    int64     `json:"downloads,omitempty"`
+	ExpiresAt    time.Time `json:"expiresAt,omitempty"`
+	FileID       string    `json:"fileId,omitempty"`
+	MaxDownloads int64     `json:"maxDownloads,omitempty"`
+	PasswordHash string    `json:"passwordHash,omitempty"`
+	Protected    bool      `json:"protected,omitempty"`
+	RevokedAt    time.Time `json:"revokedAt,omitempty"`
+	State        string    `json:"state,omitempty"`
+	Token        string    `json:"token,omitempty"`
+}
+
+type SnapshotRequest struct {
+	Copies int `json:"copies,omitempty"`
+}
+
+// AlertsParams are the optional query parameters of Alerts.
+type AlertsParams struct {
+	State string
+}
+
+// Alerts calls GET /alerts.
+//
+// Alert rules and which are firing.
+func (c *Client) Alerts(ctx context.Context, params AlertsParams) (map[string]any, error) {
+	query := url.Values{}
+	if params.State != "" {
+		query.Set("state", params.State)
+	}
+	var out map[string]any
+	err := c.call(ctx, "GET", "/alerts", query, nil, &out)
+	return out, err
+}
+
+// Allocate calls POST /allocate.
+//
+// Allocate a file ID and replica nodes for an upload.
+func (c *Client) Allocate(ctx context.Context, body AllocateRequest) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "POST", "/allocate", query, body, &out)
+	return out, err
+}
+
+// BackupStatus calls GET /backup-status.
+//
+// What each backup target has and how its last run went.
+func (c *Client) BackupStatus(ctx context.Context) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "GET", "/backup-status", query, nil, &out)
+	return out, err
+}
+
+// BatchParams are the optional query parameters of Batch.
+type BatchParams struct {
+	DryRun string
+}
+
+// Batch calls POST /batch.
+//
+// Commit and delete a group of files, all or none.
+func (c *Client) Batch(ctx context.Context, params BatchParams, body BatchRequest) (map[string]any, error) {
+	query := url.Values{}
+	if params.DryRun != "" {
+		query.Set("dryRun", params.DryRun)
+	}
+	var out map[string]any
+	err := c.call(ctx, "POST", "/batch", query, body, &out)
+	return out, err
+}
+
+// CancelOperation calls POST /operations/cancel.
+//
+// Cancel a running operation.
+func (c *Client) CancelOperation(ctx context.Context, body CancelOperationRequest) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "POST", "/operations/cancel", query, body, &out)
+	return out, err
+}
+
+// CapacityForecastParams are the optional query parameters of CapacityForecast.
+type CapacityForecastParams struct {
+	Window      string
+	HorizonDays string
+	Series      string
+}
+
+// CapacityForecast calls GET /capacity-forecast.
+//
+// Days until full per node and cluster-wide, and nodes to add.
+func (c *Client) CapacityForecast(ctx context.Context, params CapacityForecastParams) (map[string]any, error) {
+	query := url.Values{}
+	if params.Window != "" {
+		query.Set("window", params.Window)
+	}
+	if params.HorizonDays != "" {
+		query.Set("horizonDays", params.HorizonDays)
+	}
+	if params.Series != "" {
+		query.Set("series", params.Series)
+	}
+	var out map[string]any
+	err := c.call(ctx, "GET", "/capacity-forecast", query, nil, &out)
+	return out, err
+}
+
+// ChangeStorageClass calls POST /files/{fileId}/storage-class.
+//
+// Move a file to another storage class.
+func (c *Client) ChangeStorageClass(ctx context.Context, fileId string, body ChangeClassRequest) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "POST", "/files/"+url.PathEscape(fileId)+"/storage-class", query, body, &out)
+	return out, err
+}
+
+// ClusterInfo calls GET /cluster-info.
+//
+// Version, settings and node counts.
+func (c *Client) ClusterInfo(ctx context.Context) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "GET", "/cluster-info", query, nil, &out)
+	return out, err
+}
+
+// Commit calls POST /commit.
+//
+// Commit the replicas an upload reached.
+func (c *Client) Commit(ctx context.Context, body CommitRequest) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "POST", "/commit", query, body, &out)
+	return out, err
+}
+
+// CopyFile calls POST /files/{fileId}/copy.
+//
+// Copy a file on the nodes that hold it, without moving its bytes.
+func (c *Client) CopyFile(ctx context.Context, fileId string, body CopyFileRequest) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "POST", "/files/"+url.PathEscape(fileId)+"/copy", query, body, &out)
+	return out, err
+}
+
+// CreateShare calls POST /shares.
+//
+// Create a share link.
+func (c *Client) CreateShare(ctx context.Context, body CreateShareRequest) (ShareStatus, error) {
+	var query url.Values
+	var out ShareStatus
+	err := c.call(ctx, "POST", "/shares", query, body, &out)
+	return out, err
+}
+
+// DeleteFileParams are the optional query parameters of DeleteFile.
+type DeleteFileParams struct {
+	DryRun string
+}
+
+// DeleteFile calls DELETE /files/{fileId}.
+//
+// Delete a file and its replicas.
+func (c *Client) DeleteFile(ctx context.Context, fileId string, params DeleteFileParams) (map[string]any, error) {
+	query := url.Values{}
+	if params.DryRun != "" {
+		query.Set("dryRun", params.DryRun)
+	}
+	var out map[string]any
+	err := c.call(ctx, "DELETE", "/files/"+url.PathEscape(fileId), query, nil, &out)
+	return out, err
+}
+
+// DeleteFileLegacyParams are the optional query parameters of DeleteFileLegacy.
+type DeleteFileLegacyParams struct {
+	DryRun string
+}
+
+// DeleteFileLegacy calls POST /delete-file.
+//
+// Delete a file (deprecated: use DELETE /files/{fileId}).
+func (c *Client) DeleteFileLegacy(ctx context.Context, params DeleteFileLegacyParams, body DeleteFileRequest) (map[string]any, error) {
+	query := url.Values{}
+	if params.DryRun != "" {
+		query.Set("dryRun", params.DryRun)
+	}
+	var out map[string]any
+	err := c.call(ctx, "POST", "/delete-file", query, body, &out)
+	return out, err
+}
+
+// Discovery calls GET /discovery.
+//
+// Node discovery mode and last result.
+func (c *Client) Discovery(ctx context.Context) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "GET", "/discovery", query, nil, &out)
+	return out, err
+}
+
+// ExportSnapshot calls GET /admin/snapshot.
+//
+// The catalog as of now, for /admin/restore.
+func (c *Client) ExportSnapshot(ctx context.Context) (ClusterSnapshot, error) {
+	var query url.Values
+	var out ClusterSnapshot
+	err := c.call(ctx, "GET", "/admin/snapshot", query, nil, &out)
+	return out, err
+}
+
+// ExportTopologyParams are the optional query parameters of ExportTopology.
+type ExportTopologyParams struct {
+	Format string
+	Limit  string
+}
+
+// ExportTopology calls GET /admin/export-topology.
+//
+// Nodes and replicas as a Mermaid or DOT diagram.
+// The caller must close the returned stream.
+func (c *Client) ExportTopology(ctx context.Context, params ExportTopologyParams) (io.ReadCloser, error) {
+	query := url.Values{}
+	if params.Format != "" {
+		query.Set("format", params.Format)
+	}
+	if params.Limit != "" {
+		query.Set("limit", params.Limit)
+	}
+	resp, err := c.do(ctx, "GET", "/admin/export-topology", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// FileInfo calls GET /file-info/{fileId}.
+//
+// A file's full metadata.
+func (c *Client) FileInfo(ctx context.Context, fileId string) (FileMetadata, error) {
+	var query url.Values
+	var out FileMetadata
+	err := c.call(ctx, "GET", "/file-info/"+url.PathEscape(fileId), query, nil, &out)
+	return out, err
+}
+
+// GeoReceive calls POST /admin/geo-replication/receive.
+//
+// Take a file a peer cluster pushes.
+func (c *Client) GeoReceive(ctx context.Context, body GeoReceiveRequest) (GeoReceiveResponse, error) {
+	var query url.Values
+	var out GeoReceiveResponse
+	err := c.call(ctx, "POST", "/admin/geo-replication/receive", query, body, &out)
+	return out, err
+}
+
+// GeoReplicationStatus calls GET /geo-replication.
+//
+// Geo-replication queues, lag and conflicts per peer.
+func (c *Client) GeoReplicationStatus(ctx context.Context) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "GET", "/geo-replication", query, nil, &out)
+	return out, err
+}
+
+// GetAlertConfig calls GET /admin/alerts.
+//
+// Alert rules and channels, secrets masked.
+func (c *Client) GetAlertConfig(ctx context.Context) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "GET", "/admin/alerts", query, nil, &out)
+	return out, err
+}
+
+// GetBackupTargets calls GET /admin/backup.
+//
+// Backup targets, secrets masked.
+func (c *Client) GetBackupTargets(ctx context.Context) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "GET", "/admin/backup", query, nil, &out)
+	return out, err
+}
+
+// GetConflict calls GET /conflicts/{conflictId}.
+//
+// One conflict and its files.
+func (c *Client) GetConflict(ctx context.Context, conflictId string) (ConflictStatus, error) {
+	var query url.Values
+	var out ConflictStatus
+	err := c.call(ctx, "GET", "/conflicts/"+url.PathEscape(conflictId), query, nil, &out)
+	return out, err
+}
+
+// GetGeoPeers calls GET /admin/geo-replication.
+//
+// Geo-replication peers, tokens masked.
+func (c *Client) GetGeoPeers(ctx context.Context) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "GET", "/admin/geo-replication", query, nil, &out)
+	return out, err
+}
+
+// GetPermissions calls GET /permissions/{fileId}.
+//
+// A file's owner and ACL.
+func (c *Client) GetPermissions(ctx context.Context, fileId string) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "GET", "/permissions/"+url.PathEscape(fileId), query, nil, &out)
+	return out, err
+}
+
+// GetPlacementPolicy calls GET /admin/placement-policy.
+//
+// The placement policy and the ones available.
+func (c *Client) GetPlacementPolicy(ctx context.Context) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "GET", "/admin/placement-policy", query, nil, &out)
+	return out, err
+}
+
+// GetSettings calls GET /admin/settings.
+//
+// Runtime settings.
+func (c *Client) GetSettings(ctx context.Context) (Settings, error) {
+	var query url.Values
+	var out Settings
+	err := c.call(ctx, "GET", "/admin/settings", query, nil, &out)
+	return out, err
+}
+
+// Heal calls POST /heal/{fileId}.
+//
+// Repair a file now, ahead of the heal sweep.
+func (c *Client) Heal(ctx context.Context, fileId string) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "POST", "/heal/"+url.PathEscape(fileId), query, nil, &out)
+	return out, err
+}
+
+// HealQueue calls GET /heal-queue.
+//
+// Files waiting to be healed.
+func (c *Client) HealQueue(ctx context.Context) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "GET", "/heal-queue", query, nil, &out)
+	return out, err
+}
+
+// Heartbeat calls POST /heartbeat.
+//
+// Report a node's usage, reads and inventory.
+func (c *Client) Heartbeat(ctx context.Context, body HeartbeatRequest) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "POST", "/heartbeat", query, body, &out)
+	return out, err
+}
+
+// IntegrityReportParams are the optional query parameters of IntegrityReport.
+type IntegrityReportParams struct {
+	Format     string
+	Problems   string
+	StaleAfter string
+}
+
+// IntegrityReport calls GET /integrity-report.
+//
+// Replication and checksum health of every file.
+func (c *Client) IntegrityReport(ctx context.Context, params IntegrityReportParams) (map[string]any, error) {
+	query := url.Values{}
+	if params.Format != "" {
+		query.Set("format", params.Format)
+	}
+	if params.Problems != "" {
+		query.Set("problems", params.Problems)
+	}
+	if params.StaleAfter != "" {
+		query.Set("staleAfter", params.StaleAfter)
+	}
+	var out map[string]any
+	err := c.call(ctx, "GET", "/integrity-report", query, nil, &out)
+	return out, err
+}
+
+// Lifecycle calls GET /lifecycle.
+//
+// Lifecycle rules and the last pass.
+func (c *Client) Lifecycle(ctx context.Context) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "GET", "/lifecycle", query, nil, &out)
+	return out, err
+}
+
+// ListAuditParams are the optional query parameters of ListAudit.
+type ListAuditParams struct {
+	Since  string
+	Action string
+}
+
+// ListAudit calls GET /audit.
+//
+// Audit log entries.
+func (c *Client) ListAudit(ctx context.Context, params ListAuditParams) (map[string]any, error) {
+	query := url.Values{}
+	if params.Since != "" {
+		query.Set("since", params.Since)
+	}
+	if params.Action != "" {
+		query.Set("action", params.Action)
+	}
+	var out map[string]any
+	err := c.call(ctx, "GET", "/audit", query, nil, &out)
+	return out, err
+}
+
+// ListConflictsParams are the optional query parameters of ListConflicts.
+type ListConflictsParams struct {
+	Owner string
+}
+
+// ListConflicts calls GET /conflicts.
+//
+// Uploads of the same filename with different content.
+func (c *Client) ListConflicts(ctx context.Context, params ListConflictsParams) (map[string]any, error) {
+	query := url.Values{}
+	if params.Owner != "" {
+		query.Set("owner", params.Owner)
+	}
+	var out map[string]any
+	err := c.call(ctx, "GET", "/conflicts", query, nil, &out)
+	return out, err
+}
+
+// ListFiles calls GET /list-files.
+//
+// Every file in the catalog.
+func (c *Client) ListFiles(ctx context.Context) ([]FileSummary, error) {
+	var query url.Values
+	var out []FileSummary
+	err := c.call(ctx, "GET", "/list-files", query, nil, &out)
+	return out, err
+}
+
+// ListNodes calls GET /list-nodes.
+//
+// Every registered node.
+func (c *Client) ListNodes(ctx context.Context) ([]NodeInfo, error) {
+	var query url.Values
+	var out []NodeInfo
+	err := c.call(ctx, "GET", "/list-nodes", query, nil, &out)
+	return out, err
+}
+
+// ListOperationsParams are the optional query parameters of ListOperations.
+type ListOperationsParams struct {
+	State string
+}
+
+// ListOperations calls GET /operations.
+//
+// Background operations.
+func (c *Client) ListOperations(ctx context.Context, params ListOperationsParams) (map[string]any, error) {
+	query := url.Values{}
+	if params.State != "" {
+		query.Set("state", params.State)
+	}
+	var out map[string]any
+	err := c.call(ctx, "GET", "/operations", query, nil, &out)
+	return out, err
+}
+
+// ListSharesParams are the optional query parameters of ListShares.
+type ListSharesParams struct {
+	FileID string
+}
+
+// ListShares calls GET /shares.
+//
+// List share links.
+func (c *Client) ListShares(ctx context.Context, params ListSharesParams) (map[string]any, error) {
+	query := url.Values{}
+	if params.FileID != "" {
+		query.Set("fileId", params.FileID)
+	}
+	var out map[string]any
+	err := c.call(ctx, "GET", "/shares", query, nil, &out)
+	return out, err
+}
+
+// LookupParams are the optional query parameters of Lookup.
+type LookupParams struct {
+	Peek string
+}
+
+// Lookup calls GET /lookup/{fileId}.
+//
+// Replicas to download a file from, healthy nodes first.
+func (c *Client) Lookup(ctx context.Context, fileId string, params LookupParams) ([]LookupReplica, error) {
+	query := url.Values{}
+	if params.Peek != "" {
+		query.Set("peek", params.Peek)
+	}
+	var out []LookupReplica
+	err := c.call(ctx, "GET", "/lookup/"+url.PathEscape(fileId), query, nil, &out)
+	return out, err
+}
+
+// Metrics calls GET /metrics.
+//
+// Cluster totals.
+func (c *Client) Metrics(ctx context.Context) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "GET", "/metrics", query, nil, &out)
+	return out, err
+}
+
+// MetricsHistoryParams are the optional query parameters of MetricsHistory.
+type MetricsHistoryParams struct {
+	Window string
+	Step   string
+}
+
+// MetricsHistory calls GET /metrics/history.
+//
+// Cluster totals sampled over time.
+func (c *Client) MetricsHistory(ctx context.Context, params MetricsHistoryParams) (map[string]any, error) {
+	query := url.Values{}
+	if params.Window != "" {
+		query.Set("window", params.Window)
+	}
+	if params.Step != "" {
+		query.Set("step", params.Step)
+	}
+	var out map[string]any
+	err := c.call(ctx, "GET", "/metrics/history", query, nil, &out)
+	return out, err
+}
+
+// MoveFile calls POST /files/{fileId}/move.
+//
+// Move a file to another folder or owner.
+func (c *Client) MoveFile(ctx context.Context, fileId string, body MoveFileRequest) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "POST", "/files/"+url.PathEscape(fileId)+"/move", query, body, &out)
+	return out, err
+}
+
+// MoveReplica calls POST /move-replica.
+//
+// Move a replica to another node.
+func (c *Client) MoveReplica(ctx context.Context, body MoveReplicaRequest) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "POST", "/move-replica", query, body, &out)
+	return out, err
+}
+
+// NodeHealth calls GET /node-health/{nodeId}.
+//
+// Why a node has its status.
+func (c *Client) NodeHealth(ctx context.Context, nodeId string) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "GET", "/node-health/"+url.PathEscape(nodeId), query, nil, &out)
+	return out, err
+}
+
+// NodeHistory calls GET /node-history/{nodeId}.
+//
+// A node's health transitions and whether it is flapping.
+func (c *Client) NodeHistory(ctx context.Context, nodeId string) (NodeHistoryResult, error) {
+	var query url.Values
+	var out NodeHistoryResult
+	err := c.call(ctx, "GET", "/node-history/"+url.PathEscape(nodeId), query, nil, &out)
+	return out, err
+}
+
+// NodeStatsParams are the optional query parameters of NodeStats.
+type NodeStatsParams struct {
+	Window string
+}
+
+// NodeStats calls GET /stats/nodes.
+//
+// Bytes served per node.
+func (c *Client) NodeStats(ctx context.Context, params NodeStatsParams) (map[string]any, error) {
+	query := url.Values{}
+	if params.Window != "" {
+		query.Set("window", params.Window)
+	}
+	var out map[string]any
+	err := c.call(ctx, "GET", "/stats/nodes", query, nil, &out)
+	return out, err
+}
+
+// OpenAPI calls GET /openapi.json.
+//
+// This API as an OpenAPI 3 document.
+func (c *Client) OpenAPI(ctx context.Context) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "GET", "/openapi.json", query, nil, &out)
+	return out, err
+}
+
+// OpenShare calls POST /shares/open.
+//
+// Count a download through a share link.
+func (c *Client) OpenShare(ctx context.Context, body OpenShareRequest) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "POST", "/shares/open", query, body, &out)
+	return out, err
+}
+
+// OverrideServe calls POST /admin/override-serve.
+//
+// Serve a CORRUPT file anyway, or stop doing so.
+func (c *Client) OverrideServe(ctx context.Context, body OverrideServeRequest) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "POST", "/admin/override-serve", query, body, &out)
+	return out, err
+}
+
+// PeerReport calls POST /peer-report.
+//
+// Report which peers a node can reach.
+func (c *Client) PeerReport(ctx context.Context, body PeerReportRequest) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "POST", "/peer-report", query, body, &out)
+	return out, err
+}
+
+// PopularParams are the optional query parameters of Popular.
+type PopularParams struct {
+	Window string
+	By     string
+	Limit  string
+}
+
+// Popular calls GET /popular.
+//
+// Most read files.
+func (c *Client) Popular(ctx context.Context, params PopularParams) (map[string]any, error) {
+	query := url.Values{}
+	if params.Window != "" {
+		query.Set("window", params.Window)
+	}
+	if params.By != "" {
+		query.Set("by", params.By)
+	}
+	if params.Limit != "" {
+		query.Set("limit", params.Limit)
+	}
+	var out map[string]any
+	err := c.call(ctx, "GET", "/popular", query, nil, &out)
+	return out, err
+}
+
+// QuotaParams are the optional query parameters of Quota.
+type QuotaParams struct {
+	Owner string
+}
+
+// Quota calls GET /quota.
+//
+// Quota usage.
+func (c *Client) Quota(ctx context.Context, params QuotaParams) (map[string]any, error) {
+	query := url.Values{}
+	if params.Owner != "" {
+		query.Set("owner", params.Owner)
+	}
+	var out map[string]any
+	err := c.call(ctx, "GET", "/quota", query, nil, &out)
+	return out, err
+}
+
+// RebuildMetadataParams are the optional query parameters of RebuildMetadata.
+type RebuildMetadataParams struct {
+	DryRun string
+}
+
+// RebuildMetadata calls POST /admin/rebuild-metadata.
+//
+// Rebuild the catalog from the blobs on the storage nodes.
+func (c *Client) RebuildMetadata(ctx context.Context, params RebuildMetadataParams, body RebuildRequest) (RebuildResult, error) {
+	query := url.Values{}
+	if params.DryRun != "" {
+		query.Set("dryRun", params.DryRun)
+	}
+	var out RebuildResult
+	err := c.call(ctx, "POST", "/admin/rebuild-metadata", query, body, &out)
+	return out, err
+}
+
+// RecheckParams are the optional query parameters of Recheck.
+type RecheckParams struct {
+	FileID  string
+	Timeout string
+}
+
+// Recheck calls POST /admin/recheck.
+//
+// Verify a file's replicas now.
+func (c *Client) Recheck(ctx context.Context, params RecheckParams) (map[string]any, error) {
+	query := url.Values{}
+	if params.FileID != "" {
+		query.Set("fileId", params.FileID)
+	}
+	if params.Timeout != "" {
+		query.Set("timeout", params.Timeout)
+	}
+	var out map[string]any
+	err := c.call(ctx, "POST", "/admin/recheck", query, nil, &out)
+	return out, err
+}
+
+// RecordAudit calls POST /audit.
+//
+// Record an audit entry from another service.
+func (c *Client) RecordAudit(ctx context.Context, body AuditRequest) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "POST", "/audit", query, body, &out)
+	return out, err
+}
+
+// RegisterNode calls POST /register-node.
+//
+// Register a storage node, or re-register it after a restart.
+func (c *Client) RegisterNode(ctx context.Context, body RegisterNodeRequest) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "POST", "/register-node", query, body, &out)
+	return out, err
+}
+
+// Reload calls POST /admin/reload.
+//
+// Reload the catalog from disk.
+func (c *Client) Reload(ctx context.Context) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "POST", "/admin/reload", query, nil, &out)
+	return out, err
+}
+
+// RenameFile calls POST /rename-file.
+//
+// Rename a file.
+func (c *Client) RenameFile(ctx context.Context, body RenameFileRequest) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "POST", "/rename-file", query, body, &out)
+	return out, err
+}
+
+// ReportIncident calls POST /report-incident.
+//
+// Report a checksum mismatch or other incident.
+func (c *Client) ReportIncident(ctx context.Context, body ReportIncidentRequest) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "POST", "/report-incident", query, body, &out)
+	return out, err
+}
+
+// ReportMissing calls POST /report-missing.
+//
+// Report a replica a node no longer has.
+func (c *Client) ReportMissing(ctx context.Context, body ReportMissingRequest) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "POST", "/report-missing", query, body, &out)
+	return out, err
+}
+
+// ResolveConflictParams are the optional query parameters of ResolveConflict.
+type ResolveConflictParams struct {
+	DryRun string
+}
+
+// ResolveConflict calls POST /conflicts/{conflictId}/resolve.
+//
+// Resolve a conflict: keep-newest, keep-both or pick.
+func (c *Client) ResolveConflict(ctx context.Context, conflictId string, params ResolveConflictParams, body ResolveConflictRequest) (map[string]any, error) {
+	query := url.Values{}
+	if params.DryRun != "" {
+		query.Set("dryRun", params.DryRun)
+	}
+	var out map[string]any
+	err := c.call(ctx, "POST", "/conflicts/"+url.PathEscape(conflictId)+"/resolve", query, body, &out)
+	return out, err
+}
+
+// RestoreSnapshotParams are the optional query parameters of RestoreSnapshot.
+type RestoreSnapshotParams struct {
+	DryRun string
+}
+
+// RestoreSnapshot calls POST /admin/restore.
+//
+// Load a catalog snapshot.
+func (c *Client) RestoreSnapshot(ctx context.Context, params RestoreSnapshotParams, body RestoreRequest) (map[string]any, error) {
+	query := url.Values{}
+	if params.DryRun != "" {
+		query.Set("dryRun", params.DryRun)
+	}
+	var out map[string]any
+	err := c.call(ctx, "POST", "/admin/restore", query, body, &out)
+	return out, err
+}
+
+// RevokeShare calls DELETE /shares/{token}.
+//
+// Revoke a share link.
+func (c *Client) RevokeShare(ctx context.Context, token string) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "DELETE", "/shares/"+url.PathEscape(token), query, nil, &out)
+	return out, err
+}
+
+// RevokeShareLegacy calls POST /shares/revoke.
+//
+// Revoke a share link (deprecated: use DELETE /shares/{token}).
+func (c *Client) RevokeShareLegacy(ctx context.Context, body RevokeShareRequest) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "POST", "/shares/revoke", query, body, &out)
+	return out, err
+}
+
+// RunBackupParams are the optional query parameters of RunBackup.
+type RunBackupParams struct {
+	Target string
+}
+
+// RunBackup calls POST /admin/backup/run.
+//
+// Start a backup run now.
+func (c *Client) RunBackup(ctx context.Context, params RunBackupParams) (map[string]any, error) {
+	query := url.Values{}
+	if params.Target != "" {
+		query.Set("target", params.Target)
+	}
+	var out map[string]any
+	err := c.call(ctx, "POST", "/admin/backup/run", query, nil, &out)
+	return out, err
+}
+
+// RunLifecycleParams are the optional query parameters of RunLifecycle.
+type RunLifecycleParams struct {
+	DryRun string
+}
+
+// RunLifecycle calls POST /admin/lifecycle/run.
+//
+// Run a lifecycle pass now.
+func (c *Client) RunLifecycle(ctx context.Context, params RunLifecycleParams) (map[string]any, error) {
+	query := url.Values{}
+	if params.DryRun != "" {
+		query.Set("dryRun", params.DryRun)
+	}
+	var out map[string]any
+	err := c.call(ctx, "POST", "/admin/lifecycle/run", query, nil, &out)
+	return out, err
+}
+
+// SetAlertConfig calls PUT /admin/alerts.
+//
+// Replace the alert rules and channels.
+func (c *Client) SetAlertConfig(ctx context.Context, body SetAlertsRequest) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "PUT", "/admin/alerts", query, body, &out)
+	return out, err
+}
+
+// SetBackupTargets calls PUT /admin/backup.
+//
+// Replace the backup targets.
+func (c *Client) SetBackupTargets(ctx context.Context, body SetBackupRequest) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "PUT", "/admin/backup", query, body, &out)
+	return out, err
+}
+
+// SetGeoPeers calls PUT /admin/geo-replication.
+//
+// Replace the geo-replication peers.
+func (c *Client) SetGeoPeers(ctx context.Context, body SetGeoPeersRequest) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "PUT", "/admin/geo-replication", query, body, &out)
+	return out, err
+}
+
+// SetLifecycleParams are the optional query parameters of SetLifecycle.
+type SetLifecycleParams struct {
+	DryRun string
+}
+
+// SetLifecycle calls PUT /admin/lifecycle.
+//
+// Replace the lifecycle rules.
+func (c *Client) SetLifecycle(ctx context.Context, params SetLifecycleParams, body SetLifecycleRequest) (map[string]any, error) {
+	query := url.Values{}
+	if params.DryRun != "" {
+		query.Set("dryRun", params.DryRun)
+	}
+	var out map[string]any
+	err := c.call(ctx, "PUT", "/admin/lifecycle", query, body, &out)
+	return out, err
+}
+
+// SetMaintenanceMode calls POST /admin/maintenance-mode.
+//
+// Make the catalog read-only, or writable again.
+func (c *Client) SetMaintenanceMode(ctx context.Context, body MaintenanceModeRequest) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "POST", "/admin/maintenance-mode", query, body, &out)
+	return out, err
+}
+
+// SetNodeMaintenanceParams are the optional query parameters of SetNodeMaintenance.
+type SetNodeMaintenanceParams struct {
+	DryRun string
+}
+
+// SetNodeMaintenance calls POST /admin/node-maintenance.
+//
+// Put a node into maintenance, or take it out.
+func (c *Client) SetNodeMaintenance(ctx context.Context, params SetNodeMaintenanceParams, body NodeMaintenanceRequest) (map[string]any, error) {
+	query := url.Values{}
+	if params.DryRun != "" {
+		query.Set("dryRun", params.DryRun)
+	}
+	var out map[string]any
+	err := c.call(ctx, "POST", "/admin/node-maintenance", query, body, &out)
+	return out, err
+}
+
+// SetPermissions calls PUT /permissions/{fileId}.
+//
+// Replace a file's ACL and optionally its owner.
+func (c *Client) SetPermissions(ctx context.Context, fileId string, body PermissionsRequest) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "PUT", "/permissions/"+url.PathEscape(fileId), query, body, &out)
+	return out, err
+}
+
+// SetPlacementPolicy calls PUT /admin/placement-policy.
+//
+// Switch the placement policy.
+func (c *Client) SetPlacementPolicy(ctx context.Context, body PlacementPolicyRequest) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "PUT", "/admin/placement-policy", query, body, &out)
+	return out, err
+}
+
+// SetQuota calls PUT /admin/quota.
+//
+// Set or remove an owner's quota.
+func (c *Client) SetQuota(ctx context.Context, body SetQuotaRequest) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "PUT", "/admin/quota", query, body, &out)
+	return out, err
+}
+
+// SetReplicationParams are the optional query parameters of SetReplication.
+type SetReplicationParams struct {
+	DryRun string
+}
+
+// SetReplication calls POST /admin/set-replication.
+//
+// Change a file's replication factor.
+func (c *Client) SetReplication(ctx context.Context, params SetReplicationParams, body SetReplicationRequest) (map[string]any, error) {
+	query := url.Values{}
+	if params.DryRun != "" {
+		query.Set("dryRun", params.DryRun)
+	}
+	var out map[string]any
+	err := c.call(ctx, "POST", "/admin/set-replication", query, body, &out)
+	return out, err
+}
+
+// Stop calls POST /admin/stop.
+//
+// Stop the naming service gracefully.
+func (c *Client) Stop(ctx context.Context) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "POST", "/admin/stop", query, nil, &out)
+	return out, err
+}
+
+// StorageClasses calls GET /storage-classes.
+//
+// The storage classes and what they mean.
+func (c *Client) StorageClasses(ctx context.Context) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "GET", "/storage-classes", query, nil, &out)
+	return out, err
+}
+
+// StoreSnapshot calls POST /admin/snapshot.
+//
+// Store a catalog snapshot on storage nodes.
+func (c *Client) StoreSnapshot(ctx context.Context, body SnapshotRequest) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "POST", "/admin/snapshot", query, body, &out)
+	return out, err
+}
+
+// TestAlertParams are the optional query parameters of TestAlert.
+type TestAlertParams struct {
+	Channel string
+}
+
+// TestAlert calls POST /admin/alerts/test.
+//
+// Send a test notification.
+func (c *Client) TestAlert(ctx context.Context, params TestAlertParams) (map[string]any, error) {
+	query := url.Values{}
+	if params.Channel != "" {
+		query.Set("channel", params.Channel)
+	}
+	var out map[string]any
+	err := c.call(ctx, "POST", "/admin/alerts/test", query, nil, &out)
+	return out, err
+}
+
+// TopFilesParams are the optional query parameters of TopFiles.
+type TopFilesParams struct {
+	Window string
+	By     string
+	Limit  string
+}
+
+// TopFiles calls GET /stats/files/top.
+//
+// Most read files (alias of /popular).
+func (c *Client) TopFiles(ctx context.Context, params TopFilesParams) (map[string]any, error) {
+	query := url.Values{}
+	if params.Window != "" {
+		query.Set("window", params.Window)
+	}
+	if params.By != "" {
+		query.Set("by", params.By)
+	}
+	if params.Limit != "" {
+		query.Set("limit", params.Limit)
+	}
+	var out map[string]any
+	err := c.call(ctx, "GET", "/stats/files/top", query, nil, &out)
+	return out, err
+}
+
+// UpdateSettings calls PUT /admin/settings.
+//
+// Change runtime settings.
+func (c *Client) UpdateSettings(ctx context.Context, body Settings) (map[string]any, error) {
+	var query url.Values
+	var out map[string]any
+	err := c.call(ctx, "PUT", "/admin/settings", query, body, &out)
+	return out, err
+}
+
+// VerifyFileParams are the optional query parameters of VerifyFile.
+type VerifyFileParams struct {
+	FileID  string
+	Timeout string
+}
+
+// VerifyFile calls GET /verify-file.
+//
+// Check every replica of a file against its checksum.
+func (c *Client) VerifyFile(ctx context.Context, params VerifyFileParams) (map[string]any, error) {
+	query := url.Values{}
+	if params.FileID != "" {
+		query.Set("fileId", params.FileID)
+	}
+	if params.Timeout != "" {
+		query.Set("timeout", params.Timeout)
+	}
+	var out map[string]any
+	err := c.call(ctx, "GET", "/verify-file", query, nil, &out)
+	return out, err
+}
+
+// VerifyFileByPathParams are the optional query parameters of VerifyFileByPath.
+type VerifyFileByPathParams struct {
+	Timeout string
+}
+
+// VerifyFileByPath calls GET /verify-file/{fileId}.
+//
+// Check every replica of a file against its checksum.
+func (c *Client) VerifyFileByPath(ctx context.Context, fileId string, params VerifyFileByPathParams) (map[string]any, error) {
+	query := url.Values{}
+	if params.Timeout != "" {
+		query.Set("timeout", params.Timeout)
+	}
+	var out map[string]any
+	err := c.call(ctx, "GET", "/verify-file/"+url.PathEscape(fileId), query, nil, &out)
+	return out, err
+}
@@ -0,0 +1,928 @@
+// Code generated by cmd/apigen from api/naming.openapi.json. DO NOT EDIT.
+//
+// A client for the Naming Service API, for browsers and Node 18+ (it uses fetch).
+
+export interface ACLEntry {
+  permissions?: string[];
+  subject?: string;
+}
+
+export interface AccessCount {
+  bytes?: number;
+  count?: number;
+}
+
+export interface AlertChannel {
+  disabled?: boolean;
+  from?: string;
+  id?: string;
+  kind?: string;
+  minSeverity?: string;
+  password?: string;
+  smtpAddr?: string;
+  to?: string[];
+  url?: string;
+  username?: string;
+}
+
+export interface AlertRule {
+  disabled?: boolean;
+  forSeconds?: number;
+  id?: string;
+  metric?: string;
+  op?: string;
+  severity?: string;
+  threshold?: number;
+}
+
+export interface AllocateRequest {
+  checksum?: string;
+  contentType?: string;
+  derivedKind?: string;
+  detectedContentType?: string;
+  fileId?: string;
+  filename?: string;
+  owner?: string;
+  parentId?: string;
+  placement?: string[];
+  size?: number;
+  storageClass?: string;
+}
+
+export interface AuditRequest {
+  action?: string;
+  actor?: string;
+  detail?: string;
+  target?: string;
+}
+
+export interface BackupTarget {
+  accessKey?: string;
+  bucket?: string;
+  disabled?: boolean;
+  endpoint?: string;
+  fileIds?: string[];
+  id?: string;
+  keyPrefix?: string;
+  kind?: string;
+  password?: string;
+  path?: string;
+  prefix?: string;
+  region?: string;
+  secretKey?: string;
+  url?: string;
+  username?: string;
+}
+
+export interface BatchRequest {
+  commit?: CommitRequest[];
+  delete?: string[];
+}
+
+export interface CancelOperationRequest {
+  id?: string;
+}
+
+export interface ChangeClassRequest {
+  storageClass?: string;
+}
+
+export interface ClusterSnapshot {
+  checksum?: string;
+  clusterId?: string;
+  createdAt?: string;
+  files?: Record<string, FileMetadata>;
+  format?: number;
+  nodes?: Record<string, NodeInfo>;
+  revision?: number;
+}
+
+export interface CommitRequest {
+  fileId?: string;
+  storedSize?: number;
+  uploaded?: string[];
+  version?: number;
+}
+
+export interface ConflictFile {
+  checksum?: string;
+  createdAt?: string;
+  fileId?: string;
+  size?: number;
+  state?: string;
+}
+
+export interface ConflictStatus {
+  conflictId?: string;
+  createdAt?: string;
+  fileIds?: string[];
+  filename?: string;
+  files?: ConflictFile[];
+  owner?: string;
+}
+
+export interface CopyFileRequest {
+  filename?: string;
+  owner?: string;
+}
+
+export interface CreateShareRequest {
+  expiresIn?: string;
+  fileId?: string;
+  maxDownloads?: number;
+  password?: string;
+}
+
+export interface DeleteFileRequest {
+  fileId?: string;
+}
+
+export interface FileMetadata {
+  accessCount?: number;
+  acl?: ACLEntry[];
+  checksum?: string;
+  committedVersion?: number;
+  conflictId?: string;
+  contentType?: string;
+  createdAt?: string;
+  derived?: Record<string, string>;
+  detectedContentType?: string;
+  fileId?: string;
+  filename?: string;
+  lastAccessedAt?: string;
+  lastReadAt?: string;
+  origin?: string;
+  overrideServe?: boolean;
+  owner?: string;
+  parentId?: string;
+  placement?: string[];
+  replicas?: ReplicaInfo[];
+  replicationFactor?: number;
+  size?: number;
+  state?: string;
+  storageClass?: string;
+  storedSize?: number;
+  updatedAt?: string;
+  version?: number;
+}
+
+export interface FileSummary {
+  acl?: ACLEntry[];
+  conflictId?: string;
+  createdAt?: string;
+  fileId?: string;
+  filename?: string;
+  owner?: string;
+  replicaCount?: number;
+  replicationFactor?: number;
+  savedBytes?: number;
+  size?: number;
+  state?: string;
+  storageClass?: string;
+  storedSize?: number;
+}
+
+export interface GeoPeer {
+  disabled?: boolean;
+  id?: string;
+  namingUrl?: string;
+  onConflict?: string;
+  prefix?: string;
+  token?: string;
+}
+
+export interface GeoReceiveRequest {
+  checksum?: string;
+  contentType?: string;
+  fileId?: string;
+  filename?: string;
+  origin?: string;
+  overwrite?: boolean;
+  owner?: string;
+  placement?: string[];
+  size?: number;
+  storageClass?: string;
+}
+
+export interface GeoReceiveResponse {
+  action?: string;
+  clusterId?: string;
+  fileId?: string;
+  replicas?: GeoReplica[];
+  version?: number;
+}
+
+export interface GeoReplica {
+  NodeID?: string;
+  Ticket?: string;
+  URL?: string;
+}
+
+export interface HealthTransition {
+  at?: string;
+  from?: string;
+  reason?: string;
+  to?: string;
+}
+
+export interface HeartbeatRequest {
+  degraded?: boolean;
+  diskFreeBytes?: number;
+  inventory?: InventoryDigest;
+  nodeId?: string;
+  readOnly?: boolean;
+  reads?: Record<string, AccessCount>;
+  received?: AccessCount;
+  usedBytes?: number;
+}
+
+export interface InventoryDigest {
+  count?: number;
+  hash?: string;
+}
+
+export interface LifecycleRule {
+  action?: string;
+  afterDays?: number;
+  disabled?: boolean;
+  factor?: number;
+  fileId?: string;
+  id?: string;
+  prefix?: string;
+  storageClass?: string;
+}
+
+export interface LookupReplica {
+  NodeID?: string;
+  URL?: string;
+}
+
+export interface MaintenanceModeRequest {
+  enabled?: boolean;
+}
+
+export interface MoveFileRequest {
+  directory?: string;
+  filename?: string;
+  owner?: string;
+}
+
+export interface MoveReplicaRequest {
+  fileId?: string;
+  from?: string;
+  to?: string;
+}
+
+export interface NodeHistoryResult {
+  flapping?: boolean;
+  nodeId?: string;
+  outages?: number;
+  status?: string;
+  threshold?: number;
+  transitions?: HealthTransition[];
+  window?: string;
+}
+
+export interface NodeInfo {
+  capacityBytes?: number;
+  degraded?: boolean;
+  discovered?: boolean;
+  diskFreeBytes?: number;
+  flapping?: boolean;
+  heartbeatIntervalMs?: number;
+  lastChosen?: string;
+  lastPeerSeenAt?: string;
+  lastSeenAt?: string;
+  maintenance?: boolean;
+  nodeId?: string;
+  readOnly?: boolean;
+  status?: string;
+  tags?: string[];
+  url?: string;
+  usedBytes?: number;
+  version?: string;
+  weight?: number;
+  zone?: string;
+}
+
+export interface NodeMaintenanceRequest {
+  enabled?: boolean;
+  nodeId?: string;
+}
+
+export interface OpenShareRequest {
+  password?: string;
+  token?: string;
+}
+
+export interface OverrideServeRequest {
+  allow?: boolean;
+  fileId?: string;
+}
+
+export interface PeerReportRequest {
+  observations?: ({ nodeId?: string; reachable?: boolean })[];
+  observer?: string;
+}
+
+export interface PermissionsRequest {
+  acl?: ACLEntry[];
+  owner?: string;
+}
+
+export interface PlacementPolicyRequest {
+  policy?: string;
+}
+
+export interface RebuildRequest {
+  force?: boolean;
+  merge?: boolean;
+}
+
+export interface RebuildResult {
+  added?: number;
+  blobs?: Record<string, number>;
+  degraded?: number;
+  disagreements?: number;
+  dryRun?: boolean;
+  failedNodes?: Record<string, string>;
+  files?: number;
+  kept?: number;
+  revision?: number;
+  unidentified?: number;
+}
+
+export interface RegisterNodeRequest {
+  capacityBytes?: number;
+  heartbeatIntervalMs?: number;
+  nodeId?: string;
+  tags?: string[];
+  url?: string;
+  usedBytes?: number;
+  version?: string;
+  weight?: number;
+  zone?: string;
+}
+
+export interface RenameFileRequest {
+  fileId?: string;
+  filename?: string;
+}
+
+export interface ReplicaInfo {
+  lastVerifiedAt?: string;
+  mismatchChecksum?: string;
+  nodeId?: string;
+  status?: string;
+  url?: string;
+  version?: number;
+}
+
+export interface ReportIncidentRequest {
+  detail?: string;
+  fileId?: string;
+  kind?: string;
+  nodeId?: string;
+  nodeUrl?: string;
+  reporter?: string;
+}
+
+export interface ReportMissingRequest {
+  fileId?: string;
+  nodeId?: string;
+  nodeUrl?: string;
+  reporter?: string;
+}
+
+export interface ResolveConflictRequest {
+  keep?: string;
+  strategy?: string;
+}
+
+export interface RestoreRequest {
+  force?: boolean;
+  nodeUrl?: string;
+  snapshot?: ClusterSnapshot;
+  snapshotId?: string;
+}
+
+export interface RevokeShareRequest {
+  token?: string;
+}
+
+export interface SetAlertsRequest {
+  channels?: AlertChannel[];
+  rules?: AlertRule[];
+}
+
+export interface SetBackupRequest {
+  targets?: BackupTarget[];
+}
+
+export interface SetGeoPeersRequest {
+  peers?: GeoPeer[];
+}
+
+export interface SetLifecycleRequest {
+  rules?: LifecycleRule[];
+}
+
+export interface SetQuotaRequest {
+  maxBytes?: number;
+  maxFiles?: number;
+  owner?: string;
+}
+
+export interface SetReplicationRequest {
+  all?: boolean;
+  factor?: number;
+  fileId?: string;
+  fileIds?: string[];
+}
+
+export interface Settings {
+  defaultHeartbeatMs?: number;
+  downAfterBeats?: number;
+  healIntervalMs?: number;
+  placementPolicy?: string;
+  readPolicy?: string;
+  replicationFactor?: number;
+  suspectAfterBeats?: number;
+  writeQuorum?: number;
+}
+
+export interface ShareStatus {
+  createdAt?: string;
+  createdBy?: string;
+  downloads?: number;
+  expiresAt?: string;
+  fileId?: string;
+  maxDownloads?: number;
+  passwordHash?: string;
+  protected?: boolean;
+  revokedAt?: string;
+  state?: string;
+  token?: string;
+}
+
+export interface SnapshotRequest {
+  copies?: number;
+}
+
+/** A response with a non-2xx status; code, message and requestId come from the error envelope. */
+export class ApiError extends Error {
+  code = "";
+  detail?: unknown;
+  requestId = "";
+
+  constructor(public status: number, public body: string) {
+    super(status + ": " + body);
+    try {
+      const e = JSON.parse(body);
+      this.code = e.code ?? "";
+      this.message = status + " " + this.code + ": " + (e.message ?? "");
+      this.detail = e.detail;
+      this.requestId = e.requestId ?? "";
+    } catch {
+      // not an envelope; message stays the raw body
+    }
+  }
+}
+
+export class NamingClient {
+  /**
+   * @param baseUrl where the service is, "" for the page's own origin
+   * @param init merged into every fetch, e.g. headers or credentials
+   */
+  constructor(public baseUrl = "", public init: RequestInit = {}) {}
+
+  private async send(method: string, path: string, query: Record<string, string | undefined> = {}, body?: BodyInit, contentType?: string): Promise<Response> {
+    const q = new URLSearchParams();
+    for (const [k, v] of Object.entries(query)) if (v !== undefined && v !== "") q.set(k, v);
+    const headers = new Headers(this.init.headers);
+    if (contentType) headers.set("Content-Type", contentType);
+    const resp = await fetch(this.baseUrl + path + (q.size ? "?" + q : ""), { ...this.init, method, headers, body });
+    if (!resp.ok) throw new ApiError(resp.status, (await resp.text()).trim());
+    return resp;
+  }
+
+  private async json<T>(method: string, path: string, query?: Record<string, string | undefined>, body?: unknown): Promise<T> {
+    const resp = await this.send(method, path, query, body === undefined ? undefined : JSON.stringify(body), body === undefined ? undefined : "application/json");
+    return resp.json() as Promise<T>;
+  }
+
+  /** GET /alerts: Alert rules and which are firing. */
+  alerts(query: { state?: string } = {}): Promise<Record<string, unknown>> {
+    return this.json("GET", "/alerts", query);
+  }
+
+  /** POST /allocate: Allocate a file ID and replica nodes for an upload. */
+  allocate(body: AllocateRequest): Promise<Record<string, unknown>> {
+    return this.json("POST", "/allocate", {}, body);
+  }
+
+  /** GET /backup-status: What each backup target has and how its last run went. */
+  backupStatus(): Promise<Record<string, unknown>> {
+    return this.json("GET", "/backup-status", {});
+  }
+
+  /** POST /batch: Commit and delete a group of files, all or none. */
+  batch(body: BatchRequest, query: { dryRun?: string } = {}): Promise<Record<string, unknown>> {
+    return this.json("POST", "/batch", query, body);
+  }
+
+  /** POST /operations/cancel: Cancel a running operation. */
+  cancelOperation(body: CancelOperationRequest): Promise<Record<string, unknown>> {
+    return this.json("POST", "/operations/cancel", {}, body);
+  }
+
+  /** GET /capacity-forecast: Days until full per node and cluster-wide, and nodes to add. */
+  capacityForecast(query: { window?: string; horizonDays?: string; series?: string } = {}): Promise<Record<string, unknown>> {
+    return this.json("GET", "/capacity-forecast", query);
+  }
+
+  /** POST /files/{fileId}/storage-class: Move a file to another storage class. */
+  changeStorageClass(fileId: string, body: ChangeClassRequest): Promise<Record<string, unknown>> {
+    return this.json("POST", `/files/${encodeURIComponent(fileId)}/storage-class`, {}, body);
+  }
+
+  /** GET /cluster-info: Version, settings and node counts. */
+  clusterInfo(): Promise<Record<string, unknown>> {
+    return this.json("GET", "/cluster-info", {});
+  }
+
+  /** POST /commit: Commit the replicas an upload reached. */
+  commit(body: CommitRequest): Promise<Record<string, unknown>> {
+    return this.json("POST", "/commit", {}, body);
+  }
+
+  /** POST /files/{fileId}/copy: Copy a file on the nodes that hold it, without moving its bytes. */
+  copyFile(fileId: string, body: CopyFileRequest): Promise<Record<string, unknown>> {
+    return this.json("POST", `/files/${encodeURIComponent(fileId)}/copy`, {}, body);
+  }
+
+  /** POST /shares: Create a share link. */
+  createShare(body: CreateShareRequest): Promise<ShareStatus> {
+    return this.json("POST", "/shares", {}, body);
+  }
+
+  /** DELETE /files/{fileId}: Delete a file and its replicas. */
+  deleteFile(fileId: string, query: { dryRun?: string } = {}): Promise<Record<string, unknown>> {
+    return this.json("DELETE", `/files/${encodeURIComponent(fileId)}`, query);
+  }
+
+  /** POST /delete-file: Delete a file (deprecated: use DELETE /files/{fileId}). */
+  deleteFileLegacy(body: DeleteFileRequest, query: { dryRun?: string } = {}): Promise<Record<string, unknown>> {
+    return this.json("POST", "/delete-file", query, body);
+  }
+
+  /** GET /discovery: Node discovery mode and last result. */
+  discovery(): Promise<Record<string, unknown>> {
+    return this.json("GET", "/discovery", {});
+  }
+
+  /** GET /admin/snapshot: The catalog as of now, for /admin/restore. */
+  exportSnapshot(): Promise<ClusterSnapshot> {
+    return this.json("GET", "/admin/snapshot", {});
+  }
+
+  /** GET /admin/export-topology: Nodes and replicas as a Mermaid or DOT diagram. */
+  exportTopology(query: { format?: string; limit?: string } = {}): Promise<Response> {
+    return this.send("GET", "/admin/export-topology", query);
+  }
+
+  /** GET /file-info/{fileId}: A file's full metadata. */
+  fileInfo(fileId: string): Promise<FileMetadata> {
+    return this.json("GET", `/file-info/${encodeURIComponent(fileId)}`, {});
+  }
+
+  /** POST /admin/geo-replication/receive: Take a file a peer cluster pushes. */
+  geoReceive(body: GeoReceiveRequest): Promise<GeoReceiveResponse> {
+    return this.json("POST", "/admin/geo-replication/receive", {}, body);
+  }
+
+  /** GET /geo-replication: Geo-replication queues, lag and conflicts per peer. */
+  geoReplicationStatus(): Promise<Record<string, unknown>> {
+    return this.json("GET", "/geo-replication", {});
+  }
+
+  /** GET /admin/alerts: Alert rules and channels, secrets masked. */
+  getAlertConfig(): Promise<Record<string, unknown>> {
+    return this.json("GET", "/admin/alerts", {});
+  }
+
+  /** GET /admin/backup: Backup targets, secrets masked. */
+  getBackupTargets(): Promise<Record<string, unknown>> {
+    return this.json("GET", "/admin/backup", {});
+  }
+
+  /** GET /conflicts/{conflictId}: One conflict and its files. */
+  getConflict(conflictId: string): Promise<ConflictStatus> {
+    return this.json("GET", `/conflicts/${encodeURIComponent(conflictId)}`, {});
+  }
+
+  /** GET /admin/geo-replication: Geo-replication peers, tokens masked. */
+  getGeoPeers(): Promise<Record<string, unknown>> {
+    return this.json("GET", "/admin/geo-replication", {});
+  }
+
+  /** GET /permissions/{fileId}: A file's owner and ACL. */
+  getPermissions(fileId: string): Promise<Record<string, unknown>> {
+    return this.json("GET", `/permissions/${encodeURIComponent(fileId)}`, {});
+  }
+
+  /** GET /admin/placement-policy: The placement policy and the ones available. */
+  getPlacementPolicy(): Promise<Record<string, unknown>> {
+    return this.json("GET", "/admin/placement-policy", {});
+  }
+
+  /** GET /admin/settings: Runtime settings. */
+  getSettings(): Promise<Settings> {
+    return this.json("GET", "/admin/settings", {});
+  }
+
+  /** POST /heal/{fileId}: Repair a file now, ahead of the heal sweep. */
+  heal(fileId: string): Promise<Record<string, unknown>> {
+    return this.json("POST", `/heal/${encodeURIComponent(fileId)}`, {});
+  }
+
+  /** GET /heal-queue: Files waiting to be healed. */
+  healQueue(): Promise<Record<string, unknown>> {
+    return this.json("GET", "/heal-queue", {});
+  }
+
+  /** POST /heartbeat: Report a node's usage, reads and inventory. */
+  heartbeat(body: HeartbeatRequest): Promise<Record<string, unknown>> {
+    return this.json("POST", "/heartbeat", {}, body);
+  }
+
+  /** GET /integrity-report: Replication and checksum health of every file. */
+  integrityReport(query: { format?: string; problems?: string; staleAfter?: string } = {}): Promise<Record<string, unknown>> {
+    return this.json("GET", "/integrity-report", query);
+  }
+
+  /** GET /lifecycle: Lifecycle rules and the last pass. */
+  lifecycle(): Promise<Record<string, unknown>> {
+    return this.json("GET", "/lifecycle", {});
+  }
+
+  /** GET /audit: Audit log entries. */
+  listAudit(query: { since?: string; action?: string } = {}): Promise<Record<string, unknown>> {
+    return this.json("GET", "/audit", query);
+  }
+
+  /** GET /conflicts: Uploads of the same filename with different content. */
+  listConflicts(query: { owner?: string } = {}): Promise<Record<string, unknown>> {
+    return this.json("GET", "/conflicts", query);
+  }
+
+  /** GET /list-files: Every file in the catalog. */
+  listFiles(): Promise<FileSummary[]> {
+    return this.json("GET", "/list-files", {});
+  }
+
+  /** GET /list-nodes: Every registered node. */
+  listNodes(): Promise<NodeInfo[]> {
+    return this.json("GET", "/list-nodes", {});
+  }
+
+  /** GET /operations: Background operations. */
+  listOperations(query: { state?: string } = {}): Promise<Record<string, unknown>> {
+    return this.json("GET", "/operations", query);
+  }
+
+  /** GET /shares: List share links. */
+  listShares(query: { fileId?: string } = {}): Promise<Record<string, unknown>> {
+    return this.json("GET", "/shares", query);
+  }
+
+  /** GET /lookup/{fileId}: Replicas to download a file from, healthy nodes first. */
+  lookup(fileId: string, query: { peek?: string } = {}): Promise<LookupReplica[]> {
+    return this.json("GET", `/lookup/${encodeURIComponent(fileId)}`, query);
+  }
+
+  /** GET /metrics: Cluster totals. */
+  metrics(): Promise<Record<string, unknown>> {
+    return this.json("GET", "/metrics", {});
+  }
+
+  /** GET /metrics/history: Cluster totals sampled over time. */
+  metricsHistory(query: { window?: string; step?: string } = {}): Promise<Record<string, unknown>> {
+    return this.json("GET", "/metrics/history", query);
+  }
+
+  /** POST /files/{fileId}/move: Move a file to another folder or owner. */
+  moveFile(fileId: string, body: MoveFileRequest): Promise<Record<string, unknown>> {
+    return this.json("POST", `/files/${encodeURIComponent(fileId)}/move`, {}, body);
+  }
+
+  /** POST /move-replica: Move a replica to another node. */
+  moveReplica(body: MoveReplicaRequest): Promise<Record<string, unknown>> {
+    return this.json("POST", "/move-replica", {}, body);
+  }
+
+  /** GET /node-health/{nodeId}: Why a node has its status. */
+  nodeHealth(nodeId: string): Promise<Record<string, unknown>> {
+    return this.json("GET", `/node-health/${encodeURIComponent(nodeId)}`, {});
+  }
+
+  /** GET /node-history/{nodeId}: A node's health transitions and whether it is flapping. */
+  nodeHistory(nodeId: string): Promise<NodeHistoryResult> {
+    return this.json("GET", `/node-history/${encodeURIComponent(nodeId)}`, {});
+  }
+
+  /** GET /stats/nodes: Bytes served per node. */
+  nodeStats(query: { window?: string } = {}): Promise<Record<string, unknown>> {
+    return this.json("GET", "/stats/nodes", query);
+  }
+
+  /** GET /openapi.json: This API as an OpenAPI 3 document. */
+  openAPI(): Promise<Record<string, unknown>> {
+    return this.json("GET", "/openapi.json", {});
+  }
+
+  /** POST /shares/open: Count a download through a share link. */
+  openShare(body: OpenShareRequest): Promise<Record<string, unknown>> {
+    return this.json("POST", "/shares/open", {}, body);
+  }
+
+  /** POST /admin/override-serve: Serve a CORRUPT file anyway, or stop doing so. */
+  overrideServe(body: OverrideServeRequest): Promise<Record<string, unknown>> {
+    return this.json("POST", "/admin/override-serve", {}, body);
+  }
+
+  /** POST /peer-report: Report which peers a node can reach. */
+  peerReport(body: PeerReportRequest): Promise<Record<string, unknown>> {
+    return this.json("POST", "/peer-report", {}, body);
+  }
+
+  /** GET /popular: Most read files. */
+  popular(query: { window?: string; by?: string; limit?: string } = {}): Promise<Record<string, unknown>> {
+    return this.json("GET", "/popular", query);
+  }
+
+  /** GET /quota: Quota usage. */
+  quota(query: { owner?: string } = {}): Promise<Record<string, unknown>> {
+    return this.json("GET", "/quota", query);
+  }
+
+  /** POST /admin/rebuild-metadata: Rebuild the catalog from the blobs on the storage nodes. */
+  rebuildMetadata(body: RebuildRequest, query: { dryRun?: string } = {}): Promise<RebuildResult> {
+    return this.json("POST", "/admin/rebuild-metadata", query, body);
+  }
+
+  /** POST /admin/recheck: Verify a file's replicas now. */
+  recheck(query: { fileId?: string; timeout?: string } = {}): Promise<Record<string, unknown>> {
+    return this.json("POST", "/admin/recheck", query);
+  }
+
+  /** POST /audit: Record an audit entry from another service. */
+  recordAudit(body: AuditRequest): Promise<Record<string, unknown>> {
+    return this.json("POST", "/audit", {}, body);
+  }
+
+  /** POST /register-node: Register a storage node, or re-register it after a restart. */
+  registerNode(body: RegisterNodeRequest): Promise<Record<string, unknown>> {
+    return this.json("POST", "/register-node", {}, body);
+  }
+
+  /** POST /admin/reload: Reload the catalog from disk. */
+  reload(): Promise<Record<string, unknown>> {
+    return this.json("POST", "/admin/reload", {});
+  }
+
+  /** POST /rename-file: Rename a file. */
+  renameFile(body: RenameFileRequest): Promise<Record<string, unknown>> {
+    return this.json("POST", "/rename-file", {}, body);
+  }
+
+  /** POST /report-incident: Report a checksum mismatch or other incident. */
+  reportIncident(body: ReportIncidentRequest): Promise<Record<string, unknown>> {
+    return this.json("POST", "/report-incident", {}, body);
+  }
+
+  /** POST /report-missing: Report a replica a node no longer has. */
+  reportMissing(body: ReportMissingRequest): Promise<Record<string, unknown>> {
+    return this.json("POST", "/report-missing", {}, body);
+  }
+
+  /** POST /conflicts/{conflictId}/resolve: Resolve a conflict: keep-newest, keep-both or pick. */
+  resolveConflict(conflictId: string, body: ResolveConflictRequest, query: { dryRun?: string } = {}): Promise<Record<string, unknown>> {
+    return this.json("POST", `/conflicts/${encodeURIComponent(conflictId)}/resolve`, query, body);
+  }
+
+  /** POST /admin/restore: Load a catalog snapshot. */
+  restoreSnapshot(body: RestoreRequest, query: { dryRun?: string } = {}): Promise<Record<string, unknown>> {
+    return this.json("POST", "/admin/restore", query, body);
+  }
+
+  /** DELETE /shares/{token}: Revoke a share link. */
+  revokeShare(token: string): Promise<Record<string, unknown>> {
+    return this.json("DELETE", `/shares/${encodeURIComponent(token)}`, {});
+  }
+
+  /** POST /shares/revoke: Revoke a share link (deprecated: use DELETE /shares/{token}). */
+  revokeShareLegacy(body: RevokeShareRequest): Promise<Record<string, unknown>> {
+    return this.json("POST", "/shares/revoke", {}, body);
+  }
+
+  /** POST /admin/backup/run: Start a backup run now. */
+  runBackup(query: { target?: string } = {}): Promise<Record<string, unknown>> {
+    return this.json("POST", "/admin/backup/run", query);
+  }
+
+  /** POST /admin/lifecycle/run: Run a lifecycle pass now. */
+  runLifecycle(query: { dryRun?: string } = {}): Promise<Record<string, unknown>> {
+    return this.json("POST", "/admin/lifecycle/run", query);
+  }
+
+  /** PUT /admin/alerts: Replace the alert rules and channels. */
+  setAlertConfig(body: SetAlertsRequest): Promise<Record<string, unknown>> {
+    return this.json("PUT", "/admin/alerts", {}, body);
+  }
+
+  /** PUT /admin/backup: Replace the backup targets. */
+  setBackupTargets(body: SetBackupRequest): Promise<Record<string, unknown>> {
+    return this.json("PUT", "/admin/backup", {}, body);
+  }
+
+  /** PUT /admin/geo-replication: Replace the geo-replication peers. */
+  setGeoPeers(body: SetGeoPeersRequest): Promise<Record<string, unknown>> {
+    return this.json("PUT", "/admin/geo-replication", {}, body);
+  }
+
+  /** PUT /admin/lifecycle: Replace the lifecycle rules. */
+  setLifecycle(body: SetLifecycleRequest, query: { dryRun?: string } = {}): Promise<Record<string, unknown>> {
+    return this.json("PUT", "/admin/lifecycle", query, body);
+  }
+
+  /** POST /admin/maintenance-mode: Make the catalog read-only, or writable again. */
+  setMaintenanceMode(body: MaintenanceModeRequest): Promise<Record<string, unknown>> {
+    return this.json("POST", "/admin/maintenance-mode", {}, body);
+  }
+
+  /** POST /admin/node-maintenance: Put a node into maintenance, or take it out. */
+  setNodeMaintenance(body: NodeMaintenanceRequest, query: { dryRun?: string } = {}): Promise<Record<string, unknown>> {
+    return this.json("POST", "/admin/node-maintenance", query, body);
+  }
+
+  /** PUT /permissions/{fileId}: Replace a file's ACL and optionally its owner. */
+  setPermissions(fileId: string, body: PermissionsRequest): Promise<Record<string, unknown>> {
+    return this.json("PUT", `/permissions/${encodeURIComponent(fileId)}`, {}, body);
+  }
+
+  /** PUT /admin/placement-policy: Switch the placement policy. */
+  setPlacementPolicy(body: PlacementPolicyRequest): Promise<Record<string, unknown>> {
+    return this.json("PUT", "/admin/placement-policy", {}, body);
+  }
+
+  /** PUT /admin/quota: Set or remove an owner's quota. */
+  setQuota(body: SetQuotaRequest): Promise<Record<string, unknown>> {
+    return this.json("PUT", "/admin/quota", {}, body);
+  }
+
+  /** POST /admin/set-replication: Change a file's replication factor. */
+  setReplication(body: SetReplicationRequest, query: { dryRun?: string } = {}): Promise<Record<string, unknown>> {
+    return this.json("POST", "/admin/set-replication", query, body);
+  }
+
+  /** POST /admin/stop: Stop the naming service gracefully. */
+  stop(): Promise<Record<string, unknown>> {
+    return this.json("POST", "/admin/stop", {});
+  }
+
+  /** GET /storage-classes: The storage classes and what they mean. */
+  storageClasses(): Promise<Record<string, unknown>> {
+    return this.json("GET", "/storage-classes", {});
+  }
+
+  /** POST /admin/snapshot: Store a catalog snapshot on storage nodes. */
+  storeSnapshot(body: SnapshotRequest): Promise<Record<string, unknown>> {
+    return this.json("POST", "/admin/snapshot", {}, body);
+  }
+
+  /** POST /admin/alerts/test: Send a test notification. */
+  testAlert(query: { channel?: string } = {}): Promise<Record<string, unknown>> {
+    return this.json("POST", "/admin/alerts/test", query);
+  }
+
+  /** GET /stats/files/top: Most read files (alias of /popular). */
+  topFiles(query: { window?: string; by?: string; limit?: string } = {}): Promise<Record<string, unknown>> {
+    return this.json("GET", "/stats/files/top", query);
+  }
+
+  /** PUT /admin/settings: Change runtime settings. */
+  updateSettings(body: Settings): Promise<Record<string, unknown>> {
+    return this.json("PUT", "/admin/settings", {}, body);
+  }
+
+  /** GET /verify-file: Check every replica of a file against its checksum. */
+  verifyFile(query: { fileId?: string; timeout?: string } = {}): Promise<Record<string, unknown>> {
+    return this.json("GET", "/verify-file", query);
+  }
+
+  /** GET /verify-file/{fileId}: Check every replica of a file against its checksum. */
+  verifyFileByPath(fileId: string, query: { timeout?: string } = {}): Promise<Record<string, unknown>> {
+    return this.json("GET", `/verify-file/${encodeURIComponent(fileId)}`, query);
+  }
+}
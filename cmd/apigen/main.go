@@ -0,0 +1,594 @@
+// Command apigen generates typed API clients, in Go and TypeScript, from
+// the OpenAPI documents the services serve at /openapi.json:
+//
+//	go run ./cmd/apigen -spec api/naming.openapi.json -name Naming \
+//	    -go clients/go/namingclient/client.go -ts clients/ts/naming.ts
+//
+// Run "make clients" rather than calling it by hand; it refreshes the
+// documents in api/ first. Only what the services' specs use is supported:
+// JSON bodies described by component schemas, multipart bodies, string
+// path and query parameters, and non-JSON responses, which are handed back
+// as a stream.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+type spec struct {
+	Info struct {
+		Title string `json:"title"`
+	} `json:"info"`
+	Paths      map[string]map[string]*operation `json:"paths"`
+	Components struct {
+		Schemas map[string]*schema `json:"schemas"`
+	} `json:"components"`
+}
+
+type operation struct {
+	OperationID string `json:"operationId"`
+	Summary     string `json:"summary"`
+	Parameters  []struct {
+		Name string `json:"name"`
+		In   string `json:"in"`
+	} `json:"parameters"`
+	RequestBody *struct {
+		Content map[string]struct {
+			Schema *schema `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+	Responses map[string]struct {
+		Content map[string]struct {
+			Schema *schema `json:"schema"`
+		} `json:"content"`
+	} `json:"responses"`
+
+	method, path string
+}
+
+type schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 string             `json:"type"`
+	Format               string             `json:"format"`
+	Items                *schema            `json:"items"`
+	Properties           map[string]*schema `json:"properties"`
+	AdditionalProperties *schema            `json:"additionalProperties"`
+}
+
+func main() {
+	specFile := flag.String("spec", "", "OpenAPI document to read")
+	name := flag.String("name", "", "API name, e.g. Naming; the TypeScript class is <name>Client")
+	goOut := flag.String("go", "", "Go client to write; the package is named after its directory")
+	tsOut := flag.String("ts", "", "TypeScript client to write")
+	flag.Parse()
+	if *specFile == "" || *name == "" || (*goOut == "" && *tsOut == "") {
+		flag.Usage()
+		os.Exit(2)
+	}
+	b, err := os.ReadFile(*specFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var s spec
+	if err := json.Unmarshal(b, &s); err != nil {
+		log.Fatalf("%s: %v", *specFile, err)
+	}
+	ops := s.operations()
+	header := fmt.Sprintf("Code generated by cmd/apigen from %s. DO NOT EDIT.", filepath.ToSlash(*specFile))
+
+	if *goOut != "" {
+		src := s.goClient(header, filepath.Base(filepath.Dir(*goOut)), ops)
+		formatted, err := format.Source(src)
+		if err != nil {
+			log.Fatalf("generated Go does not parse: %v\n%s", err, src)
+		}
+		write(*goOut, formatted)
+	}
+	if *tsOut != "" {
+		write(*tsOut, s.tsClient(header, *name, ops))
+	}
+}
+
+func write(path string, b []byte) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// operations lists every operation, sorted by operationId so the output
+// is stable.
+func (s *spec) operations() []*operation {
+	var ops []*operation
+	for path, item := range s.Paths {
+		for method, op := range item {
+			op.method, op.path = strings.ToUpper(method), path
+			ops = append(ops, op)
+		}
+	}
+	slices.SortFunc(ops, func(a, b *operation) int { return strings.Compare(a.OperationID, b.OperationID) })
+	return ops
+}
+
+func (op *operation) params(in string) []string {
+	var out []string
+	for _, p := range op.Parameters {
+		if p.In == in {
+			out = append(out, p.Name)
+		}
+	}
+	return out
+}
+
+// body returns the request body's content type and schema, if any.
+func (op *operation) body() (string, *schema) {
+	if op.RequestBody == nil {
+		return "", nil
+	}
+	for ct, c := range op.RequestBody.Content {
+		return ct, c.Schema
+	}
+	return "", nil
+}
+
+// result returns the success response's content type and schema.
+func (op *operation) result() (string, *schema) {
+	for _, code := range []string{"200", "201", "202", "204"} {
+		if r, ok := op.Responses[code]; ok {
+			for ct, c := range r.Content {
+				return ct, c.Schema
+			}
+			return "", nil
+		}
+	}
+	return "", nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// errorSchema is the component both services publish their error envelope
+// under; the clients' Error and ApiError decode it, so no type is generated.
+const errorSchema = "Error"
+
+func refName(ref string) string { return strings.TrimPrefix(ref, "#/components/schemas/") }
+
+/* ==================== GO ==================== */
+
+// initialisms are written in capitals in Go names, as golint wants.
+var initialisms = map[string]bool{"id": true, "ids": true, "url": true, "acl": true, "api": true, "http": true, "json": true}
+
+// goName turns a JSON or operation name such as fileId into FileID.
+func goName(s string) string {
+	var words []string
+	start := 0
+	for i := 1; i < len(s); i++ {
+		if unicode.IsUpper(rune(s[i])) && !unicode.IsUpper(rune(s[i-1])) {
+			words = append(words, s[start:i])
+			start = i
+		}
+	}
+	words = append(words, s[start:])
+	var b strings.Builder
+	for _, w := range words {
+		switch lw := strings.ToLower(w); {
+		case initialisms[lw] && lw == "ids":
+			b.WriteString("IDs")
+		case initialisms[lw]:
+			b.WriteString(strings.ToUpper(w))
+		default:
+			b.WriteString(strings.ToUpper(w[:1]) + w[1:])
+		}
+	}
+	return b.String()
+}
+
+func goType(s *schema) string {
+	if s == nil {
+		return "any"
+	}
+	if s.Ref != "" {
+		return goName(refName(s.Ref))
+	}
+	switch s.Type {
+	case "string":
+		if s.Format == "date-time" {
+			return "time.Time"
+		}
+		if s.Format == "byte" {
+			return "[]byte"
+		}
+		return "string"
+	case "integer":
+		if s.Format == "int64" {
+			return "int64"
+		}
+		return "int"
+	case "number":
+		return "float64"
+	case "boolean":
+		return "bool"
+	case "array":
+		return "[]" + goType(s.Items)
+	case "object":
+		switch {
+		case s.AdditionalProperties != nil:
+			return "map[string]" + goType(s.AdditionalProperties)
+		case s.Properties != nil:
+			return "struct {\n" + goFields(s) + "}"
+		}
+		return "map[string]any"
+	}
+	return "any"
+}
+
+func goFields(s *schema) string {
+	var b strings.Builder
+	for _, p := range sortedKeys(s.Properties) {
+		fmt.Fprintf(&b, "\t%s %s `json:\"%s,omitempty\"`\n", goName(p), goType(s.Properties[p]), p)
+	}
+	return b.String()
+}
+
+func (s *spec) goClient(header, pkg string, ops []*operation) []byte {
+	var b bytes.Buffer
+	p := func(format string, args ...any) { fmt.Fprintf(&b, format, args...) }
+	p(`// Client calls the %s. The zero value is not usable; set BaseURL.
+type Client struct {
+	BaseURL string
+	HTTP    *http.Client // nil = http.DefaultClient
+	// Header is sent with every request, e.g. Authorization or a session
+	// Cookie.
+	Header http.Header
+}
+
+// New returns a client for the service at baseURL.
+func New(baseURL string) *Client { return &Client{BaseURL: strings.TrimRight(baseURL, "/")} }
+
+// Error is a response with a non-2xx status. Code, Message and RequestID
+// come from the service's error envelope; Body is the raw response.
+type Error struct {
+	Status    int    `+"`json:\"-\"`"+`
+	Code      string `+"`json:\"code\"`"+`
+	Message   string `+"`json:\"message\"`"+`
+	Detail    any    `+"`json:\"detail\"`"+`
+	RequestID string `+"`json:\"requestId\"`"+`
+	Body      string `+"`json:\"-\"`"+`
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("%%d %%s: %%s", e.Status, http.StatusText(e.Status), e.Body)
+	}
+	return fmt.Sprintf("%%d %%s: %%s", e.Status, e.Code, e.Message)
+}
+
+// do sends a request and returns the response if it is a success.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body io.Reader, contentType string) (*http.Response, error) {
+	u := c.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.Header {
+		req.Header[k] = v
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	hc := c.HTTP
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		e := &Error{Status: resp.StatusCode, Body: strings.TrimSpace(string(b))}
+		_ = json.Unmarshal(b, e)
+		return nil, e
+	}
+	return resp, nil
+}
+
+// call sends in as JSON, if it is not nil, and decodes the answer into out.
+func (c *Client) call(ctx context.Context, method, path string, query url.Values, in, out any) error {
+	var body io.Reader
+	contentType := ""
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body, contentType = bytes.NewReader(b), "application/json"
+	}
+	resp, err := c.do(ctx, method, path, query, body, contentType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+`, s.Info.Title)
+
+	for _, name := range sortedKeys(s.Components.Schemas) {
+		if name == errorSchema {
+			continue
+		}
+		sc := s.Components.Schemas[name]
+		p("type %s %s\n\n", goName(name), goType(sc))
+	}
+
+	for _, op := range ops {
+		method := goName(op.OperationID)
+		pathArgs, query := op.params("path"), op.params("query")
+		ct, in := op.body()
+		rct, out := op.result()
+
+		var args []string
+		args = append(args, "ctx context.Context")
+		for _, a := range pathArgs {
+			args = append(args, a+" string")
+		}
+		if len(query) > 0 {
+			p("// %sParams are the optional query parameters of %s.\ntype %sParams struct {\n", method, method, method)
+			for _, q := range query {
+				p("\t%s string\n", goName(q))
+			}
+			p("}\n\n")
+			args = append(args, "params "+method+"Params")
+		}
+		switch {
+		case ct == "application/json":
+			args = append(args, "body "+goType(in))
+		case ct != "":
+			args = append(args, "body io.Reader", "contentType string")
+		}
+
+		result := goType(out)
+		raw := rct != "" && rct != "application/json"
+		if raw {
+			result = "io.ReadCloser"
+		} else if out != nil && out.Type == "object" && out.Properties == nil && out.AdditionalProperties == nil {
+			result = "map[string]any"
+		}
+
+		path := op.path
+		for _, a := range pathArgs {
+			path = strings.Replace(path, "{"+a+"}", `"+url.PathEscape(`+a+`)+"`, 1)
+		}
+		path = strings.TrimSuffix(`"`+path+`"`, `+""`)
+
+		p("// %s calls %s %s.\n", method, op.method, op.path)
+		if op.Summary != "" {
+			p("//\n// %s.\n", op.Summary)
+		}
+		if raw {
+			p("// The caller must close the returned stream.\n")
+		}
+		p("func (c *Client) %s(%s) (%s, error) {\n", method, strings.Join(args, ", "), result)
+		if len(query) > 0 {
+			p("\tquery := url.Values{}\n")
+			for _, q := range query {
+				p("\tif params.%s != \"\" {\n\t\tquery.Set(%q, params.%s)\n\t}\n", goName(q), q, goName(q))
+			}
+		} else {
+			p("\tvar query url.Values\n")
+		}
+		switch {
+		case raw:
+			bodyArg, ctArg := "nil", `""`
+			switch {
+			case ct == "application/json":
+				p("\tb, err := json.Marshal(body)\n\tif err != nil {\n\t\treturn nil, err\n\t}\n")
+				bodyArg, ctArg = "bytes.NewReader(b)", `"application/json"`
+			case ct != "":
+				bodyArg, ctArg = "body", "contentType"
+			}
+			p("\tresp, err := c.do(ctx, %q, %s, query, %s, %s)\n", op.method, path, bodyArg, ctArg)
+			p("\tif err != nil {\n\t\treturn nil, err\n\t}\n\treturn resp.Body, nil\n}\n\n")
+		case ct != "" && ct != "application/json":
+			p("\tvar out %s\n", result)
+			p("\tresp, err := c.do(ctx, %q, %s, query, body, contentType)\n", op.method, path)
+			p("\tif err != nil {\n\t\treturn out, err\n\t}\n\tdefer resp.Body.Close()\n")
+			p("\terr = json.NewDecoder(resp.Body).Decode(&out)\n\treturn out, err\n}\n\n")
+		default:
+			bodyArg := "nil"
+			if ct != "" {
+				bodyArg = "body"
+			}
+			p("\tvar out %s\n", result)
+			p("\terr := c.call(ctx, %q, %s, query, %s, &out)\n\treturn out, err\n}\n\n", op.method, path, bodyArg)
+		}
+	}
+	var head bytes.Buffer
+	fmt.Fprintf(&head, "// %s\n\n", header)
+	fmt.Fprintf(&head, "// Package %s is a client for the %s API. Zero-valued fields are left\n", pkg, s.Info.Title)
+	fmt.Fprintf(&head, "// out of request bodies.\npackage %s\n\nimport (\n", pkg)
+	for _, imp := range []string{"bytes", "context", "encoding/json", "fmt", "io", "net/http", "net/url", "strings", "time"} {
+		if imp != "time" || bytes.Contains(b.Bytes(), []byte("time.Time")) {
+			fmt.Fprintf(&head, "\t%q\n", imp)
+		}
+	}
+	head.WriteString(")\n\n")
+	return append(head.Bytes(), b.Bytes()...)
+}
+
+/* ==================== TYPESCRIPT ==================== */
+
+func tsType(s *schema) string {
+	if s == nil {
+		return "unknown"
+	}
+	if s.Ref != "" {
+		return refName(s.Ref)
+	}
+	switch s.Type {
+	case "string":
+		return "string"
+	case "integer", "number":
+		return "number"
+	case "boolean":
+		return "boolean"
+	case "array":
+		t := tsType(s.Items)
+		if strings.ContainsAny(t, " |{") {
+			t = "(" + t + ")"
+		}
+		return t + "[]"
+	case "object":
+		switch {
+		case s.AdditionalProperties != nil:
+			return "Record<string, " + tsType(s.AdditionalProperties) + ">"
+		case s.Properties != nil:
+			return "{ " + tsFields(s, "; ") + " }"
+		}
+		return "Record<string, unknown>"
+	}
+	return "unknown"
+}
+
+func tsFields(s *schema, sep string) string {
+	var fields []string
+	for _, p := range sortedKeys(s.Properties) {
+		fields = append(fields, fmt.Sprintf("%s?: %s", p, tsType(s.Properties[p])))
+	}
+	return strings.Join(fields, sep)
+}
+
+func (s *spec) tsClient(header, name string, ops []*operation) []byte {
+	var b bytes.Buffer
+	p := func(format string, args ...any) { fmt.Fprintf(&b, format, args...) }
+	p("// %s\n//\n// A client for the %s API, for browsers and Node 18+ (it uses fetch).\n\n", header, s.Info.Title)
+	for _, n := range sortedKeys(s.Components.Schemas) {
+		if n == errorSchema {
+			continue
+		}
+		sc := s.Components.Schemas[n]
+		if sc.Type == "object" && sc.Properties != nil {
+			p("export interface %s {\n  %s;\n}\n\n", n, tsFields(sc, ";\n  "))
+		} else {
+			p("export type %s = %s;\n\n", n, tsType(sc))
+		}
+	}
+	p(`/** A response with a non-2xx status; code, message and requestId come from the error envelope. */
+export class ApiError extends Error {
+  code = "";
+  detail?: unknown;
+  requestId = "";
+
+  constructor(public status: number, public body: string) {
+    super(status + ": " + body);
+    try {
+      const e = JSON.parse(body);
+      this.code = e.code ?? "";
+      this.message = status + " " + this.code + ": " + (e.message ?? "");
+      this.detail = e.detail;
+      this.requestId = e.requestId ?? "";
+    } catch {
+      // not an envelope; message stays the raw body
+    }
+  }
+}
+
+export class %sClient {
+  /**
+   * @param baseUrl where the service is, "" for the page's own origin
+   * @param init merged into every fetch, e.g. headers or credentials
+   */
+  constructor(public baseUrl = "", public init: RequestInit = {}) {}
+
+  private async send(method: string, path: string, query: Record<string, string | undefined> = {}, body?: BodyInit, contentType?: string): Promise<Response> {
+    const q = new URLSearchParams();
+    for (const [k, v] of Object.entries(query)) if (v !== undefined && v !== "") q.set(k, v);
+    const headers = new Headers(this.init.headers);
+    if (contentType) headers.set("Content-Type", contentType);
+    const resp = await fetch(this.baseUrl + path + (q.size ? "?" + q : ""), { ...this.init, method, headers, body });
+    if (!resp.ok) throw new ApiError(resp.status, (await resp.text()).trim());
+    return resp;
+  }
+
+  private async json<T>(method: string, path: string, query?: Record<string, string | undefined>, body?: unknown): Promise<T> {
+    const resp = await this.send(method, path, query, body === undefined ? undefined : JSON.stringify(body), body === undefined ? undefined : "application/json");
+    return resp.json() as Promise<T>;
+  }
+`, name)
+	for _, op := range ops {
+		pathArgs, query := op.params("path"), op.params("query")
+		ct, in := op.body()
+		rct, out := op.result()
+		var args []string
+		for _, a := range pathArgs {
+			args = append(args, a+": string")
+		}
+		switch {
+		case ct == "application/json":
+			args = append(args, "body: "+tsType(in))
+		case ct != "":
+			args = append(args, "body: FormData")
+		}
+		queryArg := "{}"
+		if len(query) > 0 {
+			var qs []string
+			for _, q := range query {
+				qs = append(qs, q+"?: string")
+			}
+			args = append(args, "query: { "+strings.Join(qs, "; ")+" } = {}")
+			queryArg = "query"
+		}
+		path := `"` + op.path + `"`
+		if len(pathArgs) > 0 {
+			path = "`" + op.path + "`"
+			for _, a := range pathArgs {
+				path = strings.Replace(path, "{"+a+"}", "${encodeURIComponent("+a+")}", 1)
+			}
+		}
+		p("\n  /** %s %s: %s. */\n", op.method, op.path, op.Summary)
+		switch {
+		case rct != "" && rct != "application/json":
+			bodyArg := ""
+			switch {
+			case ct == "application/json":
+				bodyArg = `, JSON.stringify(body), "application/json"`
+			case ct != "":
+				bodyArg = ", body"
+			}
+			p("  %s(%s): Promise<Response> {\n    return this.send(%q, %s, %s%s);\n  }\n", op.OperationID, strings.Join(args, ", "), op.method, path, queryArg, bodyArg)
+		case ct != "" && ct != "application/json":
+			p("  async %s(%s): Promise<%s> {\n    return (await this.send(%q, %s, %s, body)).json();\n  }\n", op.OperationID, strings.Join(args, ", "), tsType(out), op.method, path, queryArg)
+		default:
+			bodyArg := ""
+			if ct != "" {
+				bodyArg = ", body"
+			}
+			p("  %s(%s): Promise<%s> {\n    return this.json(%q, %s, %s%s);\n  }\n", op.OperationID, strings.Join(args, ", "), tsType(out), op.method, path, queryArg, bodyArg)
+		}
+	}
+	p("}\n")
+	return b.Bytes()
+}
@@ -0,0 +1,558 @@
+// Command loadgen drives concurrent uploads and downloads through the UI
+// gateway and reports latency percentiles and throughput per operation.
+//
+//	go run ./cmd/loadgen -gateway http://localhost:8080 -duration 1m \
+//	    -concurrency 16 -sizes 4KiB,256KiB,4MiB -uploads 0.2 \
+//	    -fault 20s:stop:node-b -fault 40s:start:node-b
+//
+// Downloads pick from the files seeded at start plus everything uploaded
+// during the run, resolve a replica through /api/lookup like the web UI does
+// and check the bytes against the SHA-256 computed at upload. Faults are
+// injected on a schedule, so the report shows how the cluster degrades and
+// recovers while a node is gone:
+//
+//	stop:NODE   POST /api/system/stop-node (gateway needs ADMIN_TOKEN)
+//	start:NODE  POST /api/system/start-node (only nodes the gateway started)
+//	exec:CMD    run CMD with sh -c, e.g. "exec:kill -STOP 4242" for a hung node
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	mrand "math/rand/v2"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* ---------------- CONFIG ---------------- */
+
+type config struct {
+	gateway     string
+	duration    time.Duration
+	concurrency int
+	sizes       []int64
+	uploads     float64 // share of operations that are uploads
+	seed        int     // files uploaded before the clock starts
+	tenant      string
+	apiKey      string
+	timeout     time.Duration
+	every       time.Duration // progress line interval; 0 = quiet
+	cleanup     bool
+	jsonOut     bool
+	faults      []fault
+}
+
+// fault is one scheduled disturbance, e.g. "20s:stop:node-b".
+type fault struct {
+	at     time.Duration
+	action string // stop, start or exec
+	arg    string
+}
+
+type faultList []fault
+
+func (f *faultList) String() string { return fmt.Sprint(len(*f)) }
+
+func (f *faultList) Set(v string) error {
+	parts := strings.SplitN(v, ":", 3)
+	if len(parts) != 3 || parts[2] == "" {
+		return fmt.Errorf("want AT:ACTION:ARG, got %q", v)
+	}
+	at, err := time.ParseDuration(parts[0])
+	if err != nil || at < 0 {
+		return fmt.Errorf("bad offset %q", parts[0])
+	}
+	switch parts[1] {
+	case "stop", "start", "exec":
+	default:
+		return fmt.Errorf("action must be stop, start or exec, got %q", parts[1])
+	}
+	*f = append(*f, fault{at: at, action: parts[1], arg: parts[2]})
+	return nil
+}
+
+// parseSize reads 512, 4KiB, 1MiB, 2GiB (also KB/MB/GB, as powers of two).
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	units := []struct {
+		suffix string
+		mult   int64
+	}{{"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+	mult := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s, mult = strings.TrimSuffix(s, u.suffix), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return n * mult, nil
+}
+
+func parseFlags() config {
+	var c config
+	var sizes string
+	var faults faultList
+	flag.StringVar(&c.gateway, "gateway", "http://localhost:8080", "UI gateway base URL")
+	flag.DurationVar(&c.duration, "duration", 30*time.Second, "how long to generate load")
+	flag.IntVar(&c.concurrency, "concurrency", 8, "concurrent workers")
+	flag.StringVar(&sizes, "sizes", "4KiB,256KiB,1MiB", "comma-separated file sizes, picked at random per upload")
+	flag.Float64Var(&c.uploads, "uploads", 0.2, "share of operations that are uploads (0..1)")
+	flag.IntVar(&c.seed, "seed", 20, "files uploaded before the run so downloads have targets")
+	flag.StringVar(&c.tenant, "tenant", "", "X-Tenant header, to exercise quotas")
+	flag.StringVar(&c.apiKey, "api-key", "", "X-API-Key header, to exercise per-key rate limits")
+	flag.DurationVar(&c.timeout, "timeout", 30*time.Second, "per-request timeout")
+	flag.DurationVar(&c.every, "report-every", 5*time.Second, "progress interval (0 = only the final report)")
+	flag.BoolVar(&c.cleanup, "cleanup", true, "delete the files this run uploaded")
+	flag.BoolVar(&c.jsonOut, "json", false, "print the final report as JSON")
+	flag.Var(&faults, "fault", "AT:ACTION:ARG fault to inject, repeatable (stop:NODE, start:NODE, exec:CMD)")
+	flag.Parse()
+
+	for _, s := range strings.Split(sizes, ",") {
+		n, err := parseSize(s)
+		if err != nil {
+			fatalf("-sizes: %v", err)
+		}
+		c.sizes = append(c.sizes, n)
+	}
+	if c.concurrency < 1 {
+		fatalf("-concurrency must be at least 1")
+	}
+	if c.uploads < 0 || c.uploads > 1 {
+		fatalf("-uploads must be between 0 and 1")
+	}
+	if c.uploads < 1 && c.seed < 1 {
+		fatalf("-seed must be at least 1 when the run includes downloads")
+	}
+	c.gateway = strings.TrimRight(c.gateway, "/")
+	c.faults = faults
+	sort.Slice(c.faults, func(i, j int) bool { return c.faults[i].at < c.faults[j].at })
+	return c
+}
+
+func fatalf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "loadgen: "+format+"\n", args...)
+	os.Exit(2)
+}
+
+/* ---------------- STATS ---------------- */
+
+// opStats collects every sample of one operation; a run keeps at most a
+// few hundred thousand, so sorting them at the end is cheap enough.
+type opStats struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	bytes     int64
+	errors    map[string]int
+}
+
+func newOpStats() *opStats { return &opStats{errors: map[string]int{}} }
+
+func (s *opStats) ok(d time.Duration, n int64) {
+	s.mu.Lock()
+	s.latencies = append(s.latencies, d)
+	s.bytes += n
+	s.mu.Unlock()
+}
+
+func (s *opStats) fail(reason string) {
+	s.mu.Lock()
+	s.errors[reason]++
+	s.mu.Unlock()
+}
+
+// opReport is the summary of one operation.
+type opReport struct {
+	OK         int            `json:"ok"`
+	Failed     int            `json:"failed"`
+	OpsPerSec  float64        `json:"opsPerSec"`
+	MiBPerSec  float64        `json:"mibPerSec"`
+	P50Ms      float64        `json:"p50Ms"`
+	P95Ms      float64        `json:"p95Ms"`
+	P99Ms      float64        `json:"p99Ms"`
+	MaxMs      float64        `json:"maxMs"`
+	ErrorsSeen map[string]int `json:"errors,omitempty"`
+}
+
+func (s *opStats) report(elapsed time.Duration) opReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lat := append([]time.Duration(nil), s.latencies...)
+	sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+	r := opReport{OK: len(lat), ErrorsSeen: map[string]int{}}
+	for reason, n := range s.errors {
+		r.Failed += n
+		r.ErrorsSeen[reason] = n
+	}
+	secs := elapsed.Seconds()
+	if secs > 0 {
+		r.OpsPerSec = float64(len(lat)) / secs
+		r.MiBPerSec = float64(s.bytes) / (1 << 20) / secs
+	}
+	if len(lat) > 0 {
+		r.P50Ms, r.P95Ms, r.P99Ms = ms(percentile(lat, 50)), ms(percentile(lat, 95)), ms(percentile(lat, 99))
+		r.MaxMs = ms(lat[len(lat)-1])
+	}
+	return r
+}
+
+// percentile uses the nearest-rank method on sorted samples.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(math.Ceil(float64(len(sorted))*p/100)) - 1
+	return sorted[min(max(i, 0), len(sorted)-1)]
+}
+
+func ms(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+
+/* ---------------- CLIENT ---------------- */
+
+// stored is a file this run uploaded, with what a download must return.
+type stored struct {
+	id       string
+	checksum string
+	size     int64
+}
+
+type loadgen struct {
+	cfg    config
+	client *http.Client
+	up     *opStats
+	down   *opStats
+
+	mu    sync.RWMutex
+	files []stored
+
+	inflight atomic.Int64
+}
+
+func (lg *loadgen) header(req *http.Request) {
+	if lg.cfg.tenant != "" {
+		req.Header.Set("X-Tenant", lg.cfg.tenant)
+	}
+	if lg.cfg.apiKey != "" {
+		req.Header.Set("X-API-Key", lg.cfg.apiKey)
+	}
+}
+
+// upload stores size random bytes through /api/upload.
+func (lg *loadgen) upload(size int64) (stored, error) {
+	data := make([]byte, size)
+	rand.Read(data)
+	sum := sha256.Sum256(data)
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	name := fmt.Sprintf("loadgen-%d-%x.bin", size, sum[:4])
+	mw.WriteField("filename", name)
+	fw, _ := mw.CreateFormFile("file", name)
+	fw.Write(data)
+	mw.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, lg.cfg.gateway+"/api/upload", body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	lg.header(req)
+	resp, err := lg.client.Do(req)
+	if err != nil {
+		return stored{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return stored{}, statusErr(resp.StatusCode)
+	}
+	var out struct {
+		FileID string `json:"fileId"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil || out.FileID == "" {
+		return stored{}, errors.New("bad upload response")
+	}
+	return stored{id: out.FileID, checksum: "sha256:" + hex.EncodeToString(sum[:]), size: size}, nil
+}
+
+// download fetches f the way the web UI does: lookup, then the gateway
+// proxy on the first replica. It returns the bytes read.
+func (lg *loadgen) download(f stored) (int64, error) {
+	req, _ := http.NewRequest(http.MethodGet, lg.cfg.gateway+"/api/lookup?fileId="+url.QueryEscape(f.id), nil)
+	lg.header(req)
+	resp, err := lg.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	var reps []struct {
+		URL string `json:"url"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&reps)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, statusErr(resp.StatusCode)
+	}
+	if err != nil || len(reps) == 0 {
+		return 0, errors.New("no replicas")
+	}
+
+	q := url.Values{"fileId": {f.id}, "nodeUrl": {reps[0].URL}}
+	req, _ = http.NewRequest(http.MethodGet, lg.cfg.gateway+"/api/download?"+q.Encode(), nil)
+	lg.header(req)
+	resp, err = lg.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return 0, statusErr(resp.StatusCode)
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, resp.Body)
+	if err != nil {
+		return n, err
+	}
+	if "sha256:"+hex.EncodeToString(h.Sum(nil)) != f.checksum {
+		return n, errors.New("checksum mismatch")
+	}
+	return n, nil
+}
+
+func (lg *loadgen) delete(id string) error {
+	req, _ := http.NewRequest(http.MethodDelete, lg.cfg.gateway+"/api/files?fileId="+url.QueryEscape(id), nil)
+	lg.header(req)
+	resp, err := lg.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return statusErr(resp.StatusCode)
+	}
+	return nil
+}
+
+type statusErr int
+
+func (e statusErr) Error() string { return fmt.Sprintf("status %d", int(e)) }
+
+// reason buckets an error for the report: HTTP statuses and timeouts stay
+// distinct, anything else is shortened to its first clause.
+func reason(err error) string {
+	var se statusErr
+	if errors.As(err, &se) {
+		return se.Error()
+	}
+	var ne interface{ Timeout() bool }
+	if errors.As(err, &ne) && ne.Timeout() {
+		return "timeout"
+	}
+	msg := err.Error()
+	if i := strings.LastIndex(msg, ": "); i >= 0 {
+		msg = msg[i+2:]
+	}
+	return msg
+}
+
+/* ---------------- RUN ---------------- */
+
+func (lg *loadgen) pick() (stored, bool) {
+	lg.mu.RLock()
+	defer lg.mu.RUnlock()
+	if len(lg.files) == 0 {
+		return stored{}, false
+	}
+	return lg.files[mrand.IntN(len(lg.files))], true
+}
+
+func (lg *loadgen) add(f stored) {
+	lg.mu.Lock()
+	lg.files = append(lg.files, f)
+	lg.mu.Unlock()
+}
+
+func (lg *loadgen) worker(deadline time.Time) {
+	for time.Now().Before(deadline) {
+		lg.inflight.Add(1)
+		if f, ok := lg.pick(); ok && mrand.Float64() >= lg.cfg.uploads {
+			start := time.Now()
+			if n, err := lg.download(f); err != nil {
+				lg.down.fail(reason(err))
+			} else {
+				lg.down.ok(time.Since(start), n)
+			}
+		} else {
+			size := lg.cfg.sizes[mrand.IntN(len(lg.cfg.sizes))]
+			start := time.Now()
+			if f, err := lg.upload(size); err != nil {
+				lg.up.fail(reason(err))
+			} else {
+				lg.up.ok(time.Since(start), size)
+				lg.add(f)
+			}
+		}
+		lg.inflight.Add(-1)
+	}
+}
+
+// inject runs the fault schedule relative to start until stop closes.
+func (lg *loadgen) inject(start time.Time, stop <-chan struct{}) {
+	for _, f := range lg.cfg.faults {
+		select {
+		case <-time.After(time.Until(start.Add(f.at))):
+		case <-stop:
+			return
+		}
+		var err error
+		switch f.action {
+		case "stop", "start":
+			b, _ := json.Marshal(map[string]string{"nodeId": f.arg})
+			var resp *http.Response
+			resp, err = lg.client.Post(lg.cfg.gateway+"/api/system/"+f.action+"-node", "application/json", bytes.NewReader(b))
+			if err == nil {
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode/100 != 2 {
+					err = statusErr(resp.StatusCode)
+				}
+			}
+		case "exec":
+			err = exec.Command("sh", "-c", f.arg).Run()
+		}
+		status := "ok"
+		if err != nil {
+			status = err.Error()
+		}
+		fmt.Fprintf(os.Stderr, "[%6s] fault %s:%s: %s\n", f.at, f.action, f.arg, status)
+	}
+}
+
+func (lg *loadgen) progress(start time.Time, stop <-chan struct{}) {
+	t := time.NewTicker(lg.cfg.every)
+	defer t.Stop()
+	var lastUp, lastDown int
+	for {
+		select {
+		case <-t.C:
+		case <-stop:
+			return
+		}
+		el := time.Since(start).Round(time.Second)
+		u, d := lg.up.report(el), lg.down.report(el)
+		secs := lg.cfg.every.Seconds()
+		fmt.Fprintf(os.Stderr, "[%6s] up %.1f/s (%d failed)  down %.1f/s (%d failed)  p99 up %.0fms down %.0fms  in flight %d\n",
+			el, float64(u.OK-lastUp)/secs, u.Failed, float64(d.OK-lastDown)/secs, d.Failed, u.P99Ms, d.P99Ms, lg.inflight.Load())
+		lastUp, lastDown = u.OK, d.OK
+	}
+}
+
+func main() {
+	cfg := parseFlags()
+	lg := &loadgen{
+		cfg: cfg,
+		client: &http.Client{Timeout: cfg.timeout, Transport: &http.Transport{
+			MaxIdleConnsPerHost: cfg.concurrency * 2,
+			IdleConnTimeout:     90 * time.Second,
+		}},
+		up:   newOpStats(),
+		down: newOpStats(),
+	}
+
+	if cfg.uploads < 1 {
+		fmt.Fprintf(os.Stderr, "seeding %d file(s) through %s\n", cfg.seed, cfg.gateway)
+		for i := 0; i < cfg.seed; i++ {
+			f, err := lg.upload(cfg.sizes[i%len(cfg.sizes)])
+			if err != nil {
+				fatalf("seed upload failed: %v", err)
+			}
+			lg.add(f)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "running %s with %d worker(s), %.0f%% uploads\n", cfg.duration, cfg.concurrency, cfg.uploads*100)
+	start := time.Now()
+	deadline := start.Add(cfg.duration)
+	stop := make(chan struct{})
+	go lg.inject(start, stop)
+	if cfg.every > 0 {
+		go lg.progress(start, stop)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lg.worker(deadline)
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(stop)
+
+	out := map[string]any{
+		"gateway":     cfg.gateway,
+		"durationSec": elapsed.Seconds(),
+		"concurrency": cfg.concurrency,
+		"upload":      lg.up.report(elapsed),
+		"download":    lg.down.report(elapsed),
+	}
+	if cfg.jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(out)
+	} else {
+		printReport(elapsed, out["upload"].(opReport), out["download"].(opReport))
+	}
+
+	if cfg.cleanup {
+		lg.mu.RLock()
+		files := lg.files
+		lg.mu.RUnlock()
+		failed := 0
+		for _, f := range files {
+			if lg.delete(f.id) != nil {
+				failed++
+			}
+		}
+		fmt.Fprintf(os.Stderr, "cleanup: deleted %d file(s), %d failed\n", len(files)-failed, failed)
+	}
+}
+
+func printReport(elapsed time.Duration, up, down opReport) {
+	rows := []struct {
+		name string
+		r    opReport
+	}{{"upload", up}, {"download", down}}
+	fmt.Printf("\n%-9s %8s %7s %9s %9s %9s %9s %9s %9s\n", "op", "ok", "failed", "ops/s", "MiB/s", "p50 ms", "p95 ms", "p99 ms", "max ms")
+	for _, row := range rows {
+		r := row.r
+		fmt.Printf("%-9s %8d %7d %9.1f %9.2f %9.1f %9.1f %9.1f %9.1f\n",
+			row.name, r.OK, r.Failed, r.OpsPerSec, r.MiBPerSec, r.P50Ms, r.P95Ms, r.P99Ms, r.MaxMs)
+	}
+	fmt.Printf("elapsed %s\n", elapsed.Round(time.Millisecond))
+	for _, row := range rows {
+		reasons := make([]string, 0, len(row.r.ErrorsSeen))
+		for k := range row.r.ErrorsSeen {
+			reasons = append(reasons, k)
+		}
+		sort.Strings(reasons)
+		for _, k := range reasons {
+			fmt.Printf("  %s error %q x%d\n", row.name, k, row.r.ErrorsSeen[k])
+		}
+	}
+}
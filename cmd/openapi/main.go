@@ -0,0 +1,18 @@
+// Command openapi prints the naming service's OpenAPI document, the same
+// one it serves at /openapi.json, without starting the service:
+//
+//	go run ./cmd/openapi > api/naming.openapi.json
+//
+// "make clients" runs it and then generates the API clients from the
+// result; see cmd/apigen.
+package main
+
+import (
+	"os"
+
+	"ProjectAkhir/internal/naming"
+)
+
+func main() {
+	_, _ = os.Stdout.Write(naming.OpenAPI())
+}
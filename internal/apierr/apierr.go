@@ -0,0 +1,152 @@
+// Package apierr is the error envelope every service answers a failed
+// request with:
+//
+//	{"code":"INSUFFICIENT_NODES","message":"insufficient healthy nodes","detail":{...},"requestId":"..."}
+//
+// Code is one of the constants below and is what clients branch on; Message
+// is for people and may change. The gateway, a separate module, keeps a copy
+// of the envelope in its ERRORS section, next to the codes it raises itself
+// (LOGIN_REQUIRED, PERMISSION_DENIED, ...).
+package apierr
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Error is the body of every non-2xx JSON response.
+type Error struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Detail    any    `json:"detail,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// Error codes. Keep the list in API_DOCS.md in step.
+const (
+	BadRequest       = "BAD_REQUEST"
+	InvalidJSON      = "INVALID_JSON"
+	MissingParameter = "MISSING_PARAMETER"
+	MethodNotAllowed = "METHOD_NOT_ALLOWED"
+
+	NotFound          = "NOT_FOUND"
+	FileNotFound      = "FILE_NOT_FOUND"
+	NodeNotFound      = "NODE_NOT_FOUND"
+	ShareNotFound     = "SHARE_NOT_FOUND"
+	OperationNotFound = "OPERATION_NOT_FOUND"
+	ConflictNotFound  = "CONFLICT_NOT_FOUND"
+	WrongShard        = "WRONG_SHARD" // 421: the fileId is another naming shard's
+
+	Conflict        = "CONFLICT"
+	VersionConflict = "VERSION_CONFLICT"
+	FileNotReady    = "FILE_NOT_READY"
+	FileCorrupt     = "FILE_CORRUPT"
+	FileGone        = "FILE_GONE"
+	ShareExpired    = "SHARE_EXPIRED"
+	ShareExhausted  = "SHARE_EXHAUSTED"
+	ShareRevoked    = "SHARE_REVOKED"
+
+	InvalidAdminToken = "INVALID_ADMIN_TOKEN"
+	PasswordRequired  = "PASSWORD_REQUIRED"
+	WrongPassword     = "WRONG_PASSWORD"
+	InvalidTicket     = "INVALID_TICKET"
+	FeatureDisabled   = "FEATURE_DISABLED"
+
+	IdempotencyKeyReused = "IDEMPOTENCY_KEY_REUSED"
+	RequestInProgress    = "REQUEST_IN_PROGRESS"
+
+	QuotaExceeded        = "QUOTA_EXCEEDED"
+	InsufficientNodes    = "INSUFFICIENT_NODES"
+	InsufficientStorage  = "INSUFFICIENT_STORAGE"
+	InsufficientReplicas = "INSUFFICIENT_REPLICAS"
+	PayloadTooLarge      = "PAYLOAD_TOO_LARGE"
+	ChecksumMismatch     = "CHECKSUM_MISMATCH"
+	RateLimited          = "RATE_LIMITED"
+
+	Maintenance   = "MAINTENANCE"
+	Unavailable   = "UNAVAILABLE"
+	UpstreamError = "UPSTREAM_ERROR"
+	Internal      = "INTERNAL"
+)
+
+// RequestIDHeader carries the request ID on requests and responses.
+const RequestIDHeader = "X-Request-Id"
+
+// Write answers with the envelope; the request ID is taken from the
+// response header WithRequestID set.
+func Write(w http.ResponseWriter, status int, code, message string) {
+	WriteDetail(w, status, code, message, nil)
+}
+
+// WriteDetail is Write with a detail value, typically the underlying error
+// text or a small object clients can act on.
+func WriteDetail(w http.ResponseWriter, status int, code, message string, detail any) {
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(Error{Code: code, Message: message, Detail: detail, RequestID: h.Get(RequestIDHeader)})
+}
+
+// WithRequestID gives every request an ID: the caller's X-Request-Id when it
+// is sane, so a client can match our log lines to its own, or a new random
+// one. The ID is echoed in the response header and set on the request for
+// logging.
+func WithRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validID(id) {
+			id = newID()
+			r.Header.Set(RequestIDHeader, id)
+		}
+		w.Header().Set(RequestIDHeader, id)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// newID returns 16 random hex characters.
+func newID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func validID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// methods are the ones NoRoute probes for.
+var methods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions}
+
+// NoRoute is mux's "/" handler, so it sees every request no route matches.
+// A path that some other method would reach is a 405 whose Allow header
+// lists those methods; anything else is a 404.
+func NoRoute(mux *http.ServeMux) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var allowed []string
+		for _, m := range methods {
+			if _, pattern := mux.Handler(&http.Request{Method: m, Host: r.Host, URL: r.URL}); pattern != "" && pattern != "/" {
+				allowed = append(allowed, m)
+			}
+		}
+		if len(allowed) == 0 {
+			Write(w, http.StatusNotFound, NotFound, "no such endpoint: "+r.URL.Path)
+			return
+		}
+		allow := strings.Join(allowed, ", ")
+		w.Header().Set("Allow", allow)
+		WriteDetail(w, http.StatusMethodNotAllowed, MethodNotAllowed, r.Method+" is not allowed on "+r.URL.Path,
+			map[string]string{"allow": allow})
+	}
+}
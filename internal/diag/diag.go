@@ -0,0 +1,117 @@
+// Package diag is the runtime diagnostics a service serves under /debug/
+// when DEBUG_ENDPOINTS is on, behind its admin token:
+//
+//	/debug/pprof/...  the net/http/pprof profiles
+//	/debug/vars       expvar
+//	/debug/status     goroutines, heap, GC and lock waits, plus the
+//	                  service's own gauges
+//
+// The gateway, a separate module, keeps a copy in its DIAGNOSTICS section.
+package diag
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/metrics"
+	"time"
+)
+
+// mutexProfileFraction samples one in this many contended lock events for
+// /debug/pprof/mutex once diagnostics are on.
+const mutexProfileFraction = 100
+
+var started = time.Now()
+
+// Status is the body of GET /debug/status.
+type Status struct {
+	Service    string         `json:"service"`
+	Version    string         `json:"version"`
+	GoVersion  string         `json:"goVersion"`
+	StartedAt  time.Time      `json:"startedAt"`
+	Uptime     string         `json:"uptime"`
+	CPUs       int            `json:"cpus"`
+	GOMAXPROCS int            `json:"gomaxprocs"`
+	Goroutines int            `json:"goroutines"`
+	Heap       Heap           `json:"heap"`
+	GC         GC             `json:"gc"`
+	Locks      Locks          `json:"locks"`
+	Gauges     map[string]any `json:"gauges,omitempty"` // the service's own, e.g. open uploads
+}
+
+type Heap struct {
+	AllocBytes  uint64 `json:"allocBytes"` // live objects
+	SysBytes    uint64 `json:"sysBytes"`   // obtained from the OS
+	Objects     uint64 `json:"objects"`
+	NextGCBytes uint64 `json:"nextGcBytes"`
+}
+
+type GC struct {
+	Cycles      uint32    `json:"cycles"`
+	LastAt      time.Time `json:"lastAt,omitzero"`
+	LastPause   string    `json:"lastPause"`
+	TotalPause  string    `json:"totalPause"`
+	CPUFraction float64   `json:"cpuFraction"` // of CPU time since start
+}
+
+// Locks is how long goroutines have waited for a sync.Mutex or RWMutex
+// since start; /debug/pprof/mutex says where.
+type Locks struct {
+	WaitTotal string `json:"waitTotal"`
+}
+
+// Register adds the /debug/ endpoints to mux, each wrapped in guard, and
+// turns on mutex profiling. gauges, if not nil, is called for every
+// /debug/status.
+func Register(mux *http.ServeMux, guard func(http.HandlerFunc) http.HandlerFunc, service, version string, gauges func() map[string]any) {
+	runtime.SetMutexProfileFraction(mutexProfileFraction)
+	mux.HandleFunc("GET /debug/pprof/", guard(pprof.Index))
+	mux.HandleFunc("GET /debug/pprof/cmdline", guard(pprof.Cmdline))
+	mux.HandleFunc("GET /debug/pprof/profile", guard(pprof.Profile))
+	mux.HandleFunc("GET /debug/pprof/symbol", guard(pprof.Symbol))
+	mux.HandleFunc("POST /debug/pprof/symbol", guard(pprof.Symbol))
+	mux.HandleFunc("GET /debug/pprof/trace", guard(pprof.Trace))
+	mux.HandleFunc("GET /debug/vars", guard(expvar.Handler().ServeHTTP))
+	mux.HandleFunc("GET /debug/status", guard(func(w http.ResponseWriter, r *http.Request) {
+		st := Read(service, version)
+		if gauges != nil {
+			st.Gauges = gauges()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(st)
+	}))
+}
+
+// Read takes a Status of this process, without gauges.
+func Read(service, version string) Status {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	st := Status{
+		Service:    service,
+		Version:    version,
+		GoVersion:  runtime.Version(),
+		StartedAt:  started.UTC(),
+		Uptime:     time.Since(started).Round(time.Second).String(),
+		CPUs:       runtime.NumCPU(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		Goroutines: runtime.NumGoroutine(),
+		Heap:       Heap{AllocBytes: ms.HeapAlloc, SysBytes: ms.HeapSys, Objects: ms.HeapObjects, NextGCBytes: ms.NextGC},
+		GC: GC{
+			Cycles:      ms.NumGC,
+			LastPause:   time.Duration(ms.PauseNs[(ms.NumGC+255)%256]).String(),
+			TotalPause:  time.Duration(ms.PauseTotalNs).String(),
+			CPUFraction: ms.GCCPUFraction,
+		},
+	}
+	if ms.LastGC > 0 {
+		st.GC.LastAt = time.Unix(0, int64(ms.LastGC)).UTC()
+	}
+	sample := []metrics.Sample{{Name: "/sync/mutex/wait/total:seconds"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() == metrics.KindFloat64 {
+		st.Locks.WaitTotal = time.Duration(sample[0].Value.Float64() * float64(time.Second)).String()
+	}
+	return st
+}
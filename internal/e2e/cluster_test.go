@@ -0,0 +1,356 @@
+package e2e
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ProjectAkhir/internal/naming"
+	"ProjectAkhir/internal/storagenode"
+)
+
+// heartbeat is fast so that a killed node is declared DOWN, and a file
+// healed, within a second or two.
+const heartbeat = 100 * time.Millisecond
+
+// adminToken opens the naming service's /admin endpoints.
+const adminToken = "e2e-admin"
+
+// gatewayOrigin is the only origin the test nodes answer browsers from.
+const gatewayOrigin = "https://files.example.test"
+
+// cluster is a naming service and its storage nodes, all in-process.
+type cluster struct {
+	t      *testing.T
+	dir    string
+	naming *naming.Server
+	nsURL  string
+	nodes  map[string]*testNode
+	secret []byte // UPLOAD_TICKET_SECRET; see newTicketCluster
+
+	// compression is what nodes added from here on store blobs with
+	compression storagenode.CompressionPolicy
+}
+
+// testNode is one storage node; port and dir survive a kill so the node
+// can come back as itself.
+type testNode struct {
+	id   string
+	port string
+	dir  string
+	node *storagenode.Node
+	srv  *httptest.Server
+}
+
+// newCluster starts a naming service with heal and health timings scaled
+// down to the test heartbeat. Nodes are added with addNode.
+func newCluster(t *testing.T) *cluster {
+	t.Helper()
+	return newTicketCluster(t, nil)
+}
+
+// newTicketCluster is newCluster with secret as everyone's
+// UPLOAD_TICKET_SECRET, so the nodes take no upload without a ticket.
+func newTicketCluster(t *testing.T, secret []byte) *cluster {
+	t.Helper()
+	c := &cluster{t: t, dir: t.TempDir(), nodes: map[string]*testNode{}, secret: secret}
+	seed := naming.DefaultSettings()
+	seed.DefaultHeartbeatMs = heartbeat.Milliseconds()
+	seed.HealIntervalMs = 200
+	sv, err := naming.NewServer(naming.Config{
+		MetadataDir:     filepath.Join(c.dir, "metadata"),
+		Seed:            seed,
+		HealConcurrency: 2,
+		HealMaxAttempts: 5,
+		Transport:       naming.TransportConfig{DialTimeout: time.Second},
+		NodeCalls:       naming.CallPolicy{Attempts: 1},
+		AdminToken:      []byte(adminToken),
+		TicketSecret:    secret,
+
+		GeoReplicationInterval: 200 * time.Millisecond,
+		AlertInterval:          100 * time.Millisecond,
+		CapacitySampleInterval: 50 * time.Millisecond,
+		MetricsSampleInterval:  50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("naming service: %v", err)
+	}
+	sv.Start()
+	srv := httptest.NewServer(sv.ServeMux())
+	c.naming, c.nsURL = sv, srv.URL
+	t.Cleanup(func() {
+		for id := range c.nodes {
+			c.kill(id)
+		}
+		srv.Close()
+		sv.Close()
+	})
+	return c
+}
+
+// addNode starts a new storage node and waits until the naming service
+// lists it HEALTHY and placeable.
+func (c *cluster) addNode(id string) *testNode {
+	c.t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	tn := &testNode{id: id, port: port, dir: filepath.Join(c.dir, id)}
+	if err := os.MkdirAll(tn.dir, 0755); err != nil {
+		c.t.Fatal(err)
+	}
+	c.nodes[id] = tn
+	c.start(tn, ln)
+	return tn
+}
+
+// restart brings a killed node back on its old port and data directory.
+func (c *cluster) restart(id string) {
+	c.t.Helper()
+	tn := c.nodes[id]
+	ln, err := net.Listen("tcp", "127.0.0.1:"+tn.port)
+	if err != nil {
+		c.t.Fatalf("relisten %s: %v", id, err)
+	}
+	c.start(tn, ln)
+}
+
+func (c *cluster) start(tn *testNode, ln net.Listener) {
+	c.t.Helper()
+	node, err := storagenode.NewNode(storagenode.Config{
+		NodeID:        tn.id,
+		Port:          tn.port,
+		DataDir:       tn.dir,
+		NamingURL:     c.nsURL,
+		CapacityBytes: 64 << 20,
+		Heartbeat:     heartbeat,
+		FastCheckMax:  16,
+		AdminToken:    []byte(adminToken),
+		Compression:   c.compression,
+
+		TicketSecret:   c.secret,
+		RequireTicket:  len(c.secret) > 0,
+		GatewayOrigins: []string{gatewayOrigin},
+	})
+	if err != nil {
+		c.t.Fatalf("node %s: %v", tn.id, err)
+	}
+	srv := httptest.NewUnstartedServer(node.Handler())
+	srv.Listener.Close()
+	srv.Listener = ln
+	srv.Start()
+	node.Start()
+	tn.node, tn.srv = node, srv
+	c.waitFor(tn.id+" HEALTHY", func() bool {
+		n, ok := c.nodeInfo(tn.id)
+		return ok && n.Status == naming.NodeHealthy && !n.Degraded
+	})
+}
+
+// kill takes a node off the network and stops its heartbeats, as if its
+// process had exited. It is a no-op for a node that is already down.
+func (c *cluster) kill(id string) {
+	tn := c.nodes[id]
+	if tn.srv == nil {
+		return
+	}
+	tn.srv.CloseClientConnections()
+	tn.srv.Close()
+	tn.node.Close()
+	tn.node, tn.srv = nil, nil
+}
+
+// waitFor polls cond until it holds, failing the test after 10s.
+func (c *cluster) waitFor(what string, cond func() bool) {
+	c.t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			c.t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (c *cluster) nodeInfo(id string) (naming.NodeInfo, bool) {
+	var nodes []naming.NodeInfo
+	c.getJSON(c.nsURL+"/list-nodes", &nodes)
+	for _, n := range nodes {
+		if n.NodeID == id {
+			return n, true
+		}
+	}
+	return naming.NodeInfo{}, false
+}
+
+func (c *cluster) fileInfo(fileID string) naming.FileMetadata {
+	c.t.Helper()
+	var meta naming.FileMetadata
+	c.getJSON(c.nsURL+"/file-info/"+fileID, &meta)
+	return meta
+}
+
+// waitForState waits until fileID is in state and returns its metadata.
+func (c *cluster) waitForState(fileID string, state naming.FileState) naming.FileMetadata {
+	c.t.Helper()
+	var meta naming.FileMetadata
+	c.waitFor(fmt.Sprintf("%s to be %s", fileID, state), func() bool {
+		meta = c.fileInfo(fileID)
+		return meta.State == state
+	})
+	return meta
+}
+
+// upload stores data the way the gateway does: allocate, push to every
+// allocated replica, commit the ones that took it.
+func (c *cluster) upload(filename string, data []byte) string {
+	c.t.Helper()
+	sum := sha256.Sum256(data)
+	checksum := "sha256:" + hex.EncodeToString(sum[:])
+	var alloc struct {
+		FileID   string `json:"fileId"`
+		Version  int    `json:"version"`
+		Replicas []struct {
+			NodeID string `json:"nodeId"`
+			URL    string `json:"url"`
+		} `json:"replicas"`
+	}
+	c.postJSON(c.nsURL+"/allocate", map[string]any{
+		"filename": filename, "size": len(data), "checksum": checksum, "contentType": "application/octet-stream",
+	}, &alloc)
+
+	var uploaded []string
+	var stored int64
+	for _, rep := range alloc.Replicas {
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		_ = mw.WriteField("fileId", alloc.FileID)
+		_ = mw.WriteField("version", fmt.Sprint(alloc.Version))
+		_ = mw.WriteField("expectedChecksum", checksum)
+		fw, _ := mw.CreateFormFile("file", filename)
+		_, _ = fw.Write(data)
+		mw.Close()
+		resp, err := http.Post(rep.URL+"/upload", mw.FormDataContentType(), body)
+		if err != nil {
+			c.t.Fatalf("upload to %s: %v", rep.NodeID, err)
+		}
+		var out struct {
+			StoredBytes int64 `json:"storedBytes"`
+		}
+		c.decode(resp, &out)
+		uploaded = append(uploaded, rep.NodeID)
+		stored = max(stored, out.StoredBytes)
+	}
+	c.postJSON(c.nsURL+"/commit", map[string]any{
+		"fileId": alloc.FileID, "version": alloc.Version, "uploaded": uploaded, "storedSize": stored,
+	}, nil)
+	return alloc.FileID
+}
+
+// heal asks the naming service to repair fileID now, ahead of the sweep
+// and of any backoff left from a failed attempt.
+func (c *cluster) heal(fileID string) {
+	c.t.Helper()
+	c.postJSON(c.nsURL+"/heal/"+fileID, nil, nil)
+}
+
+// download fetches fileID from the first replica /lookup offers.
+func (c *cluster) download(fileID string) []byte {
+	c.t.Helper()
+	var replicas []struct {
+		NodeID string `json:"nodeId"`
+		URL    string `json:"url"`
+	}
+	c.getJSON(c.nsURL+"/lookup/"+fileID, &replicas)
+	if len(replicas) == 0 {
+		c.t.Fatalf("lookup %s: no replicas", fileID)
+	}
+	return c.readFrom(replicas[0].URL, fileID)
+}
+
+// readFrom downloads fileID from one node.
+func (c *cluster) readFrom(nodeURL, fileID string) []byte {
+	c.t.Helper()
+	resp, err := http.Get(nodeURL + "/download/" + fileID)
+	if err != nil {
+		c.t.Fatalf("download %s: %v", fileID, err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		c.t.Fatalf("download %s from %s: %s: %s", fileID, nodeURL, resp.Status, b)
+	}
+	return b
+}
+
+func (c *cluster) getJSON(url string, out any) {
+	c.t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		c.t.Fatalf("GET %s: %v", url, err)
+	}
+	c.decode(resp, out)
+}
+
+func (c *cluster) postJSON(url string, in, out any) {
+	c.t.Helper()
+	b, _ := json.Marshal(in)
+	resp, err := http.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		c.t.Fatalf("POST %s: %v", url, err)
+	}
+	c.decode(resp, out)
+}
+
+// admin sends in as JSON to a naming /admin endpoint, with the token.
+func (c *cluster) admin(method, path string, in, out any) {
+	c.t.Helper()
+	b, _ := json.Marshal(in)
+	req, _ := http.NewRequest(method, c.nsURL+path, bytes.NewReader(b))
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	c.decode(resp, out)
+}
+
+func (c *cluster) delete(url string, out any) {
+	c.t.Helper()
+	req, _ := http.NewRequest(http.MethodDelete, url, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatalf("DELETE %s: %v", url, err)
+	}
+	c.decode(resp, out)
+}
+
+// decode fails the test on a non-2xx response, else decodes it into out
+// unless out is nil.
+func (c *cluster) decode(resp *http.Response, out any) {
+	c.t.Helper()
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		c.t.Fatalf("%s %s: %s: %s", resp.Request.Method, resp.Request.URL, resp.Status, bytes.TrimSpace(b))
+	}
+	if out != nil {
+		if err := json.Unmarshal(b, out); err != nil {
+			c.t.Fatalf("%s %s: bad JSON: %v", resp.Request.Method, resp.Request.URL, err)
+		}
+	}
+}
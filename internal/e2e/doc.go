@@ -0,0 +1,9 @@
+// Package e2e holds end-to-end tests that run a naming service and several
+// storage nodes in one process, on httptest servers, and drive them over
+// HTTP the way the gateway does. Run them with
+//
+//	go test ./internal/e2e
+//
+// Each test gets its own cluster under t.TempDir(); nothing else needs to
+// be running.
+package e2e
@@ -0,0 +1,2195 @@
+package e2e
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"ProjectAkhir/internal/apierr"
+	"ProjectAkhir/internal/naming"
+	"ProjectAkhir/internal/storagenode"
+)
+
+// TestNodeLossHealsOntoNewNode uploads to two nodes, loses one, and checks
+// the file turns DEGRADED, stays readable, and is healed back to AVAILABLE
+// onto a third node.
+func TestNodeLossHealsOntoNewNode(t *testing.T) {
+	c := newCluster(t)
+	c.addNode("node-a")
+	c.addNode("node-b")
+
+	data := bytes.Repeat([]byte("replicated payload\n"), 4096)
+	id := c.upload("report.txt", data)
+	meta := c.waitForState(id, naming.StateAvailable)
+	if len(meta.Replicas) != 2 {
+		t.Fatalf("replicas = %d, want 2", len(meta.Replicas))
+	}
+
+	c.kill("node-b")
+	c.waitFor("node-b DOWN", func() bool {
+		n, _ := c.nodeInfo("node-b")
+		return n.Status == naming.NodeDown
+	})
+	c.waitForState(id, naming.StateDegraded)
+	if got := c.download(id); !bytes.Equal(got, data) {
+		t.Fatalf("degraded read returned %d bytes, want the original %d", len(got), len(data))
+	}
+
+	c.addNode("node-c")
+	c.heal(id)
+	meta = c.waitForState(id, naming.StateAvailable)
+	healed := false
+	for _, rep := range meta.Replicas {
+		if rep.NodeID == "node-c" && rep.Status == naming.ReplicaReady {
+			healed = true
+			if got := c.readFrom(rep.URL, id); !bytes.Equal(got, data) {
+				t.Fatalf("healed replica on node-c differs from the upload")
+			}
+		}
+	}
+	if !healed {
+		t.Fatalf("no READY replica on node-c after healing: %+v", meta.Replicas)
+	}
+}
+
+// TestRestartedNodeRejoins kills a replica holder and brings it back on the
+// same data directory; its copy is still good, so the file recovers without
+// a third node.
+func TestRestartedNodeRejoins(t *testing.T) {
+	c := newCluster(t)
+	c.addNode("node-a")
+	c.addNode("node-b")
+
+	data := []byte("small file that survives a restart")
+	id := c.upload("note.txt", data)
+	c.waitForState(id, naming.StateAvailable)
+
+	c.kill("node-a")
+	c.waitForState(id, naming.StateDegraded)
+
+	c.restart("node-a")
+	if n, _ := c.nodeInfo("node-a"); n.UsedBytes < int64(len(data)) {
+		t.Fatalf("node-a re-registered with usedBytes=%d, want at least %d", n.UsedBytes, len(data))
+	}
+	c.heal(id)
+	meta := c.waitForState(id, naming.StateAvailable)
+	for _, rep := range meta.Replicas {
+		if rep.NodeID == "node-a" {
+			if got := c.readFrom(rep.URL, id); !bytes.Equal(got, data) {
+				t.Fatalf("node-a served %q after restart, want %q", got, data)
+			}
+			return
+		}
+	}
+	t.Fatalf("node-a no longer holds a replica: %+v", meta.Replicas)
+}
+
+// TestNodeManifestJournaled checks that uploads and deletes append to a
+// node's manifest.journal instead of rewriting manifest.json, and that a
+// node opened on that data directory without a clean shutdown, as after a
+// crash, still knows every blob from the journal.
+func TestNodeManifestJournaled(t *testing.T) {
+	c := newCluster(t)
+	tn := c.addNode("node-a")
+	c.addNode("node-b")
+	read := func(name string) string {
+		b, _ := os.ReadFile(filepath.Join(tn.dir, name))
+		return string(b)
+	}
+
+	keep := c.upload("keep.txt", []byte("kept"))
+	gone := c.upload("gone.txt", []byte("deleted"))
+	c.waitForState(keep, naming.StateAvailable)
+	c.delete(tn.srv.URL+"/files/"+gone, nil)
+	if j := read("manifest.journal"); !strings.Contains(j, keep) || !strings.Contains(j, `"deleted":true`) {
+		t.Errorf("manifest.journal does not hold the upload and the delete:\n%s", j)
+	}
+	if m := read("manifest.json"); strings.Contains(m, keep) || strings.Contains(m, gone) {
+		t.Error("manifest.json rewritten for a handful of changes")
+	}
+
+	crashed := filepath.Join(t.TempDir(), "node-a")
+	if err := os.CopyFS(crashed, os.DirFS(tn.dir)); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(crashed, ".clean-shutdown"))
+	node, err := storagenode.NewNode(storagenode.Config{NodeID: "node-a", DataDir: crashed, NamingURL: c.nsURL, CapacityBytes: 64 << 20, Heartbeat: heartbeat, SkipRegistration: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+	srv := httptest.NewServer(node.Handler())
+	defer srv.Close()
+	var list struct {
+		Files []struct {
+			FileID   string `json:"fileId"`
+			Checksum string `json:"checksum"`
+		} `json:"files"`
+	}
+	c.getJSON(srv.URL+"/list", &list)
+	if len(list.Files) != 1 || list.Files[0].FileID != keep || list.Files[0].Checksum == "" {
+		t.Errorf("after replaying the journal the node lists %+v, want only %s with its checksum", list.Files, keep)
+	}
+
+	c.kill("node-a")
+	if read("manifest.journal") != "" || !strings.Contains(read("manifest.json"), keep) {
+		t.Error("Close did not compact the journal into manifest.json")
+	}
+}
+
+// TestInventoryDigestFindsLostBlob drops a blob behind the naming service's
+// back; the node's next heartbeat digests no longer match the catalog, so
+// the replica is marked MISSING and healed without anyone downloading it.
+func TestInventoryDigestFindsLostBlob(t *testing.T) {
+	c := newCluster(t)
+	c.addNode("node-a")
+	c.addNode("node-b")
+
+	data := []byte("a blob that quietly disappears")
+	id := c.upload("lost.txt", data)
+	c.waitForState(id, naming.StateAvailable)
+
+	tn := c.nodes["node-b"]
+	c.delete(tn.srv.URL+"/files/"+id, nil)
+	c.waitFor("node-b's replica to be MISSING", func() bool {
+		for _, rep := range c.fileInfo(id).Replicas {
+			if rep.NodeID == "node-b" {
+				return rep.Status == naming.ReplicaMissing
+			}
+		}
+		return false
+	})
+
+	c.heal(id)
+	meta := c.waitForState(id, naming.StateAvailable)
+	for _, rep := range meta.Replicas {
+		if rep.NodeID == "node-b" && rep.Status == naming.ReplicaReady {
+			if got := c.readFrom(rep.URL, id); !bytes.Equal(got, data) {
+				t.Fatalf("re-healed replica on node-b differs from the upload")
+			}
+			return
+		}
+	}
+	t.Fatalf("node-b holds no READY replica after healing: %+v", meta.Replicas)
+}
+
+// TestRoutesEnforceMethods asks for known paths with the wrong method, which
+// is a 405 naming the right ones, then deletes a file with DELETE.
+func TestRoutesEnforceMethods(t *testing.T) {
+	c := newCluster(t)
+	c.addNode("node-a")
+	c.addNode("node-b")
+	id := c.upload("doomed.txt", []byte("deleted with a DELETE"))
+	c.waitForState(id, naming.StateAvailable)
+
+	for _, tc := range []struct{ method, url, allow string }{
+		{http.MethodGet, c.nsURL + "/allocate", "POST"},
+		{http.MethodPost, c.nsURL + "/lookup/" + id, "GET, HEAD"},
+		{http.MethodGet, c.nsURL + "/files/" + id, "DELETE"},
+		{http.MethodGet, c.nodes["node-a"].srv.URL + "/upload", "POST, OPTIONS"},
+	} {
+		req, _ := http.NewRequest(tc.method, tc.url, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != tc.allow {
+			t.Errorf("%s %s: %s, Allow %q; want 405, Allow %q", tc.method, tc.url, resp.Status, resp.Header.Get("Allow"), tc.allow)
+		}
+	}
+
+	var out struct {
+		Deleted bool `json:"deleted"`
+	}
+	c.delete(c.nsURL+"/files/"+id, &out)
+	if !out.Deleted {
+		t.Fatalf("DELETE /files/%s did not delete", id)
+	}
+	resp, err := http.Get(c.nsURL + "/lookup/" + id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("lookup after delete: %s, want 404", resp.Status)
+	}
+}
+
+// TestRetriesAreIdempotent retries an allocate under the same
+// Idempotency-Key, which must not allocate a second file, then repeats a
+// commit and a delete, which must succeed without changing anything.
+func TestRetriesAreIdempotent(t *testing.T) {
+	c := newCluster(t)
+	c.addNode("node-a")
+	c.addNode("node-b")
+
+	allocate := func(key, filename string) (*http.Response, string) {
+		b := fmt.Sprintf(`{"filename":%q,"size":5,"checksum":"sha256:%064x","contentType":"text/plain"}`, filename, 0)
+		req, _ := http.NewRequest(http.MethodPost, c.nsURL+"/allocate", strings.NewReader(b))
+		req.Header.Set("Idempotency-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var out struct {
+			FileID string `json:"fileId"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&out)
+		return resp, out.FileID
+	}
+	first, id := allocate("upload-1", "once.txt")
+	retry, again := allocate("upload-1", "once.txt")
+	if first.StatusCode != http.StatusOK || retry.StatusCode != http.StatusOK || again != id {
+		t.Fatalf("retried allocate: %s %q, then %s %q; want the same file", first.Status, id, retry.Status, again)
+	}
+	if retry.Header.Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retried allocate is not marked as replayed")
+	}
+	if resp, _ := allocate("upload-1", "other.txt"); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("key reused for another request: %s, want 422", resp.Status)
+	}
+
+	id = c.upload("kept.txt", []byte("committed twice"))
+	c.waitForState(id, naming.StateAvailable)
+	var commit struct {
+		State naming.FileState `json:"state"`
+	}
+	meta := c.fileInfo(id)
+	c.postJSON(c.nsURL+"/commit", map[string]any{"fileId": id, "version": meta.Version, "uploaded": []string{"node-a"}}, &commit)
+	if commit.State != naming.StateAvailable {
+		t.Errorf("repeated commit with fewer replicas: %s, want AVAILABLE", commit.State)
+	}
+
+	var del struct {
+		Deleted        bool `json:"deleted"`
+		AlreadyDeleted bool `json:"alreadyDeleted"`
+	}
+	c.delete(c.nsURL+"/files/"+id, &del)
+	c.delete(c.nsURL+"/files/"+id, &del)
+	if !del.Deleted || !del.AlreadyDeleted {
+		t.Errorf("repeated delete: %+v, want deleted and alreadyDeleted", del)
+	}
+}
+
+// TestConcurrentUploadsConflict uploads different content under one name,
+// which keeps every upload in a conflict, and resolves it both ways: by
+// keeping only the newest, whose rivals' blobs go too, and by keeping both
+// under distinct names.
+func TestConcurrentUploadsConflict(t *testing.T) {
+	c := newCluster(t)
+	c.addNode("node-a")
+	c.addNode("node-b")
+
+	older := c.upload("notes.txt", []byte("written on the laptop"))
+	newer := c.upload("notes.txt", []byte("written on the phone"))
+	cid := c.fileInfo(older).ConflictID
+	if cid == "" || c.fileInfo(newer).ConflictID != cid {
+		t.Fatalf("conflict IDs %q and %q, want one shared ID", cid, c.fileInfo(newer).ConflictID)
+	}
+	var list struct {
+		Conflicts []naming.ConflictStatus `json:"conflicts"`
+	}
+	c.getJSON(c.nsURL+"/conflicts", &list)
+	if len(list.Conflicts) != 1 || len(list.Conflicts[0].Files) != 2 || list.Conflicts[0].Filename != "notes.txt" {
+		t.Fatalf("conflicts = %+v, want notes.txt with two files", list.Conflicts)
+	}
+
+	var res struct {
+		Kept    []string `json:"kept"`
+		Deleted []string `json:"deleted"`
+	}
+	c.postJSON(c.nsURL+"/conflicts/"+cid+"/resolve", naming.ResolveConflictRequest{Strategy: naming.ResolveKeepNewest}, &res)
+	if len(res.Kept) != 1 || res.Kept[0] != newer || len(res.Deleted) != 1 || res.Deleted[0] != older {
+		t.Fatalf("keep-newest kept %v and deleted %v, want %s and %s", res.Kept, res.Deleted, newer, older)
+	}
+	if c.fileInfo(newer).ConflictID != "" {
+		t.Errorf("kept file is still in a conflict")
+	}
+	for _, n := range c.nodes {
+		if resp, err := http.Get(n.srv.URL + "/download/" + older); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusNotFound {
+				t.Errorf("deleted upload on %s: %s, want 404", n.id, resp.Status)
+			}
+		}
+	}
+
+	first := c.upload("plan.md", []byte("# Plan A"))
+	second := c.upload("plan.md", []byte("# Plan B"))
+	var both struct {
+		Renamed map[string]string `json:"renamed"`
+	}
+	c.postJSON(c.nsURL+"/conflicts/"+c.fileInfo(first).ConflictID+"/resolve", naming.ResolveConflictRequest{Strategy: naming.ResolveKeepBoth}, &both)
+	if got := c.fileInfo(second).Filename; got != "plan (2).md" || both.Renamed[second] != got {
+		t.Errorf("keep-both renamed the second upload to %q (%v), want \"plan (2).md\"", got, both.Renamed)
+	}
+	if f := c.fileInfo(first); f.Filename != "plan.md" || f.ConflictID != "" {
+		t.Errorf("first upload after keep-both: %q in %q, want plan.md and no conflict", f.Filename, f.ConflictID)
+	}
+}
+
+// TestCopyAndMove copies a file on the nodes, checks the copy survives the
+// original's deletion, and moves it into a folder and to another owner.
+func TestCopyAndMove(t *testing.T) {
+	c := newCluster(t)
+	c.addNode("node-a")
+	c.addNode("node-b")
+
+	data := bytes.Repeat([]byte("copied without a download\n"), 1024)
+	orig := c.upload("big.bin", data)
+	c.waitForState(orig, naming.StateAvailable)
+
+	var cp struct {
+		FileID   string            `json:"fileId"`
+		Filename string            `json:"filename"`
+		State    naming.FileState  `json:"state"`
+		Methods  map[string]string `json:"methods"`
+	}
+	c.postJSON(c.nsURL+"/files/"+orig+"/copy", naming.CopyFileRequest{}, &cp)
+	if cp.FileID == "" || cp.FileID == orig || cp.Filename != "big (2).bin" || cp.State != naming.StateAvailable {
+		t.Fatalf("copy = %+v, want a new AVAILABLE file named \"big (2).bin\"", cp)
+	}
+	if len(cp.Methods) != 2 || cp.Methods["node-a"] != "hardlink" {
+		t.Errorf("copy methods = %v, want a hard link on both nodes", cp.Methods)
+	}
+	c.delete(c.nsURL+"/files/"+orig, nil)
+	for _, n := range c.nodes {
+		c.delete(n.srv.URL+"/files/"+orig, nil)
+	}
+	if got := c.download(cp.FileID); !bytes.Equal(got, data) {
+		t.Fatalf("copy read back %d bytes after the original was deleted, want %d", len(got), len(data))
+	}
+
+	dir, owner := "archive/2026", "bob"
+	c.postJSON(c.nsURL+"/files/"+cp.FileID+"/move", naming.MoveFileRequest{Directory: &dir, Owner: &owner}, nil)
+	if f := c.fileInfo(cp.FileID); f.Filename != "archive/2026/big (2).bin" || f.Owner != "bob" {
+		t.Errorf("after move: %q owned by %q", f.Filename, f.Owner)
+	}
+	var quota struct {
+		UsedBytes int64 `json:"usedBytes"`
+	}
+	c.getJSON(c.nsURL+"/quota?owner=bob", &quota)
+	if quota.UsedBytes != int64(len(data)) {
+		t.Errorf("bob's quota after the move: %d bytes used, want %d", quota.UsedBytes, len(data))
+	}
+}
+
+// TestNodeFetch has one node pull a blob from another under a new fileId,
+// and checks a fetch whose checksum is wrong is refused and stores nothing.
+func TestNodeFetch(t *testing.T) {
+	c := newCluster(t)
+	a := c.addNode("node-a")
+	b := c.addNode("node-b")
+
+	data := bytes.Repeat([]byte("node to node\n"), 4096)
+	id := c.upload("peer.bin", data)
+	meta := c.waitForState(id, naming.StateAvailable)
+
+	var out struct {
+		Method string `json:"method"`
+		Size   int64  `json:"size"`
+	}
+	c.postJSON(b.srv.URL+"/fetch", map[string]any{
+		"fileId": "fetched", "sourceUrl": a.srv.URL, "sourceFileId": id, "checksum": meta.Checksum,
+	}, &out)
+	if out.Method != "network" || out.Size != int64(len(data)) {
+		t.Errorf("fetch = %+v, want %d bytes over the network", out, len(data))
+	}
+	if got := c.readFrom(b.srv.URL, "fetched"); !bytes.Equal(got, data) {
+		t.Fatalf("fetched blob read back %d bytes, want %d", len(got), len(data))
+	}
+
+	body, _ := json.Marshal(map[string]any{
+		"fileId": "bad", "sourceUrl": a.srv.URL, "sourceFileId": id, "checksum": "sha256:" + strings.Repeat("0", 64),
+	})
+	resp, err := http.Post(b.srv.URL+"/fetch", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e apierr.Error
+	_ = json.NewDecoder(resp.Body).Decode(&e)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict || e.Code != apierr.ChecksumMismatch {
+		t.Errorf("fetch with a wrong checksum = %d %s, want 409 %s", resp.StatusCode, e.Code, apierr.ChecksumMismatch)
+	}
+	if resp, err := http.Get(b.srv.URL + "/download/bad"); err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("blob after a failed fetch: %s, want 404", resp.Status)
+		}
+	}
+}
+
+// TestPlacementPolicies switches the placement policy at runtime and checks
+// where each built-in strategy puts new files, on four nodes in two zones.
+func TestPlacementPolicies(t *testing.T) {
+	c := newCluster(t)
+	zoneOf := map[string]string{}
+	for i, id := range []string{"node-a", "node-b", "node-c", "node-d"} {
+		tn := c.addNode(id)
+		zoneOf[id] = []string{"zone-1", "zone-2"}[i/2]
+		c.postJSON(c.nsURL+"/register-node", naming.RegisterNodeRequest{
+			NodeID: id, URL: tn.srv.URL, CapacityBytes: 64 << 20, Zone: zoneOf[id],
+		}, nil)
+	}
+	place := func(filename string) []string {
+		var alloc struct {
+			Replicas []struct {
+				NodeID string `json:"nodeId"`
+			} `json:"replicas"`
+		}
+		c.postJSON(c.nsURL+"/allocate", map[string]any{"filename": filename, "size": 16, "checksum": "sha256:" + strings.Repeat("ab", 32)}, &alloc)
+		var ids []string
+		for _, rep := range alloc.Replicas {
+			ids = append(ids, rep.NodeID)
+		}
+		return ids
+	}
+	use := func(policy naming.PlacementPolicy) {
+		c.admin(http.MethodPut, "/admin/placement-policy", naming.PlacementPolicyRequest{Policy: policy}, nil)
+	}
+
+	var current struct {
+		Policy    naming.PlacementPolicy   `json:"policy"`
+		Available []naming.PlacementPolicy `json:"available"`
+	}
+	c.admin(http.MethodGet, "/admin/placement-policy", nil, &current)
+	if current.Policy != naming.PlaceLeastLoaded || len(current.Available) != 5 {
+		t.Fatalf("placement policy = %+v, want least-loaded of 5", current)
+	}
+
+	use(naming.PlaceRoundRobin)
+	count := map[string]int{}
+	for i := range 4 {
+		for _, id := range place(fmt.Sprintf("rr-%d.txt", i)) {
+			count[id]++
+		}
+	}
+	for id := range zoneOf {
+		if count[id] != 2 {
+			t.Errorf("round-robin: %s got %d of 8 replicas, want 2 (%v)", id, count[id], count)
+		}
+	}
+
+	use(naming.PlaceConsistentHash)
+	first := place("same-name.txt")
+	for range 3 {
+		if got := place("same-name.txt"); strings.Join(got, ",") != strings.Join(first, ",") {
+			t.Errorf("consistent-hash: same-name.txt went to %v, then %v", first, got)
+		}
+	}
+
+	for _, policy := range []naming.PlacementPolicy{naming.PlaceZoneSpread, naming.PlaceRandom} {
+		use(policy)
+		for i := range 4 {
+			got := place(fmt.Sprintf("%s-%d.txt", policy, i))
+			if len(got) != 2 || zoneOf[got[0]] == zoneOf[got[1]] {
+				t.Errorf("%s: replicas on %v, want one in each zone", policy, got)
+			}
+		}
+	}
+
+	b, _ := json.Marshal(naming.PlacementPolicyRequest{Policy: "nearest"})
+	req, _ := http.NewRequest(http.MethodPut, c.nsURL+"/admin/placement-policy", bytes.NewReader(b))
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown placement policy: %s, want 400", resp.Status)
+	}
+}
+
+// TestPlacementHints checks allocation hints against node tags: prefer and
+// avoid order the nodes, require is a hard filter.
+func TestPlacementHints(t *testing.T) {
+	c := newCluster(t)
+	tags := map[string][]string{"node-a": {"ssd"}, "node-b": {"hdd"}, "node-c": {"ssd", "high-bandwidth"}}
+	for _, id := range []string{"node-a", "node-b", "node-c"} {
+		tn := c.addNode(id)
+		c.postJSON(c.nsURL+"/register-node", naming.RegisterNodeRequest{
+			NodeID: id, URL: tn.srv.URL, CapacityBytes: 64 << 20, Tags: tags[id],
+		}, nil)
+	}
+	allocate := func(hints ...string) (*http.Response, []string) {
+		b, _ := json.Marshal(naming.AllocateRequest{
+			Filename: "hinted.bin", Size: 16, Checksum: "sha256:" + strings.Repeat("cd", 32), Placement: hints,
+		})
+		resp, err := http.Post(c.nsURL+"/allocate", "application/json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var alloc struct {
+			Replicas []struct {
+				NodeID string `json:"nodeId"`
+			} `json:"replicas"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&alloc)
+		var ids []string
+		for _, rep := range alloc.Replicas {
+			ids = append(ids, rep.NodeID)
+		}
+		slices.Sort(ids)
+		return resp, ids
+	}
+
+	for range 3 {
+		if _, got := allocate("prefer:ssd"); !slices.Equal(got, []string{"node-a", "node-c"}) {
+			t.Errorf("prefer:ssd placed on %v, want node-a and node-c", got)
+		}
+		if _, got := allocate("avoid:ssd"); !slices.Contains(got, "node-b") {
+			t.Errorf("avoid:ssd placed on %v, want node-b among them", got)
+		}
+		if _, got := allocate("require:ssd", "prefer:high-bandwidth"); !slices.Equal(got, []string{"node-a", "node-c"}) {
+			t.Errorf("require:ssd placed on %v, want node-a and node-c", got)
+		}
+	}
+	if resp, _ := allocate("require:hdd"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("require:hdd with one hdd node: %s, want 503", resp.Status)
+	}
+	if resp, _ := allocate("fastest"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("malformed hint: %s, want 400", resp.Status)
+	}
+}
+
+// TestStorageClasses moves a file from STANDARD to REDUCED, which trims it
+// to one replica, then to ARCHIVE, which brings it back to two and moves
+// it off the SSD node.
+func TestStorageClasses(t *testing.T) {
+	c := newCluster(t)
+	tags := map[string][]string{"node-a": {"ssd"}, "node-b": {"hdd"}, "node-c": {"hdd"}}
+	for _, id := range []string{"node-a", "node-b", "node-c"} {
+		tn := c.addNode(id)
+		c.postJSON(c.nsURL+"/register-node", naming.RegisterNodeRequest{
+			NodeID: id, URL: tn.srv.URL, CapacityBytes: 64 << 20, Tags: tags[id],
+		}, nil)
+	}
+	data := bytes.Repeat([]byte("cold data\n"), 2048)
+	id := c.upload("cold.log", data)
+	c.waitForState(id, naming.StateAvailable)
+
+	replicas := func() []string {
+		var ids []string
+		for _, rep := range c.fileInfo(id).Replicas {
+			if rep.Status == naming.ReplicaReady {
+				ids = append(ids, rep.NodeID)
+			}
+		}
+		slices.Sort(ids)
+		return ids
+	}
+	var changed struct {
+		Previous naming.StorageClass `json:"previous"`
+		Factor   int                 `json:"factor"`
+	}
+	c.postJSON(c.nsURL+"/files/"+id+"/storage-class", naming.ChangeClassRequest{StorageClass: naming.ClassReduced}, &changed)
+	if changed.Previous != naming.ClassStandard || changed.Factor != 1 {
+		t.Errorf("change to REDUCED = %+v, want previous STANDARD and factor 1", changed)
+	}
+	c.waitFor("one replica", func() bool { return len(c.fileInfo(id).Replicas) == 1 })
+
+	c.postJSON(c.nsURL+"/files/"+id+"/storage-class", naming.ChangeClassRequest{StorageClass: naming.ClassArchive}, nil)
+	c.waitFor("two replicas on hdd nodes", func() bool {
+		f := c.fileInfo(id)
+		return f.State == naming.StateAvailable && len(f.Replicas) == 2 && slices.Equal(replicas(), []string{"node-b", "node-c"})
+	})
+	if f := c.fileInfo(id); f.StorageClass != naming.ClassArchive {
+		t.Errorf("storage class = %q, want ARCHIVE", f.StorageClass)
+	}
+	if got := c.download(id); !bytes.Equal(got, data) {
+		t.Errorf("read back %d bytes after the class changes, want %d", len(got), len(data))
+	}
+
+	b, _ := json.Marshal(naming.AllocateRequest{Filename: "x.bin", Size: 1, Checksum: "sha256:" + strings.Repeat("ef", 32), StorageClass: "GLACIER"})
+	resp, err := http.Post(c.nsURL+"/allocate", "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("allocate with an unknown class: %s, want 400", resp.Status)
+	}
+}
+
+// TestSnapshotRestore stores a catalog snapshot on the storage nodes and
+// loads it into a second, empty naming service.
+func TestSnapshotRestore(t *testing.T) {
+	c := newCluster(t)
+	c.addNode("node-a")
+	c.addNode("node-b")
+	data := bytes.Repeat([]byte("snapshot "), 1000)
+	fileID := c.upload("kept.txt", data)
+	c.waitForState(fileID, naming.StateAvailable)
+
+	var stored struct {
+		SnapshotID string `json:"snapshotId"`
+		Checksum   string `json:"checksum"`
+		StoredOn   []struct {
+			NodeID string `json:"nodeId"`
+			URL    string `json:"url"`
+		} `json:"storedOn"`
+	}
+	c.admin(http.MethodPost, "/admin/snapshot", naming.SnapshotRequest{}, &stored)
+	if len(stored.StoredOn) != 2 {
+		t.Fatalf("snapshot stored on %d node(s), want 2", len(stored.StoredOn))
+	}
+
+	fresh := newCluster(t)
+	source := naming.RestoreRequest{NodeURL: stored.StoredOn[1].URL, SnapshotID: stored.SnapshotID}
+	var plan struct {
+		DryRun                   bool
+		Added, Replaced, Removed int
+	}
+	fresh.admin(http.MethodPost, "/admin/restore?dryRun=true", source, &plan)
+	if !plan.DryRun || plan.Added != 1 || plan.Replaced != 0 || plan.Removed != 0 {
+		t.Errorf("restore dry run = %+v, want 1 file added", plan)
+	}
+	resp, err := http.Get(fresh.nsURL + "/file-info/" + fileID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("file-info after a dry run: %s, want 404", resp.Status)
+	}
+
+	var restored struct {
+		Files int `json:"files"`
+		Nodes int `json:"nodes"`
+	}
+	fresh.admin(http.MethodPost, "/admin/restore", source, &restored)
+	if restored.Files != 1 || restored.Nodes != 2 {
+		t.Errorf("restored %d files and %d nodes, want 1 and 2", restored.Files, restored.Nodes)
+	}
+	got := fresh.fileInfo(fileID)
+	if got.Filename != "kept.txt" || got.Size != int64(len(data)) || len(got.Replicas) != 2 {
+		t.Errorf("restored file: %+v", got)
+	}
+
+	// a second restore would replace a catalog that has files
+	var snap naming.ClusterSnapshot
+	c.admin(http.MethodGet, "/admin/snapshot", nil, &snap)
+	for _, tc := range []struct {
+		name string
+		req  naming.RestoreRequest
+		want int
+	}{
+		{"without force", naming.RestoreRequest{Snapshot: &snap}, http.StatusConflict},
+		{"tampered", naming.RestoreRequest{Snapshot: &naming.ClusterSnapshot{Format: naming.SnapshotFormat, Checksum: snap.Checksum}, Force: true}, http.StatusUnprocessableEntity},
+	} {
+		b, _ := json.Marshal(tc.req)
+		req, _ := http.NewRequest(http.MethodPost, fresh.nsURL+"/admin/restore", bytes.NewReader(b))
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("restore %s: %s, want %d", tc.name, resp.Status, tc.want)
+		}
+	}
+}
+
+// TestBackup mirrors files to a directory and to a stand-in S3 bucket,
+// then checks a second run copies nothing.
+func TestBackup(t *testing.T) {
+	c := newCluster(t)
+	c.addNode("node-a")
+	c.addNode("node-b")
+	alpha, beta := []byte(strings.Repeat("alpha ", 500)), []byte("beta")
+	alphaID, betaID := c.upload("alpha.txt", alpha), c.upload("beta.txt", beta)
+	c.waitForState(alphaID, naming.StateAvailable)
+	c.waitForState(betaID, naming.StateAvailable)
+
+	var mu sync.Mutex
+	objects := map[string][]byte{}
+	bucket := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AK/") ||
+			!strings.HasPrefix(r.Header.Get("X-Amz-Meta-Checksum"), "sha256:") {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		objects[r.URL.Path] = b
+		mu.Unlock()
+	}))
+	defer bucket.Close()
+
+	dir := t.TempDir()
+	c.admin(http.MethodPut, "/admin/backup", naming.SetBackupRequest{Targets: []naming.BackupTarget{
+		{ID: "local", Kind: naming.BackupDir, Path: dir},
+		{ID: "bucket", Kind: naming.BackupS3, Prefix: "alpha", Endpoint: bucket.URL, Bucket: "backups", Region: "us-east-1",
+			KeyPrefix: "nightly/", AccessKey: "AK", SecretKey: "SK"},
+	}}, nil)
+	var shown struct {
+		Targets []naming.BackupTarget `json:"targets"`
+	}
+	c.admin(http.MethodGet, "/admin/backup", nil, &shown)
+	if len(shown.Targets) != 2 || shown.Targets[1].SecretKey == "SK" {
+		t.Errorf("targets shown as %+v, want the secret masked", shown.Targets)
+	}
+
+	type status struct {
+		Targets []struct {
+			ID      string `json:"id"`
+			Files   int    `json:"files"`
+			Pending int    `json:"pending"`
+			LastRun *struct {
+				FinishedAt *string `json:"finishedAt"`
+				Copied     int     `json:"copied"`
+				Unchanged  int     `json:"unchanged"`
+				Failed     int     `json:"failed"`
+			} `json:"lastRun"`
+		} `json:"targets"`
+	}
+	run := func() status {
+		t.Helper()
+		c.admin(http.MethodPost, "/admin/backup/run", nil, nil)
+		var st status
+		c.waitFor("backup runs to finish", func() bool {
+			c.getJSON(c.nsURL+"/backup-status", &st)
+			for _, tg := range st.Targets {
+				if tg.LastRun == nil || tg.LastRun.FinishedAt == nil {
+					return false
+				}
+			}
+			return true
+		})
+		return st
+	}
+
+	st := run()
+	for _, tg := range st.Targets {
+		want := map[string]int{"local": 2, "bucket": 1}[tg.ID]
+		if tg.LastRun.Copied != want || tg.LastRun.Failed != 0 || tg.Files != want || tg.Pending != 0 {
+			t.Errorf("first run of %s: %+v, files %d, pending %d; want %d copied", tg.ID, *tg.LastRun, tg.Files, tg.Pending, want)
+		}
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, betaID, "beta.txt")); !bytes.Equal(got, beta) {
+		t.Errorf("directory copy of beta.txt = %q", got)
+	}
+	mu.Lock()
+	got := objects["/backups/nightly/"+alphaID+"/alpha.txt"]
+	n := len(objects)
+	mu.Unlock()
+	if !bytes.Equal(got, alpha) || n != 1 {
+		t.Errorf("bucket has %d object(s), alpha.txt %d bytes; want only alpha.txt", n, len(got))
+	}
+
+	st = run()
+	for _, tg := range st.Targets {
+		if tg.LastRun.Copied != 0 || tg.LastRun.Unchanged != tg.Files {
+			t.Errorf("second run of %s copied %d, unchanged %d; want nothing copied", tg.ID, tg.LastRun.Copied, tg.LastRun.Unchanged)
+		}
+	}
+}
+
+// TestGeoReplication pushes a committed file to a peer cluster under the
+// same ID and checks a fileId collision with a different file is refused.
+func TestGeoReplication(t *testing.T) {
+	c := newCluster(t)
+	c.addNode("node-a")
+	c.addNode("node-b")
+	peer := newCluster(t)
+	peer.addNode("dr-a")
+	peer.addNode("dr-b")
+	c.admin(http.MethodPut, "/admin/geo-replication", naming.SetGeoPeersRequest{Peers: []naming.GeoPeer{
+		{ID: "dr", NamingURL: peer.nsURL, Token: adminToken},
+	}}, nil)
+
+	data := []byte(strings.Repeat("geo ", 2000))
+	fileID := c.upload("geo.txt", data)
+	var remote naming.FileMetadata
+	peer.waitFor("the file on the peer", func() bool {
+		resp, err := http.Get(peer.nsURL + "/file-info/" + fileID)
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		return resp.StatusCode == http.StatusOK && json.NewDecoder(resp.Body).Decode(&remote) == nil &&
+			remote.State == naming.StateAvailable
+	})
+	if remote.Checksum != c.fileInfo(fileID).Checksum || remote.Origin == "" {
+		t.Errorf("peer copy: checksum %s, origin %q", remote.Checksum, remote.Origin)
+	}
+	if got := peer.download(fileID); !bytes.Equal(got, data) {
+		t.Errorf("peer copy has %d bytes, want %d", len(got), len(data))
+	}
+
+	var status struct {
+		Peers []struct {
+			Queued     int `json:"queued"`
+			Replicated int `json:"replicated"`
+		} `json:"peers"`
+	}
+	c.waitFor("the queue to drain", func() bool {
+		c.getJSON(c.nsURL+"/geo-replication", &status)
+		return len(status.Peers) == 1 && status.Peers[0].Queued == 0 && status.Peers[0].Replicated == 1
+	})
+
+	// the same ID from another cluster, with other content, is a collision
+	b, _ := json.Marshal(naming.GeoReceiveRequest{FileID: fileID, Filename: "other.txt", Size: 5,
+		Checksum: "sha256:" + strings.Repeat("ab", 32), Origin: "another-cluster"})
+	req, _ := http.NewRequest(http.MethodPost, peer.nsURL+"/admin/geo-replication/receive", bytes.NewReader(b))
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var apiErr apierr.Error
+	json.NewDecoder(resp.Body).Decode(&apiErr)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict || apiErr.Code != apierr.Conflict {
+		t.Errorf("colliding push: %s %s, want 409 %s", resp.Status, apiErr.Code, apierr.Conflict)
+	}
+}
+
+// TestNodeExport heals two files onto a new node and exports it: the tar
+// holds each file under its uploaded name, and manifest.json ties the
+// fileIds back to them with their checksums.
+func TestNodeExport(t *testing.T) {
+	c := newCluster(t)
+	c.addNode("node-a")
+	c.addNode("node-b")
+	files := map[string][]byte{
+		"report.txt":    bytes.Repeat([]byte("export me\n"), 500),
+		"notes/plan.md": []byte("# plan\n"),
+	}
+	ids := map[string]string{} // fileId -> filename
+	for name, data := range files {
+		id := c.upload(name, data)
+		c.waitForState(id, naming.StateAvailable)
+		ids[id] = name
+	}
+	c.kill("node-b")
+	c.waitFor("node-b DOWN", func() bool {
+		n, _ := c.nodeInfo("node-b")
+		return n.Status == naming.NodeDown
+	})
+	nodeC := c.addNode("node-c")
+	for id := range ids {
+		c.heal(id)
+		c.waitForState(id, naming.StateAvailable)
+	}
+
+	resp, err := http.Get(nodeC.srv.URL + "/admin/export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("export without a token: %s, want 401", resp.Status)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, nodeC.srv.URL+"/admin/export", nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("export: %s", resp.Status)
+	}
+	members := map[string][]byte{}
+	tr := tar.NewReader(resp.Body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading tar: %v", err)
+		}
+		members[hdr.Name], _ = io.ReadAll(tr)
+	}
+	var manifest struct {
+		NodeID string `json:"nodeId"`
+		Files  map[string]struct {
+			Path     string `json:"path"`
+			Filename string `json:"filename"`
+			Checksum string `json:"checksum"`
+			Error    string `json:"error"`
+		} `json:"files"`
+	}
+	if err := json.Unmarshal(members["manifest.json"], &manifest); err != nil {
+		t.Fatalf("manifest.json: %v", err)
+	}
+	if manifest.NodeID != "node-c" || len(manifest.Files) != len(ids) {
+		t.Fatalf("manifest: %+v", manifest)
+	}
+	for id, name := range ids {
+		e := manifest.Files[id]
+		// multipart hands the node the base name only
+		if e.Filename != filepath.Base(name) || e.Error != "" || e.Checksum != c.fileInfo(id).Checksum {
+			t.Errorf("manifest entry for %s: %+v", name, e)
+		}
+		if want := "files/" + id + "/" + filepath.Base(name); e.Path != want {
+			t.Errorf("%s exported as %q, want %q", name, e.Path, want)
+		}
+		if !bytes.Equal(members[e.Path], files[name]) {
+			t.Errorf("%s: exported content differs from the upload", name)
+		}
+	}
+}
+
+// TestRebuildMetadata rebuilds the catalog from the nodes: files come back
+// with their names and checksums, a file one node lost comes back DEGRADED,
+// and the snapshot blobs the nodes also hold are not mistaken for files.
+func TestRebuildMetadata(t *testing.T) {
+	c := newCluster(t)
+	a := c.addNode("node-a")
+	c.addNode("node-b")
+	data := map[string][]byte{
+		"ledger.csv": bytes.Repeat([]byte("1,2,3\n"), 2000),
+		"readme.txt": []byte("read me\n"),
+	}
+	ids := map[string]string{}
+	for name, b := range data {
+		id := c.upload(name, b)
+		c.waitForState(id, naming.StateAvailable)
+		ids[name] = id
+	}
+	c.admin(http.MethodPost, "/admin/snapshot", naming.SnapshotRequest{}, nil)
+	c.delete(a.srv.URL+"/files/"+ids["readme.txt"], nil)
+
+	req, _ := http.NewRequest(http.MethodPost, c.nsURL+"/admin/rebuild-metadata", nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("rebuild over a full catalog: %s, want 409", resp.Status)
+	}
+
+	type result struct {
+		DryRun   bool           `json:"dryRun"`
+		Files    int            `json:"files"`
+		Added    int            `json:"added"`
+		Kept     int            `json:"kept"`
+		Degraded int            `json:"degraded"`
+		Blobs    map[string]int `json:"blobs"`
+	}
+	var preview result
+	c.admin(http.MethodPost, "/admin/rebuild-metadata?dryRun=true", naming.RebuildRequest{Merge: true}, &preview)
+	if !preview.DryRun || preview.Files != 2 || preview.Kept != 2 || preview.Added != 0 {
+		t.Errorf("merge preview: %+v", preview)
+	}
+
+	var got result
+	c.admin(http.MethodPost, "/admin/rebuild-metadata", naming.RebuildRequest{Force: true}, &got)
+	if got.Files != 2 || got.Added != 2 || got.Degraded != 1 || got.Blobs["node-a"] != 2 || got.Blobs["node-b"] != 3 {
+		t.Errorf("rebuild: %+v", got)
+	}
+	for name, id := range ids {
+		meta := c.fileInfo(id)
+		if meta.Filename != name || meta.Size != int64(len(data[name])) || meta.Checksum == "" {
+			t.Errorf("rebuilt %s: %+v", name, meta)
+		}
+	}
+	if meta := c.fileInfo(ids["readme.txt"]); meta.State != naming.StateDegraded || len(meta.Replicas) != 1 {
+		t.Errorf("file missing from node-a rebuilt as %s with %d replica(s), want DEGRADED with 1", meta.State, len(meta.Replicas))
+	}
+	if got := c.download(ids["ledger.csv"]); !bytes.Equal(got, data["ledger.csv"]) {
+		t.Error("rebuilt file does not download")
+	}
+}
+
+// TestStartupQuarantine damages two blobs on a stopped node, one cut short
+// and one with a flipped byte. On restart the node quarantines both instead
+// of turning DEGRADED, and the naming service re-creates the replicas.
+func TestStartupQuarantine(t *testing.T) {
+	c := newCluster(t)
+	a := c.addNode("node-a")
+	c.addNode("node-b")
+	data := bytes.Repeat([]byte("quarantine me\n"), 1000)
+	short, flipped := c.upload("short.txt", data), c.upload("flipped.txt", data)
+	c.waitForState(short, naming.StateAvailable)
+	c.waitForState(flipped, naming.StateAvailable)
+
+	c.kill("node-a")
+	blob := func(id string) string { return filepath.Join(a.dir, id[:2], id) }
+	if err := os.Truncate(blob(short), 10); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := os.ReadFile(blob(flipped))
+	b[0] ^= 0xff
+	if err := os.WriteFile(blob(flipped), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c.restart("node-a")
+
+	var health struct {
+		Status      string `json:"status"`
+		Quarantined []struct {
+			FileID string `json:"fileId"`
+			Reason string `json:"reason"`
+		} `json:"quarantined"`
+	}
+	c.waitFor("node-a startup check", func() bool {
+		c.getJSON(a.srv.URL+"/health", &health)
+		return health.Status != "DEGRADED"
+	})
+	if health.Status != "HEALTHY" || len(health.Quarantined) != 2 {
+		t.Fatalf("node-a after restart: %+v", health)
+	}
+	for _, id := range []string{short, flipped} {
+		if _, err := os.Stat(filepath.Join(a.dir, "quarantine", id)); err != nil {
+			t.Errorf("%s not in quarantine: %v", id, err)
+		}
+		meta := c.waitForState(id, naming.StateAvailable)
+		for _, rep := range meta.Replicas {
+			if got := c.readFrom(rep.URL, id); !bytes.Equal(got, data) {
+				t.Errorf("%s on %s: replica differs from the upload", id, rep.NodeID)
+			}
+		}
+	}
+}
+
+// TestChecksumTrailer downloads with ?trailer=checksum: the node sends the
+// checksum of the body it wrote after it, so a blob damaged on disk shows
+// as a trailer that differs from the ETag, and range requests get none.
+func TestChecksumTrailer(t *testing.T) {
+	c := newCluster(t)
+	a := c.addNode("node-a")
+	c.addNode("node-b")
+	data := bytes.Repeat([]byte("trailer\n"), 4096)
+	id := c.upload("trailer.txt", data)
+	c.waitForState(id, naming.StateAvailable)
+
+	get := func(rangeHeader string) (*http.Response, []byte) {
+		req, _ := http.NewRequest(http.MethodGet, a.srv.URL+"/download/"+id+"?trailer=checksum", nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, b
+	}
+	want := c.fileInfo(id).Checksum
+	resp, body := get("")
+	if got := resp.Trailer.Get("X-Content-Checksum"); got != want || !bytes.Equal(body, data) {
+		t.Errorf("trailer %q, want %q", got, want)
+	}
+	if resp, _ = get("bytes=0-9"); resp.StatusCode != http.StatusPartialContent || resp.Trailer.Get("X-Content-Checksum") != "" {
+		t.Errorf("range request: %s with trailer %q", resp.Status, resp.Trailer.Get("X-Content-Checksum"))
+	}
+
+	// damage the blob in place, behind the node's back
+	f, err := os.OpenFile(filepath.Join(a.dir, id[:2], id), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("X"), 0)
+	f.Close()
+	resp, _ = get("")
+	if got := resp.Trailer.Get("X-Content-Checksum"); got == "" || got == want || strings.Trim(resp.Header.Get("ETag"), `"`) != want {
+		t.Errorf("damaged blob: trailer %q, ETag %s", got, resp.Header.Get("ETag"))
+	}
+}
+
+// TestResponseCompression lists files through the naming service's full
+// handler with and without Accept-Encoding: gzip. Both must decode to the
+// same catalog, and only the first may be compressed.
+func TestResponseCompression(t *testing.T) {
+	c := newCluster(t)
+	c.addNode("node-a")
+	c.addNode("node-b")
+	for i := range 20 {
+		c.upload(fmt.Sprintf("listed-%02d.txt", i), []byte("compressed listing"))
+	}
+	srv := httptest.NewServer(c.naming.Handler())
+	defer srv.Close()
+
+	get := func(encoding string) (*http.Response, []byte) {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/list-files", nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, b
+	}
+	resp, zipped := get("gzip, deflate")
+	if resp.Header.Get("Content-Encoding") != "gzip" || resp.Header.Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("gzip accepted: Content-Encoding %q, Vary %q", resp.Header.Get("Content-Encoding"), resp.Header.Get("Vary"))
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(zipped))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unzipped, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, plain := get("identity")
+	if resp.Header.Get("Content-Encoding") != "" || !bytes.Equal(plain, unzipped) {
+		t.Errorf("identity: Content-Encoding %q, body matches gzip one: %v", resp.Header.Get("Content-Encoding"), bytes.Equal(plain, unzipped))
+	}
+	if len(zipped) >= len(plain) {
+		t.Errorf("gzip body is %d bytes, plain %d", len(zipped), len(plain))
+	}
+	for _, refused := range []string{"gzip;q=0", "gzip; q=0.000, deflate", "*;q=1, gzip;q=0", "br, *;q=0"} {
+		if resp, _ = get(refused); resp.Header.Get("Content-Encoding") != "" {
+			t.Errorf("%s got Content-Encoding %q", refused, resp.Header.Get("Content-Encoding"))
+		}
+	}
+	if resp, _ = get("br;q=1, *;q=0.5"); resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("*;q=0.5 got Content-Encoding %q", resp.Header.Get("Content-Encoding"))
+	}
+}
+
+// TestCompressedBlobEncoding reads a blob stored gzip-compressed straight
+// off its node. The stored bytes go out as-is only to a client whose
+// Accept-Encoding allows gzip; everyone else gets them inflated.
+func TestCompressedBlobEncoding(t *testing.T) {
+	c := newCluster(t)
+	c.compression = storagenode.CompressionPolicy{Enabled: true}
+	tn := c.addNode("node-a")
+	c.addNode("node-b")
+	data := bytes.Repeat([]byte("compressed at rest "), 1000)
+	id := c.upload("rest.txt", data)
+
+	// the commit carries the nodes' storedBytes, so the catalog counts the
+	// compressed size against capacity
+	var meta naming.FileMetadata
+	c.getJSON(c.nsURL+"/file-info/"+id, &meta)
+	if meta.StoredSize <= 0 || meta.StoredSize >= int64(len(data)) {
+		t.Errorf("storedSize = %d, want the compressed size below %d", meta.StoredSize, len(data))
+	}
+
+	for encoding, zipped := range map[string]bool{
+		"gzip":               true,
+		"deflate, gzip;q=.5": true,
+		"gzip;q=0":           false,
+		"*;q=1, gzip;q=0":    false,
+		"identity":           false,
+	} {
+		req, _ := http.NewRequest(http.MethodGet, tn.srv.URL+"/download/"+id, nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if got := resp.Header.Get("Content-Encoding") == "gzip"; got != zipped {
+			t.Errorf("%s: Content-Encoding %q", encoding, resp.Header.Get("Content-Encoding"))
+			continue
+		}
+		if zipped {
+			zr, err := gzip.NewReader(bytes.NewReader(b))
+			if err != nil {
+				t.Fatalf("%s: %v", encoding, err)
+			}
+			b, _ = io.ReadAll(zr)
+		}
+		if !bytes.Equal(b, data) {
+			t.Errorf("%s: body is %d bytes, want the %d uploaded", encoding, len(b), len(data))
+		}
+	}
+}
+
+// TestDebugEndpoints turns on a naming service's diagnostics and checks
+// they answer only with the admin token.
+func TestDebugEndpoints(t *testing.T) {
+	sv, err := naming.NewServer(naming.Config{
+		MetadataDir: t.TempDir(),
+		Seed:        naming.DefaultSettings(),
+		AdminToken:  []byte(adminToken),
+		Debug:       true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sv.Close()
+	srv := httptest.NewServer(sv.ServeMux())
+	defer srv.Close()
+
+	get := func(path, token string) (*http.Response, []byte) {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, b
+	}
+	for _, path := range []string{"/debug/status", "/debug/vars", "/debug/pprof/", "/debug/pprof/goroutine?debug=1"} {
+		if resp, _ := get(path, "wrong"); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s with a wrong token: %s", path, resp.Status)
+		}
+		if resp, _ := get(path, adminToken); resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: %s", path, resp.Status)
+		}
+	}
+	_, b := get("/debug/status", adminToken)
+	var st struct {
+		Service    string         `json:"service"`
+		Goroutines int            `json:"goroutines"`
+		Heap       map[string]any `json:"heap"`
+		Locks      map[string]any `json:"locks"`
+		Gauges     map[string]any `json:"gauges"`
+	}
+	if err := json.Unmarshal(b, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Service != "naming-service" || st.Goroutines == 0 || st.Heap["allocBytes"] == nil || st.Locks["waitTotal"] == nil {
+		t.Errorf("status: %s", b)
+	}
+	if _, ok := st.Gauges["openUploads"]; !ok {
+		t.Errorf("status has no openUploads gauge: %s", b)
+	}
+}
+
+// TestNodeHistoryFlapping takes a node down and back three times; each drop
+// is in its /node-history, the third marks it flapping, and new uploads are
+// placed on the steady nodes instead.
+func TestNodeHistoryFlapping(t *testing.T) {
+	c := newCluster(t)
+	c.addNode("node-a")
+	c.addNode("node-b")
+	c.addNode("node-c")
+
+	type history struct {
+		Status      naming.NodeStatus `json:"status"`
+		Flapping    bool              `json:"flapping"`
+		Outages     int               `json:"outages"`
+		Transitions []struct {
+			From   naming.NodeStatus `json:"from"`
+			To     naming.NodeStatus `json:"to"`
+			Reason string            `json:"reason"`
+		} `json:"transitions"`
+	}
+	for i := 0; i < 3; i++ {
+		c.kill("node-c")
+		c.waitFor("node-c DOWN in its history", func() bool {
+			var h history
+			c.getJSON(c.nsURL+"/node-history/node-c", &h)
+			return len(h.Transitions) > 0 && h.Transitions[0].To == naming.NodeDown
+		})
+		c.restart("node-c")
+	}
+	var h history
+	c.getJSON(c.nsURL+"/node-history/node-c", &h)
+	if h.Status != naming.NodeHealthy || h.Outages != 3 || !h.Flapping {
+		t.Fatalf("node-c history: status=%s outages=%d flapping=%v", h.Status, h.Outages, h.Flapping)
+	}
+	if last := h.Transitions[len(h.Transitions)-1]; last.From != "" || last.To != naming.NodeHealthy || last.Reason != "registered" {
+		t.Errorf("first transition = %+v, want registration as HEALTHY", last)
+	}
+	if n, _ := c.nodeInfo("node-c"); !n.Flapping {
+		t.Errorf("node listing does not mark node-c flapping")
+	}
+	c.getJSON(c.nsURL+"/node-history/node-a", &h)
+	if h.Flapping || h.Outages != 0 {
+		t.Errorf("node-a history: outages=%d flapping=%v", h.Outages, h.Flapping)
+	}
+
+	id := c.upload("steady.txt", []byte("placed away from the flapping node"))
+	for _, rep := range c.waitForState(id, naming.StateAvailable).Replicas {
+		if rep.NodeID == "node-c" {
+			t.Errorf("replica placed on flapping node-c: %+v", rep)
+		}
+	}
+
+	resp, err := http.Get(c.nsURL + "/node-history/node-z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown node history: %s", resp.Status)
+	}
+}
+
+// TestAlerts sets rules and channels, takes a node down, and checks the
+// node-down alert fires to the webhook and Slack channels and resolves once
+// the node is back, while a rule with a long hold stays PENDING.
+func TestAlerts(t *testing.T) {
+	c := newCluster(t)
+	c.addNode("node-a")
+	c.addNode("node-b")
+
+	var mu sync.Mutex
+	var notices []map[string]any
+	var slack []string
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path == "/slack" {
+			slack = append(slack, fmt.Sprint(body["text"]))
+		} else {
+			notices = append(notices, body)
+		}
+	}))
+	defer hook.Close()
+	received := func(state string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, n := range notices {
+			if n["rule"] == "node-down" && n["state"] == state {
+				return true
+			}
+		}
+		return false
+	}
+
+	c.admin(http.MethodPut, "/admin/alerts", map[string]any{
+		"rules": []map[string]any{
+			{"id": "node-down", "metric": "downNodes", "threshold": 0, "severity": "critical"},
+			{"id": "node-down-long", "metric": "downNodes", "op": ">=", "threshold": 1, "forSeconds": 3600},
+		},
+		"channels": []map[string]any{
+			{"id": "ops", "kind": "webhook", "url": hook.URL + "/hook", "minSeverity": "critical"},
+			{"id": "chat", "kind": "slack", "url": hook.URL + "/slack"},
+		},
+	}, nil)
+
+	c.kill("node-b")
+	c.waitFor("node-down FIRING notice", func() bool { return received("FIRING") })
+	var st struct {
+		Firing int `json:"firing"`
+		Alerts []struct {
+			ID    string   `json:"id"`
+			State string   `json:"state"`
+			Value *float64 `json:"value"`
+		} `json:"alerts"`
+	}
+	c.getJSON(c.nsURL+"/alerts", &st)
+	states := map[string]string{}
+	for _, a := range st.Alerts {
+		states[a.ID] = a.State
+	}
+	if st.Firing != 1 || states["node-down"] != "FIRING" || states["node-down-long"] != "PENDING" {
+		t.Fatalf("alerts while node-b is down: firing=%d %v", st.Firing, states)
+	}
+	c.getJSON(c.nsURL+"/alerts?state=FIRING", &st)
+	if len(st.Alerts) != 1 || st.Alerts[0].ID != "node-down" || st.Alerts[0].Value == nil || *st.Alerts[0].Value != 1 {
+		t.Errorf("?state=FIRING: %+v", st.Alerts)
+	}
+
+	c.restart("node-b")
+	c.waitFor("node-down RESOLVED notice", func() bool { return received("RESOLVED") })
+	mu.Lock()
+	if !slices.ContainsFunc(slack, func(s string) bool { return strings.HasPrefix(s, "[FIRING] node-down: downNodes is 1") }) {
+		t.Errorf("slack messages: %q", slack)
+	}
+	for _, n := range notices {
+		if n["rule"] == "node-down-long" {
+			t.Errorf("warning sent to a critical-only channel: %v", n)
+		}
+	}
+	mu.Unlock()
+
+	var cfg struct {
+		Channels []map[string]any          `json:"channels"`
+		Delivery map[string]map[string]any `json:"delivery"`
+	}
+	c.admin(http.MethodGet, "/admin/alerts", nil, &cfg)
+	if cfg.Channels[1]["url"] != "********" || cfg.Delivery["ops"]["sent"] != float64(2) {
+		t.Errorf("alert config: %+v", cfg)
+	}
+	// sending the masked URL back keeps the real one
+	c.admin(http.MethodPut, "/admin/alerts", map[string]any{"channels": cfg.Channels}, nil)
+	var test struct {
+		Results map[string]string `json:"results"`
+	}
+	c.admin(http.MethodPost, "/admin/alerts/test?channel=chat", nil, &test)
+	if test.Results["chat"] != "sent" {
+		t.Errorf("test notification: %v", test.Results)
+	}
+}
+
+// TestCapacityForecast grows the cluster's usage between samples and checks
+// /capacity-forecast sees the growth, projects when the nodes fill up, and
+// returns the samples it used.
+func TestCapacityForecast(t *testing.T) {
+	c := newCluster(t)
+	c.addNode("node-a")
+	c.addNode("node-b")
+
+	used := func() int64 {
+		var total int64
+		for _, id := range []string{"node-a", "node-b"} {
+			n, _ := c.nodeInfo(id)
+			total += n.UsedBytes
+		}
+		return total
+	}
+	for i := range 4 {
+		before := used()
+		c.waitForState(c.upload(fmt.Sprintf("grow-%d.bin", i), bytes.Repeat([]byte{byte(i)}, 256<<10)), naming.StateAvailable)
+		c.waitFor("usage reported", func() bool { return used() > before })
+		time.Sleep(120 * time.Millisecond) // a sample or two at this level
+	}
+
+	type outlook struct {
+		NodeID            string     `json:"nodeId"`
+		UsedBytes         int64      `json:"usedBytes"`
+		GrowthBytesPerDay *float64   `json:"growthBytesPerDay"`
+		DaysUntilFull     *float64   `json:"daysUntilFull"`
+		FullAt            *time.Time `json:"fullAt"`
+		Series            []struct {
+			UsedBytes int64 `json:"usedBytes"`
+		} `json:"series"`
+	}
+	var fc struct {
+		Cluster outlook   `json:"cluster"`
+		Nodes   []outlook `json:"nodes"`
+		Plan    struct {
+			NodesToAdd int `json:"nodesToAdd"`
+		} `json:"plan"`
+	}
+	c.getJSON(c.nsURL+"/capacity-forecast?window=1h&series=true", &fc)
+	cl := fc.Cluster
+	if cl.GrowthBytesPerDay == nil || *cl.GrowthBytesPerDay <= 0 || cl.DaysUntilFull == nil || cl.FullAt == nil {
+		t.Fatalf("cluster forecast: %+v", cl)
+	}
+	if len(cl.Series) < 4 || cl.Series[0].UsedBytes >= cl.Series[len(cl.Series)-1].UsedBytes {
+		t.Errorf("cluster series does not show the growth: %+v", cl.Series)
+	}
+	if len(fc.Nodes) != 2 || fc.Nodes[0].NodeID != "node-a" || len(fc.Nodes[0].Series) == 0 {
+		t.Errorf("node forecasts: %+v", fc.Nodes)
+	}
+	// at megabytes a second, 90 days needs far more than two 64 MiB nodes
+	if fc.Plan.NodesToAdd == 0 {
+		t.Errorf("plan asks for no new nodes: %+v", fc.Plan)
+	}
+
+	var plain struct {
+		Cluster outlook `json:"cluster"`
+	}
+	c.getJSON(c.nsURL+"/capacity-forecast", &plain)
+	if plain.Cluster.Series != nil {
+		t.Errorf("series without ?series=true")
+	}
+	resp, err := http.Get(c.nsURL + "/capacity-forecast?window=soon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad window: %s", resp.Status)
+	}
+}
+
+// TestMetricsHistory checks /metrics/history records the cluster over time:
+// an upload shows up in later samples, a lost node in the health counts,
+// and ?step= thins the samples.
+func TestMetricsHistory(t *testing.T) {
+	c := newCluster(t)
+	c.addNode("node-a")
+	c.addNode("node-b")
+
+	type sample struct {
+		At           time.Time                `json:"at"`
+		Files        int                      `json:"files"`
+		FilesByState map[naming.FileState]int `json:"filesByState"`
+		HealthyNodes int                      `json:"healthyNodes"`
+		DownNodes    int                      `json:"downNodes"`
+	}
+	var hist struct {
+		Window  string   `json:"window"`
+		Samples []sample `json:"samples"`
+	}
+	latest := func() sample {
+		c.getJSON(c.nsURL+"/metrics/history?window=1m", &hist)
+		if len(hist.Samples) == 0 {
+			return sample{}
+		}
+		return hist.Samples[len(hist.Samples)-1]
+	}
+
+	c.waitForState(c.upload("charted.txt", []byte("one more file on the chart")), naming.StateAvailable)
+	c.waitFor("a sample with the file", func() bool {
+		s := latest()
+		return s.Files == 1 && s.FilesByState[naming.StateAvailable] == 1 && s.HealthyNodes == 2
+	})
+	c.kill("node-b")
+	c.waitFor("a sample with node-b down", func() bool { return latest().DownNodes == 1 })
+	if hist.Samples[0].Files != 0 || hist.Window != "1m0s" {
+		t.Errorf("first sample has %d files, window %s; want the empty cluster over 1m0s", hist.Samples[0].Files, hist.Window)
+	}
+	for i := 1; i < len(hist.Samples); i++ {
+		if hist.Samples[i].At.Before(hist.Samples[i-1].At) {
+			t.Fatalf("samples out of order at %d", i)
+		}
+	}
+
+	var thin struct {
+		Samples []sample `json:"samples"`
+	}
+	c.getJSON(c.nsURL+"/metrics/history?window=1m&step=1h", &thin)
+	if len(thin.Samples) > 2 || len(thin.Samples) == 0 || thin.Samples[len(thin.Samples)-1].DownNodes != 1 {
+		t.Errorf("step=1h: %+v", thin.Samples)
+	}
+	resp, err := http.Get(c.nsURL + "/metrics/history?step=-1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("negative step: %s", resp.Status)
+	}
+}
+
+// TestAllocateCancelled has a client give up on an allocation while the
+// placement webhook is still deciding, and checks the webhook call is
+// cancelled with it instead of running to PLACEMENT_TIMEOUT, and that
+// nothing is allocated or counted as a webhook failure.
+func TestAllocateCancelled(t *testing.T) {
+	cancelled := make(chan time.Duration, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		_, _ = io.Copy(io.Discard, r.Body) // the server notices a hang-up once the body is read
+		select {
+		case <-r.Context().Done():
+			cancelled <- time.Since(start)
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer hook.Close()
+	sv, err := naming.NewServer(naming.Config{
+		MetadataDir:      t.TempDir(),
+		Seed:             naming.DefaultSettings(),
+		PlacementWebhook: hook.URL,
+		PlacementTimeout: 10 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sv.Close()
+	srv := httptest.NewServer(sv.ServeMux())
+	defer srv.Close()
+	c := &cluster{t: t, nsURL: srv.URL}
+	for _, id := range []string{"node-a", "node-b", "node-c"} {
+		c.postJSON(srv.URL+"/register-node", naming.RegisterNodeRequest{NodeID: id, URL: "http://" + id + ".invalid", CapacityBytes: 1 << 30}, nil)
+	}
+
+	b, _ := json.Marshal(naming.AllocateRequest{Filename: "slow.txt", Size: 5, Checksum: "sha256:x"})
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/allocate", bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", "cancelled-allocate") // as the gateway sends
+	client := &http.Client{Timeout: 200 * time.Millisecond}
+	if resp, err := client.Do(req); err == nil {
+		resp.Body.Close()
+		t.Fatalf("allocate answered %s while the webhook was deciding", resp.Status)
+	}
+	select {
+	case took := <-cancelled:
+		if took > 2*time.Second {
+			t.Errorf("webhook call cancelled after %s", took)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("webhook call was not cancelled with the client")
+	}
+
+	var m struct {
+		TotalFiles int            `json:"totalFiles"`
+		Placement  map[string]any `json:"placement"`
+	}
+	time.Sleep(100 * time.Millisecond) // the handler returns just after the webhook call
+	c.getJSON(srv.URL+"/metrics", &m)
+	if m.TotalFiles != 0 || m.Placement["fallbacks"] != float64(0) {
+		t.Errorf("after a cancelled allocate: files=%d placement=%v", m.TotalFiles, m.Placement)
+	}
+}
+
+// TestCatalogWritesCoalesced checks that with a long PersistInterval the
+// first change is written at once, later ones wait for the interval, and
+// Close writes whatever is still pending.
+func TestCatalogWritesCoalesced(t *testing.T) {
+	dir := t.TempDir()
+	sv, err := naming.NewServer(naming.Config{
+		MetadataDir:     dir,
+		Seed:            naming.DefaultSettings(),
+		PersistInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(sv.ServeMux())
+	defer srv.Close()
+	c := &cluster{t: t, nsURL: srv.URL}
+	onDisk := func(id string) bool {
+		b, _ := os.ReadFile(filepath.Join(dir, "nodes.json"))
+		return strings.Contains(string(b), `"`+id+`"`)
+	}
+	register := func(id string) {
+		c.postJSON(srv.URL+"/register-node", naming.RegisterNodeRequest{NodeID: id, URL: "http://" + id + ".invalid", CapacityBytes: 1 << 30}, nil)
+	}
+
+	register("node-a")
+	c.waitFor("node-a written", func() bool { return onDisk("node-a") })
+	register("node-b")
+	register("node-c")
+	time.Sleep(200 * time.Millisecond)
+	if onDisk("node-b") || onDisk("node-c") {
+		t.Error("changes written before PersistInterval was up")
+	}
+	sv.Close()
+	if !onDisk("node-b") || !onDisk("node-c") {
+		t.Error("Close did not write the pending changes")
+	}
+}
+
+// TestCatalogJournalReplayed checks that file changes go to files.journal
+// rather than rewriting files.json, that a naming service which was never
+// closed, as after a crash, is rebuilt from the journal, and that Close
+// compacts the journal into files.json.
+func TestCatalogJournalReplayed(t *testing.T) {
+	dir := t.TempDir()
+	open := func() (*naming.Server, *cluster) {
+		sv, err := naming.NewServer(naming.Config{MetadataDir: dir, Seed: naming.DefaultSettings()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := httptest.NewServer(sv.ServeMux())
+		t.Cleanup(srv.Close)
+		return sv, &cluster{t: t, nsURL: srv.URL}
+	}
+	journal := func() string {
+		b, _ := os.ReadFile(filepath.Join(dir, "files.journal"))
+		return string(b)
+	}
+
+	first, c := open()
+	defer first.Close()
+	for _, id := range []string{"node-a", "node-b", "node-c"} {
+		c.postJSON(c.nsURL+"/register-node", naming.RegisterNodeRequest{NodeID: id, URL: "http://" + id + ".invalid", CapacityBytes: 1 << 30}, nil)
+	}
+	var ids []string
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		var alloc struct {
+			FileID string `json:"fileId"`
+		}
+		c.postJSON(c.nsURL+"/allocate", naming.AllocateRequest{Filename: name, Size: 5, Checksum: "sha256:" + name}, &alloc)
+		ids = append(ids, alloc.FileID)
+	}
+	c.postJSON(c.nsURL+"/rename-file", naming.RenameFileRequest{FileID: ids[1], Filename: "renamed.txt"}, nil)
+	c.waitFor("rename journaled", func() bool { return strings.Contains(journal(), "renamed.txt") })
+	if _, err := os.Stat(filepath.Join(dir, "files.json")); err == nil {
+		t.Error("files.json rewritten for a handful of changes")
+	}
+
+	second, c2 := open()
+	for i, want := range []string{"a.txt", "renamed.txt", "c.txt"} {
+		var meta naming.FileMetadata
+		c2.getJSON(c2.nsURL+"/file-info/"+ids[i], &meta)
+		if meta.Filename != want {
+			t.Errorf("%s after restart: filename %q, want %q", ids[i], meta.Filename, want)
+		}
+	}
+	second.Close()
+	if journal() != "" {
+		t.Error("Close left the journal behind")
+	}
+	b, _ := os.ReadFile(filepath.Join(dir, "files.json"))
+	if !strings.Contains(string(b), "renamed.txt") {
+		t.Error("Close did not compact the journal into files.json")
+	}
+}
+
+// TestUploadTicketsRequired gives the naming service and the nodes one
+// ticket secret and checks that a node then refuses uploads without a
+// ticket, still takes the snapshots the naming service signs for, and
+// answers browsers only from the gateway's origin.
+func TestUploadTicketsRequired(t *testing.T) {
+	c := newTicketCluster(t, []byte("e2e-tickets"))
+	tn := c.addNode("node-a")
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	_ = mw.WriteField("fileId", "no-ticket")
+	fw, _ := mw.CreateFormFile("file", "x.txt")
+	fw.Write([]byte("hello"))
+	mw.Close()
+	req, _ := http.NewRequest(http.MethodPost, tn.srv.URL+"/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Origin", "https://elsewhere.test")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("upload without a ticket: %s, want 403", resp.Status)
+	}
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("answered a foreign origin with Access-Control-Allow-Origin %q", got)
+	}
+
+	req, _ = http.NewRequest(http.MethodOptions, tn.srv.URL+"/upload", nil)
+	req.Header.Set("Origin", gatewayOrigin)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != gatewayOrigin {
+		t.Errorf("preflight from the gateway: Access-Control-Allow-Origin %q, want %q", got, gatewayOrigin)
+	}
+
+	var stored struct {
+		StoredOn []struct {
+			NodeID string `json:"nodeId"`
+		} `json:"storedOn"`
+	}
+	c.admin(http.MethodPost, "/admin/snapshot", naming.SnapshotRequest{Copies: 1}, &stored)
+	if len(stored.StoredOn) != 1 {
+		t.Errorf("snapshot with a signed ticket stored on %+v, want node-a", stored.StoredOn)
+	}
+}
+
+// TestAdminDryRuns previews a replication change, a node drain and new
+// lifecycle rules with ?dryRun=true and checks that none of them applied.
+func TestAdminDryRuns(t *testing.T) {
+	c := newCluster(t)
+	c.addNode("node-a")
+	c.addNode("node-b")
+	data := []byte("scratch data")
+	id := c.upload("tmp/a.txt", data)
+	size := int64(len(data))
+
+	var repl struct {
+		DryRun bool     `json:"dryRun"`
+		Files  []string `json:"files"`
+		Bytes  int64    `json:"bytes"`
+		Trims  int      `json:"trims"`
+	}
+	c.admin(http.MethodPost, "/admin/set-replication?dryRun=true", naming.SetReplicationRequest{FileID: id, Factor: 1}, &repl)
+	if !repl.DryRun || !slices.Equal(repl.Files, []string{id}) || repl.Trims != 1 || repl.Bytes != size {
+		t.Errorf("set-replication preview: %+v", repl)
+	}
+	if meta := c.fileInfo(id); meta.ReplicationFactor != 0 || len(meta.Replicas) != 2 {
+		t.Errorf("dry run changed the file: factor %d, %d replicas", meta.ReplicationFactor, len(meta.Replicas))
+	}
+
+	var drain struct {
+		DryRun bool     `json:"dryRun"`
+		Files  []string `json:"files"`
+		Nodes  []string `json:"nodes"`
+		Bytes  int64    `json:"bytes"`
+	}
+	c.admin(http.MethodPost, "/admin/node-maintenance?dryRun=true", naming.NodeMaintenanceRequest{NodeID: "node-a", Enabled: true}, &drain)
+	if !drain.DryRun || !slices.Equal(drain.Files, []string{id}) || !slices.Equal(drain.Nodes, []string{"node-a"}) || drain.Bytes != size {
+		t.Errorf("node-maintenance preview: %+v", drain)
+	}
+	if n, _ := c.nodeInfo("node-a"); n.Maintenance {
+		t.Error("dry run put node-a into maintenance")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	var pass struct {
+		DryRun bool `json:"dryRun"`
+		Steps  []struct {
+			FileID string `json:"fileId"`
+		} `json:"steps"`
+	}
+	rules := map[string]any{"rules": []map[string]any{{"id": "tmp", "action": "expire", "prefix": "tmp/", "afterDays": 1e-6}}}
+	c.admin(http.MethodPut, "/admin/lifecycle?dryRun=true", rules, &pass)
+	if !pass.DryRun || len(pass.Steps) != 1 || pass.Steps[0].FileID != id {
+		t.Errorf("lifecycle preview: %+v", pass)
+	}
+	var saved struct {
+		Rules []any `json:"rules"`
+	}
+	c.getJSON(c.nsURL+"/lifecycle", &saved)
+	if len(saved.Rules) != 0 {
+		t.Errorf("dry run saved the rules: %v", saved.Rules)
+	}
+	if meta := c.fileInfo(id); meta.State != naming.StateAvailable {
+		t.Errorf("file is %s after the previews", meta.State)
+	}
+}
+
+// TestCancelNeedsAdmin checks that POST /operations/cancel is behind the
+// admin token like the /admin endpoints.
+func TestCancelNeedsAdmin(t *testing.T) {
+	c := newCluster(t)
+	cancel := func(token string) int {
+		req, _ := http.NewRequest(http.MethodPost, c.nsURL+"/operations/cancel", strings.NewReader(`{"id":"no-such-op"}`))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := cancel(""); code != http.StatusUnauthorized {
+		t.Errorf("cancel without a token: %d, want 401", code)
+	}
+	if code := cancel("wrong"); code != http.StatusUnauthorized {
+		t.Errorf("cancel with a wrong token: %d, want 401", code)
+	}
+	if code := cancel(adminToken); code != http.StatusNotFound {
+		t.Errorf("cancel of an unknown operation with the token: %d, want 404", code)
+	}
+}
+
+// TestAuditNeedsAdmin checks that POST /audit refuses entries without the
+// admin token, and that a node still records its own shutdown with it.
+func TestAuditNeedsAdmin(t *testing.T) {
+	c := newCluster(t)
+	tn := c.addNode("a")
+	record := func(token string) int {
+		req, _ := http.NewRequest(http.MethodPost, c.nsURL+"/audit", strings.NewReader(`{"actor":"alice","action":"forged","target":"x"}`))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := record(""); code != http.StatusUnauthorized {
+		t.Errorf("audit without a token: %d, want 401", code)
+	}
+	if code := record("wrong"); code != http.StatusUnauthorized {
+		t.Errorf("audit with a wrong token: %d, want 401", code)
+	}
+	var entries []struct{ Actor, Action, Target string }
+	c.getJSON(c.nsURL+"/audit?action=forged", &entries)
+	if len(entries) != 0 {
+		t.Fatalf("entries recorded without the token: %+v", entries)
+	}
+	if code := record(adminToken); code != http.StatusOK {
+		t.Errorf("audit with the token: %d, want 200", code)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1:"+tn.port+"/admin/stop", nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	c.getJSON(c.nsURL+"/audit?action=node-shutdown", &entries)
+	if len(entries) != 1 || entries[0].Target != "a" {
+		t.Errorf("node-shutdown entries = %+v, want one for a", entries)
+	}
+}
+
+// TestServersKeepOwnSettings runs two naming services in one process, one
+// with an extra placement strategy, and checks that neither sees the
+// other's settings or strategies.
+func TestServersKeepOwnSettings(t *testing.T) {
+	const first naming.PlacementPolicy = "first-node"
+	open := func(seed naming.Settings, extra map[naming.PlacementPolicy]naming.PlacementStrategy) *cluster {
+		sv, err := naming.NewServer(naming.Config{MetadataDir: t.TempDir(), Seed: seed, Placements: extra, AdminToken: []byte(adminToken)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(sv.Close)
+		srv := httptest.NewServer(sv.ServeMux())
+		t.Cleanup(srv.Close)
+		return &cluster{t: t, nsURL: srv.URL}
+	}
+	seed := naming.DefaultSettings()
+	seed.PlacementPolicy, seed.ReplicationFactor = first, 1
+	custom := open(seed, map[naming.PlacementPolicy]naming.PlacementStrategy{
+		first: naming.PlacementFunc(func(_ naming.PlacementFile, cands []*naming.NodeInfo, factor int) []*naming.NodeInfo {
+			slices.SortFunc(cands, func(a, b *naming.NodeInfo) int { return strings.Compare(a.NodeID, b.NodeID) })
+			return cands[:factor]
+		}),
+	})
+	plain := open(naming.DefaultSettings(), nil)
+
+	if _, err := naming.NewServer(naming.Config{MetadataDir: t.TempDir(), Seed: seed}); err == nil {
+		t.Error("a server without the strategy accepted settings naming it")
+	}
+
+	var policy struct {
+		Policy    naming.PlacementPolicy   `json:"policy"`
+		Available []naming.PlacementPolicy `json:"available"`
+	}
+	custom.admin(http.MethodGet, "/admin/placement-policy", nil, &policy)
+	if policy.Policy != first || !slices.Contains(policy.Available, first) {
+		t.Errorf("custom server: %+v", policy)
+	}
+	plain.admin(http.MethodGet, "/admin/placement-policy", nil, &policy)
+	if policy.Policy != naming.PlaceLeastLoaded || slices.Contains(policy.Available, first) {
+		t.Errorf("plain server sees the other's strategy: %+v", policy)
+	}
+	var settings naming.Settings
+	plain.admin(http.MethodGet, "/admin/settings", nil, &settings)
+	if settings.ReplicationFactor != 2 {
+		t.Errorf("plain server has replication factor %d, want its own 2", settings.ReplicationFactor)
+	}
+
+	for _, id := range []string{"node-c", "node-a", "node-b"} {
+		custom.postJSON(custom.nsURL+"/register-node", naming.RegisterNodeRequest{NodeID: id, URL: "http://" + id + ".invalid", CapacityBytes: 1 << 30}, nil)
+	}
+	var alloc struct {
+		Replicas []struct {
+			NodeID string `json:"nodeId"`
+		} `json:"replicas"`
+	}
+	custom.postJSON(custom.nsURL+"/allocate", naming.AllocateRequest{Filename: "a.txt", Size: 5, Checksum: "sha256:a"}, &alloc)
+	if len(alloc.Replicas) != 1 || alloc.Replicas[0].NodeID != "node-a" {
+		t.Errorf("placed on %+v, want node-a alone", alloc.Replicas)
+	}
+}
+
+// TestServersKeepOwnNodeCalls opens a second naming service whose node
+// calls break after one failure, then has the first verify a file on a
+// dead node. The first keeps its own policy, so no circuit opens there.
+func TestServersKeepOwnNodeCalls(t *testing.T) {
+	c := newCluster(t)
+	c.addNode("node-a")
+	c.addNode("node-b")
+	id := c.upload("calls.txt", []byte("each server its own breaker"))
+
+	other, err := naming.NewServer(naming.Config{
+		MetadataDir: t.TempDir(),
+		Seed:        naming.DefaultSettings(),
+		NodeCalls:   naming.CallPolicy{Attempts: 1, BreakAfter: 1, OpenFor: time.Hour},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	c.kill("node-a")
+	c.getJSON(c.nsURL+"/verify-file/"+id, nil)
+	var metrics struct {
+		Nodes struct {
+			OpenCircuits int `json:"openCircuits"`
+		} `json:"nodes"`
+	}
+	c.getJSON(c.nsURL+"/metrics", &metrics)
+	if metrics.Nodes.OpenCircuits != 0 {
+		t.Errorf("%d circuits open on a server without a breaker", metrics.Nodes.OpenCircuits)
+	}
+}
+
+// TestShardsMintOwnedIDs runs a catalog split in two and checks that each
+// shard only hands out file IDs that hash to it, and refuses an overwrite
+// of the other shard's file with 421 WRONG_SHARD.
+func TestShardsMintOwnedIDs(t *testing.T) {
+	shards := make([]*cluster, 2)
+	for i := range shards {
+		sv, err := naming.NewServer(naming.Config{
+			MetadataDir: t.TempDir(),
+			Seed:        naming.DefaultSettings(),
+			Shard:       naming.Shard{Index: i, Count: 2},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := httptest.NewServer(sv.ServeMux())
+		t.Cleanup(func() { srv.Close(); sv.Close() })
+		c := &cluster{t: t, nsURL: srv.URL}
+		c.postJSON(srv.URL+"/register-node", naming.RegisterNodeRequest{NodeID: "node-a", URL: "http://node-a.invalid", CapacityBytes: 1 << 30}, nil)
+		c.postJSON(srv.URL+"/register-node", naming.RegisterNodeRequest{NodeID: "node-b", URL: "http://node-b.invalid", CapacityBytes: 1 << 30}, nil)
+		shards[i] = c
+	}
+
+	owned := make([]string, 2)
+	for i, c := range shards {
+		for n := range 8 {
+			var alloc struct {
+				FileID string `json:"fileId"`
+			}
+			name := fmt.Sprintf("f%d.txt", n)
+			c.postJSON(c.nsURL+"/allocate", naming.AllocateRequest{Filename: name, Size: 5, Checksum: "sha256:" + name}, &alloc)
+			if got := naming.ShardOf(alloc.FileID, 2); got != i {
+				t.Errorf("shard %d minted %s, which hashes to shard %d", i, alloc.FileID, got)
+			}
+			owned[i] = alloc.FileID
+		}
+	}
+
+	b, _ := json.Marshal(naming.AllocateRequest{Filename: "f0.txt", Size: 5, Checksum: "sha256:x", FileID: owned[1]})
+	resp, err := http.Post(shards[0].nsURL+"/allocate", "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e apierr.Error
+	_ = json.NewDecoder(resp.Body).Decode(&e)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMisdirectedRequest || e.Code != apierr.WrongShard {
+		t.Errorf("overwrite of shard 1's file on shard 0 = %d %s, want 421 %s", resp.StatusCode, e.Code, apierr.WrongShard)
+	}
+}
+
+// shardVector pins ShardOf. The gateway's shardOf, a copy it keeps because
+// it cannot import this module, is checked against the same table in
+// ui_gateway/internal/gateway; change both together.
+var shardVector = []struct {
+	id    string
+	count int
+	want  int
+}{
+	{"", 2, 1},
+	{"alice", 3, 2},
+	{"bob", 7, 3},
+	{"report.pdf", 7, 0},
+	{"0c5b2a4e-9f1d-4c3b-8a7e-2d6f1b9e3a10", 2, 0},
+	{"70868dc9-fbbd-bdc0-e198-76f605e85917", 7, 5},
+	{"70868dc9-fbbd-bdc0-e198-76f605e85917", 1, 0},
+}
+
+func TestShardOfVector(t *testing.T) {
+	for _, tc := range shardVector {
+		if got := naming.ShardOf(tc.id, tc.count); got != tc.want {
+			t.Errorf("ShardOf(%q, %d) = %d, want %d", tc.id, tc.count, got, tc.want)
+		}
+	}
+}
+
+// TestBatchAllOrNothing checks that POST /batch changes nothing when one
+// file of it cannot be applied, and commits or deletes every file when
+// all can.
+func TestBatchAllOrNothing(t *testing.T) {
+	sv, err := naming.NewServer(naming.Config{MetadataDir: t.TempDir(), Seed: naming.DefaultSettings()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(sv.ServeMux())
+	t.Cleanup(func() { srv.Close(); sv.Close() })
+	c := &cluster{t: t, nsURL: srv.URL}
+	for _, id := range []string{"node-a", "node-b"} {
+		c.postJSON(srv.URL+"/register-node", naming.RegisterNodeRequest{NodeID: id, URL: "http://" + id + ".invalid", CapacityBytes: 1 << 30}, nil)
+	}
+	var ids []string
+	for _, name := range []string{"part-1.csv", "part-2.csv", "part-3.csv"} {
+		var alloc struct {
+			FileID string `json:"fileId"`
+		}
+		c.postJSON(srv.URL+"/allocate", naming.AllocateRequest{Filename: name, Size: 5, Checksum: "sha256:" + name}, &alloc)
+		ids = append(ids, alloc.FileID)
+	}
+	both := []string{"node-a", "node-b"}
+	batch := func(req naming.BatchRequest) (int, apierr.Error) {
+		b, _ := json.Marshal(req)
+		resp, err := http.Post(srv.URL+"/batch", "application/json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var e apierr.Error
+		_ = json.NewDecoder(resp.Body).Decode(&e)
+		return resp.StatusCode, e
+	}
+
+	// the last part reached no node
+	status, e := batch(naming.BatchRequest{Commit: []naming.CommitRequest{
+		{FileID: ids[0], Uploaded: both}, {FileID: ids[1], Uploaded: both}, {FileID: ids[2]},
+	}})
+	if status != http.StatusConflict || e.Code != apierr.Conflict {
+		t.Fatalf("batch with a short commit = %d %s, want 409 %s", status, e.Code, apierr.Conflict)
+	}
+	if meta := c.fileInfo(ids[0]); meta.State != naming.StateAllocated {
+		t.Errorf("refused batch committed %s anyway: %s", ids[0], meta.State)
+	}
+
+	status, _ = batch(naming.BatchRequest{Commit: []naming.CommitRequest{
+		{FileID: ids[0], Uploaded: both}, {FileID: ids[1], Uploaded: both}, {FileID: ids[2], Uploaded: both},
+	}})
+	if status != http.StatusOK {
+		t.Fatalf("batch commit = %d", status)
+	}
+	for _, id := range ids {
+		if meta := c.fileInfo(id); meta.State != naming.StateAvailable {
+			t.Errorf("%s after batch commit: %s", id, meta.State)
+		}
+	}
+
+	if status, e = batch(naming.BatchRequest{Delete: []string{ids[0], "no-such-file"}}); status != http.StatusConflict {
+		t.Fatalf("batch delete of an unknown file = %d %s, want 409", status, e.Code)
+	}
+	c.fileInfo(ids[0]) // still there
+
+	var plan struct {
+		DryRun bool
+		Commit []string
+		Delete struct {
+			Files []string
+			Nodes []string
+			Bytes int64
+		}
+	}
+	c.postJSON(srv.URL+"/batch?dryRun=true", naming.BatchRequest{Delete: ids[:2]}, &plan)
+	if !plan.DryRun || len(plan.Delete.Files) != 2 || len(plan.Delete.Nodes) != 2 || plan.Delete.Bytes != 20 {
+		t.Errorf("batch delete dry run = %+v, want 2 files of 5 bytes on 2 nodes", plan)
+	}
+	c.fileInfo(ids[0]) // a dry run deletes nothing
+
+	if status, _ = batch(naming.BatchRequest{Delete: ids[:2]}); status != http.StatusOK {
+		t.Fatalf("batch delete = %d", status)
+	}
+	for i, id := range ids {
+		resp, err := http.Get(srv.URL + "/file-info/" + id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if gone := resp.StatusCode == http.StatusNotFound; gone != (i < 2) {
+			t.Errorf("%s after deleting the first two: status %d", id, resp.StatusCode)
+		}
+	}
+
+	// both deletes were tombstoned, so repeating the batch is a no-op
+	if status, e = batch(naming.BatchRequest{Delete: ids[:2]}); status != http.StatusOK {
+		t.Errorf("repeated batch delete = %d %s, want 200", status, e.Code)
+	}
+}
+
+// TestStartupCopyInStep checks that the ui_gateway module's copy of
+// internal/startup, which it cannot import, matches the original.
+func TestStartupCopyInStep(t *testing.T) {
+	orig, err := os.ReadFile(filepath.Join("..", "startup", "startup.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp, err := os.ReadFile(filepath.Join("..", "..", "ui_gateway", "internal", "startup", "startup.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(orig, cp) {
+		t.Error("ui_gateway/internal/startup/startup.go differs from internal/startup/startup.go")
+	}
+}
@@ -0,0 +1,11413 @@
+// Package naming is the naming service: it owns the file catalog, places
+// replicas on storage nodes, tracks node health and heals under-replicated
+// files. naming_service/main.go wires it to the environment.
+package naming
+
+import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ProjectAkhir/internal/apierr"
+	"ProjectAkhir/internal/diag"
+)
+
+/* ==================== TYPES ==================== */
+
+type ReplicaStatus string
+
+const (
+	ReplicaReady   ReplicaStatus = "READY"
+	ReplicaMissing ReplicaStatus = "MISSING"
+	ReplicaStale   ReplicaStatus = "STALE"
+	// ReplicaTrimming marks a surplus copy being removed after the file's
+	// replication factor was lowered; it is no longer served.
+	ReplicaTrimming ReplicaStatus = "TRIMMING"
+)
+
+type FileState string
+
+const (
+	StateAllocated FileState = "ALLOCATED"
+	StatePartial   FileState = "PARTIAL"
+	StateAvailable FileState = "AVAILABLE"
+	StateDegraded  FileState = "DEGRADED"
+	StateDeleted   FileState = "DELETED"
+	// StateCorrupt quarantines a file whose replicas all failed verification.
+	StateCorrupt FileState = "CORRUPT"
+)
+
+// ReadPolicy decides whether files that are not fully replicated and
+// verified (DEGRADED, PARTIAL) may be served.
+type ReadPolicy string
+
+const (
+	ReadStrict  ReadPolicy = "strict"  // refuse with 503
+	ReadLenient ReadPolicy = "lenient" // serve with a warning header
+)
+
+const degradedReadHeader = "X-Degraded-Read"
+
+type NodeStatus string
+
+const (
+	NodeHealthy NodeStatus = "HEALTHY"
+	NodeSuspect NodeStatus = "SUSPECT"
+	NodeDown    NodeStatus = "DOWN"
+	// NodeMaintenance is reported for a healthy node an operator has drained
+	// with /admin/node-maintenance: it still serves reads but gets no new
+	// replicas.
+	NodeMaintenance NodeStatus = "MAINTENANCE"
+	// NodeReadOnly is reported for a healthy node that is low on disk space.
+	NodeReadOnly NodeStatus = "READ_ONLY"
+)
+
+type ReplicaInfo struct {
+	NodeID         string        `json:"nodeId"`
+	URL            string        `json:"url"`
+	Status         ReplicaStatus `json:"status"`
+	LastVerifiedAt time.Time     `json:"lastVerifiedAt"`
+	// Version is the file version this replica holds; a replica behind
+	// FileMetadata.Version is STALE.
+	Version int `json:"version,omitempty"`
+	// MismatchChecksum is what the node hashed when verification found its
+	// content differs from the committed checksum.
+	MismatchChecksum string `json:"mismatchChecksum,omitempty"`
+}
+
+type FileMetadata struct {
+	FileID      string        `json:"fileId"`
+	Filename    string        `json:"filename"`
+	Size        int64         `json:"size"`
+	StoredSize  int64         `json:"storedSize"`
+	Checksum    string        `json:"checksum"`
+	ContentType string        `json:"contentType"`
+	Version     int           `json:"version"`
+	Replicas    []ReplicaInfo `json:"replicas"`
+	State       FileState     `json:"state"`
+	CreatedAt   time.Time     `json:"createdAt"`
+	UpdatedAt   time.Time     `json:"updatedAt"`
+	// OverrideServe lets an operator serve a CORRUPT file anyway.
+	OverrideServe bool `json:"overrideServe,omitempty"`
+	// ReplicationFactor overrides the cluster default for this file; 0
+	// means the default. Changed with /admin/set-replication.
+	ReplicationFactor int `json:"replicationFactor,omitempty"`
+	// Placement holds the hints the file was allocated with, e.g.
+	// "prefer:ssd"; auto-heal honors them when it picks new nodes.
+	Placement []string `json:"placement,omitempty"`
+	// StorageClass sets the file's default replication factor and adds its
+	// placement hints; empty means STANDARD. See StorageClasses.
+	StorageClass StorageClass `json:"storageClass,omitempty"`
+	// Origin is the cluster ID a geo-replicated file was pushed from;
+	// empty for files uploaded here.
+	Origin string `json:"origin,omitempty"`
+	// LastReadAt is the last heartbeat that reported a download of the
+	// file; lifecycle rules use it to find inactive files.
+	LastReadAt time.Time `json:"lastReadAt,omitempty"`
+	// AccessCount counts the lookups that resolved the file for a read, and
+	// LastAccessedAt is the later of the last such lookup and LastReadAt.
+	// Cached downloads only show up here, since no node serves them.
+	AccessCount    int64     `json:"accessCount,omitempty"`
+	LastAccessedAt time.Time `json:"lastAccessedAt,omitempty"`
+	// Owner is the tenant or user the file counts against for quotas; it
+	// is set at allocation and kept across overwrites.
+	Owner string `json:"owner,omitempty"`
+	// DetectedContentType is what the gateway sniffed from the first bytes
+	// of the upload; ContentType stays what the client declared.
+	DetectedContentType string `json:"detectedContentType,omitempty"`
+	// A derived file, such as a preview, names the file it was made from
+	// in ParentID; the parent maps each kind of derived file to its ID.
+	// Derived files are left out of /list-files and deleted with the parent.
+	ParentID string            `json:"parentId,omitempty"`
+	Derived  map[string]string `json:"derived,omitempty"`
+	// ACL grants other users and groups access to an owned file; see
+	// ACLEntry. The gateway enforces it.
+	ACL []ACLEntry `json:"acl,omitempty"`
+	// CommittedVersion is the last Version a commit reached quorum for; a
+	// repeated commit of it changes nothing.
+	CommittedVersion int `json:"committedVersion,omitempty"`
+	// ConflictID is set while the file is in an open Conflict with other
+	// uploads of its name.
+	ConflictID string `json:"conflictId,omitempty"`
+}
+
+// File permissions granted by an ACLEntry.
+const (
+	PermRead   = "read"   // download, look up, share
+	PermWrite  = "write"  // upload a new version, rename
+	PermDelete = "delete" // delete
+)
+
+// ACLEntry grants Permissions on a file to Subject: "user:<name>",
+// "group:<name>" or "*" for anyone. The owner has every permission, and a
+// file with neither owner nor ACL is open to everyone.
+type ACLEntry struct {
+	Subject     string   `json:"subject"`
+	Permissions []string `json:"permissions"`
+}
+
+// clone copies meta so it can be read after the store lock is released.
+func (meta *FileMetadata) clone() *FileMetadata {
+	c := *meta
+	c.Replicas = append([]ReplicaInfo(nil), meta.Replicas...)
+	c.Derived = maps.Clone(meta.Derived)
+	c.ACL = append([]ACLEntry(nil), meta.ACL...)
+	return &c
+}
+
+type NodeInfo struct {
+	NodeID        string     `json:"nodeId"`
+	URL           string     `json:"url"`
+	CapacityBytes int64      `json:"capacityBytes"`
+	UsedBytes     int64      `json:"usedBytes"`
+	Status        NodeStatus `json:"status"`
+	LastSeenAt    time.Time  `json:"lastSeenAt"`
+	Zone          string     `json:"zone,omitempty"`
+	Tags          []string   `json:"tags,omitempty"`
+	// Weight scales the node's share of new replicas: at weight 2 it is
+	// treated as half as loaded as its usage says. 0 means 1.
+	Weight      float64   `json:"weight,omitempty"`
+	LastChosen  time.Time `json:"lastChosen"`
+	HeartbeatMs int64     `json:"heartbeatIntervalMs,omitempty"`
+	Version     string    `json:"version,omitempty"`
+	// LastPeerSeenAt is the last time another storage node reported this
+	// node reachable; it lets a node partitioned from the naming service stay
+	// SUSPECT instead of being declared DOWN.
+	LastPeerSeenAt time.Time `json:"lastPeerSeenAt,omitempty"`
+	// Degraded is set by the node itself while its startup integrity check
+	// is running or has found bad blobs; degraded nodes get no new replicas.
+	Degraded bool `json:"degraded,omitempty"`
+	// Maintenance is set by an operator and survives re-registration.
+	Maintenance bool `json:"maintenance,omitempty"`
+	// Discovered nodes were found through DNS or Consul rather than
+	// registering themselves; see discover.
+	Discovered bool `json:"discovered,omitempty"`
+	// ReadOnly is reported by the node when its disk is below its free-space
+	// threshold; like Degraded, it keeps the node out of placement.
+	ReadOnly      bool  `json:"readOnly,omitempty"`
+	DiskFreeBytes int64 `json:"diskFreeBytes,omitempty"`
+	// Flapping is set while the node has dropped out of HEALTHY at least
+	// flapThreshold times within flapWindow; see steadyFirst.
+	Flapping bool `json:"flapping,omitempty"`
+}
+
+/* ============== IN-MEM STORE + PERSIST ============== */
+
+type Store struct {
+	mu        sync.RWMutex
+	files     map[string]*FileMetadata // fileId -> meta
+	nodes     map[string]*NodeInfo     // nodeId -> info
+	filesPath string
+	nodesPath string
+	clusterID string // generated once at bootstrap, see cluster.json
+
+	// journalPath holds the file changes made since files.json was last
+	// written, one JSON line each; see save.
+	journalPath string
+
+	// revision is bumped on every catalog change (files or node membership)
+	// and persisted in revision.json, so clients can tell whether anything
+	// changed between two polls.
+	revision     uint64
+	revisionPath string
+
+	settingsPath string
+
+	quotas    *quotaBook    // guarded by mu
+	shares    *shareBook    // guarded by mu
+	conflicts *conflictBook // guarded by mu
+
+	saver *coalescer // runs save
+
+	dirty     map[string]bool // fileIds changed since the last save; guarded by mu
+	rewrite   bool            // the next save writes files.json whole; guarded by mu
+	journaled int             // entries in the journal; only save touches it
+	failed    bool            // the last save could not write; only save touches it
+}
+
+// NewStore loads the catalog from base. Changes are written back at most
+// once per persistEvery; see persist.
+func NewStore(base string, persistEvery time.Duration) (*Store, error) {
+	if err := os.MkdirAll(base, 0755); err != nil {
+		return nil, err
+	}
+	s := &Store{
+		files:     map[string]*FileMetadata{},
+		nodes:     map[string]*NodeInfo{},
+		filesPath: filepath.Join(base, "files.json"),
+		nodesPath: filepath.Join(base, "nodes.json"),
+		dirty:     map[string]bool{},
+
+		journalPath:  filepath.Join(base, "files.journal"),
+		revisionPath: filepath.Join(base, "revision.json"),
+		settingsPath: filepath.Join(base, "settings.json"),
+	}
+	_ = s.load()
+	quotas, err := openQuotaBook(filepath.Join(base, "quotas.json"), s.files)
+	if err != nil {
+		return nil, err
+	}
+	s.quotas = quotas
+	if s.shares, err = openShareBook(filepath.Join(base, "shares.json")); err != nil {
+		return nil, err
+	}
+	if s.conflicts, err = openConflictBook(filepath.Join(base, "conflicts.json")); err != nil {
+		return nil, err
+	}
+	if err := s.loadClusterID(filepath.Join(base, "cluster.json")); err != nil {
+		return nil, err
+	}
+	s.saver = newCoalescer(persistEvery, s.save)
+	return s, nil
+}
+
+// loadClusterID reads the cluster identity, generating and persisting a new
+// one the first time the naming service boots against an empty metadata dir.
+func (s *Store) loadClusterID(path string) error {
+	var c struct {
+		ClusterID string    `json:"clusterId"`
+		CreatedAt time.Time `json:"createdAt"`
+	}
+	if b, err := os.ReadFile(path); err == nil {
+		_ = json.Unmarshal(b, &c)
+	}
+	if c.ClusterID == "" {
+		c.ClusterID = uuidLike("cluster")
+		c.CreatedAt = now()
+		if err := writeJSONFile(path, c); err != nil {
+			return err
+		}
+	}
+	s.clusterID = c.ClusterID
+	return nil
+}
+
+func (s *Store) load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b, err := os.ReadFile(s.filesPath); err == nil {
+		_ = json.Unmarshal(b, &s.files)
+	}
+	s.journaled, _ = replayJournal(s.journalPath, s.files)
+	if b, err := os.ReadFile(s.nodesPath); err == nil {
+		_ = json.Unmarshal(b, &s.nodes)
+	}
+	var rev struct {
+		Revision uint64 `json:"revision"`
+	}
+	if b, err := os.ReadFile(s.revisionPath); err == nil {
+		_ = json.Unmarshal(b, &rev)
+	}
+	s.revision = rev.Revision
+	return nil
+}
+
+// reload replaces the in-memory catalog with what is on disk,
+// e.g. after an operator restored files.json from a backup. The journal is
+// replayed on top, so one restoring files.json alone removes it first.
+func (s *Store) reload() error {
+	files := map[string]*FileMetadata{}
+	nodes := map[string]*NodeInfo{}
+	b, err := os.ReadFile(s.filesPath)
+	if err == nil {
+		err = json.Unmarshal(b, &files)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("files.json: %w", err)
+	}
+	if _, err := replayJournal(s.journalPath, files); err != nil {
+		return fmt.Errorf("files.journal: %w", err)
+	}
+	b, err = os.ReadFile(s.nodesPath)
+	if err == nil {
+		err = json.Unmarshal(b, &nodes)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("nodes.json: %w", err)
+	}
+	s.mu.Lock()
+	s.files, s.nodes = files, nodes
+	s.quotas.rebuild(files)
+	s.touchAll()
+	s.mu.Unlock()
+	return nil
+}
+
+// touch records a catalog change to the files named, or to nodes alone if
+// none are. Callers must hold the store lock for writing, in the same
+// critical section as the change itself.
+func (s *Store) touch(fileIDs ...string) {
+	s.revision++
+	s.mark(fileIDs...)
+}
+
+// mark records that the files named changed as a side effect of a change
+// touch already counts, e.g. the rivals of a conflict that just ended.
+// A file no longer in the catalog is journaled as deleted.
+func (s *Store) mark(fileIDs ...string) {
+	for _, id := range fileIDs {
+		if id != "" {
+			s.dirty[id] = true
+		}
+	}
+}
+
+// touchAll records that the whole catalog was replaced; the next save
+// rewrites files.json instead of journaling.
+func (s *Store) touchAll() {
+	s.revision++
+	s.rewrite = true
+}
+
+// factorOf is the number of READY replicas meta should have: its own
+// override, else its storage class's factor, else the cluster's.
+func (sv *Server) factorOf(meta *FileMetadata) int {
+	if meta.ReplicationFactor > 0 {
+		return meta.ReplicationFactor
+	}
+	if f := StorageClasses[classOf(meta)].Factor; f > 0 {
+		return f
+	}
+	return sv.tunables().ReplicationFactor
+}
+
+// persist asks for the catalog to be written. It never blocks, so callers
+// may hold the store lock; many changes in a row make one write.
+func (s *Store) persist() { s.saver.request() }
+
+// close stops the writer and writes the catalog a last time, compacted.
+func (s *Store) close() {
+	s.saver.close()
+	s.mu.Lock()
+	s.rewrite = true
+	s.mu.Unlock()
+	s.save()
+}
+
+// journalCompactMin is how many journal entries a catalog of any size may
+// gather before save compacts them into files.json; past it, a journal as
+// long as the catalog is. Rewriting that many files then costs about one
+// write per change journaled.
+const journalCompactMin = 1000
+
+// journalEntry is one line of files.journal: the file as it now is, or that
+// it was deleted.
+type journalEntry struct {
+	FileID  string        `json:"fileId"`
+	File    *FileMetadata `json:"file,omitempty"`
+	Deleted bool          `json:"deleted,omitempty"`
+}
+
+// save appends the files changed since the last save to the journal, or,
+// once the journal is long enough, rewrites files.json and empties it.
+// A change made without naming its file reaches disk at the next
+// compaction, at the latest when the naming service stops.
+func (s *Store) save() {
+	s.mu.Lock()
+	compact := s.rewrite || s.failed || s.journaled+len(s.dirty) > max(journalCompactMin, len(s.files))
+	var lines []byte
+	if !compact {
+		for id := range s.dirty {
+			meta := s.files[id]
+			b, _ := json.Marshal(journalEntry{FileID: id, File: meta, Deleted: meta == nil})
+			lines = append(append(lines, b...), '\n')
+		}
+	}
+	entries := len(s.dirty)
+	clear(s.dirty)
+	s.rewrite = false
+	s.mu.Unlock()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var err error
+	switch {
+	case compact:
+		if err = writeJSONFile(s.filesPath, s.files); err == nil {
+			err = os.Remove(s.journalPath)
+			if errors.Is(err, os.ErrNotExist) {
+				err = nil
+			}
+			s.journaled = 0
+		}
+	case entries > 0:
+		if err = appendFile(s.journalPath, lines); err == nil {
+			s.journaled += entries
+		}
+	}
+	if err != nil {
+		log.Printf("[STORE] cannot save the catalog, compacting next time: %v", err)
+	}
+	s.failed = err != nil
+	_ = writeJSONFile(s.nodesPath, s.nodes)
+	_ = writeJSONFile(s.revisionPath, map[string]uint64{"revision": s.revision})
+}
+
+// replayJournal applies the journal at path to files and returns how many
+// entries it had. A line cut short by a crash mid-append is skipped.
+func replayJournal(path string, files map[string]*FileMetadata) (int, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for line := range bytes.Lines(b) {
+		var e journalEntry
+		if json.Unmarshal(line, &e) != nil || e.FileID == "" {
+			continue
+		}
+		if e.Deleted || e.File == nil {
+			delete(files, e.FileID)
+		} else {
+			files[e.FileID] = e.File
+		}
+		n++
+	}
+	return n, nil
+}
+
+func appendFile(path string, b []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func writeJSONFile(path string, v any) error {
+	tmp := path + ".tmp"
+	b, _ := json.MarshalIndent(v, "", "  ")
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// coalescer runs fn on one goroutine, at most once per interval however
+// often it is asked to: requests made while fn runs or waits fold into its
+// next run. A goroutine per change would race whole-file rewrites against
+// each other, hundreds at a time under load.
+type coalescer struct {
+	fn       func()
+	interval time.Duration // 0 runs again as soon as the last run ends
+	kick     chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+	once     sync.Once
+}
+
+func newCoalescer(interval time.Duration, fn func()) *coalescer {
+	c := &coalescer{fn: fn, interval: interval, kick: make(chan struct{}, 1), stop: make(chan struct{}), done: make(chan struct{})}
+	go c.run()
+	return c
+}
+
+// request asks for a run without waiting for it.
+func (c *coalescer) request() {
+	select {
+	case c.kick <- struct{}{}:
+	default: // one is pending already
+	}
+}
+
+func (c *coalescer) run() {
+	defer close(c.done)
+	for {
+		select {
+		case <-c.kick:
+		case <-c.stop:
+			return
+		}
+		c.fn()
+		select {
+		case <-time.After(c.interval):
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// close stops the goroutine, waiting for a run in progress, and makes any
+// pending request now.
+func (c *coalescer) close() {
+	c.once.Do(func() { close(c.stop) })
+	<-c.done
+	select {
+	case <-c.kick:
+		c.fn()
+	default:
+	}
+}
+
+/* ==================== SETTINGS ==================== */
+
+// Settings are the cluster tunables that can be changed at runtime with
+// PUT /admin/settings. They live in metadata/settings.json; the environment
+// only seeds them the first time the naming service boots.
+type Settings struct {
+	ReplicationFactor int `json:"replicationFactor"`
+	// WriteQuorum is how many uploaded replicas a commit needs before the
+	// file becomes readable; below the replication factor it is PARTIAL.
+	WriteQuorum    int   `json:"writeQuorum"`
+	HealIntervalMs int64 `json:"healIntervalMs"`
+	// Health thresholds are expressed in missed heartbeats so that a node
+	// which declares a slow interval at registration is not flapped to
+	// SUSPECT/DOWN.
+	DefaultHeartbeatMs int64      `json:"defaultHeartbeatMs"`
+	SuspectAfterBeats  float64    `json:"suspectAfterBeats"`
+	DownAfterBeats     float64    `json:"downAfterBeats"`
+	ReadPolicy         ReadPolicy `json:"readPolicy"`
+	// PlacementPolicy picks the nodes for new files; see PlacementStrategy.
+	PlacementPolicy PlacementPolicy `json:"placementPolicy"`
+}
+
+// DefaultSettings are the tunables a fresh cluster starts with.
+func DefaultSettings() Settings {
+	return Settings{
+		ReplicationFactor:  2,
+		WriteQuorum:        1,
+		HealIntervalMs:     30000,
+		DefaultHeartbeatMs: 5000,
+		SuspectAfterBeats:  2,
+		DownAfterBeats:     4,
+		ReadPolicy:         ReadLenient,
+		PlacementPolicy:    PlaceLeastLoaded,
+	}
+}
+
+// tunables are the live Settings; only loadSettings and saveSettings
+// replace them, after persisting.
+func (sv *Server) tunables() Settings { return *sv.settings.Load() }
+
+func (t Settings) defaultHeartbeat() time.Duration {
+	return time.Duration(t.DefaultHeartbeatMs) * time.Millisecond
+}
+
+func (t Settings) healInterval() time.Duration {
+	return time.Duration(t.HealIntervalMs) * time.Millisecond
+}
+
+// validate lists every problem with t; known are the placement policies
+// it may name.
+func (t Settings) validate(known placements) []string {
+	var problems []string
+	if t.ReplicationFactor < 1 {
+		problems = append(problems, "replicationFactor must be at least 1")
+	}
+	if t.WriteQuorum < 1 || t.WriteQuorum > t.ReplicationFactor {
+		problems = append(problems, fmt.Sprintf("writeQuorum must be between 1 and replicationFactor (%d)", t.ReplicationFactor))
+	}
+	if t.HealIntervalMs < 1000 {
+		problems = append(problems, "healIntervalMs must be at least 1000")
+	}
+	if t.DefaultHeartbeatMs <= 0 {
+		problems = append(problems, "defaultHeartbeatMs must be greater than zero")
+	}
+	if t.SuspectAfterBeats <= 0 || t.DownAfterBeats <= t.SuspectAfterBeats {
+		problems = append(problems, fmt.Sprintf("need 0 < suspectAfterBeats (%g) < downAfterBeats (%g)", t.SuspectAfterBeats, t.DownAfterBeats))
+	}
+	if t.ReadPolicy != ReadStrict && t.ReadPolicy != ReadLenient {
+		problems = append(problems, fmt.Sprintf("readPolicy must be %q or %q", ReadStrict, ReadLenient))
+	}
+	if known[t.PlacementPolicy] == nil {
+		problems = append(problems, fmt.Sprintf("placementPolicy must be one of %v", known.policies()))
+	}
+	return problems
+}
+
+// decodeSettings parses and validates a settings.json body into t.
+func (sv *Server) decodeSettings(b []byte, t *Settings) error {
+	if err := json.Unmarshal(b, t); err != nil {
+		return fmt.Errorf("%s: %w", sv.store.settingsPath, err)
+	}
+	if problems := t.validate(sv.placements); len(problems) > 0 {
+		return fmt.Errorf("%s: %s", sv.store.settingsPath, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// readSettings is the persisted settings, or false if there are none yet.
+func (sv *Server) readSettings() (Settings, bool, error) {
+	t := DefaultSettings() // fields added since the file was written
+	b, err := os.ReadFile(sv.store.settingsPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, false, nil
+	}
+	if err == nil {
+		err = sv.decodeSettings(b, &t)
+	}
+	return t, err == nil, err
+}
+
+// loadSettings makes the persisted settings live, or on first boot persists
+// seed (built from defaults and the environment).
+func (sv *Server) loadSettings(seed Settings) error {
+	t, ok, err := sv.readSettings()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if sv.placements[seed.PlacementPolicy] == nil {
+			return fmt.Errorf("placement policy %q is not one of %v", seed.PlacementPolicy, sv.placements.policies())
+		}
+		return sv.saveSettings(seed)
+	}
+	if t != seed {
+		log.Printf("settings: using %s; environment values only seed a new cluster", sv.store.settingsPath)
+	}
+	sv.settings.Store(&t)
+	return nil
+}
+
+// saveSettings persists t and makes it live.
+func (sv *Server) saveSettings(t Settings) error {
+	if err := writeJSONFile(sv.store.settingsPath, t); err != nil {
+		return err
+	}
+	sv.settings.Store(&t)
+	return nil
+}
+
+// handleSettings shows (GET) or changes (PUT) the cluster settings. A PUT
+// body may name only the fields to change.
+func (sv *Server) handleSettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		writeJSONResp(w, sv.tunables())
+		return
+	}
+	sv.settingsMu.Lock()
+	defer sv.settingsMu.Unlock()
+	old := sv.tunables()
+	next := old
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&next); err != nil {
+		apierr.WriteDetail(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json", err.Error())
+		return
+	}
+	if problems := next.validate(sv.placements); len(problems) > 0 {
+		apierr.WriteDetail(w, http.StatusBadRequest, apierr.BadRequest, strings.Join(problems, "; "), problems)
+		return
+	}
+	if err := sv.saveSettings(next); err != nil {
+		apierr.WriteDetail(w, http.StatusInternalServerError, apierr.Internal, "cannot save settings", err.Error())
+		return
+	}
+
+	var before, after map[string]any
+	b, _ := json.Marshal(old)
+	_ = json.Unmarshal(b, &before)
+	b, _ = json.Marshal(next)
+	_ = json.Unmarshal(b, &after)
+	changed := []string{}
+	for k, v := range after {
+		if before[k] != v {
+			changed = append(changed, fmt.Sprintf("%s=%v", k, v))
+		}
+	}
+	sort.Strings(changed)
+	if next.HealIntervalMs != old.HealIntervalMs {
+		select {
+		case sv.healWake <- struct{}{}:
+		default:
+		}
+	}
+	log.Printf("[ADMIN] settings changed: %s", strings.Join(changed, ", "))
+	sv.record(r, "settings", "cluster", strings.Join(changed, ", "))
+	writeJSONResp(w, map[string]any{"settings": next, "changed": changed})
+}
+
+/* ==================== HELPERS ==================== */
+
+func now() time.Time { return time.Now().UTC() }
+
+func (sv *Server) heartbeatOf(n *NodeInfo) time.Duration {
+	if n.HeartbeatMs > 0 {
+		return time.Duration(n.HeartbeatMs) * time.Millisecond
+	}
+	return sv.tunables().defaultHeartbeat()
+}
+
+func (sv *Server) thresholdsOf(n *NodeInfo) (suspect, down time.Duration) {
+	hb := sv.heartbeatOf(n)
+	t := sv.tunables()
+	return time.Duration(float64(hb) * t.SuspectAfterBeats), time.Duration(float64(hb) * t.DownAfterBeats)
+}
+
+// peerVouched reports whether a peer has seen n alive recently.
+func (sv *Server) peerVouched(n *NodeInfo) bool {
+	suspect, _ := sv.thresholdsOf(n)
+	return !n.LastPeerSeenAt.IsZero() && time.Since(n.LastPeerSeenAt) <= suspect
+}
+
+func (sv *Server) healthOf(n *NodeInfo) NodeStatus {
+	ago := time.Since(n.LastSeenAt)
+	suspect, down := sv.thresholdsOf(n)
+	switch {
+	case ago > down && sv.peerVouched(n):
+		return NodeSuspect
+	case ago > down:
+		return NodeDown
+	case ago > suspect:
+		return NodeSuspect
+	default:
+		return NodeHealthy
+	}
+}
+
+// stateOf is healthOf plus the operator-set maintenance state and the
+// node-reported read-only state.
+func (sv *Server) stateOf(n *NodeInfo) NodeStatus {
+	st := sv.healthOf(n)
+	switch {
+	case st != NodeHealthy:
+		return st
+	case n.Maintenance:
+		return NodeMaintenance
+	case n.ReadOnly:
+		return NodeReadOnly
+	}
+	return st
+}
+
+// placeable reports whether n may receive new replicas, from allocation,
+// auto-heal or a manual move.
+func (sv *Server) placeable(n *NodeInfo) bool {
+	return sv.healthOf(n) == NodeHealthy && !n.Degraded && !n.Maintenance && !n.ReadOnly
+}
+
+func freeBytes(n *NodeInfo) int64 { return n.CapacityBytes - n.UsedBytes }
+
+func loadFactor(n *NodeInfo) float64 {
+	if n.CapacityBytes <= 0 {
+		return math.MaxFloat64
+	}
+	return float64(n.UsedBytes) / float64(n.CapacityBytes)
+}
+
+// weightedLoad is loadFactor scaled down by the node's declared weight;
+// placement and auto-heal fill nodes in this order.
+func weightedLoad(n *NodeInfo) float64 {
+	if n.Weight > 0 {
+		return loadFactor(n) / n.Weight
+	}
+	return loadFactor(n)
+}
+
+// steadyFirst drops flapping nodes from cands when enough steady ones are
+// left for need, so an unstable node only gets replicas as a last resort.
+func steadyFirst(cands []*NodeInfo, need int) []*NodeInfo {
+	steady := slices.DeleteFunc(slices.Clone(cands), func(n *NodeInfo) bool { return n.Flapping })
+	if len(steady) >= need {
+		return steady
+	}
+	return cands
+}
+
+// hasTag reports whether n declared tag.
+func hasTag(n *NodeInfo, tag string) bool { return slices.Contains(n.Tags, tag) }
+
+// storedSize is the number of bytes a single replica occupies on disk. Files
+// committed before nodes reported it fall back to the logical size.
+func storedSize(f *FileMetadata) int64 {
+	if f.StoredSize > 0 {
+		return f.StoredSize
+	}
+	return f.Size
+}
+
+func uuidLike(seed string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s-%d", seed, time.Now().UnixNano())))
+	hexed := hex.EncodeToString(sum[:])
+	return fmt.Sprintf("%s-%s-%s-%s-%s", hexed[:8], hexed[8:12], hexed[12:16], hexed[16:20], hexed[20:32])
+}
+
+/* ==================== HTTP SERVER ==================== */
+
+// Version is the naming service build version; main copies in its own,
+// which is stamped with -ldflags "-X main.Version=...".
+var Version = "dev"
+
+type Server struct {
+	store            *Store
+	antiEntropyEvery time.Duration // 0 when disabled
+	verifyEvery      time.Duration // scheduled verifier; 0 when disabled
+	verifyBatch      int
+	ops              *opRegistry
+	audit            *auditLog
+	access           *accessStats
+
+	shard Shard
+
+	settingsMu sync.Mutex               // serializes settings changes
+	settings   atomic.Pointer[Settings] // see tunables
+	placements placements               // the policies settings may name
+
+	// placementURL, when set, is consulted on every allocation; see
+	// consultPlacement.
+	placementURL     string
+	placementTimeout time.Duration
+	placement        placementStats
+
+	ticketSecret []byte // signs the uploads the naming service makes itself; see ticketFor
+
+	// transport carries all traffic to the nodes and the placement webhook,
+	// and nodeCalls retries it and keeps a circuit per node; both are built
+	// from Config by NewServer. See httpClient.
+	transport *http.Transport
+	nodeCalls *resilientClient
+
+	adminToken  []byte      // guards /admin/*; empty disables the admin API
+	debug       bool        // serve /debug/, behind adminToken
+	maintenance atomic.Bool // read-only: catalog writes get 503
+	stopCh      chan struct{}
+	stopOnce    sync.Once
+	healWake    chan struct{} // nudges the auto-healer after a settings change
+	heal        *healQueue
+	track       *nodeTrack // evidence for /node-health
+	history     *nodeHistory
+	lifecycle   *lifecycle
+	backups     *backups
+	geo         *geoReplication
+	alerts      *alerts
+	capacity    *capacityHistory
+	metrics     *metricsHistory
+	idem        *idemBook // Idempotency-Key responses and delete tombstones
+
+	// filesSnap is the encoded /list-files body for one catalog revision,
+	// so polls during an upload storm don't rebuild it under the lock.
+	snapMu    sync.Mutex
+	filesSnap catalogSnapshot
+
+	// quit is closed by Close and ends the background jobs.
+	quit     chan struct{}
+	quitOnce sync.Once
+
+	discovery      DiscoveryConfig
+	discoveryState discoveryState
+	inventory      *inventoryTracker
+}
+
+// catalogSnapshot is a response body frozen at one catalog revision.
+type catalogSnapshot struct {
+	revision uint64
+	body     []byte
+}
+
+// catalogRevisionHeader carries the catalog revision a list or metrics
+// response was built from; /list-files also uses it as its ETag.
+const catalogRevisionHeader = "X-Catalog-Revision"
+
+// RegisterNodeRequest is the body of POST /register-node. UsedBytes is set
+// by a node that restarts on an existing data directory.
+type RegisterNodeRequest struct {
+	NodeID        string   `json:"nodeId"`
+	URL           string   `json:"url"`
+	CapacityBytes int64    `json:"capacityBytes"`
+	Zone          string   `json:"zone,omitempty"`
+	Tags          []string `json:"tags,omitempty"`
+	Weight        float64  `json:"weight,omitempty"`
+	HeartbeatMs   int64    `json:"heartbeatIntervalMs,omitempty"`
+	Version       string   `json:"version,omitempty"`
+	UsedBytes     *int64   `json:"usedBytes,omitempty"`
+}
+
+// handleRegisterNode is idempotent: a node that re-registers, e.g. after a
+// restart, keeps its usage, health flags, maintenance state and placement
+// history, and only the fields it reports are updated. usedBytes is optional;
+// without it a known node keeps its last figure and a new one starts from the
+// replicas the catalog already places on it, until its first heartbeat.
+func (sv *Server) handleRegisterNode(w http.ResponseWriter, r *http.Request) {
+	var body RegisterNodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil ||
+		body.NodeID == "" || body.URL == "" || body.CapacityBytes <= 0 || body.HeartbeatMs < 0 || body.Weight < 0 ||
+		(body.UsedBytes != nil && *body.UsedBytes < 0) {
+		apierr.Write(w, http.StatusBadRequest, apierr.BadRequest, "bad payload")
+		return
+	}
+
+	sv.store.mu.Lock()
+	n, known := sv.store.nodes[body.NodeID]
+	switch {
+	case !known:
+		n = &NodeInfo{NodeID: body.NodeID, UsedBytes: sv.store.catalogUsed(body.NodeID)}
+		sv.store.nodes[body.NodeID] = n
+	case n.CapacityBytes != body.CapacityBytes:
+		log.Printf("[NODE] %s capacity %d -> %d bytes", n.NodeID, n.CapacityBytes, body.CapacityBytes)
+	}
+	if n.URL != "" && n.URL != body.URL {
+		log.Printf("[NODE] %s moved from %s to %s", n.NodeID, n.URL, body.URL)
+	}
+	if body.UsedBytes != nil {
+		n.UsedBytes = *body.UsedBytes
+	}
+	n.URL, n.CapacityBytes = body.URL, body.CapacityBytes
+	n.Zone, n.Tags, n.Weight = body.Zone, body.Tags, body.Weight
+	n.HeartbeatMs, n.Version = body.HeartbeatMs, body.Version
+	n.Discovered = false // it speaks for itself from now on
+	n.LastSeenAt = now()
+	n.Status = sv.healthOf(n)
+	sv.noteHealth(n, "registered")
+	suspect, down := sv.thresholdsOf(n)
+	hb := sv.heartbeatOf(n)
+	usedBytes := n.UsedBytes
+	sv.store.touch()
+	sv.store.mu.Unlock()
+	sv.store.persist()
+
+	writeJSONResp(w, map[string]any{
+		"ok":                  true,
+		"known":               known,
+		"usedBytes":           usedBytes,
+		"heartbeatIntervalMs": hb.Milliseconds(),
+		"suspectAfterMs":      suspect.Milliseconds(),
+		"downAfterMs":         down.Milliseconds(),
+	})
+}
+
+// catalogUsed estimates a node's usage from the replicas the catalog places
+// on it. Callers hold s.mu.
+func (s *Store) catalogUsed(nodeID string) int64 {
+	var used int64
+	for _, meta := range s.files {
+		for _, rep := range meta.Replicas {
+			if rep.NodeID == nodeID && rep.Status != ReplicaMissing {
+				used += storedSize(meta)
+			}
+		}
+	}
+	return used
+}
+
+// HeartbeatRequest is the body of POST /heartbeat.
+type HeartbeatRequest struct {
+	NodeID    string `json:"nodeId"`
+	UsedBytes int64  `json:"usedBytes"`
+	Degraded  bool   `json:"degraded"`
+	ReadOnly  bool   `json:"readOnly"`
+	DiskFree  int64  `json:"diskFreeBytes"`
+	// Reads are the downloads the node served since its last beat;
+	// Received counts the blobs written to it by uploads and copies.
+	Reads    map[string]accessCount `json:"reads"`
+	Received accessCount            `json:"received"`
+	// Inventory summarizes the blobs the node holds; see checkInventory.
+	Inventory *inventoryDigest `json:"inventory"`
+}
+
+func (sv *Server) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	var body HeartbeatRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json")
+		return
+	}
+	sv.access.add(body.NodeID, body.Reads, body.Received)
+	sv.store.mu.Lock()
+	defer sv.store.mu.Unlock()
+	n, ok := sv.store.nodes[body.NodeID]
+	if !ok {
+		apierr.Write(w, http.StatusNotFound, apierr.NodeNotFound, "unknown node")
+		return
+	}
+	for id := range body.Reads {
+		if meta, ok := sv.store.files[id]; ok {
+			meta.LastReadAt = now()
+			meta.LastAccessedAt = meta.LastReadAt
+			sv.store.mark(id)
+		}
+	}
+	n.UsedBytes = body.UsedBytes
+	n.Degraded = body.Degraded
+	if body.ReadOnly != n.ReadOnly {
+		log.Printf("[NODE] %s read-only=%v (%d bytes free on disk)", n.NodeID, body.ReadOnly, body.DiskFree)
+	}
+	n.ReadOnly = body.ReadOnly
+	n.DiskFreeBytes = body.DiskFree
+	n.LastSeenAt = now()
+	n.Status = sv.healthOf(n)
+	sv.noteHealth(n, "")
+	sv.store.persist()
+	if body.Inventory != nil {
+		go sv.checkInventory(body.NodeID, *body.Inventory)
+	}
+
+	writeJSONResp(w, map[string]any{"ok": true, "status": n.Status})
+}
+
+// PeerReportRequest is the body of POST /peer-report: which peers the
+// observing node could reach.
+type PeerReportRequest struct {
+	Observer     string `json:"observer"`
+	Observations []struct {
+		NodeID    string `json:"nodeId"`
+		Reachable bool   `json:"reachable"`
+	} `json:"observations"`
+}
+
+func (sv *Server) handlePeerReport(w http.ResponseWriter, r *http.Request) {
+	var body PeerReportRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Observer == "" {
+		apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json")
+		return
+	}
+	sv.store.mu.Lock()
+	defer sv.store.mu.Unlock()
+	observer, ok := sv.store.nodes[body.Observer]
+	if !ok {
+		apierr.Write(w, http.StatusNotFound, apierr.NodeNotFound, "unknown node")
+		return
+	}
+	// a gossip report is itself proof of life for the observer
+	observer.LastSeenAt = now()
+	accepted := 0
+	for _, o := range body.Observations {
+		n, ok := sv.store.nodes[o.NodeID]
+		if !ok || o.NodeID == body.Observer || !o.Reachable {
+			continue
+		}
+		n.LastPeerSeenAt = now()
+		accepted++
+	}
+
+	writeJSONResp(w, map[string]any{"ok": true, "accepted": accepted})
+}
+
+// AllocateRequest is the body of POST /allocate.
+type AllocateRequest struct {
+	Filename    string `json:"filename"`
+	Size        int64  `json:"size"`
+	Checksum    string `json:"checksum"`
+	ContentType string `json:"contentType"`
+	FileID      string `json:"fileId,omitempty"` // overwrite an existing file
+	Owner       string `json:"owner,omitempty"`  // tenant or user charged for quotas
+	Detected    string `json:"detectedContentType,omitempty"`
+	ParentID    string `json:"parentId,omitempty"`    // derived from this file
+	DerivedKind string `json:"derivedKind,omitempty"` // e.g. "preview"; needs parentId
+	// Placement hints steer the new file's replicas by node tag:
+	// "require:T", "prefer:T" or "avoid:T". See placementHints.
+	Placement []string `json:"placement,omitempty"`
+	// StorageClass is one of StorageClasses; empty means STANDARD.
+	StorageClass StorageClass `json:"storageClass,omitempty"`
+}
+
+func (sv *Server) handleAllocate(w http.ResponseWriter, r *http.Request) {
+	var body AllocateRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil ||
+		body.Filename == "" || body.Size <= 0 || !strings.HasPrefix(body.Checksum, "sha256:") {
+		apierr.Write(w, http.StatusBadRequest, apierr.BadRequest, "invalid payload")
+		return
+	}
+	if (body.ParentID == "") != (body.DerivedKind == "") {
+		apierr.Write(w, http.StatusBadRequest, apierr.BadRequest, "parentId and derivedKind go together")
+		return
+	}
+	class, ok := StorageClasses[cmp.Or(body.StorageClass, ClassStandard)]
+	if !ok {
+		apierr.WriteDetail(w, http.StatusBadRequest, apierr.BadRequest, fmt.Sprintf("unknown storage class %q", body.StorageClass),
+			map[string]any{"available": slices.Sorted(maps.Keys(StorageClasses))})
+		return
+	}
+	allHints := append(slices.Clone(class.Placement), body.Placement...)
+	hints, err := parsePlacementHints(allHints)
+	if err != nil {
+		apierr.WriteDetail(w, http.StatusBadRequest, apierr.BadRequest, err.Error(), body.Placement)
+		return
+	}
+	if body.FileID != "" {
+		if sv.refuseForeign(w, body.FileID) {
+			return
+		}
+		sv.handleOverwrite(w, body.FileID, body.Filename, body.Size, body.Checksum, body.ContentType, body.Detected)
+		return
+	}
+	sv.store.mu.RLock()
+	qe := sv.store.quotas.check(body.Owner, "", body.Size)
+	sv.store.mu.RUnlock()
+	if qe != nil {
+		writeQuotaExceeded(w, qe)
+		return
+	}
+
+	fileID := sv.shard.mint(func() string { return uuidLike(body.Filename) })
+	factor := cmp.Or(class.Factor, sv.tunables().ReplicationFactor)
+	replicas, err := sv.pickReplicas(r.Context(), PlacementFile{body.Filename, body.Size, body.ContentType, allHints}, hints, factor)
+	if err != nil {
+		apierr.WriteDetail(w, http.StatusServiceUnavailable, apierr.InsufficientNodes, err.Error(), err)
+		return
+	}
+
+	meta := &FileMetadata{
+		FileID:      fileID,
+		Filename:    body.Filename,
+		Size:        body.Size,
+		Checksum:    body.Checksum,
+		ContentType: body.ContentType,
+		Version:     1,
+		State:       StateAllocated,
+		CreatedAt:   now(),
+		UpdatedAt:   now(),
+		Owner:       body.Owner,
+		Placement:   body.Placement,
+
+		StorageClass:        body.StorageClass,
+		DetectedContentType: body.Detected,
+	}
+	for _, n := range replicas {
+		meta.Replicas = append(meta.Replicas, ReplicaInfo{
+			NodeID: n.NodeID, URL: n.URL, Status: ReplicaReady, LastVerifiedAt: now(), Version: meta.Version,
+		})
+	}
+
+	sv.store.mu.Lock()
+	if body.ParentID != "" {
+		parent, ok := sv.store.files[body.ParentID]
+		if !ok || parent.State == StateDeleted || parent.ParentID != "" {
+			sv.store.mu.Unlock()
+			apierr.Write(w, http.StatusNotFound, apierr.FileNotFound, "parent file not found")
+			return
+		}
+		if parent.Derived == nil {
+			parent.Derived = map[string]string{}
+		}
+		parent.Derived[body.DerivedKind] = fileID
+		meta.ParentID = body.ParentID
+	} else if meta.ConflictID = sv.store.conflicts.note(meta, sv.store.files); meta.ConflictID != "" {
+		log.Printf("[CONFLICT] %s: %q by %q differs from an earlier upload (%s)", fileID, meta.Filename, meta.Owner, meta.ConflictID)
+		sv.store.mark(sv.store.conflicts.members(meta.ConflictID)...)
+	}
+	sv.store.files[fileID] = meta
+	sv.store.touch(fileID)
+	for _, n := range replicas {
+		sv.store.nodes[n.NodeID].LastChosen = now()
+	}
+	sv.store.mu.Unlock()
+	sv.store.persist()
+
+	sv.writeAllocation(w, meta)
+}
+
+// handleOverwrite starts a new version of an existing file on the nodes that
+// already hold it. Replicas that are not rewritten become STALE at commit.
+func (sv *Server) handleOverwrite(w http.ResponseWriter, fileID, filename string, size int64, checksum, contentType, detected string) {
+	sv.store.mu.Lock()
+	meta, ok := sv.store.files[fileID]
+	if !ok || meta.State == StateDeleted {
+		sv.store.mu.Unlock()
+		apierr.Write(w, http.StatusNotFound, apierr.FileNotFound, "fileId not found")
+		return
+	}
+	if qe := sv.store.quotas.check(meta.Owner, fileID, size); qe != nil {
+		sv.store.mu.Unlock()
+		writeQuotaExceeded(w, qe)
+		return
+	}
+	sv.newVersion(meta, filename, size, checksum, contentType, detected)
+	sv.store.mu.Unlock()
+	sv.store.persist()
+
+	sv.writeAllocation(w, meta)
+}
+
+// newVersion starts the next version of meta with the given content.
+// Callers must hold the store lock for writing.
+func (sv *Server) newVersion(meta *FileMetadata, filename string, size int64, checksum, contentType, detected string) {
+	meta.Version++
+	if filename != meta.Filename {
+		sv.store.conflicts.dropFile(meta, sv.store.files)
+	}
+	meta.Filename = filename
+	meta.Size = size
+	meta.StoredSize = 0
+	meta.Checksum = checksum
+	meta.ContentType = contentType
+	meta.DetectedContentType = detected
+	meta.UpdatedAt = now()
+	sv.store.touch(meta.FileID)
+}
+
+// writeAllocation answers an allocation with meta's replicas and how many
+// of them a commit needs, so the uploader knows when it may commit.
+func (sv *Server) writeAllocation(w http.ResponseWriter, meta *FileMetadata) {
+	type outRep struct{ NodeID, URL string }
+	out := struct {
+		FileID      string   `json:"fileId"`
+		Version     int      `json:"version"`
+		Replicas    []outRep `json:"replicas"`
+		WriteQuorum int      `json:"writeQuorum"`
+		ConflictID  string   `json:"conflictId,omitempty"`
+	}{FileID: meta.FileID, Version: meta.Version, ConflictID: meta.ConflictID}
+	out.WriteQuorum = min(sv.tunables().WriteQuorum, sv.factorOf(meta), len(meta.Replicas))
+	for _, rinfo := range meta.Replicas {
+		out.Replicas = append(out.Replicas, outRep{rinfo.NodeID, rinfo.URL})
+	}
+	writeJSONResp(w, out)
+}
+
+// insufficientNodes is the detail of an INSUFFICIENT_NODES refusal.
+type insufficientNodes struct {
+	Need int `json:"need"`
+	Have int `json:"have"`
+}
+
+func (e *insufficientNodes) Error() string {
+	return fmt.Sprintf("insufficient healthy nodes: need %d, have %d", e.Need, e.Have)
+}
+
+// pickReplicas chooses factor nodes for a new file with the configured
+// PlacementStrategy and the file's hints, unless PLACEMENT_WEBHOOK is set
+// and answers with a valid choice.
+func (sv *Server) pickReplicas(ctx context.Context, file PlacementFile, hints placementHints, factor int) ([]*NodeInfo, error) {
+	sv.store.mu.RLock()
+	var cands []*NodeInfo
+	for _, n := range sv.store.nodes {
+		if sv.placeable(n) && freeBytes(n) >= file.Size && hints.allows(n) {
+			cands = append(cands, n)
+		}
+	}
+	cands = steadyFirst(cands, factor)
+	t := sv.tunables()
+	if len(cands) < factor {
+		sv.store.mu.RUnlock()
+		return nil, &insufficientNodes{Need: factor, Have: len(cands)}
+	}
+	sort.Slice(cands, func(i, j int) bool {
+		li, lj := weightedLoad(cands[i]), weightedLoad(cands[j])
+		if li == lj {
+			return cands[i].LastChosen.Before(cands[j].LastChosen)
+		}
+		return li < lj
+	})
+	picked := hints.place(sv.placements[t.PlacementPolicy], file, slices.Clone(cands), factor)
+	if sv.placementURL == "" {
+		sv.store.mu.RUnlock()
+		return picked, nil
+	}
+	req := placementRequest{File: file, ReplicationFactor: factor}
+	byID := map[string]*NodeInfo{}
+	for _, n := range cands {
+		byID[n.NodeID] = n
+		req.Candidates = append(req.Candidates, placementCandidate{
+			NodeID: n.NodeID, URL: n.URL, Zone: n.Zone, Tags: n.Tags,
+			Weight: n.Weight, CapacityBytes: n.CapacityBytes, UsedBytes: n.UsedBytes, FreeBytes: freeBytes(n), LoadFactor: loadFactor(n),
+		})
+	}
+	for _, n := range picked {
+		req.Default = append(req.Default, n.NodeID)
+	}
+	sv.store.mu.RUnlock()
+
+	chosen, err := sv.consultPlacement(ctx, req)
+	if ctx.Err() != nil {
+		return nil, ctx.Err() // the caller is gone; not the webhook's fault
+	}
+	if err != nil {
+		sv.placement.fallbacks.Add(1)
+		log.Printf("[PLACEMENT] webhook failed for %s, using %s policy: %v", file.Filename, t.PlacementPolicy, err)
+		return picked, nil
+	}
+	sv.placement.webhook.Add(1)
+	out := make([]*NodeInfo, 0, len(chosen))
+	for _, id := range chosen {
+		out = append(out, byID[id])
+	}
+	return out, nil
+}
+
+// CommitRequest is the body of POST /commit.
+type CommitRequest struct {
+	FileID     string   `json:"fileId"`
+	Uploaded   []string `json:"uploaded"`
+	StoredSize int64    `json:"storedSize"`
+	Version    int      `json:"version"` // optional: the allocated version being committed
+}
+
+// handleCommit records which replicas an upload reached. It is safe to
+// repeat: once a version is committed, committing it again only promotes
+// STALE replicas the request names (a late commit adding them), leaves
+// READY ones alone, does not revive one found MISSING since, and never
+// moves the file back from AVAILABLE or PARTIAL.
+func (sv *Server) handleCommit(w http.ResponseWriter, r *http.Request) {
+	var body CommitRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json")
+		return
+	}
+
+	sv.store.mu.Lock()
+	defer sv.store.mu.Unlock()
+	meta, ok := sv.store.files[body.FileID]
+	if !ok {
+		apierr.Write(w, http.StatusNotFound, apierr.FileNotFound, "fileId not found")
+		return
+	}
+	if body.Version > 0 && body.Version != meta.Version {
+		// a late commit for a version that has since been overwritten
+		apierr.Write(w, http.StatusConflict, apierr.VersionConflict, fmt.Sprintf("version %d is not current (%d)", body.Version, meta.Version))
+		return
+	}
+	res := sv.commit(meta, body)
+	sv.store.persist()
+
+	writeJSONResp(w, res)
+}
+
+// commitResult is what a commit answers for one file.
+type commitResult struct {
+	FileID      string    `json:"fileId,omitempty"` // in a batch
+	State       FileState `json:"state"`
+	WriteQuorum int       `json:"writeQuorum"`
+	QuorumMet   bool      `json:"quorumMet"`
+}
+
+// commit applies body to meta, whose version the caller has checked.
+// Callers hold the store lock for writing and persist.
+func (sv *Server) commit(meta *FileMetadata, body CommitRequest) commitResult {
+	repeat := meta.CommittedVersion == meta.Version
+	count := commitReplicas(meta, body.Uploaded)
+	if body.StoredSize > 0 {
+		meta.StoredSize = body.StoredSize
+	}
+	factor := sv.factorOf(meta)
+	quorum := min(sv.tunables().WriteQuorum, factor)
+	next := StateAvailable
+	switch {
+	case count == 0 || count < quorum:
+		next = StateAllocated
+	case count < factor:
+		next = StatePartial
+	}
+	if cur, ok := commitRank[meta.State]; !repeat || ok && commitRank[next] > cur {
+		meta.State = next
+	}
+	if meta.State != StateAllocated {
+		sv.store.quotas.charge(meta)
+		meta.CommittedVersion = meta.Version
+	}
+	meta.UpdatedAt = now()
+	sv.store.touch(meta.FileID)
+	if !repeat && meta.State != StateAllocated {
+		sv.geo.enqueue(meta)
+	}
+	return commitResult{State: meta.State, WriteQuorum: quorum, QuorumMet: count > 0 && count >= quorum}
+}
+
+// commitReplicas marks the replicas on the uploaded nodes READY at the
+// file's version, and the others that missed it STALE, and returns how
+// many the commit counts toward the quorum.
+func commitReplicas(meta *FileMetadata, uploaded []string) int {
+	repeat := meta.CommittedVersion == meta.Version
+	count := 0
+	for i := range meta.Replicas {
+		rep := &meta.Replicas[i]
+		switch {
+		case !slices.Contains(uploaded, rep.NodeID):
+			if rep.Version < meta.Version {
+				rep.Status = ReplicaStale
+			}
+			continue
+		case repeat && rep.Status == ReplicaReady:
+		case repeat && rep.Status != ReplicaStale:
+			continue
+		default:
+			rep.Status = ReplicaReady
+			rep.LastVerifiedAt = now()
+			rep.Version = meta.Version
+		}
+		count++
+	}
+	return count
+}
+
+// commitRank orders the states a commit can set; a repeated commit only
+// moves a file up. Health verdicts such as DEGRADED are left to the
+// healer.
+var commitRank = map[FileState]int{StateAllocated: 0, StatePartial: 1, StateAvailable: 2}
+
+// LookupReplica is one replica in a /lookup answer, healthy nodes first.
+// Its keys are NodeID and URL, without JSON tags, as clients already read
+// them.
+type LookupReplica struct{ NodeID, URL string }
+
+func (sv *Server) handleLookup(w http.ResponseWriter, r *http.Request) {
+	fileID := r.PathValue("fileId")
+	sv.store.mu.RLock()
+	meta, ok := sv.store.files[fileID]
+	if ok {
+		meta = meta.clone()
+	}
+	sv.store.mu.RUnlock()
+	if !ok {
+		apierr.Write(w, http.StatusNotFound, apierr.FileNotFound, "file not found")
+		return
+	}
+	if meta.State == StateCorrupt {
+		if !meta.OverrideServe {
+			apierr.Write(w, http.StatusConflict, apierr.FileCorrupt, "file is CORRUPT and quarantined")
+			return
+		}
+		w.Header().Set(degradedReadHeader, string(meta.State))
+	}
+	if meta.State == StateDegraded || meta.State == StatePartial {
+		if policy := sv.tunables().ReadPolicy; policy == ReadStrict {
+			apierr.Write(w, http.StatusServiceUnavailable, apierr.Unavailable, fmt.Sprintf("file is %s and read policy is %s", meta.State, policy))
+			return
+		}
+		w.Header().Set(degradedReadHeader, string(meta.State))
+	}
+
+	if r.URL.Query().Get("peek") == "" {
+		sv.noteAccess(fileID)
+	}
+
+	// describe the file so a gateway can name and cache the download
+	w.Header().Set("X-File-Name", url.PathEscape(meta.Filename))
+	w.Header().Set("X-File-Content-Type", meta.ContentType)
+	w.Header().Set("X-File-Checksum", meta.Checksum)
+	w.Header().Set("X-File-Size", fmt.Sprint(meta.Size))
+	w.Header().Set("X-File-Version", fmt.Sprint(meta.Version))
+	w.Header().Set("X-File-Updated", meta.UpdatedAt.UTC().Format(http.TimeFormat))
+
+	var healthy, others []LookupReplica
+
+	sv.store.mu.RLock()
+	for _, rep := range meta.Replicas {
+		if rep.Status == ReplicaTrimming {
+			continue
+		}
+		n := sv.store.nodes[rep.NodeID]
+		if sv.healthOf(n) == NodeHealthy {
+			healthy = append(healthy, LookupReplica{rep.NodeID, rep.URL})
+		} else {
+			others = append(others, LookupReplica{rep.NodeID, rep.URL})
+		}
+	}
+	sv.store.mu.RUnlock()
+
+	w.Header().Set("X-Healthy-Replicas", fmt.Sprint(len(healthy)))
+	writeJSONResp(w, append(healthy, others...))
+}
+
+// noteAccess counts a read of fileID. It only updates access fields, which
+// are not a catalog change, so the revision is left alone and the next
+// persist picks them up.
+func (sv *Server) noteAccess(fileID string) {
+	sv.store.mu.Lock()
+	if meta, ok := sv.store.files[fileID]; ok {
+		meta.AccessCount++
+		meta.LastAccessedAt = now()
+		sv.store.mark(fileID)
+	}
+	sv.store.mu.Unlock()
+}
+
+// ReportMissingRequest is the body of POST /report-missing.
+type ReportMissingRequest struct {
+	FileID   string `json:"fileId"`
+	NodeID   string `json:"nodeId"`
+	NodeURL  string `json:"nodeUrl"` // alternative to nodeId
+	Reporter string `json:"reporter"`
+}
+
+func (sv *Server) handleReportMissing(w http.ResponseWriter, r *http.Request) {
+	var body ReportMissingRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json")
+		return
+	}
+
+	sv.store.mu.Lock()
+	defer sv.store.mu.Unlock()
+	meta, ok := sv.store.files[body.FileID]
+	if !ok {
+		apierr.Write(w, http.StatusNotFound, apierr.FileNotFound, "file not found")
+		return
+	}
+	if n := sv.nodeByRef(body.NodeID, body.NodeURL); n != nil {
+		body.NodeID = n.NodeID
+		sv.track.report(n.NodeID, incident{At: now(), Kind: "missing", FileID: body.FileID, Reporter: reporterOf(r, body.Reporter)})
+	}
+
+	missing := 0
+	for i := range meta.Replicas {
+		if meta.Replicas[i].NodeID == body.NodeID {
+			meta.Replicas[i].Status = ReplicaMissing
+		}
+		if meta.Replicas[i].Status != ReplicaReady {
+			missing++
+		}
+	}
+	if missing > 0 && meta.State == StateAvailable {
+		meta.State = StateDegraded
+	}
+	meta.UpdatedAt = now()
+	sv.store.touch(meta.FileID)
+	sv.store.persist()
+
+	writeJSONResp(w, map[string]any{"accepted": true, "state": meta.State})
+}
+
+/* ==================== PLACEMENT ==================== */
+
+// PlacementPolicy names the PlacementStrategy that places new files. It is
+// a runtime setting: PLACEMENT_POLICY seeds it, /admin/placement-policy
+// and /admin/settings change it.
+type PlacementPolicy string
+
+const (
+	PlaceLeastLoaded    PlacementPolicy = "least-loaded"            // lowest weighted load, then least recently chosen
+	PlaceRoundRobin     PlacementPolicy = "round-robin"             // take turns in node ID order
+	PlaceConsistentHash PlacementPolicy = "consistent-hash"         // same filename, same nodes while they are eligible
+	PlaceZoneSpread     PlacementPolicy = "zone-spread"             // least loaded, one per zone before any zone gets two
+	PlaceRandom         PlacementPolicy = "random-with-constraints" // at random, one per zone before any zone gets two
+)
+
+// PlacementStrategy chooses factor distinct nodes for a new file among
+// cands: the nodes that may take it (placeable, with room for it, with the
+// tags the file requires), at least factor of them, sorted by weighted load,
+// lightest first. It may reorder cands.
+type PlacementStrategy interface {
+	Place(file PlacementFile, cands []*NodeInfo, factor int) []*NodeInfo
+}
+
+// PlacementFunc adapts a function to PlacementStrategy.
+type PlacementFunc func(file PlacementFile, cands []*NodeInfo, factor int) []*NodeInfo
+
+func (f PlacementFunc) Place(file PlacementFile, cands []*NodeInfo, factor int) []*NodeInfo {
+	return f(file, cands, factor)
+}
+
+// placements are the strategies one server may place with, by policy:
+// the built-in ones plus Config.Placements. They are fixed once the server
+// is built.
+type placements map[PlacementPolicy]PlacementStrategy
+
+func builtinPlacements() placements {
+	return placements{
+		PlaceLeastLoaded: PlacementFunc(func(_ PlacementFile, cands []*NodeInfo, factor int) []*NodeInfo {
+			return cands[:factor]
+		}),
+		PlaceRoundRobin:     &roundRobin{},
+		PlaceConsistentHash: PlacementFunc(placeByHash),
+		PlaceZoneSpread: PlacementFunc(func(_ PlacementFile, cands []*NodeInfo, factor int) []*NodeInfo {
+			return spreadZones(cands, factor)
+		}),
+		PlaceRandom: PlacementFunc(func(_ PlacementFile, cands []*NodeInfo, factor int) []*NodeInfo {
+			rand.Shuffle(len(cands), func(i, j int) { cands[i], cands[j] = cands[j], cands[i] })
+			return spreadZones(cands, factor)
+		}),
+	}
+}
+
+// policies lists p's policies, sorted.
+func (p placements) policies() []PlacementPolicy { return slices.Sorted(maps.Keys(p)) }
+
+// PlacementPolicies lists the built-in policies, sorted; Config.Placements
+// adds to them.
+func PlacementPolicies() []PlacementPolicy { return builtinPlacements().policies() }
+
+// roundRobin deals files out in node ID order, each starting one node on
+// from the last, so nodes get equal numbers of files whatever their load.
+type roundRobin struct{ next atomic.Uint64 }
+
+func (rr *roundRobin) Place(_ PlacementFile, cands []*NodeInfo, factor int) []*NodeInfo {
+	slices.SortFunc(cands, func(a, b *NodeInfo) int { return strings.Compare(a.NodeID, b.NodeID) })
+	start := int((rr.next.Add(1) - 1) % uint64(len(cands)))
+	out := make([]*NodeInfo, 0, factor)
+	for i := range factor {
+		out = append(out, cands[(start+i)%len(cands)])
+	}
+	return out
+}
+
+// placeByHash ranks nodes by a hash of the filename and node ID
+// (rendezvous hashing): a file keeps its nodes while they stay eligible,
+// and a node joining or leaving moves only the files it ranks first for.
+func placeByHash(file PlacementFile, cands []*NodeInfo, factor int) []*NodeInfo {
+	score := func(n *NodeInfo) uint64 {
+		h := fnv.New64a()
+		h.Write([]byte(file.Filename))
+		h.Write([]byte{0})
+		h.Write([]byte(n.NodeID))
+		return h.Sum64()
+	}
+	slices.SortStableFunc(cands, func(a, b *NodeInfo) int { return cmp.Compare(score(b), score(a)) })
+	return cands[:factor]
+}
+
+// spreadZones takes nodes in cands order, skipping any whose zone already
+// has a replica until every zone has one. Nodes without a zone count as one
+// zone of their own.
+func spreadZones(cands []*NodeInfo, factor int) []*NodeInfo {
+	out := make([]*NodeInfo, 0, factor)
+	taken := map[*NodeInfo]bool{}
+	zones := map[string]bool{}
+	for _, n := range cands {
+		if len(out) < factor && !zones[n.Zone] {
+			zones[n.Zone] = true
+			taken[n] = true
+			out = append(out, n)
+		}
+	}
+	for _, n := range cands {
+		if len(out) < factor && !taken[n] {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// placementHints are an allocation's "require:T", "prefer:T" and "avoid:T"
+// hints, each naming a node tag. Required tags are hard: only nodes with
+// all of them are candidates. Preferred and avoided tags only order the
+// candidates: nodes with more preferred and fewer avoided tags are taken
+// first, and the strategy chooses among equals.
+type placementHints struct {
+	require, prefer, avoid []string
+}
+
+func parsePlacementHints(hints []string) (placementHints, error) {
+	var h placementHints
+	for _, hint := range hints {
+		kind, tag, ok := strings.Cut(hint, ":")
+		if !ok || tag == "" {
+			return h, fmt.Errorf("placement hint %q is not require:TAG, prefer:TAG or avoid:TAG", hint)
+		}
+		switch kind {
+		case "require":
+			h.require = append(h.require, tag)
+		case "prefer":
+			h.prefer = append(h.prefer, tag)
+		case "avoid":
+			h.avoid = append(h.avoid, tag)
+		default:
+			return h, fmt.Errorf("placement hint %q is not require:TAG, prefer:TAG or avoid:TAG", hint)
+		}
+	}
+	return h, nil
+}
+
+// allows reports whether n has every required tag.
+func (h placementHints) allows(n *NodeInfo) bool {
+	for _, tag := range h.require {
+		if !hasTag(n, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// rank is how much the hints favor n: preferred tags it has less avoided
+// tags it has.
+func (h placementHints) rank(n *NodeInfo) int {
+	r := 0
+	for _, tag := range h.prefer {
+		if hasTag(n, tag) {
+			r++
+		}
+	}
+	for _, tag := range h.avoid {
+		if hasTag(n, tag) {
+			r--
+		}
+	}
+	return r
+}
+
+// place fills factor slots from the best ranked candidates down, letting s
+// choose within the rank where the slots run out.
+func (h placementHints) place(s PlacementStrategy, file PlacementFile, cands []*NodeInfo, factor int) []*NodeInfo {
+	if len(h.prefer)+len(h.avoid) == 0 {
+		return s.Place(file, cands, factor)
+	}
+	slices.SortStableFunc(cands, func(a, b *NodeInfo) int { return cmp.Compare(h.rank(b), h.rank(a)) })
+	out := make([]*NodeInfo, 0, factor)
+	for start := 0; start < len(cands) && len(out) < factor; {
+		end := start + 1
+		for end < len(cands) && h.rank(cands[end]) == h.rank(cands[start]) {
+			end++
+		}
+		group, need := cands[start:end], factor-len(out)
+		if len(group) > need {
+			group = s.Place(file, group, need)
+		}
+		out = append(out, group...)
+		start = end
+	}
+	return out
+}
+
+// PlacementPolicyRequest is the body of PUT /admin/placement-policy.
+type PlacementPolicyRequest struct {
+	Policy PlacementPolicy `json:"policy"`
+}
+
+// handlePlacementPolicy shows (GET) or switches (PUT) the placement
+// policy. A switch applies to the next allocation; files already placed
+// stay where they are.
+func (sv *Server) handlePlacementPolicy(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		writeJSONResp(w, map[string]any{"policy": sv.tunables().PlacementPolicy, "available": sv.placements.policies(), "webhook": sv.placementURL != ""})
+		return
+	}
+	var body PlacementPolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json")
+		return
+	}
+	if sv.placements[body.Policy] == nil {
+		apierr.WriteDetail(w, http.StatusBadRequest, apierr.BadRequest, fmt.Sprintf("unknown placement policy %q", body.Policy),
+			map[string]any{"available": sv.placements.policies()})
+		return
+	}
+	sv.settingsMu.Lock()
+	defer sv.settingsMu.Unlock()
+	next := sv.tunables()
+	previous := next.PlacementPolicy
+	next.PlacementPolicy = body.Policy
+	if err := sv.saveSettings(next); err != nil {
+		apierr.WriteDetail(w, http.StatusInternalServerError, apierr.Internal, "cannot save settings", err.Error())
+		return
+	}
+	if previous != body.Policy {
+		log.Printf("[ADMIN] placement policy %s -> %s", previous, body.Policy)
+		sv.record(r, "placement-policy", "cluster", fmt.Sprintf("%s -> %s", previous, body.Policy))
+	}
+	writeJSONResp(w, map[string]any{"policy": body.Policy, "previous": previous})
+}
+
+/* ==================== STORAGE CLASSES ==================== */
+
+// StorageClass names a durability and placement profile for files. A file
+// without one is STANDARD.
+type StorageClass string
+
+const (
+	ClassStandard StorageClass = "STANDARD"
+	ClassReduced  StorageClass = "REDUCED"
+	ClassArchive  StorageClass = "ARCHIVE"
+)
+
+// StorageClassSpec is what a class means for its files. Factor 0 follows
+// the cluster's replicationFactor; Placement hints come before the file's
+// own.
+type StorageClassSpec struct {
+	Factor      int      `json:"factor,omitempty"`
+	Placement   []string `json:"placement,omitempty"`
+	Description string   `json:"description"`
+}
+
+// StorageClasses are the classes /allocate and /files/{fileId}/storage-class
+// accept. Programs embedding the naming service may change them before
+// NewServer, which checks their hints.
+var StorageClasses = map[StorageClass]StorageClassSpec{
+	ClassStandard: {Description: "the cluster replication factor, on any nodes"},
+	ClassReduced:  {Factor: 1, Description: "a single replica: cheaper, and lost with its node until re-uploaded"},
+	ClassArchive:  {Placement: []string{"prefer:hdd", "avoid:ssd"}, Description: "the cluster replication factor, kept off fast nodes"},
+}
+
+func classOf(meta *FileMetadata) StorageClass { return cmp.Or(meta.StorageClass, ClassStandard) }
+
+// hintsOf is meta's placement hints: its class's, then its own. Both were
+// checked when they were set.
+func hintsOf(meta *FileMetadata) placementHints {
+	h, _ := parsePlacementHints(append(slices.Clone(StorageClasses[classOf(meta)].Placement), meta.Placement...))
+	return h
+}
+
+func checkStorageClasses() error {
+	for name, spec := range StorageClasses {
+		if spec.Factor < 0 {
+			return fmt.Errorf("storage class %s: factor must not be negative", name)
+		}
+		if _, err := parsePlacementHints(spec.Placement); err != nil {
+			return fmt.Errorf("storage class %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// setClass moves meta to class and plans what that takes: copies or trims
+// to reach the class's factor, then moves off nodes its hints now rank
+// below a free node. A per-file factor from /admin/set-replication is
+// dropped, so the class decides. Callers must hold the store lock for
+// writing.
+func (sv *Server) setClass(meta *FileMetadata, class StorageClass) []repairJob {
+	meta.StorageClass = class
+	meta.ReplicationFactor = 0
+	sv.refreshState(meta)
+	meta.UpdatedAt = now()
+	sv.store.touch(meta.FileID)
+	return append(sv.planHeal(meta), sv.planPlacementMoves(meta)...)
+}
+
+// planPlacementMoves moves READY replicas off nodes the file's hints rank
+// below a node that could take it instead, worst placed first, one move
+// per better node. Callers must hold the store lock for writing.
+func (sv *Server) planPlacementMoves(meta *FileMetadata) []repairJob {
+	hints := hintsOf(meta)
+	if len(hints.require)+len(hints.prefer)+len(hints.avoid) == 0 {
+		return nil
+	}
+	holding := map[string]bool{}
+	for _, rep := range meta.Replicas {
+		holding[rep.NodeID] = true
+	}
+	var cands []*NodeInfo
+	for _, n := range sv.store.nodes {
+		if !holding[n.NodeID] && sv.placeable(n) && freeBytes(n) >= storedSize(meta) && hints.allows(n) {
+			cands = append(cands, n)
+		}
+	}
+	cands = steadyFirst(cands, 1)
+	sort.Slice(cands, func(i, j int) bool {
+		ri, rj := hints.rank(cands[i]), hints.rank(cands[j])
+		if ri != rj {
+			return ri > rj
+		}
+		return weightedLoad(cands[i]) < weightedLoad(cands[j])
+	})
+	// a replica on a node the hints no longer allow ranks below any candidate
+	score := func(rep ReplicaInfo) int {
+		n, ok := sv.store.nodes[rep.NodeID]
+		if !ok || !hints.allows(n) {
+			return math.MinInt
+		}
+		return hints.rank(n)
+	}
+	var movable []ReplicaInfo
+	for _, rep := range meta.Replicas {
+		if rep.Status == ReplicaReady {
+			movable = append(movable, rep)
+		}
+	}
+	sort.SliceStable(movable, func(i, j int) bool { return score(movable[i]) < score(movable[j]) })
+
+	var jobs []repairJob
+	for _, rep := range movable {
+		if len(cands) == 0 || score(rep) >= hints.rank(cands[0]) {
+			break
+		}
+		target := cands[0]
+		cands = cands[1:]
+		jobs = append(jobs, repairJob{
+			FileID: meta.FileID, Checksum: meta.Checksum,
+			SourceID: rep.NodeID, SourceURL: rep.URL,
+			TargetID: target.NodeID, TargetURL: target.URL, Move: true,
+		})
+		meta.Replicas = append(meta.Replicas, ReplicaInfo{NodeID: target.NodeID, URL: target.URL, Status: ReplicaMissing, LastVerifiedAt: now()})
+		log.Printf("[PLACEMENT] %s (%s): moving the replica on %s to %s", meta.FileID, meta.Filename, rep.NodeID, target.NodeID)
+	}
+	return jobs
+}
+
+// handleStorageClasses lists the storage classes.
+func (sv *Server) handleStorageClasses(w http.ResponseWriter, r *http.Request) {
+	writeJSONResp(w, map[string]any{"classes": StorageClasses, "default": ClassStandard})
+}
+
+// ChangeClassRequest is the body of POST /files/{fileId}/storage-class.
+type ChangeClassRequest struct {
+	StorageClass StorageClass `json:"storageClass"`
+}
+
+// handleChangeClass moves a file to another storage class and starts the
+// copies, trims and moves that takes. Progress is reported by the returned
+// operation in /operations; auto-heal finishes whatever fails.
+func (sv *Server) handleChangeClass(w http.ResponseWriter, r *http.Request) {
+	var body ChangeClassRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.StorageClass == "" {
+		apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json: need storageClass")
+		return
+	}
+	if _, ok := StorageClasses[body.StorageClass]; !ok {
+		apierr.WriteDetail(w, http.StatusBadRequest, apierr.BadRequest, fmt.Sprintf("unknown storage class %q", body.StorageClass),
+			map[string]any{"available": slices.Sorted(maps.Keys(StorageClasses))})
+		return
+	}
+	sv.store.mu.Lock()
+	meta, ok := sv.store.files[r.PathValue("fileId")]
+	if !ok || meta.State == StateDeleted {
+		sv.store.mu.Unlock()
+		apierr.Write(w, http.StatusNotFound, apierr.FileNotFound, "file not found")
+		return
+	}
+	if meta.State == StateAllocated {
+		sv.store.mu.Unlock()
+		apierr.Write(w, http.StatusConflict, apierr.FileNotReady, "file is not committed yet")
+		return
+	}
+	previous := classOf(meta)
+	var jobs []repairJob
+	if previous != body.StorageClass || meta.ReplicationFactor > 0 {
+		jobs = sv.setClass(meta, body.StorageClass)
+	}
+	factor := sv.factorOf(meta)
+	sv.store.mu.Unlock()
+	sv.store.persist()
+
+	resp := map[string]any{"fileId": meta.FileID, "storageClass": body.StorageClass, "previous": previous, "factor": factor, "scheduled": len(jobs)}
+	if previous != body.StorageClass {
+		log.Printf("[CLASS] %s: %s -> %s, %d repairs scheduled", meta.FileID, previous, body.StorageClass, len(jobs))
+		sv.record(r, "change-class", meta.FileID, fmt.Sprintf("%s -> %s", previous, body.StorageClass))
+	}
+	if len(jobs) > 0 {
+		op := sv.ops.start("change-class", fmt.Sprintf("%s to %s", meta.FileID, body.StorageClass), len(jobs))
+		go sv.runRepairs(op, jobs)
+		resp["operation"] = op.ID
+	}
+	writeJSONResp(w, resp)
+}
+
+/* ==================== PLACEMENT WEBHOOK ==================== */
+
+// placementRequest is POSTed to PLACEMENT_WEBHOOK for every new file. The
+// webhook answers with placementResponse; anything else (error, timeout,
+// invalid choice) falls back to the configured PlacementPolicy.
+type placementRequest struct {
+	File              PlacementFile        `json:"file"`
+	ReplicationFactor int                  `json:"replicationFactor"`
+	Candidates        []placementCandidate `json:"candidates"` // eligible nodes, least loaded first
+	Default           []string             `json:"default"`    // what the configured PlacementPolicy would choose
+}
+
+type PlacementFile struct {
+	Filename    string   `json:"filename"`
+	Size        int64    `json:"size"`
+	ContentType string   `json:"contentType"`
+	Hints       []string `json:"hints,omitempty"` // the allocation's placement hints
+}
+
+type placementCandidate struct {
+	NodeID        string   `json:"nodeId"`
+	URL           string   `json:"url"`
+	Zone          string   `json:"zone,omitempty"`
+	Tags          []string `json:"tags,omitempty"`
+	Weight        float64  `json:"weight,omitempty"`
+	CapacityBytes int64    `json:"capacityBytes"`
+	UsedBytes     int64    `json:"usedBytes"`
+	FreeBytes     int64    `json:"freeBytes"`
+	LoadFactor    float64  `json:"loadFactor"`
+}
+
+type placementResponse struct {
+	Nodes []string `json:"nodes"`
+}
+
+// placementStats counts how allocations were placed, for /metrics.
+type placementStats struct {
+	webhook   atomic.Int64 // placed by the webhook
+	fallbacks atomic.Int64 // webhook failed or answered invalidly
+}
+
+// consultPlacement asks the webhook to choose req.ReplicationFactor distinct
+// nodes among req.Candidates.
+func (sv *Server) consultPlacement(ctx context.Context, req placementRequest) ([]string, error) {
+	payload, _ := json.Marshal(req)
+	ctx, cancel := context.WithTimeout(ctx, sv.placementTimeout)
+	defer cancel()
+	hreq, _ := http.NewRequestWithContext(ctx, http.MethodPost, sv.placementURL, bytes.NewReader(payload))
+	hreq.Header.Set("Content-Type", "application/json")
+	resp, err := sv.httpClient(0).Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	var out placementResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("bad webhook response: %w", err)
+	}
+	if len(out.Nodes) != req.ReplicationFactor {
+		return nil, fmt.Errorf("webhook chose %d nodes, need %d", len(out.Nodes), req.ReplicationFactor)
+	}
+	eligible := map[string]bool{}
+	for _, c := range req.Candidates {
+		eligible[c.NodeID] = true
+	}
+	for _, id := range out.Nodes {
+		if !eligible[id] {
+			return nil, fmt.Errorf("webhook chose %q, which is not a candidate or was chosen twice", id)
+		}
+		eligible[id] = false
+	}
+	return out.Nodes, nil
+}
+
+/* ==================== METRICS & MONITORING ==================== */
+
+func (sv *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	sv.store.mu.RLock()
+	defer sv.store.mu.RUnlock()
+
+	totalFiles := len(sv.store.files)
+	totalNodes := len(sv.store.nodes)
+	var totalSize, totalStored, usedBytes, capacityBytes int64
+	healthyNodes, suspectNodes, downNodes, maintenanceNodes, readOnlyNodes := 0, 0, 0, 0, 0
+	filesByState := map[FileState]int{}
+
+	for _, f := range sv.store.files {
+		totalSize += f.Size
+		totalStored += storedSize(f)
+		filesByState[f.State]++
+	}
+	savingsRatio := 0.0
+	if totalSize > 0 {
+		savingsRatio = float64(totalSize-totalStored) / float64(totalSize)
+	}
+
+	for _, n := range sv.store.nodes {
+		capacityBytes += n.CapacityBytes
+		usedBytes += n.UsedBytes
+		switch sv.healthOf(n) {
+		case NodeHealthy:
+			healthyNodes++
+		case NodeSuspect:
+			suspectNodes++
+		case NodeDown:
+			downNodes++
+		}
+		if n.Maintenance {
+			maintenanceNodes++
+		}
+		if n.ReadOnly {
+			readOnlyNodes++
+		}
+	}
+
+	w.Header().Set(catalogRevisionHeader, fmt.Sprint(sv.store.revision))
+	writeJSONResp(w, map[string]any{
+		"catalogRevision":  sv.store.revision,
+		"totalFiles":       totalFiles,
+		"totalNodes":       totalNodes,
+		"totalSizeBytes":   totalSize,
+		"totalStoredBytes": totalStored,
+		"compression": map[string]any{
+			"logicalBytes": totalSize,
+			"storedBytes":  totalStored,
+			"savedBytes":   totalSize - totalStored,
+			"savingsRatio": savingsRatio,
+		},
+		"nodes": map[string]int{
+			"healthy":      healthyNodes,
+			"suspect":      suspectNodes,
+			"down":         downNodes,
+			"maintenance":  maintenanceNodes,
+			"readOnly":     readOnlyNodes,
+			"openCircuits": sv.nodeCalls.openCircuits(),
+		},
+		"placement": map[string]any{
+			"webhook":   sv.placementURL != "",
+			"byWebhook": sv.placement.webhook.Load(),
+			"fallbacks": sv.placement.fallbacks.Load(),
+		},
+		"storage": map[string]int64{
+			"capacity": capacityBytes,
+			"used":     usedBytes,
+			"free":     capacityBytes - usedBytes,
+		},
+		"filesByState":   filesByState,
+		"geoReplication": geoMetrics(sv.geoStatus()),
+		"shard":          sv.shard,
+	})
+}
+
+// geoMetrics is the /metrics view of the geo-replication peers.
+func geoMetrics(peers []geoPeerStatus) map[string]any {
+	out := map[string]any{}
+	for _, p := range peers {
+		out[p.ID] = map[string]any{"queued": p.Queued, "lagSeconds": p.LagSeconds, "pushed": p.Pushed, "conflicts": len(p.Conflicts)}
+	}
+	return out
+}
+
+// metricsSample is the cluster at one time, as /metrics/history charts it.
+type metricsSample struct {
+	At            time.Time         `json:"at"`
+	Files         int               `json:"files"`
+	FilesByState  map[FileState]int `json:"filesByState"`
+	LogicalBytes  int64             `json:"logicalBytes"`
+	StoredBytes   int64             `json:"storedBytes"`
+	UsedBytes     int64             `json:"usedBytes"`
+	CapacityBytes int64             `json:"capacityBytes"`
+	HealthyNodes  int               `json:"healthyNodes"`
+	SuspectNodes  int               `json:"suspectNodes"`
+	DownNodes     int               `json:"downNodes"`
+	HealQueue     int               `json:"healQueue"`
+	AlertsFiring  int               `json:"alertsFiring"`
+}
+
+const (
+	metricsKeep      = 2880 // samples: 24h at the default 30s
+	metricsSaveEvery = 10   // samples between saves to metrics-history.json
+)
+
+// metricsHistory is a ring of the last metricsKeep samples, saved every
+// metricsSaveEvery samples and on Close so a restart keeps most of them.
+type metricsHistory struct {
+	mu      sync.Mutex
+	path    string
+	every   time.Duration // 0 when sampling is off
+	samples []metricsSample
+	next    int // where the next sample goes once the ring is full
+	unsaved int
+}
+
+func openMetricsHistory(path string) (*metricsHistory, error) {
+	h := &metricsHistory{path: path}
+	if b, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(b, &h.samples); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if len(h.samples) > metricsKeep {
+		h.samples = h.samples[len(h.samples)-metricsKeep:]
+	}
+	return h, nil
+}
+
+func (h *metricsHistory) add(s metricsSample) {
+	h.mu.Lock()
+	if len(h.samples) < metricsKeep {
+		h.samples = append(h.samples, s)
+	} else {
+		h.samples[h.next] = s
+		h.next = (h.next + 1) % metricsKeep
+	}
+	h.unsaved++
+	save := h.unsaved >= metricsSaveEvery
+	h.mu.Unlock()
+	if save {
+		h.save()
+	}
+}
+
+// since returns the samples taken after t, oldest first.
+func (h *metricsHistory) since(t time.Time) []metricsSample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ordered := append(slices.Clone(h.samples[h.next:]), h.samples[:h.next]...)
+	i, _ := slices.BinarySearchFunc(ordered, t, func(s metricsSample, t time.Time) int { return s.At.Compare(t) })
+	return ordered[i:]
+}
+
+func (h *metricsHistory) save() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.unsaved == 0 {
+		return
+	}
+	ordered := append(slices.Clone(h.samples[h.next:]), h.samples[:h.next]...)
+	if err := writeJSONFile(h.path, ordered); err != nil {
+		log.Printf("[METRICS] cannot save metrics history: %v", err)
+		return
+	}
+	h.unsaved = 0
+}
+
+// startMetricsSampling takes a sample now and then every interval.
+func (sv *Server) startMetricsSampling(every time.Duration) {
+	go func() {
+		sv.sampleMetrics()
+		sv.every(every, sv.sampleMetrics)
+	}()
+	log.Printf("Metrics sampling started (every %s)", every)
+}
+
+func (sv *Server) sampleMetrics() {
+	s := metricsSample{At: now(), FilesByState: map[FileState]int{}}
+	sv.store.mu.RLock()
+	s.Files = len(sv.store.files)
+	for _, f := range sv.store.files {
+		s.FilesByState[f.State]++
+		s.LogicalBytes += f.Size
+		s.StoredBytes += storedSize(f)
+	}
+	for _, n := range sv.store.nodes {
+		s.UsedBytes += n.UsedBytes
+		s.CapacityBytes += n.CapacityBytes
+		switch sv.healthOf(n) {
+		case NodeHealthy:
+			s.HealthyNodes++
+		case NodeSuspect:
+			s.SuspectNodes++
+		case NodeDown:
+			s.DownNodes++
+		}
+	}
+	sv.store.mu.RUnlock()
+	pending, _ := sv.heal.snapshot()
+	s.HealQueue = len(pending)
+	sv.alerts.mu.Lock()
+	for _, st := range sv.alerts.state {
+		if st.state == AlertFiring {
+			s.AlertsFiring++
+		}
+	}
+	sv.alerts.mu.Unlock()
+	sv.metrics.add(s)
+}
+
+// handleMetricsHistory returns the samples of the last ?window= (default
+// 1h). ?step= thins them to the last sample of each step, for long
+// windows on small charts.
+func (sv *Server) handleMetricsHistory(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	window := time.Hour
+	if v := q.Get("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			apierr.Write(w, http.StatusBadRequest, apierr.BadRequest, "window must be a positive duration, e.g. 1h")
+			return
+		}
+		window = d
+	}
+	var step time.Duration
+	if v := q.Get("step"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			apierr.Write(w, http.StatusBadRequest, apierr.BadRequest, "step must be a positive duration, e.g. 5m")
+			return
+		}
+		step = d
+	}
+	samples := sv.metrics.since(now().Add(-window))
+	if step > 0 {
+		var thinned []metricsSample
+		for i, s := range samples {
+			if i == len(samples)-1 || s.At.Truncate(step) != samples[i+1].At.Truncate(step) {
+				thinned = append(thinned, s)
+			}
+		}
+		samples = thinned
+	}
+	if samples == nil {
+		samples = []metricsSample{}
+	}
+	interval := ""
+	if sv.metrics.every > 0 {
+		interval = sv.metrics.every.String()
+	}
+	resp := map[string]any{"window": window.String(), "interval": interval, "samples": samples}
+	if step > 0 {
+		resp["step"] = step.String()
+	}
+	writeJSONResp(w, resp)
+}
+
+func (sv *Server) handleListFiles(w http.ResponseWriter, r *http.Request) {
+	snap := sv.filesSnapshot()
+	etag := fmt.Sprintf(`"%d"`, snap.revision)
+	w.Header().Set(catalogRevisionHeader, fmt.Sprint(snap.revision))
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(snap.body)
+}
+
+// FileSummary is one file in /list-files; derived files are left out.
+type FileSummary struct {
+	FileID       string    `json:"fileId"`
+	Filename     string    `json:"filename"`
+	Size         int64     `json:"size"`
+	StoredSize   int64     `json:"storedSize"`
+	SavedBytes   int64     `json:"savedBytes"`
+	State        FileState `json:"state"`
+	ReplicaCount int       `json:"replicaCount"`
+	Replication  int       `json:"replicationFactor"`
+	CreatedAt    time.Time `json:"createdAt"`
+
+	Owner      string     `json:"owner,omitempty"`
+	ACL        []ACLEntry `json:"acl,omitempty"`
+	ConflictID string     `json:"conflictId,omitempty"`
+
+	StorageClass StorageClass `json:"storageClass,omitempty"`
+}
+
+// filesSnapshot returns the /list-files body for the current catalog
+// revision, rebuilding it only when the catalog has changed since.
+func (sv *Server) filesSnapshot() catalogSnapshot {
+	sv.store.mu.RLock()
+	defer sv.store.mu.RUnlock()
+	sv.snapMu.Lock()
+	defer sv.snapMu.Unlock()
+	if sv.filesSnap.body != nil && sv.filesSnap.revision == sv.store.revision {
+		return sv.filesSnap
+	}
+
+	var files []FileSummary
+	for _, f := range sv.store.files {
+		if f.ParentID != "" {
+			continue // reached through the parent's derived map
+		}
+		files = append(files, FileSummary{
+			FileID:       f.FileID,
+			Filename:     f.Filename,
+			Size:         f.Size,
+			StoredSize:   storedSize(f),
+			SavedBytes:   f.Size - storedSize(f),
+			State:        f.State,
+			ReplicaCount: len(f.Replicas),
+			Replication:  sv.factorOf(f),
+			CreatedAt:    f.CreatedAt,
+			Owner:        f.Owner,
+			ACL:          f.ACL,
+			ConflictID:   f.ConflictID,
+			StorageClass: f.StorageClass,
+		})
+	}
+	body, _ := json.Marshal(files)
+	sv.filesSnap = catalogSnapshot{revision: sv.store.revision, body: append(body, '\n')}
+	return sv.filesSnap
+}
+
+func (sv *Server) handleFileInfo(w http.ResponseWriter, r *http.Request) {
+	fileID := r.PathValue("fileId")
+	sv.store.mu.RLock()
+	meta, ok := sv.store.files[fileID]
+	if ok {
+		meta = meta.clone() // heal workers update it while we encode
+	}
+	sv.store.mu.RUnlock()
+	if !ok {
+		apierr.Write(w, http.StatusNotFound, apierr.FileNotFound, "file not found")
+		return
+	}
+	writeJSONResp(w, meta)
+}
+
+// DeleteFileRequest is the body of POST /delete-file.
+type DeleteFileRequest struct {
+	FileID string `json:"fileId"`
+}
+
+// handleDeleteFile serves DELETE /files/{fileId} and the older POST
+// /delete-file, which names the file in its body.
+func (sv *Server) handleDeleteFile(w http.ResponseWriter, r *http.Request) {
+	body := DeleteFileRequest{FileID: r.PathValue("fileId")}
+	if body.FileID == "" {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json")
+			return
+		}
+	}
+
+	sv.store.mu.Lock()
+	defer sv.store.mu.Unlock()
+	meta, ok := sv.store.files[body.FileID]
+	if !ok {
+		// deleting twice is not an error: a retry must not fail because the
+		// first attempt worked
+		if _, gone := sv.idem.deletedAt(body.FileID); gone && isDryRun(r) {
+			writeJSONResp(w, newChangePlan())
+		} else if gone {
+			writeJSONResp(w, map[string]any{"deleted": true, "fileId": body.FileID, "derived": []string{}, "alreadyDeleted": true})
+		} else {
+			apierr.Write(w, http.StatusNotFound, apierr.FileNotFound, "file not found")
+		}
+		return
+	}
+	var derived []*FileMetadata
+	for _, id := range meta.Derived {
+		if d, ok := sv.store.files[id]; ok {
+			derived = append(derived, d)
+		}
+	}
+	if isDryRun(r) {
+		plan := newChangePlan()
+		plan.addFile(meta)
+		for _, d := range derived {
+			plan.addFile(d)
+		}
+		writeJSONResp(w, plan)
+		return
+	}
+	derivedIDs := sv.removeFile(meta)
+	sv.idem.tombstone(append(derivedIDs, meta.FileID)...)
+	sv.store.persist()
+	sv.record(r, "delete-file", body.FileID, meta.Filename)
+	writeJSONResp(w, map[string]any{"deleted": true, "fileId": body.FileID, "derived": derivedIDs})
+}
+
+// removeFile takes meta and the files derived from it out of the catalog,
+// with their quota charge, shares and conflict, and returns the derived
+// IDs. The blobs are left to the caller, and so are the tombstones, which
+// one call to idem.tombstone saves for every file removed. Callers hold
+// the store lock for writing.
+func (sv *Server) removeFile(meta *FileMetadata) []string {
+	delete(sv.store.files, meta.FileID)
+	sv.store.quotas.release(meta)
+	if parent, ok := sv.store.files[meta.ParentID]; ok {
+		for kind, id := range parent.Derived {
+			if id == meta.FileID {
+				delete(parent.Derived, kind)
+			}
+		}
+	}
+	derivedIDs := []string{}
+	sv.store.shares.dropFile(meta.FileID)
+	sv.store.mark(sv.store.conflicts.members(meta.ConflictID)...)
+	sv.store.conflicts.dropFile(meta, sv.store.files)
+	for _, id := range meta.Derived {
+		if d, ok := sv.store.files[id]; ok {
+			delete(sv.store.files, d.FileID)
+			sv.store.shares.dropFile(d.FileID)
+			derivedIDs = append(derivedIDs, d.FileID)
+		}
+	}
+	sv.store.touch(append([]string{meta.FileID, meta.ParentID}, derivedIDs...)...)
+	return derivedIDs
+}
+
+func (sv *Server) handleClusterInfo(w http.ResponseWriter, r *http.Request) {
+	sv.store.mu.RLock()
+	defer sv.store.mu.RUnlock()
+
+	components := []map[string]string{{"component": "naming", "id": "naming", "version": Version}}
+	for _, n := range sv.store.nodes {
+		v := n.Version
+		if v == "" {
+			v = "unknown"
+		}
+		components = append(components, map[string]string{"component": "storage-node", "id": n.NodeID, "version": v})
+	}
+	sort.Slice(components[1:], func(i, j int) bool { return components[i+1]["id"] < components[j+1]["id"] })
+
+	t := sv.tunables()
+	writeJSONResp(w, map[string]any{
+		"clusterId":  sv.store.clusterID,
+		"components": components,
+		"policies": map[string]any{
+			"replicationFactor":   t.ReplicationFactor,
+			"writeQuorum":         t.WriteQuorum,
+			"placementStrategy":   t.PlacementPolicy,
+			"readPolicy":          t.ReadPolicy,
+			"defaultHeartbeatMs":  t.DefaultHeartbeatMs,
+			"suspectAfterBeats":   t.SuspectAfterBeats,
+			"downAfterBeats":      t.DownAfterBeats,
+			"healInterval":        t.healInterval().String(),
+			"healConcurrency":     sv.heal.workers,
+			"antiEntropyInterval": sv.antiEntropyEvery.String(),
+			"verifyInterval":      sv.verifyEvery.String(),
+		},
+		"features": map[string]bool{
+			"autoHealing":    true,
+			"antiEntropy":    sv.antiEntropyEvery > 0,
+			"verifier":       sv.verifyEvery > 0,
+			"peerGossip":     true,
+			"dryRun":         true,
+			"degradedReads":  t.ReadPolicy == ReadLenient,
+			"uploadChecksum": true,
+		},
+	})
+}
+
+func (sv *Server) handleListNodes(w http.ResponseWriter, r *http.Request) {
+	sv.store.mu.RLock()
+	defer sv.store.mu.RUnlock()
+
+	type nodeInfo struct {
+		NodeID        string     `json:"nodeId"`
+		URL           string     `json:"url"`
+		Status        NodeStatus `json:"status"`
+		CapacityBytes int64      `json:"capacityBytes"`
+		UsedBytes     int64      `json:"usedBytes"`
+		FreeBytes     int64      `json:"freeBytes"`
+		LoadFactor    float64    `json:"loadFactor"`
+		LastSeenAt    time.Time  `json:"lastSeenAt"`
+		HeartbeatMs   int64      `json:"heartbeatIntervalMs"`
+		Partitioned   bool       `json:"partitioned"`
+		Degraded      bool       `json:"degraded"`
+		Maintenance   bool       `json:"maintenance"`
+		ReadOnly      bool       `json:"readOnly"`
+		DiskFreeBytes int64      `json:"diskFreeBytes,omitempty"`
+		Discovered    bool       `json:"discovered,omitempty"`
+		Flapping      bool       `json:"flapping,omitempty"`
+	}
+
+	var nodes []nodeInfo
+	for _, n := range sv.store.nodes {
+		nodes = append(nodes, nodeInfo{
+			NodeID:        n.NodeID,
+			URL:           n.URL,
+			Status:        sv.stateOf(n),
+			CapacityBytes: n.CapacityBytes,
+			UsedBytes:     n.UsedBytes,
+			FreeBytes:     freeBytes(n),
+			LoadFactor:    loadFactor(n),
+			LastSeenAt:    n.LastSeenAt,
+			HeartbeatMs:   sv.heartbeatOf(n).Milliseconds(),
+			Partitioned:   time.Since(n.LastSeenAt) > sv.heartbeatOf(n) && sv.peerVouched(n),
+			Degraded:      n.Degraded,
+			Maintenance:   n.Maintenance,
+			ReadOnly:      n.ReadOnly,
+			DiskFreeBytes: n.DiskFreeBytes,
+			Discovered:    n.Discovered,
+			Flapping:      n.Flapping,
+		})
+	}
+	writeJSONResp(w, nodes)
+}
+
+/* ==================== HTTP CLIENTS ==================== */
+
+// TransportConfig tunes the connection pool behind every outbound call.
+type TransportConfig struct {
+	MaxIdleConns        int           // idle connections kept across all hosts
+	MaxIdleConnsPerHost int           // idle connections kept per host
+	MaxConnsPerHost     int           // dialing + active + idle per host (0 = no limit)
+	IdleConnTimeout     time.Duration // idle connections are closed after this
+	DialTimeout         time.Duration
+	KeepAlive           time.Duration // TCP keep-alive probe interval
+	TLSHandshakeTimeout time.Duration
+}
+
+func newTransport(tc TransportConfig) *http.Transport {
+	dialer := &net.Dialer{Timeout: tc.DialTimeout, KeepAlive: tc.KeepAlive}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          tc.MaxIdleConns,
+		MaxIdleConnsPerHost:   tc.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       tc.MaxConnsPerHost,
+		IdleConnTimeout:       tc.IdleConnTimeout,
+		TLSHandshakeTimeout:   tc.TLSHandshakeTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// httpClient returns a client on the server's transport; clients are
+// cheap, connections are not. A zero timeout means none.
+func (sv *Server) httpClient(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: sv.transport, Timeout: timeout}
+}
+
+/* ==================== NODE CALLS ==================== */
+
+// CallPolicy governs how calls to storage nodes are retried and when a
+// node's circuit opens.
+type CallPolicy struct {
+	Attempts   int           // tries per call, the first one included
+	BaseDelay  time.Duration // backoff before the second try; doubles after that
+	MaxDelay   time.Duration // backoff ceiling
+	BreakAfter int           // consecutive failures that open a node's circuit (0 = never)
+	OpenFor    time.Duration // how long an open circuit fails fast before a trial call
+}
+
+// resilientClient retries transient failures with jittered exponential
+// backoff and keeps a circuit breaker per node, so repairs and checks
+// against a dead node fail fast instead of each waiting out a timeout.
+type resilientClient struct {
+	policy CallPolicy
+	mu     sync.Mutex
+	hosts  map[string]*circuit
+}
+
+type circuit struct {
+	fails     int       // consecutive failures while closed
+	openUntil time.Time // zero while closed; past it, one failure reopens
+}
+
+var errCircuitOpen = errors.New("circuit open")
+
+func newResilientClient(p CallPolicy) *resilientClient {
+	if p.Attempts < 1 {
+		p.Attempts = 1
+	}
+	return &resilientClient{policy: p, hosts: map[string]*circuit{}}
+}
+
+// postJSON posts body to a node.
+func (rc *resilientClient) postJSON(ctx context.Context, client *http.Client, url string, body []byte) (*http.Response, error) {
+	return rc.send(ctx, client, http.MethodPost, url, body)
+}
+
+// send makes a request to a node, with body as JSON when it is not nil.
+// Every node endpoint the naming service calls (/replicate, /verify, /copy,
+// DELETE /files/{fileId}) is idempotent, so network errors and 502/503/504
+// are retried; they also count against the node's circuit.
+func (rc *resilientClient) send(ctx context.Context, client *http.Client, method, url string, body []byte) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		host := req.URL.Host
+		if !rc.allow(host) {
+			return nil, fmt.Errorf("%s: %w", host, errCircuitOpen)
+		}
+		resp, err := client.Do(req)
+		if ctx.Err() != nil {
+			// cancelled or shutting down; that says nothing about the node
+			return resp, err
+		}
+		failed := err != nil || resp.StatusCode == http.StatusBadGateway ||
+			resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusGatewayTimeout
+		rc.record(host, !failed)
+		if !failed || attempt+1 >= rc.policy.Attempts {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		select {
+		case <-time.After(rc.backoff(attempt)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// backoff is the wait after the given (0-based) failed attempt: the
+// doubled base delay, capped, with the upper half jittered.
+func (rc *resilientClient) backoff(attempt int) time.Duration {
+	d := rc.policy.BaseDelay << attempt
+	if d <= 0 || d > rc.policy.MaxDelay {
+		d = rc.policy.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+func (rc *resilientClient) allow(host string) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	c := rc.hosts[host]
+	return c == nil || c.openUntil.IsZero() || time.Now().After(c.openUntil)
+}
+
+func (rc *resilientClient) record(host string, ok bool) {
+	if rc.policy.BreakAfter <= 0 {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if ok {
+		delete(rc.hosts, host)
+		return
+	}
+	c := rc.hosts[host]
+	if c == nil {
+		c = &circuit{}
+		rc.hosts[host] = c
+	}
+	c.fails++
+	if !c.openUntil.IsZero() || c.fails >= rc.policy.BreakAfter {
+		if time.Now().After(c.openUntil) {
+			log.Printf("circuit for %s open for %s after %d failure(s)", host, rc.policy.OpenFor, c.fails)
+		}
+		c.fails = 0
+		c.openUntil = time.Now().Add(rc.policy.OpenFor)
+	}
+}
+
+// openCircuits counts the nodes currently failing fast, for /metrics.
+func (rc *resilientClient) openCircuits() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	n := 0
+	for _, c := range rc.hosts {
+		if time.Now().Before(c.openUntil) {
+			n++
+		}
+	}
+	return n
+}
+
+/* ==================== AUTO-HEALING ==================== */
+
+// startAutoHealing sweeps the catalog every healIntervalMs and queues the
+// files that need repair; a settings change wakes it so a new interval
+// applies immediately. The heal workers do the actual work.
+func (sv *Server) startAutoHealing() {
+	go func() {
+		for {
+			select {
+			case <-time.After(sv.tunables().healInterval()):
+				sv.enqueueHeals()
+			case <-sv.healWake:
+			case <-sv.quit:
+				return
+			}
+		}
+	}()
+	for i := 0; i < sv.heal.workers; i++ {
+		go sv.healWorker()
+	}
+	log.Printf("Auto-healing background job started (%d workers)", sv.heal.workers)
+}
+
+// repairJob asks target to pull fileID from source, or with Trim set, to
+// drop its surplus copy.
+type repairJob struct {
+	FileID, Checksum    string
+	SourceID, SourceURL string
+	TargetID, TargetURL string
+	Move                bool
+	Trim                bool
+}
+
+// planHeal brings meta towards its replication factor: missing replicas get
+// a copy job (refreshing stale copies in place first), surplus READY ones a
+// trim job. Callers must hold the store lock for writing.
+func (sv *Server) planHeal(meta *FileMetadata) []repairJob {
+	var jobs []repairJob
+	fileID := meta.FileID
+	if meta.State == StateDeleted || meta.State == StateAllocated || meta.State == StateCorrupt {
+		return nil
+	}
+	factor := sv.factorOf(meta)
+
+	// Count healthy replicas
+	healthyCount := 0
+	for _, rep := range meta.Replicas {
+		if n, ok := sv.store.nodes[rep.NodeID]; ok && sv.healthOf(n) == NodeHealthy && rep.Status == ReplicaReady {
+			healthyCount++
+		}
+	}
+
+	// Too many? Trim the copies the file's hints like least, then those on
+	// the most loaded nodes.
+	if healthyCount > factor && len(meta.Replicas) == healthyCount {
+		hints := hintsOf(meta)
+		surplus := make([]*NodeInfo, 0, len(meta.Replicas))
+		for _, rep := range meta.Replicas {
+			surplus = append(surplus, sv.store.nodes[rep.NodeID])
+		}
+		sort.Slice(surplus, func(i, j int) bool {
+			ri, rj := hints.rank(surplus[i]), hints.rank(surplus[j])
+			if ri != rj {
+				return ri < rj
+			}
+			return loadFactor(surplus[i]) > loadFactor(surplus[j])
+		})
+		trim := map[string]bool{}
+		for _, n := range surplus[:healthyCount-factor] {
+			log.Printf("[AUTO-HEAL] File %s (%s) has %d replicas, want %d: trimming %s",
+				fileID, meta.Filename, healthyCount, factor, n.NodeID)
+			trim[n.NodeID] = true
+			jobs = append(jobs, repairJob{FileID: fileID, TargetID: n.NodeID, TargetURL: n.URL, Trim: true})
+		}
+		for i := range meta.Replicas {
+			if trim[meta.Replicas[i].NodeID] {
+				meta.Replicas[i].Status = ReplicaTrimming
+			}
+		}
+		meta.UpdatedAt = now()
+		sv.store.touch(meta.FileID)
+		sv.store.persist()
+		return jobs
+	}
+
+	// Need healing? A DEGRADED file whose nodes came back is whole again.
+	if healthyCount >= factor {
+		if meta.State == StateDegraded {
+			meta.State = StateAvailable
+			meta.UpdatedAt = now()
+			sv.store.touch(meta.FileID)
+			sv.store.persist()
+		}
+		return nil
+	}
+	log.Printf("[AUTO-HEAL] File %s (%s) has only %d healthy replicas, need %d",
+		fileID, meta.Filename, healthyCount, factor)
+	// degraded whether or not there is anywhere to heal it to
+	if meta.State == StateAvailable {
+		meta.State = StateDegraded
+		meta.UpdatedAt = now()
+		sv.store.touch(meta.FileID)
+		sv.store.persist()
+	}
+
+	// Refresh stale or not-yet-copied replicas in place first
+	source := sv.readySource(meta, "")
+	refreshing := 0
+	for _, rep := range meta.Replicas {
+		n, ok := sv.store.nodes[rep.NodeID]
+		if source == nil || rep.Status == ReplicaReady || !ok || sv.healthOf(n) != NodeHealthy {
+			continue
+		}
+		jobs = append(jobs, repairJob{
+			FileID: fileID, Checksum: meta.Checksum,
+			SourceID: source.NodeID, SourceURL: source.URL,
+			TargetID: n.NodeID, TargetURL: n.URL,
+		})
+		refreshing++
+	}
+
+	// Find candidate nodes (not already hosting this file)
+	existingNodes := map[string]bool{}
+	for _, rep := range meta.Replicas {
+		existingNodes[rep.NodeID] = true
+	}
+
+	hints := hintsOf(meta)
+	var candidates []*NodeInfo
+	for _, n := range sv.store.nodes {
+		if !existingNodes[n.NodeID] && sv.placeable(n) && freeBytes(n) >= storedSize(meta) && hints.allows(n) {
+			candidates = append(candidates, n)
+		}
+	}
+
+	needed := factor - healthyCount - refreshing
+	candidates = steadyFirst(candidates, needed)
+	if len(candidates) < needed {
+		log.Printf("[AUTO-HEAL] Not enough candidate nodes for file %s (need %d, have %d)",
+			fileID, needed, len(candidates))
+		return jobs
+	}
+	// Preferred nodes first, then by weighted load
+	sort.Slice(candidates, func(i, j int) bool {
+		ri, rj := hints.rank(candidates[i]), hints.rank(candidates[j])
+		if ri != rj {
+			return ri > rj
+		}
+		return weightedLoad(candidates[i]) < weightedLoad(candidates[j])
+	})
+
+	for i := 0; i < needed && i < len(candidates); i++ {
+		n := candidates[i]
+		meta.Replicas = append(meta.Replicas, ReplicaInfo{
+			NodeID:         n.NodeID,
+			URL:            n.URL,
+			Status:         ReplicaMissing, // Will be updated when copied
+			LastVerifiedAt: now(),
+		})
+		log.Printf("[AUTO-HEAL] Added replica candidate: %s for file %s", n.NodeID, fileID)
+		if source != nil {
+			jobs = append(jobs, repairJob{
+				FileID: fileID, Checksum: meta.Checksum,
+				SourceID: source.NodeID, SourceURL: source.URL,
+				TargetID: n.NodeID, TargetURL: n.URL,
+			})
+		}
+	}
+	if needed > 0 {
+		meta.UpdatedAt = now()
+		sv.store.touch(meta.FileID)
+		sv.store.persist()
+	}
+	return jobs
+}
+
+// readySource returns a READY replica of meta on a healthy node other than
+// exclude. Callers must hold the store lock.
+func (sv *Server) readySource(meta *FileMetadata, exclude string) *ReplicaInfo {
+	for i := range meta.Replicas {
+		rep := &meta.Replicas[i]
+		n, ok := sv.store.nodes[rep.NodeID]
+		if rep.NodeID != exclude && rep.Status == ReplicaReady && ok && sv.healthOf(n) == NodeHealthy {
+			return rep
+		}
+	}
+	return nil
+}
+
+// readVerified downloads meta from a READY replica into a temporary file,
+// checks it against the catalog checksum and rewinds it. The caller closes
+// and removes the file.
+func (sv *Server) readVerified(ctx context.Context, meta *FileMetadata) (*os.File, int64, error) {
+	sv.store.mu.RLock()
+	src := sv.readySource(meta, "")
+	sv.store.mu.RUnlock()
+	if src == nil {
+		return nil, 0, errors.New("no READY replica on a healthy node")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(src.URL, "/")+"/download/"+url.PathEscape(meta.FileID), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := sv.httpClient(0).Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %v", src.NodeID, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("%s: download: %s", src.NodeID, resp.Status)
+	}
+	tmp, err := os.CreateTemp("", "blob-*")
+	if err != nil {
+		return nil, 0, err
+	}
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), resp.Body)
+	if err != nil {
+		err = fmt.Errorf("%s: download: %v", src.NodeID, err)
+	} else if sum := "sha256:" + hex.EncodeToString(h.Sum(nil)); sum != meta.Checksum {
+		err = fmt.Errorf("%s: replica checksum %s does not match the catalog", src.NodeID, sum)
+	} else {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, 0, err
+	}
+	return tmp, size, nil
+}
+
+// uploadTicket is the gateway's signed authorisation for one upload to one
+// node; storage nodes started with UPLOAD_TICKET_SECRET check it. The naming
+// service signs its own for the blobs it stores itself.
+type uploadTicket struct {
+	FileID   string `json:"fileId"`
+	NodeID   string `json:"nodeId"`
+	Version  int    `json:"version"`
+	MaxSize  int64  `json:"maxSize"`
+	Checksum string `json:"checksum"`
+	Expires  int64  `json:"exp"`
+}
+
+// uploadTicketTTL bounds the tickets the naming service signs.
+const uploadTicketTTL = 15 * time.Minute
+
+// signTicket encodes t as base64url(JSON) "." hex(HMAC-SHA256), the same
+// layout as the gateway's signTicket.
+func signTicket(secret []byte, t uploadTicket) string {
+	b, _ := json.Marshal(t)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(b)
+	return base64.RawURLEncoding.EncodeToString(b) + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// ticketFor signs a ticket for size bytes of fileID on nodeID, or is empty
+// when no UPLOAD_TICKET_SECRET is set.
+func (sv *Server) ticketFor(nodeID, fileID string, version int, size int64, checksum string) string {
+	if len(sv.ticketSecret) == 0 {
+		return ""
+	}
+	return signTicket(sv.ticketSecret, uploadTicket{
+		FileID: fileID, NodeID: nodeID, Version: version, MaxSize: size, Checksum: checksum,
+		Expires: time.Now().Add(uploadTicketTTL).Unix(),
+	})
+}
+
+// uploadToNode stores body as version of fileID on a node through its
+// /upload, which checks the checksum (and ticket, when not empty) before
+// committing the blob, and returns the bytes the node stored.
+func (sv *Server) uploadToNode(ctx context.Context, base, ticket, fileID string, version int, checksum, filename, contentType string, body io.Reader) (int64, error) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		_ = mw.WriteField("fileId", fileID)
+		_ = mw.WriteField("version", strconv.Itoa(version))
+		_ = mw.WriteField("expectedChecksum", checksum)
+		_ = mw.WriteField("contentType", contentType)
+		if ticket != "" {
+			_ = mw.WriteField("ticket", ticket)
+		}
+		fw, err := mw.CreateFormFile("file", path.Base(filename))
+		if err == nil {
+			_, err = io.Copy(fw, body)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(base, "/")+"/upload", pr)
+	if err != nil {
+		pr.CloseWithError(err)
+		return 0, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := sv.httpClient(0).Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return 0, fmt.Errorf("upload: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	var out struct {
+		StoredBytes int64 `json:"storedBytes"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	return out.StoredBytes, nil
+}
+
+// runRepairs executes replica copies and trims outside the store lock and
+// records the outcome of each as progress of op.
+func (sv *Server) runRepairs(op *operation, jobs []repairJob) {
+	failed := 0
+	for _, job := range jobs {
+		if op.ctx.Err() != nil {
+			log.Printf("[AUTO-HEAL] operation %s cancelled, %d repairs skipped", op.ID, len(jobs)-op.Done)
+			break
+		}
+		err := sv.repair(op.ctx, job)
+		sv.ops.step(op)
+		if err != nil {
+			failed++
+		}
+	}
+	sv.store.persist()
+	var err error
+	if failed > 0 {
+		err = fmt.Errorf("%d of %d repairs failed", failed, len(jobs))
+	}
+	sv.ops.finish(op, err)
+}
+
+// repair runs one copy or trim and applies the outcome to the catalog.
+func (sv *Server) repair(ctx context.Context, job repairJob) error {
+	if job.Trim {
+		if err := sv.trimReplica(ctx, job); err != nil {
+			log.Printf("[AUTO-HEAL] trim %s on %s failed: %v", job.FileID, job.TargetID, err)
+			sv.setReplicaStatus(job.FileID, job.TargetID, ReplicaTrimming, ReplicaReady)
+			return err
+		}
+		log.Printf("[AUTO-HEAL] trimmed %s from %s", job.FileID, job.TargetID)
+		sv.applyTrim(job)
+		return nil
+	}
+	method, err := sv.replicate(ctx, job)
+	if err != nil {
+		log.Printf("[AUTO-HEAL] copy %s %s -> %s failed: %v", job.FileID, job.SourceID, job.TargetID, err)
+		return err
+	}
+	log.Printf("[AUTO-HEAL] copied %s %s -> %s (%s)", job.FileID, job.SourceID, job.TargetID, method)
+	sv.applyRepair(job)
+	return nil
+}
+
+// trimReplica deletes a surplus copy from job's target node.
+func (sv *Server) trimReplica(ctx context.Context, job repairJob) error {
+	u := strings.TrimRight(job.TargetURL, "/") + "/files/" + url.PathEscape(job.FileID)
+	resp, err := sv.nodeCalls.send(ctx, sv.httpClient(30*time.Second), http.MethodDelete, u, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// setReplicaStatus moves a replica from one status to another, leaving it
+// alone if something else changed it meanwhile.
+func (sv *Server) setReplicaStatus(fileID, nodeID string, from, to ReplicaStatus) {
+	sv.store.mu.Lock()
+	defer sv.store.mu.Unlock()
+	meta, ok := sv.store.files[fileID]
+	if !ok {
+		return
+	}
+	for i := range meta.Replicas {
+		if meta.Replicas[i].NodeID == nodeID && meta.Replicas[i].Status == from {
+			meta.Replicas[i].Status = to
+			meta.UpdatedAt = now()
+			sv.store.touch(meta.FileID)
+		}
+	}
+}
+
+// applyTrim drops the trimmed replica from the catalog.
+func (sv *Server) applyTrim(job repairJob) {
+	sv.store.mu.Lock()
+	defer sv.store.mu.Unlock()
+	meta, ok := sv.store.files[job.FileID]
+	if !ok {
+		return
+	}
+	kept := meta.Replicas[:0]
+	for _, rep := range meta.Replicas {
+		if rep.NodeID != job.TargetID {
+			kept = append(kept, rep)
+		}
+	}
+	meta.Replicas = kept
+	sv.refreshState(meta)
+	meta.UpdatedAt = now()
+	sv.store.touch(meta.FileID)
+}
+
+func (sv *Server) replicate(ctx context.Context, job repairJob) (string, error) {
+	b, _ := json.Marshal(map[string]any{
+		"fileId": job.FileID, "sourceUrl": job.SourceURL, "checksum": job.Checksum, "move": job.Move,
+	})
+	client := sv.httpClient(5 * time.Minute)
+	resp, err := sv.nodeCalls.postJSON(ctx, client, strings.TrimRight(job.TargetURL, "/")+"/replicate", b)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var out struct {
+		Method string `json:"method"`
+	}
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("status %d", resp.StatusCode)
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	return out.Method, nil
+}
+
+// applyRepair marks the target replica READY (dropping the source replica
+// for moves) and recomputes the file state.
+func (sv *Server) applyRepair(job repairJob) {
+	sv.store.mu.Lock()
+	defer sv.store.mu.Unlock()
+	meta, ok := sv.store.files[job.FileID]
+	if !ok {
+		return
+	}
+	kept := meta.Replicas[:0]
+	for _, rep := range meta.Replicas {
+		if job.Move && rep.NodeID == job.SourceID {
+			continue
+		}
+		if rep.NodeID == job.TargetID {
+			rep.Status = ReplicaReady
+			rep.LastVerifiedAt = now()
+			rep.Version = meta.Version
+		}
+		kept = append(kept, rep)
+	}
+	meta.Replicas = kept
+	sv.refreshState(meta)
+	meta.UpdatedAt = now()
+	sv.store.touch(meta.FileID)
+}
+
+// refreshState derives a committed file's state from its READY replicas:
+// stale or missing copies beyond the replication factor are dropped once
+// enough READY ones exist. Callers must hold the store lock.
+func (sv *Server) refreshState(meta *FileMetadata) {
+	if meta.State == StateAllocated || meta.State == StateDeleted {
+		return
+	}
+	ready := 0
+	for _, rep := range meta.Replicas {
+		if rep.Status == ReplicaReady {
+			ready++
+		}
+	}
+	if ready >= sv.factorOf(meta) {
+		kept := meta.Replicas[:0]
+		for _, rep := range meta.Replicas {
+			if rep.Status == ReplicaReady {
+				kept = append(kept, rep)
+			}
+		}
+		meta.Replicas = kept
+		meta.State = StateAvailable
+	} else if meta.State == StateAvailable {
+		meta.State = StateDegraded
+	}
+}
+
+// MoveReplicaRequest is the body of POST /move-replica.
+type MoveReplicaRequest struct {
+	FileID string `json:"fileId"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+}
+
+func (sv *Server) handleMoveReplica(w http.ResponseWriter, r *http.Request) {
+	var body MoveReplicaRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.FileID == "" || body.From == "" || body.To == "" {
+		apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json")
+		return
+	}
+	sv.store.mu.Lock()
+	meta, ok := sv.store.files[body.FileID]
+	if !ok {
+		sv.store.mu.Unlock()
+		apierr.Write(w, http.StatusNotFound, apierr.FileNotFound, "file not found")
+		return
+	}
+	var src *ReplicaInfo
+	for i := range meta.Replicas {
+		switch meta.Replicas[i].NodeID {
+		case body.From:
+			src = &meta.Replicas[i]
+		case body.To:
+			sv.store.mu.Unlock()
+			apierr.Write(w, http.StatusConflict, apierr.Conflict, "target already holds a replica")
+			return
+		}
+	}
+	target, ok := sv.store.nodes[body.To]
+	if src == nil || src.Status != ReplicaReady || !ok || !sv.placeable(target) {
+		sv.store.mu.Unlock()
+		apierr.Write(w, http.StatusConflict, apierr.Conflict, "source replica not ready or target not accepting replicas")
+		return
+	}
+	job := repairJob{
+		FileID: meta.FileID, Checksum: meta.Checksum,
+		SourceID: src.NodeID, SourceURL: src.URL,
+		TargetID: target.NodeID, TargetURL: target.URL, Move: true,
+	}
+	if isDryRun(r) {
+		plan := newChangePlan()
+		plan.Files = append(plan.Files, meta.FileID)
+		plan.addNode(body.From)
+		plan.addNode(body.To)
+		plan.Bytes = storedSize(meta)
+		sv.store.mu.Unlock()
+		writeJSONResp(w, plan)
+		return
+	}
+	meta.Replicas = append(meta.Replicas, ReplicaInfo{NodeID: target.NodeID, URL: target.URL, Status: ReplicaMissing, LastVerifiedAt: now()})
+	sv.store.touch(meta.FileID)
+	sv.store.mu.Unlock()
+
+	op := sv.ops.startFor(r.Context(), "move", fmt.Sprintf("%s %s -> %s", job.FileID, job.SourceID, job.TargetID), 1)
+	method, err := sv.replicate(op.ctx, job)
+	sv.ops.step(op)
+	sv.ops.finish(op, err)
+	if err != nil {
+		sv.store.mu.Lock()
+		kept := meta.Replicas[:0]
+		for _, rep := range meta.Replicas {
+			if rep.NodeID != job.TargetID {
+				kept = append(kept, rep)
+			}
+		}
+		meta.Replicas = kept
+		sv.store.touch(meta.FileID)
+		sv.store.mu.Unlock()
+		apierr.WriteDetail(w, http.StatusBadGateway, apierr.UpstreamError, "move failed", err.Error())
+		return
+	}
+	sv.applyRepair(job)
+	sv.store.persist()
+	sv.record(r, "move-replica", job.FileID, job.SourceID+" -> "+job.TargetID)
+	writeJSONResp(w, map[string]any{"moved": true, "fileId": job.FileID, "from": job.SourceID, "to": job.TargetID, "method": method})
+}
+
+/* ==================== HEAL QUEUE ==================== */
+
+type HealState string
+
+const (
+	HealQueued  HealState = "QUEUED"
+	HealRunning HealState = "RUNNING"
+	HealRetry   HealState = "RETRY"  // waiting out the backoff after a failed attempt
+	HealDone    HealState = "DONE"   // only in the recent list
+	HealFailed  HealState = "FAILED" // gave up after maxAttempts
+)
+
+const (
+	healBackoff    = 10 * time.Second // first retry delay, doubled per attempt
+	healMaxBackoff = 5 * time.Minute  // also how long a FAILED job rests
+)
+
+// healJob is one file waiting for, or undergoing, repair. Priority is the
+// number of READY replicas on healthy nodes, so the files closest to data
+// loss are repaired first.
+type healJob struct {
+	FileID      string     `json:"fileId"`
+	Filename    string     `json:"filename,omitempty"`
+	State       HealState  `json:"state"`
+	Priority    int        `json:"priority"`
+	Manual      bool       `json:"manual,omitempty"`
+	Attempts    int        `json:"attempts"`
+	Repairs     int        `json:"repairs"` // copies and trims of the last attempt
+	LastError   string     `json:"lastError,omitempty"`
+	EnqueuedAt  time.Time  `json:"enqueuedAt"`
+	NextAttempt *time.Time `json:"nextAttemptAt,omitempty"`
+	FinishedAt  *time.Time `json:"finishedAt,omitempty"`
+}
+
+// healQueue holds at most one job per file plus the most recently finished
+// ones. Up to workers jobs run at a time.
+type healQueue struct {
+	mu          sync.Mutex
+	jobs        map[string]*healJob
+	recent      []healJob // newest last
+	keep        int
+	workers     int
+	maxAttempts int
+	wake        chan struct{}
+}
+
+func newHealQueue(workers, maxAttempts int) *healQueue {
+	return &healQueue{jobs: map[string]*healJob{}, keep: 50, workers: workers, maxAttempts: maxAttempts, wake: make(chan struct{}, 1)}
+}
+
+// add queues fileID or refreshes the priority of its pending job. A manual
+// request also cuts short a retry backoff or a FAILED rest; the sweep only
+// revives a FAILED job once it has rested. It reports whether the file was
+// newly queued.
+func (q *healQueue) add(fileID, filename string, priority int, manual bool) (healJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	t := now()
+	job, ok := q.jobs[fileID]
+	if !ok {
+		job = &healJob{FileID: fileID, Filename: filename, State: HealQueued, EnqueuedAt: t}
+		q.jobs[fileID] = job
+	}
+	if job.State != HealRunning {
+		job.Priority = priority
+		job.Manual = job.Manual || manual
+		due := job.NextAttempt == nil || !t.Before(*job.NextAttempt)
+		switch {
+		case job.State == HealFailed && (manual || due):
+			job.State, job.Attempts, job.NextAttempt, job.FinishedAt = HealQueued, 0, nil, nil
+		case job.State == HealRetry && manual:
+			job.State, job.NextAttempt = HealQueued, nil
+		}
+	}
+	q.signal()
+	return *job, !ok
+}
+
+func (q *healQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next claims the due job with the fewest healthy replicas, manual requests
+// first among equals, then the oldest.
+func (q *healQueue) next() *healJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	t := now()
+	var best *healJob
+	for _, job := range q.jobs {
+		due := job.State == HealQueued || (job.State == HealRetry && !t.Before(*job.NextAttempt))
+		if !due {
+			continue
+		}
+		if best == nil || healBefore(job, best) {
+			best = job
+		}
+	}
+	if best != nil {
+		best.State = HealRunning
+		best.Attempts++
+		best.NextAttempt = nil
+	}
+	return best
+}
+
+func healBefore(a, b *healJob) bool {
+	if a.Priority != b.Priority {
+		return a.Priority < b.Priority
+	}
+	if a.Manual != b.Manual {
+		return a.Manual
+	}
+	return a.EnqueuedAt.Before(b.EnqueuedAt)
+}
+
+// finish records the outcome of a claimed job: success retires it to the
+// recent list, a failure schedules a retry with exponential backoff until
+// maxAttempts is reached.
+func (q *healQueue) finish(job *healJob, repairs int, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	t := now()
+	job.Repairs = repairs
+	if err == nil {
+		job.State, job.LastError, job.FinishedAt = HealDone, "", &t
+		delete(q.jobs, job.FileID)
+		q.recent = append(q.recent, *job)
+		if len(q.recent) > q.keep {
+			q.recent = q.recent[len(q.recent)-q.keep:]
+		}
+		return
+	}
+	job.LastError = err.Error()
+	wait := healMaxBackoff
+	if job.Attempts < q.maxAttempts {
+		job.State = HealRetry
+		if d := healBackoff << (job.Attempts - 1); d < wait {
+			wait = d
+		}
+	} else {
+		job.State, job.FinishedAt = HealFailed, &t
+	}
+	at := t.Add(wait)
+	job.NextAttempt = &at
+}
+
+// snapshot returns the pending jobs in the order they will run and the
+// finished ones newest first.
+func (q *healQueue) snapshot() (pending, recent []healJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ptrs := make([]*healJob, 0, len(q.jobs))
+	for _, job := range q.jobs {
+		ptrs = append(ptrs, job)
+	}
+	sort.Slice(ptrs, func(i, j int) bool { return healBefore(ptrs[i], ptrs[j]) })
+	pending = make([]healJob, 0, len(ptrs))
+	for _, job := range ptrs {
+		pending = append(pending, *job)
+	}
+	recent = make([]healJob, 0, len(q.recent))
+	for i := len(q.recent) - 1; i >= 0; i-- {
+		recent = append(recent, q.recent[i])
+	}
+	return pending, recent
+}
+
+// healBatch is how many files one locked section of the heal sweep or of
+// a bulk replication change covers, so allocations and lookups get the
+// store lock in between.
+const healBatch = 256
+
+// healView is the part of a file the heal sweep decides on, copied out of
+// the catalog so the decision needs no lock.
+type healView struct {
+	id, name string
+	state    FileState
+	factor   int
+	replicas []ReplicaInfo
+}
+
+// viewOf copies what healNeed looks at. Callers must hold the store lock.
+func (sv *Server) viewOf(meta *FileMetadata) healView {
+	return healView{meta.FileID, meta.Filename, meta.State, sv.factorOf(meta), append([]ReplicaInfo(nil), meta.Replicas...)}
+}
+
+// healthyNodes lists the nodes currently HEALTHY. Callers must hold the
+// store lock.
+func (sv *Server) healthyNodes() map[string]bool {
+	out := make(map[string]bool, len(sv.store.nodes))
+	for id, n := range sv.store.nodes {
+		if sv.healthOf(n) == NodeHealthy {
+			out[id] = true
+		}
+	}
+	return out
+}
+
+// need reports whether planHeal has work for the file and the number of
+// READY replicas on healthy nodes. A DEGRADED file with enough of them
+// still needs a visit to be marked AVAILABLE again.
+func (v healView) need(healthy map[string]bool) (int, bool) {
+	if v.state == StateDeleted || v.state == StateAllocated || v.state == StateCorrupt {
+		return 0, false
+	}
+	ready := 0
+	for _, rep := range v.replicas {
+		if healthy[rep.NodeID] && rep.Status == ReplicaReady {
+			ready++
+		}
+	}
+	return ready, ready < v.factor || (ready > v.factor && len(v.replicas) == ready) || (ready >= v.factor && v.state == StateDegraded)
+}
+
+// healNeed is need for a file in the catalog. Callers must hold the store
+// lock.
+func (sv *Server) healNeed(meta *FileMetadata) (int, bool) {
+	return sv.viewOf(meta).need(sv.healthyNodes())
+}
+
+// enqueueHeals is the periodic sweep. It copies the catalog a batch at a
+// time under the read lock, decides without it and queues every file that
+// is under- or over-replicated; workers take the write lock per file.
+func (sv *Server) enqueueHeals() {
+	sv.store.mu.RLock()
+	ids := make([]string, 0, len(sv.store.files))
+	for id := range sv.store.files {
+		ids = append(ids, id)
+	}
+	sv.store.mu.RUnlock()
+
+	added := 0
+	for start := 0; start < len(ids); start += healBatch {
+		batch := ids[start:min(start+healBatch, len(ids))]
+		views := make([]healView, 0, len(batch))
+		sv.store.mu.RLock()
+		healthy := sv.healthyNodes()
+		for _, id := range batch {
+			if meta, ok := sv.store.files[id]; ok {
+				views = append(views, sv.viewOf(meta))
+			}
+		}
+		sv.store.mu.RUnlock()
+		for _, v := range views {
+			if ready, ok := v.need(healthy); ok {
+				if _, isNew := sv.heal.add(v.id, v.name, ready, false); isNew {
+					added++
+				}
+			}
+		}
+	}
+	if added > 0 {
+		log.Printf("[AUTO-HEAL] queued %d file(s) for repair", added)
+	}
+}
+
+func (sv *Server) healWorker() {
+	for {
+		job := sv.heal.next()
+		if job == nil {
+			select {
+			case <-sv.heal.wake:
+			case <-time.After(time.Second):
+			case <-sv.quit:
+				return
+			}
+			continue
+		}
+		repairs, err := sv.runHealJob(job.FileID)
+		if err != nil {
+			log.Printf("[AUTO-HEAL] %s attempt %d failed: %v", job.FileID, job.Attempts, err)
+		}
+		sv.heal.finish(job, repairs, err)
+	}
+}
+
+// runHealJob plans repairs for one file under the store lock, then runs
+// them without it.
+func (sv *Server) runHealJob(fileID string) (int, error) {
+	sv.store.mu.Lock()
+	meta, ok := sv.store.files[fileID]
+	if !ok {
+		sv.store.mu.Unlock()
+		return 0, nil
+	}
+	jobs := sv.planHeal(meta)
+	_, stillNeeded := sv.healNeed(meta)
+	sv.store.mu.Unlock()
+	if len(jobs) == 0 {
+		if stillNeeded {
+			return 0, errors.New("no repair possible: no READY source or not enough candidate nodes")
+		}
+		return 0, nil
+	}
+	failed := 0
+	for _, job := range jobs {
+		if sv.repair(context.Background(), job) != nil {
+			failed++
+		}
+	}
+	sv.store.persist()
+	if failed > 0 {
+		return len(jobs), fmt.Errorf("%d of %d repairs failed", failed, len(jobs))
+	}
+	return len(jobs), nil
+}
+
+// handleHeal queues one file for repair ahead of the next sweep:
+// POST /heal/{fileId}.
+func (sv *Server) handleHeal(w http.ResponseWriter, r *http.Request) {
+	fileID := r.PathValue("fileId")
+	sv.store.mu.RLock()
+	meta, ok := sv.store.files[fileID]
+	var ready int
+	var state FileState
+	var name string
+	if ok {
+		ready, _ = sv.healNeed(meta)
+		state, name = meta.State, meta.Filename
+	}
+	sv.store.mu.RUnlock()
+	if !ok {
+		apierr.Write(w, http.StatusNotFound, apierr.FileNotFound, "file not found")
+		return
+	}
+	if state == StateDeleted || state == StateAllocated || state == StateCorrupt {
+		apierr.Write(w, http.StatusConflict, apierr.Conflict, fmt.Sprintf("file is %s and cannot be healed", state))
+		return
+	}
+	job, _ := sv.heal.add(fileID, name, ready, true)
+	sv.record(r, "heal", fileID, "")
+	writeJSONResp(w, job)
+}
+
+// handleHealQueue lists pending heal jobs in run order and recently
+// finished ones.
+func (sv *Server) handleHealQueue(w http.ResponseWriter, r *http.Request) {
+	pending, recent := sv.heal.snapshot()
+	counts := map[HealState]int{}
+	for _, job := range pending {
+		counts[job.State]++
+	}
+	writeJSONResp(w, map[string]any{
+		"workers":     sv.heal.workers,
+		"maxAttempts": sv.heal.maxAttempts,
+		"counts":      counts,
+		"pending":     pending,
+		"recent":      recent,
+	})
+}
+
+/* ==================== ANTI-ENTROPY ==================== */
+
+func (sv *Server) startAntiEntropy(every time.Duration) {
+	go sv.every(every, sv.runAntiEntropy)
+	log.Printf("Anti-entropy background job started (every %s)", every)
+}
+
+// runAntiEntropy asks every replica of every committed file to re-hash its
+// blob and marks replicas whose content diverges from the committed checksum
+// as STALE. The auto-healer then places fresh replicas for those files.
+func (sv *Server) runAntiEntropy() {
+	if sv.ops.running("anti-entropy") {
+		log.Printf("[ANTI-ENTROPY] previous pass still running, skipping this one")
+		return
+	}
+	op := sv.ops.start("anti-entropy", "all files", 0)
+	checks := sv.verifyReplicas(op, nil, 30*time.Second)
+	sv.ops.finish(op, nil)
+	diverged := 0
+	for _, c := range checks {
+		if c.Changed && c.Status != ReplicaReady {
+			diverged++
+		}
+	}
+	if diverged > 0 {
+		log.Printf("[ANTI-ENTROPY] %d of %d replicas diverged; queued for healing", diverged, len(checks))
+	}
+}
+
+// startVerifier re-verifies the batch least recently verified files every
+// interval, so every replica is checked regularly without the load spike of
+// a full anti-entropy pass.
+func (sv *Server) startVerifier(every time.Duration, batch int) {
+	go sv.every(every, func() {
+		if sv.ops.running("anti-entropy") || sv.ops.running("scheduled-verify") {
+			return
+		}
+		ids := sv.leastRecentlyVerified(batch)
+		if len(ids) == 0 {
+			return
+		}
+		op := sv.ops.start("scheduled-verify", fmt.Sprintf("%d files", len(ids)), 0)
+		sv.verifyReplicas(op, ids, 30*time.Second)
+		sv.ops.finish(op, nil)
+	})
+	log.Printf("Scheduled verifier started (%d files every %s)", batch, every)
+}
+
+// leastRecentlyVerified returns up to limit verifiable files, oldest
+// LastVerifiedAt (across their READY replicas) first.
+func (sv *Server) leastRecentlyVerified(limit int) []string {
+	type cand struct {
+		id     string
+		oldest time.Time
+	}
+	var cands []cand
+	sv.store.mu.RLock()
+	for _, meta := range sv.store.files {
+		if meta.State != StateAvailable && meta.State != StateDegraded && meta.State != StatePartial {
+			continue
+		}
+		var oldest time.Time
+		for _, rep := range meta.Replicas {
+			if rep.Status == ReplicaReady && (oldest.IsZero() || rep.LastVerifiedAt.Before(oldest)) {
+				oldest = rep.LastVerifiedAt
+			}
+		}
+		if !oldest.IsZero() {
+			cands = append(cands, cand{meta.FileID, oldest})
+		}
+	}
+	sv.store.mu.RUnlock()
+	sort.Slice(cands, func(i, j int) bool { return cands[i].oldest.Before(cands[j].oldest) })
+	if len(cands) > limit {
+		cands = cands[:limit]
+	}
+	ids := make([]string, len(cands))
+	for i, c := range cands {
+		ids[i] = c.id
+	}
+	return ids
+}
+
+// replicaCheck is the outcome of asking one replica to verify its blob.
+type replicaCheck struct {
+	FileID         string        `json:"fileId"`
+	NodeID         string        `json:"nodeId"`
+	Status         ReplicaStatus `json:"status"`
+	ActualChecksum string        `json:"actualChecksum,omitempty"`
+	Version        int           `json:"version,omitempty"`
+	Error          string        `json:"error,omitempty"`
+	Changed        bool          `json:"changed"`
+}
+
+// verifyReplicas re-verifies the replicas of the given files (all committed
+// files when fileIDs is nil) and applies the results: diverging replicas
+// become STALE or MISSING, a file none of whose replicas verify is
+// quarantined as CORRUPT, and a CORRUPT file with a good copy recovers.
+func (sv *Server) verifyReplicas(op *operation, fileIDs []string, timeout time.Duration) []replicaCheck {
+	type target struct {
+		fileID, checksum, nodeID, url string
+		version                       int
+	}
+	var targets []target
+	sv.store.mu.RLock()
+	metas := []*FileMetadata{}
+	if fileIDs == nil {
+		for _, meta := range sv.store.files {
+			metas = append(metas, meta)
+		}
+	} else {
+		for _, id := range fileIDs {
+			if meta, ok := sv.store.files[id]; ok {
+				metas = append(metas, meta)
+			}
+		}
+	}
+	for _, meta := range metas {
+		if meta.State != StateAvailable && meta.State != StateDegraded && meta.State != StatePartial && meta.State != StateCorrupt {
+			continue
+		}
+		for _, rep := range meta.Replicas {
+			n, ok := sv.store.nodes[rep.NodeID]
+			if !ok || sv.healthOf(n) != NodeHealthy {
+				continue
+			}
+			// stale copies of quarantined files are re-checked in case they
+			// were restored out of band
+			if rep.Status == ReplicaReady || (meta.State == StateCorrupt && rep.Status == ReplicaStale) {
+				targets = append(targets, target{meta.FileID, meta.Checksum, rep.NodeID, rep.URL, meta.Version})
+			}
+		}
+	}
+	sv.store.mu.RUnlock()
+
+	// replicas are checked concurrently, a few at a time, so one slow node
+	// does not hold up an on-demand verification of the others
+	checks := make([]replicaCheck, len(targets))
+	sv.ops.setTotal(op, len(targets))
+	sem := make(chan struct{}, 4)
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, t target) {
+			defer func() { <-sem; wg.Done() }()
+			// a cancelled check leaves Status empty so the replica is untouched
+			checks[i] = sv.checkReplica(op.ctx, t.fileID, t.nodeID, t.url, t.checksum, t.version, timeout)
+			sv.ops.step(op)
+		}(i, t)
+	}
+	wg.Wait()
+	if op.ctx.Err() == nil {
+		for _, c := range checks {
+			sv.track.verified(c)
+		}
+	}
+
+	touched := map[string]bool{}
+	sv.store.mu.Lock()
+	for i := range checks {
+		c := &checks[i]
+		meta, ok := sv.store.files[c.FileID]
+		if !ok || c.Status == "" {
+			continue
+		}
+		for j := range meta.Replicas {
+			rep := &meta.Replicas[j]
+			if rep.NodeID != c.NodeID {
+				continue
+			}
+			if c.Status == ReplicaReady {
+				rep.LastVerifiedAt = now()
+				rep.MismatchChecksum = ""
+				if c.Version > 0 {
+					rep.Version = c.Version
+				}
+			}
+			if c.Status == ReplicaStale && c.ActualChecksum != "" && c.ActualChecksum != meta.Checksum && (c.Version == 0 || c.Version >= meta.Version) {
+				rep.MismatchChecksum = c.ActualChecksum
+			}
+			if rep.Status != c.Status {
+				log.Printf("[ANTI-ENTROPY] replica of %s on %s: %s -> %s", meta.FileID, rep.NodeID, rep.Status, c.Status)
+				rep.Status = c.Status
+				c.Changed = true
+				touched[meta.FileID] = true
+			}
+		}
+	}
+	for id := range touched {
+		sv.quarantineOrRecover(sv.store.files[id])
+	}
+	sv.store.mu.Unlock()
+	if len(touched) > 0 {
+		sv.store.persist()
+	}
+	return checks
+}
+
+// checkReplica asks one node to re-hash its copy of a file.
+func (sv *Server) checkReplica(ctx context.Context, fileID, nodeID, url, checksum string, version int, timeout time.Duration) replicaCheck {
+	c := replicaCheck{FileID: fileID, NodeID: nodeID}
+	b, _ := json.Marshal(map[string]string{"fileId": fileID, "checksum": checksum})
+	client := sv.httpClient(timeout)
+	resp, err := sv.nodeCalls.postJSON(ctx, client, strings.TrimRight(url, "/")+"/verify", b)
+	if err != nil {
+		// unreachable nodes are the health checker's problem
+		c.Error = err.Error()
+		return c
+	}
+	defer resp.Body.Close()
+	var out struct {
+		Verified       bool   `json:"verified"`
+		ActualChecksum string `json:"actualChecksum"`
+		Version        int    `json:"version"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	c.ActualChecksum = out.ActualChecksum
+	c.Version = out.Version
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		c.Status = ReplicaMissing
+	case resp.StatusCode/100 == 2 && out.Version > 0 && out.Version < version:
+		c.Status = ReplicaStale
+	case resp.StatusCode/100 == 2 && !out.Verified:
+		c.Status = ReplicaStale
+	case resp.StatusCode/100 == 2:
+		c.Status = ReplicaReady
+	default:
+		c.Error = fmt.Sprintf("status %d", resp.StatusCode)
+	}
+	return c
+}
+
+// quarantineOrRecover moves a file with no verified replica left into CORRUPT
+// and brings a CORRUPT file back once a good copy reappears. Callers must
+// hold the store lock.
+func (sv *Server) quarantineOrRecover(meta *FileMetadata) {
+	ready, stale := 0, 0
+	for _, rep := range meta.Replicas {
+		switch rep.Status {
+		case ReplicaReady:
+			ready++
+		case ReplicaStale:
+			stale++
+		}
+	}
+	switch {
+	case ready == 0 && stale > 0 && meta.State != StateCorrupt:
+		meta.State = StateCorrupt
+		log.Printf("[ALERT] file %s (%s) failed verification on every replica; quarantined as CORRUPT", meta.FileID, meta.Filename)
+	case ready > 0 && meta.State == StateCorrupt:
+		meta.State = StateDegraded
+		log.Printf("[ALERT] file %s (%s) recovered: a verified replica was found", meta.FileID, meta.Filename)
+		sv.refreshState(meta)
+	case ready < sv.factorOf(meta) && meta.State == StateAvailable:
+		meta.State = StateDegraded
+	}
+	meta.UpdatedAt = now()
+	sv.store.touch(meta.FileID)
+}
+
+// SetReplicationRequest is the body of POST /admin/set-replication.
+type SetReplicationRequest struct {
+	FileID  string   `json:"fileId"`
+	FileIDs []string `json:"fileIds"`
+	All     bool     `json:"all"`
+	Factor  int      `json:"factor"`
+}
+
+// handleSetReplication changes the replication factor of existing files and
+// immediately schedules the copies or trims needed to reach it. Progress is
+// reported by the returned operation in /operations. With ?dryRun=true it
+// only counts them; see replicationPreview.
+func (sv *Server) handleSetReplication(w http.ResponseWriter, r *http.Request) {
+	var body SetReplicationRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json")
+		return
+	}
+	if body.FileID != "" {
+		body.FileIDs = append(body.FileIDs, body.FileID)
+	}
+	if len(body.FileIDs) == 0 && !body.All {
+		apierr.Write(w, http.StatusBadRequest, apierr.BadRequest, "fileId, fileIds or all is required")
+		return
+	}
+
+	sv.store.mu.RLock()
+	if body.Factor < 1 || body.Factor > len(sv.store.nodes) {
+		n := len(sv.store.nodes)
+		sv.store.mu.RUnlock()
+		apierr.Write(w, http.StatusBadRequest, apierr.BadRequest, fmt.Sprintf("factor must be between 1 and %d (registered nodes)", n))
+		return
+	}
+	ids := body.FileIDs
+	if body.All {
+		ids = make([]string, 0, len(sv.store.files))
+		for id := range sv.store.files {
+			ids = append(ids, id)
+		}
+	} else {
+		for _, id := range ids {
+			if _, ok := sv.store.files[id]; !ok {
+				sv.store.mu.RUnlock()
+				apierr.WriteDetail(w, http.StatusNotFound, apierr.FileNotFound, "file not found: "+id, map[string]string{"fileId": id})
+				return
+			}
+		}
+	}
+	if isDryRun(r) {
+		preview := sv.replicationPreview(ids, body.Factor)
+		sv.store.mu.RUnlock()
+		writeJSONResp(w, preview)
+		return
+	}
+	sv.store.mu.RUnlock()
+
+	// applied a batch per write section; a file deleted in between is skipped
+	var jobs []repairJob
+	updated := 0
+	for start := 0; start < len(ids); start += healBatch {
+		sv.store.mu.Lock()
+		for _, id := range ids[start:min(start+healBatch, len(ids))] {
+			meta, ok := sv.store.files[id]
+			if !ok {
+				continue
+			}
+			meta.ReplicationFactor = body.Factor
+			sv.refreshState(meta)
+			meta.UpdatedAt = now()
+			jobs = append(jobs, sv.planHeal(meta)...)
+			sv.store.mark(id)
+			updated++
+		}
+		sv.store.touch()
+		sv.store.mu.Unlock()
+	}
+	sv.store.persist()
+
+	log.Printf("[ADMIN] replication factor of %d file(s) set to %d, %d repairs scheduled", updated, body.Factor, len(jobs))
+	target := strings.Join(body.FileIDs, ",")
+	if body.All {
+		target = "all files"
+	}
+	sv.record(r, "set-replication", target, fmt.Sprintf("factor %d", body.Factor))
+	resp := map[string]any{"files": updated, "factor": body.Factor, "scheduled": len(jobs)}
+	if len(jobs) > 0 {
+		op := sv.ops.start("set-replication", fmt.Sprintf("%d files to RF %d", updated, body.Factor), len(jobs))
+		go sv.runRepairs(op, jobs)
+		resp["operation"] = op.ID
+	}
+	writeJSONResp(w, resp)
+}
+
+// replicationPreview is what setting ids to factor would schedule: copies
+// for files short of it, trims (and the bytes they free) for files over it.
+// Like planHeal it only counts READY replicas on healthy nodes. Callers must
+// hold the store lock.
+func (sv *Server) replicationPreview(ids []string, factor int) map[string]any {
+	plan := newChangePlan()
+	copies, trims := 0, 0
+	for _, id := range ids {
+		meta := sv.store.files[id]
+		if meta.State == StateDeleted || meta.State == StateAllocated || meta.State == StateCorrupt {
+			continue
+		}
+		ready := 0
+		for _, rep := range meta.Replicas {
+			if n, ok := sv.store.nodes[rep.NodeID]; ok && sv.healthOf(n) == NodeHealthy && rep.Status == ReplicaReady {
+				ready++
+			}
+		}
+		switch {
+		case ready > factor:
+			plan.Files = append(plan.Files, id)
+			plan.Bytes += int64(ready-factor) * storedSize(meta)
+			trims += ready - factor
+		case ready < factor:
+			plan.Files = append(plan.Files, id)
+			copies += factor - ready
+		}
+	}
+	return map[string]any{"dryRun": true, "files": plan.Files, "bytes": plan.Bytes, "factor": factor, "copies": copies, "trims": trims}
+}
+
+// OverrideServeRequest is the body of POST /admin/override-serve.
+type OverrideServeRequest struct {
+	FileID string `json:"fileId"`
+	Allow  bool   `json:"allow"`
+}
+
+func (sv *Server) handleOverrideServe(w http.ResponseWriter, r *http.Request) {
+	var body OverrideServeRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.FileID == "" {
+		apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json")
+		return
+	}
+	sv.store.mu.Lock()
+	defer sv.store.mu.Unlock()
+	meta, ok := sv.store.files[body.FileID]
+	if !ok {
+		apierr.Write(w, http.StatusNotFound, apierr.FileNotFound, "file not found")
+		return
+	}
+	meta.OverrideServe = body.Allow
+	meta.UpdatedAt = now()
+	sv.store.touch(meta.FileID)
+	log.Printf("[ADMIN] override-serve for %s set to %v (state %s)", meta.FileID, body.Allow, meta.State)
+	sv.record(r, "override-serve", meta.FileID, fmt.Sprintf("allow=%v", body.Allow))
+	sv.store.persist()
+	writeJSONResp(w, map[string]any{"fileId": meta.FileID, "state": meta.State, "overrideServe": meta.OverrideServe})
+}
+
+// handleVerifyFile re-verifies every replica of one file right away and
+// reports the outcome per replica; replicas on unhealthy nodes are listed as
+// skipped. It is also the recovery path for a quarantined file once a good
+// copy has been restored.
+func (sv *Server) handleVerifyFile(w http.ResponseWriter, r *http.Request) {
+	fileID := cmp.Or(r.PathValue("fileId"), r.URL.Query().Get("fileId"))
+	timeout := 30 * time.Second
+	if d, err := time.ParseDuration(r.URL.Query().Get("timeout")); err == nil && d > 0 {
+		timeout = d
+	}
+	sv.store.mu.RLock()
+	_, ok := sv.store.files[fileID]
+	sv.store.mu.RUnlock()
+	if !ok {
+		apierr.Write(w, http.StatusNotFound, apierr.FileNotFound, "file not found")
+		return
+	}
+	op := sv.ops.startFor(r.Context(), "verify", fileID, 0)
+	checks := sv.verifyReplicas(op, []string{fileID}, timeout)
+	sv.ops.finish(op, nil)
+
+	checked := map[string]bool{}
+	for _, c := range checks {
+		checked[c.NodeID] = true
+	}
+	sv.store.mu.RLock()
+	meta := sv.store.files[fileID]
+	state := meta.State
+	for _, rep := range meta.Replicas {
+		if !checked[rep.NodeID] {
+			checks = append(checks, replicaCheck{FileID: fileID, NodeID: rep.NodeID, Status: rep.Status, Error: "skipped: node not healthy or replica not verifiable"})
+		}
+	}
+	sv.store.mu.RUnlock()
+
+	verified := 0
+	for _, c := range checks {
+		if c.Status == ReplicaReady && c.Error == "" {
+			verified++
+		}
+	}
+	writeJSONResp(w, map[string]any{
+		"fileId":   fileID,
+		"state":    state,
+		"verified": verified,
+		"total":    len(checks),
+		"replicas": checks,
+	})
+}
+
+/* ==================== NODE HEALTH ==================== */
+
+// nodeTrack keeps the evidence /node-health explains a node's status with:
+// incidents reported by gateways and the outcome of replica verifications.
+// It lives in memory only.
+type nodeTrack struct {
+	mu        sync.Mutex
+	incidents map[string][]incident // nodeId -> newest last
+	verify    map[string]*verifyTally
+	keep      int
+}
+
+type incident struct {
+	At       time.Time `json:"at"`
+	Kind     string    `json:"kind"` // "missing", "download-failed" or "checksum-mismatch"
+	FileID   string    `json:"fileId,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+	Reporter string    `json:"reporter"`
+}
+
+// verifyTally counts verification outcomes for one node since startup.
+type verifyTally struct {
+	Checked       int        `json:"checked"`
+	Failed        int        `json:"failed"` // replica MISSING or STALE
+	Errors        int        `json:"errors"` // node unreachable or answered badly
+	LastFailure   string     `json:"lastFailure,omitempty"`
+	LastFailureAt *time.Time `json:"lastFailureAt,omitempty"`
+}
+
+func newNodeTrack() *nodeTrack {
+	return &nodeTrack{incidents: map[string][]incident{}, verify: map[string]*verifyTally{}, keep: 20}
+}
+
+func (t *nodeTrack) report(nodeID string, in incident) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := append(t.incidents[nodeID], in)
+	if len(list) > t.keep {
+		list = list[len(list)-t.keep:]
+	}
+	t.incidents[nodeID] = list
+}
+
+func (t *nodeTrack) verified(c replicaCheck) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	v := t.verify[c.NodeID]
+	if v == nil {
+		v = &verifyTally{}
+		t.verify[c.NodeID] = v
+	}
+	v.Checked++
+	var what string
+	switch {
+	case c.Status == ReplicaMissing || c.Status == ReplicaStale:
+		v.Failed++
+		what = fmt.Sprintf("%s: %s", c.FileID, c.Status)
+	case c.Status == "" || c.Error != "":
+		v.Errors++
+		what = fmt.Sprintf("%s: %s", c.FileID, c.Error)
+	default:
+		return
+	}
+	at := now()
+	v.LastFailure, v.LastFailureAt = what, &at
+}
+
+// of returns nodeID's incidents newest first and its verification tally.
+func (t *nodeTrack) of(nodeID string) ([]incident, verifyTally) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := t.incidents[nodeID]
+	out := make([]incident, 0, len(list))
+	for i := len(list) - 1; i >= 0; i-- {
+		out = append(out, list[i])
+	}
+	var v verifyTally
+	if p := t.verify[nodeID]; p != nil {
+		v = *p
+	}
+	return out, v
+}
+
+// healthTransition is one change of a node's health.
+type healthTransition struct {
+	At     time.Time  `json:"at"`
+	From   NodeStatus `json:"from,omitempty"` // empty the first time a node is seen
+	To     NodeStatus `json:"to"`
+	Reason string     `json:"reason"`
+}
+
+const (
+	historyKeep   = 100 // transitions kept per node
+	flapWindow    = 10 * time.Minute
+	flapThreshold = 3 // drops from HEALTHY within flapWindow that make a node flapping
+)
+
+// nodeHistory keeps the last historyKeep health transitions of every node
+// for /node-history, in node-history.json so a restart keeps them.
+type nodeHistory struct {
+	mu    sync.Mutex
+	path  string
+	saver *coalescer
+	Nodes map[string][]healthTransition `json:"nodes"` // oldest first
+}
+
+func openNodeHistory(path string, persistEvery time.Duration) (*nodeHistory, error) {
+	h := &nodeHistory{path: path, Nodes: map[string][]healthTransition{}}
+	if b, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(b, h); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	h.saver = newCoalescer(persistEvery, h.save)
+	return h, nil
+}
+
+// observe records nodeID's health as st and reports whether that is a
+// change.
+func (h *nodeHistory) observe(nodeID string, st NodeStatus, reason string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	list := h.Nodes[nodeID]
+	var from NodeStatus
+	if len(list) > 0 {
+		from = list[len(list)-1].To
+	}
+	if from == st {
+		return false
+	}
+	list = append(list, healthTransition{At: now(), From: from, To: st, Reason: reason})
+	if len(list) > historyKeep {
+		list = list[len(list)-historyKeep:]
+	}
+	h.Nodes[nodeID] = list
+	return true
+}
+
+// outages counts nodeID's drops from HEALTHY since since.
+func (h *nodeHistory) outages(nodeID string, since time.Time) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := 0
+	for _, tr := range h.Nodes[nodeID] {
+		if tr.From == NodeHealthy && !tr.At.Before(since) {
+			n++
+		}
+	}
+	return n
+}
+
+// of returns nodeID's transitions newest first, and whether it has any.
+func (h *nodeHistory) of(nodeID string) ([]healthTransition, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	list, ok := h.Nodes[nodeID]
+	out := slices.Clone(list)
+	slices.Reverse(out)
+	return out, ok
+}
+
+func (h *nodeHistory) save() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := writeJSONFile(h.path, h); err != nil {
+		log.Printf("[NODE] cannot save health history: %v", err)
+	}
+}
+
+// noteHealth records n's current health in its history and refreshes its
+// Flapping mark. reason says what changed; empty means the heartbeat age.
+// Callers hold the store lock for writing.
+func (sv *Server) noteHealth(n *NodeInfo, reason string) {
+	st := sv.healthOf(n)
+	if reason == "" {
+		age := time.Since(n.LastSeenAt).Round(time.Millisecond)
+		switch {
+		case st == NodeHealthy:
+			reason = "heartbeat"
+		case sv.peerVouched(n):
+			reason = fmt.Sprintf("no heartbeat for %s, but a peer saw it %s ago", age, time.Since(n.LastPeerSeenAt).Round(time.Millisecond))
+		default:
+			reason = fmt.Sprintf("no heartbeat for %s", age)
+		}
+	}
+	if sv.history.observe(n.NodeID, st, reason) {
+		sv.history.saver.request()
+	}
+	flapping := sv.history.outages(n.NodeID, now().Add(-flapWindow)) >= flapThreshold
+	if flapping != n.Flapping {
+		log.Printf("[NODE] %s flapping=%v", n.NodeID, flapping)
+		n.Flapping = flapping
+		sv.store.touch()
+	}
+}
+
+// watchHealth notes the health of every node, so a node that stops sending
+// heartbeats has its fall to SUSPECT and DOWN recorded when it happens.
+func (sv *Server) watchHealth() {
+	sv.store.mu.Lock()
+	defer sv.store.mu.Unlock()
+	for _, n := range sv.store.nodes {
+		sv.noteHealth(n, "")
+	}
+}
+
+// nodeHistoryResult is the body of GET /node-history/{nodeId}.
+type nodeHistoryResult struct {
+	NodeID      string             `json:"nodeId"`
+	Status      NodeStatus         `json:"status,omitempty"` // empty once the node has left the catalog
+	Flapping    bool               `json:"flapping"`
+	Outages     int                `json:"outages"` // drops from HEALTHY within window
+	Window      string             `json:"window"`
+	Threshold   int                `json:"threshold"`
+	Transitions []healthTransition `json:"transitions"` // newest first
+}
+
+// handleNodeHistory lists a node's health transitions: GET
+// /node-history/{nodeId}.
+func (sv *Server) handleNodeHistory(w http.ResponseWriter, r *http.Request) {
+	nodeID := r.PathValue("nodeId")
+	transitions, seen := sv.history.of(nodeID)
+	out := nodeHistoryResult{NodeID: nodeID, Window: flapWindow.String(), Threshold: flapThreshold, Transitions: transitions}
+	sv.store.mu.RLock()
+	n, ok := sv.store.nodes[nodeID]
+	if ok {
+		out.Status, out.Flapping = sv.healthOf(n), n.Flapping
+	}
+	sv.store.mu.RUnlock()
+	if !ok && !seen {
+		apierr.Write(w, http.StatusNotFound, apierr.NodeNotFound, "unknown node")
+		return
+	}
+	out.Outages = sv.history.outages(nodeID, now().Add(-flapWindow))
+	writeJSONResp(w, out)
+}
+
+// nodeByRef resolves a node reported by ID or by URL. Callers must hold the
+// store lock.
+func (sv *Server) nodeByRef(nodeID, nodeURL string) *NodeInfo {
+	if n, ok := sv.store.nodes[nodeID]; ok {
+		return n
+	}
+	for _, n := range sv.store.nodes {
+		if nodeURL != "" && strings.TrimRight(n.URL, "/") == strings.TrimRight(nodeURL, "/") {
+			return n
+		}
+	}
+	return nil
+}
+
+// reporterOf names who sent an incident: the reporter the body names, else
+// the X-Actor header, else the remote address.
+func reporterOf(r *http.Request, named string) string {
+	if named != "" {
+		return named
+	}
+	if a := r.Header.Get(actorHeader); a != "" {
+		return a
+	}
+	return r.RemoteAddr
+}
+
+// ReportIncidentRequest is the body of POST /report-incident.
+type ReportIncidentRequest struct {
+	NodeID   string `json:"nodeId"`
+	NodeURL  string `json:"nodeUrl"`
+	FileID   string `json:"fileId"`
+	Kind     string `json:"kind"`
+	Detail   string `json:"detail"`
+	Reporter string `json:"reporter"`
+}
+
+// handleReportIncident records a failed request against a node, e.g. a
+// gateway that could not download from it. Unlike /report-missing it does
+// not change any replica.
+func (sv *Server) handleReportIncident(w http.ResponseWriter, r *http.Request) {
+	var body ReportIncidentRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Kind == "" {
+		apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json")
+		return
+	}
+	sv.store.mu.RLock()
+	n := sv.nodeByRef(body.NodeID, body.NodeURL)
+	sv.store.mu.RUnlock()
+	if n == nil {
+		apierr.Write(w, http.StatusNotFound, apierr.NodeNotFound, "unknown node")
+		return
+	}
+	sv.track.report(n.NodeID, incident{At: now(), Kind: body.Kind, FileID: body.FileID, Detail: body.Detail, Reporter: reporterOf(r, body.Reporter)})
+	writeJSONResp(w, map[string]any{"accepted": true, "nodeId": n.NodeID})
+}
+
+// handleNodeHealth explains a node's status: GET /node-health/{nodeId}.
+func (sv *Server) handleNodeHealth(w http.ResponseWriter, r *http.Request) {
+	nodeID := r.PathValue("nodeId")
+	sv.store.mu.RLock()
+	n, ok := sv.store.nodes[nodeID]
+	if !ok {
+		sv.store.mu.RUnlock()
+		apierr.Write(w, http.StatusNotFound, apierr.NodeNotFound, "unknown node")
+		return
+	}
+	node := *n
+	// placement rank among the nodes that may take replicas right now
+	rank, eligible := 0, 0
+	for _, o := range sv.store.nodes {
+		if !sv.placeable(o) {
+			continue
+		}
+		eligible++
+		lo, ln := weightedLoad(o), weightedLoad(n)
+		if o != n && (lo < ln || (lo == ln && o.LastChosen.Before(n.LastChosen))) {
+			rank++
+		}
+	}
+	sv.store.mu.RUnlock()
+
+	t := sv.tunables()
+	hb := sv.heartbeatOf(&node)
+	hbSource := "node"
+	if node.HeartbeatMs <= 0 {
+		hbSource = "cluster default"
+	}
+	suspect, down := sv.thresholdsOf(&node)
+	age := time.Since(node.LastSeenAt)
+	health := sv.healthOf(&node)
+
+	var why []string
+	switch {
+	case health == NodeSuspect && age > down:
+		why = append(why, fmt.Sprintf("last heartbeat %s ago is past the DOWN threshold %s, but a peer saw the node %s ago, so it stays SUSPECT",
+			age.Round(time.Millisecond), down, time.Since(node.LastPeerSeenAt).Round(time.Millisecond)))
+	case health == NodeDown:
+		why = append(why, fmt.Sprintf("last heartbeat %s ago is past the DOWN threshold %s (%g x %s heartbeat) and no peer has seen it within %s",
+			age.Round(time.Millisecond), down, t.DownAfterBeats, hb, suspect))
+	case health == NodeSuspect:
+		why = append(why, fmt.Sprintf("last heartbeat %s ago is past the SUSPECT threshold %s (%g x %s heartbeat)",
+			age.Round(time.Millisecond), suspect, t.SuspectAfterBeats, hb))
+	default:
+		why = append(why, fmt.Sprintf("last heartbeat %s ago is within the SUSPECT threshold %s", age.Round(time.Millisecond), suspect))
+	}
+	blocked := []string{}
+	if health != NodeHealthy {
+		blocked = append(blocked, "not HEALTHY")
+	}
+	if node.Degraded {
+		blocked = append(blocked, "degraded")
+		why = append(why, "the node reports itself degraded: its startup integrity check is running or found bad blobs")
+	}
+	if node.Maintenance {
+		blocked = append(blocked, "maintenance")
+		why = append(why, "an operator put the node in maintenance with /admin/node-maintenance")
+	}
+	if node.ReadOnly {
+		blocked = append(blocked, "read-only")
+		why = append(why, fmt.Sprintf("the node is read-only: %d bytes free on disk is below its MIN_FREE_DISK_BYTES", node.DiskFreeBytes))
+	}
+	if node.Flapping {
+		why = append(why, fmt.Sprintf("the node dropped out of HEALTHY %d times in the last %s, so it only gets new replicas when steadier nodes run short (see /node-history)",
+			sv.history.outages(nodeID, now().Add(-flapWindow)), flapWindow))
+	}
+	incidents, verify := sv.track.of(nodeID)
+	if len(incidents) > 0 {
+		why = append(why, fmt.Sprintf("%d incident(s) reported, the latest %s ago: %s", len(incidents), time.Since(incidents[0].At).Round(time.Second), incidents[0].Kind))
+	}
+	if verify.Failed+verify.Errors > 0 {
+		why = append(why, fmt.Sprintf("%d of %d replica verifications failed and %d could not reach the node", verify.Failed, verify.Checked, verify.Errors))
+	}
+
+	placement := map[string]any{
+		"eligible":      len(blocked) == 0,
+		"blockedBy":     blocked,
+		"loadFactor":    loadFactor(&node),
+		"weight":        node.Weight,
+		"tags":          node.Tags,
+		"usedBytes":     node.UsedBytes,
+		"capacityBytes": node.CapacityBytes,
+		"freeBytes":     freeBytes(&node),
+		"diskFreeBytes": node.DiskFreeBytes,
+		"lastChosen":    node.LastChosen,
+	}
+	if len(blocked) == 0 {
+		placement["rank"] = rank + 1
+		placement["eligibleNodes"] = eligible
+	}
+	writeJSONResp(w, map[string]any{
+		"nodeId":      node.NodeID,
+		"url":         node.URL,
+		"status":      sv.stateOf(&node),
+		"explanation": why,
+		"heartbeat": map[string]any{
+			"lastSeenAt": node.LastSeenAt,
+			"age":        age.Round(time.Millisecond).String(),
+			"interval":   hb.String(),
+			"source":     hbSource,
+		},
+		"thresholds": map[string]any{
+			"suspectAfter":      suspect.String(),
+			"downAfter":         down.String(),
+			"suspectAfterBeats": t.SuspectAfterBeats,
+			"downAfterBeats":    t.DownAfterBeats,
+		},
+		"peers": map[string]any{
+			"lastPeerSeenAt": node.LastPeerSeenAt,
+			"vouched":        sv.peerVouched(&node),
+		},
+		"placement":    placement,
+		"incidents":    incidents,
+		"verification": verify,
+		"inventory":    sv.inventoryOf(nodeID),
+	})
+}
+
+/* ==================== SERVICE DISCOVERY ==================== */
+
+// DiscoveryConfig lets the naming service find storage nodes itself, in a
+// DNS SRV record or the Consul catalog, instead of waiting for them to
+// register. Discovered nodes are polled on /health every Interval, which
+// stands in for their heartbeats.
+type DiscoveryConfig struct {
+	Mode          string // "" (off), "dns" or "consul"
+	DNSName       string // SRV record, e.g. _storage._tcp.cluster.local
+	ConsulURL     string // Consul HTTP API, e.g. http://localhost:8500
+	ConsulService string // catalog service the nodes are registered as
+	ConsulToken   string // sent as X-Consul-Token when set
+	Interval      time.Duration
+}
+
+// discoveryState is what the last discovery pass saw, for /discovery.
+type discoveryState struct {
+	mu      sync.Mutex
+	lastRun time.Time
+	targets []string
+	err     string
+}
+
+func (sv *Server) startDiscovery() {
+	go func() {
+		sv.discover()
+		sv.every(sv.discovery.Interval, sv.discover)
+	}()
+	log.Printf("Node discovery started (%s, every %s)", sv.discovery.Mode, sv.discovery.Interval)
+}
+
+// discoverTargets lists the base URLs of the nodes the catalog knows.
+func (sv *Server) discoverTargets() ([]string, error) {
+	d := sv.discovery
+	var out []string
+	switch d.Mode {
+	case "dns":
+		_, srvs, err := net.LookupSRV("", "", d.DNSName)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range srvs {
+			out = append(out, fmt.Sprintf("http://%s", net.JoinHostPort(strings.TrimSuffix(s.Target, "."), strconv.Itoa(int(s.Port)))))
+		}
+	case "consul":
+		req, _ := http.NewRequest(http.MethodGet, strings.TrimRight(d.ConsulURL, "/")+"/v1/health/service/"+url.PathEscape(d.ConsulService)+"?passing=true", nil)
+		if d.ConsulToken != "" {
+			req.Header.Set("X-Consul-Token", d.ConsulToken)
+		}
+		resp, err := sv.httpClient(5 * time.Second).Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			return nil, fmt.Errorf("consul: %s: %s", resp.Status, strings.TrimSpace(string(b)))
+		}
+		var entries []struct {
+			Node    struct{ Address string }
+			Service struct {
+				Address string
+				Port    int
+			}
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+			return nil, fmt.Errorf("consul: %v", err)
+		}
+		for _, e := range entries {
+			host := e.Service.Address
+			if host == "" {
+				host = e.Node.Address
+			}
+			out = append(out, "http://"+net.JoinHostPort(host, strconv.Itoa(e.Service.Port)))
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// nodeHealth is the part of a storage node's /health discovery needs.
+type nodeHealth struct {
+	NodeID        string   `json:"nodeId"`
+	Status        string   `json:"status"`
+	UsedBytes     int64    `json:"usedBytes"`
+	CapacityBytes int64    `json:"capacityBytes"`
+	DiskFreeBytes int64    `json:"diskFreeBytes"`
+	ReadOnly      bool     `json:"readOnly"`
+	Zone          string   `json:"zone"`
+	Tags          []string `json:"tags"`
+	Weight        float64  `json:"weight"`
+}
+
+// discover runs one discovery pass. Every target that answers /health is
+// registered, or refreshed as if it had sent a heartbeat. A discovered node
+// that has left the catalog is deregistered: it is marked unseen so it goes
+// DOWN and its replicas are healed elsewhere, and it is dropped once no file
+// lists it. Nodes that registered themselves are never touched, and a failed
+// lookup changes nothing.
+func (sv *Server) discover() {
+	targets, err := sv.discoverTargets()
+	sv.discoveryState.mu.Lock()
+	sv.discoveryState.lastRun = now()
+	if err != nil {
+		sv.discoveryState.err = err.Error()
+		sv.discoveryState.mu.Unlock()
+		log.Printf("[DISCOVERY] lookup failed: %v", err)
+		return
+	}
+	sv.discoveryState.targets, sv.discoveryState.err = targets, ""
+	sv.discoveryState.mu.Unlock()
+
+	client := sv.httpClient(2 * time.Second)
+	listed := map[string]bool{}
+	for _, u := range targets {
+		listed[u] = true
+		resp, err := client.Get(u + "/health")
+		if err != nil {
+			continue // unreachable this pass; it goes SUSPECT, then DOWN
+		}
+		var h nodeHealth
+		err = json.NewDecoder(resp.Body).Decode(&h)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK || h.NodeID == "" || h.CapacityBytes <= 0 {
+			continue
+		}
+		sv.store.mu.Lock()
+		n, ok := sv.store.nodes[h.NodeID]
+		switch {
+		case ok && !n.Discovered:
+			sv.store.mu.Unlock()
+			continue // registered itself; its heartbeats rule
+		case !ok:
+			n = &NodeInfo{NodeID: h.NodeID, Discovered: true}
+			sv.store.nodes[h.NodeID] = n
+			log.Printf("[DISCOVERY] registered %s at %s", h.NodeID, u)
+			sv.audit.append(auditEntry{Time: now(), Actor: "discovery", Action: "node-discovered", Target: h.NodeID, Detail: u})
+		}
+		n.URL, n.CapacityBytes, n.UsedBytes = u, h.CapacityBytes, h.UsedBytes
+		n.Degraded, n.ReadOnly, n.DiskFreeBytes = h.Status == "DEGRADED", h.ReadOnly, h.DiskFreeBytes
+		n.Zone, n.Tags, n.Weight = h.Zone, h.Tags, h.Weight
+		n.HeartbeatMs = sv.discovery.Interval.Milliseconds()
+		n.LastSeenAt = now()
+		n.Status = sv.healthOf(n)
+		sv.noteHealth(n, "health poll")
+		sv.store.touch()
+		sv.store.mu.Unlock()
+	}
+
+	sv.store.mu.Lock()
+	inUse := map[string]bool{}
+	for _, meta := range sv.store.files {
+		for _, rep := range meta.Replicas {
+			inUse[rep.NodeID] = true
+		}
+	}
+	for id, n := range sv.store.nodes {
+		if !n.Discovered || listed[n.URL] {
+			continue
+		}
+		if !n.LastSeenAt.IsZero() {
+			n.LastSeenAt, n.LastPeerSeenAt = time.Time{}, time.Time{}
+			n.Status = sv.healthOf(n)
+			sv.noteHealth(n, "left the discovery catalog")
+			log.Printf("[DISCOVERY] %s (%s) left the catalog, deregistering", id, n.URL)
+			sv.audit.append(auditEntry{Time: now(), Actor: "discovery", Action: "node-deregistered", Target: id, Detail: n.URL})
+		}
+		if !inUse[id] {
+			delete(sv.store.nodes, id)
+			log.Printf("[DISCOVERY] removed %s: no replicas left on it", id)
+		}
+		sv.store.touch()
+	}
+	sv.store.mu.Unlock()
+	sv.store.persist()
+}
+
+// handleDiscovery reports the discovery mode and what the last pass found.
+func (sv *Server) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	d := sv.discovery
+	out := map[string]any{"mode": d.Mode}
+	if d.Mode == "" {
+		out["mode"] = "off"
+		writeJSONResp(w, out)
+		return
+	}
+	out["interval"] = d.Interval.String()
+	if d.Mode == "dns" {
+		out["dnsName"] = d.DNSName
+	} else {
+		out["consulUrl"], out["consulService"] = d.ConsulURL, d.ConsulService
+	}
+	var nodes []string
+	sv.store.mu.RLock()
+	for id, n := range sv.store.nodes {
+		if n.Discovered {
+			nodes = append(nodes, id)
+		}
+	}
+	sv.store.mu.RUnlock()
+	sort.Strings(nodes)
+	sv.discoveryState.mu.Lock()
+	out["lastRun"], out["targets"], out["nodes"] = sv.discoveryState.lastRun, sv.discoveryState.targets, nodes
+	if sv.discoveryState.err != "" {
+		out["error"] = sv.discoveryState.err
+	}
+	sv.discoveryState.mu.Unlock()
+	writeJSONResp(w, out)
+}
+
+/* ==================== INVENTORY DIGESTS ==================== */
+
+// inventoryDigest is a storage node's summary of the blobs it holds: their
+// count and the XOR of the FNV-1a hashes of their file IDs. It arrives with
+// every heartbeat and must be built exactly as the node builds it.
+type inventoryDigest struct {
+	Count int    `json:"count"`
+	Hash  string `json:"hash"`
+}
+
+func digestOf(ids []string) inventoryDigest {
+	var x uint64
+	for _, id := range ids {
+		h := fnv.New64a()
+		h.Write([]byte(id))
+		x ^= h.Sum64()
+	}
+	return inventoryDigest{Count: len(ids), Hash: fmt.Sprintf("%016x", x)}
+}
+
+// inventoryState is what the naming service knows about one node's
+// inventory, shown in /node-health.
+type inventoryState struct {
+	Reported        inventoryDigest `json:"reported"`
+	Expected        inventoryDigest `json:"expected"`
+	InSync          bool            `json:"inSync"`
+	CheckedAt       time.Time       `json:"checkedAt"`
+	Mismatches      int             `json:"consecutiveMismatches"`
+	LastReconcileAt time.Time       `json:"lastReconcileAt,omitzero"`
+	Missing         int             `json:"missingFound"`  // READY replicas the node turned out not to have
+	Orphans         int             `json:"orphanedBlobs"` // blobs on the node no replica accounts for
+	LastError       string          `json:"lastError,omitempty"`
+
+	reconciling bool
+	settled     [2]inventoryDigest // reported/expected pair the last reconcile ran for
+}
+
+// inventoryTracker holds inventoryState per node and the expected digests,
+// rebuilt at most once per catalog revision.
+type inventoryTracker struct {
+	mu       sync.Mutex
+	nodes    map[string]*inventoryState
+	revision uint64
+	expected map[string]inventoryDigest
+	built    bool
+}
+
+func newInventoryTracker() *inventoryTracker {
+	return &inventoryTracker{nodes: map[string]*inventoryState{}}
+}
+
+// expectedInventory returns the digest nodeID should report: every file
+// with a replica on it that is not MISSING.
+func (sv *Server) expectedInventory(nodeID string) inventoryDigest {
+	sv.store.mu.RLock()
+	defer sv.store.mu.RUnlock()
+	t := sv.inventory
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.built || t.revision != sv.store.revision {
+		ids := map[string][]string{}
+		for id, meta := range sv.store.files {
+			for _, rep := range meta.Replicas {
+				if rep.Status != ReplicaMissing {
+					ids[rep.NodeID] = append(ids[rep.NodeID], id)
+				}
+			}
+		}
+		t.expected = map[string]inventoryDigest{}
+		for node, list := range ids {
+			t.expected[node] = digestOf(list)
+		}
+		t.revision, t.built = sv.store.revision, true
+	}
+	if d, ok := t.expected[nodeID]; ok {
+		return d
+	}
+	return digestOf(nil)
+}
+
+// checkInventory compares a heartbeat's digest with the catalog. Uploads
+// and deletes in flight make a single mismatch normal, so a node is only
+// reconciled after two in a row, and not again for the same pair of
+// digests (a leftover orphan would otherwise trigger it on every beat).
+func (sv *Server) checkInventory(nodeID string, reported inventoryDigest) {
+	expected := sv.expectedInventory(nodeID)
+	t := sv.inventory
+	t.mu.Lock()
+	st, ok := t.nodes[nodeID]
+	if !ok {
+		st = &inventoryState{}
+		t.nodes[nodeID] = st
+	}
+	st.Reported, st.Expected, st.CheckedAt = reported, expected, now()
+	st.InSync = reported == expected
+	if st.InSync {
+		st.Mismatches = 0
+		t.mu.Unlock()
+		return
+	}
+	st.Mismatches++
+	pair := [2]inventoryDigest{reported, expected}
+	if st.Mismatches < 2 || st.reconciling || st.settled == pair {
+		t.mu.Unlock()
+		return
+	}
+	st.reconciling, st.settled = true, pair
+	t.mu.Unlock()
+
+	log.Printf("[INVENTORY] %s reports %d blobs (%s), catalog expects %d (%s); reconciling",
+		nodeID, reported.Count, reported.Hash, expected.Count, expected.Hash)
+	missing, orphans, err := sv.reconcileInventory(nodeID)
+
+	t.mu.Lock()
+	st.reconciling, st.LastReconcileAt = false, now()
+	st.LastError = ""
+	if err != nil {
+		st.LastError = err.Error()
+		st.settled = [2]inventoryDigest{} // try again on the next mismatch
+	} else {
+		st.Missing += missing
+		st.Orphans = orphans
+	}
+	t.mu.Unlock()
+}
+
+// reconcileInventory lists the blobs actually on nodeID and marks its READY
+// replicas of files it does not have as MISSING, so the healer replaces
+// them now rather than after a failed download.
+func (sv *Server) reconcileInventory(nodeID string) (missing, orphans int, err error) {
+	sv.store.mu.RLock()
+	n, ok := sv.store.nodes[nodeID]
+	var base string
+	if ok {
+		base = strings.TrimRight(n.URL, "/")
+	}
+	sv.store.mu.RUnlock()
+	if !ok {
+		return 0, 0, fmt.Errorf("unknown node")
+	}
+	resp, err := sv.httpClient(30 * time.Second).Get(base + "/list")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("list: %s", resp.Status)
+	}
+	var listing struct {
+		Files []struct {
+			FileID string `json:"fileId"`
+		} `json:"files"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&listing); err != nil {
+		return 0, 0, fmt.Errorf("list: %v", err)
+	}
+	has := map[string]bool{}
+	for _, f := range listing.Files {
+		has[f.FileID] = true
+	}
+
+	sv.store.mu.Lock()
+	known := map[string]bool{}
+	for id, meta := range sv.store.files {
+		changed := false
+		for i := range meta.Replicas {
+			rep := &meta.Replicas[i]
+			if rep.NodeID != nodeID {
+				continue
+			}
+			known[id] = true
+			if rep.Status == ReplicaReady && !has[id] {
+				rep.Status = ReplicaMissing
+				changed = true
+				missing++
+				sv.track.report(nodeID, incident{At: now(), Kind: "missing", FileID: id, Reporter: "inventory"})
+			}
+		}
+		if changed {
+			if meta.State == StateAvailable {
+				meta.State = StateDegraded
+			}
+			meta.UpdatedAt = now()
+			sv.store.mark(id)
+		}
+	}
+	for id := range has {
+		if !known[id] && sv.shard.owns(id) { // the rest are other shards'
+			orphans++
+		}
+	}
+	if missing > 0 {
+		sv.store.touch()
+	}
+	sv.store.mu.Unlock()
+
+	if missing > 0 {
+		sv.store.persist()
+		select {
+		case sv.healWake <- struct{}{}:
+		default:
+		}
+	}
+	log.Printf("[INVENTORY] %s: %d blobs listed, %d READY replicas missing, %d orphaned blobs", nodeID, len(has), missing, orphans)
+	return missing, orphans, nil
+}
+
+func (sv *Server) inventoryOf(nodeID string) *inventoryState {
+	t := sv.inventory
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st, ok := t.nodes[nodeID]
+	if !ok {
+		return nil
+	}
+	cp := *st
+	return &cp
+}
+
+/* ==================== INTEGRITY REPORT ==================== */
+
+// integrityRow summarizes the health of one file's replicas.
+type integrityRow struct {
+	FileID            string             `json:"fileId"`
+	Filename          string             `json:"filename"`
+	State             FileState          `json:"state"`
+	ReplicationFactor int                `json:"replicationFactor"`
+	ReadyReplicas     int                `json:"readyReplicas"`
+	UnderReplicatedBy int                `json:"underReplicatedBy"`
+	ChecksumMismatch  int                `json:"checksumMismatches"`
+	OldestVerifiedAt  *time.Time         `json:"oldestVerifiedAt,omitempty"`
+	Replicas          []integrityReplica `json:"replicas"`
+	Problems          []string           `json:"problems"`
+}
+
+type integrityReplica struct {
+	NodeID         string        `json:"nodeId"`
+	NodeStatus     NodeStatus    `json:"nodeStatus"`
+	Status         ReplicaStatus `json:"status"`
+	Version        int           `json:"version,omitempty"`
+	LastVerifiedAt time.Time     `json:"lastVerifiedAt"`
+	ActualChecksum string        `json:"actualChecksum,omitempty"` // set on a checksum mismatch
+}
+
+// integrityOf builds the report row for meta; replicas not verified within
+// staleAfter are flagged. Callers must hold the store lock.
+func (sv *Server) integrityOf(meta *FileMetadata, staleAfter time.Duration) integrityRow {
+	row := integrityRow{
+		FileID:            meta.FileID,
+		Filename:          meta.Filename,
+		State:             meta.State,
+		ReplicationFactor: sv.factorOf(meta),
+		Replicas:          []integrityReplica{},
+		Problems:          []string{},
+	}
+	for _, rep := range meta.Replicas {
+		ir := integrityReplica{NodeID: rep.NodeID, NodeStatus: "UNKNOWN", Status: rep.Status, Version: rep.Version, LastVerifiedAt: rep.LastVerifiedAt, ActualChecksum: rep.MismatchChecksum}
+		if n, ok := sv.store.nodes[rep.NodeID]; ok {
+			ir.NodeStatus = sv.stateOf(n)
+		}
+		row.Replicas = append(row.Replicas, ir)
+		switch {
+		case rep.MismatchChecksum != "":
+			row.ChecksumMismatch++
+			row.Problems = append(row.Problems, "checksum mismatch on "+rep.NodeID)
+		case rep.Status == ReplicaMissing:
+			row.Problems = append(row.Problems, "replica missing on "+rep.NodeID)
+		case rep.Status == ReplicaStale:
+			row.Problems = append(row.Problems, fmt.Sprintf("stale replica on %s (version %d of %d)", rep.NodeID, rep.Version, meta.Version))
+		case rep.Status == ReplicaReady:
+			row.ReadyReplicas++
+			if ir.NodeStatus == NodeDown || ir.NodeStatus == NodeSuspect || ir.NodeStatus == "UNKNOWN" {
+				row.Problems = append(row.Problems, fmt.Sprintf("replica on %s node %s", ir.NodeStatus, rep.NodeID))
+			}
+			if row.OldestVerifiedAt == nil || rep.LastVerifiedAt.Before(*row.OldestVerifiedAt) {
+				t := rep.LastVerifiedAt
+				row.OldestVerifiedAt = &t
+			}
+			if time.Since(rep.LastVerifiedAt) > staleAfter {
+				row.Problems = append(row.Problems, fmt.Sprintf("%s not verified since %s", rep.NodeID, rep.LastVerifiedAt.Format(time.RFC3339)))
+			}
+		}
+	}
+	if row.ReadyReplicas < row.ReplicationFactor {
+		row.UnderReplicatedBy = row.ReplicationFactor - row.ReadyReplicas
+		row.Problems = append(row.Problems, fmt.Sprintf("under-replicated (%d of %d)", row.ReadyReplicas, row.ReplicationFactor))
+	}
+	if meta.State == StateCorrupt {
+		row.Problems = append(row.Problems, "quarantined as CORRUPT")
+	}
+	return row
+}
+
+// handleIntegrityReport lists replica health per file:
+// ?problems=only keeps files with at least one problem, ?staleAfter=24h sets
+// how old a verification may be, and ?format=csv exports one line per file.
+func (sv *Server) handleIntegrityReport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	onlyProblems := q.Get("problems") == "only"
+	staleAfter := 24 * time.Hour
+	if v := q.Get("staleAfter"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			apierr.Write(w, http.StatusBadRequest, apierr.BadRequest, "bad staleAfter")
+			return
+		}
+		staleAfter = d
+	}
+	format := q.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		apierr.Write(w, http.StatusBadRequest, apierr.BadRequest, "format must be json or csv")
+		return
+	}
+
+	sv.store.mu.RLock()
+	rows := []integrityRow{}
+	total := 0
+	for _, meta := range sv.store.files {
+		if meta.State == StateDeleted || meta.State == StateAllocated {
+			continue
+		}
+		total++
+		row := sv.integrityOf(meta, staleAfter)
+		if onlyProblems && len(row.Problems) == 0 {
+			continue
+		}
+		rows = append(rows, row)
+	}
+	sv.store.mu.RUnlock()
+	sort.Slice(rows, func(i, j int) bool {
+		if len(rows[i].Problems) != len(rows[j].Problems) {
+			return len(rows[i].Problems) > len(rows[j].Problems)
+		}
+		return rows[i].FileID < rows[j].FileID
+	})
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="integrity-report.csv"`)
+		cw := csv.NewWriter(w)
+		_ = cw.Write([]string{"fileId", "filename", "state", "replicationFactor", "readyReplicas", "underReplicatedBy", "checksumMismatches", "oldestVerifiedAt", "problems"})
+		for _, row := range rows {
+			oldest := ""
+			if row.OldestVerifiedAt != nil {
+				oldest = row.OldestVerifiedAt.Format(time.RFC3339)
+			}
+			_ = cw.Write([]string{
+				row.FileID, row.Filename, string(row.State),
+				strconv.Itoa(row.ReplicationFactor), strconv.Itoa(row.ReadyReplicas), strconv.Itoa(row.UnderReplicatedBy),
+				strconv.Itoa(row.ChecksumMismatch), oldest, strings.Join(row.Problems, "; "),
+			})
+		}
+		cw.Flush()
+		return
+	}
+	withProblems := 0
+	for _, row := range rows {
+		if len(row.Problems) > 0 {
+			withProblems++
+		}
+	}
+	writeJSONResp(w, map[string]any{
+		"generatedAt":  now(),
+		"staleAfter":   staleAfter.String(),
+		"files":        total,
+		"withProblems": withProblems,
+		"rows":         rows,
+	})
+}
+
+/* ==================== OPERATIONS ==================== */
+
+type OpState string
+
+const (
+	OpRunning   OpState = "RUNNING"
+	OpDone      OpState = "DONE"
+	OpFailed    OpState = "FAILED"
+	OpCancelled OpState = "CANCELLED"
+)
+
+// operation is one long-running background job (heal batch, anti-entropy
+// pass, replica move, on-demand verification) as listed by /operations.
+type operation struct {
+	ID         string     `json:"id"`
+	Kind       string     `json:"kind"`
+	Target     string     `json:"target,omitempty"`
+	State      OpState    `json:"state"`
+	Total      int        `json:"total"`
+	Done       int        `json:"done"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// opRegistry tracks running operations plus the most recent finished ones.
+type opRegistry struct {
+	mu    sync.Mutex
+	ops   map[string]*operation
+	keep  int   // finished operations kept for inspection
+	shard Shard // op IDs are minted in it
+}
+
+func newOpRegistry() *opRegistry {
+	return &opRegistry{ops: map[string]*operation{}, keep: 50}
+}
+
+// start registers a new RUNNING operation; its ctx is cancelled by /operations/cancel.
+func (o *opRegistry) start(kind, target string, total int) *operation {
+	ctx, cancel := context.WithCancel(context.Background())
+	op := &operation{
+		ID: o.shard.mint(func() string { return uuidLike("op") }), Kind: kind, Target: target, State: OpRunning,
+		Total: total, StartedAt: now(), ctx: ctx, cancel: cancel,
+	}
+	o.mu.Lock()
+	o.ops[op.ID] = op
+	o.mu.Unlock()
+	return op
+}
+
+// startFor is start for an operation a handler runs before answering: ctx
+// ending, i.e. the caller hanging up, cancels it too.
+func (o *opRegistry) startFor(ctx context.Context, kind, target string, total int) *operation {
+	op := o.start(kind, target, total)
+	context.AfterFunc(ctx, op.cancel)
+	return op
+}
+
+// running reports whether an operation of kind is still in progress.
+func (o *opRegistry) running(kind string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, op := range o.ops {
+		if op.Kind == kind && op.State == OpRunning {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *opRegistry) setTotal(op *operation, total int) {
+	o.mu.Lock()
+	op.Total = total
+	o.mu.Unlock()
+}
+
+func (o *opRegistry) step(op *operation) {
+	o.mu.Lock()
+	op.Done++
+	o.mu.Unlock()
+}
+
+// finish closes op as DONE, FAILED (err != nil) or CANCELLED and trims the
+// history of finished operations.
+func (o *opRegistry) finish(op *operation, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	t := now()
+	op.FinishedAt = &t
+	switch {
+	case op.ctx.Err() != nil:
+		op.State = OpCancelled
+	case err != nil:
+		op.State = OpFailed
+		op.Error = err.Error()
+	default:
+		op.State = OpDone
+	}
+	op.cancel()
+
+	var finished []*operation
+	for _, x := range o.ops {
+		if x.State != OpRunning {
+			finished = append(finished, x)
+		}
+	}
+	if len(finished) > o.keep {
+		sort.Slice(finished, func(i, j int) bool { return finished[i].FinishedAt.Before(*finished[j].FinishedAt) })
+		for _, x := range finished[:len(finished)-o.keep] {
+			delete(o.ops, x.ID)
+		}
+	}
+}
+
+func (o *opRegistry) list() []operation {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	out := make([]operation, 0, len(o.ops))
+	for _, op := range o.ops {
+		out = append(out, *op)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].StartedAt.After(out[j].StartedAt) })
+	return out
+}
+
+func (sv *Server) handleListOperations(w http.ResponseWriter, r *http.Request) {
+	state := OpState(strings.ToUpper(r.URL.Query().Get("state")))
+	ops := []operation{}
+	for _, op := range sv.ops.list() {
+		if state == "" || op.State == state {
+			ops = append(ops, op)
+		}
+	}
+	writeJSONResp(w, ops)
+}
+
+// CancelOperationRequest is the body of POST /operations/cancel.
+type CancelOperationRequest struct {
+	ID string `json:"id"`
+}
+
+// handleCancelOperation cancels a running operation. Work already done is
+// kept; in-flight node calls are aborted and nothing further is started.
+func (sv *Server) handleCancelOperation(w http.ResponseWriter, r *http.Request) {
+	var body CancelOperationRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json")
+		return
+	}
+	sv.ops.mu.Lock()
+	op, ok := sv.ops.ops[body.ID]
+	running := ok && op.State == OpRunning
+	sv.ops.mu.Unlock()
+	if !ok {
+		apierr.Write(w, http.StatusNotFound, apierr.OperationNotFound, "operation not found")
+		return
+	}
+	if !running {
+		apierr.Write(w, http.StatusConflict, apierr.Conflict, "operation is not running")
+		return
+	}
+	op.cancel()
+	log.Printf("[ADMIN] cancelled operation %s (%s %s)", op.ID, op.Kind, op.Target)
+	sv.record(r, "cancel-operation", op.ID, op.Kind+" "+op.Target)
+	writeJSONResp(w, map[string]any{"id": op.ID, "cancelled": true})
+}
+
+/* ==================== ACCESS STATS ==================== */
+
+// accessWindowMax is how far back download statistics are kept.
+const accessWindowMax = 7 * 24 * time.Hour
+
+type accessCount struct {
+	Count int64 `json:"count"`
+	Bytes int64 `json:"bytes"`
+}
+
+// accessStats aggregates downloads and uploads reported by storage nodes
+// into per-minute buckets, per file and per node. They live in memory only
+// and restart empty.
+type accessStats struct {
+	mu    sync.Mutex
+	files map[string]map[int64]accessCount // fileId -> minute -> count
+	nodes map[string]map[int64]nodeTraffic // nodeId -> minute -> traffic
+}
+
+func newAccessStats() *accessStats {
+	return &accessStats{files: map[string]map[int64]accessCount{}, nodes: map[string]map[int64]nodeTraffic{}}
+}
+
+// nodeTraffic is what one node served and received within a bucket or
+// window.
+type nodeTraffic struct {
+	Downloads     int64 `json:"downloads"`
+	BytesServed   int64 `json:"bytesServed"`
+	Uploads       int64 `json:"uploads"`
+	BytesReceived int64 `json:"bytesReceived"`
+}
+
+// add records one heartbeat's worth of traffic from nodeID.
+func (a *accessStats) add(nodeID string, reads map[string]accessCount, received accessCount) {
+	if len(reads) == 0 && received.Count == 0 {
+		return
+	}
+	minute := now().Unix() / 60
+	oldest := now().Add(-accessWindowMax).Unix() / 60
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var nt nodeTraffic
+	for id, rc := range reads {
+		buckets := a.files[id]
+		if buckets == nil {
+			buckets = map[int64]accessCount{}
+			a.files[id] = buckets
+		}
+		b := buckets[minute]
+		b.Count += rc.Count
+		b.Bytes += rc.Bytes
+		buckets[minute] = b
+		for m := range buckets {
+			if m < oldest {
+				delete(buckets, m)
+			}
+		}
+		nt.Downloads += rc.Count
+		nt.BytesServed += rc.Bytes
+	}
+	buckets := a.nodes[nodeID]
+	if buckets == nil {
+		buckets = map[int64]nodeTraffic{}
+		a.nodes[nodeID] = buckets
+	}
+	b := buckets[minute]
+	b.Downloads += nt.Downloads
+	b.BytesServed += nt.BytesServed
+	b.Uploads += received.Count
+	b.BytesReceived += received.Bytes
+	buckets[minute] = b
+	for m := range buckets {
+		if m < oldest {
+			delete(buckets, m)
+		}
+	}
+}
+
+// nodeTotals sums each node's traffic over the last window.
+func (a *accessStats) nodeTotals(window time.Duration) map[string]nodeTraffic {
+	since := now().Add(-window).Unix() / 60
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := map[string]nodeTraffic{}
+	for id, buckets := range a.nodes {
+		var t nodeTraffic
+		for m, b := range buckets {
+			if m >= since {
+				t.Downloads += b.Downloads
+				t.BytesServed += b.BytesServed
+				t.Uploads += b.Uploads
+				t.BytesReceived += b.BytesReceived
+			}
+		}
+		out[id] = t
+	}
+	return out
+}
+
+// fileAccess is one file's downloads within a window.
+type fileAccess struct {
+	FileID    string `json:"fileId"`
+	Filename  string `json:"filename,omitempty"`
+	Downloads int64  `json:"downloads"`
+	Bytes     int64  `json:"bytes"`
+	// BytesPerSec is Bytes averaged over the window.
+	BytesPerSec float64 `json:"bytesPerSec"`
+}
+
+// top returns the limit most downloaded files over the last window, ranked
+// by download count or, with byBytes, by bytes served.
+func (a *accessStats) top(window time.Duration, byBytes bool, limit int) []fileAccess {
+	since := now().Add(-window).Unix() / 60
+	a.mu.Lock()
+	out := []fileAccess{}
+	for id, buckets := range a.files {
+		fa := fileAccess{FileID: id}
+		for m, b := range buckets {
+			if m >= since {
+				fa.Downloads += b.Count
+				fa.Bytes += b.Bytes
+			}
+		}
+		if fa.Downloads > 0 {
+			out = append(out, fa)
+		}
+	}
+	a.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if byBytes && out[i].Bytes != out[j].Bytes {
+			return out[i].Bytes > out[j].Bytes
+		}
+		if out[i].Downloads != out[j].Downloads {
+			return out[i].Downloads > out[j].Downloads
+		}
+		return out[i].FileID < out[j].FileID
+	})
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+// accessWindow parses ?window= for the stats endpoints: a duration up to
+// accessWindowMax, def when absent.
+func accessWindow(w http.ResponseWriter, r *http.Request, def time.Duration) (time.Duration, bool) {
+	v := r.URL.Query().Get("window")
+	if v == "" {
+		return def, true
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 || d > accessWindowMax {
+		apierr.Write(w, http.StatusBadRequest, apierr.BadRequest, "window must be a duration up to 168h")
+		return 0, false
+	}
+	return d, true
+}
+
+// handlePopular lists the most downloaded files:
+// ?window=24h (up to 168h) &by=count|bytes &limit=10. It is also served as
+// /stats/files/top.
+func (sv *Server) handlePopular(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	window, ok := accessWindow(w, r, 24*time.Hour)
+	if !ok {
+		return
+	}
+	limit := 10
+	if v := q.Get("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			limit = n
+		}
+	}
+	by := q.Get("by")
+	if by == "" {
+		by = "count"
+	}
+	if by != "count" && by != "bytes" {
+		apierr.Write(w, http.StatusBadRequest, apierr.BadRequest, "by must be count or bytes")
+		return
+	}
+
+	// deleted files drop out of the ranking
+	files := []fileAccess{}
+	sv.store.mu.RLock()
+	for _, fa := range sv.access.top(window, by == "bytes", 0) {
+		if meta, ok := sv.store.files[fa.FileID]; ok && len(files) < limit {
+			fa.Filename = meta.Filename
+			fa.BytesPerSec = float64(fa.Bytes) / window.Seconds()
+			files = append(files, fa)
+		}
+	}
+	sv.store.mu.RUnlock()
+	writeJSONResp(w, map[string]any{"window": window.String(), "by": by, "files": files})
+}
+
+// nodeStats is one row of /stats/nodes.
+type nodeStats struct {
+	NodeID string     `json:"nodeId"`
+	Status NodeStatus `json:"status"`
+	nodeTraffic
+	ServedPerSec   float64 `json:"servedBytesPerSec"`
+	ReceivedPerSec float64 `json:"receivedBytesPerSec"`
+	// Share is this node's part of all bytes moved in the window, so a hot
+	// spot stands out however busy the cluster is.
+	Share float64 `json:"share"`
+}
+
+// handleNodeStats reports each node's traffic, busiest first:
+// GET /stats/nodes?window=1h (up to 168h).
+func (sv *Server) handleNodeStats(w http.ResponseWriter, r *http.Request) {
+	window, ok := accessWindow(w, r, time.Hour)
+	if !ok {
+		return
+	}
+	totals := sv.access.nodeTotals(window)
+	rows := []nodeStats{}
+	var all int64
+	sv.store.mu.RLock()
+	for id, n := range sv.store.nodes {
+		t := totals[id]
+		all += t.BytesServed + t.BytesReceived
+		rows = append(rows, nodeStats{
+			NodeID:         id,
+			Status:         sv.stateOf(n),
+			nodeTraffic:    t,
+			ServedPerSec:   float64(t.BytesServed) / window.Seconds(),
+			ReceivedPerSec: float64(t.BytesReceived) / window.Seconds(),
+		})
+	}
+	sv.store.mu.RUnlock()
+	for i := range rows {
+		if all > 0 {
+			rows[i].Share = float64(rows[i].BytesServed+rows[i].BytesReceived) / float64(all)
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Share != rows[j].Share {
+			return rows[i].Share > rows[j].Share
+		}
+		return rows[i].NodeID < rows[j].NodeID
+	})
+	writeJSONResp(w, map[string]any{"window": window.String(), "totalBytes": all, "nodes": rows})
+}
+
+/* ==================== LIFECYCLE ==================== */
+
+// LifecycleAction is what a lifecycle rule does to the files it matches.
+type LifecycleAction string
+
+const (
+	// LifecycleExpire deletes files created more than AfterDays ago.
+	LifecycleExpire LifecycleAction = "expire"
+	// LifecycleReduce lowers the replication factor of files nobody has
+	// downloaded for AfterDays.
+	LifecycleReduce LifecycleAction = "reduce-replication"
+	// LifecycleAbort deletes uploads left ALLOCATED (never committed) for
+	// AfterDays.
+	LifecycleAbort LifecycleAction = "abort-incomplete"
+	// LifecycleTransition moves files nobody has downloaded for AfterDays
+	// to StorageClass.
+	LifecycleTransition LifecycleAction = "transition"
+)
+
+// lifecycleRule applies Action to the files in its scope. A rule without
+// FileID or Prefix covers every file.
+type lifecycleRule struct {
+	ID        string          `json:"id"`
+	Action    LifecycleAction `json:"action"`
+	AfterDays float64         `json:"afterDays"`
+	FileID    string          `json:"fileId,omitempty"`
+	Prefix    string          `json:"prefix,omitempty"` // filename prefix
+	Factor    int             `json:"factor,omitempty"` // reduce-replication target
+	// StorageClass is the transition target.
+	StorageClass StorageClass `json:"storageClass,omitempty"`
+	Disabled     bool         `json:"disabled,omitempty"`
+}
+
+func (r lifecycleRule) age() time.Duration {
+	return time.Duration(r.AfterDays * float64(24*time.Hour))
+}
+
+// due reports whether the rule acts on meta at t, and why. factor is the
+// file's current replication factor.
+func (r lifecycleRule) due(meta *FileMetadata, factor int, t time.Time) (bool, string) {
+	if r.Disabled || (r.FileID != "" && r.FileID != meta.FileID) || !strings.HasPrefix(meta.Filename, r.Prefix) {
+		return false, ""
+	}
+	switch r.Action {
+	case LifecycleExpire:
+		if meta.State != StateAllocated && t.Sub(meta.CreatedAt) >= r.age() {
+			return true, "created " + meta.CreatedAt.Format(time.RFC3339)
+		}
+	case LifecycleReduce:
+		idle := idleSince(meta)
+		if meta.State != StateAllocated && factor > r.Factor && t.Sub(idle) >= r.age() {
+			return true, fmt.Sprintf("idle since %s, factor %d -> %d", idle.Format(time.RFC3339), factor, r.Factor)
+		}
+	case LifecycleTransition:
+		idle := idleSince(meta)
+		if meta.State != StateAllocated && classOf(meta) != r.StorageClass && t.Sub(idle) >= r.age() {
+			return true, fmt.Sprintf("idle since %s, class %s -> %s", idle.Format(time.RFC3339), classOf(meta), r.StorageClass)
+		}
+	case LifecycleAbort:
+		if meta.State == StateAllocated && t.Sub(meta.UpdatedAt) >= r.age() {
+			return true, "allocated " + meta.UpdatedAt.Format(time.RFC3339)
+		}
+	}
+	return false, ""
+}
+
+// idleSince is the last time meta was created, downloaded or looked up
+// for a read.
+func idleSince(meta *FileMetadata) time.Time {
+	idle := meta.CreatedAt
+	if meta.LastReadAt.After(idle) {
+		idle = meta.LastReadAt
+	}
+	if meta.LastAccessedAt.After(idle) {
+		idle = meta.LastAccessedAt
+	}
+	return idle
+}
+
+func validateLifecycle(rules []lifecycleRule) []string {
+	var problems []string
+	seen := map[string]bool{}
+	for i, r := range rules {
+		name := fmt.Sprintf("rule %d", i+1)
+		if r.ID == "" {
+			problems = append(problems, name+": id is required")
+		} else if seen[r.ID] {
+			problems = append(problems, fmt.Sprintf("%s: duplicate id %q", name, r.ID))
+		}
+		seen[r.ID] = true
+		switch r.Action {
+		case LifecycleExpire, LifecycleAbort, LifecycleTransition:
+			if r.Factor != 0 {
+				problems = append(problems, fmt.Sprintf("%s: factor only applies to %s", name, LifecycleReduce))
+			}
+		case LifecycleReduce:
+			if r.Factor < 1 {
+				problems = append(problems, name+": factor must be at least 1")
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("%s: action must be %q, %q, %q or %q", name, LifecycleExpire, LifecycleReduce, LifecycleAbort, LifecycleTransition))
+		}
+		if _, ok := StorageClasses[r.StorageClass]; r.Action == LifecycleTransition && !ok {
+			problems = append(problems, fmt.Sprintf("%s: storageClass must be one of %v", name, slices.Sorted(maps.Keys(StorageClasses))))
+		} else if r.Action != LifecycleTransition && r.StorageClass != "" {
+			problems = append(problems, fmt.Sprintf("%s: storageClass only applies to %s", name, LifecycleTransition))
+		}
+		if r.AfterDays <= 0 {
+			problems = append(problems, name+": afterDays must be greater than zero")
+		}
+	}
+	return problems
+}
+
+// lifecycle holds the rules, persisted in metadata/lifecycle.json, and the
+// outcome of the last evaluation.
+type lifecycle struct {
+	mu    sync.Mutex
+	path  string
+	every time.Duration // 0 when the schedule is off
+	rules []lifecycleRule
+	last  *lifecycleReport
+}
+
+func openLifecycle(path string) (*lifecycle, error) {
+	l := &lifecycle{path: path, rules: []lifecycleRule{}}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err == nil {
+		err = json.Unmarshal(b, &l.rules)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if problems := validateLifecycle(l.rules); len(problems) > 0 {
+		return nil, fmt.Errorf("%s: %s", path, strings.Join(problems, "; "))
+	}
+	return l, nil
+}
+
+func (l *lifecycle) snapshot() []lifecycleRule {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]lifecycleRule(nil), l.rules...)
+}
+
+// lifecycleStep is one action a lifecycle pass took or, in a dry run,
+// would take.
+type lifecycleStep struct {
+	Rule     string          `json:"rule"`
+	Action   LifecycleAction `json:"action"`
+	FileID   string          `json:"fileId"`
+	Filename string          `json:"filename"`
+	Reason   string          `json:"reason"`
+	Error    string          `json:"error,omitempty"`
+
+	rule    lifecycleRule
+	version int
+}
+
+type lifecycleReport struct {
+	DryRun     bool            `json:"dryRun,omitempty"`
+	StartedAt  time.Time       `json:"startedAt"`
+	FinishedAt time.Time       `json:"finishedAt"`
+	Evaluated  int             `json:"evaluated"`
+	Steps      []lifecycleStep `json:"steps"`
+	Operation  string          `json:"operation,omitempty"`
+}
+
+// startLifecycle evaluates the rules every interval.
+func (sv *Server) startLifecycle(every time.Duration) {
+	go sv.every(every, func() {
+		if sv.maintenance.Load() || sv.ops.running("lifecycle") {
+			return
+		}
+		if rep := sv.runLifecycle(false); len(rep.Steps) > 0 {
+			log.Printf("[LIFECYCLE] %d action(s) on %d files evaluated", len(rep.Steps), rep.Evaluated)
+		}
+	})
+	log.Printf("Lifecycle background job started (every %s)", every)
+}
+
+// planLifecycle lists the files a rule is due on, reading the catalog in
+// batches. Rules are tried in order; the first due rule acts on a file.
+func (sv *Server) planLifecycle(rules []lifecycleRule) (int, []lifecycleStep) {
+	sv.store.mu.RLock()
+	ids := make([]string, 0, len(sv.store.files))
+	for id := range sv.store.files {
+		ids = append(ids, id)
+	}
+	sv.store.mu.RUnlock()
+	sort.Strings(ids)
+
+	t := now()
+	evaluated := 0
+	steps := []lifecycleStep{}
+	for start := 0; start < len(ids); start += healBatch {
+		sv.store.mu.RLock()
+		for _, id := range ids[start:min(start+healBatch, len(ids))] {
+			meta, ok := sv.store.files[id]
+			if !ok {
+				continue
+			}
+			evaluated++
+			for _, rule := range rules {
+				if ok, why := rule.due(meta, sv.factorOf(meta), t); ok {
+					steps = append(steps, lifecycleStep{Rule: rule.ID, Action: rule.Action, FileID: id, Filename: meta.Filename, Reason: why, rule: rule, version: meta.Version})
+					break
+				}
+			}
+		}
+		sv.store.mu.RUnlock()
+	}
+	return evaluated, steps
+}
+
+// runLifecycle evaluates every rule against the catalog and applies what is
+// due, or with dryRun only reports it. Deletions remove the blobs from the
+// nodes first; a file whose replicas cannot all be deleted stays in the
+// catalog and is retried on the next pass.
+func (sv *Server) runLifecycle(dryRun bool) lifecycleReport {
+	rep := lifecycleReport{DryRun: dryRun, StartedAt: now()}
+	rep.Evaluated, rep.Steps = sv.planLifecycle(sv.lifecycle.snapshot())
+	if !dryRun && len(rep.Steps) > 0 {
+		op := sv.ops.start("lifecycle", fmt.Sprintf("%d files", len(rep.Steps)), len(rep.Steps))
+		rep.Operation = op.ID
+		var jobs []repairJob
+		failed := 0
+		for i := range rep.Steps {
+			st := &rep.Steps[i]
+			if op.ctx.Err() != nil {
+				st.Error = "cancelled"
+				continue
+			}
+			var err error
+			switch st.Action {
+			case LifecycleReduce, LifecycleTransition:
+				var planned []repairJob
+				planned, err = sv.lifecycleReduce(*st)
+				jobs = append(jobs, planned...)
+			default:
+				err = sv.lifecyclePurge(op.ctx, *st)
+			}
+			if err != nil {
+				st.Error = err.Error()
+				failed++
+			} else {
+				sv.audit.append(auditEntry{Time: now(), Actor: "lifecycle", Action: "lifecycle-" + string(st.Action), Target: st.FileID, Detail: st.Rule + ": " + st.Reason})
+			}
+			sv.ops.step(op)
+		}
+		sv.store.persist()
+		var err error
+		if failed > 0 {
+			err = fmt.Errorf("%d of %d actions failed", failed, len(rep.Steps))
+		}
+		sv.ops.finish(op, err)
+		if len(jobs) > 0 {
+			trim := sv.ops.start("set-replication", fmt.Sprintf("lifecycle: %d repairs", len(jobs)), len(jobs))
+			go sv.runRepairs(trim, jobs)
+		}
+	}
+	rep.FinishedAt = now()
+	if !dryRun {
+		sv.lifecycle.mu.Lock()
+		sv.lifecycle.last = &rep
+		sv.lifecycle.mu.Unlock()
+	}
+	return rep
+}
+
+// stillDue re-checks a planned step against the current catalog. Callers
+// must hold the store lock.
+func (sv *Server) stillDue(st lifecycleStep) (*FileMetadata, error) {
+	meta, ok := sv.store.files[st.FileID]
+	if !ok {
+		return nil, errors.New("file no longer exists")
+	}
+	if due, _ := st.rule.due(meta, sv.factorOf(meta), now()); !due || meta.Version != st.version {
+		return nil, errors.New("file changed since the pass started")
+	}
+	return meta, nil
+}
+
+// lifecycleReduce lowers the file's replication factor, or changes its
+// storage class, and plans the repairs that takes.
+func (sv *Server) lifecycleReduce(st lifecycleStep) ([]repairJob, error) {
+	sv.store.mu.Lock()
+	defer sv.store.mu.Unlock()
+	meta, err := sv.stillDue(st)
+	if err != nil {
+		return nil, err
+	}
+	if st.Action == LifecycleTransition {
+		return sv.setClass(meta, st.rule.StorageClass), nil
+	}
+	meta.ReplicationFactor = st.rule.Factor
+	sv.refreshState(meta)
+	meta.UpdatedAt = now()
+	sv.store.touch(meta.FileID)
+	return sv.planHeal(meta), nil
+}
+
+// lifecyclePurge deletes the file's blobs from its nodes, then the file
+// from the catalog.
+func (sv *Server) lifecyclePurge(ctx context.Context, st lifecycleStep) error {
+	sv.store.mu.RLock()
+	meta, err := sv.stillDue(st)
+	var replicas []ReplicaInfo
+	if err == nil {
+		replicas = append(replicas, meta.Replicas...)
+	}
+	sv.store.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for _, rep := range replicas {
+		if err := sv.trimReplica(ctx, repairJob{FileID: st.FileID, TargetID: rep.NodeID, TargetURL: rep.URL}); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", rep.NodeID, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("delete failed on %s", strings.Join(failed, "; "))
+	}
+	sv.store.mu.Lock()
+	defer sv.store.mu.Unlock()
+	meta, err = sv.stillDue(st)
+	if err != nil {
+		return err
+	}
+	delete(sv.store.files, st.FileID)
+	sv.store.quotas.release(meta)
+	sv.store.shares.dropFile(st.FileID)
+	sv.store.mark(sv.store.conflicts.members(meta.ConflictID)...)
+	sv.store.conflicts.dropFile(meta, sv.store.files)
+	sv.idem.tombstone(st.FileID)
+	sv.store.touch(st.FileID)
+	log.Printf("[LIFECYCLE] %s %s (%s): %s", st.Action, st.FileID, st.Rule, st.Reason)
+	return nil
+}
+
+// handleLifecycle shows the rules and the last pass.
+func (sv *Server) handleLifecycle(w http.ResponseWriter, r *http.Request) {
+	sv.lifecycle.mu.Lock()
+	defer sv.lifecycle.mu.Unlock()
+	every := ""
+	if sv.lifecycle.every > 0 {
+		every = sv.lifecycle.every.String()
+	}
+	writeJSONResp(w, map[string]any{"rules": sv.lifecycle.rules, "interval": every, "lastRun": sv.lifecycle.last})
+}
+
+// SetLifecycleRequest is the body of PUT /admin/lifecycle.
+type SetLifecycleRequest struct {
+	Rules []lifecycleRule `json:"rules"`
+}
+
+// handleSetLifecycle replaces the rules with the PUT body's {"rules": [...]}.
+// With ?dryRun=true the rules are not saved; the answer is the pass they
+// would make now, as from POST /admin/lifecycle/run?dryRun=true.
+func (sv *Server) handleSetLifecycle(w http.ResponseWriter, r *http.Request) {
+	var body SetLifecycleRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		apierr.WriteDetail(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json", err.Error())
+		return
+	}
+	if body.Rules == nil {
+		body.Rules = []lifecycleRule{}
+	}
+	if problems := validateLifecycle(body.Rules); len(problems) > 0 {
+		apierr.WriteDetail(w, http.StatusBadRequest, apierr.BadRequest, strings.Join(problems, "; "), problems)
+		return
+	}
+	if isDryRun(r) {
+		rep := lifecycleReport{DryRun: true, StartedAt: now()}
+		rep.Evaluated, rep.Steps = sv.planLifecycle(body.Rules)
+		rep.FinishedAt = now()
+		writeJSONResp(w, rep)
+		return
+	}
+	sv.lifecycle.mu.Lock()
+	err := writeJSONFile(sv.lifecycle.path, body.Rules)
+	if err == nil {
+		sv.lifecycle.rules = body.Rules
+	}
+	sv.lifecycle.mu.Unlock()
+	if err != nil {
+		apierr.WriteDetail(w, http.StatusInternalServerError, apierr.Internal, "cannot save lifecycle rules", err.Error())
+		return
+	}
+	ids := make([]string, 0, len(body.Rules))
+	for _, rule := range body.Rules {
+		ids = append(ids, rule.ID)
+	}
+	log.Printf("[ADMIN] lifecycle rules set: %s", strings.Join(ids, ", "))
+	sv.record(r, "lifecycle-rules", "cluster", strings.Join(ids, ", "))
+	writeJSONResp(w, map[string]any{"rules": body.Rules})
+}
+
+// handleRunLifecycle evaluates the rules now; ?dryRun=true only lists what
+// would happen.
+func (sv *Server) handleRunLifecycle(w http.ResponseWriter, r *http.Request) {
+	dry := isDryRun(r)
+	if !dry && sv.ops.running("lifecycle") {
+		apierr.Write(w, http.StatusConflict, apierr.Conflict, "a lifecycle pass is already running")
+		return
+	}
+	if !dry && sv.maintenance.Load() {
+		apierr.Write(w, http.StatusServiceUnavailable, apierr.Maintenance, "naming service is in maintenance mode (read-only)")
+		return
+	}
+	if !dry {
+		sv.record(r, "lifecycle-run", "cluster", "")
+	}
+	writeJSONResp(w, sv.runLifecycle(dry))
+}
+
+/* ==================== BACKUP ==================== */
+
+// BackupKind is where a backup target keeps its copies.
+type BackupKind string
+
+const (
+	// BackupDir copies files into a local directory as <fileId>/<filename>.
+	BackupDir BackupKind = "dir"
+	// BackupS3 puts files into an S3 bucket, or anything speaking its API
+	// such as MinIO, as <keyPrefix><fileId>/<filename>.
+	BackupS3 BackupKind = "s3"
+	// BackupGateway uploads files to another cluster through its gateway.
+	BackupGateway BackupKind = "gateway"
+)
+
+// redactedSecret stands in for a secret in responses. PUT /admin/backup
+// keeps the stored secret of a target that sends it back.
+const redactedSecret = "********"
+
+// BackupTarget is one place backups go. A target without FileIDs or Prefix
+// covers every committed file.
+type BackupTarget struct {
+	ID       string     `json:"id"`
+	Kind     BackupKind `json:"kind"`
+	FileIDs  []string   `json:"fileIds,omitempty"`
+	Prefix   string     `json:"prefix,omitempty"` // filename prefix
+	Disabled bool       `json:"disabled,omitempty"`
+
+	// dir
+	Path string `json:"path,omitempty"`
+
+	// s3; requests are path-style, e.g. https://s3.eu-west-1.amazonaws.com/<bucket>/<key>
+	Endpoint  string `json:"endpoint,omitempty"`
+	Bucket    string `json:"bucket,omitempty"`
+	Region    string `json:"region,omitempty"`
+	KeyPrefix string `json:"keyPrefix,omitempty"`
+	AccessKey string `json:"accessKey,omitempty"`
+	SecretKey string `json:"secretKey,omitempty"`
+
+	// gateway; without a username the other gateway must not require login
+	URL      string `json:"url,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// covers reports whether meta is committed and in the target's scope.
+func (t BackupTarget) covers(meta *FileMetadata) bool {
+	switch meta.State {
+	case StateAllocated, StateDeleted, StateCorrupt:
+		return false
+	}
+	return strings.HasPrefix(meta.Filename, t.Prefix) && (len(t.FileIDs) == 0 || slices.Contains(t.FileIDs, meta.FileID))
+}
+
+// public is t with its secrets masked.
+func (t BackupTarget) public() BackupTarget {
+	if t.SecretKey != "" {
+		t.SecretKey = redactedSecret
+	}
+	if t.Password != "" {
+		t.Password = redactedSecret
+	}
+	return t
+}
+
+func validateBackup(targets []BackupTarget) []string {
+	var problems []string
+	seen := map[string]bool{}
+	for i, t := range targets {
+		name := fmt.Sprintf("target %d", i+1)
+		if t.ID == "" {
+			problems = append(problems, name+": id is required")
+		} else if seen[t.ID] {
+			problems = append(problems, fmt.Sprintf("%s: duplicate id %q", name, t.ID))
+		}
+		seen[t.ID] = true
+		need := func(field, value string) {
+			if value == "" {
+				problems = append(problems, fmt.Sprintf("%s: %s is required for %s", name, field, t.Kind))
+			} else if value == redactedSecret {
+				problems = append(problems, fmt.Sprintf("%s: %s is masked; send the secret itself", name, field))
+			}
+		}
+		switch t.Kind {
+		case BackupDir:
+			if !filepath.IsAbs(t.Path) {
+				problems = append(problems, name+": path must be an absolute directory")
+			}
+		case BackupS3:
+			if u, err := url.Parse(t.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				problems = append(problems, name+": endpoint must be an http(s) URL")
+			}
+			need("bucket", t.Bucket)
+			need("region", t.Region)
+			need("accessKey", t.AccessKey)
+			need("secretKey", t.SecretKey)
+		case BackupGateway:
+			if u, err := url.Parse(t.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				problems = append(problems, name+": url must be an http(s) URL")
+			}
+			if t.Username != "" {
+				need("password", t.Password)
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("%s: kind must be %q, %q or %q", name, BackupDir, BackupS3, BackupGateway))
+		}
+	}
+	return problems
+}
+
+// backupEntry is a target's copy of one file.
+type backupEntry struct {
+	Checksum string    `json:"checksum"`
+	Version  int       `json:"version"`
+	Key      string    `json:"key"` // path, object key or file ID on the other cluster
+	Size     int64     `json:"size"`
+	At       time.Time `json:"at"`
+}
+
+// backupError is one file a backup run could not copy.
+type backupError struct {
+	FileID string `json:"fileId"`
+	Error  string `json:"error"`
+}
+
+// maxBackupErrors caps the errors a run keeps.
+const maxBackupErrors = 20
+
+// backupRun is the outcome of one pass over a target.
+type backupRun struct {
+	Operation  string        `json:"operation"`
+	StartedAt  time.Time     `json:"startedAt"`
+	FinishedAt *time.Time    `json:"finishedAt,omitempty"` // nil while running
+	Copied     int           `json:"copied"`
+	Unchanged  int           `json:"unchanged"`
+	Failed     int           `json:"failed"`
+	Bytes      int64         `json:"bytes"`
+	Error      string        `json:"error,omitempty"` // the target itself failed
+	Errors     []backupError `json:"errors,omitempty"`
+}
+
+// backups holds the targets, persisted in metadata/backup.json, what each
+// target has, in metadata/backup-state.json, and the last run per target.
+type backups struct {
+	mu        sync.Mutex
+	path      string
+	statePath string
+	every     time.Duration // 0 when the schedule is off
+	targets   []BackupTarget
+	state     map[string]map[string]backupEntry // target ID -> file ID -> copy
+	last      map[string]*backupRun
+}
+
+func openBackups(path, statePath string) (*backups, error) {
+	b := &backups{path: path, statePath: statePath, targets: []BackupTarget{},
+		state: map[string]map[string]backupEntry{}, last: map[string]*backupRun{}}
+	for file, v := range map[string]any{path: &b.targets, statePath: &b.state} {
+		raw, err := os.ReadFile(file)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err == nil {
+			err = json.Unmarshal(raw, v)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	if problems := validateBackup(b.targets); len(problems) > 0 {
+		return nil, fmt.Errorf("%s: %s", path, strings.Join(problems, "; "))
+	}
+	return b, nil
+}
+
+// copies returns a copy of what target id has.
+func (b *backups) copies(id string) map[string]backupEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return maps.Clone(b.state[id])
+}
+
+func (b *backups) record(id, fileID string, e backupEntry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state[id] == nil {
+		b.state[id] = map[string]backupEntry{}
+	}
+	b.state[id][fileID] = e
+}
+
+// startBackups runs every enabled target every interval.
+func (sv *Server) startBackups(every time.Duration) {
+	go sv.every(every, func() {
+		sv.backups.mu.Lock()
+		targets := slices.Clone(sv.backups.targets)
+		sv.backups.mu.Unlock()
+		for _, t := range targets {
+			if !t.Disabled {
+				sv.startBackup(t)
+			}
+		}
+	})
+	log.Printf("Backup background job started (every %s)", every)
+}
+
+// startBackup starts a run of t in the background; it returns nil when t
+// is already running.
+func (sv *Server) startBackup(t BackupTarget) *operation {
+	sv.backups.mu.Lock()
+	if last := sv.backups.last[t.ID]; last != nil && last.FinishedAt == nil {
+		sv.backups.mu.Unlock()
+		return nil
+	}
+	op := sv.ops.start("backup", t.ID, 0)
+	run := &backupRun{Operation: op.ID, StartedAt: now()}
+	sv.backups.last[t.ID] = run
+	sv.backups.mu.Unlock()
+	go sv.runBackup(op, t, run)
+	return op
+}
+
+// runBackup copies to t every file it covers whose checksum differs from
+// the target's copy, reading each from a READY replica and checking it
+// against the catalog checksum before anything is written.
+func (sv *Server) runBackup(op *operation, t BackupTarget, run *backupRun) {
+	sv.store.mu.RLock()
+	var files []*FileMetadata
+	for _, meta := range sv.store.files {
+		if t.covers(meta) {
+			files = append(files, meta.clone())
+		}
+	}
+	sv.store.mu.RUnlock()
+	slices.SortFunc(files, func(a, b *FileMetadata) int { return cmp.Compare(a.FileID, b.FileID) })
+
+	have := sv.backups.copies(t.ID)
+	var todo []*FileMetadata
+	for _, meta := range files {
+		if have[meta.FileID].Checksum != meta.Checksum {
+			todo = append(todo, meta)
+		}
+	}
+	sv.backups.mu.Lock()
+	run.Unchanged = len(files) - len(todo)
+	sv.backups.mu.Unlock()
+	sv.ops.setTotal(op, len(todo))
+
+	var err error
+	if len(todo) > 0 {
+		var w backupWriter
+		if w, err = sv.newBackupWriter(op.ctx, t); err == nil {
+			for _, meta := range todo {
+				if op.ctx.Err() != nil {
+					break
+				}
+				e, ferr := sv.backupFile(op.ctx, w, meta, have[meta.FileID])
+				sv.backups.mu.Lock()
+				if ferr != nil {
+					run.Failed++
+					if len(run.Errors) < maxBackupErrors {
+						run.Errors = append(run.Errors, backupError{FileID: meta.FileID, Error: ferr.Error()})
+					}
+				} else {
+					run.Copied++
+					run.Bytes += e.Size
+				}
+				sv.backups.mu.Unlock()
+				if ferr == nil {
+					sv.backups.record(t.ID, meta.FileID, e)
+				}
+				sv.ops.step(op)
+			}
+		}
+	}
+
+	sv.backups.mu.Lock()
+	if err != nil {
+		run.Error = err.Error()
+	} else if run.Failed > 0 {
+		err = fmt.Errorf("%d of %d files failed", run.Failed, len(todo))
+	}
+	finished := now()
+	run.FinishedAt = &finished
+	serr := writeJSONFile(sv.backups.statePath, sv.backups.state)
+	sv.backups.mu.Unlock()
+	if serr != nil {
+		log.Printf("[BACKUP] cannot save backup state: %v", serr)
+	}
+	sv.ops.finish(op, err)
+	if err != nil {
+		log.Printf("[BACKUP] %s: %v", t.ID, err)
+	}
+	if run.Copied > 0 {
+		log.Printf("[BACKUP] %s: %d copied (%d bytes), %d unchanged", t.ID, run.Copied, run.Bytes, run.Unchanged)
+	}
+}
+
+// backupFile reads meta from a READY replica and hands it to w.
+func (sv *Server) backupFile(ctx context.Context, w backupWriter, meta *FileMetadata, prev backupEntry) (backupEntry, error) {
+	tmp, size, err := sv.readVerified(ctx, meta)
+	if err != nil {
+		return prev, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	key, err := w.put(ctx, meta, prev.Key, tmp, size)
+	if err != nil {
+		return prev, err
+	}
+	return backupEntry{Checksum: meta.Checksum, Version: meta.Version, Key: key, Size: size, At: now()}, nil
+}
+
+// backupWriter stores verified file content on a target.
+type backupWriter interface {
+	// put stores body, size bytes of meta's content, and returns where it
+	// went; prevKey is where the target's last copy of the file is, if any.
+	put(ctx context.Context, meta *FileMetadata, prevKey string, body io.ReadSeeker, size int64) (string, error)
+}
+
+func (sv *Server) newBackupWriter(ctx context.Context, t BackupTarget) (backupWriter, error) {
+	switch t.Kind {
+	case BackupDir:
+		return dirBackup{root: t.Path}, os.MkdirAll(t.Path, 0755)
+	case BackupS3:
+		return s3Backup{t, sv.httpClient(0)}, nil
+	case BackupGateway:
+		return sv.newGatewayBackup(ctx, t)
+	}
+	return nil, fmt.Errorf("unknown backup kind %q", t.Kind)
+}
+
+// backupKey is where a copy of meta goes: <fileId>/<filename>.
+func backupKey(meta *FileMetadata) string {
+	name := path.Base(strings.ReplaceAll(meta.Filename, `\`, "/"))
+	if name == "." || name == "/" || name == ".." {
+		name = "file"
+	}
+	return meta.FileID + "/" + name
+}
+
+type dirBackup struct{ root string }
+
+// put writes the copy next to its final name and renames it into place,
+// then removes the last copy if the file has been renamed since.
+func (d dirBackup) put(_ context.Context, meta *FileMetadata, prevKey string, body io.ReadSeeker, _ int64) (string, error) {
+	key := backupKey(meta)
+	dst := filepath.Join(d.root, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", err
+	}
+	out, err := os.CreateTemp(filepath.Dir(dst), ".backup-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(out.Name())
+	_, err = io.Copy(out, body)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), dst)
+	}
+	if err != nil {
+		return "", err
+	}
+	if prevKey != "" && prevKey != key {
+		_ = os.Remove(filepath.Join(d.root, filepath.FromSlash(prevKey)))
+	}
+	return key, nil
+}
+
+type s3Backup struct {
+	t      BackupTarget
+	client *http.Client
+}
+
+// put uploads the copy with one PUT Object; the catalog checksum goes
+// along as x-amz-meta-checksum. A copy under an old filename is deleted.
+func (s s3Backup) put(ctx context.Context, meta *FileMetadata, prevKey string, body io.ReadSeeker, size int64) (string, error) {
+	key := s.t.KeyPrefix + backupKey(meta)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(key), body)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", cmp.Or(meta.ContentType, "application/octet-stream"))
+	req.Header.Set("X-Amz-Meta-Checksum", meta.Checksum)
+	if err := s.do(req); err != nil {
+		return "", err
+	}
+	if prevKey != "" && prevKey != key {
+		if req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.objectURL(prevKey), nil); err == nil {
+			_ = s.do(req)
+		}
+	}
+	return key, nil
+}
+
+func (s s3Backup) objectURL(key string) string {
+	segs := strings.Split(key, "/")
+	for i, seg := range segs {
+		segs[i] = awsEscape(seg)
+	}
+	return strings.TrimRight(s.t.Endpoint, "/") + "/" + awsEscape(s.t.Bucket) + "/" + strings.Join(segs, "/")
+}
+
+func (s s3Backup) do(req *http.Request) error {
+	signS3(req, s.t, now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("s3 %s: %s: %s", req.Method, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// awsEscape percent-encodes everything but the unreserved characters, as
+// Signature Version 4 expects of each path segment.
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// signS3 signs req with AWS Signature Version 4. The payload is left
+// unsigned, which S3 accepts, so the body can stream.
+func signS3(req *http.Request, t BackupTarget, at time.Time) {
+	stamp := at.UTC().Format("20060102T150405Z")
+	day := stamp[:8]
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	names := []string{"host"}
+	values := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-amz-") {
+			names = append(names, lk)
+			values[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, n := range names {
+		headers.WriteString(n + ":" + values[n] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	canonical := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery, headers.String(), signed, "UNSIGNED-PAYLOAD"}, "\n")
+	scope := day + "/" + t.Region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	key := []byte("AWS4" + t.SecretKey)
+	for _, part := range []string{day, t.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	sig := hmacSHA256(key, "AWS4-HMAC-SHA256\n"+stamp+"\n"+scope+"\n"+hex.EncodeToString(sum[:]))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		t.AccessKey, scope, signed, hex.EncodeToString(sig)))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// gatewayBackup uploads to another cluster's /api/upload, signed in with a
+// session cookie when the target has a username.
+type gatewayBackup struct {
+	base   string
+	client *http.Client
+}
+
+func (sv *Server) newGatewayBackup(ctx context.Context, t BackupTarget) (*gatewayBackup, error) {
+	jar, _ := cookiejar.New(nil)
+	g := &gatewayBackup{base: strings.TrimRight(t.URL, "/"), client: &http.Client{Transport: sv.transport, Jar: jar}}
+	if t.Username == "" {
+		return g, nil
+	}
+	b, _ := json.Marshal(map[string]string{"username": t.Username, "password": t.Password})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.base+"/api/login", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("gateway login: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("gateway login: %s", resp.Status)
+	}
+	return g, nil
+}
+
+// put uploads a new version of the other cluster's copy, or a new file
+// when there is none yet or it has gone.
+func (g *gatewayBackup) put(ctx context.Context, meta *FileMetadata, prevKey string, body io.ReadSeeker, _ int64) (string, error) {
+	id, status, err := g.upload(ctx, meta, prevKey, body)
+	if prevKey != "" && (status == http.StatusNotFound || status == http.StatusForbidden) {
+		if _, err = body.Seek(0, io.SeekStart); err == nil {
+			id, _, err = g.upload(ctx, meta, "", body)
+		}
+	}
+	return id, err
+}
+
+func (g *gatewayBackup) upload(ctx context.Context, meta *FileMetadata, fileID string, body io.Reader) (string, int, error) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		_ = mw.WriteField("filename", meta.Filename)
+		if fileID != "" {
+			_ = mw.WriteField("fileId", fileID)
+		}
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename=%q`, path.Base(meta.Filename)))
+		h.Set("Content-Type", cmp.Or(meta.ContentType, "application/octet-stream"))
+		part, err := mw.CreatePart(h)
+		if err == nil {
+			_, err = io.Copy(part, body)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.base+"/api/upload", pr)
+	if err != nil {
+		pr.CloseWithError(err)
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", resp.StatusCode, fmt.Errorf("gateway upload: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	var res struct {
+		FileID string `json:"fileId"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil || res.FileID == "" {
+		return "", resp.StatusCode, fmt.Errorf("gateway upload: no fileId in the response")
+	}
+	return res.FileID, resp.StatusCode, nil
+}
+
+// handleBackup shows the targets, secrets masked.
+func (sv *Server) handleBackup(w http.ResponseWriter, r *http.Request) {
+	sv.backups.mu.Lock()
+	defer sv.backups.mu.Unlock()
+	targets := make([]BackupTarget, 0, len(sv.backups.targets))
+	for _, t := range sv.backups.targets {
+		targets = append(targets, t.public())
+	}
+	every := ""
+	if sv.backups.every > 0 {
+		every = sv.backups.every.String()
+	}
+	writeJSONResp(w, map[string]any{"targets": targets, "interval": every})
+}
+
+// SetBackupRequest is the body of PUT /admin/backup.
+type SetBackupRequest struct {
+	Targets []BackupTarget `json:"targets"`
+}
+
+// handleSetBackup replaces the targets. A masked secret keeps the stored
+// one of the target with the same ID. What a removed target had is
+// forgotten, so adding it back copies everything again.
+func (sv *Server) handleSetBackup(w http.ResponseWriter, r *http.Request) {
+	var body SetBackupRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		apierr.WriteDetail(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json", err.Error())
+		return
+	}
+	if body.Targets == nil {
+		body.Targets = []BackupTarget{}
+	}
+	sv.backups.mu.Lock()
+	defer sv.backups.mu.Unlock()
+	old := map[string]BackupTarget{}
+	for _, t := range sv.backups.targets {
+		old[t.ID] = t
+	}
+	ids := make([]string, 0, len(body.Targets))
+	for i := range body.Targets {
+		t := &body.Targets[i]
+		if t.SecretKey == redactedSecret {
+			t.SecretKey = old[t.ID].SecretKey
+		}
+		if t.Password == redactedSecret {
+			t.Password = old[t.ID].Password
+		}
+		ids = append(ids, t.ID)
+	}
+	if problems := validateBackup(body.Targets); len(problems) > 0 {
+		apierr.WriteDetail(w, http.StatusBadRequest, apierr.BadRequest, strings.Join(problems, "; "), problems)
+		return
+	}
+	if err := writeJSONFile(sv.backups.path, body.Targets); err != nil {
+		apierr.WriteDetail(w, http.StatusInternalServerError, apierr.Internal, "cannot save backup targets", err.Error())
+		return
+	}
+	sv.backups.targets = body.Targets
+	for id := range sv.backups.state {
+		if !slices.Contains(ids, id) {
+			delete(sv.backups.state, id)
+		}
+	}
+	_ = writeJSONFile(sv.backups.statePath, sv.backups.state)
+	log.Printf("[ADMIN] backup targets set: %s", strings.Join(ids, ", "))
+	sv.record(r, "backup-targets", "cluster", strings.Join(ids, ", "))
+	targets := make([]BackupTarget, 0, len(body.Targets))
+	for _, t := range body.Targets {
+		targets = append(targets, t.public())
+	}
+	writeJSONResp(w, map[string]any{"targets": targets})
+}
+
+// handleRunBackup starts a run of every enabled target, or of
+// ?target=<id> whether enabled or not, and returns the operations.
+func (sv *Server) handleRunBackup(w http.ResponseWriter, r *http.Request) {
+	want := r.URL.Query().Get("target")
+	sv.backups.mu.Lock()
+	var targets []BackupTarget
+	for _, t := range sv.backups.targets {
+		if t.ID == want || (want == "" && !t.Disabled) {
+			targets = append(targets, t)
+		}
+	}
+	sv.backups.mu.Unlock()
+	if want != "" && len(targets) == 0 {
+		apierr.Write(w, http.StatusNotFound, apierr.NotFound, "no backup target "+want)
+		return
+	}
+	started := map[string]string{}
+	var busy []string
+	for _, t := range targets {
+		if op := sv.startBackup(t); op != nil {
+			started[t.ID] = op.ID
+		} else {
+			busy = append(busy, t.ID)
+		}
+	}
+	if want != "" && len(busy) > 0 {
+		apierr.Write(w, http.StatusConflict, apierr.Conflict, "a run of "+want+" is already in progress")
+		return
+	}
+	sv.record(r, "backup-run", cmp.Or(want, "cluster"), fmt.Sprintf("%d target(s)", len(started)))
+	resp := map[string]any{"operations": started}
+	if len(busy) > 0 {
+		resp["alreadyRunning"] = busy
+	}
+	writeJSONResp(w, resp)
+}
+
+// backupStatus is one target in /backup-status.
+type backupStatus struct {
+	ID       string     `json:"id"`
+	Kind     BackupKind `json:"kind"`
+	Disabled bool       `json:"disabled,omitempty"`
+	Files    int        `json:"files"`   // files the target has a copy of
+	Bytes    int64      `json:"bytes"`   // their size
+	Pending  int        `json:"pending"` // covered files whose copy is missing or out of date
+	Retained int        `json:"retained"`
+	LastRun  *backupRun `json:"lastRun,omitempty"`
+}
+
+// handleBackupStatus reports, per target, what it has, what the next run
+// would copy, and how the last run went. Retained counts copies of files
+// no longer in the catalog; backups never delete them.
+func (sv *Server) handleBackupStatus(w http.ResponseWriter, r *http.Request) {
+	sv.backups.mu.Lock()
+	targets := slices.Clone(sv.backups.targets)
+	out := make([]backupStatus, len(targets))
+	for i, t := range targets {
+		st := backupStatus{ID: t.ID, Kind: t.Kind, Disabled: t.Disabled, Files: len(sv.backups.state[t.ID])}
+		for _, e := range sv.backups.state[t.ID] {
+			st.Bytes += e.Size
+		}
+		if last := sv.backups.last[t.ID]; last != nil {
+			run := *last
+			run.Errors = slices.Clone(last.Errors)
+			st.LastRun = &run
+		}
+		out[i] = st
+	}
+	state := map[string]map[string]backupEntry{}
+	for _, t := range targets {
+		state[t.ID] = maps.Clone(sv.backups.state[t.ID])
+	}
+	every := ""
+	if sv.backups.every > 0 {
+		every = sv.backups.every.String()
+	}
+	sv.backups.mu.Unlock()
+
+	sv.store.mu.RLock()
+	for i, t := range targets {
+		for _, meta := range sv.store.files {
+			if t.covers(meta) && state[t.ID][meta.FileID].Checksum != meta.Checksum {
+				out[i].Pending++
+			}
+		}
+		for id := range state[t.ID] {
+			if meta, ok := sv.store.files[id]; !ok || meta.State == StateDeleted {
+				out[i].Retained++
+			}
+		}
+	}
+	sv.store.mu.RUnlock()
+	writeJSONResp(w, map[string]any{"targets": out, "interval": every})
+}
+
+/* ==================== GEO-REPLICATION ==================== */
+
+// GeoConflictPolicy is what a push does when the peer already has a
+// different file under the same ID.
+type GeoConflictPolicy string
+
+const (
+	// GeoSkip leaves the peer's file alone and reports the collision.
+	GeoSkip GeoConflictPolicy = "skip"
+	// GeoOverwrite pushes ours as a new version of the peer's file.
+	GeoOverwrite GeoConflictPolicy = "overwrite"
+)
+
+// GeoPeer is a remote cluster committed files are pushed to.
+type GeoPeer struct {
+	ID        string `json:"id"`
+	NamingURL string `json:"namingUrl"`
+	// Token is the peer's ADMIN_TOKEN; pushes go to its admin API.
+	Token      string            `json:"token"`
+	Prefix     string            `json:"prefix,omitempty"`     // filename prefix; empty pushes every file
+	OnConflict GeoConflictPolicy `json:"onConflict,omitempty"` // empty means skip
+	Disabled   bool              `json:"disabled,omitempty"`
+}
+
+// covers reports whether meta is a committed file the peer should have.
+// Derived files such as previews stay local; the peer makes its own.
+func (p GeoPeer) covers(meta *FileMetadata) bool {
+	switch meta.State {
+	case StateAllocated, StateDeleted, StateCorrupt:
+		return false
+	}
+	return meta.ParentID == "" && strings.HasPrefix(meta.Filename, p.Prefix)
+}
+
+func validateGeoPeers(peers []GeoPeer) []string {
+	var problems []string
+	seen := map[string]bool{}
+	for i, p := range peers {
+		name := fmt.Sprintf("peer %d", i+1)
+		if p.ID == "" {
+			problems = append(problems, name+": id is required")
+		} else if seen[p.ID] {
+			problems = append(problems, fmt.Sprintf("%s: duplicate id %q", name, p.ID))
+		}
+		seen[p.ID] = true
+		if u, err := url.Parse(p.NamingURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, name+": namingUrl must be an http(s) URL")
+		}
+		switch p.Token {
+		case "":
+			problems = append(problems, name+": token is required")
+		case redactedSecret:
+			problems = append(problems, name+": token is masked; send the token itself")
+		}
+		if p.OnConflict != "" && p.OnConflict != GeoSkip && p.OnConflict != GeoOverwrite {
+			problems = append(problems, fmt.Sprintf("%s: onConflict must be %q or %q", name, GeoSkip, GeoOverwrite))
+		}
+	}
+	return problems
+}
+
+// geoEntry is what a peer has of one file.
+type geoEntry struct {
+	Checksum string    `json:"checksum"`
+	Version  int       `json:"version,omitempty"` // the version on the peer
+	At       time.Time `json:"at"`
+	// Conflict is why the peer refused the file; it is not pushed again
+	// until it changes here.
+	Conflict string `json:"conflict,omitempty"`
+}
+
+// geoQueue is a peer's pending pushes, rebuilt from the catalog on every
+// sweep, and how its last push went.
+type geoQueue struct {
+	due       map[string]time.Time // fileId -> when it was committed
+	pushed    int64                // files pushed since start
+	lastPush  time.Time
+	lastError string
+}
+
+// geoReplication holds the peers, persisted in metadata/geo-peers.json,
+// what each peer has, in metadata/geo-state.json, and the queues.
+type geoReplication struct {
+	mu        sync.Mutex
+	path      string
+	statePath string
+	every     time.Duration // 0 when geo-replication is off
+	peers     []GeoPeer
+	state     map[string]map[string]geoEntry // peer ID -> file ID -> copy
+	queues    map[string]*geoQueue
+	wake      chan struct{}
+}
+
+func openGeoReplication(path, statePath string) (*geoReplication, error) {
+	g := &geoReplication{path: path, statePath: statePath, peers: []GeoPeer{},
+		state: map[string]map[string]geoEntry{}, queues: map[string]*geoQueue{}, wake: make(chan struct{}, 1)}
+	for file, v := range map[string]any{path: &g.peers, statePath: &g.state} {
+		raw, err := os.ReadFile(file)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err == nil {
+			err = json.Unmarshal(raw, v)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	if problems := validateGeoPeers(g.peers); len(problems) > 0 {
+		return nil, fmt.Errorf("%s: %s", path, strings.Join(problems, "; "))
+	}
+	return g, nil
+}
+
+// queue returns peer id's queue. Callers must hold g.mu.
+func (g *geoReplication) queue(id string) *geoQueue {
+	q := g.queues[id]
+	if q == nil {
+		q = &geoQueue{due: map[string]time.Time{}}
+		g.queues[id] = q
+	}
+	return q
+}
+
+// enqueue queues a just-committed file for every peer that covers it.
+// Callers hold the store lock; g never takes it while holding g.mu.
+func (g *geoReplication) enqueue(meta *FileMetadata) {
+	g.mu.Lock()
+	if g.every == 0 {
+		g.mu.Unlock()
+		return
+	}
+	for _, p := range g.peers {
+		if !p.Disabled && p.covers(meta) {
+			g.queue(p.ID).due[meta.FileID] = meta.UpdatedAt
+		}
+	}
+	g.mu.Unlock()
+	select {
+	case g.wake <- struct{}{}:
+	default:
+	}
+}
+
+// lag is how long the oldest queued file has waited. Callers must hold g.mu.
+func (q *geoQueue) lag(t time.Time) time.Duration {
+	var oldest time.Time
+	for _, at := range q.due {
+		if oldest.IsZero() || at.Before(oldest) {
+			oldest = at
+		}
+	}
+	if oldest.IsZero() {
+		return 0
+	}
+	return t.Sub(oldest)
+}
+
+// startGeoReplication pushes queued files as they are committed and, every
+// interval, requeues whatever a peer is missing or has out of date, which
+// also retries failed pushes.
+func (sv *Server) startGeoReplication(every time.Duration) {
+	go func() {
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		sv.geoSweep()
+		for {
+			sv.geoPushAll()
+			select {
+			case <-ticker.C:
+				sv.geoSweep()
+			case <-sv.geo.wake:
+			case <-sv.quit:
+				return
+			}
+		}
+	}()
+	log.Printf("Geo-replication started (sweep every %s)", every)
+}
+
+// geoSweep rebuilds every peer's queue from the catalog.
+func (sv *Server) geoSweep() {
+	sv.store.mu.RLock()
+	defer sv.store.mu.RUnlock()
+	sv.geo.mu.Lock()
+	defer sv.geo.mu.Unlock()
+	for _, p := range sv.geo.peers {
+		q := sv.geo.queue(p.ID)
+		clear(q.due)
+		if p.Disabled {
+			continue
+		}
+		have := sv.geo.state[p.ID]
+		for id, meta := range sv.store.files {
+			if p.covers(meta) && have[id].Checksum != meta.Checksum {
+				q.due[id] = meta.UpdatedAt
+			}
+		}
+	}
+}
+
+// geoPushAll pushes every queued file, oldest first, peer by peer.
+func (sv *Server) geoPushAll() {
+	sv.geo.mu.Lock()
+	peers := slices.Clone(sv.geo.peers)
+	sv.geo.mu.Unlock()
+	for _, p := range peers {
+		if p.Disabled {
+			continue
+		}
+		sv.geo.mu.Lock()
+		q := sv.geo.queue(p.ID)
+		ids := slices.Collect(maps.Keys(q.due))
+		slices.SortFunc(ids, func(a, b string) int { return q.due[a].Compare(q.due[b]) })
+		sv.geo.mu.Unlock()
+		for _, id := range ids {
+			select {
+			case <-sv.quit:
+				return
+			default:
+			}
+			sv.store.mu.RLock()
+			meta, ok := sv.store.files[id]
+			if ok {
+				meta = meta.clone()
+			}
+			sv.store.mu.RUnlock()
+			if !ok || !p.covers(meta) {
+				sv.geo.mu.Lock()
+				delete(q.due, id)
+				sv.geo.mu.Unlock()
+				continue
+			}
+			e, err := sv.geoPush(context.Background(), p, meta)
+			sv.geo.mu.Lock()
+			if err != nil {
+				q.lastError = fmt.Sprintf("%s: %v", id, err)
+				sv.geo.mu.Unlock()
+				log.Printf("[GEO] push %s to %s: %v", id, p.ID, err)
+				break // the peer is likely down; the next sweep retries
+			}
+			if sv.geo.state[p.ID] == nil {
+				sv.geo.state[p.ID] = map[string]geoEntry{}
+			}
+			sv.geo.state[p.ID][id] = e
+			if at, ok := q.due[id]; ok && !at.After(meta.UpdatedAt) {
+				delete(q.due, id) // not recommitted while we pushed
+			}
+			q.lastPush, q.lastError = now(), ""
+			if e.Conflict == "" {
+				q.pushed++
+			} else {
+				log.Printf("[GEO] %s on %s: %s", id, p.ID, e.Conflict)
+			}
+			serr := writeJSONFile(sv.geo.statePath, sv.geo.state)
+			sv.geo.mu.Unlock()
+			if serr != nil {
+				log.Printf("[GEO] cannot save geo-replication state: %v", serr)
+			}
+		}
+	}
+}
+
+// GeoReceiveRequest is the body of POST /admin/geo-replication/receive,
+// which a peer sends before uploading a file's content here.
+type GeoReceiveRequest struct {
+	FileID       string       `json:"fileId"`
+	Filename     string       `json:"filename"`
+	Size         int64        `json:"size"`
+	Checksum     string       `json:"checksum"`
+	ContentType  string       `json:"contentType"`
+	Owner        string       `json:"owner,omitempty"`
+	StorageClass StorageClass `json:"storageClass,omitempty"`
+	Placement    []string     `json:"placement,omitempty"`
+	// Origin is the cluster ID the file was first uploaded to.
+	Origin string `json:"origin"`
+	// Overwrite replaces a file with the same ID from another origin.
+	Overwrite bool `json:"overwrite,omitempty"`
+}
+
+// geoReceiveResponse answers a GeoReceiveRequest. Action is "allocated" or
+// "overwritten", when the sender should upload Version to Replicas and
+// commit it, or "unchanged" or "skipped", when there is nothing to send.
+type geoReceiveResponse struct {
+	Action    string       `json:"action"`
+	FileID    string       `json:"fileId"`
+	Version   int          `json:"version,omitempty"`
+	Replicas  []geoReplica `json:"replicas,omitempty"`
+	ClusterID string       `json:"clusterId"`
+}
+
+// geoReplica is a node a pushing peer uploads to, with the ticket the
+// receiving cluster signed for it when its nodes want one.
+type geoReplica struct {
+	NodeID, URL string
+	Ticket      string `json:",omitempty"`
+}
+
+// handleGeoReceive takes a file pushed by a peer under its own ID. A file
+// already here under that ID is updated when it came from the same origin
+// or the peer asks to overwrite, and is otherwise a 409 collision.
+func (sv *Server) handleGeoReceive(w http.ResponseWriter, r *http.Request) {
+	var body GeoReceiveRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.FileID == "" || body.Filename == "" ||
+		body.Size <= 0 || !strings.HasPrefix(body.Checksum, "sha256:") || body.Origin == "" {
+		apierr.Write(w, http.StatusBadRequest, apierr.BadRequest, "invalid payload")
+		return
+	}
+	if sv.refuseForeign(w, body.FileID) {
+		return
+	}
+	resp := geoReceiveResponse{FileID: body.FileID, ClusterID: sv.store.clusterID}
+	if body.Origin == sv.store.clusterID {
+		resp.Action = "skipped" // our own file coming back
+		writeJSONResp(w, resp)
+		return
+	}
+	if _, ok := StorageClasses[body.StorageClass]; !ok {
+		body.StorageClass = "" // a class this cluster does not have
+	}
+
+	sv.store.mu.RLock()
+	_, exists := sv.store.files[body.FileID]
+	sv.store.mu.RUnlock()
+	var replicas []*NodeInfo
+	if !exists {
+		class := StorageClasses[cmp.Or(body.StorageClass, ClassStandard)]
+		allHints := append(slices.Clone(class.Placement), body.Placement...)
+		hints, err := parsePlacementHints(allHints)
+		if err != nil {
+			// hints the sender should have refused; place it like any file
+			body.Placement, allHints, hints = nil, class.Placement, placementHints{}
+		}
+		factor := cmp.Or(class.Factor, sv.tunables().ReplicationFactor)
+		if replicas, err = sv.pickReplicas(r.Context(), PlacementFile{body.Filename, body.Size, body.ContentType, allHints}, hints, factor); err != nil {
+			apierr.WriteDetail(w, http.StatusServiceUnavailable, apierr.InsufficientNodes, err.Error(), err)
+			return
+		}
+	}
+
+	sv.store.mu.Lock()
+	meta, ok := sv.store.files[body.FileID]
+	switch {
+	case !ok && replicas == nil:
+		sv.store.mu.Unlock()
+		apierr.Write(w, http.StatusConflict, apierr.Conflict, "file was deleted while the push started; retry")
+		return
+	case !ok:
+		if qe := sv.store.quotas.check(body.Owner, "", body.Size); qe != nil {
+			sv.store.mu.Unlock()
+			writeQuotaExceeded(w, qe)
+			return
+		}
+		meta = &FileMetadata{
+			FileID: body.FileID, Filename: body.Filename, Size: body.Size, Checksum: body.Checksum,
+			ContentType: body.ContentType, Version: 1, State: StateAllocated, CreatedAt: now(), UpdatedAt: now(),
+			Owner: body.Owner, Placement: body.Placement, StorageClass: body.StorageClass, Origin: body.Origin,
+		}
+		for _, n := range replicas {
+			meta.Replicas = append(meta.Replicas, ReplicaInfo{NodeID: n.NodeID, URL: n.URL, Status: ReplicaReady, LastVerifiedAt: now(), Version: 1})
+			sv.store.nodes[n.NodeID].LastChosen = now()
+		}
+		sv.store.files[body.FileID] = meta
+		sv.store.touch(body.FileID)
+		resp.Action = "allocated"
+	case meta.State == StateDeleted:
+		sv.store.mu.Unlock()
+		apierr.Write(w, http.StatusConflict, apierr.FileGone, "file was deleted on this cluster")
+		return
+	case meta.Checksum == body.Checksum && meta.CommittedVersion == meta.Version:
+		resp.Action, resp.Version = "unchanged", meta.Version
+		sv.store.mu.Unlock()
+		writeJSONResp(w, resp)
+		return
+	case meta.Origin != body.Origin && !body.Overwrite:
+		sv.store.mu.Unlock()
+		apierr.WriteDetail(w, http.StatusConflict, apierr.Conflict, "fileId collision: a different file has this ID here",
+			map[string]any{"fileId": meta.FileID, "filename": meta.Filename, "checksum": meta.Checksum, "origin": meta.Origin})
+		return
+	default:
+		if qe := sv.store.quotas.check(meta.Owner, meta.FileID, body.Size); qe != nil {
+			sv.store.mu.Unlock()
+			writeQuotaExceeded(w, qe)
+			return
+		}
+		sv.newVersion(meta, body.Filename, body.Size, body.Checksum, body.ContentType, "")
+		meta.Origin = body.Origin
+		resp.Action = "overwritten"
+	}
+	resp.Version = meta.Version
+	for _, rep := range meta.Replicas {
+		ticket := sv.ticketFor(rep.NodeID, meta.FileID, meta.Version, body.Size, body.Checksum)
+		resp.Replicas = append(resp.Replicas, geoReplica{rep.NodeID, rep.URL, ticket})
+	}
+	sv.store.mu.Unlock()
+	sv.store.persist()
+	sv.record(r, "geo-receive", body.FileID, fmt.Sprintf("%s v%d from %s", resp.Action, resp.Version, body.Origin))
+	writeJSONResp(w, resp)
+}
+
+// geoPush sends one file to a peer: it announces the file, uploads the
+// content to the nodes the peer picked and commits it there. A collision
+// the peer refuses comes back as an entry with Conflict set.
+func (sv *Server) geoPush(ctx context.Context, p GeoPeer, meta *FileMetadata) (geoEntry, error) {
+	e := geoEntry{Checksum: meta.Checksum, At: now()}
+	tmp, _, err := sv.readVerified(ctx, meta)
+	if err != nil {
+		return e, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	var alloc geoReceiveResponse
+	status, err := p.call(ctx, sv.httpClient(30*time.Second), "/admin/geo-replication/receive", GeoReceiveRequest{
+		FileID: meta.FileID, Filename: meta.Filename, Size: meta.Size, Checksum: meta.Checksum,
+		ContentType: meta.ContentType, Owner: meta.Owner, StorageClass: meta.StorageClass, Placement: meta.Placement,
+		Origin: cmp.Or(meta.Origin, sv.store.clusterID), Overwrite: p.OnConflict == GeoOverwrite,
+	}, &alloc)
+	if status == http.StatusConflict {
+		e.Conflict = err.Error()
+		return e, nil
+	}
+	if err != nil {
+		return e, err
+	}
+	e.Version = alloc.Version
+	if alloc.Action == "unchanged" || alloc.Action == "skipped" {
+		return e, nil
+	}
+
+	var uploaded, failed []string
+	var stored int64
+	for _, rep := range alloc.Replicas {
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return e, err
+		}
+		n, err := sv.uploadToNode(ctx, rep.URL, rep.Ticket, meta.FileID, alloc.Version, meta.Checksum, meta.Filename, meta.ContentType, tmp)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", rep.NodeID, err))
+			continue
+		}
+		uploaded = append(uploaded, rep.NodeID)
+		stored = max(stored, n)
+	}
+	if len(uploaded) == 0 {
+		return e, fmt.Errorf("no peer node took the file: %s", strings.Join(failed, "; "))
+	}
+	var commit struct {
+		State FileState `json:"state"`
+	}
+	if _, err := p.call(ctx, sv.httpClient(30*time.Second), "/commit", CommitRequest{FileID: meta.FileID, Uploaded: uploaded, StoredSize: stored, Version: alloc.Version}, &commit); err != nil {
+		return e, err
+	}
+	if commit.State == StateAllocated {
+		return e, fmt.Errorf("write quorum not met on the peer (%d node(s) took it)", len(uploaded))
+	}
+	return e, nil
+}
+
+// call posts in to the peer's naming service with its token and decodes
+// the answer into out. It returns the status, with the peer's error
+// message as the error for anything but 2xx.
+func (p GeoPeer) call(ctx context.Context, client *http.Client, path string, in, out any) (int, error) {
+	b, _ := json.Marshal(in)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(p.NamingURL, "/")+path, bytes.NewReader(b))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+p.Token)
+	req.Header.Set(actorHeader, "geo-replication")
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		var e apierr.Error
+		raw, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(raw, &e) != nil || e.Message == "" {
+			e.Message = string(bytes.TrimSpace(raw))
+		}
+		return resp.StatusCode, fmt.Errorf("%s %s: %s", path, resp.Status, e.Message)
+	}
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+}
+
+// handleGeoPeers shows the peers, tokens masked.
+func (sv *Server) handleGeoPeers(w http.ResponseWriter, r *http.Request) {
+	sv.geo.mu.Lock()
+	defer sv.geo.mu.Unlock()
+	writeJSONResp(w, map[string]any{"peers": maskGeoPeers(sv.geo.peers)})
+}
+
+func maskGeoPeers(peers []GeoPeer) []GeoPeer {
+	out := slices.Clone(peers)
+	for i := range out {
+		out[i].Token = redactedSecret
+	}
+	return out
+}
+
+// SetGeoPeersRequest is the body of PUT /admin/geo-replication.
+type SetGeoPeersRequest struct {
+	Peers []GeoPeer `json:"peers"`
+}
+
+// handleSetGeoPeers replaces the peers. A masked token keeps the stored one
+// of the peer with the same ID. What a removed peer had is forgotten.
+func (sv *Server) handleSetGeoPeers(w http.ResponseWriter, r *http.Request) {
+	var body SetGeoPeersRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		apierr.WriteDetail(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json", err.Error())
+		return
+	}
+	if body.Peers == nil {
+		body.Peers = []GeoPeer{}
+	}
+	sv.geo.mu.Lock()
+	old := map[string]GeoPeer{}
+	for _, p := range sv.geo.peers {
+		old[p.ID] = p
+	}
+	ids := make([]string, 0, len(body.Peers))
+	for i := range body.Peers {
+		if body.Peers[i].Token == redactedSecret {
+			body.Peers[i].Token = old[body.Peers[i].ID].Token
+		}
+		ids = append(ids, body.Peers[i].ID)
+	}
+	if problems := validateGeoPeers(body.Peers); len(problems) > 0 {
+		sv.geo.mu.Unlock()
+		apierr.WriteDetail(w, http.StatusBadRequest, apierr.BadRequest, strings.Join(problems, "; "), problems)
+		return
+	}
+	if err := writeJSONFile(sv.geo.path, body.Peers); err != nil {
+		sv.geo.mu.Unlock()
+		apierr.WriteDetail(w, http.StatusInternalServerError, apierr.Internal, "cannot save geo-replication peers", err.Error())
+		return
+	}
+	sv.geo.peers = body.Peers
+	for id := range sv.geo.state {
+		if !slices.Contains(ids, id) {
+			delete(sv.geo.state, id)
+			delete(sv.geo.queues, id)
+		}
+	}
+	_ = writeJSONFile(sv.geo.statePath, sv.geo.state)
+	sv.geo.mu.Unlock()
+	if sv.geo.every > 0 {
+		sv.geoSweep()
+		select {
+		case sv.geo.wake <- struct{}{}:
+		default:
+		}
+	}
+	log.Printf("[ADMIN] geo-replication peers set: %s", strings.Join(ids, ", "))
+	sv.record(r, "geo-peers", "cluster", strings.Join(ids, ", "))
+	writeJSONResp(w, map[string]any{"peers": maskGeoPeers(body.Peers)})
+}
+
+// geoConflict is a file a peer refused.
+type geoConflict struct {
+	FileID string    `json:"fileId"`
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+// geoPeerStatus is one peer in /geo-replication.
+type geoPeerStatus struct {
+	ID         string        `json:"id"`
+	NamingURL  string        `json:"namingUrl"`
+	Disabled   bool          `json:"disabled,omitempty"`
+	Queued     int           `json:"queued"`
+	LagSeconds float64       `json:"lagSeconds"` // age of the oldest queued commit
+	Replicated int           `json:"replicated"` // files the peer has
+	Pushed     int64         `json:"pushed"`     // since start
+	LastPushAt *time.Time    `json:"lastPushAt,omitempty"`
+	LastError  string        `json:"lastError,omitempty"`
+	Conflicts  []geoConflict `json:"conflicts"`
+}
+
+// geoStatus reports every peer.
+func (sv *Server) geoStatus() []geoPeerStatus {
+	sv.geo.mu.Lock()
+	defer sv.geo.mu.Unlock()
+	t := now()
+	out := make([]geoPeerStatus, 0, len(sv.geo.peers))
+	for _, p := range sv.geo.peers {
+		q := sv.geo.queue(p.ID)
+		st := geoPeerStatus{ID: p.ID, NamingURL: p.NamingURL, Disabled: p.Disabled, Queued: len(q.due),
+			LagSeconds: q.lag(t).Seconds(), Pushed: q.pushed, LastError: q.lastError, Conflicts: []geoConflict{}}
+		if !q.lastPush.IsZero() {
+			at := q.lastPush
+			st.LastPushAt = &at
+		}
+		for id, e := range sv.geo.state[p.ID] {
+			if e.Conflict == "" {
+				st.Replicated++
+			} else {
+				st.Conflicts = append(st.Conflicts, geoConflict{FileID: id, Reason: e.Conflict, At: e.At})
+			}
+		}
+		slices.SortFunc(st.Conflicts, func(a, b geoConflict) int { return cmp.Compare(a.FileID, b.FileID) })
+		out = append(out, st)
+	}
+	return out
+}
+
+// handleGeoStatus reports each peer's queue, lag and conflicts.
+func (sv *Server) handleGeoStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSONResp(w, map[string]any{"clusterId": sv.store.clusterID, "enabled": sv.geo.every > 0, "peers": sv.geoStatus()})
+}
+
+/* ==================== CAPACITY FORECAST ==================== */
+
+// capacitySample is a node's, or the cluster's, usage at one time.
+type capacitySample struct {
+	At            time.Time `json:"at"`
+	UsedBytes     int64     `json:"usedBytes"`
+	CapacityBytes int64     `json:"capacityBytes"`
+}
+
+const (
+	capacityKeep       = 2880 // samples per series: 30 days at the default 15m
+	capacityTargetFill = 0.85 // the planned fill nodesToAdd keeps the cluster under
+)
+
+// capacityHistory samples every node's usage, and the cluster's, every
+// CapacitySampleInterval for /capacity-forecast, in capacity-history.json
+// so a restart keeps them.
+type capacityHistory struct {
+	mu      sync.Mutex
+	path    string
+	every   time.Duration               // 0 when sampling is off
+	Cluster []capacitySample            `json:"cluster"` // oldest first
+	Nodes   map[string][]capacitySample `json:"nodes"`
+}
+
+func openCapacityHistory(path string) (*capacityHistory, error) {
+	h := &capacityHistory{path: path, Cluster: []capacitySample{}, Nodes: map[string][]capacitySample{}}
+	if b, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(b, h); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return h, nil
+}
+
+func appendSample(list []capacitySample, s capacitySample) []capacitySample {
+	list = append(list, s)
+	if len(list) > capacityKeep {
+		list = list[len(list)-capacityKeep:]
+	}
+	return list
+}
+
+// startCapacitySampling takes a sample now and then every interval.
+func (sv *Server) startCapacitySampling(every time.Duration) {
+	go func() {
+		sv.sampleCapacity()
+		sv.every(every, sv.sampleCapacity)
+	}()
+	log.Printf("Capacity sampling started (every %s)", every)
+}
+
+// sampleCapacity records every node's usage and the cluster's. The history
+// of a node that has left the catalog is dropped.
+func (sv *Server) sampleCapacity() {
+	t := now()
+	current := map[string]capacitySample{}
+	var cluster capacitySample
+	sv.store.mu.RLock()
+	for id, n := range sv.store.nodes {
+		current[id] = capacitySample{At: t, UsedBytes: n.UsedBytes, CapacityBytes: n.CapacityBytes}
+		cluster.UsedBytes += n.UsedBytes
+		cluster.CapacityBytes += n.CapacityBytes
+	}
+	sv.store.mu.RUnlock()
+	cluster.At = t
+
+	h := sv.capacity
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id := range h.Nodes {
+		if _, ok := current[id]; !ok {
+			delete(h.Nodes, id)
+		}
+	}
+	for id, s := range current {
+		h.Nodes[id] = appendSample(h.Nodes[id], s)
+	}
+	h.Cluster = appendSample(h.Cluster, cluster)
+	if err := writeJSONFile(h.path, h); err != nil {
+		log.Printf("[CAPACITY] cannot save capacity history: %v", err)
+	}
+}
+
+// capacityForecast is the outlook for one node or the whole cluster.
+type capacityForecast struct {
+	NodeID            string     `json:"nodeId,omitempty"` // empty for the cluster
+	UsedBytes         int64      `json:"usedBytes"`
+	CapacityBytes     int64      `json:"capacityBytes"`
+	FreeBytes         int64      `json:"freeBytes"`
+	UsedPercent       float64    `json:"usedPercent"`
+	GrowthBytesPerDay *float64   `json:"growthBytesPerDay"` // nil with fewer than two samples in the window
+	DaysUntilFull     *float64   `json:"daysUntilFull"`     // nil when usage is not growing
+	FullAt            *time.Time `json:"fullAt,omitempty"`
+	Samples           int        `json:"samples"`
+
+	Series []capacitySample `json:"series,omitempty"` // the samples in the window, with ?series=true
+}
+
+// capacityPlan is how many nodes to add to stay under capacityTargetFill
+// for HorizonDays at the cluster's growth rate.
+type capacityPlan struct {
+	HorizonDays        int     `json:"horizonDays"`
+	TargetFill         float64 `json:"targetFill"`
+	ProjectedUsedBytes int64   `json:"projectedUsedBytes"`
+	NodeCapacityBytes  int64   `json:"nodeCapacityBytes"` // the mean of the current nodes
+	NodesToAdd         int     `json:"nodesToAdd"`
+}
+
+// forecast fits a least-squares line through samples and live, the
+// current reading, and projects when used reaches capacity.
+func forecast(samples []capacitySample, live capacitySample) capacityForecast {
+	f := capacityForecast{UsedBytes: live.UsedBytes, CapacityBytes: live.CapacityBytes, FreeBytes: max(live.CapacityBytes-live.UsedBytes, 0), Samples: len(samples)}
+	if live.CapacityBytes > 0 {
+		f.UsedPercent = math.Round(float64(live.UsedBytes)/float64(live.CapacityBytes)*1000) / 10
+	}
+	points := append(slices.Clone(samples), live)
+	if len(points) < 3 { // the live reading and at least two samples
+		return f
+	}
+	var mx, my float64
+	for _, p := range points {
+		mx += p.At.Sub(points[0].At).Hours() / 24
+		my += float64(p.UsedBytes)
+	}
+	mx /= float64(len(points))
+	my /= float64(len(points))
+	var sxy, sxx float64
+	for _, p := range points {
+		dx := p.At.Sub(points[0].At).Hours()/24 - mx
+		sxy += dx * (float64(p.UsedBytes) - my)
+		sxx += dx * dx
+	}
+	if sxx == 0 {
+		return f
+	}
+	growth := math.Round(sxy / sxx)
+	f.GrowthBytesPerDay = &growth
+	switch {
+	case f.FreeBytes == 0:
+		days := 0.0
+		f.DaysUntilFull = &days
+	case growth > 0:
+		days := math.Round(float64(f.FreeBytes)/growth*10) / 10
+		full := live.At.Add(time.Duration(days * float64(24*time.Hour))).Truncate(time.Second)
+		f.DaysUntilFull, f.FullAt = &days, &full
+	}
+	return f
+}
+
+// within returns the samples taken after since.
+func within(list []capacitySample, since time.Time) []capacitySample {
+	i, _ := slices.BinarySearchFunc(list, since, func(s capacitySample, t time.Time) int { return s.At.Compare(t) })
+	return slices.Clone(list[i:])
+}
+
+// handleCapacityForecast projects days until full per node and for the
+// cluster from the usage samples of the last ?window= (default 168h), and
+// plans the nodes to add for ?horizonDays= (default 90). ?series=true adds
+// the samples themselves.
+func (sv *Server) handleCapacityForecast(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	window := 7 * 24 * time.Hour
+	if v := q.Get("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			apierr.Write(w, http.StatusBadRequest, apierr.BadRequest, "window must be a positive duration, e.g. 168h")
+			return
+		}
+		window = d
+	}
+	horizon := 90
+	if v := q.Get("horizonDays"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			apierr.Write(w, http.StatusBadRequest, apierr.BadRequest, "horizonDays must be a positive number of days")
+			return
+		}
+		horizon = n
+	}
+	series := q.Get("series") == "true"
+
+	t := now()
+	live := map[string]capacitySample{}
+	cluster := capacitySample{At: t}
+	sv.store.mu.RLock()
+	for id, n := range sv.store.nodes {
+		live[id] = capacitySample{At: t, UsedBytes: n.UsedBytes, CapacityBytes: n.CapacityBytes}
+		cluster.UsedBytes += n.UsedBytes
+		cluster.CapacityBytes += n.CapacityBytes
+	}
+	sv.store.mu.RUnlock()
+
+	since := t.Add(-window)
+	h := sv.capacity
+	h.mu.Lock()
+	clusterSamples := within(h.Cluster, since)
+	nodeSamples := map[string][]capacitySample{}
+	for id := range live {
+		nodeSamples[id] = within(h.Nodes[id], since)
+	}
+	h.mu.Unlock()
+
+	out := forecast(clusterSamples, cluster)
+	nodes := make([]capacityForecast, 0, len(live))
+	for _, id := range slices.Sorted(maps.Keys(live)) {
+		f := forecast(nodeSamples[id], live[id])
+		f.NodeID = id
+		if series {
+			f.Series = nodeSamples[id]
+		}
+		nodes = append(nodes, f)
+	}
+	if series {
+		out.Series = clusterSamples
+	}
+
+	plan := capacityPlan{HorizonDays: horizon, TargetFill: capacityTargetFill, ProjectedUsedBytes: cluster.UsedBytes}
+	if len(live) > 0 {
+		plan.NodeCapacityBytes = cluster.CapacityBytes / int64(len(live))
+	}
+	if out.GrowthBytesPerDay != nil && *out.GrowthBytesPerDay > 0 {
+		plan.ProjectedUsedBytes += int64(*out.GrowthBytesPerDay * float64(horizon))
+	}
+	if short := float64(plan.ProjectedUsedBytes)/capacityTargetFill - float64(cluster.CapacityBytes); short > 0 && plan.NodeCapacityBytes > 0 {
+		plan.NodesToAdd = int(math.Ceil(short / float64(plan.NodeCapacityBytes)))
+	}
+
+	interval := ""
+	if h.every > 0 {
+		interval = h.every.String()
+	}
+	writeJSONResp(w, map[string]any{
+		"generatedAt": t,
+		"window":      window.String(),
+		"interval":    interval,
+		"cluster":     out,
+		"nodes":       nodes,
+		"plan":        plan,
+	})
+}
+
+/* ==================== ALERTS ==================== */
+
+// AlertMetric is a cluster figure alert rules can watch.
+type AlertMetric string
+
+const (
+	AlertDegradedFiles AlertMetric = "degradedFiles"
+	AlertCorruptFiles  AlertMetric = "corruptFiles"
+	AlertDownNodes     AlertMetric = "downNodes"
+	AlertSuspectNodes  AlertMetric = "suspectNodes"
+	AlertFlappingNodes AlertMetric = "flappingNodes"
+	AlertUsedPercent   AlertMetric = "usedPercent" // of the nodes' total capacity
+	AlertHealQueue     AlertMetric = "healQueue"   // files waiting to be healed
+)
+
+var alertMetrics = []AlertMetric{AlertDegradedFiles, AlertCorruptFiles, AlertDownNodes, AlertSuspectNodes, AlertFlappingNodes, AlertUsedPercent, AlertHealQueue}
+
+// AlertRule fires once Metric compared with Threshold by Op has held for
+// ForSeconds, and resolves as soon as it no longer holds.
+type AlertRule struct {
+	ID         string      `json:"id"`
+	Metric     AlertMetric `json:"metric"`
+	Op         string      `json:"op,omitempty"` // >, >=, <, <= or ==; empty means >
+	Threshold  float64     `json:"threshold"`
+	ForSeconds float64     `json:"forSeconds,omitempty"`
+	Severity   string      `json:"severity,omitempty"` // warning (the default) or critical
+	Disabled   bool        `json:"disabled,omitempty"`
+}
+
+func (r AlertRule) op() string { return cmp.Or(r.Op, ">") }
+
+func (r AlertRule) severity() string { return cmp.Or(r.Severity, "warning") }
+
+func (r AlertRule) hold() time.Duration { return time.Duration(r.ForSeconds * float64(time.Second)) }
+
+func (r AlertRule) holds(v float64) bool {
+	switch r.op() {
+	case ">":
+		return v > r.Threshold
+	case ">=":
+		return v >= r.Threshold
+	case "<":
+		return v < r.Threshold
+	case "<=":
+		return v <= r.Threshold
+	case "==":
+		return v == r.Threshold
+	}
+	return false
+}
+
+// defaultAlertRules are the rules of a cluster that has never set any.
+var defaultAlertRules = []AlertRule{
+	{ID: "degraded-files", Metric: AlertDegradedFiles, Threshold: 0, ForSeconds: 300},
+	{ID: "node-down", Metric: AlertDownNodes, Threshold: 0, Severity: "critical"},
+	{ID: "cluster-full", Metric: AlertUsedPercent, Threshold: 85},
+}
+
+// AlertChannelKind is how a channel delivers notifications.
+type AlertChannelKind string
+
+const (
+	// AlertWebhook POSTs each alertNotice as JSON to URL.
+	AlertWebhook AlertChannelKind = "webhook"
+	// AlertSlack posts a message to URL, a Slack incoming webhook.
+	AlertSlack AlertChannelKind = "slack"
+	// AlertEmail mails To through the SMTP server at SMTPAddr.
+	AlertEmail AlertChannelKind = "email"
+)
+
+// AlertChannel is one place notifications go. Each alert is sent when it
+// fires and when it resolves.
+type AlertChannel struct {
+	ID          string           `json:"id"`
+	Kind        AlertChannelKind `json:"kind"`
+	MinSeverity string           `json:"minSeverity,omitempty"` // critical skips warnings
+	Disabled    bool             `json:"disabled,omitempty"`
+
+	// webhook and slack; a Slack URL is a secret and masked like one
+	URL string `json:"url,omitempty"`
+
+	// email; Username and Password are for SMTP AUTH PLAIN, which the
+	// server must offer over TLS unless it is on localhost
+	SMTPAddr string   `json:"smtpAddr,omitempty"` // host:port
+	From     string   `json:"from,omitempty"`
+	To       []string `json:"to,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+}
+
+func (c AlertChannel) wants(severity string) bool {
+	return c.MinSeverity != "critical" || severity == "critical"
+}
+
+// public is c with its secrets masked.
+func (c AlertChannel) public() AlertChannel {
+	if c.Kind == AlertSlack && c.URL != "" {
+		c.URL = redactedSecret
+	}
+	if c.Password != "" {
+		c.Password = redactedSecret
+	}
+	return c
+}
+
+func validateAlerts(rules []AlertRule, channels []AlertChannel) []string {
+	var problems []string
+	seen := map[string]bool{}
+	for i, r := range rules {
+		name := fmt.Sprintf("rule %d", i+1)
+		if r.ID == "" {
+			problems = append(problems, name+": id is required")
+		} else if seen[r.ID] {
+			problems = append(problems, fmt.Sprintf("%s: duplicate id %q", name, r.ID))
+		}
+		seen[r.ID] = true
+		if !slices.Contains(alertMetrics, r.Metric) {
+			problems = append(problems, fmt.Sprintf("%s: metric must be one of %v", name, alertMetrics))
+		}
+		if !slices.Contains([]string{">", ">=", "<", "<=", "=="}, r.op()) {
+			problems = append(problems, name+": op must be >, >=, <, <= or ==")
+		}
+		if r.ForSeconds < 0 {
+			problems = append(problems, name+": forSeconds must not be negative")
+		}
+		if r.severity() != "warning" && r.severity() != "critical" {
+			problems = append(problems, name+": severity must be warning or critical")
+		}
+	}
+	seen = map[string]bool{}
+	for i, c := range channels {
+		name := fmt.Sprintf("channel %d", i+1)
+		if c.ID == "" {
+			problems = append(problems, name+": id is required")
+		} else if seen[c.ID] {
+			problems = append(problems, fmt.Sprintf("%s: duplicate id %q", name, c.ID))
+		}
+		seen[c.ID] = true
+		if c.MinSeverity != "" && c.MinSeverity != "warning" && c.MinSeverity != "critical" {
+			problems = append(problems, name+": minSeverity must be warning or critical")
+		}
+		switch c.Kind {
+		case AlertWebhook, AlertSlack:
+			if c.URL == redactedSecret {
+				problems = append(problems, name+": url is masked; send the URL itself")
+			} else if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				problems = append(problems, name+": url must be an http(s) URL")
+			}
+		case AlertEmail:
+			if _, _, err := net.SplitHostPort(c.SMTPAddr); err != nil {
+				problems = append(problems, name+": smtpAddr must be host:port")
+			}
+			if c.From == "" || len(c.To) == 0 {
+				problems = append(problems, name+": from and to are required for email")
+			}
+			if c.Password == redactedSecret {
+				problems = append(problems, name+": password is masked; send the secret itself")
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("%s: kind must be %q, %q or %q", name, AlertWebhook, AlertSlack, AlertEmail))
+		}
+	}
+	return problems
+}
+
+// AlertState is where a rule stands.
+type AlertState string
+
+const (
+	AlertOK      AlertState = "OK"
+	AlertPending AlertState = "PENDING" // holds, but not yet for ForSeconds
+	AlertFiring  AlertState = "FIRING"
+	// AlertResolved is only sent, in the notice of a rule that stopped
+	// firing.
+	AlertResolved AlertState = "RESOLVED"
+)
+
+// alertStatus is one rule in /alerts.
+type alertStatus struct {
+	AlertRule
+	State AlertState `json:"state"`
+	Value *float64   `json:"value,omitempty"` // nil until the first evaluation
+	Since time.Time  `json:"since,omitzero"`  // when State began
+}
+
+// alertNotice is what channels are sent; webhooks get it as JSON.
+type alertNotice struct {
+	Rule      string      `json:"rule"`
+	State     AlertState  `json:"state"` // FIRING or RESOLVED
+	Severity  string      `json:"severity"`
+	Metric    AlertMetric `json:"metric"`
+	Value     float64     `json:"value"`
+	Op        string      `json:"op"`
+	Threshold float64     `json:"threshold"`
+	Since     time.Time   `json:"since"` // when the condition began to hold, or when it fired
+	At        time.Time   `json:"at"`
+	Summary   string      `json:"summary"`
+}
+
+func newAlertNotice(r AlertRule, st AlertState, v float64, since time.Time, why string) alertNotice {
+	summary := fmt.Sprintf("[%s] %s: %s is %s (%s %s", st, r.ID, r.Metric, strconv.FormatFloat(v, 'f', -1, 64), r.op(), strconv.FormatFloat(r.Threshold, 'f', -1, 64))
+	if r.ForSeconds > 0 {
+		summary += " for " + r.hold().String()
+	}
+	summary += ")"
+	if why != "" {
+		summary += "; " + why
+	}
+	return alertNotice{Rule: r.ID, State: st, Severity: r.severity(), Metric: r.Metric, Value: v, Op: r.op(),
+		Threshold: r.Threshold, Since: since, At: now(), Summary: summary}
+}
+
+// alertDelivery is how sending to one channel has gone since startup.
+type alertDelivery struct {
+	Sent        int       `json:"sent"`
+	Failed      int       `json:"failed"`
+	LastSentAt  time.Time `json:"lastSentAt,omitzero"`
+	LastError   string    `json:"lastError,omitempty"`
+	LastErrorAt time.Time `json:"lastErrorAt,omitzero"`
+}
+
+// ruleState is a rule's standing between evaluations.
+type ruleState struct {
+	rule  AlertRule // as last evaluated; an edited rule starts over
+	state AlertState
+	value float64
+	since time.Time
+}
+
+// alerts holds the rules and channels, persisted in metadata/alerts.json,
+// and, in memory, where each rule stands and how delivery has gone.
+type alerts struct {
+	mu          sync.Mutex
+	path        string
+	every       time.Duration // 0 when evaluation is off
+	rules       []AlertRule
+	channels    []AlertChannel
+	state       map[string]*ruleState
+	evaluatedAt time.Time
+	delivery    map[string]*alertDelivery
+}
+
+// alertsFile is the layout of alerts.json.
+type alertsFile struct {
+	Rules    []AlertRule    `json:"rules"`
+	Channels []AlertChannel `json:"channels"`
+}
+
+func openAlerts(path string) (*alerts, error) {
+	a := &alerts{path: path, state: map[string]*ruleState{}, delivery: map[string]*alertDelivery{}}
+	f := alertsFile{Rules: slices.Clone(defaultAlertRules), Channels: []AlertChannel{}}
+	if b, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(b, &f); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if problems := validateAlerts(f.Rules, f.Channels); len(problems) > 0 {
+		return nil, fmt.Errorf("%s: %s", path, strings.Join(problems, "; "))
+	}
+	a.rules, a.channels = f.Rules, f.Channels
+	return a, nil
+}
+
+// alertFigures measures every AlertMetric.
+func (sv *Server) alertFigures() map[AlertMetric]float64 {
+	out := map[AlertMetric]float64{}
+	var capacity, used int64
+	sv.store.mu.RLock()
+	for _, meta := range sv.store.files {
+		switch meta.State {
+		case StateDegraded:
+			out[AlertDegradedFiles]++
+		case StateCorrupt:
+			out[AlertCorruptFiles]++
+		}
+	}
+	for _, n := range sv.store.nodes {
+		switch sv.healthOf(n) {
+		case NodeSuspect:
+			out[AlertSuspectNodes]++
+		case NodeDown:
+			out[AlertDownNodes]++
+		}
+		if n.Flapping {
+			out[AlertFlappingNodes]++
+		}
+		capacity += n.CapacityBytes
+		used += n.UsedBytes
+	}
+	sv.store.mu.RUnlock()
+	if capacity > 0 {
+		out[AlertUsedPercent] = math.Round(float64(used)/float64(capacity)*1000) / 10
+	}
+	pending, _ := sv.heal.snapshot()
+	out[AlertHealQueue] = float64(len(pending))
+	return out
+}
+
+// startAlerts evaluates the rules every interval.
+func (sv *Server) startAlerts(every time.Duration) {
+	go sv.every(every, sv.evaluateAlerts)
+	log.Printf("Alerting started (rules evaluated every %s)", every)
+}
+
+// evaluateAlerts moves every rule along OK -> PENDING -> FIRING and back,
+// and sends a notice for each alert that fires or resolves.
+func (sv *Server) evaluateAlerts() {
+	figures := sv.alertFigures()
+	t := now()
+	var notices []alertNotice
+	sv.alerts.mu.Lock()
+	ids := map[string]bool{}
+	for _, rule := range sv.alerts.rules {
+		ids[rule.ID] = true
+		st := sv.alerts.state[rule.ID]
+		if st != nil && st.rule != rule && st.state == AlertFiring {
+			notices = append(notices, newAlertNotice(st.rule, AlertResolved, st.value, st.since, "the rule was changed"))
+		}
+		if st == nil || st.rule != rule {
+			st = &ruleState{rule: rule, state: AlertOK, since: t}
+			sv.alerts.state[rule.ID] = st
+		}
+		st.value = figures[rule.Metric]
+		holds := !rule.Disabled && rule.holds(st.value)
+		switch {
+		case !holds && st.state == AlertFiring:
+			notices = append(notices, newAlertNotice(rule, AlertResolved, st.value, st.since, ""))
+			fallthrough
+		case !holds && st.state == AlertPending:
+			st.state, st.since = AlertOK, t
+		case holds && st.state == AlertOK:
+			st.state, st.since = AlertPending, t
+		}
+		if holds && st.state == AlertPending && t.Sub(st.since) >= rule.hold() {
+			notices = append(notices, newAlertNotice(rule, AlertFiring, st.value, st.since, ""))
+			st.state, st.since = AlertFiring, t
+		}
+	}
+	for id, st := range sv.alerts.state {
+		if !ids[id] {
+			if st.state == AlertFiring {
+				notices = append(notices, newAlertNotice(st.rule, AlertResolved, st.value, st.since, "the rule was removed"))
+			}
+			delete(sv.alerts.state, id)
+		}
+	}
+	sv.alerts.evaluatedAt = t
+	channels := slices.Clone(sv.alerts.channels)
+	sv.alerts.mu.Unlock()
+
+	for _, n := range notices {
+		log.Printf("[ALERT] %s", n.Summary)
+		for _, c := range channels {
+			if !c.Disabled && c.wants(n.Severity) {
+				go sv.sendAlert(c, n)
+			}
+		}
+	}
+}
+
+// sendAlert delivers n to c and records how that went.
+func (sv *Server) sendAlert(c AlertChannel, n alertNotice) error {
+	err := sv.deliverAlert(c, n)
+	sv.alerts.mu.Lock()
+	d := sv.alerts.delivery[c.ID]
+	if d == nil {
+		d = &alertDelivery{}
+		sv.alerts.delivery[c.ID] = d
+	}
+	if err != nil {
+		d.Failed++
+		d.LastError, d.LastErrorAt = err.Error(), now()
+	} else {
+		d.Sent++
+		d.LastSentAt = now()
+	}
+	sv.alerts.mu.Unlock()
+	if err != nil {
+		log.Printf("[ALERT] cannot send %s to %s: %v", n.Rule, c.ID, err)
+	}
+	return err
+}
+
+// alertTimeout bounds one webhook or Slack delivery.
+const alertTimeout = 10 * time.Second
+
+func (sv *Server) deliverAlert(c AlertChannel, n alertNotice) error {
+	switch c.Kind {
+	case AlertWebhook:
+		return sv.postAlert(c.URL, n)
+	case AlertSlack:
+		return sv.postAlert(c.URL, map[string]string{"text": n.Summary})
+	case AlertEmail:
+		host, _, _ := net.SplitHostPort(c.SMTPAddr)
+		var auth smtp.Auth
+		if c.Username != "" {
+			auth = smtp.PlainAuth("", c.Username, c.Password, host)
+		}
+		msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: [%s] %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n\r\nSeverity: %s\r\nSince: %s\r\n",
+			c.From, strings.Join(c.To, ", "), n.State, n.Rule, n.At.Format(time.RFC1123Z), n.Summary, n.Severity, n.Since.Format(time.RFC3339))
+		return smtp.SendMail(c.SMTPAddr, auth, c.From, c.To, []byte(msg))
+	}
+	return fmt.Errorf("unknown channel kind %q", c.Kind)
+}
+
+func (sv *Server) postAlert(target string, body any) error {
+	payload, _ := json.Marshal(body)
+	ctx, cancel := context.WithTimeout(context.Background(), alertTimeout)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := sv.httpClient(0).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// handleAlerts shows every rule and where it stands: GET /alerts, or
+// ?state=FIRING for the ones firing.
+func (sv *Server) handleAlerts(w http.ResponseWriter, r *http.Request) {
+	want := AlertState(strings.ToUpper(r.URL.Query().Get("state")))
+	sv.alerts.mu.Lock()
+	defer sv.alerts.mu.Unlock()
+	out := []alertStatus{}
+	firing := 0
+	for _, rule := range sv.alerts.rules {
+		s := alertStatus{AlertRule: rule, State: AlertOK}
+		if st := sv.alerts.state[rule.ID]; st != nil && st.rule == rule {
+			v := st.value
+			s.State, s.Value, s.Since = st.state, &v, st.since
+		}
+		if s.State == AlertFiring {
+			firing++
+		}
+		if want == "" || s.State == want {
+			out = append(out, s)
+		}
+	}
+	every := ""
+	if sv.alerts.every > 0 {
+		every = sv.alerts.every.String()
+	}
+	writeJSONResp(w, map[string]any{"alerts": out, "firing": firing, "evaluatedAt": sv.alerts.evaluatedAt, "interval": every})
+}
+
+// handleAlertConfig shows the rules and the channels, secrets masked, with
+// how delivery to each channel has gone.
+func (sv *Server) handleAlertConfig(w http.ResponseWriter, r *http.Request) {
+	sv.alerts.mu.Lock()
+	defer sv.alerts.mu.Unlock()
+	channels := make([]AlertChannel, 0, len(sv.alerts.channels))
+	for _, c := range sv.alerts.channels {
+		channels = append(channels, c.public())
+	}
+	delivery := map[string]alertDelivery{}
+	for id, d := range sv.alerts.delivery {
+		delivery[id] = *d
+	}
+	writeJSONResp(w, map[string]any{"rules": sv.alerts.rules, "channels": channels, "delivery": delivery})
+}
+
+// SetAlertsRequest is the body of PUT /admin/alerts.
+type SetAlertsRequest struct {
+	Rules    []AlertRule    `json:"rules"`
+	Channels []AlertChannel `json:"channels"`
+}
+
+// handleSetAlerts replaces the rules and channels. A masked secret keeps
+// the stored one of the channel with the same ID. Edited rules start over
+// from OK at the next evaluation.
+func (sv *Server) handleSetAlerts(w http.ResponseWriter, r *http.Request) {
+	var body SetAlertsRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		apierr.WriteDetail(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json", err.Error())
+		return
+	}
+	if body.Rules == nil {
+		body.Rules = []AlertRule{}
+	}
+	if body.Channels == nil {
+		body.Channels = []AlertChannel{}
+	}
+	sv.alerts.mu.Lock()
+	old := map[string]AlertChannel{}
+	for _, c := range sv.alerts.channels {
+		old[c.ID] = c
+	}
+	for i := range body.Channels {
+		c := &body.Channels[i]
+		if c.URL == redactedSecret && old[c.ID].Kind == c.Kind {
+			c.URL = old[c.ID].URL
+		}
+		if c.Password == redactedSecret {
+			c.Password = old[c.ID].Password
+		}
+	}
+	if problems := validateAlerts(body.Rules, body.Channels); len(problems) > 0 {
+		sv.alerts.mu.Unlock()
+		apierr.WriteDetail(w, http.StatusBadRequest, apierr.BadRequest, strings.Join(problems, "; "), problems)
+		return
+	}
+	if err := writeJSONFile(sv.alerts.path, alertsFile{Rules: body.Rules, Channels: body.Channels}); err != nil {
+		sv.alerts.mu.Unlock()
+		apierr.WriteDetail(w, http.StatusInternalServerError, apierr.Internal, "cannot save alert rules", err.Error())
+		return
+	}
+	sv.alerts.rules, sv.alerts.channels = body.Rules, body.Channels
+	ids := make([]string, 0, len(body.Channels))
+	for _, c := range body.Channels {
+		ids = append(ids, c.ID)
+	}
+	for id := range sv.alerts.delivery {
+		if !slices.Contains(ids, id) {
+			delete(sv.alerts.delivery, id)
+		}
+	}
+	every := sv.alerts.every
+	sv.alerts.mu.Unlock()
+	if every > 0 {
+		go sv.evaluateAlerts()
+	}
+
+	summary := fmt.Sprintf("%d rule(s), %d channel(s)", len(body.Rules), len(body.Channels))
+	log.Printf("[ADMIN] alerts set: %s", summary)
+	sv.record(r, "alert-rules", "cluster", summary)
+	channels := make([]AlertChannel, 0, len(body.Channels))
+	for _, c := range body.Channels {
+		channels = append(channels, c.public())
+	}
+	writeJSONResp(w, map[string]any{"rules": body.Rules, "channels": channels})
+}
+
+// handleTestAlert sends a test notice to every enabled channel, or to
+// ?channel=<id> whether enabled or not, and waits for the outcome.
+func (sv *Server) handleTestAlert(w http.ResponseWriter, r *http.Request) {
+	want := r.URL.Query().Get("channel")
+	sv.alerts.mu.Lock()
+	var channels []AlertChannel
+	for _, c := range sv.alerts.channels {
+		if c.ID == want || (want == "" && !c.Disabled) {
+			channels = append(channels, c)
+		}
+	}
+	sv.alerts.mu.Unlock()
+	if want != "" && len(channels) == 0 {
+		apierr.Write(w, http.StatusNotFound, apierr.NotFound, "no alert channel "+want)
+		return
+	}
+	n := alertNotice{Rule: "test", State: AlertFiring, Severity: "warning", Since: now(), At: now(),
+		Summary: "[FIRING] test: a test notification from the naming service"}
+	results := make(map[string]string, len(channels))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range channels {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := "sent"
+			if err := sv.sendAlert(c, n); err != nil {
+				res = err.Error()
+			}
+			mu.Lock()
+			results[c.ID] = res
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	writeJSONResp(w, map[string]any{"results": results})
+}
+
+/* ==================== QUOTAS ==================== */
+
+// quotaDefault names the limits that apply to owners without their own.
+const quotaDefault = "*"
+
+// quotaLimit caps one owner's committed files; 0 means unlimited.
+type quotaLimit struct {
+	MaxBytes int64 `json:"maxBytes"`
+	MaxFiles int64 `json:"maxFiles"`
+}
+
+type quotaUsage struct {
+	Bytes int64 `json:"bytes"`
+	Files int64 `json:"files"`
+}
+
+// quotaBook holds per-owner limits, persisted in metadata/quotas.json, and
+// usage. A file is charged its logical size when a commit makes it readable
+// and released when it is deleted; usage is rebuilt from the catalog at
+// startup and on reload. Guarded by the store lock.
+type quotaBook struct {
+	path    string
+	limits  map[string]quotaLimit
+	used    map[string]*quotaUsage
+	charged map[string]int64 // fileId -> bytes charged to its owner
+}
+
+func openQuotaBook(path string, files map[string]*FileMetadata) (*quotaBook, error) {
+	q := &quotaBook{path: path, limits: map[string]quotaLimit{}}
+	if b, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(b, &q.limits); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	q.rebuild(files)
+	return q, nil
+}
+
+func (q *quotaBook) rebuild(files map[string]*FileMetadata) {
+	q.used = map[string]*quotaUsage{}
+	q.charged = map[string]int64{}
+	for _, meta := range files {
+		if meta.State != StateAllocated && meta.State != StateDeleted {
+			q.charge(meta)
+		}
+	}
+}
+
+func (q *quotaBook) usage(owner string) *quotaUsage {
+	u := q.used[owner]
+	if u == nil {
+		u = &quotaUsage{}
+		q.used[owner] = u
+	}
+	return u
+}
+
+// limitOf returns owner's limits and whether they are the default ones.
+func (q *quotaBook) limitOf(owner string) (quotaLimit, bool) {
+	if l, ok := q.limits[owner]; ok {
+		return l, false
+	}
+	return q.limits[quotaDefault], true
+}
+
+// charge brings meta's owner up to date with the committed size of meta.
+func (q *quotaBook) charge(meta *FileMetadata) {
+	u := q.usage(meta.Owner)
+	if old, ok := q.charged[meta.FileID]; ok {
+		u.Bytes += meta.Size - old
+	} else {
+		u.Bytes += meta.Size
+		u.Files++
+	}
+	q.charged[meta.FileID] = meta.Size
+}
+
+func (q *quotaBook) release(meta *FileMetadata) {
+	old, ok := q.charged[meta.FileID]
+	if !ok {
+		return
+	}
+	u := q.usage(meta.Owner)
+	u.Bytes -= old
+	u.Files--
+	delete(q.charged, meta.FileID)
+}
+
+// quotaExceeded is the detail of a 403 QUOTA_EXCEEDED for an allocation
+// over quota.
+type quotaExceeded struct {
+	Owner     string `json:"owner"`
+	Resource  string `json:"resource"` // "bytes" or "files"
+	Limit     int64  `json:"limit"`
+	Used      int64  `json:"used"`
+	Requested int64  `json:"requested"`
+}
+
+// check returns why writing size bytes as fileID (empty for a new file)
+// would take owner over quota, or nil.
+func (q *quotaBook) check(owner, fileID string, size int64) *quotaExceeded {
+	l, _ := q.limitOf(owner)
+	var u quotaUsage
+	if cur := q.used[owner]; cur != nil {
+		u = *cur
+	}
+	extra, files := size, int64(1)
+	if old, ok := q.charged[fileID]; ok {
+		extra, files = size-old, 0
+	}
+	switch {
+	case l.MaxFiles > 0 && files > 0 && u.Files+files > l.MaxFiles:
+		return &quotaExceeded{Owner: owner, Resource: "files", Limit: l.MaxFiles, Used: u.Files, Requested: files}
+	case l.MaxBytes > 0 && extra > 0 && u.Bytes+extra > l.MaxBytes:
+		return &quotaExceeded{Owner: owner, Resource: "bytes", Limit: l.MaxBytes, Used: u.Bytes, Requested: extra}
+	}
+	return nil
+}
+
+func writeQuotaExceeded(w http.ResponseWriter, qe *quotaExceeded) {
+	apierr.WriteDetail(w, http.StatusForbidden, apierr.QuotaExceeded, fmt.Sprintf("quota exceeded: %s for %q", qe.Resource, qe.Owner), qe)
+}
+
+// quotaStatus is one owner's limits next to its usage.
+type quotaStatus struct {
+	Owner     string `json:"owner"`
+	MaxBytes  int64  `json:"maxBytes"`
+	MaxFiles  int64  `json:"maxFiles"`
+	UsedBytes int64  `json:"usedBytes"`
+	UsedFiles int64  `json:"usedFiles"`
+	// Default is set when the owner has no quota of its own and the "*"
+	// limits apply.
+	Default bool `json:"default,omitempty"`
+}
+
+func (q *quotaBook) status(owner string) quotaStatus {
+	l, def := q.limitOf(owner)
+	st := quotaStatus{Owner: owner, MaxBytes: l.MaxBytes, MaxFiles: l.MaxFiles, Default: def}
+	if u := q.used[owner]; u != nil {
+		st.UsedBytes, st.UsedFiles = u.Bytes, u.Files
+	}
+	return st
+}
+
+// handleQuota shows ?owner='s quota and usage, or without owner every owner
+// that has a quota or stores files.
+func (sv *Server) handleQuota(w http.ResponseWriter, r *http.Request) {
+	sv.store.mu.RLock()
+	defer sv.store.mu.RUnlock()
+	q := sv.store.quotas
+	if r.URL.Query().Has("owner") {
+		writeJSONResp(w, q.status(r.URL.Query().Get("owner")))
+		return
+	}
+	owners := map[string]bool{}
+	for o := range q.limits {
+		owners[o] = true
+	}
+	for o, u := range q.used {
+		if u.Files > 0 {
+			owners[o] = true
+		}
+	}
+	out := make([]quotaStatus, 0, len(owners))
+	for o := range owners {
+		out = append(out, q.status(o))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Owner < out[j].Owner })
+	writeJSONResp(w, map[string]any{"quotas": out})
+}
+
+// SetQuotaRequest is the body of PUT /admin/quota.
+type SetQuotaRequest struct {
+	Owner string `json:"owner"`
+	quotaLimit
+}
+
+// handleSetQuota sets an owner's limits; both limits 0 removes the quota.
+func (sv *Server) handleSetQuota(w http.ResponseWriter, r *http.Request) {
+	var body SetQuotaRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.MaxBytes < 0 || body.MaxFiles < 0 {
+		apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json: need owner and non-negative maxBytes/maxFiles")
+		return
+	}
+	sv.store.mu.Lock()
+	q := sv.store.quotas
+	limits := make(map[string]quotaLimit, len(q.limits)+1)
+	for o, l := range q.limits {
+		limits[o] = l
+	}
+	if body.quotaLimit == (quotaLimit{}) {
+		delete(limits, body.Owner)
+	} else {
+		limits[body.Owner] = body.quotaLimit
+	}
+	err := writeJSONFile(q.path, limits)
+	if err == nil {
+		q.limits = limits
+	}
+	st := q.status(body.Owner)
+	sv.store.mu.Unlock()
+	if err != nil {
+		apierr.WriteDetail(w, http.StatusInternalServerError, apierr.Internal, "cannot save quotas", err.Error())
+		return
+	}
+	detail := fmt.Sprintf("maxBytes=%d maxFiles=%d", body.MaxBytes, body.MaxFiles)
+	log.Printf("[ADMIN] quota for %q set: %s", body.Owner, detail)
+	sv.record(r, "quota", body.Owner, detail)
+	writeJSONResp(w, st)
+}
+
+/* ==================== PERMISSIONS ==================== */
+
+// validSubject accepts "*", "user:<name>" and "group:<name>".
+func validSubject(s string) bool {
+	if s == "*" {
+		return true
+	}
+	kind, name, ok := strings.Cut(s, ":")
+	return ok && name != "" && (kind == "user" || kind == "group")
+}
+
+// validateACL returns what is wrong with acl, or nil.
+func validateACL(acl []ACLEntry) []string {
+	var problems []string
+	seen := map[string]bool{}
+	for i, e := range acl {
+		if !validSubject(e.Subject) {
+			problems = append(problems, fmt.Sprintf("entry %d: subject %q must be *, user:<name> or group:<name>", i, e.Subject))
+		} else if seen[e.Subject] {
+			problems = append(problems, fmt.Sprintf("entry %d: subject %q is listed twice", i, e.Subject))
+		}
+		seen[e.Subject] = true
+		if len(e.Permissions) == 0 {
+			problems = append(problems, fmt.Sprintf("entry %d: no permissions", i))
+		}
+		for _, p := range e.Permissions {
+			if p != PermRead && p != PermWrite && p != PermDelete {
+				problems = append(problems, fmt.Sprintf("entry %d: permission %q must be read, write or delete", i, p))
+			}
+		}
+	}
+	return problems
+}
+
+// filePermissions is a file's owner and ACL.
+type filePermissions struct {
+	FileID string     `json:"fileId"`
+	Owner  string     `json:"owner"`
+	ACL    []ACLEntry `json:"acl"`
+}
+
+// PermissionsRequest is the body of PUT /permissions/{fileId}.
+type PermissionsRequest struct {
+	Owner *string    `json:"owner"`
+	ACL   []ACLEntry `json:"acl"`
+}
+
+// handlePermissions shows (GET) or replaces (PUT) /permissions/{fileId}.
+// A PUT replaces the whole ACL, and changes the owner when "owner" is
+// given; the file's quota charge moves with it. The gateway decides who
+// may call it.
+func (sv *Server) handlePermissions(w http.ResponseWriter, r *http.Request) {
+	fileID := r.PathValue("fileId")
+	var body PermissionsRequest
+	if r.Method == http.MethodPut {
+		if sv.maintenance.Load() {
+			apierr.Write(w, http.StatusServiceUnavailable, apierr.Maintenance, "naming service is in maintenance mode (read-only)")
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json")
+			return
+		}
+		if problems := validateACL(body.ACL); len(problems) > 0 {
+			apierr.WriteDetail(w, http.StatusBadRequest, apierr.BadRequest, strings.Join(problems, "; "), problems)
+			return
+		}
+	}
+
+	sv.store.mu.Lock()
+	meta, ok := sv.store.files[fileID]
+	if !ok || meta.State == StateDeleted {
+		sv.store.mu.Unlock()
+		apierr.Write(w, http.StatusNotFound, apierr.FileNotFound, "file not found")
+		return
+	}
+	if r.Method == http.MethodPut {
+		if body.Owner != nil && *body.Owner != meta.Owner {
+			_, charged := sv.store.quotas.charged[fileID]
+			sv.store.quotas.release(meta)
+			meta.Owner = *body.Owner
+			if charged {
+				sv.store.quotas.charge(meta)
+			}
+		}
+		meta.ACL = body.ACL
+		sv.store.touch(fileID)
+		sv.store.persist()
+	}
+	out := filePermissions{FileID: fileID, Owner: meta.Owner, ACL: append([]ACLEntry{}, meta.ACL...)}
+	sv.store.mu.Unlock()
+	if r.Method == http.MethodPut {
+		detail := fmt.Sprintf("owner=%q entries=%d", out.Owner, len(out.ACL))
+		log.Printf("[PERMISSIONS] %s: %s", fileID, detail)
+		sv.record(r, "permissions", fileID, detail)
+	}
+	writeJSONResp(w, out)
+}
+
+// RenameFileRequest is the body of POST /rename-file.
+type RenameFileRequest struct {
+	FileID   string `json:"fileId"`
+	Filename string `json:"filename"`
+}
+
+// handleRenameFile changes {fileId}'s filename to {filename}. Only the
+// catalog changes; blobs are stored by fileId.
+func (sv *Server) handleRenameFile(w http.ResponseWriter, r *http.Request) {
+	var body RenameFileRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.FileID == "" || strings.TrimSpace(body.Filename) == "" {
+		apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json: need fileId and filename")
+		return
+	}
+	sv.store.mu.Lock()
+	meta, ok := sv.store.files[body.FileID]
+	if !ok || meta.State == StateDeleted {
+		sv.store.mu.Unlock()
+		apierr.Write(w, http.StatusNotFound, apierr.FileNotFound, "file not found")
+		return
+	}
+	old := meta.Filename
+	if body.Filename != old {
+		sv.store.mark(sv.store.conflicts.members(meta.ConflictID)...)
+		sv.store.conflicts.dropFile(meta, sv.store.files)
+	}
+	meta.Filename = body.Filename
+	sv.store.touch(meta.FileID)
+	sv.store.mu.Unlock()
+	sv.store.persist()
+	detail := fmt.Sprintf("%q -> %q", old, body.Filename)
+	log.Printf("[RENAME] %s: %s", body.FileID, detail)
+	sv.record(r, "rename-file", body.FileID, detail)
+	writeJSONResp(w, map[string]any{"fileId": body.FileID, "filename": body.Filename, "previous": old})
+}
+
+/* ==================== COPY & MOVE ==================== */
+
+// CopyFileRequest is the body of POST /files/{fileId}/copy. Filename
+// defaults to the source's name with the first free " (n)" suffix, and
+// Owner to the source's owner.
+type CopyFileRequest struct {
+	Filename string  `json:"filename,omitempty"`
+	Owner    *string `json:"owner,omitempty"`
+}
+
+// handleCopyFile makes a new file with the same content as {fileId}
+// without moving the bytes through anyone: every node holding a current
+// READY replica clones it under the new fileId (a hard link where it can),
+// and the healer tops up a copy that landed on fewer nodes than the
+// replication factor. The copy starts with no ACL and no derived files.
+func (sv *Server) handleCopyFile(w http.ResponseWriter, r *http.Request) {
+	var body CopyFileRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json")
+		return
+	}
+
+	sv.store.mu.RLock()
+	src, ok := sv.store.files[r.PathValue("fileId")]
+	if !ok || src.State == StateDeleted {
+		sv.store.mu.RUnlock()
+		apierr.Write(w, http.StatusNotFound, apierr.FileNotFound, "file not found")
+		return
+	}
+	if src.State != StateAvailable && src.State != StatePartial && src.State != StateDegraded {
+		sv.store.mu.RUnlock()
+		apierr.Write(w, http.StatusConflict, apierr.FileNotReady, fmt.Sprintf("file is %s", src.State))
+		return
+	}
+	owner := src.Owner
+	if body.Owner != nil {
+		owner = *body.Owner
+	}
+	filename := body.Filename
+	if filename == "" {
+		filename = sv.store.freeName(owner, src.Filename)
+	}
+	qe := sv.store.quotas.check(owner, "", src.Size)
+	var sources []ReplicaInfo
+	for _, rep := range src.Replicas {
+		if rep.Status == ReplicaReady && rep.Version == src.Version {
+			sources = append(sources, rep)
+		}
+	}
+	copyID := sv.shard.mint(func() string { return uuidLike(filename) })
+	meta := &FileMetadata{
+		FileID:      copyID,
+		Filename:    filename,
+		Size:        src.Size,
+		StoredSize:  src.StoredSize,
+		Checksum:    src.Checksum,
+		ContentType: src.ContentType,
+		Version:     1,
+		State:       StateAllocated,
+		CreatedAt:   now(),
+		UpdatedAt:   now(),
+		Owner:       owner,
+		Placement:   src.Placement,
+
+		StorageClass:        src.StorageClass,
+		DetectedContentType: src.DetectedContentType,
+	}
+	sv.store.mu.RUnlock()
+	if qe != nil {
+		writeQuotaExceeded(w, qe)
+		return
+	}
+	if len(sources) == 0 {
+		apierr.Write(w, http.StatusConflict, apierr.FileNotReady, "no READY replica to copy from")
+		return
+	}
+
+	methods := map[string]string{}
+	failed := []string{}
+	for _, rep := range sources {
+		method, err := sv.cloneReplica(r.Context(), rep.URL, src.FileID, copyID, meta.Checksum, meta.Version)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", rep.NodeID, err))
+			continue
+		}
+		methods[rep.NodeID] = method
+		meta.Replicas = append(meta.Replicas, ReplicaInfo{
+			NodeID: rep.NodeID, URL: rep.URL, Status: ReplicaReady, LastVerifiedAt: now(), Version: meta.Version,
+		})
+	}
+	if len(meta.Replicas) == 0 {
+		apierr.WriteDetail(w, http.StatusBadGateway, apierr.UpstreamError, "no node could copy the file", failed)
+		return
+	}
+
+	sv.store.mu.Lock()
+	meta.State = StateAvailable
+	if len(meta.Replicas) < sv.factorOf(meta) {
+		meta.State = StatePartial
+	}
+	meta.CommittedVersion = meta.Version
+	sv.store.files[copyID] = meta
+	sv.store.quotas.charge(meta)
+	sv.store.touch(copyID)
+	sv.store.mu.Unlock()
+	sv.store.persist()
+	if meta.State == StatePartial {
+		// don't wait for the sweep: the missing replicas are fetched node
+		// to node from the clones just made
+		sv.heal.add(copyID, filename, len(meta.Replicas), false)
+	}
+
+	detail := fmt.Sprintf("%s -> %s %q", src.FileID, copyID, filename)
+	log.Printf("[COPY] %s on %d node(s)", detail, len(methods))
+	sv.record(r, "copy-file", copyID, detail)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"fileId": copyID, "sourceFileId": src.FileID, "filename": filename, "owner": owner,
+		"state": meta.State, "methods": methods, "failed": failed,
+	})
+}
+
+// cloneReplica asks the node at nodeURL to store its blob of from under
+// to as well, and returns how it did so: "hardlink" or "copy". The node
+// refuses if its blob no longer has checksum, e.g. after an overwrite.
+func (sv *Server) cloneReplica(ctx context.Context, nodeURL, from, to, checksum string, version int) (string, error) {
+	b, _ := json.Marshal(map[string]any{"fromFileId": from, "toFileId": to, "checksum": checksum, "version": version})
+	resp, err := sv.nodeCalls.postJSON(ctx, sv.httpClient(5*time.Minute), strings.TrimRight(nodeURL, "/")+"/copy", b)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var out struct {
+		Method string `json:"method"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	return out.Method, nil
+}
+
+// MoveFileRequest is the body of POST /files/{fileId}/move. Directory
+// moves the file into another folder under the same base name, "" being
+// the top level; Filename gives the whole new name instead. Owner hands
+// the file, with its derived files and quota charge, to another owner.
+type MoveFileRequest struct {
+	Directory *string `json:"directory,omitempty"`
+	Filename  string  `json:"filename,omitempty"`
+	Owner     *string `json:"owner,omitempty"`
+}
+
+// handleMoveFile renames {fileId} into another folder and/or gives it to
+// another owner. Like a rename, only the catalog changes; blobs are stored
+// by fileId.
+func (sv *Server) handleMoveFile(w http.ResponseWriter, r *http.Request) {
+	var body MoveFileRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json")
+		return
+	}
+	if body.Directory == nil && body.Filename == "" && body.Owner == nil {
+		apierr.Write(w, http.StatusBadRequest, apierr.BadRequest, "need directory, filename or owner")
+		return
+	}
+
+	sv.store.mu.Lock()
+	meta, ok := sv.store.files[r.PathValue("fileId")]
+	if !ok || meta.State == StateDeleted {
+		sv.store.mu.Unlock()
+		apierr.Write(w, http.StatusNotFound, apierr.FileNotFound, "file not found")
+		return
+	}
+	if meta.ParentID != "" {
+		sv.store.mu.Unlock()
+		apierr.Write(w, http.StatusBadRequest, apierr.BadRequest, "a derived file moves with its parent")
+		return
+	}
+	filename := meta.Filename
+	switch {
+	case body.Filename != "":
+		filename = body.Filename
+	case body.Directory != nil:
+		filename = path.Base(meta.Filename)
+		if dir := strings.Trim(*body.Directory, "/"); dir != "" {
+			filename = dir + "/" + filename
+		}
+	}
+	owner := meta.Owner
+	if body.Owner != nil {
+		owner = *body.Owner
+	}
+	group := []*FileMetadata{meta}
+	for _, id := range meta.Derived {
+		if d, ok := sv.store.files[id]; ok {
+			group = append(group, d)
+		}
+	}
+	if owner != meta.Owner {
+		var size int64
+		for _, f := range group {
+			size += f.Size
+		}
+		if qe := sv.store.quotas.check(owner, "", size); qe != nil {
+			sv.store.mu.Unlock()
+			writeQuotaExceeded(w, qe)
+			return
+		}
+	}
+	prev := map[string]string{"filename": meta.Filename, "owner": meta.Owner}
+	if filename != meta.Filename || owner != meta.Owner {
+		sv.store.mark(sv.store.conflicts.members(meta.ConflictID)...)
+		sv.store.conflicts.dropFile(meta, sv.store.files)
+	}
+	meta.Filename = filename
+	for _, f := range group {
+		if f.Owner == owner {
+			continue
+		}
+		_, charged := sv.store.quotas.charged[f.FileID]
+		sv.store.quotas.release(f)
+		f.Owner = owner
+		if charged {
+			sv.store.quotas.charge(f)
+		}
+		sv.store.mark(f.FileID)
+	}
+	meta.UpdatedAt = now()
+	sv.store.touch(meta.FileID)
+	sv.store.mu.Unlock()
+	sv.store.persist()
+
+	detail := fmt.Sprintf("%q (%q) -> %q (%q)", prev["filename"], prev["owner"], filename, owner)
+	log.Printf("[MOVE] %s: %s", meta.FileID, detail)
+	sv.record(r, "move-file", meta.FileID, detail)
+	writeJSONResp(w, map[string]any{"fileId": meta.FileID, "filename": filename, "owner": owner, "previous": prev})
+}
+
+/* ==================== CONFLICTS ==================== */
+
+// Conflict is two or more files of one owner with the same filename but
+// different content: uploads that did not know about each other, since a
+// client that did would have overwritten the file by fileId. Every file is
+// kept until the conflict is resolved with a ResolveConflictRequest.
+type Conflict struct {
+	ID        string    `json:"conflictId"`
+	Owner     string    `json:"owner,omitempty"`
+	Filename  string    `json:"filename"`
+	FileIDs   []string  `json:"fileIds"` // in upload order
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ConflictFile is one file of a conflict as the API shows it, enough to
+// choose between them.
+type ConflictFile struct {
+	FileID    string    `json:"fileId"`
+	Size      int64     `json:"size"`
+	Checksum  string    `json:"checksum"`
+	State     FileState `json:"state"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ConflictStatus is a conflict with its files.
+type ConflictStatus struct {
+	Conflict
+	Files []ConflictFile `json:"files"`
+}
+
+// conflictBook holds the open conflicts, persisted in
+// metadata/conflicts.json. Guarded by the store lock, like the files'
+// ConflictID it is kept in step with.
+type conflictBook struct {
+	path      string
+	conflicts map[string]*Conflict // conflictId -> conflict
+	shard     Shard                // conflict IDs are minted in it
+}
+
+func openConflictBook(path string) (*conflictBook, error) {
+	cb := &conflictBook{path: path, conflicts: map[string]*Conflict{}}
+	if b, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(b, &cb.conflicts); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return cb, nil
+}
+
+func (cb *conflictBook) save() {
+	if err := writeJSONFile(cb.path, cb.conflicts); err != nil {
+		log.Printf("[CONFLICT] cannot save conflicts: %v", err)
+	}
+}
+
+// note puts meta, a new upload, in a conflict with the files of its owner
+// that have its name but not its checksum, joining theirs if they already
+// are in one, and returns the conflict's ID; "" means there are none.
+func (cb *conflictBook) note(meta *FileMetadata, files map[string]*FileMetadata) string {
+	var rivals []*FileMetadata
+	for _, f := range files {
+		if f.FileID != meta.FileID && f.ParentID == "" && f.State != StateDeleted &&
+			f.Owner == meta.Owner && f.Filename == meta.Filename && f.Checksum != meta.Checksum {
+			rivals = append(rivals, f)
+		}
+	}
+	if len(rivals) == 0 {
+		return ""
+	}
+	sort.Slice(rivals, func(i, j int) bool { return rivals[i].CreatedAt.Before(rivals[j].CreatedAt) })
+	var c *Conflict
+	for _, f := range rivals {
+		if c = cb.conflicts[f.ConflictID]; c != nil {
+			break
+		}
+	}
+	if c == nil {
+		c = &Conflict{ID: cb.shard.mint(func() string { return uuidLike("conflict-" + meta.Filename) }), Owner: meta.Owner, Filename: meta.Filename, CreatedAt: now()}
+		cb.conflicts[c.ID] = c
+	}
+	for _, f := range append(rivals, meta) {
+		if !slices.Contains(c.FileIDs, f.FileID) {
+			c.FileIDs = append(c.FileIDs, f.FileID)
+		}
+		f.ConflictID = c.ID
+	}
+	cb.save()
+	return c.ID
+}
+
+// dropFile takes meta out of its conflict because it was deleted or
+// renamed. A conflict down to one file is over.
+func (cb *conflictBook) dropFile(meta *FileMetadata, files map[string]*FileMetadata) {
+	c := cb.conflicts[meta.ConflictID]
+	meta.ConflictID = ""
+	if c == nil {
+		return
+	}
+	c.FileIDs = slices.DeleteFunc(c.FileIDs, func(id string) bool { return id == meta.FileID })
+	if len(c.FileIDs) < 2 {
+		cb.end(c, files)
+	}
+	cb.save()
+}
+
+// members returns the IDs of the files in conflict id, whose ConflictID
+// changes when it does.
+func (cb *conflictBook) members(id string) []string {
+	if c := cb.conflicts[id]; c != nil {
+		return c.FileIDs
+	}
+	return nil
+}
+
+// end closes c, clearing its files' ConflictID.
+func (cb *conflictBook) end(c *Conflict, files map[string]*FileMetadata) {
+	for _, id := range c.FileIDs {
+		if f, ok := files[id]; ok && f.ConflictID == c.ID {
+			f.ConflictID = ""
+		}
+	}
+	delete(cb.conflicts, c.ID)
+}
+
+// files returns c's files still in the catalog, in upload order.
+func (cb *conflictBook) files(c *Conflict, files map[string]*FileMetadata) []*FileMetadata {
+	var out []*FileMetadata
+	for _, id := range c.FileIDs {
+		if f, ok := files[id]; ok {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+func (cb *conflictBook) status(c *Conflict, files map[string]*FileMetadata) ConflictStatus {
+	st := ConflictStatus{Conflict: *c, Files: []ConflictFile{}}
+	for _, f := range cb.files(c, files) {
+		st.Files = append(st.Files, ConflictFile{FileID: f.FileID, Size: f.Size, Checksum: f.Checksum, State: f.State, CreatedAt: f.CreatedAt})
+	}
+	return st
+}
+
+// freeName returns name with the lowest " (n)" suffix, n from 2, that no
+// other file of owner has. The suffix goes before the extension:
+// "report (2).pdf".
+func (s *Store) freeName(owner, name string) string {
+	taken := map[string]bool{}
+	for _, f := range s.files {
+		if f.Owner == owner && f.ParentID == "" {
+			taken[f.Filename] = true
+		}
+	}
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for n := 2; ; n++ {
+		if cand := fmt.Sprintf("%s (%d)%s", base, n, ext); !taken[cand] {
+			return cand
+		}
+	}
+}
+
+// handleConflicts lists the open conflicts, optionally only ?owner='s.
+func (sv *Server) handleConflicts(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	sv.store.mu.RLock()
+	out := []ConflictStatus{}
+	for _, c := range sv.store.conflicts.conflicts {
+		if !q.Has("owner") || c.Owner == q.Get("owner") {
+			out = append(out, sv.store.conflicts.status(c, sv.store.files))
+		}
+	}
+	sv.store.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	writeJSONResp(w, map[string]any{"conflicts": out})
+}
+
+func (sv *Server) handleConflict(w http.ResponseWriter, r *http.Request) {
+	sv.store.mu.RLock()
+	defer sv.store.mu.RUnlock()
+	c, ok := sv.store.conflicts.conflicts[r.PathValue("conflictId")]
+	if !ok {
+		apierr.Write(w, http.StatusNotFound, apierr.ConflictNotFound, "conflict not found")
+		return
+	}
+	writeJSONResp(w, sv.store.conflicts.status(c, sv.store.files))
+}
+
+// Conflict resolution strategies.
+const (
+	ResolveKeepNewest = "keep-newest" // keep the last committed upload, delete the others
+	ResolveKeepBoth   = "keep-both"   // keep every file, renaming all but the first with a suffix
+	ResolvePick       = "pick"        // keep the file named in Keep, delete the others
+)
+
+// ResolveConflictRequest is the body of POST /conflicts/{conflictId}/resolve.
+type ResolveConflictRequest struct {
+	Strategy string `json:"strategy"`
+	Keep     string `json:"keep,omitempty"` // the fileId to keep; pick only
+}
+
+// handleResolveConflict ends a conflict. keep-both only renames; the other
+// two strategies delete the files not kept, blobs first as a lifecycle
+// purge does, and with ?dryRun=true only say what they would delete. A file
+// whose blobs could not all be deleted stays, and so does the conflict.
+func (sv *Server) handleResolveConflict(w http.ResponseWriter, r *http.Request) {
+	var body ResolveConflictRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json")
+		return
+	}
+	if body.Strategy != ResolveKeepNewest && body.Strategy != ResolveKeepBoth && body.Strategy != ResolvePick {
+		apierr.Write(w, http.StatusBadRequest, apierr.BadRequest, "strategy must be keep-newest, keep-both or pick")
+		return
+	}
+
+	sv.store.mu.Lock()
+	c, ok := sv.store.conflicts.conflicts[r.PathValue("conflictId")]
+	if !ok {
+		sv.store.mu.Unlock()
+		apierr.Write(w, http.StatusNotFound, apierr.ConflictNotFound, "conflict not found")
+		return
+	}
+	files := sv.store.conflicts.files(c, sv.store.files)
+	if len(files) < 2 {
+		// the catalog was reloaded without the other files
+		sv.store.mark(c.FileIDs...)
+		sv.store.conflicts.end(c, sv.store.files)
+		sv.store.conflicts.save()
+		sv.store.mu.Unlock()
+		apierr.Write(w, http.StatusNotFound, apierr.ConflictNotFound, "conflict is over")
+		return
+	}
+
+	if body.Strategy == ResolveKeepBoth {
+		renamed := map[string]string{}
+		if !isDryRun(r) {
+			for _, f := range files[1:] {
+				f.Filename = sv.store.freeName(f.Owner, f.Filename)
+				f.UpdatedAt = now()
+				renamed[f.FileID] = f.Filename
+			}
+			sv.store.conflicts.end(c, sv.store.files)
+			sv.store.conflicts.save()
+			sv.store.touch(c.FileIDs...)
+		}
+		sv.store.mu.Unlock()
+		if isDryRun(r) {
+			writeJSONResp(w, newChangePlan())
+			return
+		}
+		sv.store.persist()
+		sv.record(r, "resolve-conflict", c.ID, fmt.Sprintf("%s %q: renamed %d", body.Strategy, c.Filename, len(renamed)))
+		writeJSONResp(w, map[string]any{"conflictId": c.ID, "strategy": body.Strategy, "kept": c.FileIDs, "deleted": []string{}, "renamed": renamed})
+		return
+	}
+
+	var keep *FileMetadata
+	for _, f := range files {
+		switch body.Strategy {
+		case ResolvePick:
+			if f.FileID == body.Keep {
+				keep = f
+			}
+		case ResolveKeepNewest:
+			if f.State != StateAllocated && (keep == nil || f.CreatedAt.After(keep.CreatedAt)) {
+				keep = f
+			}
+		}
+	}
+	if keep == nil {
+		sv.store.mu.Unlock()
+		if body.Strategy == ResolvePick {
+			apierr.WriteDetail(w, http.StatusBadRequest, apierr.BadRequest, "keep must be one of the conflict's files", map[string]any{"fileIds": c.FileIDs})
+		} else {
+			apierr.Write(w, http.StatusConflict, apierr.FileNotReady, "no upload in the conflict has been committed yet")
+		}
+		return
+	}
+	var losers []*FileMetadata
+	plan := newChangePlan()
+	jobs := map[string][]repairJob{} // loser fileId -> its blobs and its derived files'
+	for _, f := range files {
+		if f == keep {
+			continue
+		}
+		losers = append(losers, f)
+		group := []*FileMetadata{f}
+		for _, id := range f.Derived {
+			if d, ok := sv.store.files[id]; ok {
+				group = append(group, d)
+			}
+		}
+		for _, g := range group {
+			plan.addFile(g)
+			for _, rep := range g.Replicas {
+				jobs[f.FileID] = append(jobs[f.FileID], repairJob{FileID: g.FileID, TargetID: rep.NodeID, TargetURL: rep.URL})
+			}
+		}
+	}
+	sv.store.mu.Unlock()
+	if isDryRun(r) {
+		writeJSONResp(w, plan)
+		return
+	}
+
+	failed := map[string]string{}
+	for _, f := range losers {
+		var errs []string
+		for _, job := range jobs[f.FileID] {
+			if err := sv.trimReplica(r.Context(), job); err != nil {
+				errs = append(errs, fmt.Sprintf("%s on %s: %v", job.FileID, job.TargetID, err))
+			}
+		}
+		if len(errs) > 0 {
+			failed[f.FileID] = strings.Join(errs, "; ")
+		}
+	}
+	deleted, gone := []string{}, []string{}
+	sv.store.mu.Lock()
+	for _, f := range losers {
+		if _, ok := sv.store.files[f.FileID]; ok && failed[f.FileID] == "" {
+			gone = append(gone, sv.removeFile(f)...)
+			deleted = append(deleted, f.FileID)
+		}
+	}
+	sv.idem.tombstone(append(gone, deleted...)...)
+	sv.store.mu.Unlock()
+	sv.store.persist()
+	sv.record(r, "resolve-conflict", c.ID, fmt.Sprintf("%s %q: kept %s, deleted %d", body.Strategy, c.Filename, keep.FileID, len(deleted)))
+	if len(failed) > 0 {
+		apierr.WriteDetail(w, http.StatusBadGateway, apierr.UpstreamError, "some files could not be deleted from their nodes",
+			map[string]any{"deleted": deleted, "failed": failed})
+		return
+	}
+	writeJSONResp(w, map[string]any{"conflictId": c.ID, "strategy": body.Strategy, "kept": []string{keep.FileID}, "deleted": deleted, "renamed": map[string]string{}})
+}
+
+/* ==================== SHARES ==================== */
+
+// Share is a public link to one file. The gateway serves it at
+// /s/{token}; the naming service decides whether a request may use it and
+// counts the downloads.
+type Share struct {
+	Token        string    `json:"token"`
+	FileID       string    `json:"fileId"`
+	CreatedBy    string    `json:"createdBy,omitempty"`
+	CreatedAt    time.Time `json:"createdAt"`
+	ExpiresAt    time.Time `json:"expiresAt,omitzero"`     // zero: never
+	MaxDownloads int64     `json:"maxDownloads,omitempty"` // 0: unlimited
+	Downloads    int64     `json:"downloads"`
+	RevokedAt    time.Time `json:"revokedAt,omitzero"`
+	// PasswordHash is "pbkdf2-sha256$<iterations>$<salt>$<key>", hex
+	// encoded; it never leaves metadata/shares.json.
+	PasswordHash string `json:"passwordHash,omitempty"`
+}
+
+// Share states, from the link's point of view.
+const (
+	ShareActive    = "ACTIVE"
+	ShareExpired   = "EXPIRED"
+	ShareExhausted = "EXHAUSTED"
+	ShareRevoked   = "REVOKED"
+)
+
+func (s *Share) state(at time.Time) string {
+	switch {
+	case !s.RevokedAt.IsZero():
+		return ShareRevoked
+	case !s.ExpiresAt.IsZero() && !at.Before(s.ExpiresAt):
+		return ShareExpired
+	case s.MaxDownloads > 0 && s.Downloads >= s.MaxDownloads:
+		return ShareExhausted
+	}
+	return ShareActive
+}
+
+// ShareStatus is a share as the API shows it: no password hash, but
+// whether there is one and what state the link is in.
+type ShareStatus struct {
+	Share
+	PasswordHash string `json:"passwordHash,omitempty"` // shadows Share's; always empty
+	Protected    bool   `json:"protected"`
+	State        string `json:"state"`
+}
+
+func (s *Share) status() ShareStatus {
+	return ShareStatus{Share: *s, Protected: s.PasswordHash != "", State: s.state(now())}
+}
+
+// sharePasswordIterations is the PBKDF2 work factor for share passwords.
+const sharePasswordIterations = 100_000
+
+func hashSharePassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := crand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, sharePasswordIterations, 32)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("pbkdf2-sha256$%d$%x$%x", sharePasswordIterations, salt, key), nil
+}
+
+func checkSharePassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iter, err := strconv.Atoi(parts[1])
+	salt, err2 := hex.DecodeString(parts[2])
+	want, err3 := hex.DecodeString(parts[3])
+	if err != nil || err2 != nil || err3 != nil {
+		return false
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, iter, len(want))
+	return err == nil && subtle.ConstantTimeCompare(key, want) == 1
+}
+
+// shareBook holds every share, persisted in metadata/shares.json. Guarded
+// by the store lock, so a share and the file it points at are checked
+// together.
+type shareBook struct {
+	path   string
+	shares map[string]*Share // token -> share
+}
+
+func openShareBook(path string) (*shareBook, error) {
+	sb := &shareBook{path: path, shares: map[string]*Share{}}
+	if b, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(b, &sb.shares); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return sb, nil
+}
+
+func (sb *shareBook) save() {
+	if err := writeJSONFile(sb.path, sb.shares); err != nil {
+		log.Printf("[SHARE] cannot save shares: %v", err)
+	}
+}
+
+// dropFile forgets the shares of a file that no longer exists.
+func (sb *shareBook) dropFile(fileID string) {
+	n := len(sb.shares)
+	maps.DeleteFunc(sb.shares, func(_ string, s *Share) bool { return s.FileID == fileID })
+	if len(sb.shares) != n {
+		sb.save()
+	}
+}
+
+// handleShares creates a share (POST) or lists them (GET, optionally
+// ?fileId=).
+func (sv *Server) handleShares(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		fid := r.URL.Query().Get("fileId")
+		sv.store.mu.RLock()
+		out := []ShareStatus{}
+		for _, s := range sv.store.shares.shares {
+			if fid == "" || s.FileID == fid {
+				out = append(out, s.status())
+			}
+		}
+		sv.store.mu.RUnlock()
+		sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+		writeJSONResp(w, map[string]any{"shares": out})
+	case http.MethodPost:
+		if sv.maintenance.Load() {
+			apierr.Write(w, http.StatusServiceUnavailable, apierr.Maintenance, "naming service is in maintenance mode (read-only)")
+			return
+		}
+		sv.createShare(w, r)
+	}
+}
+
+// CreateShareRequest is the body of POST /shares.
+type CreateShareRequest struct {
+	FileID       string `json:"fileId"`
+	ExpiresIn    string `json:"expiresIn"` // Go duration, e.g. 24h; empty: never
+	MaxDownloads int64  `json:"maxDownloads"`
+	Password     string `json:"password"`
+}
+
+func (sv *Server) createShare(w http.ResponseWriter, r *http.Request) {
+	var body CreateShareRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.FileID == "" || body.MaxDownloads < 0 {
+		apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json: need fileId and a non-negative maxDownloads")
+		return
+	}
+	s := &Share{FileID: body.FileID, MaxDownloads: body.MaxDownloads, CreatedBy: r.Header.Get(actorHeader), CreatedAt: now()}
+	if body.ExpiresIn != "" {
+		d, err := time.ParseDuration(body.ExpiresIn)
+		if err != nil || d <= 0 {
+			apierr.Write(w, http.StatusBadRequest, apierr.BadRequest, "expiresIn must be a positive duration such as 24h")
+			return
+		}
+		s.ExpiresAt = s.CreatedAt.Add(d)
+	}
+	if body.Password != "" {
+		hash, err := hashSharePassword(body.Password)
+		if err != nil {
+			apierr.WriteDetail(w, http.StatusInternalServerError, apierr.Internal, "cannot hash password", err.Error())
+			return
+		}
+		s.PasswordHash = hash
+	}
+	s.Token = sv.shard.mint(crand.Text)
+
+	sv.store.mu.Lock()
+	meta, ok := sv.store.files[body.FileID]
+	if !ok || meta.State == StateDeleted {
+		sv.store.mu.Unlock()
+		apierr.Write(w, http.StatusNotFound, apierr.FileNotFound, "file not found")
+		return
+	}
+	if meta.State == StateAllocated {
+		sv.store.mu.Unlock()
+		apierr.Write(w, http.StatusConflict, apierr.FileNotReady, "file has not been committed yet")
+		return
+	}
+	sv.store.shares.shares[s.Token] = s
+	sv.store.shares.save()
+	st := s.status()
+	sv.store.mu.Unlock()
+
+	detail := "expires=never"
+	if !s.ExpiresAt.IsZero() {
+		detail = "expires=" + s.ExpiresAt.Format(time.RFC3339)
+	}
+	detail += fmt.Sprintf(" maxDownloads=%d protected=%t", s.MaxDownloads, st.Protected)
+	log.Printf("[SHARE] %s shared as %s…: %s", s.FileID, s.Token[:6], detail)
+	sv.record(r, "share", s.FileID, detail)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(st)
+}
+
+// shareRefusals maps the state of a share that cannot be used to its error
+// code.
+var shareRefusals = map[string]string{
+	ShareRevoked:   apierr.ShareRevoked,
+	ShareExpired:   apierr.ShareExpired,
+	ShareExhausted: apierr.ShareExhausted,
+}
+
+// OpenShareRequest is the body of POST /shares/open.
+type OpenShareRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// handleOpenShare checks {token, password} against the share and, if the
+// link may be used, counts a download and returns the file it points at.
+// The password is checked outside the lock; the limits are checked again
+// when the download is counted.
+func (sv *Server) handleOpenShare(w http.ResponseWriter, r *http.Request) {
+	var body OpenShareRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Token == "" {
+		apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json: need token")
+		return
+	}
+	sv.store.mu.RLock()
+	var hash string
+	s, ok := sv.store.shares.shares[body.Token]
+	if ok {
+		hash = s.PasswordHash
+	}
+	sv.store.mu.RUnlock()
+	if !ok {
+		apierr.Write(w, http.StatusNotFound, apierr.ShareNotFound, "share not found")
+		return
+	}
+	if hash != "" {
+		if body.Password == "" {
+			apierr.Write(w, http.StatusUnauthorized, apierr.PasswordRequired, "this link needs a password")
+			return
+		}
+		if !checkSharePassword(hash, body.Password) {
+			apierr.Write(w, http.StatusForbidden, apierr.WrongPassword, "wrong password")
+			return
+		}
+	}
+
+	sv.store.mu.Lock()
+	defer sv.store.mu.Unlock()
+	if s = sv.store.shares.shares[body.Token]; s == nil {
+		apierr.Write(w, http.StatusNotFound, apierr.ShareNotFound, "share not found")
+		return
+	}
+	switch st := s.state(now()); st {
+	case ShareRevoked:
+		apierr.Write(w, http.StatusGone, shareRefusals[st], "this link has been revoked")
+		return
+	case ShareExpired:
+		apierr.Write(w, http.StatusGone, shareRefusals[st], "this link has expired")
+		return
+	case ShareExhausted:
+		apierr.Write(w, http.StatusGone, shareRefusals[st], "this link has reached its download limit")
+		return
+	}
+	meta, ok := sv.store.files[s.FileID]
+	if !ok || meta.State == StateDeleted || meta.State == StateAllocated {
+		apierr.Write(w, http.StatusGone, apierr.FileGone, "the shared file no longer exists")
+		return
+	}
+	s.Downloads++
+	sv.store.shares.save()
+	writeJSONResp(w, map[string]any{
+		"share":       s.status(),
+		"fileId":      meta.FileID,
+		"filename":    meta.Filename,
+		"contentType": meta.ContentType,
+		"size":        meta.Size,
+	})
+}
+
+// RevokeShareRequest is the body of POST /shares/revoke.
+type RevokeShareRequest struct {
+	Token string `json:"token"`
+}
+
+// handleRevokeShare revokes the share named by DELETE /shares/{token}, or
+// by the body of the older POST /shares/revoke. A revoked share stays
+// listed so its owner can see it was used and when it was cut off.
+func (sv *Server) handleRevokeShare(w http.ResponseWriter, r *http.Request) {
+	body := RevokeShareRequest{Token: r.PathValue("token")}
+	if body.Token == "" {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Token == "" {
+			apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json: need token")
+			return
+		}
+	}
+	sv.store.mu.Lock()
+	s, ok := sv.store.shares.shares[body.Token]
+	if !ok {
+		sv.store.mu.Unlock()
+		apierr.Write(w, http.StatusNotFound, apierr.ShareNotFound, "share not found")
+		return
+	}
+	if s.RevokedAt.IsZero() {
+		s.RevokedAt = now()
+		sv.store.shares.save()
+	}
+	st := s.status()
+	sv.store.mu.Unlock()
+	log.Printf("[SHARE] %s… for %s revoked", body.Token[:min(6, len(body.Token))], st.FileID)
+	sv.record(r, "share-revoke", st.FileID, "token="+body.Token[:min(6, len(body.Token))]+"…")
+	writeJSONResp(w, st)
+}
+
+/* ==================== AUDIT LOG ==================== */
+
+// actorHeader names the caller of a destructive request; the gateway fills it
+// in from its own client. Without it the remote address is recorded.
+const actorHeader = "X-Actor"
+
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	Target string    `json:"target,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+	Remote string    `json:"remote,omitempty"`
+}
+
+// auditLog is an append-only JSON-lines file of destructive operations,
+// mirrored in memory for /audit queries.
+type auditLog struct {
+	mu      sync.Mutex
+	path    string
+	entries []auditEntry
+}
+
+func openAuditLog(path string) *auditLog {
+	a := &auditLog{path: path}
+	if b, err := os.ReadFile(path); err == nil {
+		for _, line := range strings.Split(string(b), "\n") {
+			var e auditEntry
+			if line != "" && json.Unmarshal([]byte(line), &e) == nil {
+				a.entries = append(a.entries, e)
+			}
+		}
+	}
+	return a
+}
+
+func (a *auditLog) append(e auditEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.entries = append(a.entries, e)
+	b, _ := json.Marshal(e)
+	f, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("[AUDIT] cannot open %s: %v", a.path, err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		log.Printf("[AUDIT] write failed: %v", err)
+		return
+	}
+	_ = f.Sync()
+}
+
+// record appends an audit entry for a request handled by the naming service.
+func (sv *Server) record(r *http.Request, action, target, detail string) {
+	remote := r.RemoteAddr
+	actor := r.Header.Get(actorHeader)
+	if actor == "" {
+		actor = remote
+	}
+	sv.audit.append(auditEntry{Time: now(), Actor: actor, Action: action, Target: target, Detail: detail, Remote: remote})
+}
+
+// AuditRequest is the body of POST /audit.
+type AuditRequest struct {
+	Actor  string `json:"actor"`
+	Action string `json:"action"`
+	Target string `json:"target"`
+	Detail string `json:"detail"`
+}
+
+// handleAudit lists audit entries (GET, optionally ?since=RFC3339 or a
+// duration such as 24h, ?action=) or records one reported by another
+// service (POST, behind the admin token), e.g. a storage node being shut
+// down.
+func (sv *Server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var body AuditRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Action == "" {
+			apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json")
+			return
+		}
+		if body.Actor != "" {
+			r.Header.Set(actorHeader, body.Actor)
+		}
+		sv.record(r, body.Action, body.Target, body.Detail)
+		writeJSONResp(w, map[string]any{"ok": true})
+		return
+	}
+
+	var since time.Time
+	if v := r.URL.Query().Get("since"); v != "" {
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			since = t
+		} else if d, err := time.ParseDuration(v); err == nil {
+			since = now().Add(-d)
+		} else {
+			apierr.Write(w, http.StatusBadRequest, apierr.BadRequest, "since must be RFC3339 or a duration")
+			return
+		}
+	}
+	action := r.URL.Query().Get("action")
+	sv.audit.mu.Lock()
+	out := []auditEntry{}
+	for _, e := range sv.audit.entries {
+		if e.Time.Before(since) || (action != "" && e.Action != action) {
+			continue
+		}
+		out = append(out, e)
+	}
+	sv.audit.mu.Unlock()
+	writeJSONResp(w, out)
+}
+
+/* ==================== ADMIN ==================== */
+
+// admin wraps an /admin/* handler with the ADMIN_TOKEN bearer check. Without
+// a configured token the admin API is disabled.
+func (sv *Server) admin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(sv.adminToken) == 0 {
+			apierr.Write(w, http.StatusForbidden, apierr.FeatureDisabled, "admin API disabled: set ADMIN_TOKEN")
+			return
+		}
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), sv.adminToken) != 1 {
+			apierr.Write(w, http.StatusUnauthorized, apierr.InvalidAdminToken, "invalid admin token")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// writable rejects catalog writes while the naming service is in
+// maintenance mode; lookups and listings keep working.
+func (sv *Server) writable(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if sv.maintenance.Load() {
+			apierr.Write(w, http.StatusServiceUnavailable, apierr.Maintenance, "naming service is in maintenance mode (read-only)")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// handleAdminStop stops the naming service gracefully once in-flight
+// requests are done; main then calls Close to persist the catalog.
+func (sv *Server) handleAdminStop(w http.ResponseWriter, r *http.Request) {
+	sv.record(r, "shutdown", "naming-service", "")
+	writeJSONResp(w, map[string]any{"ok": true, "stopping": true})
+	sv.stopOnce.Do(func() { close(sv.stopCh) })
+}
+
+// MaintenanceModeRequest is the body of POST /admin/maintenance-mode.
+type MaintenanceModeRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+func (sv *Server) handleAdminMaintenance(w http.ResponseWriter, r *http.Request) {
+	var body MaintenanceModeRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json")
+		return
+	}
+	sv.maintenance.Store(body.Enabled)
+	log.Printf("[ADMIN] maintenance mode %v", body.Enabled)
+	sv.record(r, "maintenance-mode", "naming-service", fmt.Sprintf("enabled=%v", body.Enabled))
+	writeJSONResp(w, map[string]any{"maintenance": body.Enabled})
+}
+
+// handleAdminReload re-reads files.json, nodes.json and settings.json from
+// disk.
+func (sv *Server) handleAdminReload(w http.ResponseWriter, r *http.Request) {
+	sv.settingsMu.Lock()
+	defer sv.settingsMu.Unlock()
+	t, ok, err := sv.readSettings()
+	if err == nil {
+		err = sv.store.reload()
+	}
+	if err != nil {
+		apierr.WriteDetail(w, http.StatusInternalServerError, apierr.Internal, "reload failed", err.Error())
+		return
+	}
+	if ok {
+		sv.settings.Store(&t)
+	}
+	sv.store.mu.RLock()
+	files, nodes := len(sv.store.files), len(sv.store.nodes)
+	sv.store.mu.RUnlock()
+	sv.record(r, "reload", "naming-service", fmt.Sprintf("%d files, %d nodes", files, nodes))
+	writeJSONResp(w, map[string]any{"reloaded": true, "files": files, "nodes": nodes})
+}
+
+// NodeMaintenanceRequest is the body of POST /admin/node-maintenance.
+type NodeMaintenanceRequest struct {
+	NodeID  string `json:"nodeId"`
+	Enabled bool   `json:"enabled"`
+}
+
+// handleNodeMaintenance drains a storage node (or returns it to service):
+// a node in maintenance keeps serving reads and acting as a repair source
+// but is never chosen for allocation, auto-heal or a replica move. With
+// ?dryRun=true it changes nothing and lists the files with a replica on the
+// node and the bytes they keep there.
+func (sv *Server) handleNodeMaintenance(w http.ResponseWriter, r *http.Request) {
+	var body NodeMaintenanceRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.NodeID == "" {
+		apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json")
+		return
+	}
+	sv.store.mu.Lock()
+	n, ok := sv.store.nodes[body.NodeID]
+	if !ok {
+		sv.store.mu.Unlock()
+		apierr.Write(w, http.StatusNotFound, apierr.NodeNotFound, "unknown node")
+		return
+	}
+	if isDryRun(r) {
+		plan := newChangePlan()
+		plan.addNode(n.NodeID)
+		for _, meta := range sv.store.files {
+			if meta.State != StateDeleted && slices.ContainsFunc(meta.Replicas, func(rep ReplicaInfo) bool { return rep.NodeID == n.NodeID }) {
+				plan.Files = append(plan.Files, meta.FileID)
+				plan.Bytes += storedSize(meta)
+			}
+		}
+		sv.store.mu.Unlock()
+		slices.Sort(plan.Files)
+		writeJSONResp(w, plan)
+		return
+	}
+	n.Maintenance = body.Enabled
+	status := sv.stateOf(n)
+	sv.store.touch()
+	sv.store.mu.Unlock()
+	sv.store.persist()
+
+	log.Printf("[ADMIN] node %s maintenance %v", body.NodeID, body.Enabled)
+	sv.record(r, "node-maintenance", body.NodeID, fmt.Sprintf("enabled=%v", body.Enabled))
+	writeJSONResp(w, map[string]any{"nodeId": body.NodeID, "maintenance": body.Enabled, "status": status})
+}
+
+/* ==================== SNAPSHOTS ==================== */
+
+// SnapshotFormat is the layout version of a ClusterSnapshot; /admin/restore
+// refuses any other.
+const SnapshotFormat = 1
+
+// maxSnapshotBytes bounds a snapshot /admin/restore reads from its body or
+// a storage node.
+const maxSnapshotBytes = 256 << 20
+
+// snapshotIDPrefix starts the ID a snapshot is stored on nodes under; such
+// blobs are not files, and /admin/rebuild-metadata leaves them out.
+const snapshotIDPrefix = "snapshot-"
+
+// ClusterSnapshot is the catalog as of one revision: every file and node
+// record. Checksum covers Files and Nodes, so a snapshot that was cut short
+// or edited is refused on restore.
+type ClusterSnapshot struct {
+	Format    int                      `json:"format"`
+	ClusterID string                   `json:"clusterId"`
+	Revision  uint64                   `json:"revision"`
+	CreatedAt time.Time                `json:"createdAt"`
+	Checksum  string                   `json:"checksum"`
+	Files     map[string]*FileMetadata `json:"files"`
+	Nodes     map[string]*NodeInfo     `json:"nodes"`
+}
+
+// snapshotChecksum hashes the snapshot's files and nodes; encoding/json
+// sorts map keys, so the same catalog always hashes the same.
+func snapshotChecksum(files map[string]*FileMetadata, nodes map[string]*NodeInfo) string {
+	b, _ := json.Marshal(struct {
+		Files map[string]*FileMetadata `json:"files"`
+		Nodes map[string]*NodeInfo     `json:"nodes"`
+	}{files, nodes})
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// snapshot encodes the catalog under the read lock, so files and nodes are
+// from the same revision.
+func (sv *Server) snapshot() (ClusterSnapshot, []byte) {
+	sv.store.mu.RLock()
+	snap := ClusterSnapshot{
+		Format:    SnapshotFormat,
+		ClusterID: sv.store.clusterID,
+		Revision:  sv.store.revision,
+		CreatedAt: now(),
+		Checksum:  snapshotChecksum(sv.store.files, sv.store.nodes),
+		Files:     sv.store.files,
+		Nodes:     sv.store.nodes,
+	}
+	b, _ := json.Marshal(snap)
+	sv.store.mu.RUnlock()
+	snap.Files, snap.Nodes = nil, nil // the live maps; only b is safe to keep
+	return snap, append(b, '\n')
+}
+
+// SnapshotRequest is the body of POST /admin/snapshot.
+type SnapshotRequest struct {
+	// Copies is how many storage nodes keep the snapshot; 0 means the
+	// cluster replication factor.
+	Copies int `json:"copies,omitempty"`
+}
+
+// handleSnapshot exports the catalog. GET returns the snapshot itself;
+// POST stores it as a blob on storage nodes, placed like a new file, and
+// returns where, for a later /admin/restore.
+func (sv *Server) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		snap, b := sv.snapshot()
+		sv.record(r, "snapshot", "naming-service", fmt.Sprintf("revision %d exported", snap.Revision))
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="snapshot-r%d.json"`, snap.Revision))
+		w.Write(b)
+		return
+	}
+	var body SnapshotRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json")
+		return
+	}
+	if body.Copies < 0 {
+		apierr.Write(w, http.StatusBadRequest, apierr.BadRequest, "copies must not be negative")
+		return
+	}
+	snap, b := sv.snapshot()
+	id := fmt.Sprintf(snapshotIDPrefix+"r%d-%d", snap.Revision, snap.CreatedAt.Unix())
+	sum := sha256.Sum256(b)
+	checksum := "sha256:" + hex.EncodeToString(sum[:])
+	copies := cmp.Or(body.Copies, sv.tunables().ReplicationFactor)
+	nodes, err := sv.pickReplicas(r.Context(), PlacementFile{Filename: id + ".json", Size: int64(len(b)), ContentType: "application/json"}, placementHints{}, copies)
+	if err != nil {
+		apierr.WriteDetail(w, http.StatusServiceUnavailable, apierr.InsufficientNodes, err.Error(), err)
+		return
+	}
+	var stored []map[string]string
+	failed := map[string]string{}
+	for _, n := range nodes {
+		ticket := sv.ticketFor(n.NodeID, id, 1, int64(len(b)), checksum)
+		if _, err := sv.uploadToNode(r.Context(), n.URL, ticket, id, 1, checksum, id+".json", "application/json", bytes.NewReader(b)); err != nil {
+			failed[n.NodeID] = err.Error()
+			continue
+		}
+		stored = append(stored, map[string]string{"nodeId": n.NodeID, "url": n.URL})
+	}
+	if len(stored) == 0 {
+		apierr.WriteDetail(w, http.StatusBadGateway, apierr.UpstreamError, "no storage node took the snapshot", failed)
+		return
+	}
+	log.Printf("[ADMIN] snapshot %s (revision %d, %d bytes) stored on %d node(s)", id, snap.Revision, len(b), len(stored))
+	sv.record(r, "snapshot", id, fmt.Sprintf("revision %d on %d node(s)", snap.Revision, len(stored)))
+	resp := map[string]any{
+		"snapshotId": id, "revision": snap.Revision, "createdAt": snap.CreatedAt,
+		"size": len(b), "checksum": checksum, "storedOn": stored,
+	}
+	if len(failed) > 0 {
+		resp["failed"] = failed
+	}
+	writeJSONResp(w, resp)
+}
+
+// RestoreRequest is the body of POST /admin/restore: either the snapshot
+// itself, or the node and ID POST /admin/snapshot reported.
+type RestoreRequest struct {
+	Snapshot   *ClusterSnapshot `json:"snapshot,omitempty"`
+	NodeURL    string           `json:"nodeUrl,omitempty"`
+	SnapshotID string           `json:"snapshotId,omitempty"`
+	// Force replaces a catalog that already has files.
+	Force bool `json:"force,omitempty"`
+}
+
+// handleRestore loads a snapshot into the catalog. It is meant for a fresh
+// instance, so a catalog with files is only replaced with force. Nodes that
+// registered before the restore keep their live records; the rest come
+// from the snapshot and are marked down by the health checks until they
+// heartbeat again. Auto-heal then repairs whatever the nodes no longer have.
+// With ?dryRun=true nothing is loaded; the answer counts the files the
+// restore would add, replace and remove.
+func (sv *Server) handleRestore(w http.ResponseWriter, r *http.Request) {
+	var body RestoreRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxSnapshotBytes)).Decode(&body); err != nil {
+		apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json")
+		return
+	}
+	snap := body.Snapshot
+	source := "request body"
+	if snap == nil {
+		if body.NodeURL == "" || body.SnapshotID == "" {
+			apierr.Write(w, http.StatusBadRequest, apierr.MissingParameter, "need snapshot, or nodeUrl and snapshotId")
+			return
+		}
+		var err error
+		if snap, err = sv.fetchSnapshot(r.Context(), body.NodeURL, body.SnapshotID); err != nil {
+			apierr.WriteDetail(w, http.StatusBadGateway, apierr.UpstreamError, "cannot fetch snapshot", err.Error())
+			return
+		}
+		source = body.SnapshotID + " from " + body.NodeURL
+	}
+	if snap.Format != SnapshotFormat {
+		apierr.WriteDetail(w, http.StatusBadRequest, apierr.BadRequest, "unsupported snapshot format",
+			map[string]int{"format": snap.Format, "supported": SnapshotFormat})
+		return
+	}
+	if snap.Files == nil {
+		snap.Files = map[string]*FileMetadata{}
+	}
+	if snap.Nodes == nil {
+		snap.Nodes = map[string]*NodeInfo{}
+	}
+	if got := snapshotChecksum(snap.Files, snap.Nodes); got != snap.Checksum {
+		apierr.WriteDetail(w, http.StatusUnprocessableEntity, apierr.ChecksumMismatch, "snapshot checksum mismatch",
+			map[string]string{"expectedChecksum": snap.Checksum, "actualChecksum": got})
+		return
+	}
+
+	sv.store.mu.Lock()
+	if len(sv.store.files) > 0 && !body.Force {
+		n := len(sv.store.files)
+		sv.store.mu.Unlock()
+		apierr.WriteDetail(w, http.StatusConflict, apierr.Conflict, "catalog is not empty; set force to replace it",
+			map[string]int{"files": n})
+		return
+	}
+	if isDryRun(r) {
+		var added, replaced, removed int
+		for id := range snap.Files {
+			if _, ok := sv.store.files[id]; ok {
+				replaced++
+			} else {
+				added++
+			}
+		}
+		for id := range sv.store.files {
+			if _, ok := snap.Files[id]; !ok {
+				removed++
+			}
+		}
+		nodes := len(snap.Nodes)
+		for id := range sv.store.nodes {
+			if _, ok := snap.Nodes[id]; !ok {
+				nodes++
+			}
+		}
+		sv.store.mu.Unlock()
+		writeJSONResp(w, map[string]any{
+			"dryRun": true, "sourceClusterId": snap.ClusterID, "snapshotRevision": snap.Revision,
+			"files": len(snap.Files), "nodes": nodes, "added": added, "replaced": replaced, "removed": removed,
+		})
+		return
+	}
+	for id, n := range sv.store.nodes {
+		snap.Nodes[id] = n
+	}
+	sv.store.files, sv.store.nodes = snap.Files, snap.Nodes
+	sv.store.quotas.rebuild(snap.Files)
+	sv.store.revision = max(sv.store.revision, snap.Revision)
+	sv.store.touchAll()
+	revision := sv.store.revision
+	sv.store.mu.Unlock()
+	sv.store.persist()
+	select {
+	case sv.healWake <- struct{}{}:
+	default:
+	}
+
+	log.Printf("[ADMIN] restored revision %d of cluster %s from %s: %d files, %d nodes", snap.Revision, snap.ClusterID, source, len(snap.Files), len(snap.Nodes))
+	sv.record(r, "restore", "naming-service", fmt.Sprintf("revision %d of %s from %s", snap.Revision, snap.ClusterID, source))
+	writeJSONResp(w, map[string]any{
+		"restored": true, "sourceClusterId": snap.ClusterID, "snapshotRevision": snap.Revision,
+		"revision": revision, "files": len(snap.Files), "nodes": len(snap.Nodes),
+	})
+}
+
+// fetchSnapshot downloads a snapshot POST /admin/snapshot stored on a node.
+func (sv *Server) fetchSnapshot(ctx context.Context, base, id string) (*ClusterSnapshot, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(base, "/")+"/download/"+url.PathEscape(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := sv.httpClient(30 * time.Second).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download: %s", resp.Status)
+	}
+	var snap ClusterSnapshot
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxSnapshotBytes)).Decode(&snap); err != nil {
+		return nil, fmt.Errorf("decode: %v", err)
+	}
+	return &snap, nil
+}
+
+/* ==================== METADATA REBUILD ==================== */
+
+// RebuildRequest is the body of POST /admin/rebuild-metadata. Like a
+// restore, a rebuild refuses a catalog that still has files unless Force
+// replaces it or Merge keeps it and only adds the files it lacks.
+type RebuildRequest struct {
+	Force bool `json:"force,omitempty"`
+	Merge bool `json:"merge,omitempty"`
+}
+
+// nodeBlob is one entry of a storage node's GET /list.
+type nodeBlob struct {
+	FileID      string    `json:"fileId"`
+	Size        int64     `json:"size"`
+	StoredSize  int64     `json:"storedSize"`
+	Checksum    string    `json:"checksum"`
+	Version     int       `json:"version"`
+	ModifiedAt  time.Time `json:"modifiedAt"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"contentType"`
+}
+
+// listNode returns every blob a node holds.
+func (sv *Server) listNode(ctx context.Context, base string) ([]nodeBlob, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(base, "/")+"/list", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := sv.httpClient(30 * time.Second).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("list: %s", resp.Status)
+	}
+	var listing struct {
+		Files []nodeBlob `json:"files"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&listing); err != nil {
+		return nil, fmt.Errorf("list: %v", err)
+	}
+	return listing.Files, nil
+}
+
+// rebuildResult summarizes a rebuild. Unidentified counts blobs the nodes
+// hold no checksum for, which cannot be told apart from damaged ones and
+// are left out; Disagreements counts files whose copies differ, where the
+// newest version held by the most nodes wins and the rest are STALE.
+type rebuildResult struct {
+	DryRun        bool              `json:"dryRun,omitempty"`
+	Files         int               `json:"files"`
+	Added         int               `json:"added"`
+	Kept          int               `json:"kept,omitempty"`
+	Degraded      int               `json:"degraded"`
+	Disagreements int               `json:"disagreements"`
+	Unidentified  int               `json:"unidentified"`
+	Blobs         map[string]int    `json:"blobs"`
+	FailedNodes   map[string]string `json:"failedNodes,omitempty"`
+	Revision      uint64            `json:"revision,omitempty"`
+}
+
+// handleRebuildMetadata rebuilds the catalog from what the storage nodes
+// hold, for when files.json is lost or corrupt and there is no snapshot to
+// restore: POST /admin/rebuild-metadata. Every registered node is asked
+// for its /list, and each fileId becomes a file with the filename, content
+// type, version and checksum the nodes recorded when it was uploaded.
+// Owners, ACLs, shares, storage classes and placement hints live only in
+// the catalog and are not recovered. With ?dryRun=true nothing is changed.
+func (sv *Server) handleRebuildMetadata(w http.ResponseWriter, r *http.Request) {
+	var body RebuildRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json")
+		return
+	}
+	if body.Force && body.Merge {
+		apierr.Write(w, http.StatusBadRequest, apierr.BadRequest, "force and merge are mutually exclusive")
+		return
+	}
+	dry := isDryRun(r)
+
+	sv.store.mu.RLock()
+	nodes := make(map[string]string, len(sv.store.nodes))
+	for id, n := range sv.store.nodes {
+		nodes[id] = n.URL
+	}
+	sv.store.mu.RUnlock()
+	res := rebuildResult{DryRun: dry, Blobs: map[string]int{}, FailedNodes: map[string]string{}}
+	listings := map[string][]nodeBlob{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for id, base := range nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			blobs, err := sv.listNode(r.Context(), base)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				res.FailedNodes[id] = err.Error()
+				return
+			}
+			listings[id] = blobs
+			res.Blobs[id] = len(blobs)
+		}()
+	}
+	wg.Wait()
+	if len(listings) == 0 {
+		apierr.WriteDetail(w, http.StatusServiceUnavailable, apierr.InsufficientNodes, "no storage node could be listed", res.FailedNodes)
+		return
+	}
+	files := sv.rebuildCatalog(listings, nodes, &res)
+
+	sv.store.mu.Lock()
+	if len(sv.store.files) > 0 && !body.Force && !body.Merge {
+		n := len(sv.store.files)
+		sv.store.mu.Unlock()
+		apierr.WriteDetail(w, http.StatusConflict, apierr.Conflict, "catalog is not empty; set force to replace it or merge to add to it",
+			map[string]int{"files": n})
+		return
+	}
+	if body.Merge {
+		for id := range files {
+			if _, ok := sv.store.files[id]; ok {
+				delete(files, id)
+				res.Kept++
+			}
+		}
+	}
+	res.Added = len(files)
+	if dry {
+		sv.store.mu.Unlock()
+		writeJSONResp(w, res)
+		return
+	}
+	if body.Merge {
+		maps.Copy(sv.store.files, files)
+	} else {
+		sv.store.files = files
+	}
+	sv.store.quotas.rebuild(sv.store.files)
+	sv.store.touchAll()
+	res.Revision = sv.store.revision
+	sv.store.mu.Unlock()
+	sv.store.persist()
+	select {
+	case sv.healWake <- struct{}{}:
+	default:
+	}
+
+	log.Printf("[ADMIN] rebuilt metadata from %d node(s): %d files, %d added, %d degraded, %d unidentified blobs",
+		len(listings), res.Files, res.Added, res.Degraded, res.Unidentified)
+	sv.record(r, "rebuild-metadata", "naming-service", fmt.Sprintf("%d files from %d nodes, %d added", res.Files, len(listings), res.Added))
+	writeJSONResp(w, res)
+}
+
+// rebuildCatalog turns node listings into files. A file's version and
+// checksum are the newest version's, and among its copies the checksum
+// most nodes hold, then the most recently written; those copies are READY
+// and the others STALE.
+func (sv *Server) rebuildCatalog(listings map[string][]nodeBlob, urls map[string]string, res *rebuildResult) map[string]*FileMetadata {
+	type copyOf struct {
+		nodeID string
+		blob   nodeBlob
+	}
+	byFile := map[string][]copyOf{}
+	for nodeID, blobs := range listings {
+		for _, b := range blobs {
+			switch {
+			case strings.HasPrefix(b.FileID, snapshotIDPrefix):
+			case !sv.shard.owns(b.FileID): // another shard's to rebuild
+			case b.Checksum == "":
+				res.Unidentified++
+			default:
+				byFile[b.FileID] = append(byFile[b.FileID], copyOf{nodeID, b})
+			}
+		}
+	}
+
+	files := make(map[string]*FileMetadata, len(byFile))
+	for id, copies := range byFile {
+		// newest version first, then the checksum most copies agree on,
+		// then the latest write
+		votes := map[string]int{}
+		for _, c := range copies {
+			votes[fmt.Sprint(c.blob.Version, c.blob.Checksum)]++
+		}
+		best := slices.MaxFunc(copies, func(a, b copyOf) int {
+			return cmp.Or(cmp.Compare(a.blob.Version, b.blob.Version),
+				cmp.Compare(votes[fmt.Sprint(a.blob.Version, a.blob.Checksum)], votes[fmt.Sprint(b.blob.Version, b.blob.Checksum)]),
+				a.blob.ModifiedAt.Compare(b.blob.ModifiedAt))
+		}).blob
+		meta := &FileMetadata{
+			FileID:           id,
+			Filename:         cmp.Or(best.Filename, id),
+			Size:             best.Size,
+			Checksum:         best.Checksum,
+			ContentType:      cmp.Or(best.ContentType, "application/octet-stream"),
+			Version:          max(best.Version, 1),
+			CommittedVersion: max(best.Version, 1),
+			State:            StateDegraded,
+			CreatedAt:        best.ModifiedAt,
+			UpdatedAt:        best.ModifiedAt,
+		}
+		sort.Slice(copies, func(i, j int) bool { return copies[i].nodeID < copies[j].nodeID })
+		for _, c := range copies {
+			rep := ReplicaInfo{NodeID: c.nodeID, URL: urls[c.nodeID], Status: ReplicaReady, Version: max(c.blob.Version, 1)}
+			if c.blob.Version != best.Version || c.blob.Checksum != best.Checksum {
+				rep.Status = ReplicaStale
+				if c.blob.Version == best.Version {
+					rep.MismatchChecksum = c.blob.Checksum
+				}
+			} else {
+				meta.StoredSize = max(meta.StoredSize, c.blob.StoredSize)
+				meta.CreatedAt = minTime(meta.CreatedAt, c.blob.ModifiedAt)
+			}
+			meta.Replicas = append(meta.Replicas, rep)
+		}
+		if len(votes) > 1 {
+			res.Disagreements++
+		}
+		sv.refreshState(meta)
+		if meta.State != StateAvailable {
+			res.Degraded++
+		}
+		files[id] = meta
+	}
+	res.Files = len(files)
+	return files
+}
+
+// minTime is the earlier of a and b.
+func minTime(a, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
+
+/* ==================== TOPOLOGY EXPORT ==================== */
+
+// topoFile is a file drawn in a topology export with its replica edges.
+type topoFile struct {
+	id, name string
+	replicas []ReplicaInfo
+}
+
+// handleExportTopology describes the cluster as a diagram:
+// GET /admin/export-topology?format=mermaid|dot&fileId=...&limit=10.
+// Nodes are grouped by zone; replica edges are drawn for the files named by
+// fileId (repeatable), or else for the limit most recently updated ones.
+func (sv *Server) handleExportTopology(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = "mermaid"
+	}
+	if format != "mermaid" && format != "dot" {
+		apierr.Write(w, http.StatusBadRequest, apierr.BadRequest, "format must be mermaid or dot")
+		return
+	}
+	limit := 10
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			apierr.Write(w, http.StatusBadRequest, apierr.BadRequest, "limit must be a non-negative integer")
+			return
+		}
+		limit = n
+	}
+
+	sv.store.mu.RLock()
+	nodes := make([]NodeInfo, 0, len(sv.store.nodes))
+	for _, n := range sv.store.nodes {
+		node := *n
+		node.Status = sv.stateOf(n)
+		nodes = append(nodes, node)
+	}
+	var files []topoFile
+	if ids := q["fileId"]; len(ids) > 0 {
+		for _, id := range ids {
+			meta, ok := sv.store.files[id]
+			if !ok {
+				sv.store.mu.RUnlock()
+				apierr.WriteDetail(w, http.StatusNotFound, apierr.FileNotFound, "file not found: "+id, map[string]string{"fileId": id})
+				return
+			}
+			files = append(files, topoFile{meta.FileID, meta.Filename, append([]ReplicaInfo(nil), meta.Replicas...)})
+		}
+	} else {
+		metas := make([]*FileMetadata, 0, len(sv.store.files))
+		for _, meta := range sv.store.files {
+			if meta.State != StateDeleted && meta.State != StateAllocated {
+				metas = append(metas, meta)
+			}
+		}
+		sort.Slice(metas, func(i, j int) bool { return metas[i].UpdatedAt.After(metas[j].UpdatedAt) })
+		if len(metas) > limit {
+			metas = metas[:limit]
+		}
+		for _, meta := range metas {
+			files = append(files, topoFile{meta.FileID, meta.Filename, append([]ReplicaInfo(nil), meta.Replicas...)})
+		}
+	}
+	sv.store.mu.RUnlock()
+
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Zone != nodes[j].Zone {
+			return nodes[i].Zone < nodes[j].Zone
+		}
+		return nodes[i].NodeID < nodes[j].NodeID
+	})
+	if format == "dot" {
+		w.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+		fmt.Fprint(w, topologyDot(nodes, files))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, topologyMermaid(nodes, files))
+}
+
+// topoID turns s into an identifier both Mermaid and Graphviz accept.
+func topoID(prefix, s string) string {
+	var b strings.Builder
+	b.WriteString(prefix)
+	for _, c := range s {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+			b.WriteRune(c)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+func topoNodeLabel(n *NodeInfo) string {
+	return fmt.Sprintf("%s|%s %.0f%%", n.NodeID, n.Status, loadFactor(n)*100)
+}
+
+// zoneGroups splits nodes (sorted by zone) into runs sharing a zone.
+func zoneGroups(nodes []NodeInfo) [][]NodeInfo {
+	var groups [][]NodeInfo
+	for i := 0; i < len(nodes); {
+		j := i
+		for j < len(nodes) && nodes[j].Zone == nodes[i].Zone {
+			j++
+		}
+		groups = append(groups, nodes[i:j])
+		i = j
+	}
+	return groups
+}
+
+func topologyMermaid(nodes []NodeInfo, files []topoFile) string {
+	esc := strings.NewReplacer(`"`, "#quot;").Replace
+	var b strings.Builder
+	b.WriteString("flowchart LR\n")
+	b.WriteString("    naming[\"Naming Service\"]\n")
+	for gi, group := range zoneGroups(nodes) {
+		indent := "    "
+		if zone := group[0].Zone; zone != "" {
+			fmt.Fprintf(&b, "    subgraph zone%d[\"zone %s\"]\n", gi, esc(zone))
+			indent = "        "
+		}
+		for i := range group {
+			n := &group[i]
+			fmt.Fprintf(&b, "%s%s[\"%s\"]:::%s\n", indent, topoID("n_", n.NodeID),
+				strings.Replace(esc(topoNodeLabel(n)), "|", "<br/>", 1), strings.ToLower(string(n.Status)))
+		}
+		if group[0].Zone != "" {
+			b.WriteString("    end\n")
+		}
+	}
+	for i := range nodes {
+		fmt.Fprintf(&b, "    naming -.- %s\n", topoID("n_", nodes[i].NodeID))
+	}
+	for _, f := range files {
+		id := topoID("f_", f.id)
+		fmt.Fprintf(&b, "    %s[(\"%s\")]\n", id, esc(f.name))
+		for _, rep := range f.replicas {
+			fmt.Fprintf(&b, "    %s -->|%s| %s\n", id, rep.Status, topoID("n_", rep.NodeID))
+		}
+	}
+	b.WriteString("    classDef healthy fill:#d4edda,stroke:#28a745\n")
+	b.WriteString("    classDef suspect fill:#fff3cd,stroke:#ffc107\n")
+	b.WriteString("    classDef down fill:#f8d7da,stroke:#dc3545\n")
+	b.WriteString("    classDef maintenance fill:#e2e3e5,stroke:#6c757d\n")
+	b.WriteString("    classDef read_only fill:#cce5ff,stroke:#007bff\n")
+	return b.String()
+}
+
+func topologyDot(nodes []NodeInfo, files []topoFile) string {
+	esc := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace
+	colors := map[NodeStatus]string{
+		NodeHealthy: "#d4edda", NodeSuspect: "#fff3cd", NodeDown: "#f8d7da",
+		NodeMaintenance: "#e2e3e5", NodeReadOnly: "#cce5ff",
+	}
+	var b strings.Builder
+	b.WriteString("digraph topology {\n")
+	b.WriteString("    rankdir=LR;\n")
+	b.WriteString("    node [fontname=\"Helvetica\"];\n")
+	b.WriteString("    naming [shape=box, label=\"Naming Service\"];\n")
+	for gi, group := range zoneGroups(nodes) {
+		indent := "    "
+		if zone := group[0].Zone; zone != "" {
+			fmt.Fprintf(&b, "    subgraph cluster_zone%d {\n        label=\"zone %s\";\n", gi, esc(zone))
+			indent = "        "
+		}
+		for i := range group {
+			n := &group[i]
+			fmt.Fprintf(&b, "%s%s [shape=box3d, style=filled, fillcolor=\"%s\", label=\"%s\"];\n", indent, topoID("n_", n.NodeID),
+				colors[n.Status], strings.Replace(esc(topoNodeLabel(n)), "|", `\n`, 1))
+		}
+		if group[0].Zone != "" {
+			b.WriteString("    }\n")
+		}
+	}
+	for i := range nodes {
+		fmt.Fprintf(&b, "    naming -> %s [style=dashed, arrowhead=none];\n", topoID("n_", nodes[i].NodeID))
+	}
+	for _, f := range files {
+		id := topoID("f_", f.id)
+		fmt.Fprintf(&b, "    %s [shape=note, label=\"%s\"];\n", id, esc(f.name))
+		for _, rep := range f.replicas {
+			fmt.Fprintf(&b, "    %s -> %s [label=\"%s\"];\n", id, topoID("n_", rep.NodeID), rep.Status)
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+/* ==================== IDEMPOTENCY ==================== */
+
+// idempotencyKeyHeader lets a client retry a POST, PUT or DELETE safely:
+// the first successful response to a key is stored and replayed, marked
+// with idempotentReplayHeader, for any retry carrying the same key.
+const (
+	idempotencyKeyHeader   = "Idempotency-Key"
+	idempotentReplayHeader = "Idempotent-Replayed"
+)
+
+// maxIdempotentBody caps the stored response; a bigger one is not kept
+// and a retry simply runs again.
+const maxIdempotentBody = 1 << 20
+
+// idemRecord is the stored response to one key. Fingerprint ties the key
+// to one request, so reusing it for a different one is refused.
+type idemRecord struct {
+	Fingerprint string    `json:"fingerprint"`
+	Status      int       `json:"status"`
+	ContentType string    `json:"contentType"`
+	Body        []byte    `json:"body"`
+	CreatedAt   time.Time `json:"createdAt"`
+	pending     bool      // the first request is still running
+}
+
+// idemBook holds stored responses by key and tombstones of deleted files,
+// both for ttl, persisted in metadata/idempotency.json so a retry after a
+// restart is still recognised.
+type idemBook struct {
+	mu        sync.Mutex
+	path      string
+	ttl       time.Duration
+	Responses map[string]*idemRecord `json:"responses"`
+	Deleted   map[string]time.Time   `json:"deleted"` // fileId -> when
+}
+
+func openIdemBook(path string, ttl time.Duration) (*idemBook, error) {
+	ib := &idemBook{path: path, ttl: ttl, Responses: map[string]*idemRecord{}, Deleted: map[string]time.Time{}}
+	if b, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(b, ib); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return ib, nil
+}
+
+// save drops what has outlived ttl and writes the rest. Callers hold mu.
+func (ib *idemBook) save() {
+	cutoff := now().Add(-ib.ttl)
+	maps.DeleteFunc(ib.Responses, func(_ string, rec *idemRecord) bool { return !rec.pending && rec.CreatedAt.Before(cutoff) })
+	maps.DeleteFunc(ib.Deleted, func(_ string, at time.Time) bool { return at.Before(cutoff) })
+	done := maps.Clone(ib.Responses)
+	maps.DeleteFunc(done, func(_ string, rec *idemRecord) bool { return rec.pending })
+	if err := writeJSONFile(ib.path, map[string]any{"responses": done, "deleted": ib.Deleted}); err != nil {
+		log.Printf("[IDEMPOTENCY] cannot save: %v", err)
+	}
+}
+
+// tombstone remembers that fileIDs were deleted, so deleting one again
+// succeeds instead of answering 404. The book is saved once for all.
+func (ib *idemBook) tombstone(fileIDs ...string) {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+	at := now()
+	for _, id := range fileIDs {
+		ib.Deleted[id] = at
+	}
+	ib.save()
+}
+
+func (ib *idemBook) deletedAt(fileID string) (time.Time, bool) {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+	at, ok := ib.Deleted[fileID]
+	return at, ok && now().Sub(at) < ib.ttl
+}
+
+// idempotent serves h once per Idempotency-Key. A retry gets the stored
+// response; a retry while the first request runs gets 409; the same key
+// on a different method, path or body gets 422. Only 2xx responses are
+// stored: an error changed nothing, so its retry runs again.
+func (sv *Server) idempotent(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			h(w, r)
+			return
+		}
+		if len(key) > 255 {
+			apierr.Write(w, http.StatusBadRequest, apierr.BadRequest, idempotencyKeyHeader+" is longer than 255 characters")
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			apierr.WriteDetail(w, http.StatusBadRequest, apierr.BadRequest, "cannot read body", err.Error())
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256([]byte(r.Method + " " + r.URL.RequestURI() + "\n" + string(body)))
+		fingerprint := hex.EncodeToString(sum[:])
+
+		ib := sv.idem
+		ib.mu.Lock()
+		rec, ok := ib.Responses[key]
+		if ok && !rec.pending && now().Sub(rec.CreatedAt) >= ib.ttl {
+			ok = false
+		}
+		switch {
+		case ok && rec.Fingerprint != fingerprint:
+			ib.mu.Unlock()
+			apierr.Write(w, http.StatusUnprocessableEntity, apierr.IdempotencyKeyReused, "this "+idempotencyKeyHeader+" was used for a different request")
+			return
+		case ok && rec.pending:
+			ib.mu.Unlock()
+			apierr.Write(w, http.StatusConflict, apierr.RequestInProgress, "a request with this "+idempotencyKeyHeader+" is still running")
+			return
+		case ok:
+			ib.mu.Unlock()
+			w.Header().Set("Content-Type", rec.ContentType)
+			w.Header().Set(idempotentReplayHeader, "true")
+			w.WriteHeader(rec.Status)
+			_, _ = w.Write(rec.Body)
+			return
+		}
+		ib.Responses[key] = &idemRecord{Fingerprint: fingerprint, pending: true}
+		ib.mu.Unlock()
+
+		rw := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+		finished := false
+		defer func() {
+			ib.mu.Lock()
+			defer ib.mu.Unlock()
+			if !finished || rw.status/100 != 2 || rw.overflow {
+				delete(ib.Responses, key)
+				return
+			}
+			ib.Responses[key] = &idemRecord{Fingerprint: fingerprint, Status: rw.status,
+				ContentType: w.Header().Get("Content-Type"), Body: rw.body.Bytes(), CreatedAt: now()}
+			ib.save()
+		}()
+		h(rw, r)
+		finished = true
+	}
+}
+
+// recordingWriter passes a response through and keeps a copy of it.
+type recordingWriter struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	rw.status = status
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	if !rw.overflow {
+		if rw.body.Len()+len(b) > maxIdempotentBody {
+			rw.overflow = true
+			rw.body.Reset()
+		} else {
+			rw.body.Write(b)
+		}
+	}
+	return rw.ResponseWriter.Write(b)
+}
+
+/* ==================== DRY RUN ==================== */
+
+// isDryRun reports whether a destructive request asked to preview its impact
+// with ?dryRun=true instead of applying it.
+func isDryRun(r *http.Request) bool {
+	v := strings.ToLower(r.URL.Query().Get("dryRun"))
+	return v == "true" || v == "1"
+}
+
+// changePlan is what a destructive operation would touch; it is returned
+// verbatim for dry runs.
+type changePlan struct {
+	DryRun bool     `json:"dryRun"`
+	Files  []string `json:"files"`
+	Nodes  []string `json:"nodes"`
+	Bytes  int64    `json:"bytes"`
+	nodes  map[string]bool
+}
+
+func newChangePlan() *changePlan {
+	return &changePlan{DryRun: true, Files: []string{}, Nodes: []string{}, nodes: map[string]bool{}}
+}
+
+// addFile counts every stored replica of f towards the plan.
+func (p *changePlan) addFile(f *FileMetadata) {
+	p.Files = append(p.Files, f.FileID)
+	for _, rep := range f.Replicas {
+		p.Bytes += storedSize(f)
+		p.addNode(rep.NodeID)
+	}
+}
+
+func (p *changePlan) addNode(nodeID string) {
+	if !p.nodes[nodeID] {
+		p.nodes[nodeID] = true
+		p.Nodes = append(p.Nodes, nodeID)
+	}
+}
+
+/* ==================== BATCH ==================== */
+
+// batchMaxFiles caps the files of one POST /batch; the whole batch is
+// checked and applied under the catalog lock.
+const batchMaxFiles = 1000
+
+// BatchRequest is the body of POST /batch: uploads to commit and files to
+// delete, applied together or not at all.
+type BatchRequest struct {
+	Commit []CommitRequest `json:"commit,omitempty"`
+	Delete []string        `json:"delete,omitempty"` // file IDs
+}
+
+// batchFailure is why one file of a refused batch could not be applied.
+type batchFailure struct {
+	FileID  string `json:"fileId"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// batchDeleted is one deleted file in a /batch answer.
+type batchDeleted struct {
+	FileID         string   `json:"fileId"`
+	Derived        []string `json:"derived"`
+	AlreadyDeleted bool     `json:"alreadyDeleted,omitempty"`
+
+	filename string // for the audit log
+}
+
+// handleBatch commits and deletes a group of files as one catalog change,
+// e.g. the files of a dataset. Every file is checked first: a commit must
+// be of the current version and reach the write quorum, a delete must name
+// a file that exists or was already deleted. If any fails, nothing is
+// changed and the answer is 409 with each failure; otherwise all of it is
+// applied under one lock, so no reader sees part of the batch, and written
+// in one save. The blobs of deleted files are left to the caller, as with
+// /files/{fileId}. With ?dryRun=true the batch is only checked; the answer
+// lists the commits and, as a change plan, what the deletes would remove.
+func (sv *Server) handleBatch(w http.ResponseWriter, r *http.Request) {
+	var body BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json")
+		return
+	}
+	n := len(body.Commit) + len(body.Delete)
+	if n == 0 || n > batchMaxFiles {
+		apierr.Write(w, http.StatusBadRequest, apierr.BadRequest, fmt.Sprintf("a batch has 1 to %d files, got %d", batchMaxFiles, n))
+		return
+	}
+	seen := map[string]bool{}
+	for _, id := range append(commitIDs(body.Commit), body.Delete...) {
+		if id == "" || seen[id] {
+			apierr.WriteDetail(w, http.StatusBadRequest, apierr.BadRequest, "every file of a batch needs a fileId, once", id)
+			return
+		}
+		seen[id] = true
+	}
+
+	sv.store.mu.Lock()
+	defer sv.store.mu.Unlock()
+	var failed []batchFailure
+	for _, c := range body.Commit {
+		meta, ok := sv.store.files[c.FileID]
+		switch {
+		case !ok:
+			failed = append(failed, batchFailure{c.FileID, apierr.FileNotFound, "fileId not found"})
+		case c.Version > 0 && c.Version != meta.Version:
+			failed = append(failed, batchFailure{c.FileID, apierr.VersionConflict, fmt.Sprintf("version %d is not current (%d)", c.Version, meta.Version)})
+		default:
+			quorum := min(sv.tunables().WriteQuorum, sv.factorOf(meta))
+			if got := commitReplicas(meta.clone(), c.Uploaded); got == 0 || got < quorum {
+				failed = append(failed, batchFailure{c.FileID, apierr.InsufficientReplicas, fmt.Sprintf("%d replicas uploaded, write quorum is %d", got, quorum)})
+			}
+		}
+	}
+	for _, id := range body.Delete {
+		if _, ok := sv.store.files[id]; !ok {
+			if _, gone := sv.idem.deletedAt(id); !gone {
+				failed = append(failed, batchFailure{id, apierr.FileNotFound, "file not found"})
+			}
+		}
+	}
+	if len(failed) > 0 {
+		apierr.WriteDetail(w, http.StatusConflict, apierr.Conflict,
+			fmt.Sprintf("%d of %d files cannot be applied; nothing was changed", len(failed), n), failed)
+		return
+	}
+	if isDryRun(r) {
+		plan := newChangePlan()
+		planned := map[string]bool{}
+		add := func(f *FileMetadata) {
+			if !planned[f.FileID] {
+				planned[f.FileID] = true
+				plan.addFile(f)
+			}
+		}
+		for _, id := range body.Delete {
+			meta, ok := sv.store.files[id]
+			if !ok {
+				continue
+			}
+			add(meta)
+			for _, d := range meta.Derived {
+				if f, ok := sv.store.files[d]; ok {
+					add(f)
+				}
+			}
+		}
+		writeJSONResp(w, map[string]any{"dryRun": true, "commit": commitIDs(body.Commit), "delete": plan})
+		return
+	}
+
+	committed := make([]commitResult, 0, len(body.Commit))
+	for _, c := range body.Commit {
+		res := sv.commit(sv.store.files[c.FileID], c)
+		res.FileID = c.FileID
+		committed = append(committed, res)
+	}
+	deleted := make([]batchDeleted, 0, len(body.Delete))
+	var gone []string
+	for _, id := range body.Delete {
+		meta, ok := sv.store.files[id]
+		if !ok { // deleted before, or with its parent in this batch
+			deleted = append(deleted, batchDeleted{FileID: id, Derived: []string{}, AlreadyDeleted: true})
+			continue
+		}
+		derived := sv.removeFile(meta)
+		deleted = append(deleted, batchDeleted{FileID: id, Derived: derived, filename: meta.Filename})
+		gone = append(append(gone, derived...), id)
+	}
+	if len(gone) > 0 {
+		sv.idem.tombstone(gone...)
+	}
+	sv.store.persist()
+	for _, d := range deleted {
+		if !d.AlreadyDeleted {
+			sv.record(r, "delete-file", d.FileID, d.filename)
+		}
+	}
+	writeJSONResp(w, map[string]any{"committed": committed, "deleted": deleted})
+}
+
+// commitIDs is the file IDs of commits.
+func commitIDs(commits []CommitRequest) []string {
+	ids := make([]string, len(commits))
+	for i, c := range commits {
+		ids[i] = c.FileID
+	}
+	return ids
+}
+
+/* ==================== SHARDING ==================== */
+
+// Shard is the part of the fileId space a naming service owns when the
+// catalog is split across several of them: the fileIds ShardOf puts at
+// Index. A lone naming service is shard 0 of 1.
+//
+// Every shard keeps its own catalog, heal queue, quotas and conflicts, and
+// the same node registry: storage nodes register and heartbeat with each
+// (NAMING_SHARDS). A router, the gateway's NAMING_SHARDS, sends per-file
+// calls to the owner and a new file to the shard its owner hashes to,
+// which picks an ID it owns; a shard's quotas hold because every file of
+// an owner it counts is there.
+type Shard struct {
+	Index int `json:"index"`
+	Count int `json:"count"`
+}
+
+// ShardOf is the shard of count that owns fileID: FNV-1a of the ID modulo
+// count. The gateway keeps a copy in its NAMING SHARDS section; the two
+// must agree, and the tests check both against one table.
+func ShardOf(fileID string, count int) int {
+	if count <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(fileID))
+	return int(h.Sum32() % uint32(count))
+}
+
+// ParseShard reads SHARD, "index/count" such as "1/4".
+func ParseShard(s string) (Shard, error) {
+	i, n, ok := strings.Cut(s, "/")
+	index, err1 := strconv.Atoi(i)
+	count, err2 := strconv.Atoi(n)
+	if !ok || err1 != nil || err2 != nil || count < 1 || index < 0 || index >= count {
+		return Shard{}, fmt.Errorf("shard %q is not index/count with 0 <= index < count, e.g. 0/4", s)
+	}
+	return Shard{Index: index, Count: count}, nil
+}
+
+func (sh Shard) owns(fileID string) bool { return ShardOf(fileID, sh.Count) == sh.Index }
+
+// mint calls gen until it returns an ID this shard owns, Count tries on
+// average. FileIds, share tokens, conflict and operation IDs are minted, so
+// a router can tell the shard to ask from any of them.
+func (sh Shard) mint(gen func() string) string {
+	for {
+		if id := gen(); sh.owns(id) {
+			return id
+		}
+	}
+}
+
+// refuseForeign answers 421 WRONG_SHARD, with the owning shard, when
+// fileID is not this shard's to create, and reports whether it did.
+func (sv *Server) refuseForeign(w http.ResponseWriter, fileID string) bool {
+	if sv.shard.owns(fileID) {
+		return false
+	}
+	apierr.WriteDetail(w, http.StatusMisdirectedRequest, apierr.WrongShard, "fileId belongs to another shard",
+		map[string]int{"shard": ShardOf(fileID, sv.shard.Count), "index": sv.shard.Index, "count": sv.shard.Count})
+	return true
+}
+
+/* ============== SHARED RESP & BOOTSTRAP ============== */
+
+func writeJSONResp(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func logRequest(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		h.ServeHTTP(w, r)
+		log.Printf("%s %s %s [%s]", r.Method, r.URL.Path, time.Since(start), r.Header.Get(apierr.RequestIDHeader))
+	})
+}
+
+// compressMin is the smallest response, by Content-Length, worth gzipping.
+const compressMin = 1 << 10
+
+var gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(io.Discard) }}
+
+// compressResponses gzips the response for a client that accepts it, when
+// the body is JSON, text or another compressible type and the handler has
+// not encoded it already. Ranges and bodies known to be tiny go out as
+// they are. zstd is not offered: the standard library has no encoder.
+func compressResponses(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponse{ResponseWriter: w}
+		defer gw.close()
+		h.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip. A
+// gzip entry wins over "*" wherever it appears, and q=0 refuses; a q that
+// does not parse counts as a refusal too.
+func acceptsGzip(header string) bool {
+	gz, star := -1.0, -1.0
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			if k, v, ok := strings.Cut(p, "="); ok && strings.EqualFold(strings.TrimSpace(k), "q") {
+				if q, _ = strconv.ParseFloat(strings.TrimSpace(v), 64); !(q >= 0 && q <= 1) {
+					q = 0
+				}
+			}
+		}
+		switch coding = strings.TrimSpace(coding); {
+		case strings.EqualFold(coding, "gzip"), strings.EqualFold(coding, "x-gzip"):
+			gz = max(gz, q)
+		case coding == "*":
+			star = max(star, q)
+		}
+	}
+	if gz >= 0 {
+		return gz > 0
+	}
+	return star > 0
+}
+
+// compressible reports whether a body of contentType shrinks under gzip.
+// Event streams are left alone, since gzip would hold events back.
+func compressible(contentType string) bool {
+	t, _, _ := strings.Cut(contentType, ";")
+	t = strings.ToLower(strings.TrimSpace(t))
+	switch {
+	case t == "text/event-stream":
+		return false
+	case strings.HasPrefix(t, "text/"), strings.HasSuffix(t, "+json"), strings.HasSuffix(t, "+xml"):
+		return true
+	}
+	switch t {
+	case "application/json", "application/x-ndjson", "application/javascript", "application/xml", "application/yaml":
+		return true
+	}
+	return false
+}
+
+// gzipResponse decides on compression when the header is written, then
+// sends the body through a pooled gzip.Writer.
+type gzipResponse struct {
+	http.ResponseWriter
+	gz      *gzip.Writer
+	decided bool
+}
+
+func (g *gzipResponse) WriteHeader(code int) {
+	if g.decided || code < 200 {
+		g.ResponseWriter.WriteHeader(code)
+		return
+	}
+	g.decided = true
+	h := g.Header()
+	if compressible(h.Get("Content-Type")) {
+		if !slices.Contains(h.Values("Vary"), "Accept-Encoding") {
+			h.Add("Vary", "Accept-Encoding")
+		}
+		size, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+		small := err == nil && size < compressMin
+		if !small && code != http.StatusNoContent && code != http.StatusPartialContent && code != http.StatusNotModified &&
+			h.Get("Content-Encoding") == "" && h.Get("Content-Range") == "" {
+			h.Del("Content-Length")
+			h.Set("Content-Encoding", "gzip")
+			if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				// the bytes on the wire are no longer the tagged ones
+				h.Set("ETag", "W/"+etag)
+			}
+			g.gz = gzipWriters.Get().(*gzip.Writer)
+			g.gz.Reset(g.ResponseWriter)
+		}
+	}
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *gzipResponse) Write(b []byte) (int, error) {
+	if !g.decided {
+		if g.Header().Get("Content-Type") == "" {
+			g.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.gz != nil {
+		return g.gz.Write(b)
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+func (g *gzipResponse) Flush() {
+	if g.gz != nil {
+		_ = g.gz.Flush()
+	}
+	_ = http.NewResponseController(g.ResponseWriter).Flush()
+}
+
+func (g *gzipResponse) Unwrap() http.ResponseWriter { return g.ResponseWriter }
+
+func (g *gzipResponse) close() {
+	if g.gz == nil {
+		return
+	}
+	_ = g.gz.Close()
+	g.gz.Reset(io.Discard)
+	gzipWriters.Put(g.gz)
+}
+
+/* ==================== SERVER ==================== */
+
+// Config is what NewServer needs; naming_service/main.go fills it from the
+// environment.
+type Config struct {
+	MetadataDir string   // catalog, settings, quotas, audit log, lifecycle rules
+	Seed        Settings // only used while MetadataDir has no settings.json
+	AdminToken  []byte   // guards /admin/*; empty disables the admin API
+	Debug       bool     // serve pprof, expvar and /debug/status behind AdminToken
+
+	AntiEntropyInterval    time.Duration // 0 disables
+	VerifyInterval         time.Duration // 0 disables the scheduled verifier
+	VerifyBatch            int
+	HealConcurrency        int
+	HealMaxAttempts        int
+	LifecycleInterval      time.Duration // 0 disables
+	BackupInterval         time.Duration // 0 disables
+	GeoReplicationInterval time.Duration // sweep and retry interval; 0 disables geo-replication
+	AlertInterval          time.Duration // how often alert rules are evaluated; 0 disables
+	CapacitySampleInterval time.Duration // how often node usage is sampled for /capacity-forecast; 0 disables
+	MetricsSampleInterval  time.Duration // how often /metrics/history is sampled; 0 disables
+	PersistInterval        time.Duration // catalog and node history writes are coalesced to one per interval; 0 writes after every change
+
+	Shard Shard // the fileIds this naming service owns; zero owns them all
+
+	// TicketSecret (UPLOAD_TICKET_SECRET) is shared with the storage nodes
+	// and the gateway; the naming service signs upload tickets with it.
+	TicketSecret []byte
+
+	PlacementWebhook string // consulted on every allocation when set
+	PlacementTimeout time.Duration
+	// Placements add strategies to the built-in ones, or replace one, so
+	// Seed and /admin/settings may name their policies.
+	Placements map[PlacementPolicy]PlacementStrategy
+
+	Transport TransportConfig
+	NodeCalls CallPolicy
+
+	Discovery DiscoveryConfig
+
+	// IdempotencyTTL is how long Idempotency-Key responses and deleted
+	// file IDs are remembered; 0 means 24h.
+	IdempotencyTTL time.Duration
+}
+
+// NewServer opens the catalog in cfg.MetadataDir.
+func NewServer(cfg Config) (*Server, error) {
+	if err := checkStorageClasses(); err != nil {
+		return nil, err
+	}
+	store, err := NewStore(cfg.MetadataDir, cfg.PersistInterval)
+	if err != nil {
+		return nil, err
+	}
+	sv := &Server{store: store, ops: newOpRegistry(), audit: openAuditLog(filepath.Join(cfg.MetadataDir, "audit.log")), access: newAccessStats()}
+	sv.transport, sv.nodeCalls = newTransport(cfg.Transport), newResilientClient(cfg.NodeCalls)
+	sv.placements = builtinPlacements()
+	maps.Copy(sv.placements, cfg.Placements)
+	if err := sv.loadSettings(cfg.Seed); err != nil {
+		return nil, err
+	}
+	sv.adminToken, sv.debug = cfg.AdminToken, cfg.Debug
+	sv.ticketSecret = cfg.TicketSecret
+	sv.placementURL, sv.placementTimeout = cfg.PlacementWebhook, cfg.PlacementTimeout
+	sv.shard = cfg.Shard
+	if sv.shard.Count == 0 {
+		sv.shard.Count = 1
+	}
+	sv.ops.shard, store.conflicts.shard = sv.shard, sv.shard
+	sv.antiEntropyEvery, sv.verifyEvery, sv.verifyBatch = cfg.AntiEntropyInterval, cfg.VerifyInterval, cfg.VerifyBatch
+	sv.stopCh = make(chan struct{})
+	sv.quit = make(chan struct{})
+	sv.healWake = make(chan struct{}, 1)
+	sv.heal = newHealQueue(cfg.HealConcurrency, cfg.HealMaxAttempts)
+	sv.track = newNodeTrack()
+	sv.history, err = openNodeHistory(filepath.Join(cfg.MetadataDir, "node-history.json"), cfg.PersistInterval)
+	if err != nil {
+		return nil, err
+	}
+	sv.inventory = newInventoryTracker()
+	sv.lifecycle, err = openLifecycle(filepath.Join(cfg.MetadataDir, "lifecycle.json"))
+	if err != nil {
+		return nil, err
+	}
+	sv.lifecycle.every = cfg.LifecycleInterval
+	sv.backups, err = openBackups(filepath.Join(cfg.MetadataDir, "backup.json"), filepath.Join(cfg.MetadataDir, "backup-state.json"))
+	if err != nil {
+		return nil, err
+	}
+	sv.backups.every = cfg.BackupInterval
+	sv.geo, err = openGeoReplication(filepath.Join(cfg.MetadataDir, "geo-peers.json"), filepath.Join(cfg.MetadataDir, "geo-state.json"))
+	if err != nil {
+		return nil, err
+	}
+	sv.geo.every = cfg.GeoReplicationInterval
+	sv.alerts, err = openAlerts(filepath.Join(cfg.MetadataDir, "alerts.json"))
+	if err != nil {
+		return nil, err
+	}
+	sv.alerts.every = cfg.AlertInterval
+	sv.capacity, err = openCapacityHistory(filepath.Join(cfg.MetadataDir, "capacity-history.json"))
+	if err != nil {
+		return nil, err
+	}
+	sv.capacity.every = cfg.CapacitySampleInterval
+	sv.metrics, err = openMetricsHistory(filepath.Join(cfg.MetadataDir, "metrics-history.json"))
+	if err != nil {
+		return nil, err
+	}
+	sv.metrics.every = cfg.MetricsSampleInterval
+	sv.discovery = cfg.Discovery
+	sv.idem, err = openIdemBook(filepath.Join(cfg.MetadataDir, "idempotency.json"), cmp.Or(cfg.IdempotencyTTL, 24*time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	return sv, nil
+}
+
+// ServeMux routes every naming service endpoint, as listed by routes.
+func (sv *Server) ServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	for _, rt := range sv.routes() {
+		h := rt.handler
+		if rt.writable {
+			h = sv.writable(h)
+		}
+		if rt.method != http.MethodGet {
+			h = sv.idempotent(h)
+		}
+		if rt.admin {
+			h = sv.admin(h)
+		}
+		mux.HandleFunc(rt.method+" "+rt.path, h)
+	}
+	if sv.debug {
+		diag.Register(mux, sv.admin, "naming-service", Version, sv.debugGauges)
+	}
+	mux.HandleFunc("/", apierr.NoRoute(mux))
+	return mux
+}
+
+// debugGauges are the naming service's own figures on /debug/status.
+func (sv *Server) debugGauges() map[string]any {
+	sv.store.mu.RLock()
+	files, open := len(sv.store.files), 0
+	for _, meta := range sv.store.files {
+		if meta.State == StateAllocated {
+			open++
+		}
+	}
+	nodes, revision := len(sv.store.nodes), sv.store.revision
+	sv.store.mu.RUnlock()
+	pending, _ := sv.heal.snapshot()
+	running := 0
+	for _, op := range sv.ops.list() {
+		if op.State == OpRunning {
+			running++
+		}
+	}
+	return map[string]any{
+		"files":           files,
+		"openUploads":     open, // allocated, not yet committed
+		"nodes":           nodes,
+		"catalogRevision": revision,
+		"healJobs":        len(pending),
+		"operations":      running,
+	}
+}
+
+/* ==================== ROUTES & OPENAPI ==================== */
+
+// route is one operation of the HTTP API. ServeMux serves the routes and
+// /openapi.json describes them, so the spec cannot drift from what is
+// served. Each route is registered as a method pattern, so a handler only
+// sees its own methods.
+type route struct {
+	method  string
+	path    string // {name} segments are path parameters
+	id      string // operationId; the method name in generated clients
+	tag     string
+	summary string
+	query   []string // optional query parameters
+	body    any      // zero value of the JSON request body; nil = none
+	returns any      // zero value of the JSON response; nil = an untyped object
+	status  int      // success status when it is not 200
+	raw     string   // content type of a response that is not JSON
+
+	admin    bool // needs the ADMIN_TOKEN bearer token
+	writable bool // refused in maintenance mode
+	handler  http.HandlerFunc
+}
+
+// routes lists the API. It only takes method values, so it works on a nil
+// *Server; OpenAPI relies on that.
+func (sv *Server) routes() []route {
+	return []route{
+		// Node management
+		{method: "POST", path: "/register-node", id: "registerNode", tag: "nodes", summary: "Register a storage node, or re-register it after a restart", body: RegisterNodeRequest{}, handler: sv.handleRegisterNode},
+		{method: "POST", path: "/heartbeat", id: "heartbeat", tag: "nodes", summary: "Report a node's usage, reads and inventory", body: HeartbeatRequest{}, handler: sv.handleHeartbeat},
+		{method: "POST", path: "/peer-report", id: "peerReport", tag: "nodes", summary: "Report which peers a node can reach", body: PeerReportRequest{}, handler: sv.handlePeerReport},
+		{method: "GET", path: "/discovery", id: "discovery", tag: "nodes", summary: "Node discovery mode and last result", handler: sv.handleDiscovery},
+
+		// File operations
+		{method: "POST", path: "/allocate", id: "allocate", tag: "files", summary: "Allocate a file ID and replica nodes for an upload", body: AllocateRequest{}, writable: true, handler: sv.handleAllocate},
+		{method: "POST", path: "/commit", id: "commit", tag: "files", summary: "Commit the replicas an upload reached", body: CommitRequest{}, writable: true, handler: sv.handleCommit},
+		{method: "POST", path: "/batch", id: "batch", tag: "files", summary: "Commit and delete a group of files, all or none", query: []string{"dryRun"}, body: BatchRequest{}, writable: true, handler: sv.handleBatch},
+		{method: "GET", path: "/lookup/{fileId}", id: "lookup", tag: "files", summary: "Replicas to download a file from, healthy nodes first", query: []string{"peek"}, returns: []LookupReplica{}, handler: sv.handleLookup},
+		{method: "POST", path: "/report-missing", id: "reportMissing", tag: "files", summary: "Report a replica a node no longer has", body: ReportMissingRequest{}, handler: sv.handleReportMissing},
+		{method: "POST", path: "/report-incident", id: "reportIncident", tag: "files", summary: "Report a checksum mismatch or other incident", body: ReportIncidentRequest{}, handler: sv.handleReportIncident},
+		{method: "DELETE", path: "/files/{fileId}", id: "deleteFile", tag: "files", summary: "Delete a file and its replicas", query: []string{"dryRun"}, writable: true, handler: sv.handleDeleteFile},
+		{method: "POST", path: "/delete-file", id: "deleteFileLegacy", tag: "files", summary: "Delete a file (deprecated: use DELETE /files/{fileId})", query: []string{"dryRun"}, body: DeleteFileRequest{}, writable: true, handler: sv.handleDeleteFile},
+		{method: "POST", path: "/files/{fileId}/copy", id: "copyFile", tag: "files", summary: "Copy a file on the nodes that hold it, without moving its bytes", body: CopyFileRequest{}, status: http.StatusCreated, writable: true, handler: sv.handleCopyFile},
+		{method: "POST", path: "/files/{fileId}/storage-class", id: "changeStorageClass", tag: "files", summary: "Move a file to another storage class", body: ChangeClassRequest{}, writable: true, handler: sv.handleChangeClass},
+		{method: "GET", path: "/storage-classes", id: "storageClasses", tag: "files", summary: "The storage classes and what they mean", handler: sv.handleStorageClasses},
+		{method: "POST", path: "/files/{fileId}/move", id: "moveFile", tag: "files", summary: "Move a file to another folder or owner", body: MoveFileRequest{}, writable: true, handler: sv.handleMoveFile},
+		{method: "POST", path: "/rename-file", id: "renameFile", tag: "files", summary: "Rename a file", body: RenameFileRequest{}, writable: true, handler: sv.handleRenameFile},
+		{method: "GET", path: "/permissions/{fileId}", id: "getPermissions", tag: "files", summary: "A file's owner and ACL", handler: sv.handlePermissions},
+		{method: "PUT", path: "/permissions/{fileId}", id: "setPermissions", tag: "files", summary: "Replace a file's ACL and optionally its owner", body: PermissionsRequest{}, handler: sv.handlePermissions},
+		{method: "POST", path: "/move-replica", id: "moveReplica", tag: "files", summary: "Move a replica to another node", body: MoveReplicaRequest{}, writable: true, handler: sv.handleMoveReplica},
+		{method: "GET", path: "/verify-file", id: "verifyFile", tag: "files", summary: "Check every replica of a file against its checksum", query: []string{"fileId", "timeout"}, handler: sv.handleVerifyFile},
+		{method: "GET", path: "/verify-file/{fileId}", id: "verifyFileByPath", tag: "files", summary: "Check every replica of a file against its checksum", query: []string{"timeout"}, handler: sv.handleVerifyFile},
+		{method: "POST", path: "/heal/{fileId}", id: "heal", tag: "files", summary: "Repair a file now, ahead of the heal sweep", writable: true, handler: sv.handleHeal},
+
+		// Conflicts
+		{method: "GET", path: "/conflicts", id: "listConflicts", tag: "conflicts", summary: "Uploads of the same filename with different content", query: []string{"owner"}, handler: sv.handleConflicts},
+		{method: "GET", path: "/conflicts/{conflictId}", id: "getConflict", tag: "conflicts", summary: "One conflict and its files", returns: ConflictStatus{}, handler: sv.handleConflict},
+		{method: "POST", path: "/conflicts/{conflictId}/resolve", id: "resolveConflict", tag: "conflicts", summary: "Resolve a conflict: keep-newest, keep-both or pick", query: []string{"dryRun"}, body: ResolveConflictRequest{}, writable: true, handler: sv.handleResolveConflict},
+
+		// Shares
+		{method: "GET", path: "/shares", id: "listShares", tag: "shares", summary: "List share links", query: []string{"fileId"}, handler: sv.handleShares},
+		{method: "POST", path: "/shares", id: "createShare", tag: "shares", summary: "Create a share link", body: CreateShareRequest{}, returns: ShareStatus{}, status: http.StatusCreated, handler: sv.handleShares},
+		{method: "POST", path: "/shares/open", id: "openShare", tag: "shares", summary: "Count a download through a share link", body: OpenShareRequest{}, handler: sv.handleOpenShare},
+		{method: "DELETE", path: "/shares/{token}", id: "revokeShare", tag: "shares", summary: "Revoke a share link", writable: true, handler: sv.handleRevokeShare},
+		{method: "POST", path: "/shares/revoke", id: "revokeShareLegacy", tag: "shares", summary: "Revoke a share link (deprecated: use DELETE /shares/{token})", body: RevokeShareRequest{}, writable: true, handler: sv.handleRevokeShare},
+
+		// Monitoring & metrics
+		{method: "GET", path: "/metrics", id: "metrics", tag: "monitoring", summary: "Cluster totals", handler: sv.handleMetrics},
+		{method: "GET", path: "/metrics/history", id: "metricsHistory", tag: "monitoring", summary: "Cluster totals sampled over time", query: []string{"window", "step"}, handler: sv.handleMetricsHistory},
+		{method: "GET", path: "/list-files", id: "listFiles", tag: "monitoring", summary: "Every file in the catalog", returns: []FileSummary{}, handler: sv.handleListFiles},
+		{method: "GET", path: "/list-nodes", id: "listNodes", tag: "monitoring", summary: "Every registered node", returns: []NodeInfo{}, handler: sv.handleListNodes},
+		{method: "GET", path: "/node-health/{nodeId}", id: "nodeHealth", tag: "monitoring", summary: "Why a node has its status", handler: sv.handleNodeHealth},
+		{method: "GET", path: "/node-history/{nodeId}", id: "nodeHistory", tag: "monitoring", summary: "A node's health transitions and whether it is flapping", returns: nodeHistoryResult{}, handler: sv.handleNodeHistory},
+		{method: "GET", path: "/file-info/{fileId}", id: "fileInfo", tag: "monitoring", summary: "A file's full metadata", returns: FileMetadata{}, handler: sv.handleFileInfo},
+		{method: "GET", path: "/cluster-info", id: "clusterInfo", tag: "monitoring", summary: "Version, settings and node counts", handler: sv.handleClusterInfo},
+		{method: "GET", path: "/operations", id: "listOperations", tag: "monitoring", summary: "Background operations", query: []string{"state"}, handler: sv.handleListOperations},
+		{method: "POST", path: "/operations/cancel", id: "cancelOperation", tag: "monitoring", summary: "Cancel a running operation", body: CancelOperationRequest{}, admin: true, handler: sv.handleCancelOperation},
+		{method: "GET", path: "/audit", id: "listAudit", tag: "monitoring", summary: "Audit log entries", query: []string{"since", "action"}, handler: sv.handleAudit},
+		{method: "POST", path: "/audit", id: "recordAudit", tag: "monitoring", summary: "Record an audit entry from another service", body: AuditRequest{}, admin: true, handler: sv.handleAudit},
+		{method: "GET", path: "/popular", id: "popular", tag: "monitoring", summary: "Most read files", query: []string{"window", "by", "limit"}, handler: sv.handlePopular},
+		{method: "GET", path: "/stats/files/top", id: "topFiles", tag: "monitoring", summary: "Most read files (alias of /popular)", query: []string{"window", "by", "limit"}, handler: sv.handlePopular},
+		{method: "GET", path: "/stats/nodes", id: "nodeStats", tag: "monitoring", summary: "Bytes served per node", query: []string{"window"}, handler: sv.handleNodeStats},
+		{method: "GET", path: "/integrity-report", id: "integrityReport", tag: "monitoring", summary: "Replication and checksum health of every file", query: []string{"format", "problems", "staleAfter"}, handler: sv.handleIntegrityReport},
+		{method: "GET", path: "/heal-queue", id: "healQueue", tag: "monitoring", summary: "Files waiting to be healed", handler: sv.handleHealQueue},
+		{method: "GET", path: "/lifecycle", id: "lifecycle", tag: "monitoring", summary: "Lifecycle rules and the last pass", handler: sv.handleLifecycle},
+		{method: "GET", path: "/geo-replication", id: "geoReplicationStatus", tag: "monitoring", summary: "Geo-replication queues, lag and conflicts per peer", handler: sv.handleGeoStatus},
+		{method: "GET", path: "/capacity-forecast", id: "capacityForecast", tag: "monitoring", summary: "Days until full per node and cluster-wide, and nodes to add", query: []string{"window", "horizonDays", "series"}, handler: sv.handleCapacityForecast},
+		{method: "GET", path: "/alerts", id: "alerts", tag: "monitoring", summary: "Alert rules and which are firing", query: []string{"state"}, handler: sv.handleAlerts},
+		{method: "GET", path: "/backup-status", id: "backupStatus", tag: "monitoring", summary: "What each backup target has and how its last run went", handler: sv.handleBackupStatus},
+		{method: "GET", path: "/quota", id: "quota", tag: "monitoring", summary: "Quota usage", query: []string{"owner"}, handler: sv.handleQuota},
+		{method: "GET", path: "/openapi.json", id: "openAPI", tag: "monitoring", summary: "This API as an OpenAPI 3 document", handler: sv.handleOpenAPI},
+
+		// Admin
+		{method: "POST", path: "/admin/override-serve", id: "overrideServe", tag: "admin", summary: "Serve a CORRUPT file anyway, or stop doing so", body: OverrideServeRequest{}, admin: true, handler: sv.handleOverrideServe},
+		{method: "POST", path: "/admin/set-replication", id: "setReplication", tag: "admin", summary: "Change a file's replication factor", query: []string{"dryRun"}, body: SetReplicationRequest{}, admin: true, writable: true, handler: sv.handleSetReplication},
+		{method: "POST", path: "/admin/recheck", id: "recheck", tag: "admin", summary: "Verify a file's replicas now", query: []string{"fileId", "timeout"}, admin: true, handler: sv.handleVerifyFile},
+		{method: "POST", path: "/admin/stop", id: "stop", tag: "admin", summary: "Stop the naming service gracefully", admin: true, handler: sv.handleAdminStop},
+		{method: "POST", path: "/admin/maintenance-mode", id: "setMaintenanceMode", tag: "admin", summary: "Make the catalog read-only, or writable again", body: MaintenanceModeRequest{}, admin: true, handler: sv.handleAdminMaintenance},
+		{method: "POST", path: "/admin/reload", id: "reload", tag: "admin", summary: "Reload the catalog from disk", admin: true, handler: sv.handleAdminReload},
+		{method: "GET", path: "/admin/snapshot", id: "exportSnapshot", tag: "admin", summary: "The catalog as of now, for /admin/restore", returns: ClusterSnapshot{}, admin: true, handler: sv.handleSnapshot},
+		{method: "POST", path: "/admin/snapshot", id: "storeSnapshot", tag: "admin", summary: "Store a catalog snapshot on storage nodes", body: SnapshotRequest{}, admin: true, handler: sv.handleSnapshot},
+		{method: "POST", path: "/admin/restore", id: "restoreSnapshot", tag: "admin", summary: "Load a catalog snapshot", query: []string{"dryRun"}, body: RestoreRequest{}, admin: true, handler: sv.handleRestore},
+		{method: "POST", path: "/admin/rebuild-metadata", id: "rebuildMetadata", tag: "admin", summary: "Rebuild the catalog from the blobs on the storage nodes", query: []string{"dryRun"}, body: RebuildRequest{}, returns: rebuildResult{}, admin: true, handler: sv.handleRebuildMetadata},
+		{method: "POST", path: "/admin/node-maintenance", id: "setNodeMaintenance", tag: "admin", summary: "Put a node into maintenance, or take it out", query: []string{"dryRun"}, body: NodeMaintenanceRequest{}, admin: true, handler: sv.handleNodeMaintenance},
+		{method: "GET", path: "/admin/settings", id: "getSettings", tag: "admin", summary: "Runtime settings", returns: Settings{}, admin: true, handler: sv.handleSettings},
+		{method: "PUT", path: "/admin/settings", id: "updateSettings", tag: "admin", summary: "Change runtime settings", body: Settings{}, admin: true, handler: sv.handleSettings},
+		{method: "GET", path: "/admin/placement-policy", id: "getPlacementPolicy", tag: "admin", summary: "The placement policy and the ones available", admin: true, handler: sv.handlePlacementPolicy},
+		{method: "PUT", path: "/admin/placement-policy", id: "setPlacementPolicy", tag: "admin", summary: "Switch the placement policy", body: PlacementPolicyRequest{}, admin: true, handler: sv.handlePlacementPolicy},
+		{method: "GET", path: "/admin/export-topology", id: "exportTopology", tag: "admin", summary: "Nodes and replicas as a Mermaid or DOT diagram", query: []string{"format", "limit"}, raw: "text/plain", admin: true, handler: sv.handleExportTopology},
+		{method: "PUT", path: "/admin/quota", id: "setQuota", tag: "admin", summary: "Set or remove an owner's quota", body: SetQuotaRequest{}, admin: true, handler: sv.handleSetQuota},
+		{method: "PUT", path: "/admin/lifecycle", id: "setLifecycle", tag: "admin", summary: "Replace the lifecycle rules", query: []string{"dryRun"}, body: SetLifecycleRequest{}, admin: true, handler: sv.handleSetLifecycle},
+		{method: "POST", path: "/admin/lifecycle/run", id: "runLifecycle", tag: "admin", summary: "Run a lifecycle pass now", query: []string{"dryRun"}, admin: true, handler: sv.handleRunLifecycle},
+		{method: "GET", path: "/admin/backup", id: "getBackupTargets", tag: "admin", summary: "Backup targets, secrets masked", admin: true, handler: sv.handleBackup},
+		{method: "PUT", path: "/admin/backup", id: "setBackupTargets", tag: "admin", summary: "Replace the backup targets", body: SetBackupRequest{}, admin: true, handler: sv.handleSetBackup},
+		{method: "POST", path: "/admin/backup/run", id: "runBackup", tag: "admin", summary: "Start a backup run now", query: []string{"target"}, admin: true, handler: sv.handleRunBackup},
+		{method: "GET", path: "/admin/alerts", id: "getAlertConfig", tag: "admin", summary: "Alert rules and channels, secrets masked", admin: true, handler: sv.handleAlertConfig},
+		{method: "PUT", path: "/admin/alerts", id: "setAlertConfig", tag: "admin", summary: "Replace the alert rules and channels", body: SetAlertsRequest{}, admin: true, handler: sv.handleSetAlerts},
+		{method: "POST", path: "/admin/alerts/test", id: "testAlert", tag: "admin", summary: "Send a test notification", query: []string{"channel"}, admin: true, handler: sv.handleTestAlert},
+		{method: "GET", path: "/admin/geo-replication", id: "getGeoPeers", tag: "admin", summary: "Geo-replication peers, tokens masked", admin: true, handler: sv.handleGeoPeers},
+		{method: "PUT", path: "/admin/geo-replication", id: "setGeoPeers", tag: "admin", summary: "Replace the geo-replication peers", body: SetGeoPeersRequest{}, admin: true, handler: sv.handleSetGeoPeers},
+		{method: "POST", path: "/admin/geo-replication/receive", id: "geoReceive", tag: "admin", summary: "Take a file a peer cluster pushes", body: GeoReceiveRequest{}, returns: geoReceiveResponse{}, admin: true, writable: true, handler: sv.handleGeoReceive},
+	}
+}
+
+// OpenAPI is the OpenAPI 3 document for the naming service, built from
+// routes. cmd/openapi writes it to api/ for the client generator.
+func OpenAPI() []byte {
+	doc := openAPIDoc("Naming Service", Version, (*Server)(nil).routes())
+	doc["components"].(map[string]any)["securitySchemes"] = map[string]any{
+		"adminToken": map[string]any{"type": "http", "scheme": "bearer", "description": "ADMIN_TOKEN"},
+	}
+	b, _ := json.MarshalIndent(doc, "", "  ")
+	return append(b, '\n')
+}
+
+func (sv *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(OpenAPI())
+}
+
+var pathParam = regexp.MustCompile(`\{(\w+)\}`)
+
+// openAPIDoc describes routes. Request and response types are turned into
+// schemas by reflection over their JSON fields.
+func openAPIDoc(title, version string, routes []route) map[string]any {
+	schemas := map[string]any{}
+	paths := map[string]any{}
+	errorSchema := schemaOf(schemas, reflect.TypeFor[apierr.Error]())
+	for _, rt := range routes {
+		var params []any
+		for _, m := range pathParam.FindAllStringSubmatch(rt.path, -1) {
+			params = append(params, map[string]any{"name": m[1], "in": "path", "required": true, "schema": map[string]any{"type": "string"}})
+		}
+		for _, q := range rt.query {
+			params = append(params, map[string]any{"name": q, "in": "query", "schema": map[string]any{"type": "string"}})
+		}
+		var content map[string]any
+		switch {
+		case rt.raw != "":
+			content = map[string]any{rt.raw: map[string]any{"schema": map[string]any{"type": "string"}}}
+		case rt.returns != nil:
+			content = map[string]any{"application/json": map[string]any{"schema": schemaOf(schemas, reflect.TypeOf(rt.returns))}}
+		default:
+			content = map[string]any{"application/json": map[string]any{"schema": map[string]any{"type": "object"}}}
+		}
+		status := cmp.Or(rt.status, http.StatusOK)
+		responses := map[string]any{
+			strconv.Itoa(status): map[string]any{"description": http.StatusText(status), "content": content},
+			"default":            map[string]any{"description": "Error", "content": map[string]any{"application/json": map[string]any{"schema": errorSchema}}},
+		}
+		if rt.writable {
+			responses["503"] = map[string]any{"description": "The naming service is in maintenance mode (read-only)"}
+		}
+		op := map[string]any{"operationId": rt.id, "summary": rt.summary, "tags": []string{rt.tag}, "responses": responses}
+		if params != nil {
+			op["parameters"] = params
+		}
+		if rt.body != nil {
+			op["requestBody"] = map[string]any{"required": true, "content": map[string]any{
+				"application/json": map[string]any{"schema": schemaOf(schemas, reflect.TypeOf(rt.body))},
+			}}
+		}
+		if rt.admin {
+			op["security"] = []any{map[string]any{"adminToken": []string{}}}
+		}
+		if paths[rt.path] == nil {
+			paths[rt.path] = map[string]any{}
+		}
+		paths[rt.path].(map[string]any)[strings.ToLower(rt.method)] = op
+	}
+	return map[string]any{
+		"openapi":    "3.0.3",
+		"info":       map[string]any{"title": title, "version": version},
+		"paths":      paths,
+		"components": map[string]any{"schemas": schemas},
+	}
+}
+
+var (
+	timeType          = reflect.TypeFor[time.Time]()
+	textMarshalerType = reflect.TypeFor[encoding.TextMarshaler]()
+)
+
+// schemaOf returns the JSON schema of t as encoding/json marshals it.
+// Named structs go into schemas and are referenced, so recursive types
+// terminate.
+func schemaOf(schemas map[string]any, t reflect.Type) map[string]any {
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t.Kind() != reflect.Pointer && reflect.PointerTo(t).Implements(textMarshalerType):
+		return map[string]any{"type": "string"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaOf(schemas, t.Elem())
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]any{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": schemaOf(schemas, t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaOf(schemas, t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(schemas, t)
+		}
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if _, ok := schemas[name]; !ok {
+			schemas[name] = nil // placeholder while the fields are walked
+			schemas[name] = structSchema(schemas, t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]any{} // interfaces: anything
+}
+
+func structSchema(schemas map[string]any, t reflect.Type) map[string]any {
+	props := map[string]any{}
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		for i := range t.NumField() {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" || (!f.IsExported() && !f.Anonymous) {
+				continue
+			}
+			name, _, _ := strings.Cut(tag, ",")
+			if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+				walk(f.Type) // embedded fields are promoted
+				continue
+			}
+			props[cmp.Or(name, f.Name)] = schemaOf(schemas, f.Type)
+		}
+	}
+	walk(t)
+	return map[string]any{"type": "object", "properties": props}
+}
+
+// Handler is ServeMux with request IDs, logging and response compression,
+// as main serves it.
+func (sv *Server) Handler() http.Handler {
+	return apierr.WithRequestID(logRequest(compressResponses(sv.ServeMux())))
+}
+
+// Start launches the background jobs: auto-healing always, anti-entropy,
+// the verifier and lifecycle rules when their interval is set.
+func (sv *Server) Start() {
+	sv.startAutoHealing()
+	go sv.every(sv.tunables().defaultHeartbeat()/2, sv.watchHealth)
+	if sv.antiEntropyEvery > 0 {
+		sv.startAntiEntropy(sv.antiEntropyEvery)
+	}
+	if sv.verifyEvery > 0 {
+		sv.startVerifier(sv.verifyEvery, sv.verifyBatch)
+	}
+	if sv.lifecycle.every > 0 {
+		sv.startLifecycle(sv.lifecycle.every)
+	}
+	if sv.backups.every > 0 {
+		sv.startBackups(sv.backups.every)
+	}
+	if sv.geo.every > 0 {
+		sv.startGeoReplication(sv.geo.every)
+	}
+	if sv.alerts.every > 0 {
+		sv.startAlerts(sv.alerts.every)
+	}
+	if sv.capacity.every > 0 {
+		sv.startCapacitySampling(sv.capacity.every)
+	}
+	if sv.metrics.every > 0 {
+		sv.startMetricsSampling(sv.metrics.every)
+	}
+	if sv.discovery.Mode != "" {
+		sv.startDiscovery()
+	}
+}
+
+// Stopping is closed once /admin/stop has asked the service to shut down.
+func (sv *Server) Stopping() <-chan struct{} {
+	return sv.stopCh
+}
+
+// Close ends the background jobs and persists the catalog, the node and
+// metrics histories. Requests still in flight must be drained first.
+func (sv *Server) Close() {
+	sv.quitOnce.Do(func() { close(sv.quit) })
+	sv.store.close()
+	sv.history.saver.close()
+	sv.metrics.save()
+	sv.transport.CloseIdleConnections()
+}
+
+// every runs fn on a ticker until Close.
+func (sv *Server) every(d time.Duration, fn func()) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fn()
+		case <-sv.quit:
+			return
+		}
+	}
+}
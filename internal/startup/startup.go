@@ -0,0 +1,234 @@
+// Package startup reads and validates a service's environment
+// configuration. The ui_gateway module cannot import it and keeps a copy in
+// ui_gateway/internal/startup; keep the two files identical (the package
+// test and make check-startup fail when they differ).
+package startup
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExitConfig is the exit status for invalid configuration (EX_CONFIG from
+// sysexits.h), so a process manager can tell it apart from a crash.
+const ExitConfig = 78
+
+// Check validates environment configuration at startup. Every problem is
+// collected so an operator sees all of them at once, then Done refuses to
+// start the service instead of running with silently ignored settings.
+type Check struct {
+	service  string
+	settings [][2]string
+	problems []string
+}
+
+// New starts a Check for service, the name its summary is logged under.
+func New(service string) *Check {
+	return &Check{service: service}
+}
+
+// Fail records a problem.
+func (cc *Check) Fail(format string, args ...any) {
+	cc.problems = append(cc.problems, fmt.Sprintf(format, args...))
+}
+
+// Str reads key, def when it is unset or empty.
+func (cc *Check) Str(key, def string) string {
+	v := os.Getenv(key)
+	if v == "" {
+		v = def
+	}
+	cc.settings = append(cc.settings, [2]string{key, v})
+	return v
+}
+
+// Secret reads key without echoing its value in the summary.
+func (cc *Check) Secret(key string) string {
+	v := os.Getenv(key)
+	shown := "(unset)"
+	if v != "" {
+		shown = "(set)"
+	}
+	cc.settings = append(cc.settings, [2]string{key, shown})
+	return v
+}
+
+// Duration reads key as a positive Go duration.
+func (cc *Check) Duration(key string, def time.Duration) time.Duration {
+	raw := cc.Str(key, def.String())
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		cc.Fail("%s=%q must be a positive duration (e.g. 5s, 2m)", key, raw)
+		return def
+	}
+	return d
+}
+
+// OptionalDuration is Duration for settings where 0 turns a feature off.
+func (cc *Check) OptionalDuration(key string, def time.Duration) time.Duration {
+	raw := cc.Str(key, def.String())
+	d, err := time.ParseDuration(raw)
+	if err != nil || d < 0 {
+		cc.Fail("%s=%q must be a duration, 0 to turn it off (e.g. 0, 30s)", key, raw)
+		return def
+	}
+	return d
+}
+
+// Int reads key as a non-negative integer.
+func (cc *Check) Int(key string, def int) int {
+	return int(cc.Int64(key, int64(def)))
+}
+
+// Int64 reads key as a non-negative integer.
+func (cc *Check) Int64(key string, def int64) int64 {
+	raw := cc.Str(key, strconv.FormatInt(def, 10))
+	x, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || x < 0 {
+		cc.Fail("%s=%q must be a non-negative integer", key, raw)
+		return def
+	}
+	return x
+}
+
+// Float reads key as a positive number.
+func (cc *Check) Float(key string, def float64) float64 {
+	raw := cc.Str(key, strconv.FormatFloat(def, 'g', -1, 64))
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil || f <= 0 {
+		cc.Fail("%s=%q must be a positive number", key, raw)
+		return def
+	}
+	return f
+}
+
+// OptionalFloat is Float for settings where 0 turns a feature off.
+func (cc *Check) OptionalFloat(key string, def float64) float64 {
+	raw := cc.Str(key, strconv.FormatFloat(def, 'g', -1, 64))
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil || f < 0 {
+		cc.Fail("%s=%q must be a non-negative number, 0 to turn it off", key, raw)
+		return def
+	}
+	return f
+}
+
+// Bool reads key as true or false.
+func (cc *Check) Bool(key string, def bool) bool {
+	raw := cc.Str(key, strconv.FormatBool(def))
+	b, err := strconv.ParseBool(raw)
+	if err != nil {
+		cc.Fail("%s=%q must be true or false", key, raw)
+		return def
+	}
+	return b
+}
+
+// List reads a list separated by commas or spaces.
+func (cc *Check) List(key, def string) []string {
+	return strings.FieldsFunc(cc.Str(key, def), func(r rune) bool { return r == ',' || r == ' ' })
+}
+
+// WritableDir makes sure dir exists and a file can be created in it.
+func (cc *Check) WritableDir(key, dir string) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		cc.Fail("%s %q cannot be created: %v", key, dir, err)
+		return
+	}
+	f, err := os.CreateTemp(dir, ".probe-*")
+	if err != nil {
+		cc.Fail("%s %q is not writable: %v", key, dir, err)
+		return
+	}
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// ServiceURL checks that raw is an absolute http(s) URL whose host resolves.
+func (cc *Check) ServiceURL(key, raw string) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		cc.Fail("%s=%q must be an absolute http(s) URL such as http://localhost:8000", key, raw)
+		return
+	}
+	if _, err := net.LookupHost(u.Hostname()); err != nil {
+		cc.Fail("%s host %q does not resolve: %v", key, u.Hostname(), err)
+	}
+}
+
+// Listen binds addr up front so a port clash is reported with the other
+// problems rather than after the service has started its background loops.
+func (cc *Check) Listen(key, addr string) net.Listener {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		cc.Fail("%s %s is not available: %v (is another instance running?)", key, addr, err)
+	}
+	return ln
+}
+
+// HTTPServer builds the listener's http.Server, handler to be set, from the
+// SERVER_* settings; a zero timeout is off. readTimeout and writeTimeout are
+// the service's defaults for whole requests and responses. With
+// TLS_CERT_FILE and TLS_KEY_FILE set the certificate is loaded up front, and
+// Serve offers HTTP/2 alongside HTTP/1.1.
+func (cc *Check) HTTPServer(readTimeout, writeTimeout time.Duration) *http.Server {
+	srv := &http.Server{
+		ReadHeaderTimeout: cc.Duration("SERVER_READ_HEADER_TIMEOUT", 10*time.Second),
+		ReadTimeout:       cc.OptionalDuration("SERVER_READ_TIMEOUT", readTimeout),
+		WriteTimeout:      cc.OptionalDuration("SERVER_WRITE_TIMEOUT", writeTimeout),
+		IdleTimeout:       cc.Duration("SERVER_IDLE_TIMEOUT", 2*time.Minute),
+		MaxHeaderBytes:    cc.Int("SERVER_MAX_HEADER_BYTES", 1<<20),
+	}
+	if srv.MaxHeaderBytes < 4<<10 {
+		cc.Fail("SERVER_MAX_HEADER_BYTES must be at least 4096, got %d", srv.MaxHeaderBytes)
+	}
+	cert, key := cc.Str("TLS_CERT_FILE", ""), cc.Str("TLS_KEY_FILE", "")
+	switch {
+	case cert == "" && key == "":
+	case cert == "" || key == "":
+		cc.Fail("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	default:
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			cc.Fail("TLS_CERT_FILE %q and TLS_KEY_FILE %q cannot be loaded: %v", cert, key, err)
+			break
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{pair}, MinVersion: tls.VersionTLS12}
+		srv.Protocols = new(http.Protocols)
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetHTTP2(true)
+	}
+	return srv
+}
+
+// Serve runs srv on ln, over TLS when HTTPServer loaded a certificate.
+func Serve(srv *http.Server, ln net.Listener) error {
+	if srv.TLSConfig != nil {
+		return srv.ServeTLS(ln, "", "")
+	}
+	return srv.Serve(ln)
+}
+
+// Done logs the effective configuration and exits if anything was invalid.
+func (cc *Check) Done() {
+	log.Printf("%s configuration:", cc.service)
+	for _, kv := range cc.settings {
+		log.Printf("  %-24s %s", kv[0], kv[1])
+	}
+	if len(cc.problems) == 0 {
+		return
+	}
+	for _, p := range cc.problems {
+		log.Printf("config error: %s", p)
+	}
+	log.Printf("%s: %d configuration problem(s), refusing to start", cc.service, len(cc.problems))
+	os.Exit(ExitConfig)
+}
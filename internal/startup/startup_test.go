@@ -0,0 +1,23 @@
+package startup
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// TestGatewayCopy fails when the ui_gateway module's copy of this package
+// has drifted from this one.
+func TestGatewayCopy(t *testing.T) {
+	ours, err := os.ReadFile("startup.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs, err := os.ReadFile("../../ui_gateway/internal/startup/startup.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ours, theirs) {
+		t.Error("ui_gateway/internal/startup/startup.go differs from internal/startup/startup.go; copy the change across")
+	}
+}
@@ -0,0 +1,2588 @@
+// Package storagenode is a storage node: it stores blobs on local disk,
+// serves them, and registers and heartbeats with the naming service.
+// storage_node/main.go wires it to the environment.
+package storagenode
+
+import (
+	"archive/tar"
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"ProjectAkhir/internal/apierr"
+	"ProjectAkhir/internal/diag"
+)
+
+// Version is the storage node build version; main copies in its own,
+// which is stamped with -ldflags "-X main.Version=...".
+var Version = "dev"
+
+// Config is a node's static configuration; storage_node/main.go fills it
+// from the environment.
+type Config struct {
+	NodeID        string
+	Port          string
+	DataDir       string
+	NamingURL     string
+	NamingShards  []string // the other naming shards (NAMING_SHARDS); see namingURLs
+	CapacityBytes int64
+	Heartbeat     time.Duration
+	FastCheckMax  int
+	// FullCheck (STARTUP_FULL_CHECK) hashes every blob at startup, after
+	// the FastCheckMax sample; the node leaves DEGRADED before it is done.
+	FullCheck   bool
+	Compression CompressionPolicy
+	// TicketSecret verifies gateway-signed upload tickets; RequireTicket
+	// rejects uploads that do not carry one.
+	TicketSecret  []byte
+	RequireTicket bool
+	// GatewayOrigins (GATEWAY_ORIGINS) are the origins whose pages may
+	// upload here directly; other browsers cannot read the answers.
+	GatewayOrigins []string
+	// MaxConcurrentUploads bounds in-flight uploads; 0 means unlimited.
+	MaxConcurrentUploads int64
+	// MaxUploadBytes (MAX_UPLOAD_BYTES) is the largest file /upload takes
+	// and MaxRequestBytes (MAX_REQUEST_BYTES) the largest body of any other
+	// request; 0 means no limit.
+	MaxUploadBytes  int64
+	MaxRequestBytes int64
+
+	// AdminToken guards /admin/*; empty disables the admin API.
+	AdminToken []byte
+
+	// MinFreeDisk is the free space (MIN_FREE_DISK_BYTES) below which the
+	// node turns read-only; 0 disables the check.
+	MinFreeDisk int64
+
+	// ReadAhead is the chunk size (READ_AHEAD_BYTES) prefetched while a
+	// download is being sent; 0 serves straight from the file. DirectIO
+	// opens blobs with O_DIRECT so large reads bypass the page cache.
+	ReadAhead int
+	DirectIO  bool
+
+	// HotDir (HOT_DIR) is a small fast tier that frequently read blobs are
+	// promoted into; DataDir stays the bulk tier and keeps the manifest.
+	// Empty disables tiering.
+	HotDir       string
+	HotCapacity  int64
+	PromoteReads float64 // decayed reads that earn a blob a place in HotDir
+	DemoteReads  float64 // below this a hot blob goes back to DataDir
+	TierInterval time.Duration
+
+	// ChaosEnabled (CHAOS_ENABLED) allows /admin/chaos to inject faults;
+	// it is meant for test clusters only.
+	ChaosEnabled bool
+
+	// Debug (DEBUG_ENDPOINTS) serves pprof, expvar and /debug/status
+	// behind AdminToken.
+	Debug bool
+
+	// Zone (NODE_ZONE), Tags (NODE_TAGS, e.g. ssd,high-bandwidth) and
+	// Weight (NODE_WEIGHT, 0 means 1) are declared to the naming service,
+	// whose placement spreads replicas over zones, honors allocation hints
+	// naming tags, and gives a node of weight 2 twice the share of files.
+	Zone   string
+	Tags   []string
+	Weight float64
+
+	// SkipRegistration (SELF_REGISTER=false) leaves registration and
+	// liveness to the naming service's discovery, which polls /health; the
+	// node then sends neither /register-node nor heartbeats.
+	SkipRegistration bool
+}
+
+type Node struct {
+	Config
+	mu        sync.RWMutex
+	usedBytes int64
+
+	manifest  map[string]manifestEntry // fileId -> entry, guarded by mu
+	journaled int                      // entries in manifest.journal, guarded by mu
+	degraded  bool                     // true until the startup check passes
+	badBlobs  []string                 // failed the check but could not be quarantined
+	// quarantined lists the blobs quarantined since the node started.
+	quarantined []quarantineRecord
+	// uploadSlots bounds concurrent uploads (MAX_CONCURRENT_UPLOADS); nil
+	// means unlimited. uploading counts them either way.
+	uploadSlots chan struct{}
+	uploading   atomic.Int64
+
+	// reads counts downloads per file since the last heartbeat, which
+	// carries them to the naming service's popularity and traffic stats;
+	// received does the same for blobs written by uploads and replication.
+	readsMu  sync.Mutex
+	reads    map[string]readStat
+	received readStat
+
+	maintenance bool  // refuses writes, keeps serving reads; guarded by mu
+	readOnly    bool  // guarded by mu
+	diskFree    int64 // last Statfs reading, guarded by mu
+	stopOnce    sync.Once
+	stopCh      chan struct{} // closed by /admin/stop
+	quit        chan struct{} // closed by Close; ends the background loops
+	quitOnce    sync.Once
+
+	tierMu     sync.RWMutex       // held exclusively while a blob changes tier
+	heat       map[string]float64 // decayed read counts, guarded by readsMu
+	promotions int64              // guarded by mu
+	demotions  int64              // guarded by mu
+
+	chaos     atomic.Pointer[chaosConfig]
+	chaosHits chaosCounters
+}
+
+type readStat struct {
+	Count int64 `json:"count"`
+	Bytes int64 `json:"bytes"`
+}
+
+type manifestEntry struct {
+	Size       int64     `json:"size"`
+	Checksum   string    `json:"checksum"`
+	ModifiedAt time.Time `json:"modifiedAt"`
+	// Encoding is "gzip" when the blob is compressed at rest; StoredSize is
+	// then its on-disk size while Size and Checksum describe the content.
+	Encoding   string `json:"encoding,omitempty"`
+	StoredSize int64  `json:"storedSize,omitempty"`
+	// Version is the file version written by the naming service's allocate.
+	Version int `json:"version,omitempty"`
+	// Tier is "hot" while the blob lives in HotDir.
+	Tier string `json:"tier,omitempty"`
+	blobLabel
+}
+
+// blobLabel is the filename and content type the blob was uploaded with.
+// The node never needs them itself; they let /admin/export name what it
+// writes out when the naming service's catalog is gone.
+type blobLabel struct {
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+}
+
+// storedBytes is the blob's size on disk.
+func (e manifestEntry) storedBytes() int64 {
+	if e.Encoding != "" {
+		return e.StoredSize
+	}
+	return e.Size
+}
+
+// CompressionPolicy decides which uploads are gzip-compressed at rest.
+type CompressionPolicy struct {
+	Enabled  bool
+	MinBytes int64
+	Types    []string // content-type prefixes; empty means any
+}
+
+func (p CompressionPolicy) applies(contentType string, size int64) bool {
+	if !p.Enabled || size < p.MinBytes {
+		return false
+	}
+	if len(p.Types) == 0 {
+		return true
+	}
+	for _, t := range p.Types {
+		if strings.HasPrefix(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+func getenv(k, d string) string {
+	if v := os.Getenv(k); v != "" {
+		return v
+	}
+	return d
+}
+
+// dataPathFor is where the blob lives: HotDir for blobs in the hot tier,
+// DataDir otherwise.
+func (n *Node) dataPathFor(fileID string) string {
+	if e, _ := n.entryFor(fileID); e.Tier == tierHot && n.HotDir != "" {
+		return shardPath(n.HotDir, fileID)
+	}
+	return shardPath(n.DataDir, fileID)
+}
+
+func shardPath(root, fileID string) string {
+	if len(fileID) < 2 {
+		return filepath.Join(root, fileID)
+	}
+	sub := fileID[:2]
+	dir := filepath.Join(root, sub)
+	_ = os.MkdirAll(dir, 0755)
+	return filepath.Join(dir, fileID)
+}
+func (n *Node) addUsed(delta int64) {
+	n.mu.Lock()
+	n.usedBytes += delta
+	if n.usedBytes < 0 {
+		n.usedBytes = 0
+	}
+	n.mu.Unlock()
+}
+func (n *Node) currentUsed() int64 { n.mu.RLock(); defer n.mu.RUnlock(); return n.usedBytes }
+func (n *Node) isDegraded() bool   { n.mu.RLock(); defer n.mu.RUnlock(); return n.degraded }
+func (n *Node) inMaintenance() bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.maintenance
+}
+func (n *Node) isReadOnly() bool { n.mu.RLock(); defer n.mu.RUnlock(); return n.readOnly }
+
+/* ---------------- DISK SPACE ---------------- */
+
+// diskFree returns the bytes available to unprivileged writers on the
+// filesystem holding dir.
+func diskFree(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// refreshDisk re-reads the free space of DataDir and updates the read-only
+// state, returning the free bytes.
+func (n *Node) refreshDisk() int64 {
+	free, err := diskFree(n.DataDir)
+	if err != nil {
+		log.Printf("disk space check failed: %v", err)
+		n.mu.RLock()
+		defer n.mu.RUnlock()
+		return n.diskFree
+	}
+	n.mu.Lock()
+	was := n.readOnly
+	n.diskFree = free
+	n.readOnly = n.MinFreeDisk > 0 && free < n.MinFreeDisk
+	ro := n.readOnly
+	n.mu.Unlock()
+	if ro != was {
+		log.Printf("disk free %d bytes (minimum %d): read-only=%v", free, n.MinFreeDisk, ro)
+	}
+	return free
+}
+
+// noSpace answers 507 and returns true when writing incoming more bytes
+// would take the disk below MinFreeDisk (incoming may be 0 if unknown).
+func (n *Node) noSpace(w http.ResponseWriter, incoming int64) bool {
+	if n.MinFreeDisk <= 0 {
+		return false
+	}
+	free := n.refreshDisk()
+	if !n.isReadOnly() && free-incoming >= n.MinFreeDisk {
+		return false
+	}
+	apierr.Write(w, http.StatusInsufficientStorage, apierr.InsufficientStorage, fmt.Sprintf("node is read-only: %d bytes free, minimum %d", free, n.MinFreeDisk))
+	return true
+}
+
+/* ---------------- REQUEST LIMITS ---------------- */
+
+// multipartSlack is room for the form fields and part headers around an
+// upload's file, so a file of exactly MaxUploadBytes still fits.
+const multipartSlack = 1 << 20
+
+// limitBody caps request bodies at MaxUploadBytes (plus form overhead) for
+// /upload and MaxRequestBytes for everything else. A body whose declared
+// length is over the limit is refused before any of it is read.
+func (n *Node) limitBody(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		what, limit, slack := "request", n.MaxRequestBytes, int64(0)
+		if r.URL.Path == "/upload" {
+			// browsers upload directly and must be able to read the refusal
+			n.allowOrigin(w, r)
+			what, limit, slack = "upload", n.MaxUploadBytes, multipartSlack
+		}
+		if limit > 0 {
+			if r.ContentLength > limit+slack {
+				tooLarge(w, what, limit)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit+slack)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// tooLarge answers 413 with the limit that was exceeded.
+func tooLarge(w http.ResponseWriter, what string, limit int64) {
+	w.Header().Set("Connection", "close") // don't read the rest of the body
+	apierr.WriteDetail(w, http.StatusRequestEntityTooLarge, apierr.PayloadTooLarge, what+" too large", map[string]int64{"limitBytes": limit})
+}
+
+/* ---------------- MANIFEST ---------------- */
+
+func (n *Node) manifestPath() string  { return filepath.Join(n.DataDir, "manifest.json") }
+func (n *Node) journalPath() string   { return filepath.Join(n.DataDir, "manifest.journal") }
+func (n *Node) cleanMarkPath() string { return filepath.Join(n.DataDir, ".clean-shutdown") }
+
+// manifestCompactMin is how many journal entries a manifest of any size may
+// gather before it is rewritten; past it, a journal as long as the manifest
+// is. As with the naming service's files.journal, a write then costs about
+// one append per blob changed rather than the whole manifest.
+const manifestCompactMin = 1000
+
+// journalEntry is one line of manifest.journal: a blob's entry as it now
+// is, or that the blob is gone.
+type journalEntry struct {
+	FileID  string         `json:"fileId"`
+	Entry   *manifestEntry `json:"entry,omitempty"`
+	Deleted bool           `json:"deleted,omitempty"`
+}
+
+// quarantineDir, under DataDir or HotDir, holds the blobs the startup check
+// found damaged, each with a <fileId>.json saying why. Nothing reads them
+// back; they are kept for an operator to inspect or delete.
+const quarantineDir = "quarantine"
+
+// loadManifest must be called with n.mu held. The journal is replayed on
+// top of manifest.json, skipping a line cut short by a crash. usedBytes is
+// recomputed from the manifest, so a restarted node reports the data it
+// already holds.
+func (n *Node) loadManifest() {
+	n.manifest = map[string]manifestEntry{}
+	if b, err := os.ReadFile(n.manifestPath()); err == nil {
+		_ = json.Unmarshal(b, &n.manifest)
+	}
+	n.journaled = 0
+	if b, err := os.ReadFile(n.journalPath()); err == nil {
+		for line := range bytes.Lines(b) {
+			var e journalEntry
+			if json.Unmarshal(line, &e) != nil || e.FileID == "" {
+				continue
+			}
+			if e.Deleted || e.Entry == nil {
+				delete(n.manifest, e.FileID)
+			} else {
+				n.manifest[e.FileID] = *e.Entry
+			}
+			n.journaled++
+		}
+	}
+	n.usedBytes = 0
+	for _, e := range n.manifest {
+		n.usedBytes += e.storedBytes()
+	}
+}
+
+// saveManifest rewrites manifest.json whole and empties the journal. It
+// must be called with n.mu held.
+func (n *Node) saveManifest() {
+	b, _ := json.MarshalIndent(n.manifest, "", "  ")
+	tmp := n.manifestPath() + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		log.Printf("manifest write: %v", err)
+		return
+	}
+	_ = os.Rename(tmp, n.manifestPath())
+	if err := os.Remove(n.journalPath()); err == nil || errors.Is(err, os.ErrNotExist) {
+		n.journaled = 0
+	}
+	_ = syncDir(n.DataDir)
+}
+
+// journalBlob records fileID's manifest entry, or its removal, by appending
+// it to the journal; once the journal is long enough it compacts it into
+// manifest.json instead. It must be called with n.mu held.
+func (n *Node) journalBlob(fileID string) {
+	if n.journaled+1 > max(manifestCompactMin, len(n.manifest)) {
+		n.saveManifest()
+		return
+	}
+	e := journalEntry{FileID: fileID, Deleted: true}
+	if cur, ok := n.manifest[fileID]; ok {
+		e = journalEntry{FileID: fileID, Entry: &cur}
+	}
+	b, _ := json.Marshal(e)
+	if err := appendLine(n.journalPath(), b); err != nil {
+		log.Printf("manifest journal: %v; rewriting the manifest", err)
+		n.saveManifest()
+		return
+	}
+	n.journaled++
+}
+
+func appendLine(path string, b []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (n *Node) recordBlob(fileID string, size int64, checksum, encoding string, stored int64, version int, label blobLabel) {
+	n.mu.Lock()
+	tier := n.manifest[fileID].Tier // a rewrite lands in the blob's current tier
+	n.manifest[fileID] = manifestEntry{Size: size, Checksum: checksum, ModifiedAt: time.Now().UTC(), Encoding: encoding, StoredSize: stored, Version: version, Tier: tier, blobLabel: label}
+	n.journalBlob(fileID)
+	n.mu.Unlock()
+}
+
+func (n *Node) forgetBlob(fileID string) {
+	n.mu.Lock()
+	delete(n.manifest, fileID)
+	n.journalBlob(fileID)
+	n.mu.Unlock()
+}
+
+// inventoryDigest summarizes the manifest for heartbeats: the number of
+// blobs and the XOR of the FNV-1a hashes of their file IDs. XOR makes it
+// independent of order, so the naming service can build the same digest
+// from its replica lists and compare.
+type inventoryDigest struct {
+	Count int    `json:"count"`
+	Hash  string `json:"hash"`
+}
+
+func (n *Node) inventory() inventoryDigest {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	var x uint64
+	for id := range n.manifest {
+		h := fnv.New64a()
+		h.Write([]byte(id))
+		x ^= h.Sum64()
+	}
+	return inventoryDigest{Count: len(n.manifest), Hash: fmt.Sprintf("%016x", x)}
+}
+
+// startupCheck checks every blob's size against the manifest, then hashes
+// a random sample of it plus every blob modified since the last clean
+// shutdown; with FullCheck the remaining blobs are hashed afterwards. Blobs
+// that fail are quarantined. The node reports itself degraded until the
+// sample is done, and stays so only if a bad blob could not be moved away.
+func (n *Node) startupCheck() {
+	// temp files left behind by a crash mid-upload were never acknowledged
+	tmps, _ := filepath.Glob(filepath.Join(n.DataDir, "*", "*.tmp"))
+	for _, t := range tmps {
+		_ = os.Remove(t)
+	}
+
+	var since time.Time
+	if b, err := os.ReadFile(n.cleanMarkPath()); err == nil {
+		since, _ = time.Parse(time.RFC3339Nano, strings.TrimSpace(string(b)))
+		_ = os.Remove(n.cleanMarkPath())
+	}
+
+	n.mu.Lock()
+	n.degraded = true
+	entries := make(map[string]manifestEntry, len(n.manifest))
+	for id, e := range n.manifest {
+		entries[id] = e
+	}
+	n.mu.Unlock()
+
+	// a size check is only a stat, so every blob gets one
+	var recent, rest, bad []string
+	moved := 0
+	for id, e := range entries {
+		reason := ""
+		if st, err := os.Stat(n.dataPathFor(id)); err != nil {
+			reason = "blob is missing"
+		} else if st.Size() != e.storedBytes() {
+			reason = fmt.Sprintf("blob is %d bytes, manifest says %d", st.Size(), e.storedBytes())
+		}
+		switch {
+		case reason == "":
+		case n.quarantineBlob(id, e, reason) != nil:
+			bad = append(bad, id)
+			continue
+		default:
+			moved++
+			continue
+		}
+		if since.IsZero() || e.ModifiedAt.After(since) {
+			recent = append(recent, id)
+		} else {
+			rest = append(rest, id)
+		}
+	}
+
+	rand.Shuffle(len(rest), func(i, j int) { rest[i], rest[j] = rest[j], rest[i] })
+	sample := rest[:min(len(rest), n.FastCheckMax)]
+	toCheck := append(recent, sample...)
+	k, failed := n.hashCheck(toCheck, entries)
+	moved += k
+	bad = append(bad, failed...)
+
+	n.mu.Lock()
+	n.badBlobs = bad
+	n.degraded = len(bad) > 0
+	n.mu.Unlock()
+	log.Printf("startup check: %d blobs size-checked, %d hashed (%d recent), %d quarantined, %d failed", len(entries), len(toCheck), len(recent), moved, len(bad))
+
+	if !n.FullCheck || len(sample) == len(rest) {
+		return
+	}
+	later := rest[len(sample):]
+	k, failed = n.hashCheck(later, entries)
+	if len(failed) > 0 {
+		n.mu.Lock()
+		n.badBlobs = append(n.badBlobs, failed...)
+		n.degraded = true
+		n.mu.Unlock()
+	}
+	log.Printf("full startup check: %d more blobs hashed, %d quarantined, %d failed", len(later), k, len(failed))
+}
+
+// hashCheck hashes the blobs ids name and quarantines those that no longer
+// match entries. It returns how many were quarantined and the ones that
+// could not be, and gives up early when the node is closed.
+func (n *Node) hashCheck(ids []string, entries map[string]manifestEntry) (moved int, failed []string) {
+	for _, id := range ids {
+		select {
+		case <-n.quit:
+			return moved, failed
+		default:
+		}
+		e := entries[id]
+		size, sum, err := n.hashBlob(id)
+		var reason string
+		switch {
+		case err != nil:
+			reason = err.Error()
+		case size != e.Size:
+			reason = fmt.Sprintf("content is %d bytes, manifest says %d", size, e.Size)
+		case sum != e.Checksum:
+			reason = "content hashes to " + sum + ", manifest says " + e.Checksum
+		default:
+			continue
+		}
+		if n.quarantineBlob(id, e, reason) != nil {
+			failed = append(failed, id)
+		} else {
+			moved++
+		}
+	}
+	return moved, failed
+}
+
+// quarantineRecord is written next to a quarantined blob as <fileId>.json.
+type quarantineRecord struct {
+	FileID string        `json:"fileId"`
+	Reason string        `json:"reason"`
+	At     time.Time     `json:"at"`
+	Entry  manifestEntry `json:"entry"`
+}
+
+// quarantineBlob moves a damaged blob into the quarantine directory of its
+// tier, forgets it, and reports the replica missing to the naming service
+// so it is re-created from a good copy instead of served broken. checked
+// is the manifest entry the damage was found against; a blob rewritten or
+// deleted since is left alone.
+func (n *Node) quarantineBlob(fileID string, checked manifestEntry, reason string) error {
+	n.tierMu.Lock()
+	e, ok := n.entryFor(fileID)
+	if !ok || !e.ModifiedAt.Equal(checked.ModifiedAt) || e.Checksum != checked.Checksum {
+		n.tierMu.Unlock()
+		return nil
+	}
+	root := n.DataDir
+	if e.Tier == tierHot && n.HotDir != "" {
+		root = n.HotDir
+	}
+	dir := filepath.Join(root, quarantineDir)
+	err := os.MkdirAll(dir, 0755)
+	if err == nil {
+		err = os.Rename(n.dataPathFor(fileID), filepath.Join(dir, fileID))
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil // nothing left to keep
+		}
+	}
+	if err != nil {
+		n.tierMu.Unlock()
+		log.Printf("quarantine %s: %v", fileID, err)
+		return err
+	}
+	n.forgetBlob(fileID)
+	n.addUsed(-e.storedBytes())
+	n.tierMu.Unlock()
+
+	rec := quarantineRecord{FileID: fileID, Reason: reason, At: time.Now().UTC(), Entry: e}
+	b, _ := json.MarshalIndent(rec, "", "  ")
+	_ = os.WriteFile(filepath.Join(dir, fileID+".json"), b, 0644)
+	n.mu.Lock()
+	n.quarantined = append(n.quarantined, rec)
+	n.mu.Unlock()
+	log.Printf("quarantined %s: %s", fileID, reason)
+	// heartbeats' inventory digest catches a report that does not get through;
+	// only the shard that owns fileID knows it
+	for _, u := range n.namingURLs() {
+		_ = postJSON(u+"/report-missing", map[string]string{"fileId": fileID, "nodeId": n.NodeID, "reporter": "startup-check"})
+	}
+	return nil
+}
+
+func (n *Node) entryFor(fileID string) (manifestEntry, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	e, ok := n.manifest[fileID]
+	return e, ok
+}
+
+// openBlob returns a reader over the blob's original content, decompressing
+// it if it is stored compressed.
+func (n *Node) openBlob(fileID string) (io.ReadCloser, error) {
+	n.tierMu.RLock()
+	f, err := os.Open(n.dataPathFor(fileID))
+	n.tierMu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if e, _ := n.entryFor(fileID); e.Encoding != "gzip" {
+		return f, nil
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{zr, f}, nil
+}
+
+// hashBlob returns the size and checksum of the blob's original content.
+func (n *Node) hashBlob(fileID string) (int64, string, error) {
+	rc, err := n.openBlob(fileID)
+	if err != nil {
+		return 0, "", err
+	}
+	defer rc.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, rc)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// uploadTicket mirrors the gateway's signed authorisation for one upload.
+type uploadTicket struct {
+	FileID   string `json:"fileId"`
+	NodeID   string `json:"nodeId"`
+	Version  int    `json:"version"`
+	MaxSize  int64  `json:"maxSize"`
+	Checksum string `json:"checksum"`
+	Expires  int64  `json:"exp"`
+}
+
+func (n *Node) checkTicket(raw, fileID string, size int64) (*uploadTicket, error) {
+	payload, sig, ok := strings.Cut(raw, ".")
+	if !ok || len(n.TicketSecret) == 0 {
+		return nil, fmt.Errorf("malformed ticket")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, fmt.Errorf("malformed ticket")
+	}
+	mac := hmac.New(sha256.New, n.TicketSecret)
+	mac.Write(b)
+	want, _ := hex.DecodeString(sig)
+	if !hmac.Equal(mac.Sum(nil), want) {
+		return nil, fmt.Errorf("bad ticket signature")
+	}
+	var t uploadTicket
+	if err := json.Unmarshal(b, &t); err != nil {
+		return nil, fmt.Errorf("malformed ticket")
+	}
+	switch {
+	case time.Now().Unix() > t.Expires:
+		return nil, fmt.Errorf("ticket expired")
+	case t.FileID != fileID || t.NodeID != n.NodeID:
+		return nil, fmt.Errorf("ticket is for %s on %s", t.FileID, t.NodeID)
+	case size > t.MaxSize:
+		return nil, fmt.Errorf("upload of %d bytes exceeds ticket limit %d", size, t.MaxSize)
+	}
+	return &t, nil
+}
+
+// allowOrigin lets the gateway's pages read /upload answers: a request from
+// one of GatewayOrigins gets it back in Access-Control-Allow-Origin.
+func (n *Node) allowOrigin(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Origin")
+	if origin := r.Header.Get("Origin"); origin != "" && slices.Contains(n.GatewayOrigins, origin) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+}
+
+func (n *Node) handleUpload(w http.ResponseWriter, r *http.Request) {
+	// browsers upload here directly with a gateway-issued ticket; limitBody
+	// has answered their origin
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if n.inMaintenance() {
+		apierr.Write(w, http.StatusServiceUnavailable, apierr.Maintenance, "node is in maintenance mode")
+		return
+	}
+	if n.noSpace(w, max(r.ContentLength, 0)) {
+		return
+	}
+	if n.dropUpload() {
+		apierr.Write(w, http.StatusServiceUnavailable, apierr.Unavailable, "chaos: upload dropped")
+		return
+	}
+	if n.uploadSlots != nil {
+		select {
+		case n.uploadSlots <- struct{}{}:
+			defer func() { <-n.uploadSlots }()
+		default:
+			w.Header().Set("Retry-After", "1")
+			apierr.Write(w, http.StatusTooManyRequests, apierr.RateLimited, "too many concurrent uploads")
+			return
+		}
+	}
+	n.uploading.Add(1)
+	defer n.uploading.Add(-1)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			tooLarge(w, "upload", n.MaxUploadBytes)
+			return
+		}
+		apierr.Write(w, http.StatusBadRequest, apierr.BadRequest, "cannot parse form")
+		return
+	}
+	fileID := r.FormValue("fileId")
+	if fileID == "" {
+		apierr.Write(w, http.StatusBadRequest, apierr.MissingParameter, "missing fileId")
+		return
+	}
+	f, hdr, err := r.FormFile("file")
+	if err != nil {
+		apierr.Write(w, http.StatusBadRequest, apierr.MissingParameter, "missing file")
+		return
+	}
+	defer f.Close()
+	if n.MaxUploadBytes > 0 && hdr.Size > n.MaxUploadBytes {
+		tooLarge(w, "upload", n.MaxUploadBytes)
+		return
+	}
+
+	if raw := r.FormValue("ticket"); raw != "" || n.RequireTicket {
+		t, err := n.checkTicket(raw, fileID, hdr.Size)
+		if err != nil {
+			apierr.WriteDetail(w, http.StatusForbidden, apierr.InvalidTicket, "upload ticket rejected", err.Error())
+			return
+		}
+		// the ticket's checksum and version are authoritative
+		r.Form.Set("expectedChecksum", t.Checksum)
+		r.Form.Set("version", fmt.Sprint(t.Version))
+	}
+
+	// write to a temp file next to the target and rename it into place, so a
+	// crash never leaves a truncated blob that /has would report as present
+	target := n.dataPathFor(fileID)
+	out, err := os.CreateTemp(filepath.Dir(target), filepath.Base(target)+".*.tmp")
+	if err != nil {
+		apierr.Write(w, http.StatusInternalServerError, apierr.Internal, "cannot create")
+		return
+	}
+	tmp := out.Name()
+	defer os.Remove(tmp) // no-op once renamed
+
+	contentType := r.FormValue("contentType")
+	if contentType == "" {
+		contentType = hdr.Header.Get("Content-Type")
+	}
+	encoding := ""
+	if n.Compression.applies(contentType, hdr.Size) {
+		encoding = "gzip"
+	}
+	size, checksum, err := writeBlob(out, f, encoding)
+	stored, _ := out.Seek(0, io.SeekCurrent)
+	if err == nil && encoding != "" && stored >= size {
+		// incompressible content: keep it raw rather than pay for gzip on reads
+		encoding = ""
+		if _, err = f.Seek(0, io.SeekStart); err == nil {
+			if _, err = out.Seek(0, io.SeekStart); err == nil {
+				if err = out.Truncate(0); err == nil {
+					size, checksum, err = writeBlob(out, f, "")
+					stored = size
+				}
+			}
+		}
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		apierr.Write(w, http.StatusInternalServerError, apierr.Internal, "write error")
+		return
+	}
+	if expected := r.FormValue("expectedChecksum"); expected != "" && expected != checksum {
+		apierr.WriteDetail(w, http.StatusUnprocessableEntity, apierr.ChecksumMismatch, "checksum mismatch", map[string]string{
+			"fileId":           fileID,
+			"expectedChecksum": expected,
+			"actualChecksum":   checksum,
+		})
+		return
+	}
+
+	version := 1
+	fmt.Sscanf(r.FormValue("version"), "%d", &version)
+	if err := n.commitBlob(fileID, tmp, size, checksum, encoding, stored, version, blobLabel{hdr.Filename, contentType}); err != nil {
+		apierr.Write(w, http.StatusInternalServerError, apierr.Internal, "write error")
+		return
+	}
+	n.countReceived(size)
+	writeJSON(w, map[string]any{"ok": true, "fileId": fileID, "version": version, "size": size, "storedBytes": stored, "encoding": encoding, "checksum": checksum, "name": hdr.Filename})
+}
+
+// writeBlob copies src into dst, gzip-compressing it when encoding is "gzip",
+// and returns the size and checksum of the uncompressed content.
+func writeBlob(dst io.Writer, src io.Reader, encoding string) (int64, string, error) {
+	h := sha256.New()
+	var zw *gzip.Writer
+	if encoding == "gzip" {
+		zw = gzip.NewWriter(dst)
+		dst = zw
+	}
+	size, err := io.Copy(io.MultiWriter(dst, h), src)
+	if zw != nil {
+		if cerr := zw.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return size, "sha256:" + hex.EncodeToString(h.Sum(nil)), err
+}
+
+// syncDir fsyncs a directory so a rename inside it survives power loss.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (n *Node) handleDownload(w http.ResponseWriter, r *http.Request) {
+	fileID := r.PathValue("fileId")
+	n.tierMu.RLock()
+	f, err := n.openForDownload(n.dataPathFor(fileID))
+	n.tierMu.RUnlock()
+	if err != nil {
+		apierr.Write(w, http.StatusNotFound, apierr.FileNotFound, "file not found")
+		return
+	}
+	defer f.Close()
+	cw := &countingWriter{ResponseWriter: w}
+	defer func() { n.countRead(fileID, cw.n) }()
+	w = cw
+	// ?trailer=checksum hashes the body on its way out (after any chaos
+	// corruption, so that shows) and sends the digest after it
+	var tw *trailerWriter
+	if r.URL.Query().Get("trailer") == "checksum" && r.Method == http.MethodGet && r.Header.Get("Range") == "" {
+		tw = &trailerWriter{ResponseWriter: w, h: sha256.New()}
+		w = tw
+		w.Header().Set("Trailer", checksumTrailer)
+		defer tw.finish()
+	}
+	if chance(n.chaosConf().CorruptReadPct) {
+		n.chaosHits.corrupted.Add(1)
+		w = &corruptingWriter{ResponseWriter: w}
+	}
+	e, _ := n.entryFor(fileID)
+	if e.Version > 0 {
+		w.Header().Set("X-Blob-Version", fmt.Sprint(e.Version))
+	}
+	if e.Filename != "" {
+		w.Header().Set("X-Blob-Filename", url.PathEscape(e.Filename))
+	}
+	if e.ContentType != "" {
+		w.Header().Set("X-Blob-Content-Type", e.ContentType)
+	}
+	if e.Checksum != "" {
+		etag := `"` + e.Checksum + `"`
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "no-cache")
+		if etagMatch(r.Header.Get("If-None-Match"), etag) {
+			// ServeContent would do the same, but not for compressed blobs
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	if e.Encoding != "gzip" {
+		// ServeContent answers If-None-Match / If-Modified-Since from these
+		http.ServeContent(w, r, fileID, e.ModifiedAt, f)
+		return
+	}
+	// compressed at rest: hand the stored bytes over as-is when the client
+	// accepts gzip and wants no trailer, otherwise inflate on the fly (no
+	// range support either way)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Vary", "Accept-Encoding")
+	if tw == nil && acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		w.Header().Set("Content-Encoding", "gzip")
+		io.Copy(w, f)
+		return
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		apierr.Write(w, http.StatusInternalServerError, apierr.FileCorrupt, "corrupt blob")
+		return
+	}
+	w.Header().Set("Content-Length", fmt.Sprint(e.Size))
+	io.Copy(w, zr)
+}
+
+// etagMatch reports whether an If-None-Match header value matches etag,
+// comparing weakly as RFC 9110 asks for GET.
+func etagMatch(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip. A
+// gzip entry wins over "*" wherever it appears, and q=0 refuses; a q that
+// does not parse counts as a refusal too.
+func acceptsGzip(header string) bool {
+	gz, star := -1.0, -1.0
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			if k, v, ok := strings.Cut(p, "="); ok && strings.EqualFold(strings.TrimSpace(k), "q") {
+				if q, _ = strconv.ParseFloat(strings.TrimSpace(v), 64); !(q >= 0 && q <= 1) {
+					q = 0
+				}
+			}
+		}
+		switch coding = strings.TrimSpace(coding); {
+		case strings.EqualFold(coding, "gzip"), strings.EqualFold(coding, "x-gzip"):
+			gz = max(gz, q)
+		case coding == "*":
+			star = max(star, q)
+		}
+	}
+	if gz >= 0 {
+		return gz > 0
+	}
+	return star > 0
+}
+
+// countingWriter counts the body bytes written through it.
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	k, err := cw.ResponseWriter.Write(b)
+	cw.n += int64(k)
+	return k, err
+}
+
+// checksumTrailer carries the checksum of a download's body, when asked
+// for with ?trailer=checksum.
+const checksumTrailer = "X-Content-Checksum"
+
+// trailerWriter hashes a response body for the checksum trailer. Go drops
+// trailers from a response with a Content-Length, so it removes that
+// header and the body goes out chunked.
+type trailerWriter struct {
+	http.ResponseWriter
+	h      hash.Hash
+	status int
+}
+
+func (tw *trailerWriter) WriteHeader(code int) {
+	if tw.status == 0 {
+		tw.status = code
+		tw.Header().Del("Content-Length")
+	}
+	tw.ResponseWriter.WriteHeader(code)
+}
+
+func (tw *trailerWriter) Write(b []byte) (int, error) {
+	if tw.status == 0 {
+		tw.WriteHeader(http.StatusOK)
+	}
+	k, err := tw.ResponseWriter.Write(b)
+	tw.h.Write(b[:k])
+	return k, err
+}
+
+// finish sets the trailer once the body is written; only a full 200 body
+// gets one.
+func (tw *trailerWriter) finish() {
+	if tw.status == http.StatusOK {
+		tw.Header().Set(checksumTrailer, "sha256:"+hex.EncodeToString(tw.h.Sum(nil)))
+	}
+}
+
+/* ---------------- READ-AHEAD ---------------- */
+
+// DirectIOAlign is the offset and buffer alignment O_DIRECT reads need.
+const DirectIOAlign = 4096
+
+// openForDownload opens a blob for a download. With ReadAhead unset the plain file
+// is returned so ServeContent can use sendfile; otherwise the file is wrapped
+// in a readAhead, opened with O_DIRECT when DirectIO is on and the
+// filesystem allows it (tmpfs, for one, does not).
+func (n *Node) openForDownload(path string) (io.ReadSeekCloser, error) {
+	if n.ReadAhead <= 0 {
+		return os.Open(path)
+	}
+	align := int64(1)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if n.DirectIO {
+		if df, derr := os.OpenFile(path, os.O_RDONLY|syscall.O_DIRECT, 0); derr == nil {
+			f.Close()
+			f, align = df, DirectIOAlign
+		}
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &readAhead{f: f, chunk: n.ReadAhead, align: align, size: st.Size()}, nil
+}
+
+// readAhead is an io.ReadSeeker that keeps the next chunk of the file
+// loading in the background while the current one is written to the
+// client, so disk and network transfers overlap on large sequential reads.
+// Seeks outside the chunk in hand restart the prefetch at the new offset.
+type readAhead struct {
+	f     *os.File
+	chunk int
+	align int64
+	size  int64
+	off   int64 // logical offset of the next Read
+
+	buf    []byte // chunk in hand, starting at file offset bufOff
+	bufOff int64
+	mem    []byte // backing array of buf, returned to free when consumed
+	err    error  // set once the prefetcher hit EOF or a read error
+
+	next chan raChunk
+	free chan []byte
+	stop chan struct{}
+	done chan struct{}
+}
+
+type raChunk struct {
+	off int64
+	b   []byte
+	mem []byte
+	err error
+}
+
+// start prefetches from off, rounded down to the alignment O_DIRECT needs.
+// Three buffers circulate: one being sent, one queued, one being filled.
+func (ra *readAhead) start() {
+	ra.next = make(chan raChunk, 1)
+	ra.free = make(chan []byte, 3)
+	ra.stop = make(chan struct{})
+	ra.done = make(chan struct{})
+	for i := 0; i < 3; i++ {
+		ra.free <- alignedBuf(ra.chunk, ra.align)
+	}
+	pos := ra.off - ra.off%ra.align
+	go func() {
+		defer close(ra.done)
+		for {
+			var mem []byte
+			select {
+			case mem = <-ra.free:
+			case <-ra.stop:
+				return
+			}
+			k, err := ra.f.ReadAt(mem, pos)
+			select {
+			case ra.next <- raChunk{off: pos, b: mem[:k], mem: mem, err: err}:
+			case <-ra.stop:
+				return
+			}
+			if err != nil {
+				return
+			}
+			pos += int64(k)
+		}
+	}()
+}
+
+// halt stops the prefetcher and drops whatever it had loaded.
+func (ra *readAhead) halt() {
+	if ra.stop == nil {
+		return
+	}
+	close(ra.stop)
+	<-ra.done
+	ra.next, ra.free, ra.stop, ra.done = nil, nil, nil, nil
+	ra.buf, ra.mem, ra.err = nil, nil, nil
+}
+
+func (ra *readAhead) Read(p []byte) (int, error) {
+	if ra.off >= ra.size {
+		return 0, io.EOF
+	}
+	if ra.stop == nil {
+		ra.start()
+	}
+	for ra.off >= ra.bufOff+int64(len(ra.buf)) {
+		if err := ra.err; err != nil {
+			if err == io.EOF {
+				// the file shrank under us; stop at what is on disk
+				ra.size = ra.off
+			}
+			ra.halt()
+			return 0, err
+		}
+		if ra.mem != nil {
+			ra.free <- ra.mem
+			ra.buf, ra.mem = nil, nil
+		}
+		c := <-ra.next
+		ra.buf, ra.bufOff, ra.mem, ra.err = c.b, c.off, c.mem, c.err
+	}
+	k := copy(p, ra.buf[ra.off-ra.bufOff:])
+	ra.off += int64(k)
+	return k, nil
+}
+
+func (ra *readAhead) Seek(offset int64, whence int) (int64, error) {
+	abs := offset
+	switch whence {
+	case io.SeekCurrent:
+		abs += ra.off
+	case io.SeekEnd:
+		abs += ra.size
+	}
+	if abs < 0 {
+		return 0, fmt.Errorf("readAhead: negative position")
+	}
+	// ServeContent sniffs the first bytes and seeks back; stay on the
+	// chunk in hand instead of throwing the prefetch away
+	if ra.buf == nil || abs < ra.bufOff || abs > ra.bufOff+int64(len(ra.buf)) {
+		ra.halt()
+	}
+	ra.off = abs
+	return abs, nil
+}
+
+func (ra *readAhead) Close() error {
+	ra.halt()
+	return ra.f.Close()
+}
+
+// alignedBuf returns an n-byte buffer whose start is a multiple of align.
+func alignedBuf(n int, align int64) []byte {
+	if align <= 1 {
+		return make([]byte, n)
+	}
+	b := make([]byte, n+int(align))
+	k := int(uintptr(unsafe.Pointer(&b[0])) & uintptr(align-1))
+	if k != 0 {
+		k = int(align) - k
+	}
+	return b[k : k+n]
+}
+
+func (n *Node) countRead(fileID string, bytes int64) {
+	n.readsMu.Lock()
+	defer n.readsMu.Unlock()
+	if n.reads == nil {
+		n.reads = map[string]readStat{}
+	}
+	st := n.reads[fileID]
+	st.Count++
+	st.Bytes += bytes
+	n.reads[fileID] = st
+	if n.HotDir != "" {
+		if n.heat == nil {
+			n.heat = map[string]float64{}
+		}
+		n.heat[fileID]++
+	}
+}
+
+// countReceived records a blob written to this node, by an upload or a
+// network copy from a peer.
+func (n *Node) countReceived(bytes int64) {
+	n.readsMu.Lock()
+	n.received.Count++
+	n.received.Bytes += bytes
+	n.readsMu.Unlock()
+}
+
+// takeReads hands over the reads and writes counted since the last call.
+func (n *Node) takeReads() (map[string]readStat, readStat) {
+	n.readsMu.Lock()
+	defer n.readsMu.Unlock()
+	r, recv := n.reads, n.received
+	n.reads, n.received = nil, readStat{}
+	return r, recv
+}
+
+// restoreReads puts back counts that could not be delivered.
+func (n *Node) restoreReads(r map[string]readStat, recv readStat) {
+	n.readsMu.Lock()
+	defer n.readsMu.Unlock()
+	n.received.Count += recv.Count
+	n.received.Bytes += recv.Bytes
+	for id, st := range r {
+		if n.reads == nil {
+			n.reads = map[string]readStat{}
+		}
+		cur := n.reads[id]
+		cur.Count += st.Count
+		cur.Bytes += st.Bytes
+		n.reads[id] = cur
+	}
+}
+
+func (n *Node) handleHas(w http.ResponseWriter, r *http.Request) {
+	fileID := r.URL.Query().Get("fileId")
+	if fileID == "" {
+		apierr.Write(w, http.StatusBadRequest, apierr.MissingParameter, "missing fileId")
+		return
+	}
+	_, err := os.Stat(n.dataPathFor(fileID))
+	writeJSON(w, map[string]any{"exists": err == nil})
+}
+func (n *Node) handleHealth(w http.ResponseWriter, r *http.Request) {
+	free := n.refreshDisk()
+	status := "HEALTHY"
+	switch {
+	case n.isDegraded():
+		status = "DEGRADED"
+	case n.isReadOnly():
+		status = "READ_ONLY"
+	}
+	n.mu.RLock()
+	bad := append([]string(nil), n.badBlobs...)
+	quarantined := append([]quarantineRecord(nil), n.quarantined...)
+	var logical, stored, hotBytes int64
+	compressed, hotBlobs := 0, 0
+	for _, e := range n.manifest {
+		logical += e.Size
+		stored += e.storedBytes()
+		if e.Encoding != "" {
+			compressed++
+		}
+		if e.Tier == tierHot {
+			hotBlobs++
+			hotBytes += e.storedBytes()
+		}
+	}
+	tiering := map[string]any{
+		"enabled":          n.HotDir != "",
+		"hotDir":           n.HotDir,
+		"hotCapacityBytes": n.HotCapacity,
+		"hotBlobs":         hotBlobs,
+		"hotBytes":         hotBytes,
+		"coldBlobs":        len(n.manifest) - hotBlobs,
+		"coldBytes":        stored - hotBytes,
+		"promoteReads":     n.PromoteReads,
+		"demoteReads":      n.DemoteReads,
+		"interval":         n.TierInterval.String(),
+		"promotions":       n.promotions,
+		"demotions":        n.demotions,
+	}
+	n.mu.RUnlock()
+	ratio := 1.0
+	if stored > 0 {
+		ratio = float64(logical) / float64(stored)
+	}
+	writeJSON(w, map[string]any{
+		"nodeId":      n.NodeID,
+		"status":      status,
+		"maintenance": n.inMaintenance(),
+		"badBlobs":    bad,
+		"quarantined": quarantined,
+		"compression": map[string]any{
+			"enabled":         n.Compression.Enabled,
+			"compressedBlobs": compressed,
+			"logicalBytes":    logical,
+			"storedBytes":     stored,
+			"ratio":           ratio,
+		},
+		"usedBytes":     n.currentUsed(),
+		"capacityBytes": n.CapacityBytes,
+		"freeBytes":     n.CapacityBytes - n.currentUsed(),
+		"diskFreeBytes": free,
+		"minFreeDisk":   n.MinFreeDisk,
+		"readOnly":      n.isReadOnly(),
+		"zone":          n.Zone,
+		"tags":          n.Tags,
+		"weight":        n.Weight,
+		"readAhead": map[string]any{
+			"chunkBytes": n.ReadAhead,
+			"directIO":   n.DirectIO,
+		},
+		"tiering":   tiering,
+		"inventory": n.inventory(),
+		"chaos":     n.chaosStatus(),
+		"dataDir":   n.DataDir,
+	})
+}
+
+// handleList lists the blobs on disk. Each carries what the manifest
+// records about it, so the naming service can rebuild its catalog from the
+// nodes alone; a blob the manifest does not know has only fileId and size.
+func (n *Node) handleList(w http.ResponseWriter, r *http.Request) {
+	type fileEntry struct {
+		FileID     string    `json:"fileId"`
+		Size       int64     `json:"size"`
+		StoredSize int64     `json:"storedSize"`
+		Checksum   string    `json:"checksum,omitempty"`
+		Version    int       `json:"version,omitempty"`
+		ModifiedAt time.Time `json:"modifiedAt,omitzero"`
+		blobLabel
+	}
+	var files []fileEntry
+
+	// Walk through the data directory and the hot tier
+	roots := []string{n.DataDir}
+	if n.HotDir != "" {
+		roots = append(roots, n.HotDir)
+	}
+	for _, root := range roots {
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.IsDir() && path == filepath.Join(root, quarantineDir) {
+				return filepath.SkipDir
+			}
+			// blobs live in two-character shard directories; skip the manifest
+			// and any in-flight temp files
+			if err != nil || info.IsDir() || filepath.Dir(path) == filepath.Clean(root) || strings.HasSuffix(path, ".tmp") {
+				return nil
+			}
+			fileID := filepath.Base(path)
+			f := fileEntry{FileID: fileID, Size: info.Size(), StoredSize: info.Size()}
+			if e, ok := n.entryFor(fileID); ok {
+				f.Size, f.Checksum, f.Version, f.ModifiedAt, f.blobLabel = e.Size, e.Checksum, e.Version, e.ModifiedAt, e.blobLabel
+			}
+			files = append(files, f)
+			return nil
+		})
+	}
+
+	writeJSON(w, map[string]any{"files": files, "count": len(files)})
+}
+
+// handleDelete serves DELETE /files/{fileId} and the older POST /delete,
+// which names the file in its body.
+func (n *Node) handleDelete(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		FileID string `json:"fileId"`
+	}
+	body.FileID = r.PathValue("fileId")
+	if body.FileID == "" {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.FileID == "" {
+			apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json")
+			return
+		}
+	}
+	if _, err := os.Stat(n.dataPathFor(body.FileID)); err != nil {
+		writeJSON(w, map[string]any{"deleted": false, "exists": false})
+		return
+	}
+	n.dropBlob(body.FileID)
+	writeJSON(w, map[string]any{"deleted": true})
+}
+
+func (n *Node) handleVerify(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		FileID   string `json:"fileId"`
+		Checksum string `json:"checksum"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json")
+		return
+	}
+
+	if _, err := os.Stat(n.dataPathFor(body.FileID)); err != nil {
+		apierr.Write(w, http.StatusNotFound, apierr.FileNotFound, "file not found")
+		return
+	}
+	_, computedChecksum, _ := n.hashBlob(body.FileID)
+	e, _ := n.entryFor(body.FileID)
+
+	matches := computedChecksum == body.Checksum
+	writeJSON(w, map[string]any{
+		"fileId":           body.FileID,
+		"version":          e.Version,
+		"expectedChecksum": body.Checksum,
+		"actualChecksum":   computedChecksum,
+		"verified":         matches,
+	})
+}
+
+/* ---------------- TIERING ---------------- */
+
+// Tier values recorded in the manifest; cold blobs leave Tier empty.
+const (
+	tierHot  = "hot"
+	tierCold = ""
+)
+
+// startTiering rebalances the hot tier every TierInterval.
+func (n *Node) startTiering() {
+	go n.every(n.TierInterval, n.rebalanceTiers)
+}
+
+// coolHeat returns the current read heat and halves it, so a blob's heat is
+// roughly its reads over the last couple of intervals.
+func (n *Node) coolHeat() map[string]float64 {
+	n.readsMu.Lock()
+	defer n.readsMu.Unlock()
+	heat := make(map[string]float64, len(n.heat))
+	for id, h := range n.heat {
+		heat[id] = h
+		if h /= 2; h < 0.1 {
+			delete(n.heat, id)
+		} else {
+			n.heat[id] = h
+		}
+	}
+	return heat
+}
+
+// rebalanceTiers demotes hot blobs that cooled below DemoteReads, then
+// promotes cold blobs with at least PromoteReads, hottest first. A promotion
+// that does not fit may push out hot blobs colder than itself.
+func (n *Node) rebalanceTiers() {
+	heat := n.coolHeat()
+	type blob struct {
+		id   string
+		size int64
+		heat float64
+	}
+	var hot, cold []blob
+	var hotUsed int64
+	n.mu.RLock()
+	for id, e := range n.manifest {
+		b := blob{id, e.storedBytes(), heat[id]}
+		switch {
+		case e.Tier == tierHot:
+			hot = append(hot, b)
+			hotUsed += b.size
+		case b.heat >= n.PromoteReads && b.size <= n.HotCapacity:
+			cold = append(cold, b)
+		}
+	}
+	n.mu.RUnlock()
+	sort.Slice(hot, func(i, j int) bool { return hot[i].heat < hot[j].heat })
+	sort.Slice(cold, func(i, j int) bool { return cold[i].heat > cold[j].heat })
+
+	demote := func() {
+		b := hot[0]
+		hot = hot[1:]
+		if err := n.moveBlob(b.id, tierCold); err != nil {
+			log.Printf("tiering: demote %s: %v", b.id, err)
+			return
+		}
+		hotUsed -= b.size
+	}
+	for len(hot) > 0 && hot[0].heat < n.DemoteReads {
+		demote()
+	}
+	for _, c := range cold {
+		var freeable int64
+		for _, h := range hot {
+			if h.heat >= c.heat {
+				break
+			}
+			freeable += h.size
+		}
+		if hotUsed-freeable+c.size > n.HotCapacity {
+			continue
+		}
+		for hotUsed+c.size > n.HotCapacity && len(hot) > 0 && hot[0].heat < c.heat {
+			demote()
+		}
+		if hotUsed+c.size > n.HotCapacity {
+			continue // a demotion failed
+		}
+		if err := n.moveBlob(c.id, tierHot); err != nil {
+			log.Printf("tiering: promote %s: %v", c.id, err)
+			continue
+		}
+		hotUsed += c.size
+	}
+}
+
+// moveBlob copies a blob into the other tier and switches the manifest over
+// once the copy is durable. Readers that already opened the old copy keep
+// it; a blob rewritten or deleted during the copy stays where it is.
+func (n *Node) moveBlob(fileID, to string) error {
+	e, ok := n.entryFor(fileID)
+	if !ok || e.Tier == to {
+		return nil
+	}
+	src := n.dataPathFor(fileID)
+	root := n.DataDir
+	if to == tierHot {
+		root = n.HotDir
+	}
+	dst := shardPath(root, fileID)
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := out.Name()
+	defer os.Remove(tmp) // no-op once renamed
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	_ = os.Chmod(tmp, 0644)
+
+	n.tierMu.Lock()
+	defer n.tierMu.Unlock()
+	n.mu.Lock()
+	cur, ok := n.manifest[fileID]
+	if !ok || cur.Checksum != e.Checksum || !cur.ModifiedAt.Equal(e.ModifiedAt) || cur.Tier != e.Tier {
+		n.mu.Unlock()
+		return fmt.Errorf("blob changed during the move")
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	_ = syncDir(filepath.Dir(dst))
+	cur.Tier = to
+	n.manifest[fileID] = cur
+	n.journalBlob(fileID)
+	if to == tierHot {
+		n.promotions++
+	} else {
+		n.demotions++
+	}
+	n.mu.Unlock()
+	return os.Remove(src)
+}
+
+// reconcileTiers repairs the manifest after a crash in the middle of a
+// move: each blob is recorded in the tier that actually holds it, and
+// leftover copies and temp files in HotDir are removed.
+func (n *Node) reconcileTiers() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	changed := false
+	for id, e := range n.manifest {
+		if e.Tier != tierHot {
+			continue
+		}
+		if _, err := os.Stat(shardPath(n.HotDir, id)); err != nil {
+			e.Tier = tierCold
+			n.manifest[id] = e
+			changed = true
+		}
+	}
+	files, _ := filepath.Glob(filepath.Join(n.HotDir, "*", "*"))
+	for _, p := range files {
+		if filepath.Base(filepath.Dir(p)) == quarantineDir {
+			continue
+		}
+		id := filepath.Base(p)
+		e, ok := n.manifest[id]
+		if strings.HasSuffix(p, ".tmp") || !ok {
+			_ = os.Remove(p)
+			continue
+		}
+		if e.Tier == tierHot {
+			continue
+		}
+		if _, err := os.Stat(shardPath(n.DataDir, id)); err != nil {
+			e.Tier = tierHot
+			n.manifest[id] = e
+			changed = true
+			continue
+		}
+		_ = os.Remove(p)
+	}
+	if changed {
+		n.saveManifest()
+	}
+}
+
+// hotBlobs counts the manifest entries in the hot tier.
+func (n *Node) hotBlobs() int {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	k := 0
+	for _, e := range n.manifest {
+		if e.Tier == tierHot {
+			k++
+		}
+	}
+	return k
+}
+
+/* ---------------- REPLICATION ---------------- */
+
+func hostID() string {
+	h, _ := os.Hostname()
+	return h
+}
+
+// handleBlobInfo describes where and how a blob is stored so a peer on the
+// same host can link it instead of copying it over HTTP.
+func (n *Node) handleBlobInfo(w http.ResponseWriter, r *http.Request) {
+	fileID := r.URL.Query().Get("fileId")
+	e, ok := n.entryFor(fileID)
+	if fileID == "" || !ok {
+		apierr.Write(w, http.StatusNotFound, apierr.FileNotFound, "file not found")
+		return
+	}
+	path, _ := filepath.Abs(n.dataPathFor(fileID))
+	writeJSON(w, map[string]any{
+		"fileId":      fileID,
+		"host":        hostID(),
+		"path":        path,
+		"size":        e.Size,
+		"checksum":    e.Checksum,
+		"encoding":    e.Encoding,
+		"storedSize":  e.StoredSize,
+		"version":     e.Version,
+		"filename":    e.Filename,
+		"contentType": e.ContentType,
+	})
+}
+
+// handleReplicate pulls a blob from another node. When both nodes share a
+// filesystem the blob is hard-linked; otherwise it is downloaded. With
+// move=true the source copy is deleted once the local one is verified.
+func (n *Node) handleReplicate(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		FileID    string `json:"fileId"`
+		SourceURL string `json:"sourceUrl"`
+		Checksum  string `json:"checksum"`
+		Move      bool   `json:"move"`
+	}
+	if n.inMaintenance() {
+		apierr.Write(w, http.StatusServiceUnavailable, apierr.Maintenance, "node is in maintenance mode")
+		return
+	}
+	if n.noSpace(w, 0) {
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.FileID == "" || body.SourceURL == "" {
+		apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json")
+		return
+	}
+	src := strings.TrimRight(body.SourceURL, "/")
+
+	method, err := n.linkFromPeer(src, body.FileID, body.Checksum)
+	if err != nil {
+		log.Printf("replicate %s: local link unavailable (%v), copying over network", body.FileID, err)
+		method, err = n.fetchFromPeer(r.Context(), fetchRequest{FileID: body.FileID, SourceURL: src, Checksum: body.Checksum})
+	}
+	if err != nil {
+		apierr.WriteDetail(w, http.StatusBadGateway, apierr.UpstreamError, "replicate failed", err.Error())
+		return
+	}
+	if body.Move {
+		if req, err := http.NewRequest(http.MethodDelete, src+"/files/"+url.PathEscape(body.FileID), nil); err == nil {
+			if resp, err := (&http.Client{Timeout: 5 * time.Second}).Do(req); err == nil {
+				resp.Body.Close()
+			}
+		}
+	}
+	e, _ := n.entryFor(body.FileID)
+	writeJSON(w, map[string]any{"ok": true, "fileId": body.FileID, "method": method, "size": e.Size, "storedBytes": e.StoredSize, "checksum": e.Checksum})
+}
+
+// handleCopy stores a blob this node holds under a second fileId, for the
+// naming service's file copy. The new name is a hard link to the same
+// inode where the filesystem allows, so nothing is written; uploads and
+// deletes replace or unlink names, never blob contents, so the two stay
+// independent. Otherwise, e.g. for a blob in HotDir on another device, it
+// is copied on disk.
+func (n *Node) handleCopy(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		FromFileID string `json:"fromFileId"`
+		ToFileID   string `json:"toFileId"`
+		Checksum   string `json:"checksum"`
+		Version    int    `json:"version"`
+	}
+	if n.inMaintenance() {
+		apierr.Write(w, http.StatusServiceUnavailable, apierr.Maintenance, "node is in maintenance mode")
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.FromFileID == "" || body.ToFileID == "" {
+		apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json: need fromFileId and toFileId")
+		return
+	}
+	e, ok := n.entryFor(body.FromFileID)
+	if !ok {
+		apierr.Write(w, http.StatusNotFound, apierr.FileNotFound, "file not found")
+		return
+	}
+	if body.Checksum != "" && e.Checksum != body.Checksum {
+		apierr.WriteDetail(w, http.StatusConflict, apierr.ChecksumMismatch, "blob has changed", map[string]string{"have": e.Checksum, "want": body.Checksum})
+		return
+	}
+	if n.noSpace(w, 0) {
+		return
+	}
+	tmp, method, err := n.cloneBlob(body.FromFileID, body.ToFileID)
+	if err == nil {
+		err = n.commitBlob(body.ToFileID, tmp, e.Size, e.Checksum, e.Encoding, e.storedBytes(), max(body.Version, 1), e.blobLabel)
+	}
+	_ = os.Remove(tmp) // no-op once committed
+	if err != nil {
+		apierr.WriteDetail(w, http.StatusInternalServerError, apierr.Internal, "copy failed", err.Error())
+		return
+	}
+	log.Printf("copy %s -> %s (%s)", body.FromFileID, body.ToFileID, method)
+	writeJSON(w, map[string]any{"ok": true, "fileId": body.ToFileID, "method": method, "size": e.Size, "checksum": e.Checksum})
+}
+
+// cloneBlob puts from's blob in a temp file next to where to's will live,
+// for the caller to commit, and says whether it is a "hardlink" or a
+// "copy".
+func (n *Node) cloneBlob(from, to string) (tmp, method string, err error) {
+	n.tierMu.RLock() // keep the source in its tier meanwhile
+	defer n.tierMu.RUnlock()
+	src := n.dataPathFor(from)
+	tmp = n.dataPathFor(to) + ".clone.tmp"
+	_ = os.Remove(tmp)
+	if os.Link(src, tmp) == nil {
+		return tmp, "hardlink", nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return tmp, "", err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return tmp, "", err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return tmp, "copy", err
+}
+
+func (n *Node) linkFromPeer(src, fileID, checksum string) (string, error) {
+	resp, err := http.Get(src + "/blob-info?fileId=" + fileID)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("blob-info: status %d", resp.StatusCode)
+	}
+	var info struct {
+		Host       string `json:"host"`
+		Path       string `json:"path"`
+		Size       int64  `json:"size"`
+		Checksum   string `json:"checksum"`
+		Encoding   string `json:"encoding"`
+		StoredSize int64  `json:"storedSize"`
+		Version    int    `json:"version"`
+		blobLabel
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", err
+	}
+	if info.Host != hostID() {
+		return "", fmt.Errorf("source is on host %q", info.Host)
+	}
+	if checksum != "" && info.Checksum != checksum {
+		return "", fmt.Errorf("source holds %s, want %s", info.Checksum, checksum)
+	}
+	st, err := os.Stat(info.Path)
+	if err != nil {
+		return "", err
+	}
+
+	target := n.dataPathFor(fileID)
+	tmp := target + ".link.tmp"
+	_ = os.Remove(tmp)
+	if err := os.Link(info.Path, tmp); err != nil {
+		return "", err // e.g. different filesystems
+	}
+	defer os.Remove(tmp)
+
+	stored := info.StoredSize
+	if info.Encoding == "" {
+		stored = st.Size()
+	}
+	// the link shares the source inode; record it first so hashBlob decodes
+	// it the same way, then verify before exposing it under the real name
+	if err := n.commitBlob(fileID, tmp, info.Size, info.Checksum, info.Encoding, stored, info.Version, info.blobLabel); err != nil {
+		return "", err
+	}
+	if size, sum, err := n.hashBlob(fileID); err != nil || size != info.Size || sum != info.Checksum {
+		n.dropBlob(fileID)
+		return "", fmt.Errorf("linked blob failed verification")
+	}
+	return "hardlink", nil
+}
+
+// fetchRequest names a blob to pull from a peer. SourceFileID defaults to
+// FileID; it differs when the blob is a copy stored under a new fileId.
+type fetchRequest struct {
+	FileID       string `json:"fileId"`
+	SourceURL    string `json:"sourceUrl"`
+	SourceFileID string `json:"sourceFileId"`
+	Checksum     string `json:"checksum"`
+	Size         int64  `json:"size"`
+	Version      int    `json:"version"`
+}
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// handleFetch downloads a blob straight from a peer node, so copies, heals
+// and rebalances move bytes node to node instead of through the gateway.
+// The blob is hashed as it streams in and only committed when it matches
+// checksum; a mismatch is a 409 and leaves nothing behind.
+func (n *Node) handleFetch(w http.ResponseWriter, r *http.Request) {
+	var body fetchRequest
+	if n.inMaintenance() {
+		apierr.Write(w, http.StatusServiceUnavailable, apierr.Maintenance, "node is in maintenance mode")
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.FileID == "" || body.SourceURL == "" || body.Checksum == "" {
+		apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json: need fileId, sourceUrl and checksum")
+		return
+	}
+	if n.noSpace(w, body.Size) {
+		return
+	}
+	body.SourceURL = strings.TrimRight(body.SourceURL, "/")
+	if _, err := n.fetchFromPeer(r.Context(), body); err != nil {
+		if errors.Is(err, errChecksumMismatch) {
+			apierr.WriteDetail(w, http.StatusConflict, apierr.ChecksumMismatch, "fetched blob does not match checksum", err.Error())
+			return
+		}
+		apierr.WriteDetail(w, http.StatusBadGateway, apierr.UpstreamError, "fetch failed", err.Error())
+		return
+	}
+	e, _ := n.entryFor(body.FileID)
+	log.Printf("fetch %s from %s (%d bytes)", body.FileID, body.SourceURL, e.Size)
+	writeJSON(w, map[string]any{"ok": true, "fileId": body.FileID, "method": "network", "size": e.Size, "storedBytes": e.StoredSize, "checksum": e.Checksum, "version": e.Version})
+}
+
+// fetchFromPeer streams a blob from f.SourceURL into a temp file, hashing
+// it on the way, and commits it under f.FileID once size and checksum
+// check out. A source whose ETag already names another checksum is given
+// up on before any body is read.
+func (n *Node) fetchFromPeer(ctx context.Context, f fetchRequest) (string, error) {
+	srcID := cmp.Or(f.SourceFileID, f.FileID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.SourceURL+"/download/"+url.PathEscape(srcID), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("download: status %d", resp.StatusCode)
+	}
+	if tag := strings.Trim(resp.Header.Get("ETag"), `"`); f.Checksum != "" && tag != "" && tag != f.Checksum {
+		return "", fmt.Errorf("%w: source holds %s, want %s", errChecksumMismatch, tag, f.Checksum)
+	}
+	want := f.Size
+	if want <= 0 && !resp.Uncompressed {
+		want = resp.ContentLength
+	}
+	var src io.Reader = resp.Body
+	if want > 0 {
+		src = io.LimitReader(resp.Body, want+1) // one byte over is enough to tell
+	}
+
+	target := n.dataPathFor(f.FileID)
+	out, err := os.CreateTemp(filepath.Dir(target), filepath.Base(target)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	tmp := out.Name()
+	defer os.Remove(tmp)
+	encoding := ""
+	if n.Compression.applies(resp.Header.Get("Content-Type"), want) {
+		encoding = "gzip"
+	}
+	size, sum, err := writeBlob(out, src, encoding)
+	stored, _ := out.Seek(0, io.SeekCurrent)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	if want > 0 && size != want {
+		return "", fmt.Errorf("%w: fetched %d bytes, want %d", errChecksumMismatch, size, want)
+	}
+	if f.Checksum != "" && sum != f.Checksum {
+		return "", fmt.Errorf("%w: fetched blob hashes to %s, want %s", errChecksumMismatch, sum, f.Checksum)
+	}
+	version := f.Version
+	if version <= 0 {
+		version = 1
+		fmt.Sscanf(resp.Header.Get("X-Blob-Version"), "%d", &version)
+	}
+	label := blobLabel{ContentType: resp.Header.Get("X-Blob-Content-Type")}
+	label.Filename, _ = url.PathUnescape(resp.Header.Get("X-Blob-Filename"))
+	if err := n.commitBlob(f.FileID, tmp, size, sum, encoding, stored, version, label); err != nil {
+		return "", err
+	}
+	n.countReceived(size)
+	return "network", nil
+}
+
+// commitBlob renames a fully written temp file into place and records it.
+func (n *Node) commitBlob(fileID, tmp string, size int64, checksum, encoding string, stored int64, version int, label blobLabel) error {
+	n.tierMu.RLock()
+	defer n.tierMu.RUnlock()
+	target := n.dataPathFor(fileID)
+	var replaced int64
+	if old, err := os.Stat(target); err == nil {
+		replaced = old.Size()
+	}
+	_ = os.Chmod(tmp, 0644) // CreateTemp makes files 0600
+	if err := os.Rename(tmp, target); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(target)); err != nil {
+		log.Printf("fsync %s: %v", filepath.Dir(target), err)
+	}
+	n.addUsed(stored - replaced)
+	n.recordBlob(fileID, size, checksum, encoding, stored, version, label)
+	return nil
+}
+
+// dropBlob removes a blob and its manifest entry.
+func (n *Node) dropBlob(fileID string) {
+	n.tierMu.RLock()
+	defer n.tierMu.RUnlock()
+	path := n.dataPathFor(fileID)
+	if info, err := os.Stat(path); err == nil {
+		_ = os.Remove(path)
+		n.addUsed(-info.Size())
+	}
+	n.forgetBlob(fileID)
+}
+
+/* ---------------- CHAOS ---------------- */
+
+// chaosConfig is the fault injection a test has switched on through
+// /admin/chaos. The zero value injects nothing.
+type chaosConfig struct {
+	DropUploadPct    float64 `json:"dropUploadPct"`    // uploads refused with 503, nothing stored
+	LatencyMs        int64   `json:"latencyMs"`        // delay before every non-admin request
+	LatencyJitterMs  int64   `json:"latencyJitterMs"`  // plus up to this much at random
+	CorruptReadPct   float64 `json:"corruptReadPct"`   // downloads sent with one byte flipped
+	RefuseHeartbeats bool    `json:"refuseHeartbeats"` // no heartbeats or peer reports, so naming stops hearing from us
+}
+
+type chaosCounters struct {
+	dropped, delayed, corrupted, skippedBeats atomic.Int64
+}
+
+func (n *Node) chaosConf() chaosConfig {
+	if c := n.chaos.Load(); c != nil {
+		return *c
+	}
+	return chaosConfig{}
+}
+
+func chance(pct float64) bool { return pct > 0 && rand.Float64()*100 < pct }
+
+// chaosDelay wraps the data-path handlers with the configured latency.
+// /admin/ stays prompt so a test can always switch chaos off again.
+func (n *Node) chaosDelay(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c := n.chaosConf(); c.LatencyMs > 0 || c.LatencyJitterMs > 0 {
+			if !strings.HasPrefix(r.URL.Path, "/admin/") {
+				d := time.Duration(c.LatencyMs) * time.Millisecond
+				if c.LatencyJitterMs > 0 {
+					d += time.Duration(rand.Int63n(c.LatencyJitterMs+1)) * time.Millisecond
+				}
+				n.chaosHits.delayed.Add(1)
+				select {
+				case <-time.After(d):
+				case <-r.Context().Done():
+					return
+				}
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// dropUpload reports whether chaos swallows this upload.
+func (n *Node) dropUpload() bool {
+	if !chance(n.chaosConf().DropUploadPct) {
+		return false
+	}
+	n.chaosHits.dropped.Add(1)
+	return true
+}
+
+// corruptingWriter flips one byte of the response body, the first one
+// written; the headers and length stay as they were.
+type corruptingWriter struct {
+	http.ResponseWriter
+	done bool
+}
+
+func (cw *corruptingWriter) Write(b []byte) (int, error) {
+	if cw.done || len(b) == 0 {
+		return cw.ResponseWriter.Write(b)
+	}
+	cw.done = true
+	bad := append([]byte(nil), b...)
+	bad[0] ^= 0xff
+	return cw.ResponseWriter.Write(bad)
+}
+
+// handleAdminChaos replaces the fault injection config; {} turns it off.
+// It answers 403 unless the node was started with CHAOS_ENABLED=true.
+func (n *Node) handleAdminChaos(w http.ResponseWriter, r *http.Request) {
+	if !n.ChaosEnabled {
+		apierr.Write(w, http.StatusForbidden, apierr.FeatureDisabled, "chaos mode disabled: set CHAOS_ENABLED=true")
+		return
+	}
+	var c chaosConfig
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json")
+		return
+	}
+	if c.DropUploadPct < 0 || c.DropUploadPct > 100 || c.CorruptReadPct < 0 || c.CorruptReadPct > 100 {
+		apierr.Write(w, http.StatusBadRequest, apierr.BadRequest, "percentages must be between 0 and 100")
+		return
+	}
+	if c.LatencyMs < 0 || c.LatencyJitterMs < 0 {
+		apierr.Write(w, http.StatusBadRequest, apierr.BadRequest, "latency must not be negative")
+		return
+	}
+	n.chaos.Store(&c)
+	log.Printf("chaos: %+v", c)
+	writeJSON(w, map[string]any{"nodeId": n.NodeID, "chaos": c})
+}
+
+// chaosStatus is the /health view of chaos mode.
+func (n *Node) chaosStatus() map[string]any {
+	return map[string]any{
+		"enabled":      n.ChaosEnabled,
+		"config":       n.chaosConf(),
+		"dropped":      n.chaosHits.dropped.Load(),
+		"delayed":      n.chaosHits.delayed.Load(),
+		"corrupted":    n.chaosHits.corrupted.Load(),
+		"skippedBeats": n.chaosHits.skippedBeats.Load(),
+	}
+}
+
+/* ---------------- ADMIN ---------------- */
+
+// admin wraps an admin handler with the ADMIN_TOKEN bearer token check.
+// Without a configured token the admin API is disabled.
+func (n *Node) admin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(n.AdminToken) == 0 {
+			apierr.Write(w, http.StatusForbidden, apierr.FeatureDisabled, "admin API disabled: set ADMIN_TOKEN")
+			return
+		}
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), n.AdminToken) != 1 {
+			apierr.Write(w, http.StatusUnauthorized, apierr.InvalidAdminToken, "invalid admin token")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// handleAdminStop stops the node gracefully: in-flight requests finish, then
+// Close saves the manifest and leaves the clean-shutdown marker.
+func (n *Node) handleAdminStop(w http.ResponseWriter, r *http.Request) {
+	// leave a trace in the naming service's audit log of who stopped us
+	actor := r.Header.Get("X-Actor")
+	if actor == "" {
+		actor = r.RemoteAddr
+	}
+	n.audit(actor, "node-shutdown")
+	writeJSON(w, map[string]any{"ok": true, "stopping": true})
+	n.stopOnce.Do(func() { close(n.stopCh) })
+}
+
+// handleAdminMaintenance toggles maintenance mode: uploads and incoming
+// replication are refused with 503 while downloads keep working.
+func (n *Node) handleAdminMaintenance(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		apierr.Write(w, http.StatusBadRequest, apierr.InvalidJSON, "bad json")
+		return
+	}
+	n.mu.Lock()
+	n.maintenance = body.Enabled
+	n.mu.Unlock()
+	log.Printf("maintenance mode %v", body.Enabled)
+	writeJSON(w, map[string]any{"nodeId": n.NodeID, "maintenance": body.Enabled})
+}
+
+// handleAdminReload re-reads the manifest from disk and re-runs the startup
+// integrity check, e.g. after blobs were restored by hand.
+func (n *Node) handleAdminReload(w http.ResponseWriter, r *http.Request) {
+	n.mu.Lock()
+	n.loadManifest()
+	entries := len(n.manifest)
+	n.mu.Unlock()
+	go n.startupCheck()
+	writeJSON(w, map[string]any{"nodeId": n.NodeID, "reloaded": true, "manifestEntries": entries})
+}
+
+// exportEntry describes one blob in an export's manifest.json. Path is the
+// tar member holding its content; it is empty, and Error says why, for a
+// blob that could not be read.
+type exportEntry struct {
+	Path string `json:"path,omitempty"`
+	blobLabel
+	Size       int64     `json:"size"`
+	Checksum   string    `json:"checksum"`
+	Version    int       `json:"version,omitempty"`
+	ModifiedAt time.Time `json:"modifiedAt"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// handleAdminExport streams every blob on the node as a tar, for migrating
+// data off the cluster or recovering it when the naming service's metadata
+// is lost. Each blob's original (uncompressed) content is the member
+// files/<fileId>/<filename>; manifest.json, the last member, maps each
+// fileId to its path, filename, size, checksum and version. Content is
+// hashed on the way out and a blob that no longer matches its checksum is
+// still exported but carries an error in the manifest.
+func (n *Node) handleAdminExport(w http.ResponseWriter, r *http.Request) {
+	n.mu.RLock()
+	ids := make([]string, 0, len(n.manifest))
+	for id := range n.manifest {
+		ids = append(ids, id)
+	}
+	n.mu.RUnlock()
+	sort.Strings(ids)
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-export.tar"`, n.NodeID))
+	tw := tar.NewWriter(w)
+	manifest := make(map[string]exportEntry, len(ids))
+	var total int64
+	for _, id := range ids {
+		e, ok := n.entryFor(id)
+		if !ok {
+			continue // deleted since we listed it
+		}
+		x := exportEntry{blobLabel: e.blobLabel, Size: e.Size, Checksum: e.Checksum, Version: e.Version, ModifiedAt: e.ModifiedAt}
+		rc, err := n.openBlob(id)
+		if err != nil {
+			x.Error = err.Error()
+			manifest[id] = x
+			continue
+		}
+		x.Path = path.Join("files", url.PathEscape(id), exportName(e.Filename))
+		err = tw.WriteHeader(&tar.Header{Name: x.Path, Mode: 0644, Size: e.Size, ModTime: e.ModifiedAt, Format: tar.FormatPAX})
+		if err == nil {
+			x.Error, err = exportBlob(tw, rc, e)
+		}
+		rc.Close()
+		if err != nil {
+			log.Printf("export: %v", err) // the client went away; the tar is cut short
+			return
+		}
+		manifest[id] = x
+		total += e.Size
+	}
+	b, _ := json.MarshalIndent(map[string]any{
+		"nodeId":     n.NodeID,
+		"exportedAt": time.Now().UTC(),
+		"files":      manifest,
+	}, "", "  ")
+	err := tw.WriteHeader(&tar.Header{Name: "manifest.json", Mode: 0644, Size: int64(len(b)), ModTime: time.Now()})
+	if err == nil {
+		_, err = tw.Write(b)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		log.Printf("export: %v", err)
+		return
+	}
+	log.Printf("export: %d blobs, %d bytes", len(manifest), total)
+}
+
+// exportBlob copies exactly e.Size bytes of content into the tar member,
+// padding with zeros if the blob turns out shorter so the archive stays
+// well formed. problem describes a blob that did not match its manifest
+// entry; err is a write error.
+func exportBlob(tw *tar.Writer, rc io.Reader, e manifestEntry) (problem string, err error) {
+	h := sha256.New()
+	src := &readErrs{r: io.TeeReader(rc, h)}
+	k, err := io.CopyN(tw, src, e.Size)
+	if err != nil && src.err == nil {
+		return "", err
+	}
+	if src.err != nil && src.err != io.EOF {
+		problem = src.err.Error()
+	}
+	if k < e.Size {
+		if _, err := io.CopyN(tw, zeroReader{}, e.Size-k); err != nil {
+			return "", err
+		}
+		return cmp.Or(problem, fmt.Sprintf("blob is %d bytes short", e.Size-k)), nil
+	}
+	if sum := "sha256:" + hex.EncodeToString(h.Sum(nil)); sum != e.Checksum {
+		return "checksum mismatch: content hashes to " + sum, nil
+	}
+	return "", nil
+}
+
+// readErrs remembers the error its reader returned, so a copy can tell a
+// failed read from a failed write.
+type readErrs struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readErrs) Read(p []byte) (int, error) {
+	k, err := r.r.Read(p)
+	if err != nil {
+		r.err = err
+	}
+	return k, err
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// exportName is the last element of filename, or "blob" when there is
+// none worth keeping.
+func exportName(filename string) string {
+	name := path.Base(strings.ReplaceAll(filename, `\`, "/"))
+	if name == "." || name == "/" || name == ".." {
+		return "blob"
+	}
+	return name
+}
+
+func (n *Node) registerToNaming() {
+	body := map[string]any{
+		"nodeId":              n.NodeID,
+		"url":                 fmt.Sprintf("http://localhost:%s", n.Port),
+		"capacityBytes":       n.CapacityBytes,
+		"heartbeatIntervalMs": n.Heartbeat.Milliseconds(),
+		"version":             Version,
+		"usedBytes":           n.currentUsed(),
+		"zone":                n.Zone,
+		"tags":                n.Tags,
+		"weight":              n.Weight,
+	}
+	for _, u := range n.namingURLs() {
+		_ = postJSON(u+"/register-node", body)
+	}
+}
+
+// namingURLs is every naming shard the node reports to, NamingURL first.
+// When the catalog is sharded the node registers, heartbeats and reports
+// to each; everything else goes to NamingURL.
+func (n *Node) namingURLs() []string {
+	return append([]string{n.NamingURL}, n.NamingShards...)
+}
+func (n *Node) startHeartbeat() {
+	go n.every(n.Heartbeat, func() {
+		if n.chaosConf().RefuseHeartbeats {
+			n.chaosHits.skippedBeats.Add(1)
+			return
+		}
+		reads, received := n.takeReads()
+		free := n.refreshDisk()
+		body := map[string]any{
+			"nodeId": n.NodeID, "usedBytes": n.currentUsed(), "degraded": n.isDegraded(),
+			"readOnly": n.isReadOnly(), "diskFreeBytes": free, "reads": reads,
+			"received": received, "inventory": n.inventory(),
+		}
+		// every shard gets every read and ignores the files it does not own;
+		// the counts are kept for the next beat if the first one missed it
+		for i, u := range n.namingURLs() {
+			if err := postJSON(u+"/heartbeat", body); err != nil && i == 0 {
+				n.restoreReads(reads, received)
+			}
+		}
+	})
+}
+
+// startGossip probes every peer known to the naming service and reports which
+// ones answered, so naming can tell a partitioned node from a dead one.
+func (n *Node) startGossip() {
+	go n.every(n.Heartbeat, n.probePeers)
+}
+
+func (n *Node) probePeers() {
+	resp, err := http.Get(n.NamingURL + "/list-nodes")
+	if err != nil {
+		return
+	}
+	var peers []struct {
+		NodeID string `json:"nodeId"`
+		URL    string `json:"url"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&peers)
+	resp.Body.Close()
+
+	type observation struct {
+		NodeID    string `json:"nodeId"`
+		Reachable bool   `json:"reachable"`
+	}
+	var obs []observation
+	client := &http.Client{Timeout: time.Second}
+	for _, p := range peers {
+		if p.NodeID == n.NodeID {
+			continue
+		}
+		pr, err := client.Get(strings.TrimRight(p.URL, "/") + "/health")
+		reachable := err == nil && pr.StatusCode/100 == 2
+		if err == nil {
+			pr.Body.Close()
+		}
+		obs = append(obs, observation{NodeID: p.NodeID, Reachable: reachable})
+	}
+	// a peer report counts as proof of life too, so chaos mutes it as well
+	if len(obs) == 0 || n.chaosConf().RefuseHeartbeats {
+		return
+	}
+	for _, u := range n.namingURLs() {
+		_ = postJSON(u+"/peer-report", map[string]any{"observer": n.NodeID, "observations": obs})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// audit records an action on this node in the naming service's audit log.
+// The naming service only takes entries that carry its admin token, which
+// the nodes share with it as ADMIN_TOKEN.
+func (n *Node) audit(actor, action string) {
+	b, _ := json.Marshal(map[string]string{"actor": actor, "action": action, "target": n.NodeID})
+	req, _ := http.NewRequest("POST", n.NamingURL+"/audit", bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+string(n.AdminToken))
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	io.ReadAll(resp.Body)
+}
+
+func postJSON(url string, body any) error {
+	b, _ := json.Marshal(body)
+	req, _ := http.NewRequest("POST", url, strings.NewReader(string(b)))
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.ReadAll(resp.Body)
+	return nil
+}
+
+/* ---------------- NODE ---------------- */
+
+// NewNode loads the manifest from cfg.DataDir, reconciles the hot tier and
+// starts the startup integrity check in the background. The node joins the
+// cluster once Start is called.
+func NewNode(cfg Config) (*Node, error) {
+	n := &Node{Config: cfg, stopCh: make(chan struct{}), quit: make(chan struct{})}
+	if cfg.MaxConcurrentUploads > 0 {
+		n.uploadSlots = make(chan struct{}, cfg.MaxConcurrentUploads)
+	}
+	n.loadManifest()
+	if n.HotDir != "" {
+		n.reconcileTiers()
+	} else if hot := n.hotBlobs(); hot > 0 {
+		return nil, fmt.Errorf("%d blobs are in the hot tier but HOT_DIR is unset; set it to the previous hot directory", hot)
+	}
+	n.refreshDisk()
+	n.degraded = true
+	go n.startupCheck()
+	return n, nil
+}
+
+// ServeMux routes every storage node endpoint.
+func (n *Node) ServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	routes := []struct {
+		method, path string
+		handler      http.HandlerFunc
+	}{
+		{"POST", "/upload", n.handleUpload},
+		{"OPTIONS", "/upload", n.handleUpload}, // CORS preflight for direct uploads
+		{"GET", "/download/{fileId}", n.handleDownload},
+		{"GET", "/has", n.handleHas},
+		{"GET", "/health", n.handleHealth},
+		{"GET", "/list", n.handleList},
+		{"POST", "/verify", n.handleVerify},
+		{"POST", "/admin/stop", n.admin(n.handleAdminStop)},
+		{"POST", "/admin/maintenance-mode", n.admin(n.handleAdminMaintenance)},
+		{"POST", "/admin/reload", n.admin(n.handleAdminReload)},
+		{"POST", "/admin/chaos", n.admin(n.handleAdminChaos)},
+		{"GET", "/admin/export", n.admin(n.handleAdminExport)},
+		{"DELETE", "/files/{fileId}", n.handleDelete},
+		{"POST", "/delete", n.handleDelete}, // deprecated: DELETE /files/{fileId}
+		{"GET", "/blob-info", n.handleBlobInfo},
+		{"POST", "/replicate", n.handleReplicate},
+		{"POST", "/copy", n.handleCopy},
+		{"POST", "/fetch", n.handleFetch},
+	}
+	for _, rt := range routes {
+		mux.HandleFunc(rt.method+" "+rt.path, rt.handler)
+	}
+	if n.Debug {
+		diag.Register(mux, n.admin, "storage-node "+n.NodeID, Version, n.debugGauges)
+	}
+	mux.HandleFunc("/", apierr.NoRoute(mux))
+	return mux
+}
+
+// debugGauges are the node's own figures on /debug/status.
+func (n *Node) debugGauges() map[string]any {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return map[string]any{
+		"blobs":       len(n.manifest),
+		"usedBytes":   n.usedBytes,
+		"openUploads": n.uploading.Load(),
+		"quarantined": len(n.quarantined),
+		"degraded":    n.degraded,
+	}
+}
+
+// Handler is ServeMux behind request IDs, the body size limits and, when
+// chaos mode is enabled, the chaos latency injector.
+func (n *Node) Handler() http.Handler {
+	h := n.limitBody(n.ServeMux())
+	if n.ChaosEnabled {
+		h = n.chaosDelay(h)
+	}
+	return apierr.WithRequestID(h)
+}
+
+// Start registers with the naming service and starts heartbeats (unless
+// SkipRegistration), gossip and, with a hot tier, tiering.
+func (n *Node) Start() {
+	if !n.SkipRegistration {
+		n.registerToNaming()
+		n.startHeartbeat()
+	}
+	n.startGossip()
+	if n.HotDir != "" {
+		n.startTiering()
+	}
+}
+
+// Stopping is closed once /admin/stop has asked the node to shut down.
+func (n *Node) Stopping() <-chan struct{} {
+	return n.stopCh
+}
+
+// Close ends the background loops, saves the manifest and leaves the
+// clean-shutdown marker. Requests still in flight must be drained first.
+func (n *Node) Close() {
+	n.quitOnce.Do(func() { close(n.quit) })
+	n.mu.Lock()
+	n.saveManifest()
+	n.mu.Unlock()
+	_ = os.WriteFile(n.cleanMarkPath(), []byte(time.Now().UTC().Format(time.RFC3339Nano)), 0644)
+}
+
+// every runs fn on a ticker until Close.
+func (n *Node) every(d time.Duration, fn func()) {
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			fn()
+		case <-n.quit:
+			return
+		}
+	}
+}
@@ -1,686 +1,178 @@
+// Command naming_service runs the naming service; the service itself lives
+// in internal/naming. All configuration comes from the environment.
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
-	"encoding/json"
-	"errors"
-	"fmt"
+	"context"
 	"log"
-	"math"
 	"net/http"
 	"os"
-	"path/filepath"
-	"sort"
-	"strings"
-	"sync"
+	"os/signal"
+	"slices"
+	"syscall"
 	"time"
-)
-
-/* ==================== TYPES ==================== */
-
-type ReplicaStatus string
-
-const (
-	ReplicaReady   ReplicaStatus = "READY"
-	ReplicaMissing ReplicaStatus = "MISSING"
-	ReplicaStale   ReplicaStatus = "STALE"
-)
-
-type FileState string
 
-const (
-	StateAllocated FileState = "ALLOCATED"
-	StatePartial   FileState = "PARTIAL"
-	StateAvailable FileState = "AVAILABLE"
-	StateDegraded  FileState = "DEGRADED"
-	StateDeleted   FileState = "DELETED"
+	"ProjectAkhir/internal/naming"
+	"ProjectAkhir/internal/startup"
 )
 
-type NodeStatus string
-
-const (
-	NodeHealthy NodeStatus = "HEALTHY"
-	NodeSuspect NodeStatus = "SUSPECT"
-	NodeDown    NodeStatus = "DOWN"
-)
-
-type ReplicaInfo struct {
-	NodeID         string        `json:"nodeId"`
-	URL            string        `json:"url"`
-	Status         ReplicaStatus `json:"status"`
-	LastVerifiedAt time.Time     `json:"lastVerifiedAt"`
-}
-
-type FileMetadata struct {
-	FileID      string        `json:"fileId"`
-	Filename    string        `json:"filename"`
-	Size        int64         `json:"size"`
-	Checksum    string        `json:"checksum"`
-	ContentType string        `json:"contentType"`
-	Version     int           `json:"version"`
-	Replicas    []ReplicaInfo `json:"replicas"`
-	State       FileState     `json:"state"`
-	CreatedAt   time.Time     `json:"createdAt"`
-	UpdatedAt   time.Time     `json:"updatedAt"`
-}
-
-type NodeInfo struct {
-	NodeID        string     `json:"nodeId"`
-	URL           string     `json:"url"`
-	CapacityBytes int64      `json:"capacityBytes"`
-	UsedBytes     int64      `json:"usedBytes"`
-	Status        NodeStatus `json:"status"`
-	LastSeenAt    time.Time  `json:"lastSeenAt"`
-	Zone          string     `json:"zone,omitempty"`
-	Tags          []string   `json:"tags,omitempty"`
-	LastChosen    time.Time  `json:"lastChosen"`
-}
-
-/* ============== IN-MEM STORE + PERSIST ============== */
-
-type Store struct {
-	mu        sync.RWMutex
-	files     map[string]*FileMetadata // fileId -> meta
-	nodes     map[string]*NodeInfo     // nodeId -> info
-	filesPath string
-	nodesPath string
-	repFactor int
-}
+// Version is stamped at build time with -ldflags "-X main.Version=...".
+var Version = "dev"
 
-func NewStore(base string, repFactor int) (*Store, error) {
-	if err := os.MkdirAll(base, 0755); err != nil {
-		return nil, err
-	}
-	s := &Store{
-		files:     map[string]*FileMetadata{},
-		nodes:     map[string]*NodeInfo{},
-		filesPath: filepath.Join(base, "files.json"),
-		nodesPath: filepath.Join(base, "nodes.json"),
-		repFactor: repFactor,
-	}
-	_ = s.load()
-	return s, nil
-}
-
-func (s *Store) load() error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if b, err := os.ReadFile(s.filesPath); err == nil {
-		_ = json.Unmarshal(b, &s.files)
-	}
-	if b, err := os.ReadFile(s.nodesPath); err == nil {
-		_ = json.Unmarshal(b, &s.nodes)
-	}
-	return nil
-}
-
-func (s *Store) persist() {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	_ = writeJSONFile(s.filesPath, s.files)
-	_ = writeJSONFile(s.nodesPath, s.nodes)
-}
-
-func writeJSONFile(path string, v any) error {
-	tmp := path + ".tmp"
-	b, _ := json.MarshalIndent(v, "", "  ")
-	if err := os.WriteFile(tmp, b, 0644); err != nil {
-		return err
-	}
-	return os.Rename(tmp, path)
-}
-
-/* ==================== HELPERS ==================== */
-
-func now() time.Time { return time.Now().UTC() }
-
-func healthOf(n *NodeInfo) NodeStatus {
-	ago := time.Since(n.LastSeenAt)
-	switch {
-	case ago > 20*time.Second:
-		return NodeDown
-	case ago > 10*time.Second:
-		return NodeSuspect
+func main() {
+	cc := startup.New("naming-service")
+	addr := cc.Str("ADDR", ":8000")
+	// These only seed metadata/settings.json; afterwards use /admin/settings.
+	seed := naming.DefaultSettings()
+	seed.DefaultHeartbeatMs = cc.Duration("DEFAULT_HEARTBEAT", time.Duration(seed.DefaultHeartbeatMs)*time.Millisecond).Milliseconds()
+	if seed.DefaultHeartbeatMs <= 0 {
+		cc.Fail("DEFAULT_HEARTBEAT must be greater than zero")
+	}
+	seed.SuspectAfterBeats = cc.Float("SUSPECT_AFTER_BEATS", seed.SuspectAfterBeats)
+	seed.DownAfterBeats = cc.Float("DOWN_AFTER_BEATS", seed.DownAfterBeats)
+	if seed.DownAfterBeats <= seed.SuspectAfterBeats {
+		cc.Fail("DOWN_AFTER_BEATS (%g) must be greater than SUSPECT_AFTER_BEATS (%g)", seed.DownAfterBeats, seed.SuspectAfterBeats)
+	}
+	switch p := naming.ReadPolicy(cc.Str("READ_POLICY", string(naming.ReadLenient))); p {
+	case naming.ReadStrict, naming.ReadLenient:
+		seed.ReadPolicy = p
 	default:
-		return NodeHealthy
-	}
-}
-
-func freeBytes(n *NodeInfo) int64 { return n.CapacityBytes - n.UsedBytes }
-
-func loadFactor(n *NodeInfo) float64 {
-	if n.CapacityBytes <= 0 {
-		return math.MaxFloat64
-	}
-	return float64(n.UsedBytes) / float64(n.CapacityBytes)
-}
-
-func uuidLike(seed string) string {
-	sum := sha256.Sum256([]byte(fmt.Sprintf("%s-%d", seed, time.Now().UnixNano())))
-	hexed := hex.EncodeToString(sum[:])
-	return fmt.Sprintf("%s-%s-%s-%s-%s", hexed[:8], hexed[8:12], hexed[12:16], hexed[16:20], hexed[20:32])
-}
-
-/* ==================== HTTP SERVER ==================== */
-
-type Server struct{ store *Store }
-
-func (sv *Server) handleRegisterNode(w http.ResponseWriter, r *http.Request) {
-	var body struct {
-		NodeID        string   `json:"nodeId"`
-		URL           string   `json:"url"`
-		CapacityBytes int64    `json:"capacityBytes"`
-		Zone          string   `json:"zone,omitempty"`
-		Tags          []string `json:"tags,omitempty"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil ||
-		body.NodeID == "" || body.URL == "" || body.CapacityBytes <= 0 {
-		http.Error(w, "bad payload", http.StatusBadRequest)
-		return
-	}
-
-	sv.store.mu.Lock()
-	sv.store.nodes[body.NodeID] = &NodeInfo{
-		NodeID:        body.NodeID,
-		URL:           body.URL,
-		CapacityBytes: body.CapacityBytes,
-		UsedBytes:     0,
-		Status:        NodeHealthy,
-		LastSeenAt:    now(),
-		Zone:          body.Zone,
-		Tags:          body.Tags,
-	}
-	sv.store.mu.Unlock()
-	go sv.store.persist()
-
-	writeJSONResp(w, map[string]any{"ok": true})
-}
-
-func (sv *Server) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
-	var body struct {
-		NodeID    string `json:"nodeId"`
-		UsedBytes int64  `json:"usedBytes"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		http.Error(w, "bad json", http.StatusBadRequest)
-		return
-	}
-	sv.store.mu.Lock()
-	defer sv.store.mu.Unlock()
-	n, ok := sv.store.nodes[body.NodeID]
-	if !ok {
-		http.Error(w, "unknown node", http.StatusNotFound)
-		return
-	}
-	n.UsedBytes = body.UsedBytes
-	n.LastSeenAt = now()
-	n.Status = healthOf(n)
-	go sv.store.persist()
-
-	writeJSONResp(w, map[string]any{"ok": true, "status": n.Status})
-}
-
-func (sv *Server) handleAllocate(w http.ResponseWriter, r *http.Request) {
-	var body struct {
-		Filename    string `json:"filename"`
-		Size        int64  `json:"size"`
-		Checksum    string `json:"checksum"`
-		ContentType string `json:"contentType"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil ||
-		body.Filename == "" || body.Size <= 0 || !strings.HasPrefix(body.Checksum, "sha256:") {
-		http.Error(w, "invalid payload", http.StatusBadRequest)
-		return
-	}
-
-	fileID := uuidLike(body.Filename)
-	replicas, err := sv.pickReplicas(body.Size)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusConflict)
-		return
-	}
-
-	meta := &FileMetadata{
-		FileID:      fileID,
-		Filename:    body.Filename,
-		Size:        body.Size,
-		Checksum:    body.Checksum,
-		ContentType: body.ContentType,
-		Version:     1,
-		State:       StateAllocated,
-		CreatedAt:   now(),
-		UpdatedAt:   now(),
-	}
-	for _, n := range replicas {
-		meta.Replicas = append(meta.Replicas, ReplicaInfo{
-			NodeID: n.NodeID, URL: n.URL, Status: ReplicaReady, LastVerifiedAt: now(),
-		})
-	}
-
-	sv.store.mu.Lock()
-	sv.store.files[fileID] = meta
-	for _, n := range replicas {
-		sv.store.nodes[n.NodeID].LastChosen = now()
-	}
-	sv.store.mu.Unlock()
-	go sv.store.persist()
-
-	type outRep struct{ NodeID, URL string }
-	out := struct {
-		FileID   string   `json:"fileId"`
-		Replicas []outRep `json:"replicas"`
-	}{FileID: fileID}
-	for _, rinfo := range meta.Replicas {
-		out.Replicas = append(out.Replicas, outRep{rinfo.NodeID, rinfo.URL})
-	}
-	writeJSONResp(w, out)
-}
-
-func (sv *Server) pickReplicas(size int64) ([]*NodeInfo, error) {
-	sv.store.mu.RLock()
-	defer sv.store.mu.RUnlock()
-
-	var cands []*NodeInfo
-	for _, n := range sv.store.nodes {
-		if healthOf(n) == NodeHealthy && freeBytes(n) >= size {
-			cands = append(cands, n)
+		cc.Fail("READ_POLICY must be %q or %q, got %q", naming.ReadStrict, naming.ReadLenient, p)
+	}
+	seed.PlacementPolicy = naming.PlacementPolicy(cc.Str("PLACEMENT_POLICY", string(naming.PlaceLeastLoaded)))
+	if !slices.Contains(naming.PlacementPolicies(), seed.PlacementPolicy) {
+		cc.Fail("PLACEMENT_POLICY must be one of %v, got %q", naming.PlacementPolicies(), seed.PlacementPolicy)
+	}
+	cfg := naming.Config{MetadataDir: "metadata", Seed: seed}
+	cfg.AntiEntropyInterval = cc.OptionalDuration("ANTI_ENTROPY_INTERVAL", 5*time.Minute) // 0 disables
+	cfg.VerifyInterval = cc.OptionalDuration("VERIFY_INTERVAL", time.Minute)              // 0 disables
+	cfg.VerifyBatch = cc.Int("VERIFY_BATCH", 20)
+	if cfg.VerifyBatch < 1 {
+		cc.Fail("VERIFY_BATCH must be at least 1")
+	}
+	cfg.HealConcurrency = cc.Int("HEAL_CONCURRENCY", 2)
+	if cfg.HealConcurrency < 1 {
+		cc.Fail("HEAL_CONCURRENCY must be at least 1")
+	}
+	cfg.HealMaxAttempts = cc.Int("HEAL_MAX_ATTEMPTS", 5)
+	if cfg.HealMaxAttempts < 1 {
+		cc.Fail("HEAL_MAX_ATTEMPTS must be at least 1")
+	}
+	cfg.AdminToken = []byte(cc.Secret("ADMIN_TOKEN"))
+	cfg.Debug = cc.Bool("DEBUG_ENDPOINTS", false)
+	if cfg.Debug && len(cfg.AdminToken) == 0 {
+		cc.Fail("DEBUG_ENDPOINTS=true needs ADMIN_TOKEN to be set")
+	}
+	cfg.TicketSecret = []byte(cc.Secret("UPLOAD_TICKET_SECRET"))
+	cfg.PlacementWebhook = cc.Str("PLACEMENT_WEBHOOK", "")
+	if cfg.PlacementWebhook != "" {
+		cc.ServiceURL("PLACEMENT_WEBHOOK", cfg.PlacementWebhook)
+	}
+	cfg.LifecycleInterval = cc.OptionalDuration("LIFECYCLE_INTERVAL", time.Hour)                 // 0 disables
+	cfg.BackupInterval = cc.OptionalDuration("BACKUP_INTERVAL", time.Hour)                       // 0 disables
+	cfg.GeoReplicationInterval = cc.OptionalDuration("GEO_REPLICATION_INTERVAL", 30*time.Second) // 0 disables
+	cfg.AlertInterval = cc.OptionalDuration("ALERT_INTERVAL", 15*time.Second)                    // 0 disables
+	cfg.CapacitySampleInterval = cc.OptionalDuration("CAPACITY_SAMPLE_INTERVAL", 15*time.Minute) // 0 disables
+	cfg.MetricsSampleInterval = cc.OptionalDuration("METRICS_SAMPLE_INTERVAL", 30*time.Second)   // 0 disables
+	cfg.PersistInterval = cc.OptionalDuration("PERSIST_INTERVAL", time.Second)                   // 0 writes after every change
+	if v := cc.Str("SHARD", ""); v != "" {
+		shard, err := naming.ParseShard(v)
+		if err != nil {
+			cc.Fail("SHARD: %v", err)
 		}
-	}
-	if len(cands) < sv.store.repFactor {
-		return nil, errors.New("insufficient healthy nodes")
-	}
-	sort.Slice(cands, func(i, j int) bool {
-		li, lj := loadFactor(cands[i]), loadFactor(cands[j])
-		if li == lj {
-			return cands[i].LastChosen.Before(cands[j].LastChosen)
+		cfg.Shard = shard
+	}
+	cfg.IdempotencyTTL = cc.Duration("IDEMPOTENCY_TTL", 24*time.Hour)
+	if cfg.IdempotencyTTL == 0 {
+		cc.Fail("IDEMPOTENCY_TTL must be positive")
+	}
+	cfg.Transport = naming.TransportConfig{
+		MaxIdleConns:        cc.Int("HTTP_MAX_IDLE_CONNS", 100),
+		MaxIdleConnsPerHost: cc.Int("HTTP_MAX_IDLE_CONNS_PER_HOST", 32),
+		MaxConnsPerHost:     cc.Int("HTTP_MAX_CONNS_PER_HOST", 0),
+		IdleConnTimeout:     cc.Duration("HTTP_IDLE_CONN_TIMEOUT", 90*time.Second),
+		DialTimeout:         cc.Duration("HTTP_DIAL_TIMEOUT", 5*time.Second),
+		KeepAlive:           cc.Duration("HTTP_KEEP_ALIVE", 30*time.Second),
+		TLSHandshakeTimeout: cc.Duration("HTTP_TLS_HANDSHAKE_TIMEOUT", 5*time.Second),
+	}
+	if tc := cfg.Transport; tc.MaxIdleConns < 0 || tc.MaxIdleConnsPerHost < 0 || tc.MaxConnsPerHost < 0 {
+		cc.Fail("HTTP_MAX_IDLE_CONNS, HTTP_MAX_IDLE_CONNS_PER_HOST and HTTP_MAX_CONNS_PER_HOST must not be negative")
+	}
+	cfg.NodeCalls = naming.CallPolicy{
+		Attempts:   cc.Int("NODE_RETRY_ATTEMPTS", 3),
+		BaseDelay:  cc.Duration("NODE_RETRY_BASE_DELAY", 100*time.Millisecond),
+		MaxDelay:   cc.Duration("NODE_RETRY_MAX_DELAY", 2*time.Second),
+		BreakAfter: cc.Int("NODE_CIRCUIT_BREAK_AFTER", 5),
+		OpenFor:    cc.Duration("NODE_CIRCUIT_OPEN_FOR", 30*time.Second),
+	}
+	if cfg.NodeCalls.Attempts < 1 {
+		cc.Fail("NODE_RETRY_ATTEMPTS must be at least 1")
+	}
+	cfg.PlacementTimeout = cc.Duration("PLACEMENT_WEBHOOK_TIMEOUT", 500*time.Millisecond)
+	if cfg.PlacementTimeout <= 0 {
+		cc.Fail("PLACEMENT_WEBHOOK_TIMEOUT must be greater than zero")
+	}
+	switch mode := cc.Str("DISCOVERY", "off"); mode {
+	case "off":
+	case "dns":
+		cfg.Discovery.Mode = mode
+		cfg.Discovery.DNSName = cc.Str("DISCOVERY_DNS_NAME", "")
+		if cfg.Discovery.DNSName == "" {
+			cc.Fail("DISCOVERY=dns needs DISCOVERY_DNS_NAME, an SRV record such as _storage._tcp.cluster.local")
 		}
-		return li < lj
-	})
-	return cands[:sv.store.repFactor], nil
-}
-
-func (sv *Server) handleCommit(w http.ResponseWriter, r *http.Request) {
-	var body struct {
-		FileID   string   `json:"fileId"`
-		Uploaded []string `json:"uploaded"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		http.Error(w, "bad json", http.StatusBadRequest)
-		return
-	}
-
-	sv.store.mu.Lock()
-	defer sv.store.mu.Unlock()
-	meta, ok := sv.store.files[body.FileID]
-	if !ok {
-		http.Error(w, "fileId not found", http.StatusNotFound)
-		return
-	}
-
-	uploaded := map[string]bool{}
-	for _, id := range body.Uploaded {
-		uploaded[id] = true
-	}
-	count := 0
-	for i := range meta.Replicas {
-		if uploaded[meta.Replicas[i].NodeID] {
-			count++
-			meta.Replicas[i].Status = ReplicaReady
-			meta.Replicas[i].LastVerifiedAt = now()
-		}
-	}
-	switch {
-	case count == 0:
-		meta.State = StateAllocated
-	case count < sv.store.repFactor:
-		meta.State = StatePartial
+	case "consul":
+		cfg.Discovery.Mode = mode
+		cfg.Discovery.ConsulURL = cc.Str("DISCOVERY_CONSUL_URL", "http://localhost:8500")
+		cc.ServiceURL("DISCOVERY_CONSUL_URL", cfg.Discovery.ConsulURL)
+		cfg.Discovery.ConsulService = cc.Str("DISCOVERY_CONSUL_SERVICE", "storage-node")
+		cfg.Discovery.ConsulToken = cc.Secret("CONSUL_HTTP_TOKEN")
 	default:
-		meta.State = StateAvailable
+		cc.Fail("DISCOVERY must be off, dns or consul, got %q", mode)
 	}
-	meta.UpdatedAt = now()
-	go sv.store.persist()
-
-	writeJSONResp(w, map[string]any{"state": meta.State})
-}
-
-func (sv *Server) handleLookup(w http.ResponseWriter, r *http.Request) {
-	fileID := strings.TrimPrefix(r.URL.Path, "/lookup/")
-	if fileID == "" {
-		http.Error(w, "missing fileId", http.StatusBadRequest)
-		return
-	}
-	sv.store.mu.RLock()
-	meta, ok := sv.store.files[fileID]
-	sv.store.mu.RUnlock()
-	if !ok {
-		http.Error(w, "not found", http.StatusNotFound)
-		return
-	}
-
-	type out struct{ NodeID, URL string }
-	var healthy, others []out
-
-	sv.store.mu.RLock()
-	for _, rep := range meta.Replicas {
-		n := sv.store.nodes[rep.NodeID]
-		if healthOf(n) == NodeHealthy {
-			healthy = append(healthy, out{rep.NodeID, rep.URL})
-		} else {
-			others = append(others, out{rep.NodeID, rep.URL})
-		}
-	}
-	sv.store.mu.RUnlock()
-
-	writeJSONResp(w, append(healthy, others...))
-}
-
-func (sv *Server) handleReportMissing(w http.ResponseWriter, r *http.Request) {
-	var body struct {
-		FileID string `json:"fileId"`
-		NodeID string `json:"nodeId"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		http.Error(w, "bad json", http.StatusBadRequest)
-		return
-	}
-
-	sv.store.mu.Lock()
-	defer sv.store.mu.Unlock()
-	meta, ok := sv.store.files[body.FileID]
-	if !ok {
-		http.Error(w, "file not found", http.StatusNotFound)
-		return
-	}
-
-	missing := 0
-	for i := range meta.Replicas {
-		if meta.Replicas[i].NodeID == body.NodeID {
-			meta.Replicas[i].Status = ReplicaMissing
-		}
-		if meta.Replicas[i].Status != ReplicaReady {
-			missing++
-		}
-	}
-	if missing > 0 && meta.State == StateAvailable {
-		meta.State = StateDegraded
-	}
-	meta.UpdatedAt = now()
-	go sv.store.persist()
-
-	writeJSONResp(w, map[string]any{"accepted": true, "state": meta.State})
-}
-
-/* ==================== METRICS & MONITORING ==================== */
-
-func (sv *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
-	sv.store.mu.RLock()
-	defer sv.store.mu.RUnlock()
-
-	totalFiles := len(sv.store.files)
-	totalNodes := len(sv.store.nodes)
-	var totalSize, usedBytes, capacityBytes int64
-	healthyNodes, suspectNodes, downNodes := 0, 0, 0
-	filesByState := map[FileState]int{}
-
-	for _, f := range sv.store.files {
-		totalSize += f.Size
-		filesByState[f.State]++
-	}
-
-	for _, n := range sv.store.nodes {
-		capacityBytes += n.CapacityBytes
-		usedBytes += n.UsedBytes
-		switch healthOf(n) {
-		case NodeHealthy:
-			healthyNodes++
-		case NodeSuspect:
-			suspectNodes++
-		case NodeDown:
-			downNodes++
+	if cfg.Discovery.Mode != "" {
+		cfg.Discovery.Interval = cc.Duration("DISCOVERY_INTERVAL", 10*time.Second)
+		if cfg.Discovery.Interval <= 0 {
+			cc.Fail("DISCOVERY_INTERVAL must be greater than zero")
 		}
 	}
+	cc.WritableDir("metadata dir", cfg.MetadataDir)
+	// catalog requests are small, so a slow body is cut off early
+	srv := cc.HTTPServer(30*time.Second, 0)
+	ln := cc.Listen("ADDR", addr)
+	cc.Done()
 
-	writeJSONResp(w, map[string]any{
-		"totalFiles":     totalFiles,
-		"totalNodes":     totalNodes,
-		"totalSizeBytes": totalSize,
-		"nodes": map[string]int{
-			"healthy": healthyNodes,
-			"suspect": suspectNodes,
-			"down":    downNodes,
-		},
-		"storage": map[string]int64{
-			"capacity": capacityBytes,
-			"used":     usedBytes,
-			"free":     capacityBytes - usedBytes,
-		},
-		"filesByState": filesByState,
-	})
-}
-
-func (sv *Server) handleListFiles(w http.ResponseWriter, r *http.Request) {
-	sv.store.mu.RLock()
-	defer sv.store.mu.RUnlock()
-
-	type fileInfo struct {
-		FileID       string    `json:"fileId"`
-		Filename     string    `json:"filename"`
-		Size         int64     `json:"size"`
-		State        FileState `json:"state"`
-		ReplicaCount int       `json:"replicaCount"`
-		CreatedAt    time.Time `json:"createdAt"`
-	}
-
-	var files []fileInfo
-	for _, f := range sv.store.files {
-		files = append(files, fileInfo{
-			FileID:       f.FileID,
-			Filename:     f.Filename,
-			Size:         f.Size,
-			State:        f.State,
-			ReplicaCount: len(f.Replicas),
-			CreatedAt:    f.CreatedAt,
-		})
-	}
-	writeJSONResp(w, files)
-}
-
-func (sv *Server) handleFileInfo(w http.ResponseWriter, r *http.Request) {
-	fileID := strings.TrimPrefix(r.URL.Path, "/file-info/")
-	if fileID == "" {
-		http.Error(w, "missing fileId", http.StatusBadRequest)
-		return
-	}
-	sv.store.mu.RLock()
-	meta, ok := sv.store.files[fileID]
-	sv.store.mu.RUnlock()
-	if !ok {
-		http.Error(w, "not found", http.StatusNotFound)
-		return
-	}
-	writeJSONResp(w, meta)
-}
-
-func (sv *Server) handleDeleteFile(w http.ResponseWriter, r *http.Request) {
-	var body struct {
-		FileID string `json:"fileId"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		http.Error(w, "bad json", http.StatusBadRequest)
-		return
-	}
-
-	sv.store.mu.Lock()
-	defer sv.store.mu.Unlock()
-	if _, ok := sv.store.files[body.FileID]; !ok {
-		http.Error(w, "file not found", http.StatusNotFound)
-		return
-	}
-	delete(sv.store.files, body.FileID)
-	go sv.store.persist()
-	writeJSONResp(w, map[string]any{"deleted": true, "fileId": body.FileID})
-}
-
-func handleShutdown(w http.ResponseWriter, r *http.Request) {
-	writeJSONResp(w, map[string]any{"ok": true})
-	go func() { time.Sleep(200 * time.Millisecond); os.Exit(0) }()
-}
-
-func (sv *Server) handleListNodes(w http.ResponseWriter, r *http.Request) {
-	sv.store.mu.RLock()
-	defer sv.store.mu.RUnlock()
-
-	type nodeInfo struct {
-		NodeID        string     `json:"nodeId"`
-		URL           string     `json:"url"`
-		Status        NodeStatus `json:"status"`
-		CapacityBytes int64      `json:"capacityBytes"`
-		UsedBytes     int64      `json:"usedBytes"`
-		FreeBytes     int64      `json:"freeBytes"`
-		LoadFactor    float64    `json:"loadFactor"`
-		LastSeenAt    time.Time  `json:"lastSeenAt"`
+	naming.Version = Version
+	sv, err := naming.NewServer(cfg)
+	if err != nil {
+		log.Fatal(err)
 	}
+	sv.Start()
 
-	var nodes []nodeInfo
-	for _, n := range sv.store.nodes {
-		nodes = append(nodes, nodeInfo{
-			NodeID:        n.NodeID,
-			URL:           n.URL,
-			Status:        healthOf(n),
-			CapacityBytes: n.CapacityBytes,
-			UsedBytes:     n.UsedBytes,
-			FreeBytes:     freeBytes(n),
-			LoadFactor:    loadFactor(n),
-			LastSeenAt:    n.LastSeenAt,
-		})
+	log.Printf("Naming Service running at %s ...", addr)
+	if cfg.Shard.Count > 1 {
+		log.Printf("Naming Service owns shard %d of %d", cfg.Shard.Index, cfg.Shard.Count)
 	}
-	writeJSONResp(w, nodes)
-}
-
-/* ==================== AUTO-HEALING ==================== */
-
-func (sv *Server) startAutoHealing() {
-	ticker := time.NewTicker(30 * time.Second)
+	srv.Handler = sv.Handler()
+	stopped := make(chan struct{})
 	go func() {
-		for range ticker.C {
-			sv.checkAndHealReplicas()
+		// catalog writes are coalesced, so stop cleanly on a signal too and
+		// let Close write the last changes
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		select {
+		case <-sv.Stopping():
+		case s := <-sig:
+			log.Printf("Naming Service got %s, stopping", s)
 		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+		close(stopped)
 	}()
-	log.Println("Auto-healing background job started")
-}
-
-func (sv *Server) checkAndHealReplicas() {
-	sv.store.mu.Lock()
-	defer sv.store.mu.Unlock()
-
-	for fileID, meta := range sv.store.files {
-		if meta.State == StateDeleted || meta.State == StateAllocated {
-			continue
-		}
-
-		// Count healthy replicas
-		healthyCount := 0
-		for _, rep := range meta.Replicas {
-			if n, ok := sv.store.nodes[rep.NodeID]; ok && healthOf(n) == NodeHealthy && rep.Status == ReplicaReady {
-				healthyCount++
-			}
-		}
-
-		// Need healing?
-		if healthyCount < sv.store.repFactor {
-			log.Printf("[AUTO-HEAL] File %s (%s) has only %d healthy replicas, need %d",
-				fileID, meta.Filename, healthyCount, sv.store.repFactor)
-
-			// Find candidate nodes (not already hosting this file)
-			existingNodes := map[string]bool{}
-			for _, rep := range meta.Replicas {
-				existingNodes[rep.NodeID] = true
-			}
-
-			var candidates []*NodeInfo
-			for _, n := range sv.store.nodes {
-				if !existingNodes[n.NodeID] && healthOf(n) == NodeHealthy && freeBytes(n) >= meta.Size {
-					candidates = append(candidates, n)
-				}
-			}
-
-			needed := sv.store.repFactor - healthyCount
-			if len(candidates) >= needed {
-				// Sort by load factor
-				sort.Slice(candidates, func(i, j int) bool {
-					return loadFactor(candidates[i]) < loadFactor(candidates[j])
-				})
-
-				for i := 0; i < needed && i < len(candidates); i++ {
-					n := candidates[i]
-					meta.Replicas = append(meta.Replicas, ReplicaInfo{
-						NodeID:         n.NodeID,
-						URL:            n.URL,
-						Status:         ReplicaMissing, // Will be updated when copied
-						LastVerifiedAt: now(),
-					})
-					log.Printf("[AUTO-HEAL] Added replica candidate: %s for file %s", n.NodeID, fileID)
-				}
-
-				if meta.State == StateAvailable {
-					meta.State = StateDegraded
-				}
-				meta.UpdatedAt = now()
-				go sv.store.persist()
-			} else {
-				log.Printf("[AUTO-HEAL] Not enough candidate nodes for file %s (need %d, have %d)",
-					fileID, needed, len(candidates))
-			}
-		}
-	}
-}
-
-/* ============== SHARED RESP & BOOTSTRAP ============== */
-
-func writeJSONResp(w http.ResponseWriter, v any) {
-	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(v)
-}
-
-func logRequest(h http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		h.ServeHTTP(w, r)
-		log.Printf("%s %s %s", r.Method, r.URL.Path, time.Since(start))
-	})
-}
-
-func main() {
-	store, err := NewStore("metadata", 2) // replication factor = 2
-	if err != nil {
+	if err := startup.Serve(srv, ln); err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
-
-	sv := &Server{store: store}
-	mux := http.NewServeMux()
-	// Node management
-	mux.HandleFunc("/register-node", sv.handleRegisterNode)
-	mux.HandleFunc("/heartbeat", sv.handleHeartbeat)
-
-	// File operations
-	mux.HandleFunc("/allocate", sv.handleAllocate)
-	mux.HandleFunc("/commit", sv.handleCommit)
-	mux.HandleFunc("/lookup/", sv.handleLookup) // /lookup/{fileId}
-	mux.HandleFunc("/report-missing", sv.handleReportMissing)
-
-	// Monitoring & metrics
-	mux.HandleFunc("/metrics", sv.handleMetrics)
-	mux.HandleFunc("/list-files", sv.handleListFiles)
-	mux.HandleFunc("/list-nodes", sv.handleListNodes)
-	mux.HandleFunc("/file-info/", sv.handleFileInfo)
-	mux.HandleFunc("/delete-file", sv.handleDeleteFile)
-	mux.HandleFunc("/shutdown", handleShutdown)
-
-	// Start auto-healing
-	sv.startAutoHealing()
-
-	addr := ":8000"
-	log.Printf("Naming Service running at %s ...", addr)
-	log.Fatal(http.ListenAndServe(addr, logRequest(mux)))
+	<-stopped
+	sv.Close()
+	log.Printf("Naming Service stopped")
 }
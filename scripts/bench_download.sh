@@ -0,0 +1,49 @@
+#!/bin/bash
+
+# Download throughput benchmark for storage nodes.
+#
+# Uploads one blob straight to each node, downloads it RUNS times and prints
+# the average speed, so nodes started with different READ_AHEAD_BYTES /
+# DIRECT_IO settings can be compared side by side:
+#
+#   NODE_ID=bench-plain PORT=9101 DATA_DIR=/tmp/bench_plain go run main.go
+#   NODE_ID=bench-ra    PORT=9102 DATA_DIR=/tmp/bench_ra READ_AHEAD_BYTES=1048576 go run main.go
+#   NODE_ID=bench-dio   PORT=9103 DATA_DIR=/tmp/bench_dio READ_AHEAD_BYTES=1048576 DIRECT_IO=true go run main.go
+#
+#   scripts/bench_download.sh 512 http://localhost:9101 http://localhost:9102 http://localhost:9103
+#
+# DIRECT_IO measures cold reads; the page cache serves repeated plain reads,
+# so set DROP_CACHES=1 (needs root) to compare all nodes from disk.
+
+set -euo pipefail
+
+if [ $# -lt 2 ]; then
+    echo "usage: $0 SIZE_MB NODE_URL [NODE_URL...]"
+    exit 1
+fi
+
+SIZE_MB=$1
+shift
+RUNS=${RUNS:-5}
+FILE_ID="bench-$(date +%s)"
+SRC=$(mktemp)
+trap 'rm -f "$SRC"' EXIT
+
+echo "📦 Creating ${SIZE_MB} MiB test blob..."
+dd if=/dev/urandom of="$SRC" bs=1M count="$SIZE_MB" status=none
+
+for NODE in "$@"; do
+    curl -sf -F "fileId=$FILE_ID" -F "file=@$SRC" "$NODE/upload" >/dev/null
+    SETTINGS=$(curl -s "$NODE/health" | grep -o '"readAhead":{[^}]*}' || echo "readAhead: n/a")
+    TOTAL=0
+    for ((i = 1; i <= RUNS; i++)); do
+        if [ "${DROP_CACHES:-0}" = "1" ]; then
+            sync && echo 3 > /proc/sys/vm/drop_caches
+        fi
+        SPEED=$(curl -s -o /dev/null -w '%{speed_download}' "$NODE/download/$FILE_ID")
+        TOTAL=$(awk "BEGIN { print $TOTAL + $SPEED }")
+    done
+    AVG=$(awk "BEGIN { printf \"%.1f\", $TOTAL / $RUNS / 1048576 }")
+    echo "  $NODE  ${AVG} MiB/s  ($SETTINGS)"
+    curl -s -X DELETE "$NODE/files/$FILE_ID" >/dev/null
+done
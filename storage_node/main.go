@@ -1,269 +1,147 @@
+// Command storage_node runs a storage node; the node itself lives in
+// internal/storagenode. All configuration comes from the environment.
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
-	"encoding/json"
-	"fmt"
-	"io"
+	"context"
 	"log"
-	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
-	"sync"
 	"time"
-)
-
-type Node struct {
-	NodeID        string
-	Port          string
-	DataDir       string
-	NamingURL     string
-	CapacityBytes int64
-	mu            sync.RWMutex
-	usedBytes     int64
-}
-
-func getenv(k, d string) string {
-	if v := os.Getenv(k); v != "" {
-		return v
-	}
-	return d
-}
-func (n *Node) dataPathFor(fileID string) string {
-	if len(fileID) < 2 {
-		return filepath.Join(n.DataDir, fileID)
-	}
-	sub := fileID[:2]
-	dir := filepath.Join(n.DataDir, sub)
-	_ = os.MkdirAll(dir, 0755)
-	return filepath.Join(dir, fileID)
-}
-func (n *Node) addUsed(delta int64) {
-	n.mu.Lock()
-	n.usedBytes += delta
-	if n.usedBytes < 0 {
-		n.usedBytes = 0
-	}
-	n.mu.Unlock()
-}
-func (n *Node) currentUsed() int64 { n.mu.RLock(); defer n.mu.RUnlock(); return n.usedBytes }
-
-func (n *Node) handleUpload(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseMultipartForm(32 << 20); err != nil {
-		http.Error(w, "parse form", 400)
-		return
-	}
-	fileID := r.FormValue("fileId")
-	if fileID == "" {
-		http.Error(w, "missing fileId", 400)
-		return
-	}
-	f, hdr, err := r.FormFile("file")
-	if err != nil {
-		http.Error(w, "missing file", 400)
-		return
-	}
-	defer f.Close()
 
-	target := n.dataPathFor(fileID)
-	out, err := os.Create(target)
-	if err != nil {
-		http.Error(w, "cannot create", 500)
-		return
-	}
-	defer out.Close()
+	"ProjectAkhir/internal/startup"
+	"ProjectAkhir/internal/storagenode"
+)
 
-	h := sha256.New()
-	size, err := copyWithHash(out, f, h)
-	if err != nil {
-		http.Error(w, "write error", 500)
-		return
-	}
-	n.addUsed(size)
-	checksum := "sha256:" + hex.EncodeToString(h.Sum(nil))
-	writeJSON(w, map[string]any{"ok": true, "fileId": fileID, "size": size, "checksum": checksum, "name": hdr.Filename})
-}
-func copyWithHash(dst io.Writer, src multipart.File, h io.Writer) (int64, error) {
-	return io.Copy(io.MultiWriter(dst, h), src)
-}
+// Version is stamped at build time with -ldflags "-X main.Version=...".
+var Version = "dev"
 
-func (n *Node) handleDownload(w http.ResponseWriter, r *http.Request) {
-	fileID := strings.TrimPrefix(r.URL.Path, "/download/")
-	if fileID == "" {
-		http.Error(w, "missing fileId", 400)
-		return
-	}
-	path := n.dataPathFor(fileID)
-	f, err := os.Open(path)
-	if err != nil {
-		http.Error(w, "not found", 404)
-		return
-	}
-	defer f.Close()
-	http.ServeContent(w, r, fileID, time.Now(), f)
-}
+/* ---------------- STARTUP CONFIG ---------------- */
 
-func (n *Node) handleHas(w http.ResponseWriter, r *http.Request) {
-	fileID := r.URL.Query().Get("fileId")
-	if fileID == "" {
-		http.Error(w, "missing fileId", 400)
-		return
-	}
-	_, err := os.Stat(n.dataPathFor(fileID))
-	writeJSON(w, map[string]any{"exists": err == nil})
-}
-func (n *Node) handleHealth(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, map[string]any{
-		"nodeId":        n.NodeID,
-		"status":        "HEALTHY",
-		"usedBytes":     n.currentUsed(),
-		"capacityBytes": n.CapacityBytes,
-		"freeBytes":     n.CapacityBytes - n.currentUsed(),
-		"dataDir":       n.DataDir,
-	})
+// within reports whether path is dir or lies below it.
+func within(path, dir string) bool {
+	a, _ := filepath.Abs(path)
+	b, _ := filepath.Abs(dir)
+	rel, err := filepath.Rel(b, a)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
 }
 
-func (n *Node) handleList(w http.ResponseWriter, r *http.Request) {
-	type fileEntry struct {
-		FileID string `json:"fileId"`
-		Size   int64  `json:"size"`
-	}
-	var files []fileEntry
-
-	// Walk through data directory
-	filepath.Walk(n.DataDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
-			return nil
+func main() {
+	cc := startup.New("storage-node")
+	cfg := storagenode.Config{
+		NodeID:    cc.Str("NODE_ID", "node-a"),
+		Port:      cc.Str("PORT", "9001"),
+		DataDir:   cc.Str("DATA_DIR", "./data"),
+		NamingURL: cc.Str("NAMING_URL", "http://localhost:8000"),
+	}
+	cfg.CapacityBytes = cc.Int64("CAPACITY_BYTES", 1<<30)
+	if cfg.CapacityBytes == 0 {
+		cc.Fail("CAPACITY_BYTES must be greater than zero")
+	}
+	cfg.Heartbeat = cc.Duration("HEARTBEAT_INTERVAL", 5*time.Second)
+	cfg.FastCheckMax = int(cc.Int64("FASTCHECK_SAMPLE", 16))
+	cfg.FullCheck = cc.Bool("STARTUP_FULL_CHECK", false)
+	cfg.Zone = cc.Str("NODE_ZONE", "")
+	if v := cc.Str("NODE_TAGS", ""); v != "" {
+		for _, tag := range strings.Split(v, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				cfg.Tags = append(cfg.Tags, tag)
+			}
 		}
-		fileID := filepath.Base(path)
-		files = append(files, fileEntry{FileID: fileID, Size: info.Size()})
-		return nil
-	})
-
-	writeJSON(w, map[string]any{"files": files, "count": len(files)})
-}
-func (n *Node) handleDelete(w http.ResponseWriter, r *http.Request) {
-	var body struct {
-		FileID string `json:"fileId"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.FileID == "" {
-		http.Error(w, "bad json", 400)
-		return
-	}
-	path := n.dataPathFor(body.FileID)
-	info, err := os.Stat(path)
-	if err != nil {
-		writeJSON(w, map[string]any{"deleted": false, "exists": false})
-		return
 	}
-	_ = os.Remove(path)
-	if info != nil {
-		n.addUsed(-info.Size())
-	}
-	writeJSON(w, map[string]any{"deleted": true})
-}
-
-func (n *Node) handleVerify(w http.ResponseWriter, r *http.Request) {
-	var body struct {
-		FileID   string `json:"fileId"`
-		Checksum string `json:"checksum"`
+	cfg.Weight = cc.Float("NODE_WEIGHT", 1)
+	switch v := cc.Str("COMPRESSION", "off"); v {
+	case "gzip":
+		cfg.Compression.Enabled = true
+	case "off":
+	default:
+		cc.Fail("COMPRESSION must be %q or %q, got %q", "gzip", "off", v)
+	}
+	cfg.Compression.MinBytes = cc.Int64("COMPRESS_MIN_BYTES", 4096)
+	if v := cc.Str("COMPRESS_TYPES", "text/,application/json,application/xml,application/javascript"); v != "*" {
+		cfg.Compression.Types = strings.Split(v, ",")
+	}
+	cfg.TicketSecret = []byte(cc.Secret("UPLOAD_TICKET_SECRET"))
+	cfg.RequireTicket = cc.Bool("REQUIRE_UPLOAD_TICKET", len(cfg.TicketSecret) > 0)
+	if cfg.RequireTicket && len(cfg.TicketSecret) == 0 {
+		cc.Fail("REQUIRE_UPLOAD_TICKET=true needs UPLOAD_TICKET_SECRET to be set")
+	}
+	cfg.GatewayOrigins = cc.List("GATEWAY_ORIGINS", "")
+	cfg.AdminToken = []byte(cc.Secret("ADMIN_TOKEN"))
+	cfg.MinFreeDisk = cc.Int64("MIN_FREE_DISK_BYTES", 256<<20)
+	cfg.ReadAhead = int(cc.Int64("READ_AHEAD_BYTES", 0))
+	cfg.DirectIO = cc.Bool("DIRECT_IO", false)
+	if cfg.DirectIO && (cfg.ReadAhead == 0 || cfg.ReadAhead%storagenode.DirectIOAlign != 0) {
+		cc.Fail("DIRECT_IO=true needs READ_AHEAD_BYTES to be a positive multiple of %d", storagenode.DirectIOAlign)
+	}
+	cfg.HotDir = cc.Str("HOT_DIR", "")
+	cfg.HotCapacity = cc.Int64("HOT_CAPACITY_BYTES", 256<<20)
+	cfg.PromoteReads = float64(cc.Int64("TIER_PROMOTE_READS", 5))
+	cfg.DemoteReads = float64(cc.Int64("TIER_DEMOTE_READS", 1))
+	cfg.TierInterval = cc.Duration("TIER_INTERVAL", time.Minute)
+	if cfg.HotDir != "" {
+		cc.WritableDir("HOT_DIR", cfg.HotDir)
+		if within(cfg.HotDir, cfg.DataDir) || within(cfg.DataDir, cfg.HotDir) {
+			cc.Fail("HOT_DIR %q and DATA_DIR %q must not contain each other", cfg.HotDir, cfg.DataDir)
+		}
+		if cfg.DemoteReads >= cfg.PromoteReads {
+			cc.Fail("TIER_DEMOTE_READS (%v) must be lower than TIER_PROMOTE_READS (%v)", cfg.DemoteReads, cfg.PromoteReads)
+		}
 	}
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		http.Error(w, "bad json", 400)
-		return
+	cfg.ChaosEnabled = cc.Bool("CHAOS_ENABLED", false)
+	if cfg.ChaosEnabled && len(cfg.AdminToken) == 0 {
+		cc.Fail("CHAOS_ENABLED=true needs ADMIN_TOKEN to be set")
+	}
+	cfg.Debug = cc.Bool("DEBUG_ENDPOINTS", false)
+	if cfg.Debug && len(cfg.AdminToken) == 0 {
+		cc.Fail("DEBUG_ENDPOINTS=true needs ADMIN_TOKEN to be set")
+	}
+	cfg.MaxConcurrentUploads = cc.Int64("MAX_CONCURRENT_UPLOADS", 0)
+	cfg.MaxUploadBytes = cc.Int64("MAX_UPLOAD_BYTES", 1<<30)
+	cfg.MaxRequestBytes = cc.Int64("MAX_REQUEST_BYTES", 1<<20)
+	cfg.SkipRegistration = !cc.Bool("SELF_REGISTER", true)
+	cc.ServiceURL("NAMING_URL", cfg.NamingURL)
+	if v := cc.Str("NAMING_SHARDS", ""); v != "" {
+		for _, u := range strings.Split(v, ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				cc.ServiceURL("NAMING_SHARDS", u)
+				cfg.NamingShards = append(cfg.NamingShards, u)
+			}
+		}
 	}
+	cc.WritableDir("DATA_DIR", cfg.DataDir)
+	// uploads and downloads of large blobs may take as long as they take
+	srv := cc.HTTPServer(0, 0)
+	ln := cc.Listen("PORT", ":"+cfg.Port)
+	cc.Done()
 
-	path := n.dataPathFor(body.FileID)
-	f, err := os.Open(path)
+	storagenode.Version = Version
+	node, err := storagenode.NewNode(cfg)
 	if err != nil {
-		http.Error(w, "file not found", 404)
-		return
+		log.Printf("config error: %v", err)
+		os.Exit(startup.ExitConfig)
 	}
-	defer f.Close()
-
-	h := sha256.New()
-	io.Copy(h, f)
-	computedChecksum := "sha256:" + hex.EncodeToString(h.Sum(nil))
-
-	matches := computedChecksum == body.Checksum
-	writeJSON(w, map[string]any{
-		"fileId":           body.FileID,
-		"expectedChecksum": body.Checksum,
-		"actualChecksum":   computedChecksum,
-		"verified":         matches,
-	})
-}
-
-func (n *Node) handleShutdown(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, map[string]any{"ok": true})
-	go func() { time.Sleep(200 * time.Millisecond); os.Exit(0) }()
-}
+	node.Start()
 
-func (n *Node) registerToNaming() {
-	body := map[string]any{"nodeId": n.NodeID, "url": fmt.Sprintf("http://localhost:%s", n.Port), "capacityBytes": n.CapacityBytes}
-	_ = postJSON(n.NamingURL+"/register-node", body)
-}
-func (n *Node) startHeartbeat() {
-	t := time.NewTicker(5 * time.Second)
+	log.Printf("Storage Node %s at :%s (data=%s)", cfg.NodeID, cfg.Port, cfg.DataDir)
+	if cfg.ChaosEnabled {
+		log.Printf("WARNING: chaos mode enabled; this node will inject faults when told to via /admin/chaos")
+	}
+	srv.Handler = node.Handler()
+	stopped := make(chan struct{})
 	go func() {
-		for range t.C {
-			_ = postJSON(n.NamingURL+"/heartbeat", map[string]any{"nodeId": n.NodeID, "usedBytes": n.currentUsed()})
-		}
+		<-node.Stopping()
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+		close(stopped)
 	}()
-}
-
-func writeJSON(w http.ResponseWriter, v any) {
-	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(v)
-}
-func postJSON(url string, body any) error {
-	b, _ := json.Marshal(body)
-	req, _ := http.NewRequest("POST", url, strings.NewReader(string(b)))
-	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
+	if err := startup.Serve(srv, ln); err != http.ErrServerClosed {
+		log.Fatal(err)
 	}
-	defer resp.Body.Close()
-	io.ReadAll(resp.Body)
-	return nil
-}
-
-func main() {
-	node := &Node{
-		NodeID:        getenv("NODE_ID", "node-a"),
-		Port:          getenv("PORT", "9001"),
-		DataDir:       getenv("DATA_DIR", "./data"),
-		NamingURL:     getenv("NAMING_URL", "http://localhost:8000"),
-		CapacityBytes: 1 << 30,
-	}
-	if v := getenv("CAPACITY_BYTES", ""); v != "" {
-		var x int64
-		fmt.Sscanf(v, "%d", &x)
-		if x > 0 {
-			node.CapacityBytes = x
-		}
-	}
-	_ = os.MkdirAll(node.DataDir, 0755)
-
-	mux := http.NewServeMux()
-	mux.HandleFunc("/upload", node.handleUpload)
-	mux.HandleFunc("/download/", node.handleDownload)
-	mux.HandleFunc("/has", node.handleHas)
-	mux.HandleFunc("/health", node.handleHealth)
-	mux.HandleFunc("/list", node.handleList)
-	mux.HandleFunc("/verify", node.handleVerify)
-	mux.HandleFunc("/shutdown", node.handleShutdown)
-	mux.HandleFunc("/delete", node.handleDelete)
-
-	node.registerToNaming()
-	node.startHeartbeat()
-
-	addr := ":" + node.Port
-	log.Printf("Storage Node %s at %s (data=%s)", node.NodeID, addr, node.DataDir)
-	log.Fatal(http.ListenAndServe(addr, mux))
+	<-stopped
+	node.Close()
+	log.Printf("Storage Node %s stopped", cfg.NodeID)
 }
@@ -0,0 +1,17 @@
+// Command openapi prints the gateway's OpenAPI document, the same one it
+// serves at /openapi.json, without starting the gateway:
+//
+//	go run ./cmd/openapi > ../api/gateway.openapi.json
+//
+// "make clients" at the repository root runs it; see cmd/apigen there.
+package main
+
+import (
+	"os"
+
+	"ui_gateway/internal/gateway"
+)
+
+func main() {
+	_, _ = os.Stdout.Write(gateway.OpenAPI())
+}
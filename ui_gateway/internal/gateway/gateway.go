@@ -0,0 +1,7604 @@
+// Package gateway is the UI gateway: it serves the upload page and the
+// dashboard, and fronts the naming service and storage nodes with the
+// /api endpoints. ui_gateway/main.go wires it to the environment.
+package gateway
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"container/list"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"maps"
+	"math/big"
+	"math/rand/v2"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"runtime/metrics"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ui_gateway/internal/startup"
+)
+
+// Config is what NewServer needs; ui_gateway/main.go fills it from the
+// environment.
+type Config struct {
+	NamingURLs   []string      // naming service replicas; the first is used until it fails
+	TicketSecret []byte        // shared with storage nodes; empty disables direct uploads
+	TicketTTL    time.Duration // lifetime of an upload ticket
+	AdminToken   string        // bearer token for the nodes' /admin API, and for /debug/
+	Debug        bool          // serve pprof, expvar and /debug/status behind AdminToken
+	PagesDir     string        // holds index.html and dashboard.html; "" = working directory
+
+	RateLimitRPS         float64 // per-client requests per second; 0 = off
+	RateLimitBurst       int
+	MaxConcurrentUploads int // per client; 0 = unlimited
+	MaxTotalUploads      int // across all clients; 0 = unlimited
+
+	// Body limits, 0 = none. MaxUploadBytes caps one file and the whole body
+	// of /api/upload and /api/upload-batch; MaxRequestBytes every other /api
+	// body. Uploads are buffered in memory while they are replicated, so
+	// MaxTotalUploads x MaxUploadBytes bounds what they can hold.
+	MaxUploadBytes  int64
+	MaxRequestBytes int64
+
+	CacheBytes        int64  // download cache size; 0 = off
+	CacheMaxFileBytes int64  // larger files are never cached
+	CacheDir          string // spill cached blobs here; "" keeps them in memory
+
+	// Previews: after each commit the gateway renders a JPEG of images and,
+	// when pdftoppm is installed, of a PDF's first page, and stores it as a
+	// derived file of the upload.
+	PreviewSize     int   // longest side in pixels; 0 = previews off
+	PreviewMaxBytes int64 // larger uploads get no preview
+
+	BatchConcurrency  int   // files of one batch upload stored in parallel
+	BatchMaxFiles     int   // most files (zip entries included) per batch
+	BatchMaxFileBytes int64 // largest single file in a batch
+
+	// Upload type policy: MIME types or type/* patterns, matched against
+	// both the declared and the sniffed type. "executables" in BlockedTypes
+	// stands for ExecutableTypes. An empty AllowedTypes allows anything not
+	// blocked.
+	AllowedTypes []string
+	BlockedTypes []string
+
+	ReplicaConcurrency int           // replica uploads of one file in flight at once
+	ReplicaTimeout     time.Duration // limit on a single replica upload
+
+	HedgeAfter time.Duration // race another replica when a download is this slow; 0 = off
+	// VerifyDownloads asks nodes for the checksum trailer on every proxied
+	// download, not just those whose client asked with ?trailer=checksum.
+	VerifyDownloads bool
+	// Downloads of at least ParallelMinBytes (0 = off) are assembled from
+	// ParallelChunk-sized ranges fetched from all healthy replicas at once.
+	ParallelMinBytes int64
+	ParallelChunk    int64
+
+	Transport TransportConfig
+	Calls     CallPolicy // for nodes; naming calls use it without the breaker
+
+	NamingHealthCheck time.Duration // probe every naming endpoint this often (with more than one)
+	// NamingShards, when set, are the naming services the catalog is split
+	// across, by shard index, each as its replicas; NamingURLs is then
+	// ignored. See NAMING SHARDS.
+	NamingShards [][]string
+
+	// System control (/api/system/*)
+	Orchestrator  string // process (go run), docker or compose
+	SystemNodes   int    // size of the default topology when TopologyFile does not exist
+	TopologyFile  string // node IDs, ports, data dirs and capacities; "" = not persisted
+	DockerImage   string // image holding the naming_service and storage_node binaries
+	DockerProject string // prefix for container and volume names
+
+	// Accounts: with UsersFile set, every page and /api call except
+	// /login, /api/login and share links needs a session; see requiredRole.
+	UsersFile     string        // local users as JSON; "" = accounts off
+	SessionTTL    time.Duration // how long a login lasts
+	AdminPassword string        // creates the "admin" user when UsersFile has none
+	OIDC          OIDCConfig    // sign in through an identity provider; works with or without UsersFile
+
+	// CORS for /api and /s. With no CORSOrigins only same-origin pages may
+	// call the API; "*" allows any origin (but not with CORSCredentials).
+	CORSOrigins     []string
+	CORSMethods     []string      // methods a preflight may ask for
+	CORSHeaders     []string      // request headers a cross-origin caller may send
+	CORSCredentials bool          // allow cookies, so a signed-in browser's session is used
+	CORSMaxAge      time.Duration // how long a browser may cache a preflight; 0 = its default
+
+	CSP        string        // Content-Security-Policy for every response; "" = none
+	HSTSMaxAge time.Duration // Strict-Transport-Security over HTTPS; 0 = off
+}
+
+type cfg struct {
+	Config
+	*upstreams
+	sys      *systemCtl
+	cache    *blobCache // small-file download cache; nil when off
+	pdftoppm string     // path of poppler's pdftoppm; "" = no PDF previews
+	auth     *accounts  // nil when accounts are off
+	pending  *pendingUploads
+}
+
+// namingURL is the naming endpoint calls should go to right now.
+func (c cfg) namingURL() string { return c.shards[0].url() }
+
+// Server is a configured gateway.
+type Server struct {
+	c  cfg
+	rl *rateLimiter
+}
+
+// NewServer prepares a gateway from conf.
+func NewServer(conf Config) (*Server, error) {
+	up := newUpstreams(conf)
+	for _, p := range up.shards {
+		if len(p.urls) > 1 && conf.NamingHealthCheck > 0 {
+			go p.run(conf.NamingHealthCheck, up.transport)
+		}
+	}
+
+	sys, err := newSystemCtl(conf, up)
+	if err != nil {
+		return nil, err
+	}
+	c := cfg{Config: conf, upstreams: up, sys: sys, pending: &pendingUploads{m: map[string]pendingUpload{}}}
+	if conf.PreviewSize > 0 {
+		c.pdftoppm, _ = exec.LookPath("pdftoppm")
+	}
+	if conf.UsersFile != "" || conf.OIDC.Issuer != "" {
+		if c.auth, err = openAccounts(conf.UsersFile, conf.SessionTTL, conf.AdminPassword, newOIDCProvider(conf.OIDC, up.httpClient(10*time.Second))); err != nil {
+			return nil, err
+		}
+	}
+	c.AllowedTypes = typePatterns(conf.AllowedTypes)
+	c.BlockedTypes = typePatterns(conf.BlockedTypes)
+	if conf.CacheBytes > 0 {
+		if conf.CacheDir != "" {
+			if err := os.MkdirAll(conf.CacheDir, 0755); err != nil {
+				return nil, fmt.Errorf("CACHE_DIR %q cannot be created: %v", conf.CacheDir, err)
+			}
+			// the index is not persisted, so leftovers are unreachable
+			old, _ := filepath.Glob(filepath.Join(conf.CacheDir, "*.blob"))
+			tmps, _ := filepath.Glob(filepath.Join(conf.CacheDir, "put-*.tmp"))
+			for _, f := range append(old, tmps...) {
+				os.Remove(f)
+			}
+		}
+		c.cache = newBlobCache(conf.CacheBytes, conf.CacheMaxFileBytes, conf.CacheDir)
+	}
+	rl := newRateLimiter(conf.RateLimitRPS, conf.RateLimitBurst, conf.MaxConcurrentUploads)
+	rl.maxTotal = conf.MaxTotalUploads
+	return &Server{c: c, rl: rl}, nil
+}
+
+// ServeMux routes the UI pages and every /api endpoint, as listed by
+// routes.
+func (s *Server) ServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	for _, rt := range s.c.routes() {
+		path := rt.path
+		if path == "/" {
+			path = "/{$}" // the upload page, not every path
+		}
+		mux.HandleFunc(rt.method+" "+path, rt.handler)
+	}
+	if s.c.Debug {
+		registerDebug(mux, s.c.debugGuard, s.debugGauges)
+	}
+	mux.HandleFunc("/", noRoute(mux))
+	return mux
+}
+
+// Handler is ServeMux behind the session check, the body limits, the rate
+// limiter, CORS and security headers, response compression, request
+// logging and request IDs, as main serves it.
+func (s *Server) Handler() http.Handler {
+	return withRequestID(logReq(compress(s.c.secure(s.rl.limit(s.c.limitBody(s.c.auth.enforce(s.ServeMux())))))))
+}
+
+// routeMethods are the ones noRoute probes for.
+var routeMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions}
+
+// noRoute is the mux's "/" handler, so it sees every request no route
+// matches. A path that some other method would reach is a 405 whose Allow
+// header lists those methods; anything else is a JSON 404.
+func noRoute(mux *http.ServeMux) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var allowed []string
+		for _, m := range routeMethods {
+			if _, pattern := mux.Handler(&http.Request{Method: m, Host: r.Host, URL: r.URL}); pattern != "" && pattern != "/" {
+				allowed = append(allowed, m)
+			}
+		}
+		if len(allowed) == 0 {
+			writeError(w, http.StatusNotFound, codeNotFound, "no such endpoint: "+r.URL.Path)
+			return
+		}
+		allow := strings.Join(allowed, ", ")
+		w.Header().Set("Allow", allow)
+		writeErrorDetail(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, r.Method+" is not allowed on "+r.URL.Path,
+			map[string]string{"allow": allow})
+	}
+}
+
+func logReq(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		h.ServeHTTP(w, r)
+		log.Printf("%s %s %s [%s]", r.Method, r.URL.Path, time.Since(start), r.Header.Get(requestIDHeader))
+	})
+}
+
+/* ---------------- RESPONSE COMPRESSION ---------------- */
+
+// compressMin is the smallest response, by Content-Length, worth gzipping.
+const compressMin = 1 << 10
+
+var gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(io.Discard) }}
+
+// compress gzips the response for a client that accepts it, when the body
+// is JSON, text or another compressible type: API answers, the pages, and
+// downloads of text files. Downloads of images, archives and other
+// formats that are compressed already are not in the list, and a body the
+// handler encoded itself, a range or a body known to be tiny goes out as
+// it is. zstd is not offered: the standard library has no encoder.
+func compress(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponse{ResponseWriter: w}
+		defer gw.close()
+		h.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip. A
+// gzip entry wins over "*" wherever it appears, and q=0 refuses; a q that
+// does not parse counts as a refusal too.
+func acceptsGzip(header string) bool {
+	gz, star := -1.0, -1.0
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			if k, v, ok := strings.Cut(p, "="); ok && strings.EqualFold(strings.TrimSpace(k), "q") {
+				if q, _ = strconv.ParseFloat(strings.TrimSpace(v), 64); !(q >= 0 && q <= 1) {
+					q = 0
+				}
+			}
+		}
+		switch coding = strings.TrimSpace(coding); {
+		case strings.EqualFold(coding, "gzip"), strings.EqualFold(coding, "x-gzip"):
+			gz = max(gz, q)
+		case coding == "*":
+			star = max(star, q)
+		}
+	}
+	if gz >= 0 {
+		return gz > 0
+	}
+	return star > 0
+}
+
+// compressible reports whether a body of contentType shrinks under gzip.
+// Event streams are left alone, since gzip would hold events back.
+func compressible(contentType string) bool {
+	t, _, _ := strings.Cut(contentType, ";")
+	t = strings.ToLower(strings.TrimSpace(t))
+	switch {
+	case t == "text/event-stream":
+		return false
+	case strings.HasPrefix(t, "text/"), strings.HasSuffix(t, "+json"), strings.HasSuffix(t, "+xml"):
+		return true
+	}
+	switch t {
+	case "application/json", "application/x-ndjson", "application/javascript", "application/xml", "application/yaml":
+		return true
+	}
+	return false
+}
+
+// gzipResponse decides on compression when the header is written, then
+// sends the body through a pooled gzip.Writer.
+type gzipResponse struct {
+	http.ResponseWriter
+	gz      *gzip.Writer
+	decided bool
+}
+
+func (g *gzipResponse) WriteHeader(code int) {
+	if g.decided || code < 200 {
+		g.ResponseWriter.WriteHeader(code)
+		return
+	}
+	g.decided = true
+	h := g.Header()
+	if compressible(h.Get("Content-Type")) {
+		if !slices.Contains(h.Values("Vary"), "Accept-Encoding") {
+			h.Add("Vary", "Accept-Encoding")
+		}
+		size, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+		small := err == nil && size < compressMin
+		if !small && code != http.StatusNoContent && code != http.StatusPartialContent && code != http.StatusNotModified &&
+			h.Get("Content-Encoding") == "" && h.Get("Content-Range") == "" {
+			h.Del("Content-Length")
+			h.Set("Content-Encoding", "gzip")
+			if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				// the bytes on the wire are no longer the tagged ones
+				h.Set("ETag", "W/"+etag)
+			}
+			g.gz = gzipWriters.Get().(*gzip.Writer)
+			g.gz.Reset(g.ResponseWriter)
+		}
+	}
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *gzipResponse) Write(b []byte) (int, error) {
+	if !g.decided {
+		if g.Header().Get("Content-Type") == "" {
+			g.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.gz != nil {
+		return g.gz.Write(b)
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+func (g *gzipResponse) Flush() {
+	if g.gz != nil {
+		_ = g.gz.Flush()
+	}
+	_ = http.NewResponseController(g.ResponseWriter).Flush()
+}
+
+func (g *gzipResponse) Unwrap() http.ResponseWriter { return g.ResponseWriter }
+
+func (g *gzipResponse) close() {
+	if g.gz == nil {
+		return
+	}
+	_ = g.gz.Close()
+	g.gz.Reset(io.Discard)
+	gzipWriters.Put(g.gz)
+}
+
+/* ---------------- CORS & SECURITY HEADERS ---------------- */
+
+// DefaultCSP is the Content-Security-Policy sent with every response
+// unless CSP is changed. The pages use inline scripts and handlers and the
+// Poppins web font, and index.html uploads straight to storage nodes, so
+// connect-src allows any http(s) origin.
+const DefaultCSP = "default-src 'self'; script-src 'self' 'unsafe-inline'; " +
+	"style-src 'self' 'unsafe-inline' https://fonts.googleapis.com; font-src 'self' https://fonts.gstatic.com; " +
+	"img-src 'self' data: blob:; connect-src 'self' http: https:; " +
+	"frame-ancestors 'none'; base-uri 'self'; form-action 'self'"
+
+// corsExposed are the response headers a cross-origin script may read.
+var corsExposed = "Content-Disposition, ETag, Last-Modified, Retry-After, X-Cache, " + catalogRevisionHeader + ", " + requestIDHeader
+
+// secure adds the security headers to every response and handles CORS
+// for /api and /s: preflights from an allowed origin get 204 with the
+// allowed methods and headers, other requests from it get
+// Access-Control-Allow-Origin. A state-changing request from any other
+// origin is refused with 403, so a foreign page cannot use a signed-in
+// browser's cookie either.
+func (c cfg) secure(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hd := w.Header()
+		hd.Set("X-Content-Type-Options", "nosniff")
+		hd.Set("X-Frame-Options", "DENY")
+		hd.Set("Referrer-Policy", "no-referrer") // share links carry their token in the URL
+		hd.Set("Cross-Origin-Opener-Policy", "same-origin")
+		if c.CSP != "" {
+			hd.Set("Content-Security-Policy", c.CSP)
+		}
+		if c.HSTSMaxAge > 0 && (r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https") {
+			hd.Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d", int64(c.HSTSMaxAge.Seconds())))
+		}
+
+		origin := r.Header.Get("Origin")
+		api := strings.HasPrefix(r.URL.Path, "/api/") || strings.HasPrefix(r.URL.Path, "/s/")
+		if origin == "" || !api || sameOrigin(origin, r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if len(c.CORSOrigins) > 0 {
+			hd.Add("Vary", "Origin")
+		}
+		allowed := c.corsAllowed(origin)
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !allowed || preflight && !slices.Contains(c.CORSMethods, r.Header.Get("Access-Control-Request-Method")) {
+			if preflight || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+				writeErrorDetail(w, http.StatusForbidden, codeCrossOrigin, "cross-origin request not allowed", map[string]string{"origin": origin})
+				return
+			}
+			h.ServeHTTP(w, r) // the browser will not let the page read it
+			return
+		}
+
+		if slices.Contains(c.CORSOrigins, "*") && !c.CORSCredentials {
+			hd.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			hd.Set("Access-Control-Allow-Origin", origin)
+		}
+		if c.CORSCredentials {
+			hd.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight {
+			hd.Set("Access-Control-Expose-Headers", corsExposed)
+			h.ServeHTTP(w, r)
+			return
+		}
+		hd.Set("Access-Control-Allow-Methods", strings.Join(c.CORSMethods, ", "))
+		hd.Set("Access-Control-Allow-Headers", strings.Join(c.CORSHeaders, ", "))
+		if c.CORSMaxAge > 0 {
+			hd.Set("Access-Control-Max-Age", fmt.Sprint(int64(c.CORSMaxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func (c cfg) corsAllowed(origin string) bool {
+	for _, o := range c.CORSOrigins {
+		if o == "*" || strings.EqualFold(strings.TrimRight(o, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameOrigin reports whether origin is the host the request was sent to;
+// the scheme is not compared, since a TLS-terminating proxy changes it.
+func sameOrigin(origin string, r *http.Request) bool {
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+/* ---------------- RATE LIMITING ---------------- */
+
+// clientBucket is one client's token bucket plus its in-flight uploads.
+type clientBucket struct {
+	tokens  float64
+	last    time.Time
+	uploads int
+}
+
+// rateLimiter throttles /api/ calls per client (X-API-Key header, falling back
+// to the remote IP) with a token bucket, and caps concurrent uploads per
+// client and in total. A zero rate or upload cap disables that check.
+type rateLimiter struct {
+	mu         sync.Mutex
+	rate       float64 // tokens per second
+	burst      float64
+	maxUploads int
+	clients    map[string]*clientBucket
+
+	maxTotal int // uploads in flight across all clients
+	uploads  int // guarded by mu
+}
+
+func newRateLimiter(rate float64, burst, maxUploads int) *rateLimiter {
+	if burst < 1 {
+		burst = int(rate)
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), maxUploads: maxUploads, clients: map[string]*clientBucket{}}
+}
+
+func clientKey(r *http.Request) string {
+	if k := r.Header.Get("X-API-Key"); k != "" {
+		return "key:" + k
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// bucket returns the client's bucket, refilled up to now. Caller holds mu.
+func (l *rateLimiter) bucket(key string, now time.Time) *clientBucket {
+	b, ok := l.clients[key]
+	if !ok {
+		// drop idle clients now and then so the map doesn't grow forever
+		if len(l.clients) >= 10000 {
+			for k, old := range l.clients {
+				if old.uploads == 0 && now.Sub(old.last) > 10*time.Minute {
+					delete(l.clients, k)
+				}
+			}
+		}
+		b = &clientBucket{tokens: l.burst, last: now}
+		l.clients[key] = b
+		return b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	return b
+}
+
+// allow takes one token for key, or reports how long until one is available.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	if l.rate <= 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.bucket(key, time.Now())
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// acquireUpload takes an upload slot for key, or says which cap is full.
+func (l *rateLimiter) acquireUpload(key string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxTotal > 0 && l.uploads >= l.maxTotal {
+		return "gateway is at its upload limit"
+	}
+	if l.maxUploads > 0 {
+		b := l.bucket(key, time.Now())
+		if b.uploads >= l.maxUploads {
+			return "too many concurrent uploads"
+		}
+		b.uploads++
+	}
+	l.uploads++
+	return ""
+}
+
+func (l *rateLimiter) releaseUpload(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.uploads--
+	if b, ok := l.clients[key]; ok && l.maxUploads > 0 && b.uploads > 0 {
+		b.uploads--
+	}
+}
+
+func tooManyRequests(w http.ResponseWriter, retry time.Duration, msg string) {
+	secs := int(retry.Seconds() + 0.999)
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	writeErrorDetail(w, http.StatusTooManyRequests, codeRateLimited, msg, map[string]int{"retryAfterSeconds": secs})
+}
+
+// limit applies the per-client rate limit to /api/ calls and share links,
+// which also slows password guessing, and the concurrent upload cap to
+// /api/upload and /api/upload-batch; the UI pages themselves are never throttled.
+func (l *rateLimiter) limit(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !(strings.HasPrefix(r.URL.Path, "/api/") || strings.HasPrefix(r.URL.Path, "/s/")) || r.Method == http.MethodOptions {
+			h.ServeHTTP(w, r)
+			return
+		}
+		key := clientKey(r)
+		if ok, retry := l.allow(key); !ok {
+			tooManyRequests(w, retry, "rate limit exceeded")
+			return
+		}
+		if r.URL.Path == "/api/upload" || r.URL.Path == "/api/upload-batch" {
+			if msg := l.acquireUpload(key); msg != "" {
+				tooManyRequests(w, time.Second, msg)
+				return
+			}
+			defer l.releaseUpload(key)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+/* ---------------- REQUEST LIMITS ---------------- */
+
+// multipartSlack is room for the form fields and part headers around an
+// upload's file, so a file of exactly MaxUploadBytes still fits.
+const multipartSlack = 1 << 20
+
+// limitBody caps /api and /s request bodies: uploads at MaxUploadBytes plus
+// form overhead, everything else at MaxRequestBytes. A body whose declared
+// length is over the limit is refused before any of it is read.
+func (c cfg) limitBody(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") && !strings.HasPrefix(r.URL.Path, "/s/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		what, limit, slack := "request", c.MaxRequestBytes, int64(0)
+		if r.URL.Path == "/api/upload" || r.URL.Path == "/api/upload-batch" {
+			what, limit, slack = "upload", c.MaxUploadBytes, multipartSlack
+		}
+		if limit > 0 {
+			if r.ContentLength > limit+slack {
+				tooLarge(w, what, limit)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit+slack)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// tooLarge answers 413 with the limit that was exceeded.
+func tooLarge(w http.ResponseWriter, what string, limit int64) {
+	w.Header().Set("Connection", "close") // don't read the rest of the body
+	writeErrorDetail(w, http.StatusRequestEntityTooLarge, codePayloadTooLarge, what+" too large", map[string]int64{"limitBytes": limit})
+}
+
+// parseUploadForm is ParseMultipartForm that answers 413 when the body
+// hit limitBody's cap and 400 for any other parse error.
+func (c cfg) parseUploadForm(w http.ResponseWriter, r *http.Request) bool {
+	err := r.ParseMultipartForm(64 << 20)
+	var mbe *http.MaxBytesError
+	switch {
+	case err == nil:
+		return true
+	case errors.As(err, &mbe):
+		tooLarge(w, "upload", c.MaxUploadBytes)
+	default:
+		writeError(w, http.StatusBadRequest, codeBadRequest, "cannot parse form")
+	}
+	return false
+}
+
+/* ---------------- ACCOUNTS & SESSIONS ---------------- */
+
+// role orders what a signed-in user may do; each role includes the ones
+// below it.
+type role int
+
+const (
+	rolePublic   role = iota // no session needed
+	roleViewer               // pages and read-only /api calls
+	roleUploader             // uploads, deletes, renames, shares, permissions
+	roleAdmin                // system control, settings, healing, users
+)
+
+var roleNames = []string{"public", "viewer", "uploader", "admin"}
+
+func (r role) String() string { return roleNames[r] }
+
+func parseRole(s string) (role, bool) {
+	i := slices.Index(roleNames, s)
+	return role(i), i > 0
+}
+
+// account is one local user as stored in USERS_FILE.
+type account struct {
+	Username     string   `json:"username"`
+	PasswordHash string   `json:"passwordHash"` // see hashPassword
+	Role         string   `json:"role"`
+	Groups       []string `json:"groups,omitempty"`
+}
+
+type session struct {
+	user    string
+	role    role
+	groups  []string
+	expires time.Time
+}
+
+// sessionCookie holds the session token; sessions live in memory, so a
+// restart signs everyone out.
+const sessionCookie = "gw_session"
+
+// passwordIterations is the PBKDF2 work factor for account passwords.
+const passwordIterations = 100_000
+
+// hashPassword returns "pbkdf2-sha256$<iterations>$<salt>$<key>", hex
+// encoded. PBKDF2 is in the standard library, so the gateway keeps no
+// third-party dependencies.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := crand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, 32)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("pbkdf2-sha256$%d$%x$%x", passwordIterations, salt, key), nil
+}
+
+func checkPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iter, err := strconv.Atoi(parts[1])
+	salt, err2 := hex.DecodeString(parts[2])
+	want, err3 := hex.DecodeString(parts[3])
+	if err != nil || err2 != nil || err3 != nil {
+		return false
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, iter, len(want))
+	return err == nil && subtle.ConstantTimeCompare(key, want) == 1
+}
+
+// accounts holds the local users, persisted in USERS_FILE, and the open
+// sessions, whether they signed in with a password or through OIDC. A nil
+// *accounts means accounts are off and nothing is enforced.
+type accounts struct {
+	mu       sync.Mutex
+	path     string // "" when only OIDC users sign in
+	ttl      time.Duration
+	users    map[string]*account
+	sessions map[string]*session // token -> session
+	dummy    string              // hashed for unknown users, so timing does not tell
+	oidc     *oidcProvider       // nil unless an identity provider is configured
+}
+
+// openAccounts loads path. With adminPassword set and no "admin" user yet,
+// one is created, which is how the first account comes to exist. path may
+// be empty when oidc is set.
+func openAccounts(path string, ttl time.Duration, adminPassword string, oidc *oidcProvider) (*accounts, error) {
+	a := &accounts{path: path, ttl: ttl, users: map[string]*account{}, sessions: map[string]*session{}, oidc: oidc}
+	var list []*account
+	var err error
+	if path != "" {
+		var b []byte
+		if b, err = os.ReadFile(path); err == nil {
+			err = json.Unmarshal(b, &list)
+		}
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("USERS_FILE %s: %w", path, err)
+	}
+	for _, u := range list {
+		if _, ok := parseRole(u.Role); !ok || u.Username == "" {
+			return nil, fmt.Errorf("USERS_FILE %s: user %q needs a role of viewer, uploader or admin", path, u.Username)
+		}
+		a.users[u.Username] = u
+	}
+	if a.dummy, err = hashPassword("dummy"); err != nil {
+		return nil, err
+	}
+	if _, ok := a.users["admin"]; !ok && adminPassword != "" && path != "" {
+		hash, err := hashPassword(adminPassword)
+		if err != nil {
+			return nil, err
+		}
+		a.users["admin"] = &account{Username: "admin", PasswordHash: hash, Role: "admin"}
+		if err := a.save(); err != nil {
+			return nil, fmt.Errorf("USERS_FILE %s: %w", path, err)
+		}
+		log.Printf("accounts: created user admin in %s", path)
+	}
+	if len(a.users) == 0 && oidc == nil {
+		return nil, fmt.Errorf("USERS_FILE %s has no users; set AUTH_ADMIN_PASSWORD to create the admin account", path)
+	}
+	return a, nil
+}
+
+// save writes the users sorted by name. Callers hold mu, except openAccounts.
+func (a *accounts) save() error {
+	list := slices.SortedFunc(maps.Values(a.users), func(x, y *account) int { return strings.Compare(x.Username, y.Username) })
+	b, _ := json.MarshalIndent(list, "", "  ")
+	tmp := a.path + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
+
+// login checks the password and opens a session.
+func (a *accounts) login(username, password string) (string, *session, bool) {
+	a.mu.Lock()
+	u := a.users[username]
+	hash := a.dummy
+	if u != nil {
+		hash = u.PasswordHash
+	}
+	a.mu.Unlock()
+	// outside the lock: hashing takes tens of milliseconds
+	if !checkPassword(hash, password) || u == nil {
+		return "", nil, false
+	}
+	r, _ := parseRole(u.Role)
+	token, s := a.open(u.Username, r, u.Groups)
+	return token, s, true
+}
+
+// open starts a session for user and returns its token.
+func (a *accounts) open(user string, r role, groups []string) (string, *session) {
+	s := &session{user: user, role: r, groups: groups, expires: time.Now().Add(a.ttl)}
+	token := crand.Text()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for t, old := range a.sessions {
+		if time.Now().After(old.expires) {
+			delete(a.sessions, t)
+		}
+	}
+	a.sessions[token] = s
+	return token, s
+}
+
+// setSessionCookie hands the browser its session token.
+func setSessionCookie(w http.ResponseWriter, r *http.Request, token string, s *session) {
+	http.SetCookie(w, &http.Cookie{
+		Name: sessionCookie, Value: token, Path: "/", Expires: s.expires,
+		HttpOnly: true, SameSite: http.SameSiteLaxMode, Secure: strings.HasPrefix(baseURL(r), "https:"),
+	})
+}
+
+// sessionOf returns the request's live session and its token.
+func (a *accounts) sessionOf(r *http.Request) (*session, string) {
+	ck, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, ""
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s := a.sessions[ck.Value]
+	if s == nil {
+		return nil, ""
+	}
+	if time.Now().After(s.expires) {
+		delete(a.sessions, ck.Value)
+		return nil, ""
+	}
+	return s, ck.Value
+}
+
+// isAdmin reports whether r comes from a signed-in admin. With accounts
+// off nobody is.
+func (c cfg) isAdmin(r *http.Request) bool {
+	if c.auth == nil {
+		return false
+	}
+	s, _ := c.auth.sessionOf(r)
+	return s != nil && s.role >= roleAdmin
+}
+
+// requiredRole is the least role that may make r.
+func requiredRole(r *http.Request) role {
+	p := r.URL.Path
+	switch {
+	case p == "/login" || p == "/api/login" || p == "/api/logout" || strings.HasPrefix(p, "/s/"),
+		p == "/login/oidc" || p == "/login/oidc/callback":
+		return rolePublic
+	case strings.HasPrefix(p, "/debug/"):
+		return rolePublic // behind ADMIN_TOKEN instead, for tools without a session
+	case strings.HasPrefix(p, "/api/system/"), p == "/api/nodes/maintenance", p == "/api/settings",
+		p == "/api/users", p == "/api/heal", p == "/api/operations/cancel":
+		return roleAdmin
+	case r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions:
+		return roleViewer
+	}
+	return roleUploader
+}
+
+// enforce requires a session with the right role, then makes the session
+// the caller's identity: X-User and X-Groups come from the account, so
+// quotas and file permissions apply to the signed-in user. Pages send a
+// browser without a session to /login instead.
+func (a *accounts) enforce(h http.Handler) http.Handler {
+	if a == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		need := requiredRole(r)
+		if need == rolePublic {
+			h.ServeHTTP(w, r)
+			return
+		}
+		s, _ := a.sessionOf(r)
+		if s == nil {
+			if !strings.HasPrefix(r.URL.Path, "/api/") {
+				http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+				return
+			}
+			writeError(w, http.StatusUnauthorized, codeLoginRequired, "login required")
+			return
+		}
+		if s.role < need {
+			writeErrorDetail(w, http.StatusForbidden, codeForbidden, "the "+need.String()+" role is required",
+				map[string]string{"role": s.role.String(), "needs": need.String()})
+			return
+		}
+		r.Header.Set("X-User", s.user)
+		r.Header.Del("X-Tenant")
+		r.Header.Del("X-Groups")
+		if len(s.groups) > 0 {
+			r.Header.Set("X-Groups", strings.Join(s.groups, ","))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// safeNext keeps a post-login redirect on this site.
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// loginRequest is the JSON body of POST /api/login.
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// handleLogin signs in with {username, password}. JSON requests get the
+// session as JSON; the login page's form post is redirected to ?next=.
+func (c cfg) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if c.auth == nil || c.auth.path == "" {
+		writeError(w, http.StatusNotFound, codeFeatureDisabled, "local accounts are off (USERS_FILE not set)")
+		return
+	}
+	var body loginRequest
+	form := !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+	if form {
+		body.Username, body.Password = r.PostFormValue("username"), r.PostFormValue("password")
+	} else if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidJSON, "bad json")
+		return
+	}
+	token, s, ok := c.auth.login(body.Username, body.Password)
+	if !ok {
+		log.Printf("login failed for %q from %s", body.Username, callerOf(r))
+		if form {
+			c.auth.loginPage(w, http.StatusUnauthorized, r.PostFormValue("next"), "Wrong username or password.")
+			return
+		}
+		writeError(w, http.StatusUnauthorized, codeBadCredentials, "wrong username or password")
+		return
+	}
+	setSessionCookie(w, r, token, s)
+	c.audit(r, "login", s.user)
+	if form {
+		http.Redirect(w, r, safeNext(r.PostFormValue("next")), http.StatusSeeOther)
+		return
+	}
+	writeJSON(w, map[string]any{"username": s.user, "role": s.role.String(), "groups": s.groups, "expiresAt": s.expires.UTC()})
+}
+
+// handleLogout ends the caller's session, if any.
+func (c cfg) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if c.auth != nil {
+		if _, token := c.auth.sessionOf(r); token != "" {
+			c.auth.mu.Lock()
+			delete(c.auth.sessions, token)
+			c.auth.mu.Unlock()
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1})
+	if r.Method == http.MethodGet {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	writeJSON(w, map[string]bool{"loggedOut": true})
+}
+
+// handleMe shows who the caller is signed in as.
+func (c cfg) handleMe(w http.ResponseWriter, r *http.Request) {
+	if c.auth == nil {
+		writeJSON(w, map[string]any{"accounts": false})
+		return
+	}
+	s, _ := c.auth.sessionOf(r)
+	writeJSON(w, map[string]any{"accounts": true, "username": s.user, "role": s.role.String(), "groups": s.groups, "expiresAt": s.expires.UTC()})
+}
+
+// serveLogin shows the login page.
+func (c cfg) serveLogin(w http.ResponseWriter, r *http.Request) {
+	if c.auth == nil {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	c.auth.loginPage(w, http.StatusOK, r.URL.Query().Get("next"), "")
+}
+
+// loginPage offers the identity provider, when there is one, and the
+// password form, when there are local users.
+func (a *accounts) loginPage(w http.ResponseWriter, code int, next, msg string) {
+	next = safeNext(next)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, `<!doctype html>
+<html><head><meta charset="utf-8"><title>Sign in</title></head>
+<body style="font-family:sans-serif;max-width:20rem;margin:4rem auto">
+<h2>Sign in</h2>
+<p style="color:#b00">%s</p>
+`, html.EscapeString(msg))
+	if a.oidc != nil {
+		fmt.Fprintf(w, "<p><a href=\"/login/oidc?next=%s\">Sign in with %s</a></p>\n",
+			html.EscapeString(url.QueryEscape(next)), html.EscapeString(a.oidc.Name))
+	}
+	if a.path != "" {
+		fmt.Fprintf(w, `<form method="post" action="/api/login">
+<input type="hidden" name="next" value="%s">
+<p><input name="username" placeholder="Username" autofocus required></p>
+<p><input type="password" name="password" placeholder="Password" required></p>
+<button type="submit">Sign in</button></form>
+`, html.EscapeString(next))
+	}
+	fmt.Fprint(w, "</body></html>\n")
+}
+
+// userRequest is the body of PUT /api/users; Password may be left out of an
+// update.
+type userRequest struct {
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	Role     string   `json:"role"`
+	Groups   []string `json:"groups"`
+}
+
+// handleUsers manages accounts (admin only): GET lists them, PUT
+// {username, password, role, groups} creates or updates one (password may
+// be left out of an update), DELETE ?username= removes one and ends its
+// sessions. The last admin cannot be removed or demoted.
+func (c cfg) handleUsers(w http.ResponseWriter, r *http.Request) {
+	if c.auth == nil || c.auth.path == "" {
+		writeError(w, http.StatusNotFound, codeFeatureDisabled, "local accounts are off (USERS_FILE not set)")
+		return
+	}
+	a := c.auth
+	type userView struct {
+		Username string   `json:"username"`
+		Role     string   `json:"role"`
+		Groups   []string `json:"groups,omitempty"`
+	}
+	view := func(u *account) userView { return userView{u.Username, u.Role, u.Groups} }
+	admins := func(except string) int {
+		n := 0
+		for _, u := range a.users {
+			if u.Role == "admin" && u.Username != except {
+				n++
+			}
+		}
+		return n
+	}
+	switch r.Method {
+	case http.MethodGet:
+		a.mu.Lock()
+		out := []userView{}
+		for _, u := range a.users {
+			out = append(out, view(u))
+		}
+		a.mu.Unlock()
+		sort.Slice(out, func(i, j int) bool { return out[i].Username < out[j].Username })
+		writeJSON(w, map[string]any{"users": out})
+	case http.MethodPut:
+		var body userRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Username == "" {
+			writeError(w, http.StatusBadRequest, codeInvalidJSON, "bad json: need username")
+			return
+		}
+		if _, ok := parseRole(body.Role); !ok {
+			writeError(w, http.StatusBadRequest, codeBadRequest, "role must be viewer, uploader or admin")
+			return
+		}
+		var hash string
+		if body.Password != "" {
+			var err error
+			if hash, err = hashPassword(body.Password); err != nil {
+				writeError(w, http.StatusInternalServerError, codeInternal, err.Error())
+				return
+			}
+		}
+		a.mu.Lock()
+		u := a.users[body.Username]
+		switch {
+		case u == nil && hash == "":
+			a.mu.Unlock()
+			writeError(w, http.StatusBadRequest, codeBadRequest, "a new user needs a password")
+			return
+		case u != nil && u.Role == "admin" && body.Role != "admin" && admins(u.Username) == 0:
+			a.mu.Unlock()
+			writeError(w, http.StatusConflict, codeConflict, "cannot demote the last admin")
+			return
+		case u == nil:
+			u = &account{Username: body.Username}
+		}
+		old := a.users[body.Username]
+		next := *u
+		next.Role, next.Groups = body.Role, body.Groups
+		if hash != "" {
+			next.PasswordHash = hash
+		}
+		a.users[body.Username] = &next
+		err := a.save()
+		if err != nil {
+			if old == nil {
+				delete(a.users, body.Username)
+			} else {
+				a.users[body.Username] = old
+			}
+		} else {
+			// sessions pick up the new role and groups at the next login
+			for t, s := range a.sessions {
+				if s.user == body.Username {
+					delete(a.sessions, t)
+				}
+			}
+		}
+		a.mu.Unlock()
+		if err != nil {
+			writeErrorDetail(w, http.StatusInternalServerError, codeInternal, "cannot save users", err.Error())
+			return
+		}
+		c.audit(r, "user-update", body.Username+" role="+body.Role)
+		writeJSON(w, view(&next))
+	case http.MethodDelete:
+		name := r.URL.Query().Get("username")
+		a.mu.Lock()
+		u := a.users[name]
+		switch {
+		case u == nil:
+			a.mu.Unlock()
+			writeError(w, http.StatusNotFound, codeUserNotFound, "user not found")
+			return
+		case u.Role == "admin" && admins(name) == 0:
+			a.mu.Unlock()
+			writeError(w, http.StatusConflict, codeConflict, "cannot remove the last admin")
+			return
+		}
+		delete(a.users, name)
+		err := a.save()
+		if err != nil {
+			a.users[name] = u
+		} else {
+			for t, s := range a.sessions {
+				if s.user == name {
+					delete(a.sessions, t)
+				}
+			}
+		}
+		a.mu.Unlock()
+		if err != nil {
+			writeErrorDetail(w, http.StatusInternalServerError, codeInternal, "cannot save users", err.Error())
+			return
+		}
+		c.audit(r, "user-delete", name)
+		writeJSON(w, map[string]any{"username": name, "deleted": true})
+	}
+}
+
+/* ---------------- OIDC ---------------- */
+
+// OIDCConfig signs users in through an external OpenID Connect provider
+// with the authorization-code flow (and PKCE), so nobody has to manage
+// local users. The provider's groups decide the role.
+type OIDCConfig struct {
+	Issuer       string // "" = off
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string // "" = /login/oidc/callback on the gateway as the browser reached it
+	Scopes       []string
+	Name         string // shown on the login page
+
+	UsernameClaim string // falls back to email, then sub
+	GroupsClaim   string
+	// IdP groups that get each role; "*" matches anyone the provider signs
+	// in. The highest matching role wins; a user matching none is refused.
+	AdminGroups    []string
+	UploaderGroups []string
+	ViewerGroups   []string
+}
+
+// oidcProvider is a configured provider, its discovered endpoints and
+// signing keys, and the logins that are waiting for a callback.
+type oidcProvider struct {
+	OIDCConfig
+	mu      sync.Mutex
+	meta    *oidcMetadata
+	keys    map[string]crypto.PublicKey // kid -> key
+	keysAt  time.Time
+	pending map[string]oidcPending // state -> login
+	client  *http.Client
+}
+
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcPending struct {
+	nonce, verifier, next, redirect string
+	expires                         time.Time
+}
+
+// oidcLoginTimeout is how long a user has to finish signing in at the
+// provider.
+const oidcLoginTimeout = 10 * time.Minute
+
+func newOIDCProvider(conf OIDCConfig, client *http.Client) *oidcProvider {
+	if conf.Issuer == "" {
+		return nil
+	}
+	return &oidcProvider{OIDCConfig: conf, pending: map[string]oidcPending{}, client: client}
+}
+
+func sameIssuer(a, b string) bool { return strings.TrimRight(a, "/") == strings.TrimRight(b, "/") }
+
+// discover fetches the provider's metadata once; a failure is retried at
+// the next login, so the gateway starts while the provider is down.
+func (p *oidcProvider) discover(ctx context.Context) (*oidcMetadata, error) {
+	p.mu.Lock()
+	meta := p.meta
+	p.mu.Unlock()
+	if meta != nil {
+		return meta, nil
+	}
+	var m oidcMetadata
+	if err := p.getJSON(ctx, strings.TrimRight(p.Issuer, "/")+"/.well-known/openid-configuration", &m); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if !sameIssuer(m.Issuer, p.Issuer) || m.AuthorizationEndpoint == "" || m.TokenEndpoint == "" || m.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery: issuer %q does not match or endpoints are missing", m.Issuer)
+	}
+	p.mu.Lock()
+	p.meta = &m
+	p.mu.Unlock()
+	return &m, nil
+}
+
+// getJSON GETs u from the provider and decodes a 200 response into out.
+func (p *oidcProvider) getJSON(ctx context.Context, u string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: status %d", u, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// jwk is one key of a JSON Web Key Set; RSA and P-256 keys are supported.
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	b64 := base64.RawURLEncoding
+	switch k.Kty {
+	case "RSA":
+		n, err := b64.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64.DecodeString(k.E)
+		if err != nil || len(e) > 4 {
+			return nil, fmt.Errorf("bad exponent")
+		}
+		var exp int
+		for _, b := range e {
+			exp = exp<<8 | int(b)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exp}, nil
+	case "EC":
+		x, err := b64.DecodeString(k.X)
+		y, err2 := b64.DecodeString(k.Y)
+		if err != nil || err2 != nil || k.Crv != "P-256" || len(x) != 32 || len(y) != 32 {
+			return nil, fmt.Errorf("unsupported EC key")
+		}
+		return ecdsa.ParseUncompressedPublicKey(elliptic.P256(), append(append([]byte{4}, x...), y...))
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// key returns the signing key kid, refetching the key set (at most once a
+// minute) when the provider has rotated to a key not seen yet.
+func (p *oidcProvider) key(ctx context.Context, meta *oidcMetadata, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	k, ok := p.keys[kid]
+	stale := time.Since(p.keysAt) > time.Minute
+	p.mu.Unlock()
+	if ok {
+		return k, nil
+	}
+	if !stale {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := p.getJSON(ctx, meta.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, j := range set.Keys {
+		if pk, err := j.publicKey(); err == nil {
+			keys[j.Kid] = pk
+		}
+	}
+	p.mu.Lock()
+	p.keys, p.keysAt = keys, time.Now()
+	p.mu.Unlock()
+	if k, ok := keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// verifyIDToken checks the ID token's signature (RS256 or ES256), issuer,
+// audience, expiry and nonce, and returns its claims.
+func (p *oidcProvider) verifyIDToken(ctx context.Context, meta *oidcMetadata, raw, nonce string) (map[string]any, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed id_token")
+	}
+	b64 := base64.RawURLEncoding
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	hb, err := b64.DecodeString(parts[0])
+	if err == nil {
+		err = json.Unmarshal(hb, &header)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("id_token header: %v", err)
+	}
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("id_token signature: %v", err)
+	}
+	pub, err := p.key(ctx, meta, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" {
+			return nil, fmt.Errorf("id_token alg %q does not match an RSA key", header.Alg)
+		}
+		err = rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig)
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 {
+			return nil, fmt.Errorf("id_token alg %q does not match a P-256 key", header.Alg)
+		}
+		if !ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			err = fmt.Errorf("bad signature")
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("id_token signature: %v", err)
+	}
+
+	var claims map[string]any
+	cb, err := b64.DecodeString(parts[1])
+	if err == nil {
+		err = json.Unmarshal(cb, &claims)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("id_token claims: %v", err)
+	}
+	iss, _ := claims["iss"].(string)
+	exp, _ := claims["exp"].(float64)
+	got, _ := claims["nonce"].(string)
+	switch {
+	case !sameIssuer(iss, meta.Issuer):
+		return nil, fmt.Errorf("id_token issuer %q", iss)
+	case !slices.Contains(claimStrings(claims["aud"]), p.ClientID):
+		return nil, fmt.Errorf("id_token is not for client %q", p.ClientID)
+	case time.Now().After(time.Unix(int64(exp), 0).Add(time.Minute)): // a minute of clock skew
+		return nil, fmt.Errorf("id_token expired")
+	case subtle.ConstantTimeCompare([]byte(got), []byte(nonce)) != 1:
+		return nil, fmt.Errorf("id_token nonce does not match")
+	}
+	return claims, nil
+}
+
+// claimStrings reads a claim that is a string or a list of strings.
+func claimStrings(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var out []string
+		for _, x := range v {
+			if s, ok := x.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// roleFor maps the user's IdP groups to the highest role they grant.
+func (p *oidcProvider) roleFor(groups []string) role {
+	matches := func(want []string) bool {
+		for _, g := range want {
+			if g == "*" || slices.Contains(groups, g) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case matches(p.AdminGroups):
+		return roleAdmin
+	case matches(p.UploaderGroups):
+		return roleUploader
+	case matches(p.ViewerGroups):
+		return roleViewer
+	}
+	return rolePublic
+}
+
+// handleOIDCLogin sends the browser to the provider: GET /login/oidc?next=.
+func (c cfg) handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if c.auth == nil || c.auth.oidc == nil {
+		writeError(w, http.StatusNotFound, codeFeatureDisabled, "single sign-on is off (OIDC_ISSUER not set)")
+		return
+	}
+	p := c.auth.oidc
+	meta, err := p.discover(r.Context())
+	if err != nil {
+		log.Printf("oidc: %v", err)
+		c.auth.loginPage(w, http.StatusBadGateway, r.URL.Query().Get("next"), "The identity provider is unavailable.")
+		return
+	}
+	pend := oidcPending{
+		nonce: crand.Text(), verifier: crand.Text() + crand.Text(),
+		next: safeNext(r.URL.Query().Get("next")), redirect: p.RedirectURL,
+		expires: time.Now().Add(oidcLoginTimeout),
+	}
+	if pend.redirect == "" {
+		pend.redirect = baseURL(r) + "/login/oidc/callback"
+	}
+	state := crand.Text()
+	p.mu.Lock()
+	for st, old := range p.pending {
+		if time.Now().After(old.expires) {
+			delete(p.pending, st)
+		}
+	}
+	p.pending[state] = pend
+	p.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(pend.verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {pend.redirect},
+		"scope":                 {strings.Join(p.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {pend.nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, meta.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+// handleOIDCCallback finishes a login: it trades the code for tokens,
+// verifies the ID token, maps the user's groups to a role and opens a
+// session.
+func (c cfg) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if c.auth == nil || c.auth.oidc == nil {
+		writeError(w, http.StatusNotFound, codeFeatureDisabled, "single sign-on is off (OIDC_ISSUER not set)")
+		return
+	}
+	p := c.auth.oidc
+	q := r.URL.Query()
+	p.mu.Lock()
+	pend, ok := p.pending[q.Get("state")]
+	delete(p.pending, q.Get("state"))
+	p.mu.Unlock()
+	fail := func(code int, msg string, err error) {
+		log.Printf("oidc: login failed from %s: %s: %v", callerOf(r), msg, err)
+		c.auth.loginPage(w, code, pend.next, msg)
+	}
+	switch {
+	case !ok || time.Now().After(pend.expires):
+		fail(http.StatusBadRequest, "The sign-in attempt expired, please try again.", fmt.Errorf("unknown state"))
+		return
+	case q.Get("error") != "":
+		fail(http.StatusUnauthorized, "The identity provider refused the sign-in.", fmt.Errorf("%s: %s", q.Get("error"), q.Get("error_description")))
+		return
+	}
+	meta, err := p.discover(r.Context())
+	if err != nil {
+		fail(http.StatusBadGateway, "The identity provider is unavailable.", err)
+		return
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {q.Get("code")},
+		"redirect_uri":  {pend.redirect},
+		"client_id":     {p.ClientID},
+		"code_verifier": {pend.verifier},
+	}
+	req, _ := http.NewRequestWithContext(r.Context(), http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+	resp, err := c.httpClient(10 * time.Second).Do(req)
+	if err != nil {
+		fail(http.StatusBadGateway, "The identity provider is unavailable.", err)
+		return
+	}
+	defer resp.Body.Close()
+	var tok struct {
+		IDToken string `json:"id_token"`
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&tok) != nil || tok.IDToken == "" {
+		fail(http.StatusBadGateway, "The identity provider did not accept the sign-in.", fmt.Errorf("token endpoint: status %d", resp.StatusCode))
+		return
+	}
+	claims, err := p.verifyIDToken(r.Context(), meta, tok.IDToken, pend.nonce)
+	if err != nil {
+		fail(http.StatusUnauthorized, "The sign-in could not be verified.", err)
+		return
+	}
+	var user string
+	for _, claim := range []string{p.UsernameClaim, "email", "sub"} {
+		if user, _ = claims[claim].(string); user != "" {
+			break
+		}
+	}
+	groups := claimStrings(claims[p.GroupsClaim])
+	rl := p.roleFor(groups)
+	if user == "" || rl == rolePublic {
+		fail(http.StatusForbidden, "Your account has no access to this system.", fmt.Errorf("user %q, groups %v map to no role", user, groups))
+		return
+	}
+	token, s := c.auth.open(user, rl, groups)
+	setSessionCookie(w, r, token, s)
+	c.audit(r, "login", user+" via oidc role="+rl.String())
+	http.Redirect(w, r, pend.next, http.StatusSeeOther)
+}
+
+/* ---------------- UI PAGE ---------------- */
+
+func (c cfg) serveIndex(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, filepath.Join(c.PagesDir, "index.html"))
+}
+
+func (c cfg) serveDashboard(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, filepath.Join(c.PagesDir, "dashboard.html"))
+}
+
+/* ---------------- API: UPLOAD ---------------- */
+
+type allocateResp struct {
+	FileID   string `json:"fileId"`
+	Version  int    `json:"version"`
+	Replicas []struct {
+		NodeID string `json:"nodeId"`
+		URL    string `json:"url"`
+	} `json:"replicas"`
+	// WriteQuorum is how many replicas the naming service needs uploaded
+	// before a commit counts; see requiredWrites.
+	WriteQuorum int `json:"writeQuorum"`
+	// ConflictID is set when another upload of the same filename has
+	// different content; both are kept until the conflict is resolved.
+	ConflictID string `json:"conflictId"`
+}
+
+// requiredWrites is how many replica uploads must succeed before the
+// allocation is worth committing: the naming service's write quorum, but
+// never more than the replicas it handed out. Without a reported quorum one
+// upload is enough.
+func (a allocateResp) requiredWrites() int {
+	return max(min(a.WriteQuorum, len(a.Replicas)), 1)
+}
+
+// placement is where an upload asks the naming service to put a new file:
+// placement hints such as "prefer:ssd", and a storage class.
+type placement struct {
+	Hints        []string
+	StorageClass string
+}
+
+// placementOf reads an upload's "placement" form values, each of which may
+// be a comma-separated list (placement=prefer:ssd,avoid:hdd), and its
+// "storageClass".
+func placementOf(r *http.Request) placement {
+	var p placement
+	for _, v := range r.Form["placement"] {
+		for _, hint := range strings.Split(v, ",") {
+			if hint = strings.TrimSpace(hint); hint != "" {
+				p.Hints = append(p.Hints, hint)
+			}
+		}
+	}
+	p.StorageClass = r.FormValue("storageClass")
+	return p
+}
+
+func (c cfg) handleUpload(w http.ResponseWriter, r *http.Request) {
+	if !c.parseUploadForm(w, r) {
+		return
+	}
+	filename := r.FormValue("filename")
+	file, hdr, err := r.FormFile("file")
+	if err != nil || filename == "" {
+		writeError(w, http.StatusBadRequest, codeMissingParameter, "missing filename/file")
+		return
+	}
+	defer file.Close()
+	if c.MaxUploadBytes > 0 && hdr.Size > c.MaxUploadBytes {
+		tooLarge(w, "upload", c.MaxUploadBytes)
+		return
+	}
+
+	if fid := r.FormValue("fileId"); fid != "" && !c.authorize(w, r, fid, "write") {
+		return
+	}
+	res, err := c.storeFile(r.Context(), file, filename, hdr.Header.Get("Content-Type"), r.FormValue("fileId"), tenantOf(r), "", placementOf(r))
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, res)
+}
+
+// uploadError is a failed storeFile together with the status and code to
+// report.
+type uploadError struct {
+	Status int
+	Code   string
+	Msg    string
+	Detail string
+}
+
+func (e *uploadError) Error() string { return e.Msg + ": " + e.Detail }
+
+// writeStoreError answers for a failed storeFile.
+func writeStoreError(w http.ResponseWriter, err error) {
+	var ue *uploadError
+	if errors.As(err, &ue) {
+		writeErrorDetail(w, ue.Status, ue.Code, ue.Msg, ue.Detail)
+		return
+	}
+	writeUpstreamError(w, "allocate error", err)
+}
+
+// storeFile runs allocate, replica uploads and commit for one file. A
+// refused allocation (QUOTA_EXCEEDED, INSUFFICIENT_NODES, ...) comes back as
+// the naming service's *statusError so it can be relayed; every other
+// failure is an *uploadError. A non-empty parentID
+// stores the file as that file's preview, which skips the type policy and
+// does not make a preview of the preview. place is passed on to the naming
+// service's allocation. Cancelling ctx before the commit stops the replica
+// uploads; after it they finish in the background.
+func (c cfg) storeFile(ctx context.Context, src io.Reader, filename, contentType, fileID, owner, parentID string, place placement) (map[string]any, error) {
+	// read file into memory (for demo). Untuk file besar, lebih baik stream temp file.
+	buf := &bytes.Buffer{}
+	h := sha256.New()
+	size, _ := io.Copy(io.MultiWriter(buf, h), src)
+	checksum := "sha256:" + hex.EncodeToString(h.Sum(nil))
+
+	// the declared type is the client's word; check what the bytes say too
+	detected := sniffType(buf.Bytes())
+	if why := c.checkType(contentType, detected); why != "" && parentID == "" {
+		return nil, &uploadError{Status: http.StatusUnsupportedMediaType, Code: codeUnsupportedType, Msg: "content type rejected", Detail: why}
+	}
+	if contentType == "" {
+		contentType = detected
+	}
+
+	// 1) allocate
+	payload := map[string]any{
+		"filename":            filename,
+		"size":                size,
+		"checksum":            checksum,
+		"contentType":         contentType,
+		"detectedContentType": detected,
+	}
+	if fileID != "" {
+		payload["fileId"] = fileID // overwrite: new version of an existing file
+	}
+	if owner != "" {
+		payload["owner"] = owner
+	}
+	if parentID != "" {
+		payload["parentId"], payload["derivedKind"] = parentID, "preview"
+	}
+	if len(place.Hints) > 0 {
+		payload["placement"] = place.Hints
+	}
+	if place.StorageClass != "" {
+		payload["storageClass"] = place.StorageClass
+	}
+	alloc, err := postJSON[allocateResp](ctx, c.upstreams, c.namingForNew(fileID, parentID, owner)+"/allocate", payload)
+	var se *statusError
+	if errors.As(err, &se) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, &uploadError{Status: http.StatusBadGateway, Code: codeUpstreamError, Msg: "allocate error", Detail: err.Error()}
+	}
+
+	// 2) upload to the replicas in parallel
+	fields := map[string]string{
+		"fileId":           alloc.FileID,
+		"version":          fmt.Sprint(alloc.Version),
+		"expectedChecksum": checksum,
+		"contentType":      contentType,
+	}
+	// the pushes outlive ctx once the quorum is committed, for commitStragglers
+	pushCtx, stopPushes := context.WithCancel(context.WithoutCancel(ctx))
+	unwatch := context.AfterFunc(ctx, stopPushes)
+	results := c.uploadReplicas(pushCtx, alloc, fields, size, filename, buf.Bytes())
+
+	// <-- INSERT REQUIRED-WRITES CHECK HERE (before commit) -->
+	requiredWrites := alloc.requiredWrites()
+	var uploadedIDs []string
+	var storedSize int64
+	pending := len(alloc.Replicas)
+	for pending > 0 && len(uploadedIDs) < requiredWrites {
+		res := <-results
+		pending--
+		if res.err != nil {
+			// skip failed node (client-driven best-effort)
+			continue
+		}
+		uploadedIDs = append(uploadedIDs, res.nodeID)
+		storedSize = max(storedSize, res.stored)
+	}
+	if len(uploadedIDs) < requiredWrites {
+		stopPushes()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, &uploadError{
+			Status: http.StatusBadGateway,
+			Code:   codeReplicasTooFew,
+			Msg:    "not enough replicas uploaded",
+			Detail: fmt.Sprintf("uploaded %d, required %d", len(uploadedIDs), requiredWrites),
+		}
+	}
+	// <-- end check -->
+
+	// 3) commit as soon as the quorum is in; the rest are added later
+	commitBody := map[string]any{
+		"fileId":     alloc.FileID,
+		"version":    alloc.Version,
+		"uploaded":   uploadedIDs,
+		"storedSize": storedSize,
+	}
+	var commitResp map[string]any
+	commitResp, _ = postJSON[map[string]any](ctx, c.upstreams, c.namingFor(alloc.FileID)+"/commit", commitBody)
+	unwatch()
+	c.cache.drop(alloc.FileID)
+	if pending > 0 {
+		go func() {
+			defer stopPushes()
+			c.commitStragglers(commitBody, results, pending)
+		}()
+	} else {
+		stopPushes()
+	}
+	if parentID == "" {
+		go c.makePreview(alloc.FileID, filename, detected, buf.Bytes())
+	}
+
+	out := map[string]any{
+		"fileId":              alloc.FileID,
+		"version":             alloc.Version,
+		"filename":            filename,
+		"size":                size,
+		"storedSize":          storedSize,
+		"checksum":            checksum,
+		"contentType":         contentType,
+		"detectedContentType": detected,
+		"uploaded":            uploadedIDs,
+		"pending":             pending,
+		"commit":              commitResp,
+	}
+	if alloc.ConflictID != "" {
+		out["conflictId"] = alloc.ConflictID
+	}
+	return out, nil
+}
+
+// replicaResult is the outcome of pushing one file to one replica.
+type replicaResult struct {
+	nodeID string
+	stored int64
+	err    error
+}
+
+// uploadReplicas pushes content to every allocated replica, at most
+// ReplicaConcurrency at a time and each bounded by ReplicaTimeout. Results
+// arrive on the returned channel in completion order; it holds one per
+// replica, so nobody blocks if the caller stops reading early. Cancelling
+// ctx fails the pushes not yet done.
+func (c cfg) uploadReplicas(ctx context.Context, alloc allocateResp, fields map[string]string, size int64, filename string, content []byte) <-chan replicaResult {
+	results := make(chan replicaResult, len(alloc.Replicas))
+	sem := make(chan struct{}, c.ReplicaConcurrency)
+	for _, rep := range alloc.Replicas {
+		f := make(map[string]string, len(fields)+1)
+		for k, v := range fields {
+			f[k] = v
+		}
+		if len(c.TicketSecret) > 0 {
+			f["ticket"] = signTicket(c.TicketSecret, uploadTicket{
+				FileID: alloc.FileID, NodeID: rep.NodeID, Version: alloc.Version,
+				MaxSize: size, Checksum: fields["expectedChecksum"], Expires: time.Now().Add(c.TicketTTL).Unix(),
+			})
+		}
+		go func(nodeID, url string) {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				results <- replicaResult{nodeID: nodeID, err: ctx.Err()}
+				return
+			}
+			defer func() { <-sem }()
+			stored, err := c.postMultipart(ctx, url, f, filename, content, c.ReplicaTimeout)
+			results <- replicaResult{nodeID: nodeID, stored: stored, err: err}
+		}(rep.NodeID, rep.URL+"/upload")
+	}
+	return results
+}
+
+// commitStragglers waits for the replicas still uploading after the quorum
+// commit and, if any of them succeed, commits again with the full list. The
+// version in the body makes the naming service ignore this if the file was
+// overwritten in the meantime.
+func (c cfg) commitStragglers(body map[string]any, results <-chan replicaResult, pending int) {
+	uploaded := append([]string(nil), body["uploaded"].([]string)...)
+	stored := body["storedSize"].(int64)
+	late := 0
+	for ; pending > 0; pending-- {
+		res := <-results
+		if res.err != nil {
+			log.Printf("upload %s to %s: %v", body["fileId"], res.nodeID, res.err)
+			continue
+		}
+		uploaded = append(uploaded, res.nodeID)
+		stored = max(stored, res.stored)
+		late++
+	}
+	if late == 0 {
+		return
+	}
+	body["uploaded"], body["storedSize"] = uploaded, stored
+	if _, err := postJSON[map[string]any](context.Background(), c.upstreams, c.namingFor(body["fileId"].(string))+"/commit", body); err != nil {
+		log.Printf("late commit of %s: %v", body["fileId"], err)
+	}
+}
+
+/* ---------------- CONTENT TYPES ---------------- */
+
+// ExecutableTypes are the types sniffType gives programs and scripts; the
+// word "executables" in BlockedTypes expands to them.
+var ExecutableTypes = []string{"application/x-msdownload", "application/x-elf", "application/x-mach-binary", "text/x-shellscript"}
+
+// machO holds the Mach-O magic numbers, both byte orders, 32 and 64 bit.
+var machO = map[uint32]bool{0xfeedface: true, 0xfeedfacf: true, 0xcefaedfe: true, 0xcffaedfe: true}
+
+// sniffType detects an upload's type from its first 512 bytes.
+// http.DetectContentType calls every program application/octet-stream, so
+// executable magic numbers are checked first.
+func sniffType(b []byte) string {
+	head := b[:min(len(b), 512)]
+	switch {
+	case bytes.HasPrefix(head, []byte("MZ")):
+		return "application/x-msdownload"
+	case bytes.HasPrefix(head, []byte("\x7fELF")):
+		return "application/x-elf"
+	case len(head) >= 4 && machO[binary.BigEndian.Uint32(head)]:
+		return "application/x-mach-binary"
+	case bytes.HasPrefix(head, []byte("#!")):
+		return "text/x-shellscript"
+	}
+	return http.DetectContentType(head)
+}
+
+// mediaType drops parameters such as charset and lowercases t.
+func mediaType(t string) string {
+	t, _, _ = strings.Cut(t, ";")
+	return strings.ToLower(strings.TrimSpace(t))
+}
+
+// typePatterns normalizes a configured type list and expands
+// "executables".
+func typePatterns(list []string) []string {
+	var out []string
+	for _, p := range list {
+		if p = mediaType(p); p == "executables" {
+			out = append(out, ExecutableTypes...)
+		} else if p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func typeMatches(t string, patterns []string) bool {
+	for _, p := range patterns {
+		if p == t || (strings.HasSuffix(p, "/*") && strings.HasPrefix(t, p[:len(p)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkType applies the upload type policy and returns why an upload is
+// refused, or "". Either type being blocked refuses it. For the allow-list
+// the sniffed type decides, unless it is too generic to say anything
+// (octet-stream, plain text) or unknown; then the declared type does.
+func (c cfg) checkType(declared, detected string) string {
+	declared, detected = mediaType(declared), mediaType(detected)
+	for _, t := range []string{detected, declared} {
+		if t != "" && typeMatches(t, c.BlockedTypes) {
+			return fmt.Sprintf("%s is blocked", t)
+		}
+	}
+	if len(c.AllowedTypes) == 0 {
+		return ""
+	}
+	t := detected
+	if t == "" || t == "application/octet-stream" || t == "text/plain" {
+		t = declared
+	}
+	if t == "" {
+		return "content type unknown and UPLOAD_ALLOWED_TYPES is set"
+	}
+	if !typeMatches(t, c.AllowedTypes) {
+		return fmt.Sprintf("%s is not an allowed type", t)
+	}
+	return ""
+}
+
+/* ---------------- API: BATCH UPLOAD ---------------- */
+
+// batchItem is one file of a batch upload: a multipart part or a zip entry.
+type batchItem struct {
+	name        string
+	contentType string
+	open        func() (io.ReadCloser, error)
+}
+
+// handleUploadBatch stores every "file" part of one multipart request, and
+// every entry of each "archive" zip part under its path inside the zip.
+// Files go through allocate/upload/commit independently, BatchConcurrency at
+// a time, and each gets its own result; one failure never aborts the rest.
+func (c cfg) handleUploadBatch(w http.ResponseWriter, r *http.Request) {
+	if !c.parseUploadForm(w, r) {
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	var items []batchItem
+	for _, fh := range r.MultipartForm.File["file"] {
+		fh := fh
+		items = append(items, batchItem{
+			name:        fh.Filename,
+			contentType: fh.Header.Get("Content-Type"),
+			open:        func() (io.ReadCloser, error) { return fh.Open() },
+		})
+	}
+	for _, fh := range r.MultipartForm.File["archive"] {
+		f, err := fh.Open()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, codeBadRequest, "cannot read archive "+fh.Filename)
+			return
+		}
+		defer f.Close()
+		zr, err := zip.NewReader(f, fh.Size)
+		if err != nil {
+			writeErrorDetail(w, http.StatusBadRequest, codeBadRequest, "archive "+fh.Filename+" is not a zip", err.Error())
+			return
+		}
+		for _, zf := range zr.File {
+			if zf.FileInfo().IsDir() {
+				continue
+			}
+			zf := zf
+			items = append(items, batchItem{
+				name:        zf.Name,
+				contentType: mime.TypeByExtension(path.Ext(zf.Name)),
+				open:        zf.Open,
+			})
+		}
+	}
+	if len(items) == 0 {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "no file or archive parts")
+		return
+	}
+	if len(items) > c.BatchMaxFiles {
+		writeError(w, http.StatusRequestEntityTooLarge, codePayloadTooLarge, fmt.Sprintf("batch has %d files, limit is %d", len(items), c.BatchMaxFiles))
+		return
+	}
+
+	owner := tenantOf(r)
+	results := make([]map[string]any, len(items))
+	sem := make(chan struct{}, c.BatchConcurrency)
+	var wg sync.WaitGroup
+	for i, it := range items {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, it batchItem) {
+			defer func() { <-sem; wg.Done() }()
+			results[i] = c.storeBatchItem(r.Context(), it, owner)
+		}(i, it)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, res := range results {
+		if res["ok"] != true {
+			failed++
+		}
+	}
+	writeJSON(w, map[string]any{
+		"files":     len(items),
+		"succeeded": len(items) - failed,
+		"failed":    failed,
+		"results":   results,
+	})
+}
+
+// storeBatchItem stores one batch entry and shapes the outcome as a result
+// row: the storeFile response plus ok=true, or the status and error.
+func (c cfg) storeBatchItem(ctx context.Context, it batchItem, owner string) map[string]any {
+	fail := func(status int, code, msg string, detail any) map[string]any {
+		return map[string]any{"filename": it.name, "ok": false, "status": status, "code": code, "message": msg, "detail": detail}
+	}
+	src, err := it.open()
+	if err != nil {
+		return fail(http.StatusBadRequest, codeBadRequest, "cannot read file", err.Error())
+	}
+	defer src.Close()
+	// bound what a single entry (a zip entry especially) may inflate to
+	data, err := io.ReadAll(io.LimitReader(src, c.BatchMaxFileBytes+1))
+	if err != nil {
+		return fail(http.StatusBadRequest, codeBadRequest, "cannot read file", err.Error())
+	}
+	if int64(len(data)) > c.BatchMaxFileBytes {
+		return fail(http.StatusRequestEntityTooLarge, codePayloadTooLarge, "file too large", fmt.Sprintf("limit is %d bytes", c.BatchMaxFileBytes))
+	}
+	res, err := c.storeFile(ctx, bytes.NewReader(data), it.name, it.contentType, "", owner, "", placement{})
+	var se *statusError
+	var ue *uploadError
+	switch {
+	case errors.As(err, &se):
+		e := parseError([]byte(se.Body))
+		return fail(se.Code, e.Code, e.Message, e.Detail)
+	case errors.As(err, &ue):
+		return fail(ue.Status, ue.Code, ue.Msg, ue.Detail)
+	case err != nil:
+		return fail(http.StatusInternalServerError, codeInternal, "upload error", err.Error())
+	}
+	res["ok"] = true
+	res["status"] = http.StatusOK
+	return res
+}
+
+/* ---------------- API: DIRECT UPLOAD ---------------- */
+
+// uploadTicket authorises one upload of one file version to one node. It is
+// serialised as base64url(json) + "." + hex(hmac-sha256(json)).
+type uploadTicket struct {
+	FileID   string `json:"fileId"`
+	NodeID   string `json:"nodeId"`
+	Version  int    `json:"version"`
+	MaxSize  int64  `json:"maxSize"`
+	Checksum string `json:"checksum"`
+	Expires  int64  `json:"exp"` // unix seconds
+}
+
+func signTicket(secret []byte, t uploadTicket) string {
+	b, _ := json.Marshal(t)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(b)
+	return base64.RawURLEncoding.EncodeToString(b) + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// uploadInitRequest is the body of POST /api/upload/init.
+type uploadInitRequest struct {
+	Filename    string   `json:"filename"`
+	Size        int64    `json:"size"`
+	Checksum    string   `json:"checksum"`
+	ContentType string   `json:"contentType"`
+	FileID      string   `json:"fileId,omitempty"`
+	Owner       string   `json:"owner,omitempty"`
+	Placement   []string `json:"placement,omitempty"` // e.g. ["prefer:ssd"]
+
+	StorageClass string `json:"storageClass,omitempty"`
+}
+
+// uploadInitResponse tells the browser where to send each replica and
+// the ticket each node will accept.
+type uploadInitResponse struct {
+	FileID    string          `json:"fileId"`
+	Version   int             `json:"version"`
+	ExpiresAt time.Time       `json:"expiresAt"`
+	Replicas  []replicaTicket `json:"replicas"`
+	// ConflictID: see allocateResp.
+	ConflictID string `json:"conflictId,omitempty"`
+}
+
+type replicaTicket struct {
+	NodeID    string `json:"nodeId"`
+	UploadURL string `json:"uploadUrl"`
+	Ticket    string `json:"ticket"`
+}
+
+// handleUploadInit allocates a file and hands the browser one signed ticket
+// per replica so it can upload to the storage nodes directly and in
+// parallel, then call /api/upload/commit.
+func (c cfg) handleUploadInit(w http.ResponseWriter, r *http.Request) {
+	if len(c.TicketSecret) == 0 {
+		writeError(w, http.StatusNotImplemented, codeFeatureDisabled, "direct uploads disabled (UPLOAD_TICKET_SECRET not set)")
+		return
+	}
+	var body uploadInitRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Filename == "" || body.Size <= 0 {
+		writeError(w, http.StatusBadRequest, codeInvalidJSON, "bad json")
+		return
+	}
+	if c.MaxUploadBytes > 0 && body.Size > c.MaxUploadBytes {
+		tooLarge(w, "upload", c.MaxUploadBytes)
+		return
+	}
+	if body.FileID != "" && !c.authorize(w, r, body.FileID, "write") {
+		return
+	}
+	body.Owner = tenantOf(r)
+	// the bytes never pass through here, so only the declared type is checked
+	if why := c.checkType(body.ContentType, ""); why != "" {
+		writeErrorDetail(w, http.StatusUnsupportedMediaType, codeUnsupportedType, "content type rejected", why)
+		return
+	}
+	alloc, err := postJSON[allocateResp](r.Context(), c.upstreams, c.namingForNew(body.FileID, "", body.Owner)+"/allocate", body)
+	if err != nil {
+		writeUpstreamError(w, "allocate error", err)
+		return
+	}
+
+	exp := time.Now().Add(c.TicketTTL)
+	out := uploadInitResponse{FileID: alloc.FileID, Version: alloc.Version, ExpiresAt: exp.UTC(), ConflictID: alloc.ConflictID}
+	pu := pendingUpload{uploader: uploaderOf(r), version: alloc.Version, until: exp.Add(c.TicketTTL)}
+	for _, rep := range alloc.Replicas {
+		pu.nodes = append(pu.nodes, rep.NodeID)
+		t := uploadTicket{
+			FileID: alloc.FileID, NodeID: rep.NodeID, Version: alloc.Version,
+			MaxSize: body.Size, Checksum: body.Checksum, Expires: exp.Unix(),
+		}
+		out.Replicas = append(out.Replicas, replicaTicket{
+			NodeID:    rep.NodeID,
+			UploadURL: strings.TrimRight(rep.URL, "/") + "/upload",
+			Ticket:    signTicket(c.TicketSecret, t),
+		})
+	}
+	c.pending.add(alloc.FileID, pu)
+	writeJSON(w, out)
+}
+
+// pendingUploads remembers each direct upload from /api/upload/init until
+// a ticket lifetime after its tickets expire: who started it, so only they
+// commit it, and which nodes got tickets, so only those count.
+type pendingUploads struct {
+	mu sync.Mutex
+	m  map[string]pendingUpload // by fileId
+}
+
+type pendingUpload struct {
+	uploader string // uploaderOf the init call
+	version  int
+	nodes    []string
+	until    time.Time
+}
+
+// add records fileID's upload and forgets the ones that ran out.
+func (p *pendingUploads) add(fileID string, pu pendingUpload) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	maps.DeleteFunc(p.m, func(_ string, old pendingUpload) bool { return time.Now().After(old.until) })
+	p.m[fileID] = pu
+}
+
+func (p *pendingUploads) get(fileID string) (pendingUpload, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pu, ok := p.m[fileID]
+	return pu, ok && time.Now().Before(pu.until)
+}
+
+// uploaderOf is who a direct upload is bound to: the caller's user, else
+// its address.
+func uploaderOf(r *http.Request) string {
+	if u := principalOf(r).user; u != "" {
+		return "user:" + u
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "addr:" + host
+}
+
+// uploadCommitRequest is the body of POST /api/upload/commit.
+type uploadCommitRequest struct {
+	FileID     string   `json:"fileId"`
+	Uploaded   []string `json:"uploaded"`
+	StoredSize int64    `json:"storedSize"`
+}
+
+// handleUploadCommit finishes a direct upload once the browser has pushed
+// the bytes to the nodes named in its tickets. Only the caller that ran
+// init may commit, and only the nodes it got tickets for count.
+func (c cfg) handleUploadCommit(w http.ResponseWriter, r *http.Request) {
+	var body uploadCommitRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.FileID == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidJSON, "bad json")
+		return
+	}
+	commit, ok := c.claimCommit(w, r, body)
+	if !ok {
+		return
+	}
+	body.Uploaded = commit["uploaded"].([]string)
+	// the naming service holds the write quorum; a short commit leaves the
+	// file allocated, and the browser may commit again with more replicas
+	commitResp, err := postJSON[map[string]any](r.Context(), c.upstreams, c.namingFor(body.FileID)+"/commit", commit)
+	if err != nil {
+		writeUpstreamError(w, "commit error", err)
+		return
+	}
+	if met, ok := commitResp["quorumMet"].(bool); ok && !met {
+		writeErrorDetail(w, http.StatusBadGateway, codeReplicasTooFew, "not enough replicas uploaded",
+			fmt.Sprintf("uploaded %d, required %v", len(body.Uploaded), commitResp["writeQuorum"]))
+		return
+	}
+	c.cache.drop(body.FileID)
+	go c.previewStored(body.FileID)
+	writeJSON(w, map[string]any{"fileId": body.FileID, "uploaded": body.Uploaded, "commit": commitResp})
+}
+
+// claimCommit checks that the caller started the direct upload cm commits
+// and may write its file, and returns the commit for the naming service:
+// the version init allocated, and only the uploads to nodes that got
+// tickets. Otherwise it answers and returns false.
+func (c cfg) claimCommit(w http.ResponseWriter, r *http.Request, cm uploadCommitRequest) (map[string]any, bool) {
+	pu, ok := c.pending.get(cm.FileID)
+	if !ok {
+		writeErrorDetail(w, http.StatusNotFound, codeNotFound, "no direct upload of this file is pending", cm.FileID)
+		return nil, false
+	}
+	if pu.uploader != uploaderOf(r) {
+		forbidden(w, cm.FileID, "commit")
+		return nil, false
+	}
+	if !c.authorize(w, r, cm.FileID, "write") {
+		return nil, false
+	}
+	uploaded := slices.DeleteFunc(slices.Clone(cm.Uploaded), func(id string) bool { return !slices.Contains(pu.nodes, id) })
+	return map[string]any{"fileId": cm.FileID, "version": pu.version, "uploaded": uploaded, "storedSize": cm.StoredSize}, true
+}
+
+// postMultipart uploads content to a storage node along with the given form
+// fields and returns the number of bytes the node reports having stored on
+// disk. The node rejects the upload if what it wrote does not hash to the
+// expectedChecksum field. Cancelling ctx abandons the upload.
+func (up *upstreams) postMultipart(ctx context.Context, url string, fields map[string]string, filename string, content []byte, timeout time.Duration) (int64, error) {
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+
+	for k, v := range fields {
+		_ = w.WriteField(k, v)
+	}
+	fw, _ := w.CreateFormFile("file", filename)
+	_, _ = fw.Write(content)
+	w.Close()
+
+	payload, contentType := body.Bytes(), w.FormDataContentType()
+	client := up.httpClient(timeout)
+	// a node stores one version of a file once, so resending is harmless
+	resp, err := up.nodeCalls.do(client, true, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+		if err == nil {
+			req.Header.Set("Content-Type", contentType)
+		}
+		return req, err
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(resp.Body)
+		return 0, fmt.Errorf("upload %s failed: %s", url, strings.TrimSpace(string(b)))
+	}
+	var out struct {
+		Size        int64 `json:"size"`
+		StoredBytes int64 `json:"storedBytes"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	if out.StoredBytes == 0 {
+		out.StoredBytes = out.Size
+	}
+	return out.StoredBytes, nil
+}
+
+func postJSON[T any](ctx context.Context, up *upstreams, url string, v any) (T, error) {
+	var zero T
+	b, _ := json.Marshal(v)
+	client := up.httpClient(10 * time.Second)
+	// every attempt carries the same Idempotency-Key, so the naming service
+	// answers a retry of an allocate or commit that already went through
+	// with the stored response instead of acting twice
+	var k [16]byte
+	_, _ = crand.Read(k[:])
+	key := hex.EncodeToString(k[:])
+	resp, err := up.namingCalls.do(client, true, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Idempotency-Key", key)
+		}
+		return req, err
+	})
+	if err != nil {
+		return zero, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		x, _ := io.ReadAll(resp.Body)
+		return zero, &statusError{Code: resp.StatusCode, Body: strings.TrimSpace(string(x))}
+	}
+	dec := json.NewDecoder(resp.Body)
+	if err := dec.Decode(&zero); err != nil {
+		return zero, err
+	}
+	return zero, nil
+}
+
+// statusError is a non-2xx reply from the naming service or a node.
+type statusError struct {
+	Code int
+	Body string
+}
+
+func (e *statusError) Error() string { return fmt.Sprintf("status %d: %s", e.Code, e.Body) }
+
+/* ---------------- HTTP CLIENTS ---------------- */
+
+// TransportConfig tunes the connection pool behind every outbound call.
+type TransportConfig struct {
+	MaxIdleConns        int           // idle connections kept across all hosts
+	MaxIdleConnsPerHost int           // idle connections kept per host
+	MaxConnsPerHost     int           // dialing + active + idle per host (0 = no limit)
+	IdleConnTimeout     time.Duration // idle connections are closed after this
+	DialTimeout         time.Duration
+	KeepAlive           time.Duration // TCP keep-alive probe interval
+	TLSHandshakeTimeout time.Duration
+}
+
+// upstreams is how a gateway reaches the naming service and the nodes.
+// The transport pools and keeps alive connections to both: Go's default
+// keeps only two idle connections per host, so under load most calls would
+// dial afresh and leave a socket in TIME_WAIT.
+type upstreams struct {
+	transport   *http.Transport
+	nodeCalls   *resilientClient // gateway→node traffic
+	namingCalls *resilientClient // gateway→naming traffic
+	shards      []*namingPool    // see NAMING SHARDS; one without NAMING_SHARDS
+}
+
+func newUpstreams(conf Config) *upstreams {
+	policy := conf.Calls
+	u := &upstreams{transport: newTransport(conf.Transport), nodeCalls: newResilientClient(policy)}
+	// the naming service is a single point anyway; never fail it fast
+	policy.BreakAfter = 0
+	u.namingCalls = newResilientClient(policy)
+	u.shards = []*namingPool{newNamingPool(conf.NamingURLs)}
+	if len(conf.NamingShards) > 0 {
+		u.shards = nil
+		for _, urls := range conf.NamingShards {
+			u.shards = append(u.shards, newNamingPool(urls))
+		}
+	}
+	return u
+}
+
+func newTransport(tc TransportConfig) *http.Transport {
+	dialer := &net.Dialer{Timeout: tc.DialTimeout, KeepAlive: tc.KeepAlive}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          tc.MaxIdleConns,
+		MaxIdleConnsPerHost:   tc.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       tc.MaxConnsPerHost,
+		IdleConnTimeout:       tc.IdleConnTimeout,
+		TLSHandshakeTimeout:   tc.TLSHandshakeTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// httpClient returns a client on the shared transport; clients are cheap,
+// connections are not. A zero timeout means none.
+func (up *upstreams) httpClient(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: namingFailover{up}, Timeout: timeout}
+}
+
+// httpGet is c.httpClient(timeout).Get(u) bound to ctx. Handlers pass
+// r.Context(), so a client that hangs up stops the call at once.
+func (up *upstreams) httpGet(ctx context.Context, timeout time.Duration, u string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	return up.httpClient(timeout).Do(req)
+}
+
+/* ---------------- RETRIES & CIRCUIT BREAKING ---------------- */
+
+// CallPolicy governs how outbound calls are retried and when a host's
+// circuit opens.
+type CallPolicy struct {
+	Attempts   int           // tries per call, the first one included
+	BaseDelay  time.Duration // backoff before the second try; doubles after that
+	MaxDelay   time.Duration // backoff ceiling
+	BreakAfter int           // consecutive failures that open a host's circuit (0 = never)
+	OpenFor    time.Duration // how long an open circuit fails fast before a trial call
+}
+
+// resilientClient retries transient failures with jittered exponential
+// backoff and keeps a circuit breaker per host, so a dead node costs one
+// fast error instead of a timeout on every call.
+type resilientClient struct {
+	policy CallPolicy
+	mu     sync.Mutex
+	hosts  map[string]*circuit
+}
+
+type circuit struct {
+	fails     int       // consecutive failures while closed
+	openUntil time.Time // zero while closed; past it, one failure reopens
+}
+
+var errCircuitOpen = errors.New("circuit open")
+
+func newResilientClient(p CallPolicy) *resilientClient {
+	if p.Attempts < 1 {
+		p.Attempts = 1
+	}
+	return &resilientClient{policy: p, hosts: map[string]*circuit{}}
+}
+
+// do sends the request newReq builds (once per attempt, so bodies can be
+// replayed). Network errors and 502/503/504 count against the host's
+// circuit. They are retried when the call is idempotent; otherwise only a
+// refused connection or a 503 is, since neither reached a handler that
+// acted on it. The last response or error is returned as is.
+func (rc *resilientClient) do(client *http.Client, idempotent bool, newReq func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+		host := req.URL.Host
+		if !rc.allow(host) {
+			return nil, fmt.Errorf("%s: %w", host, errCircuitOpen)
+		}
+		resp, err := client.Do(req)
+		if req.Context().Err() != nil {
+			// the caller gave up; that says nothing about the host
+			return resp, err
+		}
+		failed := err != nil || resp.StatusCode == http.StatusBadGateway ||
+			resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusGatewayTimeout
+		rc.record(host, !failed)
+		retry := failed && (idempotent || isDialError(err) || (err == nil && resp.StatusCode == http.StatusServiceUnavailable))
+		if !retry || attempt+1 >= rc.policy.Attempts {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		select {
+		case <-time.After(rc.backoff(attempt)):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// backoff is the wait after the given (0-based) failed attempt: the
+// doubled base delay, capped, with the upper half jittered.
+func (rc *resilientClient) backoff(attempt int) time.Duration {
+	d := rc.policy.BaseDelay << attempt
+	if d <= 0 || d > rc.policy.MaxDelay {
+		d = rc.policy.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+func isDialError(err error) bool {
+	var op *net.OpError
+	return errors.As(err, &op) && op.Op == "dial"
+}
+
+func (rc *resilientClient) allow(host string) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	c := rc.hosts[host]
+	return c == nil || c.openUntil.IsZero() || time.Now().After(c.openUntil)
+}
+
+func (rc *resilientClient) record(host string, ok bool) {
+	if rc.policy.BreakAfter <= 0 {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if ok {
+		delete(rc.hosts, host)
+		return
+	}
+	c := rc.hosts[host]
+	if c == nil {
+		c = &circuit{}
+		rc.hosts[host] = c
+	}
+	c.fails++
+	if !c.openUntil.IsZero() || c.fails >= rc.policy.BreakAfter {
+		if time.Now().After(c.openUntil) {
+			log.Printf("circuit for %s open for %s after %d failure(s)", host, rc.policy.OpenFor, c.fails)
+		}
+		c.fails = 0
+		c.openUntil = time.Now().Add(rc.policy.OpenFor)
+	}
+}
+
+// circuits lists the hosts whose circuit is currently open.
+func (rc *resilientClient) circuits() map[string]time.Time {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	out := map[string]time.Time{}
+	for host, c := range rc.hosts {
+		if time.Now().Before(c.openUntil) {
+			out[host] = c.openUntil
+		}
+	}
+	return out
+}
+
+// hedgedGet downloads from urls[0] and, whenever the newest request has
+// not answered within after, races the next URL against it; a failed
+// request moves on to the next URL straight away. The first 2xx wins and
+// the rest are cancelled. onFail hears about every request that lost with
+// an error or non-2xx status. If all fail, the last failure is returned
+// along with its index. after <= 0 turns hedging off but keeps failover.
+func (rc *resilientClient) hedgedGet(ctx context.Context, client *http.Client, urls []string, after time.Duration, onFail func(i int, resp *http.Response, err error)) (*http.Response, int, error) {
+	type leg struct {
+		i    int
+		resp *http.Response
+		err  error
+	}
+	legs := make(chan leg, len(urls))
+	cancels := make([]context.CancelFunc, 0, len(urls))
+	launch := func() {
+		i := len(cancels)
+		lctx, cancel := context.WithCancel(ctx)
+		cancels = append(cancels, cancel)
+		go func() {
+			resp, err := rc.do(client, true, func() (*http.Request, error) {
+				return http.NewRequestWithContext(lctx, http.MethodGet, urls[i], nil)
+			})
+			legs <- leg{i, resp, err}
+		}()
+	}
+	stopOthers := func(keep int) {
+		for i, cancel := range cancels {
+			if i != keep {
+				cancel()
+			}
+		}
+	}
+
+	launch()
+	var hedge <-chan time.Time
+	if after > 0 {
+		hedge = time.After(after)
+	}
+	var last leg
+	done := 0
+	for {
+		select {
+		case l := <-legs:
+			done++
+			if l.err == nil && l.resp.StatusCode/100 == 2 {
+				stopOthers(l.i)
+				l.resp.Body = cancelOnClose{l.resp.Body, cancels[l.i]}
+				if last.resp != nil {
+					last.resp.Body.Close()
+				}
+				return l.resp, l.i, nil
+			}
+			onFail(l.i, l.resp, l.err)
+			if last.resp != nil {
+				last.resp.Body.Close()
+			}
+			last = l
+			if len(cancels) < len(urls) {
+				launch()
+			} else if done == len(cancels) {
+				if l.resp != nil {
+					l.resp.Body = cancelOnClose{l.resp.Body, cancels[l.i]}
+				}
+				stopOthers(l.i)
+				return l.resp, l.i, l.err
+			}
+		case <-hedge:
+			if len(cancels) < len(urls) {
+				launch()
+				hedge = time.After(after)
+			}
+		}
+	}
+}
+
+// cancelOnClose releases a hedged request's context with its body.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// handleCircuits lists the nodes whose circuit is open and until when.
+func (c cfg) handleCircuits(w http.ResponseWriter, r *http.Request) {
+	p := c.nodeCalls.policy
+	writeJSON(w, map[string]any{
+		"open":       c.nodeCalls.circuits(),
+		"attempts":   p.Attempts,
+		"baseDelay":  p.BaseDelay.String(),
+		"maxDelay":   p.MaxDelay.String(),
+		"breakAfter": p.BreakAfter,
+		"openFor":    p.OpenFor.String(),
+	})
+}
+
+/* ---------------- NAMING FAILOVER ---------------- */
+
+// namingPool is the naming service replicas the gateway may use, from
+// Config.NamingURLs, or one shard's. Calls go to the active one; a call
+// that cannot connect moves on to the next, and a background check keeps
+// the up/down view fresh.
+type namingPool struct {
+	urls []string // as configured, without a trailing slash
+
+	mu     sync.Mutex
+	active int
+	down   []bool
+	seen   []time.Time // last successful check or call
+}
+
+func newNamingPool(urls []string) *namingPool {
+	p := &namingPool{down: make([]bool, len(urls)), seen: make([]time.Time, len(urls))}
+	for _, u := range urls {
+		p.urls = append(p.urls, strings.TrimRight(u, "/"))
+	}
+	return p
+}
+
+// url is the endpoint to send naming calls to.
+func (p *namingPool) url() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.urls[p.active]
+}
+
+// index finds the endpoint u points at, or -1 for any other host.
+func (p *namingPool) index(u *url.URL) int {
+	for i, e := range p.urls {
+		if eu, err := url.Parse(e); err == nil && eu.Scheme == u.Scheme && eu.Host == u.Host {
+			return i
+		}
+	}
+	return -1
+}
+
+// failed marks endpoint i down and returns the one to try next: the first
+// endpoint after i not known to be down, else simply the next one.
+func (p *namingPool) failed(i int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.down[i] = true
+	next := (i + 1) % len(p.urls)
+	for k := 1; k < len(p.urls); k++ {
+		if j := (i + k) % len(p.urls); !p.down[j] {
+			next = j
+			break
+		}
+	}
+	if p.active == i {
+		log.Printf("naming: %s unreachable, failing over to %s", p.urls[i], p.urls[next])
+		p.active = next
+	}
+	return next
+}
+
+// ok records a successful exchange with endpoint i.
+func (p *namingPool) ok(i int) {
+	p.mu.Lock()
+	p.down[i], p.seen[i] = false, time.Now()
+	p.mu.Unlock()
+}
+
+// follow makes the endpoint a naming replica redirected to the active one,
+// so later calls go to the leader directly.
+func (p *namingPool) follow(loc *url.URL) {
+	i := p.index(loc)
+	if i < 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.active != i {
+		log.Printf("naming: following redirect to %s", p.urls[i])
+		p.active = i
+	}
+}
+
+// check probes every endpoint and leaves the active one alone unless it is
+// down, so a recovered replica does not pull traffic back and forth.
+func (p *namingPool) check(transport http.RoundTripper) {
+	client := &http.Client{Transport: transport, Timeout: time.Second}
+	for i, u := range p.urls {
+		resp, err := client.Get(u + "/metrics")
+		if err == nil {
+			resp.Body.Close()
+		}
+		if err != nil || resp.StatusCode/100 == 5 {
+			p.mu.Lock()
+			p.down[i] = true
+			p.mu.Unlock()
+			continue
+		}
+		p.ok(i)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.down[p.active] {
+		return
+	}
+	for j := range p.urls {
+		if !p.down[j] {
+			log.Printf("naming: %s is down, switching to %s", p.urls[p.active], p.urls[j])
+			p.active = j
+			return
+		}
+	}
+}
+
+func (p *namingPool) run(every time.Duration, transport http.RoundTripper) {
+	for range time.Tick(every) {
+		p.check(transport)
+	}
+}
+
+// namingEndpoint is one entry of /api/naming.
+type namingEndpoint struct {
+	URL      string     `json:"url"`
+	Active   bool       `json:"active"`
+	Down     bool       `json:"down"`
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+}
+
+func (p *namingPool) snapshot() []namingEndpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make([]namingEndpoint, len(p.urls))
+	for i, u := range p.urls {
+		out[i] = namingEndpoint{URL: u, Active: i == p.active, Down: p.down[i]}
+		if t := p.seen[i]; !t.IsZero() {
+			out[i].LastSeen = &t
+		}
+	}
+	return out
+}
+
+// namingFailover is the transport behind httpClient. Requests to a naming
+// endpoint that cannot be dialed are resent to the next one; nothing
+// reached the server, so this is safe for allocate and commit too. A 307 or
+// 308 to another endpoint is followed by the client as usual and also
+// switches the active endpoint.
+type namingFailover struct{ up *upstreams }
+
+func (f namingFailover) RoundTrip(req *http.Request) (*http.Response, error) {
+	p, i := f.up.poolOf(req.URL)
+	resp, err := f.up.transport.RoundTrip(req)
+	if i < 0 {
+		return resp, err
+	}
+	for tried := 1; err != nil && isDialError(err) && tried < len(p.urls); tried++ {
+		if req.Body != nil && req.GetBody == nil {
+			break // the body cannot be replayed
+		}
+		i = p.failed(i)
+		next, _ := url.Parse(p.urls[i])
+		retry := req.Clone(req.Context())
+		retry.URL.Scheme, retry.URL.Host, retry.Host = next.Scheme, next.Host, ""
+		if req.GetBody != nil {
+			if retry.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		resp, err = f.up.transport.RoundTrip(retry)
+	}
+	if err != nil {
+		if isDialError(err) {
+			p.failed(i)
+		}
+		return resp, err
+	}
+	p.ok(i)
+	if resp.StatusCode == http.StatusTemporaryRedirect || resp.StatusCode == http.StatusPermanentRedirect {
+		if loc, lerr := resp.Location(); lerr == nil {
+			p.follow(loc)
+		}
+	}
+	return resp, nil
+}
+
+// handleNamingEndpoints lists the naming endpoints and which one is in use,
+// and with shards each shard's.
+func (c cfg) handleNamingEndpoints(w http.ResponseWriter, r *http.Request) {
+	out := map[string]any{"endpoints": c.shards[0].snapshot()}
+	if len(c.shards) > 1 {
+		shards := make([][]namingEndpoint, len(c.shards))
+		for i, p := range c.shards {
+			shards[i] = p.snapshot()
+		}
+		out["shards"] = shards
+	}
+	writeJSON(w, out)
+}
+
+/* ---------------- NAMING SHARDS ---------------- */
+
+// The naming services the catalog is split across (NAMING_SHARDS), the
+// upstreams' shards, are each a pool of replicas; shard i owns the fileIds
+// shardOf puts at i, and the share tokens, conflict and operation IDs it
+// hands out hash there too. Calls about one of them go to its owner, a new
+// file to the shard its owner hashes to, so all of an owner's files, and
+// with them its quota and conflicts, are in one catalog; an owner change
+// that would break that is refused. Lists, metrics, quotas and the
+// monitoring views are gathered from every shard unless ?shard= picks one,
+// node maintenance and settings changes are sent to each, and lifecycle
+// and metrics history read shard 0 unless ?shard= says otherwise.
+
+// shardOf must match naming.ShardOf: FNV-1a of id modulo count. Both are
+// checked against one table, shardVector in the tests.
+func shardOf(id string, count int) int {
+	if count <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % uint32(count))
+}
+
+// namingFor is the naming endpoint of the shard that owns id.
+func (c cfg) namingFor(id string) string {
+	return c.shards[shardOf(id, len(c.shards))].url()
+}
+
+// namingForNew is where a new file is allocated: by fileId for a new
+// version, by parent for a derived file, else by owner.
+func (c cfg) namingForNew(fileID, parentID, owner string) string {
+	return c.namingFor(cmp.Or(fileID, parentID, owner))
+}
+
+// refuseCrossShard answers 409 CONFLICT, and reports that it did, when
+// giving fileID to owner would put one of owner's files outside the shard
+// its uploads go to, where its quota would not count it.
+func (c cfg) refuseCrossShard(w http.ResponseWriter, fileID, owner string) bool {
+	n := len(c.shards)
+	if shardOf(fileID, n) == shardOf(owner, n) {
+		return false
+	}
+	writeErrorDetail(w, http.StatusConflict, codeConflict, "the file is on another naming shard than the owner's files",
+		map[string]any{"fileId": fileID, "owner": owner, "shard": shardOf(fileID, n), "ownerShard": shardOf(owner, n)})
+	return true
+}
+
+// namingOf is the shard a per-shard view reads: ?shard=, else 0. It answers
+// 400 itself for an index out of range.
+func (c cfg) namingOf(w http.ResponseWriter, r *http.Request) (string, bool) {
+	v := r.URL.Query().Get("shard")
+	if v == "" {
+		return c.shards[0].url(), true
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil || i < 0 || i >= len(c.shards) {
+		writeError(w, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("shard must be 0 to %d", len(c.shards)-1))
+		return "", false
+	}
+	return c.shards[i].url(), true
+}
+
+// poolOf finds the shard pool u points into and its index there; the pool
+// is shard 0's, with -1, for any other host.
+func (up *upstreams) poolOf(u *url.URL) (*namingPool, int) {
+	for _, p := range up.shards {
+		if i := p.index(u); i >= 0 {
+			return p, i
+		}
+	}
+	return up.shards[0], -1
+}
+
+// fromShards GETs path from every shard at once and decodes each 200 answer
+// into out, in shard order; headers are the answers' headers. The first
+// failure fails the whole.
+func fromShards[T any](ctx context.Context, up *upstreams, path string) (out []T, headers []http.Header, err error) {
+	bodies, headers, err := up.shardBodies(ctx, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	out = make([]T, len(bodies))
+	for i, b := range bodies {
+		if err := json.Unmarshal(b, &out[i]); err != nil {
+			return nil, nil, fmt.Errorf("shard %d: %w", i, err)
+		}
+	}
+	return out, headers, nil
+}
+
+// shardBodies is fromShards with the bodies as they came.
+func (up *upstreams) shardBodies(ctx context.Context, path string) (bodies [][]byte, headers []http.Header, err error) {
+	bodies, headers = make([][]byte, len(up.shards)), make([]http.Header, len(up.shards))
+	errs := make([]error, len(up.shards))
+	var wg sync.WaitGroup
+	for i, p := range up.shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := up.httpGet(ctx, 0, p.url()+path)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+				errs[i] = &statusError{Code: resp.StatusCode, Body: strings.TrimSpace(string(b))}
+				return
+			}
+			headers[i] = resp.Header
+			bodies[i], errs[i] = io.ReadAll(resp.Body)
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		var se *statusError
+		if errors.As(err, &se) || len(errs) == 1 {
+			return nil, nil, err // relayed as the naming service's own answer
+		}
+		return nil, nil, fmt.Errorf("shard %d: %w", i, err)
+	}
+	return bodies, headers, nil
+}
+
+// listFiles is every shard's /list-files as one JSON list, with the ETag
+// and catalog revision for it: the shards' revisions joined, and summed.
+func (c cfg) listFiles(ctx context.Context) (body []byte, etag, revision string, err error) {
+	lists, headers, err := fromShards[[]json.RawMessage](ctx, c.upstreams, "/list-files")
+	if err != nil {
+		return nil, "", "", err
+	}
+	files := []json.RawMessage{}
+	var sum uint64
+	revs := make([]string, len(lists))
+	for i, l := range lists {
+		files = append(files, l...)
+		revs[i] = headers[i].Get(catalogRevisionHeader)
+		n, _ := strconv.ParseUint(revs[i], 10, 64)
+		sum += n
+	}
+	body, err = json.Marshal(files)
+	return body, `"` + strings.Join(revs, ".") + `"`, strconv.FormatUint(sum, 10), err
+}
+
+// clusterMetrics is /metrics for the whole cluster and its catalog
+// revision. With shards, the file figures are summed and the node and
+// storage ones, every shard's view of the same nodes, are shard 0's;
+// "shards" has each shard's own file count and revision.
+func (c cfg) clusterMetrics(ctx context.Context) (json.RawMessage, string, error) {
+	all, headers, err := fromShards[map[string]any](ctx, c.upstreams, "/metrics")
+	if err != nil {
+		return nil, "", err
+	}
+	m := all[0]
+	if len(all) > 1 {
+		m = mergeMetrics(all)
+	}
+	b, err := json.Marshal(m)
+	revision := headers[0].Get(catalogRevisionHeader)
+	if len(all) > 1 {
+		revision = strconv.FormatFloat(m["catalogRevision"].(float64), 'f', 0, 64)
+	}
+	return b, revision, err
+}
+
+// mergeMetrics folds the shards' /metrics into shard 0's.
+func mergeMetrics(all []map[string]any) map[string]any {
+	num := func(m map[string]any, key string) float64 {
+		f, _ := m[key].(float64)
+		return f
+	}
+	sub := func(m map[string]any, key string) map[string]any {
+		s, _ := m[key].(map[string]any)
+		if s == nil {
+			s = map[string]any{}
+		}
+		return s
+	}
+	out := maps.Clone(all[0])
+	byState, placement := map[string]any{}, maps.Clone(sub(all[0], "placement"))
+	var revision, files, logical, stored, byWebhook, fallbacks float64
+	shards := make([]map[string]any, len(all))
+	for i, m := range all {
+		revision += num(m, "catalogRevision")
+		files += num(m, "totalFiles")
+		logical += num(m, "totalSizeBytes")
+		stored += num(m, "totalStoredBytes")
+		for state, n := range sub(m, "filesByState") {
+			f, _ := n.(float64)
+			prev, _ := byState[state].(float64)
+			byState[state] = prev + f
+		}
+		byWebhook += num(sub(m, "placement"), "byWebhook")
+		fallbacks += num(sub(m, "placement"), "fallbacks")
+		shards[i] = map[string]any{"shard": i, "totalFiles": m["totalFiles"], "catalogRevision": m["catalogRevision"]}
+	}
+	ratio := 0.0
+	if logical > 0 {
+		ratio = (logical - stored) / logical
+	}
+	placement["byWebhook"], placement["fallbacks"] = byWebhook, fallbacks
+	out["catalogRevision"], out["totalFiles"] = revision, files
+	out["totalSizeBytes"], out["totalStoredBytes"] = logical, stored
+	out["compression"] = map[string]any{"logicalBytes": logical, "storedBytes": stored, "savedBytes": logical - stored, "savingsRatio": ratio}
+	out["filesByState"], out["placement"] = byState, placement
+	out["shards"] = shards
+	delete(out, "shard")
+	return out
+}
+
+// toShards makes an admin change on shard 0 and, once it has taken it, on
+// every other shard, so node maintenance and settings agree across the
+// catalogs. Shard 0's answer is relayed unless another shard failed, which
+// gives 502 with the shards that did not take the change.
+func (c cfg) toShards(w http.ResponseWriter, r *http.Request, method, path, what string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "cannot read body")
+		return
+	}
+	send := func(base string) (*http.Response, error) {
+		req, _ := http.NewRequestWithContext(r.Context(), method, base+path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+c.AdminToken)
+		req.Header.Set(actorHeader, callerOf(r))
+		return c.httpClient(0).Do(req)
+	}
+	resp, err := send(c.shards[0].url())
+	if err != nil {
+		writeUpstreamError(w, what, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		relay(w, resp)
+		return
+	}
+	failed := map[string]string{}
+	for i, p := range c.shards[1:] {
+		sr, err := send(p.url())
+		if err == nil {
+			if sr.StatusCode/100 != 2 {
+				b, _ := io.ReadAll(io.LimitReader(sr.Body, 64<<10))
+				err = &statusError{Code: sr.StatusCode, Body: strings.TrimSpace(string(b))}
+			}
+			sr.Body.Close()
+		}
+		if err != nil {
+			failed[strconv.Itoa(i+1)] = err.Error()
+		}
+	}
+	if len(failed) > 0 {
+		writeErrorDetail(w, http.StatusBadGateway, codeUpstreamError, what+" on some shards", failed)
+		return
+	}
+	relay(w, resp)
+}
+
+// spansShards reports whether a view is gathered from every shard: there
+// are several and ?shard= does not pick one.
+func (c cfg) spansShards(r *http.Request) bool {
+	return len(c.shards) > 1 && !r.URL.Query().Has("shard")
+}
+
+// mergeFunc folds every shard's answer to a view, in shard order, into
+// one; q is the query they were asked with.
+type mergeFunc func(q url.Values, all []json.RawMessage) (any, error)
+
+// gather asks every shard for path?q and merges the answers.
+func (c cfg) gather(ctx context.Context, path string, q url.Values, merge mergeFunc) (any, error) {
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	all, _, err := fromShards[json.RawMessage](ctx, c.upstreams, path)
+	if err != nil {
+		return nil, err
+	}
+	return merge(q, all)
+}
+
+// writeGathered answers with path gathered from every shard.
+func (c cfg) writeGathered(w http.ResponseWriter, r *http.Request, path string, q url.Values, merge mergeFunc, what string) {
+	v, err := c.gather(r.Context(), path, q, merge)
+	if err != nil {
+		writeUpstreamError(w, what, err)
+		return
+	}
+	writeJSON(w, v)
+}
+
+// byTime joins lists of JSON objects and orders them by the time in their
+// key field, newest first with desc; items with equal times keep their
+// shard order.
+func byTime(lists [][]json.RawMessage, key string, desc bool) []json.RawMessage {
+	type item struct {
+		raw json.RawMessage
+		at  time.Time
+	}
+	var items []item
+	for _, l := range lists {
+		for _, raw := range l {
+			var fields map[string]json.RawMessage
+			var at time.Time
+			if json.Unmarshal(raw, &fields) == nil {
+				_ = json.Unmarshal(fields[key], &at)
+			}
+			items = append(items, item{raw, at})
+		}
+	}
+	slices.SortStableFunc(items, func(a, b item) int {
+		if desc {
+			return b.at.Compare(a.at)
+		}
+		return a.at.Compare(b.at)
+	})
+	out := make([]json.RawMessage, len(items))
+	for i, it := range items {
+		out[i] = it.raw
+	}
+	return out
+}
+
+// listOf merges answers that are a JSON list ordered by the time in key.
+func listOf(key string, desc bool) mergeFunc {
+	return func(_ url.Values, all []json.RawMessage) (any, error) {
+		lists := make([][]json.RawMessage, len(all))
+		for i, raw := range all {
+			if err := json.Unmarshal(raw, &lists[i]); err != nil {
+				return nil, err
+			}
+		}
+		return byTime(lists, key, desc), nil
+	}
+}
+
+// fieldOf merges answers that hold their list in field, such as
+// {"conflicts": [...]}, ordered oldest first by the time in key.
+func fieldOf(field, key string) mergeFunc {
+	return func(_ url.Values, all []json.RawMessage) (any, error) {
+		lists := make([][]json.RawMessage, len(all))
+		for i, raw := range all {
+			var body map[string][]json.RawMessage
+			if err := json.Unmarshal(raw, &body); err != nil {
+				return nil, err
+			}
+			lists[i] = body[field]
+		}
+		return map[string]any{field: byTime(lists, key, false)}, nil
+	}
+}
+
+// quotaStatus is one owner's entry in the naming service's /quota.
+type quotaStatus struct {
+	Owner     string `json:"owner"`
+	MaxBytes  int64  `json:"maxBytes"`
+	MaxFiles  int64  `json:"maxFiles"`
+	UsedBytes int64  `json:"usedBytes"`
+	UsedFiles int64  `json:"usedFiles"`
+	Default   bool   `json:"default,omitempty"`
+}
+
+// mergeQuotas adds up each owner's usage on every shard; the limits are
+// those of the shard the owner's uploads go to.
+func mergeQuotas(q url.Values, all []json.RawMessage) (any, error) {
+	byOwner := map[string]*quotaStatus{}
+	for i, raw := range all {
+		var list []quotaStatus
+		if q.Has("owner") {
+			list = make([]quotaStatus, 1)
+			if err := json.Unmarshal(raw, &list[0]); err != nil {
+				return nil, err
+			}
+		} else {
+			var body struct {
+				Quotas []quotaStatus `json:"quotas"`
+			}
+			if err := json.Unmarshal(raw, &body); err != nil {
+				return nil, err
+			}
+			list = body.Quotas
+		}
+		for _, st := range list {
+			m := byOwner[st.Owner]
+			if m == nil || i == shardOf(st.Owner, len(all)) {
+				used := st
+				if m != nil {
+					used.UsedBytes += m.UsedBytes
+					used.UsedFiles += m.UsedFiles
+				}
+				byOwner[st.Owner] = &used
+				continue
+			}
+			m.UsedBytes += st.UsedBytes
+			m.UsedFiles += st.UsedFiles
+		}
+	}
+	if q.Has("owner") {
+		return byOwner[q.Get("owner")], nil
+	}
+	out := make([]quotaStatus, 0, len(byOwner))
+	for _, st := range byOwner {
+		out = append(out, *st)
+	}
+	slices.SortFunc(out, func(a, b quotaStatus) int { return cmp.Compare(a.Owner, b.Owner) })
+	return map[string]any{"quotas": out}, nil
+}
+
+// mergeHealQueues joins the shards' heal queues: their workers and counts
+// added up, pending and recent jobs one after the other.
+func mergeHealQueues(_ url.Values, all []json.RawMessage) (any, error) {
+	out := map[string]any{}
+	var workers int
+	counts := map[string]int{}
+	pending, recent := []json.RawMessage{}, []json.RawMessage{}
+	for i, raw := range all {
+		var q struct {
+			Workers     int               `json:"workers"`
+			MaxAttempts int               `json:"maxAttempts"`
+			Counts      map[string]int    `json:"counts"`
+			Pending     []json.RawMessage `json:"pending"`
+			Recent      []json.RawMessage `json:"recent"`
+		}
+		if err := json.Unmarshal(raw, &q); err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			out["maxAttempts"] = q.MaxAttempts
+		}
+		workers += q.Workers
+		for state, n := range q.Counts {
+			counts[state] += n
+		}
+		pending = append(pending, q.Pending...)
+		recent = append(recent, q.Recent...)
+	}
+	out["workers"], out["counts"], out["pending"], out["recent"] = workers, counts, pending, recent
+	return out, nil
+}
+
+// fileAccess is one file in the naming service's /popular.
+type fileAccess struct {
+	FileID      string  `json:"fileId"`
+	Filename    string  `json:"filename,omitempty"`
+	Downloads   int64   `json:"downloads"`
+	Bytes       int64   `json:"bytes"`
+	BytesPerSec float64 `json:"bytesPerSec"`
+}
+
+// mergePopular ranks every shard's most read files together and keeps
+// ?limit= of them, 10 by default, as each shard does.
+func mergePopular(q url.Values, all []json.RawMessage) (any, error) {
+	var window, by string
+	files := []fileAccess{}
+	for _, raw := range all {
+		var p struct {
+			Window string       `json:"window"`
+			By     string       `json:"by"`
+			Files  []fileAccess `json:"files"`
+		}
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return nil, err
+		}
+		window, by = p.Window, p.By
+		files = append(files, p.Files...)
+	}
+	slices.SortStableFunc(files, func(a, b fileAccess) int {
+		if by == "bytes" {
+			return cmp.Compare(b.Bytes, a.Bytes)
+		}
+		return cmp.Compare(b.Downloads, a.Downloads)
+	})
+	limit := 10
+	if n, err := strconv.Atoi(q.Get("limit")); err == nil && n > 0 {
+		limit = n
+	}
+	if len(files) > limit {
+		files = files[:limit]
+	}
+	return map[string]any{"window": window, "by": by, "files": files}, nil
+}
+
+// integrityOrder is the naming service's integrity report order: most
+// problems first, then by fileId.
+func integrityOrder(aProblems, bProblems int, aID, bID string) int {
+	return cmp.Or(cmp.Compare(bProblems, aProblems), cmp.Compare(aID, bID))
+}
+
+// mergeIntegrity joins the shards' integrity reports, adding up their
+// file counts.
+func mergeIntegrity(_ url.Values, all []json.RawMessage) (any, error) {
+	type row struct {
+		raw      json.RawMessage
+		fileID   string
+		problems int
+	}
+	var staleAfter string
+	var files, withProblems int
+	var rows []row
+	for _, raw := range all {
+		var rep struct {
+			StaleAfter   string            `json:"staleAfter"`
+			Files        int               `json:"files"`
+			WithProblems int               `json:"withProblems"`
+			Rows         []json.RawMessage `json:"rows"`
+		}
+		if err := json.Unmarshal(raw, &rep); err != nil {
+			return nil, err
+		}
+		staleAfter = rep.StaleAfter
+		files += rep.Files
+		withProblems += rep.WithProblems
+		for _, r := range rep.Rows {
+			var id struct {
+				FileID   string   `json:"fileId"`
+				Problems []string `json:"problems"`
+			}
+			_ = json.Unmarshal(r, &id)
+			rows = append(rows, row{r, id.FileID, len(id.Problems)})
+		}
+	}
+	slices.SortFunc(rows, func(a, b row) int { return integrityOrder(a.problems, b.problems, a.fileID, b.fileID) })
+	out := make([]json.RawMessage, len(rows))
+	for i, r := range rows {
+		out[i] = r.raw
+	}
+	return map[string]any{
+		"generatedAt":  time.Now().UTC(),
+		"staleAfter":   staleAfter,
+		"files":        files,
+		"withProblems": withProblems,
+		"rows":         out,
+	}, nil
+}
+
+// writeIntegrityCSV answers with every shard's CSV integrity report as
+// one: the first header, then all the rows in report order.
+func (c cfg) writeIntegrityCSV(w http.ResponseWriter, r *http.Request) {
+	bodies, _, err := c.shardBodies(r.Context(), "/integrity-report?"+r.URL.RawQuery)
+	if err != nil {
+		writeUpstreamError(w, "failed to get integrity report", err)
+		return
+	}
+	var header []string
+	var rows [][]string
+	for i, b := range bodies {
+		records, err := csv.NewReader(bytes.NewReader(b)).ReadAll()
+		if err != nil {
+			writeErrorDetail(w, http.StatusBadGateway, codeUpstreamError, "bad integrity report", fmt.Sprintf("shard %d: %v", i, err))
+			return
+		}
+		if len(records) == 0 {
+			continue
+		}
+		header = records[0]
+		rows = append(rows, records[1:]...)
+	}
+	problems := func(rec []string) int {
+		if p := rec[len(rec)-1]; p != "" {
+			return strings.Count(p, "; ") + 1
+		}
+		return 0
+	}
+	slices.SortFunc(rows, func(a, b []string) int { return integrityOrder(problems(a), problems(b), a[0], b[0]) })
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="integrity-report.csv"`)
+	cw := csv.NewWriter(w)
+	if header != nil {
+		_ = cw.Write(header)
+	}
+	_ = cw.WriteAll(rows)
+}
+
+/* ---------------- API: LOOKUP & DOWNLOAD ---------------- */
+
+// degradedReadHeader is set by the naming service when a file is served
+// while DEGRADED or PARTIAL under the lenient read policy.
+const degradedReadHeader = "X-Degraded-Read"
+
+// lookupReplica is one replica in an /api/lookup answer.
+type lookupReplica struct {
+	NodeId string `json:"nodeId"`
+	Url    string `json:"url"`
+}
+
+func (c cfg) handleLookup(w http.ResponseWriter, r *http.Request) {
+	fid := r.URL.Query().Get("fileId")
+	if fid == "" {
+		writeError(w, http.StatusBadRequest, codeMissingParameter, "missing fileId")
+		return
+	}
+	if !c.authorize(w, r, fid, "read") {
+		return
+	}
+
+	// panggil naming
+	resp, err := c.httpGet(r.Context(), 0, c.namingFor(fid)+"/lookup/"+fid)
+	if err != nil {
+		writeUpstreamError(w, "lookup error", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	// baca body
+	b, _ := io.ReadAll(resp.Body)
+	// bentuk aslinya pakai "NodeID"/"URL"
+	type in struct {
+		NodeID string `json:"NodeID"`
+		URL    string `json:"URL"`
+	}
+	var arr []in
+	_ = json.Unmarshal(b, &arr)
+
+	// normalisasi jadi "nodeId"/"url"
+	outArr := make([]lookupReplica, 0, len(arr))
+	for _, v := range arr {
+		outArr = append(outArr, lookupReplica{NodeId: v.NodeID, Url: v.URL})
+	}
+
+	if v := resp.Header.Get(degradedReadHeader); v != "" {
+		w.Header().Set(degradedReadHeader, v)
+	}
+	if resp.StatusCode/100 != 2 {
+		relayError(w, resp.StatusCode, b)
+		return
+	}
+	writeJSON(w, outArr)
+}
+
+func (c cfg) handleProxyDownload(w http.ResponseWriter, r *http.Request) {
+	fid := r.URL.Query().Get("fileId")
+	nodeURL := r.URL.Query().Get("nodeUrl")
+	if fid == "" || nodeURL == "" {
+		writeError(w, http.StatusBadRequest, codeMissingParameter, "missing fileId or nodeUrl")
+		return
+	}
+	if !c.authorize(w, r, fid, "read") {
+		return
+	}
+	// the naming service owns the degraded-read policy; ask it before serving
+	lr, err := c.httpGet(r.Context(), 0, c.namingFor(fid)+"/lookup/"+fid)
+	if err != nil {
+		writeUpstreamError(w, "lookup error", err)
+		return
+	}
+	defer lr.Body.Close()
+	if lr.StatusCode == http.StatusServiceUnavailable || lr.StatusCode == http.StatusConflict {
+		// refused by read policy or quarantine; relay naming's reason
+		b, _ := io.ReadAll(io.LimitReader(lr.Body, 64<<10))
+		relayError(w, lr.StatusCode, b)
+		return
+	}
+	if v := lr.Header.Get(degradedReadHeader); v != "" {
+		w.Header().Set(degradedReadHeader, v)
+	}
+	etag := ""
+	sum := lr.Header.Get("X-File-Checksum")
+	if sum != "" {
+		etag = `"` + sum + `"`
+		if etagMatch(r.Header.Get("If-None-Match"), etag) {
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Cache-Control", "no-cache")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	inline := r.URL.Query().Get("inline") == "1"
+	asked := r.URL.Query().Get("trailer") == "checksum" && r.Method == http.MethodGet && r.Header.Get("Range") == ""
+	if c.cache != nil && sum != "" {
+		if body, ok := c.cache.get(fid, sum); ok {
+			defer body.Close()
+			describeDownload(w.Header(), lr.Header, etag, inline)
+			w.Header().Set("X-Cache", "HIT")
+			if !asked {
+				http.ServeContent(w, r, "", time.Time{}, body)
+				return
+			}
+			// cached copies were checked against sum when they were kept
+			w.Header().Set("Trailer", checksumTrailer)
+			http.ServeContent(chunkedWriter{w}, r, "", time.Time{}, body)
+			w.Header().Set(checksumTrailer, sum)
+			return
+		}
+		w.Header().Set("X-Cache", "MISS")
+	}
+	replicas, healthy := lookupNodes(lr, nodeURL)
+	if r.URL.Query().Get("verify") == "true" && sum != "" {
+		c.serveVerified(w, r, lr, fid, replicas, sum, etag, inline)
+		return
+	}
+	if c.ParallelMinBytes > 0 && len(healthy) > 1 && sum != "" && r.Method == http.MethodGet && r.Header.Get("Range") == "" {
+		size, err := strconv.ParseInt(lr.Header.Get("X-File-Size"), 10, 64)
+		if err == nil && size >= c.ParallelMinBytes && c.serveParallel(w, r, lr, fid, healthy, size, sum, etag, inline, asked) {
+			return
+		}
+	}
+
+	// with hedging on, the other replicas back up the one the client chose
+	nodes := []string{nodeURL}
+	if c.HedgeAfter > 0 {
+		nodes = replicas
+	}
+	trailer := asked || c.VerifyDownloads
+	urls := make([]string, len(nodes))
+	for i, n := range nodes {
+		urls[i] = strings.TrimRight(n, "/") + "/download/" + fid
+		if trailer {
+			urls[i] += "?trailer=checksum"
+		}
+	}
+	resp, served, err := c.nodeCalls.hedgedGet(r.Context(), c.httpClient(0), urls, c.HedgeAfter, func(i int, resp *http.Response, err error) {
+		c.reportFailedDownload(r, nodes[i], fid, resp, err)
+	})
+	if err != nil {
+		writeErrorDetail(w, http.StatusBadGateway, codeUpstreamError, "download failed", err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		relayError(w, resp.StatusCode, b)
+		return
+	}
+
+	// pass through headers, except the node's request ID
+	for k, vv := range resp.Header {
+		if k == requestIDHeader {
+			continue
+		}
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent {
+		describeDownload(w.Header(), lr.Header, etag, inline)
+	}
+	w.WriteHeader(resp.StatusCode)
+	if c.cache == nil || sum == "" || resp.StatusCode != http.StatusOK || resp.ContentLength > c.cache.maxFile {
+		_, err = io.Copy(w, resp.Body)
+	} else {
+		// keep small files for the next request, but only a complete copy
+		// that hashes to the catalog checksum
+		capture := &cacheCapture{limit: c.cache.maxFile}
+		h := sha256.New()
+		if _, err = io.Copy(w, io.TeeReader(resp.Body, io.MultiWriter(capture, h))); err == nil && !capture.over &&
+			"sha256:"+hex.EncodeToString(h.Sum(nil)) == sum {
+			c.cache.put(fid, sum, capture.buf.Bytes())
+		}
+	}
+	if err != nil || !trailer || resp.StatusCode != http.StatusOK {
+		return
+	}
+	got := resp.Trailer.Get(checksumTrailer)
+	if got != "" && sum != "" && got != sum {
+		// the body is already on the wire; cut the connection so the
+		// client sees a failed download, not a wrong file
+		log.Printf("download %s from %s: node sent %s, catalog has %s", fid, nodes[served], got, sum)
+		go c.reportBadDownload(r, nodes[served], fid, fmt.Sprintf("sent %s, catalog has %s", got, sum))
+		panic(http.ErrAbortHandler)
+	}
+	if got != "" {
+		w.Header().Set(checksumTrailer, got)
+	}
+}
+
+// lookupNodes decodes a lookup's replica list into node URLs: all of them,
+// nodeURL first, and those on healthy nodes. A naming service that does not
+// say how many are healthy has them all counted.
+func lookupNodes(lookup *http.Response, nodeURL string) (nodes, healthy []string) {
+	var reps []struct{ NodeID, URL string }
+	_ = json.NewDecoder(lookup.Body).Decode(&reps)
+	n, err := strconv.Atoi(lookup.Header.Get("X-Healthy-Replicas"))
+	if err != nil {
+		n = len(reps)
+	}
+	nodes = []string{nodeURL}
+	for i, rep := range reps {
+		if i < n {
+			healthy = append(healthy, rep.URL)
+		}
+		if strings.TrimRight(rep.URL, "/") != strings.TrimRight(nodeURL, "/") {
+			nodes = append(nodes, rep.URL)
+		}
+	}
+	return nodes, healthy
+}
+
+// serveVerified answers ?verify=true. Each replica in turn, starting with
+// the one the client chose, is spooled to a temp file and hashed; the first
+// copy that matches the catalog checksum is served, so nothing reaches the
+// client before it has been checked. A replica that sends other bytes is
+// reported like a bad trailer. When no replica has a good copy the client
+// gets 502 CHECKSUM_MISMATCH (UPSTREAM_ERROR if none could be read at all).
+func (c cfg) serveVerified(w http.ResponseWriter, r *http.Request, lookup *http.Response, fid string, nodes []string, sum, etag string, inline bool) {
+	spool, err := os.CreateTemp("", "verify-*.tmp")
+	if err != nil {
+		writeErrorDetail(w, http.StatusInternalServerError, codeInternal, "cannot spool download", err.Error())
+		return
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	failures := map[string]string{}
+	mismatch := false
+	for _, node := range nodes {
+		got, err := c.spoolReplica(r, node, fid, spool)
+		if err != nil {
+			failures[node] = err.Error()
+			continue
+		}
+		if got != sum {
+			log.Printf("verified download %s from %s: node sent %s, catalog has %s", fid, node, got, sum)
+			go c.reportBadDownload(r, node, fid, fmt.Sprintf("sent %s, catalog has %s", got, sum))
+			failures[node] = "checksum " + got
+			mismatch = true
+			continue
+		}
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			writeErrorDetail(w, http.StatusInternalServerError, codeInternal, "cannot spool download", err.Error())
+			return
+		}
+		describeDownload(w.Header(), lookup.Header, etag, inline)
+		w.Header().Set("X-Verified-From", node)
+		http.ServeContent(w, r, "", time.Time{}, spool)
+		return
+	}
+	if mismatch {
+		writeErrorDetail(w, http.StatusBadGateway, codeChecksumMismatch, "no replica matches the catalog checksum", failures)
+		return
+	}
+	writeErrorDetail(w, http.StatusBadGateway, codeUpstreamError, "download failed", failures)
+}
+
+// spoolReplica replaces spool's contents with the whole file from node and
+// returns its checksum.
+func (c cfg) spoolReplica(r *http.Request, node, fid string, spool *os.File) (string, error) {
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	if err := spool.Truncate(0); err != nil {
+		return "", err
+	}
+	resp, _, err := c.nodeCalls.hedgedGet(r.Context(), c.httpClient(0), []string{strings.TrimRight(node, "/") + "/download/" + fid}, 0,
+		func(_ int, resp *http.Response, err error) { c.reportFailedDownload(r, node, fid, resp, err) })
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("node answered %d", resp.StatusCode)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(spool, h), resp.Body); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// serveParallel assembles a large download from byte ranges fetched from
+// several replicas at once, for when one node's uplink is the bottleneck.
+// The file is cut into ParallelChunk-sized chunks that the nodes take in
+// turn; a chunk that fails is retried on the next node, and at most two
+// chunks per node wait in memory ahead of the one being written. Every
+// range is asked for with If-Range on the catalog checksum, so a node
+// holding another version answers 200 and is not stitched in. The stream
+// is hashed as it goes out and cut if it does not add up to sum.
+//
+// It returns false, having written nothing, when the first chunk cannot be
+// had from any node; blobs compressed at rest, for one, have no ranges. The
+// caller then downloads the usual way.
+func (c cfg) serveParallel(w http.ResponseWriter, r *http.Request, lookup *http.Response, fid string, nodes []string, size int64, sum, etag string, inline, trailer bool) bool {
+	chunk := c.ParallelChunk
+	count := int((size + chunk - 1) / chunk)
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	type part struct {
+		b   []byte
+		err error
+	}
+	parts := make([]chan part, count)
+	for i := range parts {
+		parts[i] = make(chan part, 1)
+	}
+	window := make(chan struct{}, 2*len(nodes))
+	next := make(chan int)
+	go func() {
+		defer close(next)
+		for i := 0; i < count; i++ {
+			select {
+			case window <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case next <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for k := range nodes {
+		go func() {
+			for i := range next {
+				off := int64(i) * chunk
+				var p part
+				for try := range nodes {
+					p.b, p.err = c.fetchRange(ctx, r, nodes[(k+try)%len(nodes)], fid, sum, off, min(chunk, size-off))
+					if p.err == nil || ctx.Err() != nil {
+						break
+					}
+				}
+				parts[i] <- p
+			}
+		}()
+	}
+
+	p := <-parts[0]
+	if p.err != nil {
+		log.Printf("parallel download %s: %v; falling back to one node", fid, p.err)
+		return false
+	}
+	describeDownload(w.Header(), lookup.Header, etag, inline)
+	w.Header().Set("X-Parallel-Download", strconv.Itoa(len(nodes)))
+	var out http.ResponseWriter = w
+	if trailer {
+		w.Header().Set("Trailer", checksumTrailer)
+		out = chunkedWriter{w}
+	} else {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	out.WriteHeader(http.StatusOK)
+	h := sha256.New()
+	for i := 0; ; {
+		h.Write(p.b)
+		if _, err := out.Write(p.b); err != nil {
+			return true // the client left
+		}
+		<-window
+		if i++; i == count {
+			break
+		}
+		if p = <-parts[i]; p.err != nil {
+			// part of the file is already on the wire
+			log.Printf("parallel download %s: chunk %d: %v", fid, i, p.err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+	if got := "sha256:" + hex.EncodeToString(h.Sum(nil)); got != sum {
+		log.Printf("parallel download %s: assembled %s, catalog has %s", fid, got, sum)
+		panic(http.ErrAbortHandler)
+	}
+	if trailer {
+		w.Header().Set(checksumTrailer, sum)
+	}
+	return true
+}
+
+// fetchRange reads n bytes of fid at off from node, provided the node's copy
+// is still the one whose checksum is sum.
+func (c cfg) fetchRange(ctx context.Context, r *http.Request, node, fid, sum string, off, n int64) ([]byte, error) {
+	resp, err := c.nodeCalls.do(c.httpClient(0), true, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(node, "/")+"/download/"+fid, nil)
+		if err == nil {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+n-1))
+			req.Header.Set("If-Range", `"`+sum+`"`)
+		}
+		return req, err
+	})
+	if err != nil {
+		c.reportFailedDownload(r, node, fid, nil, err)
+		return nil, fmt.Errorf("%s: %w", node, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		c.reportFailedDownload(r, node, fid, resp, nil)
+		return nil, fmt.Errorf("%s: answered %d to a range request", node, resp.StatusCode)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(resp.Body, b); err != nil {
+		return nil, fmt.Errorf("%s: %w", node, err)
+	}
+	return b, nil
+}
+
+// checksumTrailer is the trailer a node sends with ?trailer=checksum: the
+// checksum of the body it wrote.
+const checksumTrailer = "X-Content-Checksum"
+
+// chunkedWriter drops Content-Length as the header is written, since Go
+// leaves out the trailers of a response that has one.
+type chunkedWriter struct{ http.ResponseWriter }
+
+func (cw chunkedWriter) WriteHeader(code int) {
+	cw.Header().Del("Content-Length")
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+// reportBadDownload reports a replica whose checksum trailer did not match
+// the catalog and has the naming service verify the file's replicas, which
+// marks the bad copy for healing. The report is made even if the client
+// has gone.
+func (c cfg) reportBadDownload(r *http.Request, nodeURL, fid, detail string) {
+	ctx := context.WithoutCancel(r.Context())
+	body := map[string]string{"nodeUrl": nodeURL, "fileId": fid, "kind": "checksum-mismatch", "detail": detail, "reporter": "ui-gateway for " + callerOf(r)}
+	if _, err := postJSON[map[string]any](ctx, c.upstreams, c.namingFor(fid)+"/report-incident", body); err != nil {
+		log.Printf("report incident for %s: %v", nodeURL, err)
+	}
+	resp, err := c.httpGet(ctx, time.Minute, c.namingFor(fid)+"/verify-file?fileId="+url.QueryEscape(fid))
+	if err != nil {
+		log.Printf("verify %s: %v", fid, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// describeDownload replaces the node's view of a blob (named after its
+// fileId, content type sniffed) with the file's catalog entry from the
+// naming service's lookup headers.
+func describeDownload(h, lookup http.Header, etag string, inline bool) {
+	if name, err := url.PathUnescape(lookup.Get("X-File-Name")); err == nil && name != "" {
+		disposition := "attachment"
+		if inline {
+			disposition = "inline"
+		}
+		h.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": name}))
+	}
+	if ct := lookup.Get("X-File-Content-Type"); ct != "" {
+		h.Set("Content-Type", ct)
+	}
+	if etag != "" {
+		// a fileId keeps its name across overwrites, so caches must
+		// revalidate; the checksum ETag makes that a cheap 304
+		h.Set("ETag", etag)
+		h.Set("Cache-Control", "no-cache")
+	}
+	if lm := lookup.Get("X-File-Updated"); lm != "" {
+		h.Set("Last-Modified", lm)
+	}
+}
+
+// etagMatch reports whether an If-None-Match header value matches etag,
+// comparing weakly as RFC 9110 asks for GET.
+func etagMatch(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// reportFailedDownload reports a download that failed outright, came back
+// 404 or hit a server error; other statuses are the client's business.
+func (c cfg) reportFailedDownload(r *http.Request, nodeURL, fid string, resp *http.Response, err error) {
+	switch {
+	case err != nil && errors.Is(err, errCircuitOpen), r.Context().Err() != nil:
+		// already reported while the circuit was tripping, or the client left
+	case err != nil:
+		go c.reportIncident(r, nodeURL, fid, err.Error())
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode >= 500:
+		go c.reportIncident(r, nodeURL, fid, fmt.Sprintf("status %d", resp.StatusCode))
+	}
+}
+
+// reportIncident tells the naming service a download from nodeURL failed,
+// so /node-health can show it. A 404 is reported as a missing replica.
+func (c cfg) reportIncident(r *http.Request, nodeURL, fid, detail string) {
+	body := map[string]string{"nodeUrl": nodeURL, "fileId": fid, "reporter": "ui-gateway for " + callerOf(r)}
+	endpoint := "/report-incident"
+	if detail == "status 404" {
+		endpoint = "/report-missing"
+	} else {
+		body["kind"], body["detail"] = "download-failed", detail
+	}
+	if _, err := postJSON[map[string]any](context.WithoutCancel(r.Context()), c.upstreams, c.namingFor(fid)+endpoint, body); err != nil {
+		log.Printf("report incident for %s: %v", nodeURL, err)
+	}
+}
+
+/* ---------------- API: ARCHIVE DOWNLOAD ---------------- */
+
+// archiveFile is a catalog entry picked for an archive download.
+type archiveFile struct {
+	FileID   string `json:"fileId"`
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+
+	Owner string     `json:"owner"`
+	ACL   []aclEntry `json:"acl"`
+}
+
+// archiveErrorsEntry lists the files an archive had to leave out.
+const archiveErrorsEntry = "_archive-errors.txt"
+
+// handleDownloadArchive streams the files named by ?fileIds=a,b,c, or every
+// file under ?path=docs/, as one zip (default) or tar built on the fly.
+// Each file is copied straight from a replica into the archive, so nothing
+// is held in memory beyond the copy buffer. A file no replica can serve is
+// left out and named in _archive-errors.txt at the end; a replica whose
+// bytes do not match the catalog checksum aborts the whole response rather
+// than hand out a silently corrupt archive.
+func (c cfg) handleDownloadArchive(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = "zip"
+	}
+	if format != "zip" && format != "tar" {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "format must be zip or tar")
+		return
+	}
+	ids, prefix := q.Get("fileIds"), q.Get("path")
+	if (ids == "") == (prefix == "") {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "give exactly one of fileIds or path")
+		return
+	}
+	list, _, _, err := c.listFiles(r.Context())
+	if err != nil {
+		writeErrorDetail(w, http.StatusBadGateway, codeUpstreamError, "list files error", err.Error())
+		return
+	}
+	var catalog []archiveFile
+	if err := json.Unmarshal(list, &catalog); err != nil {
+		writeErrorDetail(w, http.StatusBadGateway, codeUpstreamError, "list files error", err.Error())
+		return
+	}
+	files, err := pickArchiveFiles(catalog, ids, prefix)
+	if err != nil {
+		writeError(w, http.StatusNotFound, codeFileNotFound, err.Error())
+		return
+	}
+
+	name := q.Get("name")
+	if name == "" {
+		name = "files"
+		if prefix != "" {
+			name = path.Base(strings.TrimSuffix(prefix, "/"))
+		}
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + "." + format}))
+	var aw archiveWriter
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		aw = zipArchive{zip.NewWriter(w)}
+	} else {
+		w.Header().Set("Content-Type", "application/x-tar")
+		aw = tarArchive{tar.NewWriter(w)}
+	}
+
+	var skipped []string
+	used := map[string]bool{}
+	caller := principalOf(r)
+	for _, f := range files {
+		entry := archiveEntryName(f, used)
+		if !caller.may(fileACL{FileID: f.FileID, Owner: f.Owner, ACL: f.ACL}, "read") {
+			skipped = append(skipped, fmt.Sprintf("%s (%s): permission denied", entry, f.FileID))
+			continue
+		}
+		body, modified, sum, err := c.openReplica(r, f.FileID)
+		if err != nil {
+			skipped = append(skipped, fmt.Sprintf("%s (%s): %v", entry, f.FileID, err))
+			continue
+		}
+		h := sha256.New()
+		dst, err := aw.create(entry, f.Size, modified)
+		if err == nil {
+			_, err = io.Copy(io.MultiWriter(dst, h), body)
+		}
+		body.Close()
+		if err == nil && sum != "" && "sha256:"+hex.EncodeToString(h.Sum(nil)) != sum {
+			err = fmt.Errorf("checksum mismatch")
+		}
+		if err != nil {
+			// part of the entry is already on the wire; cut the connection
+			// so the client sees a broken archive, not a wrong file
+			log.Printf("archive: %s (%s): %v", entry, f.FileID, err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+	if len(skipped) > 0 {
+		report := strings.Join(skipped, "\n") + "\n"
+		if dst, err := aw.create(archiveErrorsEntry, int64(len(report)), time.Now()); err == nil {
+			io.WriteString(dst, report)
+		}
+	}
+	if err := aw.Close(); err != nil {
+		log.Printf("archive: close: %v", err)
+	}
+}
+
+// pickArchiveFiles resolves ?fileIds= (in the order given) or ?path= (every
+// filename below that folder) against the catalog.
+func pickArchiveFiles(catalog []archiveFile, ids, prefix string) ([]archiveFile, error) {
+	if prefix != "" {
+		dir := strings.Trim(prefix, "/") + "/"
+		var out []archiveFile
+		for _, f := range catalog {
+			if strings.HasPrefix(strings.TrimPrefix(f.Filename, "/"), dir) {
+				out = append(out, f)
+			}
+		}
+		if len(out) == 0 {
+			return nil, fmt.Errorf("no files under %q", prefix)
+		}
+		sort.Slice(out, func(i, j int) bool { return out[i].Filename < out[j].Filename })
+		return out, nil
+	}
+	byID := make(map[string]archiveFile, len(catalog))
+	for _, f := range catalog {
+		byID[f.FileID] = f
+	}
+	var out []archiveFile
+	for _, id := range strings.Split(ids, ",") {
+		if id = strings.TrimSpace(id); id == "" {
+			continue
+		}
+		f, ok := byID[id]
+		if !ok {
+			return nil, fmt.Errorf("file %s not found", id)
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
+
+// archiveEntryName makes a filename safe to extract (no absolute paths, no
+// "..") and unique within the archive by tagging repeats with the fileId.
+func archiveEntryName(f archiveFile, used map[string]bool) string {
+	name := strings.TrimPrefix(path.Clean("/"+f.Filename), "/")
+	if name == "" || name == archiveErrorsEntry {
+		name = f.FileID
+	}
+	if used[name] {
+		ext := path.Ext(name)
+		name = strings.TrimSuffix(name, ext) + "~" + f.FileID + ext
+	}
+	used[name] = true
+	return name
+}
+
+// openReplica asks the naming service for fid's replicas, subject to its
+// read policy, and opens the first one that answers 200, hedging across
+// them like /api/download. It also returns
+// the file's modification time and catalog checksum.
+func (c cfg) openReplica(r *http.Request, fid string) (io.ReadCloser, time.Time, string, error) {
+	lr, err := c.httpGet(r.Context(), 0, c.namingFor(fid)+"/lookup/"+fid)
+	if err != nil {
+		return nil, time.Time{}, "", err
+	}
+	defer lr.Body.Close()
+	if lr.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(lr.Body)
+		return nil, time.Time{}, "", fmt.Errorf("lookup: %s", strings.TrimSpace(string(b)))
+	}
+	var reps []struct{ NodeID, URL string }
+	_ = json.NewDecoder(lr.Body).Decode(&reps)
+	modified, _ := http.ParseTime(lr.Header.Get("X-File-Updated"))
+	sum := lr.Header.Get("X-File-Checksum")
+
+	if len(reps) == 0 {
+		return nil, time.Time{}, "", fmt.Errorf("no replicas")
+	}
+	urls := make([]string, len(reps))
+	for i, rep := range reps {
+		urls[i] = strings.TrimRight(rep.URL, "/") + "/download/" + fid
+	}
+	resp, i, err := c.nodeCalls.hedgedGet(r.Context(), c.httpClient(0), urls, c.HedgeAfter, func(i int, resp *http.Response, err error) {
+		c.reportFailedDownload(r, reps[i].URL, fid, resp, err)
+	})
+	if err != nil {
+		return nil, time.Time{}, "", fmt.Errorf("%s: %v", reps[i].NodeID, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, time.Time{}, "", fmt.Errorf("%s: status %d", reps[i].NodeID, resp.StatusCode)
+	}
+	return resp.Body, modified, sum, nil
+}
+
+// archiveWriter is the part of zip.Writer and tar.Writer the archive
+// download needs.
+type archiveWriter interface {
+	create(name string, size int64, modified time.Time) (io.Writer, error)
+	Close() error
+}
+
+type zipArchive struct{ *zip.Writer }
+
+func (z zipArchive) create(name string, size int64, modified time.Time) (io.Writer, error) {
+	return z.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+}
+
+type tarArchive struct{ *tar.Writer }
+
+// create writes a tar header; the size comes from the catalog, so a replica
+// returning a different length makes the copy fail.
+func (t tarArchive) create(name string, size int64, modified time.Time) (io.Writer, error) {
+	err := t.WriteHeader(&tar.Header{Name: name, Size: size, Mode: 0644, ModTime: modified, Typeflag: tar.TypeReg})
+	return t.Writer, err
+}
+
+/* ---------------- DOWNLOAD CACHE ---------------- */
+
+// blobCache is a size-bounded LRU of small downloaded files, kept in memory
+// or, with CACHE_DIR, on disk. Entries are keyed by fileId and checksum, so
+// a new version misses and replaces the old one; deletes and overwrites
+// through the gateway drop the entry right away.
+type blobCache struct {
+	mu      sync.Mutex
+	max     int64 // CACHE_BYTES
+	maxFile int64 // CACHE_MAX_FILE_BYTES
+	dir     string
+	used    int64
+	lru     *list.List               // of *cacheEntry, most recent first
+	byID    map[string]*list.Element // fileId -> element
+
+	hits, misses, evictions int64
+}
+
+type cacheEntry struct {
+	fileID, checksum string
+	size             int64
+	data             []byte // nil in disk mode
+}
+
+func newBlobCache(max, maxFile int64, dir string) *blobCache {
+	return &blobCache{max: max, maxFile: maxFile, dir: dir, lru: list.New(), byID: map[string]*list.Element{}}
+}
+
+func (bc *blobCache) path(fileID string) string {
+	return filepath.Join(bc.dir, fileID+".blob")
+}
+
+// cacheable reports whether a fileId can name a cache file.
+func cacheable(fileID string) bool {
+	return fileID != "" && !strings.ContainsAny(fileID, `/\`) && !strings.Contains(fileID, "..")
+}
+
+// get opens the cached copy of fileID at checksum. An entry for another
+// checksum is a stale version and is dropped.
+func (bc *blobCache) get(fileID, checksum string) (io.ReadSeekCloser, bool) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	el, ok := bc.byID[fileID]
+	if ok && el.Value.(*cacheEntry).checksum != checksum {
+		bc.remove(el)
+		ok = false
+	}
+	if !ok {
+		bc.misses++
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if e.data != nil {
+		bc.lru.MoveToFront(el)
+		bc.hits++
+		return nopSeekCloser{bytes.NewReader(e.data)}, true
+	}
+	f, err := os.Open(bc.path(fileID))
+	if err != nil {
+		bc.remove(el)
+		bc.misses++
+		return nil, false
+	}
+	bc.lru.MoveToFront(el)
+	bc.hits++
+	return f, true
+}
+
+type nopSeekCloser struct{ io.ReadSeeker }
+
+func (nopSeekCloser) Close() error { return nil }
+
+// put stores data as fileID at checksum, evicting the least recently used
+// entries to stay within the size bound.
+func (bc *blobCache) put(fileID, checksum string, data []byte) {
+	size := int64(len(data))
+	if size > bc.maxFile || size > bc.max || !cacheable(fileID) {
+		return
+	}
+	e := &cacheEntry{fileID: fileID, checksum: checksum, size: size}
+	tmp := ""
+	if bc.dir == "" {
+		e.data = data
+	} else {
+		f, err := os.CreateTemp(bc.dir, "put-*.tmp")
+		if err == nil {
+			_, err = f.Write(data)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			tmp = f.Name()
+		}
+		if err != nil {
+			log.Printf("cache: %v", err)
+			if tmp != "" {
+				os.Remove(tmp)
+			}
+			return
+		}
+	}
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	if el, ok := bc.byID[fileID]; ok {
+		bc.remove(el)
+	}
+	if tmp != "" {
+		// renamed under mu so a concurrent get never sees a missing file
+		if err := os.Rename(tmp, bc.path(fileID)); err != nil {
+			log.Printf("cache: %v", err)
+			os.Remove(tmp)
+			return
+		}
+	}
+	for bc.used+size > bc.max && bc.lru.Len() > 0 {
+		bc.remove(bc.lru.Back())
+		bc.evictions++
+	}
+	bc.byID[fileID] = bc.lru.PushFront(e)
+	bc.used += size
+}
+
+// drop forgets fileID, e.g. after it was deleted or overwritten.
+func (bc *blobCache) drop(fileID string) {
+	if bc == nil {
+		return
+	}
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	if el, ok := bc.byID[fileID]; ok {
+		bc.remove(el)
+	}
+}
+
+// remove unlinks el. Callers must hold mu; a reader that already opened a
+// disk entry keeps its file handle.
+func (bc *blobCache) remove(el *list.Element) {
+	e := bc.lru.Remove(el).(*cacheEntry)
+	delete(bc.byID, e.fileID)
+	bc.used -= e.size
+	if bc.dir != "" {
+		os.Remove(bc.path(e.fileID))
+	}
+}
+
+func (bc *blobCache) stats() map[string]any {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	mode := "memory"
+	if bc.dir != "" {
+		mode = "disk"
+	}
+	return map[string]any{
+		"enabled": true, "mode": mode, "dir": bc.dir,
+		"maxBytes": bc.max, "maxFileBytes": bc.maxFile, "usedBytes": bc.used, "entries": bc.lru.Len(),
+		"hits": bc.hits, "misses": bc.misses, "evictions": bc.evictions,
+	}
+}
+
+// cacheCapture collects a download as it streams to the client, giving up
+// once it grows past limit.
+type cacheCapture struct {
+	buf   bytes.Buffer
+	limit int64
+	over  bool
+}
+
+func (cc *cacheCapture) Write(p []byte) (int, error) {
+	if !cc.over && int64(cc.buf.Len()+len(p)) <= cc.limit {
+		cc.buf.Write(p)
+	} else {
+		cc.over = true
+		cc.buf.Reset()
+	}
+	return len(p), nil
+}
+
+func (c cfg) handleCacheStats(w http.ResponseWriter, r *http.Request) {
+	if c.cache == nil {
+		writeJSON(w, map[string]any{"enabled": false})
+		return
+	}
+	writeJSON(w, c.cache.stats())
+}
+
+/* ---------------- PREVIEWS ---------------- */
+
+// previewMaxPixels caps the pixels decoded for a preview; a decoded image
+// takes four bytes per pixel.
+const previewMaxPixels = 50_000_000
+
+// makePreview renders a preview of a committed upload and stores it as the
+// file's "preview" derived file, overwriting the previous one so its ID
+// stays put across new versions. Types it cannot render are skipped.
+func (c cfg) makePreview(fileID, filename, detected string, data []byte) {
+	if c.PreviewSize <= 0 || int64(len(data)) > c.PreviewMaxBytes {
+		return
+	}
+	img, err := c.renderPreview(mediaType(detected), data)
+	if err != nil {
+		log.Printf("preview %s: %v", fileID, err)
+	}
+	if img == nil {
+		return
+	}
+	out := &bytes.Buffer{}
+	if err := jpeg.Encode(out, img, &jpeg.Options{Quality: 80}); err != nil {
+		log.Printf("preview %s: %v", fileID, err)
+		return
+	}
+	existing := c.derivedOf(context.Background(), fileID)["preview"]
+	name := strings.TrimSuffix(filename, path.Ext(filename)) + ".preview.jpg"
+	if _, err := c.storeFile(context.Background(), out, name, "image/jpeg", existing, "", fileID, placement{}); err != nil {
+		log.Printf("preview %s: store: %v", fileID, err)
+	}
+}
+
+// previewStored is makePreview for a direct upload, whose bytes never
+// passed through the gateway: it reads them back from a replica.
+func (c cfg) previewStored(fileID string) {
+	if c.PreviewSize <= 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	r, _ := http.NewRequestWithContext(ctx, http.MethodGet, "/api/upload/commit", nil)
+	body, _, _, err := c.openReplica(r, fileID)
+	if err != nil {
+		log.Printf("preview %s: %v", fileID, err)
+		return
+	}
+	defer body.Close()
+	data, err := io.ReadAll(io.LimitReader(body, c.PreviewMaxBytes+1))
+	if err != nil || int64(len(data)) > c.PreviewMaxBytes {
+		return
+	}
+	c.makePreview(fileID, fileID, sniffType(data), data)
+}
+
+// renderPreview returns the image to preview, or nil for a type that has
+// no preview.
+func (c cfg) renderPreview(typ string, data []byte) (image.Image, error) {
+	switch typ {
+	case "image/jpeg", "image/png", "image/gif":
+		conf, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if conf.Width*conf.Height > previewMaxPixels {
+			return nil, fmt.Errorf("%dx%d image is too large to preview", conf.Width, conf.Height)
+		}
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return thumbnail(img, c.PreviewSize), nil
+	case "application/pdf":
+		if c.pdftoppm == "" {
+			return nil, nil
+		}
+		return c.renderPDF(data)
+	}
+	return nil, nil
+}
+
+// renderPDF rasterizes the first page with pdftoppm, already scaled to
+// PreviewSize.
+func (c cfg) renderPDF(data []byte) (image.Image, error) {
+	dir, err := os.MkdirTemp("", "preview-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	in := filepath.Join(dir, "in.pdf")
+	if err := os.WriteFile(in, data, 0600); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, c.pdftoppm, "-f", "1", "-l", "1", "-singlefile", "-png",
+		"-scale-to", strconv.Itoa(c.PreviewSize), in, filepath.Join(dir, "page"))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("pdftoppm: %v: %s", err, bytes.TrimSpace(out))
+	}
+	f, err := os.Open(filepath.Join(dir, "page.png"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+	return thumbnail(img, c.PreviewSize), nil
+}
+
+// thumbnail scales img down to fit in size x size, averaging the source
+// pixels under each target pixel, and flattens transparency onto white.
+// Smaller images keep their size.
+func thumbnail(img image.Image, size int) *image.RGBA {
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	tw, th := sw, sh
+	if sw > size || sh > size {
+		if sw >= sh {
+			tw, th = size, max(1, sh*size/sw)
+		} else {
+			tw, th = max(1, sw*size/sh), size
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0 := b.Min.Y + y*sh/th
+		y1 := max(y0+1, b.Min.Y+(y+1)*sh/th)
+		for x := 0; x < tw; x++ {
+			x0 := b.Min.X + x*sw/tw
+			x1 := max(x0+1, b.Min.X+(x+1)*sw/tw)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			// premultiplied colour over white: c + (1 - alpha)
+			over := 0xffff - a/n
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8((r/n + over) >> 8), G: uint8((g/n + over) >> 8), B: uint8((bl/n + over) >> 8), A: 0xff,
+			})
+		}
+	}
+	return dst
+}
+
+// derivedOf returns the derived files the naming service lists for fileID,
+// by kind.
+func (c cfg) derivedOf(ctx context.Context, fileID string) map[string]string {
+	resp, err := c.httpGet(ctx, 5*time.Second, c.namingFor(fileID)+"/file-info/"+url.PathEscape(fileID))
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	var meta struct {
+		Derived map[string]string `json:"derived"`
+	}
+	if resp.StatusCode == http.StatusOK {
+		_ = json.NewDecoder(resp.Body).Decode(&meta)
+	}
+	return meta.Derived
+}
+
+// handlePreview serves a file's preview: GET /api/preview?fileId=. Files
+// without one, because of their type or because it is still being made,
+// get 404.
+func (c cfg) handlePreview(w http.ResponseWriter, r *http.Request) {
+	fid := r.URL.Query().Get("fileId")
+	if fid == "" {
+		writeError(w, http.StatusBadRequest, codeMissingParameter, "missing fileId")
+		return
+	}
+	if !c.authorize(w, r, fid, "read") {
+		return
+	}
+	pid := c.derivedOf(r.Context(), fid)["preview"]
+	if pid == "" {
+		writeError(w, http.StatusNotFound, codeNotFound, "no preview for this file")
+		return
+	}
+	body, _, sum, err := c.openReplica(r, pid)
+	if err != nil {
+		writeErrorDetail(w, http.StatusBadGateway, codeUpstreamError, "preview unavailable", err.Error())
+		return
+	}
+	defer body.Close()
+	w.Header().Set("Cache-Control", "no-cache")
+	if sum != "" {
+		etag := `"` + sum + `"`
+		w.Header().Set("ETag", etag)
+		if etagMatch(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	_, _ = io.Copy(w, body)
+}
+
+/* ---------------- SHARE LINKS ---------------- */
+
+// shareRequest is the body of POST /api/share. Only FileID is read here;
+// the body goes to the naming service as it is.
+type shareRequest struct {
+	FileID       string `json:"fileId"`
+	ExpiresIn    string `json:"expiresIn,omitempty"` // Go duration, e.g. 24h; empty: never
+	MaxDownloads int64  `json:"maxDownloads,omitempty"`
+	Password     string `json:"password,omitempty"`
+}
+
+// handleShare manages public share links: POST creates one for {fileId,
+// expiresIn, maxDownloads, password}, GET lists them (?fileId=), DELETE
+// revokes ?token=. The naming service keeps the shares; the gateway adds
+// the link to hand out, and decides who may see and revoke which.
+func (c cfg) handleShare(w http.ResponseWriter, r *http.Request) {
+	var req *http.Request
+	switch r.Method {
+	case http.MethodGet:
+		c.listShares(w, r)
+		return
+	case http.MethodPost:
+		b, err := io.ReadAll(r.Body)
+		var body shareRequest
+		if err != nil || json.Unmarshal(b, &body) != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidJSON, "bad json")
+			return
+		}
+		// a link hands out read access, so only a reader may make one
+		if body.FileID != "" && !c.authorize(w, r, body.FileID, "read") {
+			return
+		}
+		req, _ = http.NewRequestWithContext(r.Context(), http.MethodPost, c.namingFor(body.FileID)+"/shares", bytes.NewReader(b))
+	case http.MethodDelete:
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			writeError(w, http.StatusBadRequest, codeMissingParameter, "missing token")
+			return
+		}
+		if !c.mayRevoke(w, r, token) {
+			return
+		}
+		req, _ = http.NewRequestWithContext(r.Context(), http.MethodDelete, c.namingFor(token)+"/shares/"+url.PathEscape(token), nil)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(actorHeader, callerOf(r))
+	resp, err := c.httpClient(0).Do(req)
+	if err != nil {
+		writeUpstreamError(w, "share request failed", err)
+		return
+	}
+	defer resp.Body.Close()
+	if r.Method != http.MethodPost || resp.StatusCode != http.StatusCreated {
+		relay(w, resp)
+		return
+	}
+	var share map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&share); err != nil {
+		writeError(w, http.StatusBadGateway, codeUpstreamError, "bad share from naming service")
+		return
+	}
+	token, _ := share["token"].(string)
+	share["path"] = "/s/" + token
+	share["url"] = baseURL(r) + "/s/" + token
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(share)
+}
+
+// shareList is the naming service's GET /shares.
+type shareList struct {
+	Shares []json.RawMessage `json:"shares"`
+}
+
+// shareInfo is the part of a listed share access is decided on.
+type shareInfo struct {
+	Token     string `json:"token"`
+	FileID    string `json:"fileId"`
+	CreatedBy string `json:"createdBy"`
+}
+
+// madeShare reports whether r comes from the user who created s. CreatedBy
+// is callerOf the creator, "user@host", so only the user part counts; an
+// anonymous caller made nothing it can claim.
+func madeShare(r *http.Request, s shareInfo) bool {
+	user := principalOf(r).user
+	i := strings.LastIndex(s.CreatedBy, "@")
+	return user != "" && i >= 0 && s.CreatedBy[:i] == user
+}
+
+// listShares answers GET /api/share: the shares of ?fileId=, which needs
+// read on it, or of every file the caller may read. /s/{token} is public,
+// so a token is as good as read access; only its creator and admins see it.
+func (c cfg) listShares(w http.ResponseWriter, r *http.Request) {
+	fid := r.URL.Query().Get("fileId")
+	if fid != "" && !c.authorize(w, r, fid, "read") {
+		return
+	}
+	var lists []shareList
+	if fid == "" && c.spansShards(r) {
+		var err error
+		if lists, _, err = fromShards[shareList](r.Context(), c.upstreams, "/shares?"+r.URL.RawQuery); err != nil {
+			writeUpstreamError(w, "failed to list shares", err)
+			return
+		}
+	} else {
+		base, ok := c.namingOf(w, r)
+		if !ok {
+			return
+		}
+		if fid != "" {
+			base = c.namingFor(fid)
+		}
+		resp, err := c.httpGet(r.Context(), 0, base+"/shares?"+r.URL.RawQuery)
+		if err != nil {
+			writeUpstreamError(w, "share request failed", err)
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			relay(w, resp)
+			return
+		}
+		var l shareList
+		if err := json.NewDecoder(resp.Body).Decode(&l); err != nil {
+			writeError(w, http.StatusBadGateway, codeUpstreamError, "bad shares from naming service")
+			return
+		}
+		lists = []shareList{l}
+	}
+	all := make([][]json.RawMessage, len(lists))
+	for i, l := range lists {
+		all[i] = l.Shares
+	}
+
+	admin := c.isAdmin(r)
+	readable := map[string]bool{}
+	if fid != "" {
+		readable[fid] = true // authorized above
+	}
+	out := []json.RawMessage{}
+	for _, raw := range byTime(all, "createdAt", false) {
+		var s shareInfo
+		if err := json.Unmarshal(raw, &s); err != nil {
+			writeError(w, http.StatusBadGateway, codeUpstreamError, "bad shares from naming service")
+			return
+		}
+		may, checked := readable[s.FileID]
+		if !checked {
+			f, found, err := c.fileACLOf(r.Context(), s.FileID)
+			if err != nil {
+				writeErrorDetail(w, http.StatusBadGateway, codeUpstreamError, "permission check failed", err.Error())
+				return
+			}
+			may = !found || principalOf(r).may(f, "read")
+			readable[s.FileID] = may
+		}
+		if !may {
+			continue
+		}
+		if !admin && !madeShare(r, s) {
+			var fields map[string]json.RawMessage
+			_ = json.Unmarshal(raw, &fields)
+			delete(fields, "token")
+			raw, _ = json.Marshal(fields)
+		}
+		out = append(out, raw)
+	}
+	writeJSON(w, map[string]any{"shares": out})
+}
+
+// mayRevoke answers 403 and returns false unless the caller created the
+// share named by token, may write its file, or is an admin. An unknown
+// token passes, so the naming service reports it as it always has.
+func (c cfg) mayRevoke(w http.ResponseWriter, r *http.Request, token string) bool {
+	if c.isAdmin(r) {
+		return true
+	}
+	resp, err := c.httpGet(r.Context(), 0, c.namingFor(token)+"/shares")
+	if err != nil {
+		writeErrorDetail(w, http.StatusBadGateway, codeUpstreamError, "permission check failed", err.Error())
+		return false
+	}
+	defer resp.Body.Close()
+	var l shareList
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&l) != nil {
+		writeErrorDetail(w, http.StatusBadGateway, codeUpstreamError, "permission check failed", "shares: status "+resp.Status)
+		return false
+	}
+	for _, raw := range l.Shares {
+		var s shareInfo
+		if json.Unmarshal(raw, &s) != nil || s.Token != token {
+			continue
+		}
+		return madeShare(r, s) || c.authorize(w, r, s.FileID, "write")
+	}
+	return true
+}
+
+// baseURL is the gateway as the client reached it, honouring
+// X-Forwarded-Proto from a TLS-terminating proxy.
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if p := r.Header.Get("X-Forwarded-Proto"); p == "http" || p == "https" {
+		scheme = p
+	}
+	return scheme + "://" + r.Host
+}
+
+// sharePasswordHeader carries a share's password for scripted downloads;
+// browsers post it from the form sharePasswordPage serves.
+const sharePasswordHeader = "X-Share-Password"
+
+// handleShareLink serves GET /s/{token}, and POST from the password form:
+// the naming service checks expiry,
+// revocation, the download limit and the password and counts the download,
+// then the file is streamed from a replica as an attachment.
+func (c cfg) handleShareLink(w http.ResponseWriter, r *http.Request) {
+	token := r.PathValue("token")
+	password := r.Header.Get(sharePasswordHeader)
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			writeError(w, http.StatusBadRequest, codeBadRequest, "bad form")
+			return
+		}
+		password = r.PostForm.Get("password")
+	}
+	w.Header().Set("Cache-Control", "private, no-store") // every fetch is a counted download
+	opened, err := postJSON[struct {
+		FileID      string `json:"fileId"`
+		Filename    string `json:"filename"`
+		ContentType string `json:"contentType"`
+	}](r.Context(), c.upstreams, c.namingFor(token)+"/shares/open", map[string]string{"token": token, "password": password})
+	var se *statusError
+	switch {
+	case errors.As(err, &se):
+		if (se.Code == http.StatusUnauthorized || se.Code == http.StatusForbidden) &&
+			strings.Contains(r.Header.Get("Accept"), "text/html") {
+			sharePasswordPage(w, se.Code, se.Code == http.StatusForbidden)
+			return
+		}
+		relayError(w, se.Code, []byte(se.Body))
+		return
+	case err != nil:
+		writeErrorDetail(w, http.StatusBadGateway, codeUpstreamError, "share lookup failed", err.Error())
+		return
+	}
+	body, modified, _, err := c.openReplica(r, opened.FileID)
+	if err != nil {
+		writeErrorDetail(w, http.StatusBadGateway, codeUpstreamError, "download failed", err.Error())
+		return
+	}
+	defer body.Close()
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": opened.Filename}))
+	if opened.ContentType != "" {
+		w.Header().Set("Content-Type", opened.ContentType)
+	}
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	_, _ = io.Copy(w, body)
+}
+
+// sharePasswordPage asks a browser for a protected link's password and
+// posts it back to the same URL.
+func sharePasswordPage(w http.ResponseWriter, code int, wrong bool) {
+	msg := "This link is protected by a password."
+	if wrong {
+		msg = "Wrong password, try again."
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, `<!doctype html>
+<html><head><meta charset="utf-8"><title>Protected download</title></head>
+<body style="font-family:sans-serif;max-width:24rem;margin:4rem auto">
+<p>%s</p>
+<form method="post"><input type="password" name="password" autofocus required>
+<button type="submit">Download</button></form>
+</body></html>
+`, msg)
+}
+
+/* ---------------- PERMISSIONS ---------------- */
+
+// principal is who a request comes from as far as file permissions go:
+// X-User, the tenant from tenantOf and the comma-separated X-Groups. Like
+// quotas, this trusts the headers, so put an authenticating proxy in front
+// of the gateway before relying on it.
+type principal struct {
+	user, tenant string
+	groups       []string
+}
+
+func principalOf(r *http.Request) principal {
+	p := principal{user: r.Header.Get("X-User"), tenant: tenantOf(r)}
+	for _, g := range strings.Split(r.Header.Get("X-Groups"), ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			p.groups = append(p.groups, g)
+		}
+	}
+	return p
+}
+
+// aclEntry grants permissions ("read", "write", "delete") to a subject:
+// "user:<name>", "group:<name>" or "*".
+type aclEntry struct {
+	Subject     string   `json:"subject"`
+	Permissions []string `json:"permissions"`
+}
+
+// fileACL is the part of a catalog entry permissions are decided on.
+type fileACL struct {
+	FileID string     `json:"fileId"`
+	Owner  string     `json:"owner"`
+	ACL    []aclEntry `json:"acl"`
+}
+
+func (p principal) owns(f fileACL) bool {
+	return f.Owner != "" && (f.Owner == p.user || f.Owner == p.tenant)
+}
+
+// may reports whether p has perm on f. The owner may do anything, and a
+// file with neither owner nor ACL, such as an anonymous upload, is open to
+// everyone.
+func (p principal) may(f fileACL, perm string) bool {
+	if (f.Owner == "" && len(f.ACL) == 0) || p.owns(f) {
+		return true
+	}
+	for _, e := range f.ACL {
+		if !slices.Contains(e.Permissions, perm) {
+			continue
+		}
+		kind, name, _ := strings.Cut(e.Subject, ":")
+		switch {
+		case e.Subject == "*",
+			kind == "user" && name == p.user && p.user != "",
+			kind == "group" && slices.Contains(p.groups, name):
+			return true
+		}
+	}
+	return false
+}
+
+// fileACLOf fetches fid's owner and ACL; found is false for an unknown file.
+func (c cfg) fileACLOf(ctx context.Context, fid string) (f fileACL, found bool, err error) {
+	resp, err := c.httpGet(ctx, 0, c.namingFor(fid)+"/file-info/"+url.PathEscape(fid))
+	if err != nil {
+		return f, false, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return f, false, nil
+	case resp.StatusCode != http.StatusOK:
+		return f, false, fmt.Errorf("file-info: status %d", resp.StatusCode)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&f)
+	return f, err == nil, err
+}
+
+// authorize answers 403 and returns false unless the caller has perm on
+// fid. Unknown files pass, so the handler reports them as it always has.
+func (c cfg) authorize(w http.ResponseWriter, r *http.Request, fid, perm string) bool {
+	f, found, err := c.fileACLOf(r.Context(), fid)
+	if err != nil {
+		writeErrorDetail(w, http.StatusBadGateway, codeUpstreamError, "permission check failed", err.Error())
+		return false
+	}
+	if !found || principalOf(r).may(f, perm) {
+		return true
+	}
+	forbidden(w, fid, perm)
+	return false
+}
+
+func forbidden(w http.ResponseWriter, fid, perm string) {
+	writeErrorDetail(w, http.StatusForbidden, codePermissionDenied, "permission denied", map[string]string{"fileId": fid, "permission": perm})
+}
+
+// permissionsRequest is the body of PUT /api/permissions, passed on to
+// the naming service; a nil Owner leaves the owner as it is.
+type permissionsRequest struct {
+	Owner *string    `json:"owner,omitempty"`
+	ACL   []aclEntry `json:"acl"`
+}
+
+// handlePermissions shows (GET, needs read) or replaces (PUT, owner only)
+// a file's owner and ACL: /api/permissions?fileId=. A file without an owner
+// can be claimed by anyone, the same as it can be read by anyone.
+func (c cfg) handlePermissions(w http.ResponseWriter, r *http.Request) {
+	fid := r.URL.Query().Get("fileId")
+	if fid == "" {
+		writeError(w, http.StatusBadRequest, codeMissingParameter, "missing fileId")
+		return
+	}
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "cannot read body")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if !c.authorize(w, r, fid, "read") {
+			return
+		}
+	case http.MethodPut:
+		f, found, err := c.fileACLOf(r.Context(), fid)
+		if err != nil {
+			writeErrorDetail(w, http.StatusBadGateway, codeUpstreamError, "permission check failed", err.Error())
+			return
+		}
+		if found && f.Owner != "" && !principalOf(r).owns(f) {
+			forbidden(w, fid, "owner")
+			return
+		}
+		var body permissionsRequest
+		if json.Unmarshal(b, &body) == nil && body.Owner != nil && c.refuseCrossShard(w, fid, *body.Owner) {
+			return
+		}
+	}
+	req, _ := http.NewRequestWithContext(r.Context(), r.Method, c.namingFor(fid)+"/permissions/"+url.PathEscape(fid), bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(actorHeader, callerOf(r))
+	resp, err := c.httpClient(0).Do(req)
+	if err != nil {
+		writeUpstreamError(w, "permissions request failed", err)
+		return
+	}
+	defer resp.Body.Close()
+	relay(w, resp)
+}
+
+// renameRequest is the body of POST /api/rename.
+type renameRequest struct {
+	FileID   string `json:"fileId"`
+	Filename string `json:"filename"`
+}
+
+// handleRename renames {fileId} to {filename}; it needs write permission.
+func (c cfg) handleRename(w http.ResponseWriter, r *http.Request) {
+	var body renameRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.FileID == "" || body.Filename == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidJSON, "bad json: need fileId and filename")
+		return
+	}
+	if !c.authorize(w, r, body.FileID, "write") {
+		return
+	}
+	nb, _ := json.Marshal(body)
+	req, _ := http.NewRequestWithContext(r.Context(), http.MethodPost, c.namingFor(body.FileID)+"/rename-file", bytes.NewReader(nb))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(actorHeader, callerOf(r))
+	resp, err := c.httpClient(0).Do(req)
+	if err != nil {
+		writeUpstreamError(w, "rename failed", err)
+		return
+	}
+	defer resp.Body.Close()
+	relay(w, resp)
+}
+
+/* ---------------- COPY & MOVE ---------------- */
+
+// copyRequest is the body of POST /api/copy.
+type copyRequest struct {
+	FileID   string `json:"fileId"`
+	Filename string `json:"filename,omitempty"` // default: the source's name with a " (n)" suffix
+}
+
+// handleCopy copies {fileId} on the storage nodes: the bytes go neither
+// through the gateway nor between nodes. It needs read permission, and the
+// copy belongs to the caller's tenant like an upload would, so with naming
+// shards the file must be on the tenant's shard.
+func (c cfg) handleCopy(w http.ResponseWriter, r *http.Request) {
+	var body copyRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.FileID == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidJSON, "bad json: need fileId")
+		return
+	}
+	if !c.authorize(w, r, body.FileID, "read") || c.refuseCrossShard(w, body.FileID, tenantOf(r)) {
+		return
+	}
+	nb, _ := json.Marshal(map[string]any{"filename": body.Filename, "owner": tenantOf(r)})
+	req, _ := http.NewRequestWithContext(r.Context(), http.MethodPost, c.namingFor(body.FileID)+"/files/"+url.PathEscape(body.FileID)+"/copy", bytes.NewReader(nb))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(actorHeader, callerOf(r))
+	resp, err := c.httpClient(0).Do(req)
+	if err != nil {
+		writeUpstreamError(w, "copy failed", err)
+		return
+	}
+	defer resp.Body.Close()
+	relay(w, resp)
+}
+
+// moveRequest is the body of POST /api/move; see the naming service's
+// MoveFileRequest.
+type moveRequest struct {
+	FileID    string  `json:"fileId"`
+	Directory *string `json:"directory,omitempty"`
+	Filename  string  `json:"filename,omitempty"`
+	Owner     *string `json:"owner,omitempty"`
+}
+
+// handleMove moves {fileId} to another folder, which needs write
+// permission, or to another owner, which only the owner may do, as with
+// PUT /api/permissions.
+func (c cfg) handleMove(w http.ResponseWriter, r *http.Request) {
+	var body moveRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.FileID == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidJSON, "bad json: need fileId")
+		return
+	}
+	if body.Owner != nil {
+		f, found, err := c.fileACLOf(r.Context(), body.FileID)
+		if err != nil {
+			writeErrorDetail(w, http.StatusBadGateway, codeUpstreamError, "permission check failed", err.Error())
+			return
+		}
+		if found && f.Owner != "" && !principalOf(r).owns(f) {
+			forbidden(w, body.FileID, "owner")
+			return
+		}
+		if c.refuseCrossShard(w, body.FileID, *body.Owner) {
+			return
+		}
+	} else if !c.authorize(w, r, body.FileID, "write") {
+		return
+	}
+	fid := body.FileID
+	body.FileID = ""
+	nb, _ := json.Marshal(body)
+	req, _ := http.NewRequestWithContext(r.Context(), http.MethodPost, c.namingFor(fid)+"/files/"+url.PathEscape(fid)+"/move", bytes.NewReader(nb))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(actorHeader, callerOf(r))
+	resp, err := c.httpClient(0).Do(req)
+	if err != nil {
+		writeUpstreamError(w, "move failed", err)
+		return
+	}
+	defer resp.Body.Close()
+	relay(w, resp)
+}
+
+/* ---------------- STORAGE CLASSES ---------------- */
+
+// handleStorageClasses relays the naming service's storage classes.
+func (c cfg) handleStorageClasses(w http.ResponseWriter, r *http.Request) {
+	resp, err := c.httpGet(r.Context(), 0, c.namingURL()+"/storage-classes")
+	if err != nil {
+		writeUpstreamError(w, "storage classes unavailable", err)
+		return
+	}
+	defer resp.Body.Close()
+	relay(w, resp)
+}
+
+// changeClassRequest is the body of POST /api/change-class.
+type changeClassRequest struct {
+	FileID       string `json:"fileId"`
+	StorageClass string `json:"storageClass"`
+}
+
+// handleChangeClass moves {fileId} to another storage class, which needs
+// write permission. The naming service re-replicates in the background and
+// answers with the operation to follow.
+func (c cfg) handleChangeClass(w http.ResponseWriter, r *http.Request) {
+	var body changeClassRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.FileID == "" || body.StorageClass == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidJSON, "bad json: need fileId and storageClass")
+		return
+	}
+	if !c.authorize(w, r, body.FileID, "write") {
+		return
+	}
+	nb, _ := json.Marshal(map[string]string{"storageClass": body.StorageClass})
+	req, _ := http.NewRequestWithContext(r.Context(), http.MethodPost, c.namingFor(body.FileID)+"/files/"+url.PathEscape(body.FileID)+"/storage-class", bytes.NewReader(nb))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(actorHeader, callerOf(r))
+	resp, err := c.httpClient(0).Do(req)
+	if err != nil {
+		writeUpstreamError(w, "change class failed", err)
+		return
+	}
+	defer resp.Body.Close()
+	relay(w, resp)
+}
+
+/* ---------------- CONFLICTS ---------------- */
+
+// handleConflicts relays the naming service's open conflicts: uploads of
+// one filename with different content. Like /api/quota, without ?owner= it
+// shows the caller's tenant's, or every one for an anonymous caller.
+func (c cfg) handleConflicts(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if !q.Has("owner") {
+		if t := tenantOf(r); t != "" {
+			q.Set("owner", t)
+		}
+	}
+	if c.spansShards(r) {
+		c.writeGathered(w, r, "/conflicts", q, fieldOf("conflicts", "createdAt"), "failed to get conflicts")
+		return
+	}
+	base, ok := c.namingOf(w, r)
+	if !ok {
+		return
+	}
+	u := base + "/conflicts"
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	resp, err := c.httpGet(r.Context(), 0, u)
+	if err != nil {
+		writeUpstreamError(w, "failed to get conflicts", err)
+		return
+	}
+	defer resp.Body.Close()
+	relay(w, resp)
+}
+
+// resolveConflictRequest is the body of POST /api/conflicts/resolve.
+type resolveConflictRequest struct {
+	ConflictID string `json:"conflictId"`
+	Strategy   string `json:"strategy"`       // keep-newest, keep-both or pick
+	Keep       string `json:"keep,omitempty"` // the fileId pick keeps
+}
+
+// handleResolveConflict passes a resolution on to the naming service, which
+// deletes the blobs of the files it drops itself. keep-both renames, so it
+// needs write permission on every file in the conflict; the other
+// strategies may delete any of them and need delete.
+func (c cfg) handleResolveConflict(w http.ResponseWriter, r *http.Request) {
+	var body resolveConflictRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.ConflictID == "" || body.Strategy == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidJSON, "bad json: need conflictId and strategy")
+		return
+	}
+	base := c.namingFor(body.ConflictID) + "/conflicts/" + url.PathEscape(body.ConflictID)
+	cr, err := c.httpGet(r.Context(), 0, base)
+	if err != nil {
+		writeUpstreamError(w, "failed to get conflict", err)
+		return
+	}
+	defer cr.Body.Close()
+	if cr.StatusCode != http.StatusOK {
+		relay(w, cr)
+		return
+	}
+	var conflict struct {
+		FileIDs []string `json:"fileIds"`
+	}
+	if err := json.NewDecoder(cr.Body).Decode(&conflict); err != nil {
+		writeErrorDetail(w, http.StatusBadGateway, codeUpstreamError, "bad conflict from naming service", err.Error())
+		return
+	}
+	perm := "delete"
+	if body.Strategy == "keep-both" {
+		perm = "write"
+	}
+	for _, fid := range conflict.FileIDs {
+		if !c.authorize(w, r, fid, perm) {
+			return
+		}
+	}
+
+	u := base + "/resolve"
+	if r.URL.RawQuery != "" {
+		u += "?" + r.URL.RawQuery // dryRun
+	}
+	nb, _ := json.Marshal(body)
+	req, _ := http.NewRequestWithContext(r.Context(), http.MethodPost, u, bytes.NewReader(nb))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(actorHeader, callerOf(r))
+	resp, err := c.httpClient(0).Do(req)
+	if err != nil {
+		writeUpstreamError(w, "resolve failed", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		relay(w, resp)
+		return
+	}
+	b, _ := io.ReadAll(resp.Body)
+	var done struct {
+		Deleted []string `json:"deleted"`
+	}
+	_ = json.Unmarshal(b, &done)
+	for _, id := range done.Deleted {
+		c.cache.drop(id)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
+
+/* ---------------- DASHBOARD ---------------- */
+
+// dashboardVersion is the version of the /api/dashboard payload. It goes up
+// when a field changes meaning or is removed; new fields keep it.
+const dashboardVersion = 1
+
+// The lists in /api/dashboard are capped, newest first.
+const (
+	dashboardOps    = 20
+	dashboardEvents = 20
+)
+
+// dashboard is the body of GET /api/dashboard. Each section is the naming
+// service's answer to the call beside it. A section whose call failed is
+// null and named in Unavailable, so the rest of the page still renders.
+type dashboard struct {
+	Version         int               `json:"version"`
+	GeneratedAt     time.Time         `json:"generatedAt"`
+	CatalogRevision string            `json:"catalogRevision,omitempty"`
+	Cluster         json.RawMessage   `json:"cluster"`               // /metrics
+	Nodes           []map[string]any  `json:"nodes"`                 // /list-nodes, with circuitOpenUntil from this gateway
+	Heals           json.RawMessage   `json:"heals"`                 // /heal-queue
+	Alerts          json.RawMessage   `json:"alerts"`                // /alerts
+	Operations      []json.RawMessage `json:"operations"`            // /operations
+	Events          []json.RawMessage `json:"events"`                // /audit of the last 24h
+	Unavailable     map[string]string `json:"unavailable,omitempty"` // section -> why
+}
+
+// namingJSON GETs path from the naming service and decodes the 200 answer
+// into out.
+func (c cfg) namingJSON(ctx context.Context, path string, out any) (http.Header, error) {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, c.namingURL()+path, nil)
+	resp, err := c.httpClient(0).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: status %d", path, resp.StatusCode)
+	}
+	return resp.Header, json.NewDecoder(resp.Body).Decode(out)
+}
+
+// handleDashboard gathers what the dashboard shows in one call: cluster
+// totals, every node, the heal queue, alerts, recent operations and the
+// latest audit events. The naming service is asked for each in parallel;
+// the cluster totals, heals, operations and events come from every shard,
+// nodes and alerts, which every shard sees alike, from the first. Only a
+// failed /metrics fails the request.
+func (c cfg) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	d := dashboard{Version: dashboardVersion, GeneratedAt: time.Now().UTC()}
+	var (
+		mu          sync.Mutex
+		wg          sync.WaitGroup
+		revision    string
+		metricsErr  error
+		unavailable = map[string]string{}
+	)
+	// merge set gathers the section from every shard
+	fetch := func(section, path string, q url.Values, merge mergeFunc, out any) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			if merge != nil && len(c.shards) > 1 {
+				var v any
+				if v, err = c.gather(r.Context(), path, q, merge); err == nil {
+					b, _ := json.Marshal(v)
+					err = json.Unmarshal(b, out)
+				}
+			} else {
+				if len(q) > 0 {
+					path += "?" + q.Encode()
+				}
+				_, err = c.namingJSON(r.Context(), path, out)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				unavailable[section] = err.Error()
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() { // every shard's totals
+		defer wg.Done()
+		d.Cluster, revision, metricsErr = c.clusterMetrics(r.Context())
+	}()
+	fetch("nodes", "/list-nodes", nil, nil, &d.Nodes)
+	fetch("heals", "/heal-queue", nil, mergeHealQueues, &d.Heals)
+	fetch("alerts", "/alerts", nil, nil, &d.Alerts)
+	fetch("operations", "/operations", nil, listOf("startedAt", true), &d.Operations)
+	fetch("events", "/audit", url.Values{"since": {"24h"}}, listOf("time", false), &d.Events)
+	wg.Wait()
+	if metricsErr != nil {
+		writeErrorDetail(w, http.StatusBadGateway, codeUpstreamError, "failed to get metrics", metricsErr.Error())
+		return
+	}
+
+	for section := range unavailable {
+		switch section { // a half-decoded section is dropped
+		case "nodes":
+			d.Nodes = nil
+		case "heals":
+			d.Heals = nil
+		case "alerts":
+			d.Alerts = nil
+		case "operations":
+			d.Operations = nil
+		case "events":
+			d.Events = nil
+		}
+	}
+	if len(unavailable) > 0 {
+		d.Unavailable = unavailable
+	}
+	if _, failed := unavailable["nodes"]; !failed && d.Nodes == nil {
+		d.Nodes = []map[string]any{} // /list-nodes answers null for no nodes; null here means unavailable
+	}
+	open := c.nodeCalls.circuits()
+	for _, n := range d.Nodes {
+		if u, err := url.Parse(fmt.Sprint(n["url"])); err == nil {
+			if until, ok := open[u.Host]; ok {
+				n["circuitOpenUntil"] = until
+			}
+		}
+	}
+	if len(d.Operations) > dashboardOps {
+		d.Operations = d.Operations[:dashboardOps]
+	}
+	slices.Reverse(d.Events) // the audit log is oldest first
+	if len(d.Events) > dashboardEvents {
+		d.Events = d.Events[:dashboardEvents]
+	}
+	d.CatalogRevision = revision
+	writeJSON(w, d)
+}
+
+/* ---------------- ROUTES & OPENAPI ---------------- */
+
+// Version is reported in /openapi.json; set it at build time with
+// -ldflags "-X ui_gateway/internal/gateway.Version=...".
+var Version = "dev"
+
+// route is one operation of the gateway. ServeMux serves the routes and
+// /openapi.json describes them, so the spec cannot drift from what is
+// served. Routes with the same path must share a handler.
+type route struct {
+	method  string
+	path    string // {name} segments are path parameters
+	id      string // operationId; the method name in generated clients
+	tag     string
+	summary string
+	query   []string // optional query parameters
+	body    any      // zero value of the JSON request body; nil = none
+	form    bool     // the body is multipart/form-data instead
+	returns any      // zero value of the JSON response; nil = an untyped object
+	status  int      // success status when it is not 200
+	raw     string   // content type of a response that is not JSON
+	page    bool     // an HTML page or redirect; left out of the spec
+	handler http.HandlerFunc
+}
+
+// routes lists the gateway's pages and API. It only takes method values,
+// so it works on a zero cfg; OpenAPI relies on that.
+func (c cfg) routes() []route {
+	return []route{
+		// Pages and sign-in
+		{method: "GET", path: "/", page: true, handler: c.serveIndex},
+		{method: "GET", path: "/dashboard", page: true, handler: c.serveDashboard},
+		{method: "GET", path: "/login", page: true, handler: c.serveLogin},
+		{method: "GET", path: "/login/oidc", page: true, handler: c.handleOIDCLogin},
+		{method: "GET", path: "/login/oidc/callback", page: true, handler: c.handleOIDCCallback},
+		{method: "GET", path: "/s/{token}", id: "openShareLink", tag: "shares", summary: "Download a file through a public share link", raw: "application/octet-stream", handler: c.handleShareLink},
+		{method: "POST", path: "/s/{token}", page: true, handler: c.handleShareLink}, // the password form
+		{method: "POST", path: "/api/login", id: "login", tag: "accounts", summary: "Sign in with a local account", body: loginRequest{}, handler: c.handleLogin},
+		{method: "POST", path: "/api/logout", id: "logout", tag: "accounts", summary: "Sign out", handler: c.handleLogout},
+		{method: "GET", path: "/api/logout", page: true, handler: c.handleLogout}, // a link: sign out and go to /login
+		{method: "GET", path: "/api/me", id: "me", tag: "accounts", summary: "Who the caller is signed in as", handler: c.handleMe},
+		{method: "GET", path: "/api/users", id: "listUsers", tag: "accounts", summary: "List accounts", handler: c.handleUsers},
+		{method: "PUT", path: "/api/users", id: "putUser", tag: "accounts", summary: "Create or update an account", body: userRequest{}, handler: c.handleUsers},
+		{method: "DELETE", path: "/api/users", id: "deleteUser", tag: "accounts", summary: "Remove an account", query: []string{"username"}, handler: c.handleUsers},
+
+		// Files
+		{method: "POST", path: "/api/upload", id: "upload", tag: "files", summary: "Upload a file through the gateway (form field file)", query: []string{"fileId", "filename"}, form: true, handler: c.handleUpload},
+		{method: "POST", path: "/api/upload/init", id: "uploadInit", tag: "files", summary: "Allocate a file and get tickets to upload to the nodes directly", body: uploadInitRequest{}, returns: uploadInitResponse{}, handler: c.handleUploadInit},
+		{method: "POST", path: "/api/upload/commit", id: "uploadCommit", tag: "files", summary: "Commit a direct upload", body: uploadCommitRequest{}, handler: c.handleUploadCommit},
+		{method: "POST", path: "/api/batch", id: "batch", tag: "files", summary: "Commit direct uploads and delete files, all or none", query: []string{"dryRun"}, body: batchRequest{}, handler: c.handleBatch},
+		{method: "POST", path: "/api/upload-batch", id: "uploadBatch", tag: "files", summary: "Upload many files, or zip archives of them, in one request", form: true, handler: c.handleUploadBatch},
+		{method: "GET", path: "/api/download-archive", id: "downloadArchive", tag: "files", summary: "Download files as one zip or tar", query: []string{"fileIds", "path", "format", "name"}, raw: "application/zip", handler: c.handleDownloadArchive},
+		{method: "GET", path: "/api/lookup", id: "lookup", tag: "files", summary: "Replicas a file can be downloaded from", query: []string{"fileId"}, returns: []lookupReplica{}, handler: c.handleLookup},
+		{method: "GET", path: "/api/download", id: "download", tag: "files", summary: "Download a file through the gateway", query: []string{"fileId", "nodeUrl", "inline", "trailer", "verify"}, raw: "application/octet-stream", handler: c.handleProxyDownload},
+		{method: "GET", path: "/api/preview", id: "preview", tag: "files", summary: "A JPEG preview of an image or PDF", query: []string{"fileId"}, raw: "image/jpeg", handler: c.handlePreview},
+		{method: "GET", path: "/api/files", id: "listFiles", tag: "files", summary: "Every file in the catalog", handler: c.handleListFiles},
+		{method: "DELETE", path: "/api/files", id: "deleteFile", tag: "files", summary: "Delete a file and its replicas", query: []string{"fileId", "dryRun"}, handler: c.handleDeleteFile},
+		{method: "POST", path: "/api/delete", id: "deleteFileLegacy", tag: "files", summary: "Delete a file (deprecated: use DELETE /api/files?fileId=)", query: []string{"dryRun"}, body: deleteRequest{}, handler: c.handleDeleteFile},
+		{method: "GET", path: "/api/search", id: "search", tag: "files", summary: "Find files by ID or name", query: []string{"q", "fileId", "filename"}, handler: c.handleSearch},
+		{method: "GET", path: "/api/verify", id: "verify", tag: "files", summary: "Check every replica of a file against its checksum", query: []string{"fileId", "timeout"}, handler: c.handleVerify},
+		{method: "POST", path: "/api/copy", id: "copy", tag: "files", summary: "Copy a file on the storage nodes, without downloading it", body: copyRequest{}, status: http.StatusCreated, handler: c.handleCopy},
+		{method: "POST", path: "/api/move", id: "move", tag: "files", summary: "Move a file to another folder or owner", body: moveRequest{}, handler: c.handleMove},
+		{method: "GET", path: "/api/storage-classes", id: "storageClasses", tag: "files", summary: "The storage classes and what they mean", handler: c.handleStorageClasses},
+		{method: "POST", path: "/api/change-class", id: "changeClass", tag: "files", summary: "Move a file to another storage class", body: changeClassRequest{}, handler: c.handleChangeClass},
+		{method: "GET", path: "/api/conflicts", id: "listConflicts", tag: "files", summary: "Uploads of the same filename with different content", query: []string{"owner", "shard"}, handler: c.handleConflicts},
+		{method: "POST", path: "/api/conflicts/resolve", id: "resolveConflict", tag: "files", summary: "Resolve a conflict: keep-newest, keep-both or pick", query: []string{"dryRun"}, body: resolveConflictRequest{}, handler: c.handleResolveConflict},
+		{method: "POST", path: "/api/rename", id: "rename", tag: "files", summary: "Rename a file", body: renameRequest{}, handler: c.handleRename},
+		{method: "GET", path: "/api/permissions", id: "getPermissions", tag: "files", summary: "A file's owner and ACL", query: []string{"fileId"}, handler: c.handlePermissions},
+		{method: "PUT", path: "/api/permissions", id: "setPermissions", tag: "files", summary: "Replace a file's ACL and optionally its owner (owner only)", query: []string{"fileId"}, body: permissionsRequest{}, handler: c.handlePermissions},
+		{method: "POST", path: "/api/heal", id: "heal", tag: "files", summary: "Repair a file now", query: []string{"fileId"}, handler: c.handleHeal},
+
+		// Shares
+		{method: "GET", path: "/api/share", id: "listShares", tag: "shares", summary: "List share links", query: []string{"fileId", "shard"}, handler: c.handleShare},
+		{method: "POST", path: "/api/share", id: "createShare", tag: "shares", summary: "Create a share link", body: shareRequest{}, status: http.StatusCreated, handler: c.handleShare},
+		{method: "DELETE", path: "/api/share", id: "revokeShare", tag: "shares", summary: "Revoke a share link", query: []string{"token"}, handler: c.handleShare},
+
+		// Cluster
+		{method: "GET", path: "/api/nodes", id: "listNodes", tag: "cluster", summary: "Every registered node", handler: c.handleListNodes},
+		{method: "GET", path: "/api/metrics", id: "metrics", tag: "cluster", summary: "Cluster totals", handler: c.handleMetrics},
+		{method: "GET", path: "/api/dashboard", id: "dashboard", tag: "cluster", summary: "Cluster summary, nodes, heals, alerts, operations and recent events in one payload", handler: c.handleDashboard},
+		{method: "GET", path: "/api/metrics/history", id: "metricsHistory", tag: "cluster", summary: "Cluster totals sampled over time", query: []string{"window", "step", "shard"}, handler: c.handleMetricsHistory},
+		{method: "GET", path: "/api/operations", id: "listOperations", tag: "cluster", summary: "Background operations", query: []string{"state", "shard"}, handler: c.handleOperations},
+		{method: "POST", path: "/api/operations/cancel", id: "cancelOperation", tag: "cluster", summary: "Cancel a running operation", body: idRequest{}, handler: c.handleCancelOperation},
+		{method: "GET", path: "/api/audit", id: "audit", tag: "cluster", summary: "Audit log entries", query: []string{"since", "action", "shard"}, handler: c.handleAudit},
+		{method: "GET", path: "/api/popular", id: "popular", tag: "cluster", summary: "Most read files", query: []string{"window", "by", "limit", "shard"}, handler: c.handlePopular},
+		{method: "GET", path: "/api/integrity-report", id: "integrityReport", tag: "cluster", summary: "Replication and checksum health of every file", query: []string{"format", "problems", "staleAfter", "shard"}, handler: c.handleIntegrityReport},
+		{method: "GET", path: "/api/heal-queue", id: "healQueue", tag: "cluster", summary: "Files waiting to be healed", query: []string{"shard"}, handler: c.handleHealQueue},
+		{method: "GET", path: "/api/node-health", id: "nodeHealth", tag: "cluster", summary: "Why a node has its status", query: []string{"nodeId"}, handler: c.handleNodeHealth},
+		{method: "GET", path: "/api/capacity-forecast", id: "capacityForecast", tag: "cluster", summary: "Days until full per node and cluster-wide, with usage series", query: []string{"window", "horizonDays", "series"}, handler: c.handleCapacityForecast},
+		{method: "GET", path: "/api/topology", id: "topology", tag: "cluster", summary: "Nodes and replicas as a Mermaid or DOT diagram", query: []string{"format", "fileId", "limit"}, raw: "text/plain", handler: c.handleTopology},
+		{method: "GET", path: "/api/cache", id: "cacheStats", tag: "cluster", summary: "Download cache hit and miss counters", handler: c.handleCacheStats},
+		{method: "GET", path: "/api/lifecycle", id: "lifecycle", tag: "cluster", summary: "Lifecycle rules and the last pass", query: []string{"shard"}, handler: c.handleLifecycle},
+		{method: "GET", path: "/api/quota", id: "quota", tag: "cluster", summary: "Quota usage", query: []string{"owner", "shard"}, handler: c.handleQuota},
+		{method: "GET", path: "/api/circuits", id: "circuits", tag: "cluster", summary: "Nodes the gateway is currently failing fast", handler: c.handleCircuits},
+		{method: "GET", path: "/api/naming", id: "namingEndpoints", tag: "cluster", summary: "Naming endpoints and the active one", handler: c.handleNamingEndpoints},
+		{method: "GET", path: "/openapi.json", id: "openAPI", tag: "cluster", summary: "This API as an OpenAPI 3 document", handler: handleOpenAPI},
+
+		// Administration
+		{method: "POST", path: "/api/system/start", id: "systemStart", tag: "system", summary: "Start the naming service and nodes", query: []string{"nodes"}, handler: c.handleSystemStart},
+		{method: "POST", path: "/api/system/stop", id: "systemStop", tag: "system", summary: "Stop everything the gateway started", handler: c.handleSystemStop},
+		{method: "GET", path: "/api/system/status", id: "systemStatus", tag: "system", summary: "Processes or containers the gateway manages", handler: c.handleSystemStatus},
+		{method: "POST", path: "/api/system/stop-node", id: "stopNode", tag: "system", summary: "Stop a node", body: nodeRequest{}, handler: c.handleStopNode},
+		{method: "POST", path: "/api/system/start-node", id: "startNode", tag: "system", summary: "Start a node", body: nodeRequest{}, handler: c.handleStartNode},
+		{method: "POST", path: "/api/system/add-node", id: "addNode", tag: "system", summary: "Add a node to the topology and start it", body: topoNode{}, handler: c.handleAddNode},
+		{method: "POST", path: "/api/system/remove-node", id: "removeNode", tag: "system", summary: "Stop a node and drop it from the topology", body: nodeRequest{}, handler: c.handleRemoveNode},
+		{method: "POST", path: "/api/nodes/maintenance", id: "setNodeMaintenance", tag: "system", summary: "Put a node into maintenance, or take it out", body: nodeMaintenanceRequest{}, handler: c.handleNodeMaintenance},
+		{method: "GET", path: "/api/settings", id: "getSettings", tag: "system", summary: "The naming service's runtime settings", handler: c.handleSettings},
+		{method: "PUT", path: "/api/settings", id: "updateSettings", tag: "system", summary: "Change runtime settings", body: map[string]any{}, handler: c.handleSettings},
+	}
+}
+
+// OpenAPI is the OpenAPI 3 document for the gateway, built from routes.
+// ui_gateway/cmd/openapi writes it to api/ for the client generator.
+func OpenAPI() []byte {
+	var ops []route
+	for _, rt := range (cfg{}).routes() {
+		if !rt.page {
+			ops = append(ops, rt)
+		}
+	}
+	doc := openAPIDoc("UI Gateway", Version, ops)
+	for _, item := range doc["paths"].(map[string]any) {
+		for method, op := range item.(map[string]any) {
+			op := op.(map[string]any)
+			path := op["x-path"].(string)
+			delete(op, "x-path")
+			r := &http.Request{Method: strings.ToUpper(method), URL: &url.URL{Path: path}}
+			if rl := requiredRole(r); rl != rolePublic {
+				op["security"] = []any{map[string]any{"session": []string{}}}
+				op["x-required-role"] = rl.String()
+			}
+		}
+	}
+	doc["components"].(map[string]any)["securitySchemes"] = map[string]any{
+		"session": map[string]any{"type": "apiKey", "in": "cookie", "name": sessionCookie,
+			"description": "Set by /api/login or single sign-on; only needed when accounts are on"},
+	}
+	b, _ := json.MarshalIndent(doc, "", "  ")
+	return append(b, '\n')
+}
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(OpenAPI())
+}
+
+var pathParam = regexp.MustCompile(`\{(\w+)\}`)
+
+// openAPIDoc describes routes. Request and response types are turned into
+// schemas by reflection over their JSON fields. It is the naming service's
+// builder plus multipart bodies.
+func openAPIDoc(title, version string, routes []route) map[string]any {
+	schemas := map[string]any{}
+	paths := map[string]any{}
+	// The envelope is published as "Error", the same name naming uses.
+	schemas["Error"] = structSchema(schemas, reflect.TypeFor[apiError]())
+	errorSchema := map[string]any{"$ref": "#/components/schemas/Error"}
+	for _, rt := range routes {
+		var params []any
+		for _, m := range pathParam.FindAllStringSubmatch(rt.path, -1) {
+			params = append(params, map[string]any{"name": m[1], "in": "path", "required": true, "schema": map[string]any{"type": "string"}})
+		}
+		for _, q := range rt.query {
+			params = append(params, map[string]any{"name": q, "in": "query", "schema": map[string]any{"type": "string"}})
+		}
+		var content map[string]any
+		switch {
+		case rt.raw != "":
+			content = map[string]any{rt.raw: map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}}
+		case rt.returns != nil:
+			content = map[string]any{"application/json": map[string]any{"schema": schemaOf(schemas, reflect.TypeOf(rt.returns))}}
+		default:
+			content = map[string]any{"application/json": map[string]any{"schema": map[string]any{"type": "object"}}}
+		}
+		status := cmp.Or(rt.status, http.StatusOK)
+		op := map[string]any{
+			"operationId": rt.id, "summary": rt.summary, "tags": []string{rt.tag}, "x-path": rt.path,
+			"responses": map[string]any{
+				strconv.Itoa(status): map[string]any{"description": http.StatusText(status), "content": content},
+				"default":            map[string]any{"description": "Error", "content": map[string]any{"application/json": map[string]any{"schema": errorSchema}}},
+			},
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+		switch {
+		case rt.form:
+			op["requestBody"] = map[string]any{"required": true, "content": map[string]any{
+				"multipart/form-data": map[string]any{"schema": map[string]any{"type": "object"}},
+			}}
+		case rt.body != nil:
+			op["requestBody"] = map[string]any{"required": true, "content": map[string]any{
+				"application/json": map[string]any{"schema": schemaOf(schemas, reflect.TypeOf(rt.body))},
+			}}
+		}
+		if paths[rt.path] == nil {
+			paths[rt.path] = map[string]any{}
+		}
+		paths[rt.path].(map[string]any)[strings.ToLower(rt.method)] = op
+	}
+	return map[string]any{
+		"openapi":    "3.0.3",
+		"info":       map[string]any{"title": title, "version": version},
+		"paths":      paths,
+		"components": map[string]any{"schemas": schemas},
+	}
+}
+
+var (
+	timeType          = reflect.TypeFor[time.Time]()
+	textMarshalerType = reflect.TypeFor[encoding.TextMarshaler]()
+)
+
+// schemaOf returns the JSON schema of t as encoding/json marshals it.
+// Named structs go into schemas and are referenced, so recursive types
+// terminate.
+func schemaOf(schemas map[string]any, t reflect.Type) map[string]any {
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t.Kind() != reflect.Pointer && reflect.PointerTo(t).Implements(textMarshalerType):
+		return map[string]any{"type": "string"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaOf(schemas, t.Elem())
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]any{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": schemaOf(schemas, t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaOf(schemas, t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(schemas, t)
+		}
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if _, ok := schemas[name]; !ok {
+			schemas[name] = nil // placeholder while the fields are walked
+			schemas[name] = structSchema(schemas, t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]any{} // interfaces: anything
+}
+
+func structSchema(schemas map[string]any, t reflect.Type) map[string]any {
+	props := map[string]any{}
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		for i := range t.NumField() {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" || (!f.IsExported() && !f.Anonymous) {
+				continue
+			}
+			name, _, _ := strings.Cut(tag, ",")
+			if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+				walk(f.Type) // embedded fields are promoted
+				continue
+			}
+			props[cmp.Or(name, f.Name)] = schemaOf(schemas, f.Type)
+		}
+	}
+	walk(t)
+	return map[string]any{"type": "object", "properties": props}
+}
+
+/* ---------------- JSON RESP ---------------- */
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+/* ---------------- DIAGNOSTICS ---------------- */
+
+// With DEBUG_ENDPOINTS on the gateway serves, behind ADMIN_TOKEN:
+//
+//	/debug/pprof/...  the net/http/pprof profiles
+//	/debug/vars       expvar
+//	/debug/status     goroutines, heap, GC and lock waits, plus gauges
+//
+// This is a copy of internal/diag in the root module; keep the two in step.
+
+// mutexProfileFraction samples one in this many contended lock events for
+// /debug/pprof/mutex once diagnostics are on.
+const mutexProfileFraction = 100
+
+var started = time.Now()
+
+// debugStatus is the body of GET /debug/status.
+type debugStatus struct {
+	Service    string         `json:"service"`
+	Version    string         `json:"version"`
+	GoVersion  string         `json:"goVersion"`
+	StartedAt  time.Time      `json:"startedAt"`
+	Uptime     string         `json:"uptime"`
+	CPUs       int            `json:"cpus"`
+	GOMAXPROCS int            `json:"gomaxprocs"`
+	Goroutines int            `json:"goroutines"`
+	Heap       debugHeap      `json:"heap"`
+	GC         debugGC        `json:"gc"`
+	Locks      debugLocks     `json:"locks"`
+	Gauges     map[string]any `json:"gauges,omitempty"`
+}
+
+type debugHeap struct {
+	AllocBytes  uint64 `json:"allocBytes"` // live objects
+	SysBytes    uint64 `json:"sysBytes"`   // obtained from the OS
+	Objects     uint64 `json:"objects"`
+	NextGCBytes uint64 `json:"nextGcBytes"`
+}
+
+type debugGC struct {
+	Cycles      uint32    `json:"cycles"`
+	LastAt      time.Time `json:"lastAt,omitzero"`
+	LastPause   string    `json:"lastPause"`
+	TotalPause  string    `json:"totalPause"`
+	CPUFraction float64   `json:"cpuFraction"` // of CPU time since start
+}
+
+// debugLocks is how long goroutines have waited for a sync.Mutex or
+// RWMutex since start; /debug/pprof/mutex says where.
+type debugLocks struct {
+	WaitTotal string `json:"waitTotal"`
+}
+
+// registerDebug adds the /debug/ endpoints to mux, each wrapped in guard,
+// and turns on mutex profiling.
+func registerDebug(mux *http.ServeMux, guard func(http.HandlerFunc) http.HandlerFunc, gauges func() map[string]any) {
+	runtime.SetMutexProfileFraction(mutexProfileFraction)
+	mux.HandleFunc("GET /debug/pprof/", guard(pprof.Index))
+	mux.HandleFunc("GET /debug/pprof/cmdline", guard(pprof.Cmdline))
+	mux.HandleFunc("GET /debug/pprof/profile", guard(pprof.Profile))
+	mux.HandleFunc("GET /debug/pprof/symbol", guard(pprof.Symbol))
+	mux.HandleFunc("POST /debug/pprof/symbol", guard(pprof.Symbol))
+	mux.HandleFunc("GET /debug/pprof/trace", guard(pprof.Trace))
+	mux.HandleFunc("GET /debug/vars", guard(expvar.Handler().ServeHTTP))
+	mux.HandleFunc("GET /debug/status", guard(func(w http.ResponseWriter, r *http.Request) {
+		st := readDebugStatus()
+		st.Gauges = gauges()
+		writeJSON(w, st)
+	}))
+}
+
+func readDebugStatus() debugStatus {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	st := debugStatus{
+		Service:    "ui-gateway",
+		Version:    Version,
+		GoVersion:  runtime.Version(),
+		StartedAt:  started.UTC(),
+		Uptime:     time.Since(started).Round(time.Second).String(),
+		CPUs:       runtime.NumCPU(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		Goroutines: runtime.NumGoroutine(),
+		Heap:       debugHeap{AllocBytes: ms.HeapAlloc, SysBytes: ms.HeapSys, Objects: ms.HeapObjects, NextGCBytes: ms.NextGC},
+		GC: debugGC{
+			Cycles:      ms.NumGC,
+			LastPause:   time.Duration(ms.PauseNs[(ms.NumGC+255)%256]).String(),
+			TotalPause:  time.Duration(ms.PauseTotalNs).String(),
+			CPUFraction: ms.GCCPUFraction,
+		},
+	}
+	if ms.LastGC > 0 {
+		st.GC.LastAt = time.Unix(0, int64(ms.LastGC)).UTC()
+	}
+	sample := []metrics.Sample{{Name: "/sync/mutex/wait/total:seconds"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() == metrics.KindFloat64 {
+		st.Locks.WaitTotal = time.Duration(sample[0].Value.Float64() * float64(time.Second)).String()
+	}
+	return st
+}
+
+// debugGuard checks the ADMIN_TOKEN bearer token, as the nodes' admin API
+// does.
+func (c cfg) debugGuard(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if c.AdminToken == "" || subtle.ConstantTimeCompare([]byte(got), []byte(c.AdminToken)) != 1 {
+			writeError(w, http.StatusUnauthorized, codeInvalidAdminToken, "invalid admin token")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// debugGauges are the gateway's own figures on /debug/status.
+func (s *Server) debugGauges() map[string]any {
+	s.rl.mu.Lock()
+	uploads := s.rl.uploads
+	s.rl.mu.Unlock()
+	g := map[string]any{"openUploads": uploads, "openCircuits": len(s.c.nodeCalls.circuits())}
+	if a := s.c.auth; a != nil {
+		a.mu.Lock()
+		g["sessions"] = len(a.sessions)
+		a.mu.Unlock()
+	}
+	if bc := s.c.cache; bc != nil {
+		bc.mu.Lock()
+		g["cacheBytes"], g["cacheFiles"] = bc.used, len(bc.byID)
+		bc.mu.Unlock()
+	}
+	return g
+}
+
+/* ---------------- ERRORS ---------------- */
+
+// apiError is the body of every non-2xx JSON response. The naming service
+// and the nodes answer with the same envelope (internal/apierr in the root
+// module); keep the two copies in step. Their codes are relayed as they
+// are, so only the ones the gateway raises itself are listed here.
+type apiError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Detail    any    `json:"detail,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// Error codes; API_DOCS.md lists what each means.
+const (
+	codeBadRequest       = "BAD_REQUEST"
+	codeInvalidJSON      = "INVALID_JSON"
+	codeMissingParameter = "MISSING_PARAMETER"
+	codeMethodNotAllowed = "METHOD_NOT_ALLOWED"
+
+	codeNotFound      = "NOT_FOUND"
+	codeFileNotFound  = "FILE_NOT_FOUND"
+	codeNodeNotFound  = "NODE_NOT_FOUND"
+	codeShareNotFound = "SHARE_NOT_FOUND"
+	codeUserNotFound  = "USER_NOT_FOUND"
+
+	codeConflict = "CONFLICT"
+
+	codeLoginRequired     = "LOGIN_REQUIRED"
+	codeBadCredentials    = "BAD_CREDENTIALS"
+	codeForbidden         = "FORBIDDEN"
+	codePermissionDenied  = "PERMISSION_DENIED"
+	codeCrossOrigin       = "CROSS_ORIGIN_DENIED"
+	codeFeatureDisabled   = "FEATURE_DISABLED"
+	codeInvalidAdminToken = "INVALID_ADMIN_TOKEN"
+
+	codePayloadTooLarge  = "PAYLOAD_TOO_LARGE"
+	codeUnsupportedType  = "UNSUPPORTED_CONTENT_TYPE"
+	codeRateLimited      = "RATE_LIMITED"
+	codeReplicasTooFew   = "INSUFFICIENT_REPLICAS"
+	codeChecksumMismatch = "CHECKSUM_MISMATCH"
+	codeUpstreamError    = "UPSTREAM_ERROR"
+	codeTimeout          = "TIMEOUT"
+	codeInternal         = "INTERNAL"
+)
+
+// requestIDHeader carries the request ID; upstreamRequestIDHeader names
+// the naming service's or node's ID for the request whose error is relayed.
+const (
+	requestIDHeader         = "X-Request-Id"
+	upstreamRequestIDHeader = "X-Upstream-Request-Id"
+)
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeErrorDetail(w, status, code, message, nil)
+}
+
+func writeErrorDetail(w http.ResponseWriter, status int, code, message string, detail any) {
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(apiError{Code: code, Message: message, Detail: detail, RequestID: h.Get(requestIDHeader)})
+}
+
+// withRequestID keeps the caller's X-Request-Id when it is sane, or makes
+// a new one, and echoes it on the response.
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			var b [8]byte
+			_, _ = crand.Read(b[:])
+			id = hex.EncodeToString(b[:])
+			r.Header.Set(requestIDHeader, id)
+		}
+		w.Header().Set(requestIDHeader, id)
+		h.ServeHTTP(w, r)
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseError reads an error body from the naming service or a node; one
+// that is not an envelope (an older node answering in plain text) gets code
+// UPSTREAM_ERROR and its text as the message.
+func parseError(body []byte) *apiError {
+	var e apiError
+	if json.Unmarshal(body, &e) == nil && e.Code != "" {
+		return &e
+	}
+	return &apiError{Code: codeUpstreamError, Message: strings.TrimSpace(string(body))}
+}
+
+// relayError answers with an error the naming service or a node returned.
+// Code, message and detail pass through so clients see QUOTA_EXCEEDED or
+// INSUFFICIENT_NODES as they were raised; 4xx and 503 keep their status,
+// any other 5xx becomes 502 since the fault is behind the gateway. The
+// upstream request ID goes in X-Upstream-Request-Id.
+func relayError(w http.ResponseWriter, status int, body []byte) {
+	e := parseError(body)
+	if status/100 == 5 && status != http.StatusServiceUnavailable {
+		status = http.StatusBadGateway
+	}
+	if e.RequestID != "" {
+		w.Header().Set(upstreamRequestIDHeader, e.RequestID)
+	}
+	writeErrorDetail(w, status, e.Code, e.Message, e.Detail)
+}
+
+// relay copies a naming service reply to the client, passing errors
+// through relayError.
+func relay(w http.ResponseWriter, resp *http.Response) {
+	if resp.StatusCode >= 400 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		relayError(w, resp.StatusCode, b)
+		return
+	}
+	for _, h := range []string{"Content-Type", "Content-Disposition"} {
+		if v := resp.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// writeUpstreamError answers for a failed call to the naming service or a
+// node: a *statusError is relayed, anything else means it was unreachable.
+func writeUpstreamError(w http.ResponseWriter, what string, err error) {
+	var se *statusError
+	if errors.As(err, &se) {
+		relayError(w, se.Code, []byte(se.Body))
+		return
+	}
+	writeErrorDetail(w, http.StatusBadGateway, codeUpstreamError, what, err.Error())
+}
+
+/* ---------------- ADMIN API ---------------- */
+
+const catalogRevisionHeader = "X-Catalog-Revision"
+
+func (c cfg) handleListFiles(w http.ResponseWriter, r *http.Request) {
+	if len(c.shards) > 1 {
+		list, etag, revision, err := c.listFiles(r.Context())
+		if err != nil {
+			writeUpstreamError(w, "failed to get files", err)
+			return
+		}
+		w.Header().Set(catalogRevisionHeader, revision)
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(list)
+		return
+	}
+	req, _ := http.NewRequestWithContext(r.Context(), http.MethodGet, c.namingURL()+"/list-files", nil)
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		req.Header.Set("If-None-Match", inm)
+	}
+	resp, err := c.httpClient(0).Do(req)
+	if err != nil {
+		writeUpstreamError(w, "failed to get files", err)
+		return
+	}
+	defer resp.Body.Close()
+	for _, h := range []string{catalogRevisionHeader, "ETag"} {
+		if v := resp.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if resp.StatusCode/100 != 2 {
+		relay(w, resp)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	io.Copy(w, resp.Body)
+}
+
+func (c cfg) handleListNodes(w http.ResponseWriter, r *http.Request) {
+	resp, err := c.httpGet(r.Context(), 0, c.namingURL()+"/list-nodes")
+	if err != nil {
+		writeUpstreamError(w, "failed to get nodes", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		relay(w, resp)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	io.Copy(w, resp.Body)
+}
+
+func (c cfg) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	m, revision, err := c.clusterMetrics(r.Context())
+	if err != nil {
+		writeUpstreamError(w, "failed to get metrics", err)
+		return
+	}
+	w.Header().Set(catalogRevisionHeader, revision)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(m, '\n'))
+}
+
+// deleteRequest is the body of POST /api/delete.
+type deleteRequest struct {
+	FileID string `json:"fileId"`
+}
+
+// handleDeleteFile serves DELETE /api/files?fileId= and the older POST
+// /api/delete, which names the file in its body.
+func (c cfg) handleDeleteFile(w http.ResponseWriter, r *http.Request) {
+	var body deleteRequest
+	if r.Method == http.MethodDelete {
+		body.FileID = r.URL.Query().Get("fileId")
+	} else if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidJSON, "bad json")
+		return
+	}
+	fid := body.FileID
+	if fid == "" {
+		writeError(w, http.StatusBadRequest, codeMissingParameter, "missing fileId")
+		return
+	}
+	if !c.authorize(w, r, fid, "delete") {
+		return
+	}
+	if dry := r.URL.Query().Get("dryRun"); dry == "true" || dry == "1" {
+		dreq, _ := http.NewRequestWithContext(r.Context(), http.MethodDelete, c.namingFor(fid)+"/files/"+url.PathEscape(fid)+"?dryRun=true", nil)
+		dr, err := c.httpClient(0).Do(dreq)
+		if err != nil {
+			writeUpstreamError(w, "delete failed", err)
+			return
+		}
+		defer dr.Body.Close()
+		relay(w, dr)
+		return
+	}
+	// once blobs start going the delete is finished, client or not, so the
+	// catalog never points at removed replicas
+	ctx := context.WithoutCancel(r.Context())
+	// the naming service drops derived files (previews) with the parent,
+	// so their blobs go first
+	for _, id := range c.derivedOf(ctx, fid) {
+		c.deleteReplicas(ctx, id)
+	}
+	deletedNodes := c.deleteReplicas(ctx, fid)
+	dreq, _ := http.NewRequestWithContext(ctx, http.MethodDelete, c.namingFor(fid)+"/files/"+url.PathEscape(fid), nil)
+	dreq.Header.Set(actorHeader, callerOf(r))
+	dr, err := c.httpClient(0).Do(dreq)
+	if err != nil {
+		writeUpstreamError(w, "delete failed", err)
+		return
+	}
+	defer dr.Body.Close()
+	if dr.StatusCode >= 400 {
+		relay(w, dr)
+		return
+	}
+	var done struct {
+		AlreadyDeleted bool `json:"alreadyDeleted"`
+	}
+	_ = json.NewDecoder(dr.Body).Decode(&done)
+	out := map[string]any{"fileId": fid, "deleted": true, "nodes": deletedNodes}
+	if done.AlreadyDeleted {
+		out["alreadyDeleted"] = true // a repeated delete
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// deleteReplicas removes fid's blob from every node holding it and returns
+// the nodes that answered.
+func (c cfg) deleteReplicas(ctx context.Context, fid string) []string {
+	return c.removeReplicas(ctx, fid, c.replicasOf(ctx, fid))
+}
+
+// replicaRef is one replica as /lookup lists it.
+type replicaRef struct{ NodeID, URL string }
+
+// replicasOf is where fid's blobs are, asked so that it is not counted as
+// a read.
+func (c cfg) replicasOf(ctx context.Context, fid string) []replicaRef {
+	lr, err := c.httpGet(ctx, 0, c.namingFor(fid)+"/lookup/"+fid+"?peek=1")
+	var replicas []replicaRef
+	if err == nil {
+		defer lr.Body.Close()
+		_ = json.NewDecoder(lr.Body).Decode(&replicas)
+	}
+	return replicas
+}
+
+// removeReplicas deletes fid's blob from replicas and returns the nodes
+// that answered.
+func (c cfg) removeReplicas(ctx context.Context, fid string, replicas []replicaRef) []string {
+	deletedNodes := []string{}
+	for _, rep := range replicas {
+		rreq, _ := http.NewRequestWithContext(ctx, http.MethodDelete, strings.TrimRight(rep.URL, "/")+"/files/"+url.PathEscape(fid), nil)
+		rr, err := c.httpClient(2 * time.Second).Do(rreq)
+		if err == nil {
+			deletedNodes = append(deletedNodes, rep.NodeID)
+			if rr != nil {
+				rr.Body.Close()
+			}
+		}
+	}
+	c.cache.drop(fid)
+	return deletedNodes
+}
+
+// batchRequest is the body of POST /api/batch.
+type batchRequest struct {
+	Commit []uploadCommitRequest `json:"commit,omitempty"`
+	Delete []string              `json:"delete,omitempty"` // file IDs
+}
+
+// batchDeleted is one deleted file in a /api/batch answer.
+type batchDeleted struct {
+	FileID         string   `json:"fileId"`
+	Derived        []string `json:"derived"`
+	AlreadyDeleted bool     `json:"alreadyDeleted,omitempty"`
+	Nodes          []string `json:"nodes"`
+}
+
+// handleBatch commits direct uploads and deletes files in one catalog
+// change: the naming service applies all of it or, with 409 and each
+// failure, none. A batch's files must be on one naming shard, which every
+// file of one owner is (namingForNew). Unlike a single delete, blobs go
+// after the catalog has let go of them, so a refused batch leaves every
+// file whole; where they are is read first, as it cannot be asked
+// afterwards. With ?dryRun=true the naming service only checks the batch
+// and its answer is relayed; no blob is touched.
+func (c cfg) handleBatch(w http.ResponseWriter, r *http.Request) {
+	var body batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidJSON, "bad json")
+		return
+	}
+	ids := slices.Clone(body.Delete)
+	for _, cm := range body.Commit {
+		ids = append(ids, cm.FileID)
+	}
+	if len(ids) == 0 {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "nothing to commit or delete")
+		return
+	}
+	shard := shardOf(ids[0], len(c.shards))
+	for _, id := range ids {
+		if shardOf(id, len(c.shards)) != shard {
+			writeErrorDetail(w, http.StatusBadRequest, codeBadRequest, "the files of a batch must be on one naming shard, as one owner's are", id)
+			return
+		}
+	}
+	commits := make([]map[string]any, 0, len(body.Commit))
+	for _, cm := range body.Commit {
+		commit, ok := c.claimCommit(w, r, cm)
+		if !ok {
+			return
+		}
+		commits = append(commits, commit)
+	}
+	if dry := r.URL.Query().Get("dryRun"); dry == "true" || dry == "1" {
+		for _, fid := range body.Delete {
+			if !c.authorize(w, r, fid, "delete") {
+				return
+			}
+		}
+		b, _ := json.Marshal(map[string]any{"commit": commits, "delete": body.Delete})
+		req, _ := http.NewRequestWithContext(r.Context(), http.MethodPost, c.shards[shard].url()+"/batch?dryRun=true", bytes.NewReader(b))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := c.httpClient(0).Do(req)
+		if err != nil {
+			writeUpstreamError(w, "batch failed", err)
+			return
+		}
+		defer resp.Body.Close()
+		relay(w, resp)
+		return
+	}
+	replicas := map[string][]replicaRef{}
+	for _, fid := range body.Delete {
+		if !c.authorize(w, r, fid, "delete") {
+			return
+		}
+		replicas[fid] = c.replicasOf(r.Context(), fid)
+		for _, id := range c.derivedOf(r.Context(), fid) {
+			replicas[id] = c.replicasOf(r.Context(), id)
+		}
+	}
+
+	// once the naming service has the batch, the blobs go, client or not
+	ctx := context.WithoutCancel(r.Context())
+	b, _ := json.Marshal(map[string]any{"commit": commits, "delete": body.Delete})
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, c.shards[shard].url()+"/batch", bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(actorHeader, callerOf(r))
+	resp, err := c.httpClient(0).Do(req)
+	if err != nil {
+		writeUpstreamError(w, "batch failed", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		relay(w, resp)
+		return
+	}
+	var done struct {
+		Committed []json.RawMessage `json:"committed"`
+		Deleted   []batchDeleted    `json:"deleted"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&done); err != nil {
+		writeErrorDetail(w, http.StatusBadGateway, codeUpstreamError, "bad response from naming service", err.Error())
+		return
+	}
+	for _, cm := range body.Commit {
+		c.cache.drop(cm.FileID)
+		go c.previewStored(cm.FileID)
+	}
+	for i, d := range done.Deleted {
+		for _, id := range d.Derived {
+			c.removeReplicas(ctx, id, replicas[id])
+		}
+		done.Deleted[i].Nodes = c.removeReplicas(ctx, d.FileID, replicas[d.FileID])
+	}
+	writeJSON(w, done)
+}
+
+// handleAudit relays the naming service's audit log; with several shards,
+// every shard's entries, oldest first.
+func (c cfg) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if c.spansShards(r) {
+		c.writeGathered(w, r, "/audit", r.URL.Query(), listOf("time", false), "failed to get audit log")
+		return
+	}
+	base, ok := c.namingOf(w, r)
+	if !ok {
+		return
+	}
+	resp, err := c.httpGet(r.Context(), 0, base+"/audit?"+r.URL.RawQuery)
+	if err != nil {
+		writeUpstreamError(w, "failed to get audit log", err)
+		return
+	}
+	defer resp.Body.Close()
+	relay(w, resp)
+}
+
+// handlePopular relays the naming service's most read files, ranked
+// across every shard when there are several.
+func (c cfg) handlePopular(w http.ResponseWriter, r *http.Request) {
+	if c.spansShards(r) {
+		c.writeGathered(w, r, "/popular", r.URL.Query(), mergePopular, "failed to get popular files")
+		return
+	}
+	base, ok := c.namingOf(w, r)
+	if !ok {
+		return
+	}
+	resp, err := c.httpGet(r.Context(), 0, base+"/popular?"+r.URL.RawQuery)
+	if err != nil {
+		writeUpstreamError(w, "failed to get popular files", err)
+		return
+	}
+	defer resp.Body.Close()
+	relay(w, resp)
+}
+
+// handleIntegrityReport relays the naming service's integrity report,
+// keeping its content type so ?format=csv downloads as a file. With
+// several shards every shard's report is joined into one.
+func (c cfg) handleIntegrityReport(w http.ResponseWriter, r *http.Request) {
+	if c.spansShards(r) {
+		if r.URL.Query().Get("format") == "csv" {
+			c.writeIntegrityCSV(w, r)
+			return
+		}
+		c.writeGathered(w, r, "/integrity-report", r.URL.Query(), mergeIntegrity, "failed to get integrity report")
+		return
+	}
+	base, ok := c.namingOf(w, r)
+	if !ok {
+		return
+	}
+	resp, err := c.httpGet(r.Context(), 0, base+"/integrity-report?"+r.URL.RawQuery)
+	if err != nil {
+		writeUpstreamError(w, "failed to get integrity report", err)
+		return
+	}
+	defer resp.Body.Close()
+	relay(w, resp)
+}
+
+// actorHeader tells the naming service who asked for a destructive
+// operation so it lands in its audit log.
+const actorHeader = "X-Actor"
+
+// callerOf identifies the gateway's client: the X-User header when the
+// caller supplies one, plus its remote address.
+func callerOf(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if u := r.Header.Get("X-User"); u != "" {
+		return u + "@" + host
+	}
+	return host
+}
+
+// tenantOf is the owner the caller's uploads count against for quotas:
+// the X-Tenant header, else X-User, else nobody in particular.
+func tenantOf(r *http.Request) string {
+	if t := r.Header.Get("X-Tenant"); t != "" {
+		return t
+	}
+	return r.Header.Get("X-User")
+}
+
+// handleQuota relays the naming service's /quota. Without ?owner= the
+// caller's own tenant is shown, or every quota for an anonymous caller.
+func (c cfg) handleQuota(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if !q.Has("owner") {
+		if t := tenantOf(r); t != "" {
+			q.Set("owner", t)
+		}
+	}
+	if c.spansShards(r) {
+		c.writeGathered(w, r, "/quota", q, mergeQuotas, "failed to get quota")
+		return
+	}
+	base, ok := c.namingOf(w, r)
+	if !ok {
+		return
+	}
+	u := base + "/quota"
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	resp, err := c.httpGet(r.Context(), 0, u)
+	if err != nil {
+		writeUpstreamError(w, "failed to get quota", err)
+		return
+	}
+	defer resp.Body.Close()
+	relay(w, resp)
+}
+
+// audit records an action the gateway performs itself (e.g. killing the
+// processes it started) in the naming service's audit log, whether or not
+// the client waits for it. The naming service only takes entries that carry
+// its admin token.
+func (c cfg) audit(r *http.Request, action, target string) {
+	b, _ := json.Marshal(map[string]string{"actor": callerOf(r), "action": action, "target": target})
+	req, _ := http.NewRequestWithContext(context.WithoutCancel(r.Context()), http.MethodPost, c.namingURL()+"/audit", bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.AdminToken)
+	resp, err := c.httpClient(10 * time.Second).Do(req)
+	if err != nil {
+		log.Printf("audit %s: %v", action, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Printf("audit %s: naming answered %s", action, resp.Status)
+	}
+}
+
+func (c cfg) handleVerify(w http.ResponseWriter, r *http.Request) {
+	fid := r.URL.Query().Get("fileId")
+	if fid == "" {
+		writeError(w, http.StatusBadRequest, codeMissingParameter, "missing fileId")
+		return
+	}
+	timeout := 20 * time.Second
+	if d, err := time.ParseDuration(r.URL.Query().Get("timeout")); err == nil && d > 0 && d < 5*time.Minute {
+		timeout = d
+	}
+	u := c.namingFor(fid) + "/verify-file?fileId=" + url.QueryEscape(fid) + "&timeout=" + timeout.String()
+	resp, err := c.httpGet(r.Context(), timeout+5*time.Second, u)
+	if err != nil {
+		writeErrorDetail(w, http.StatusGatewayTimeout, codeTimeout, "verification timed out", err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	relay(w, resp)
+}
+
+// handleOperations relays the naming service's background operations;
+// with several shards, every shard's, newest first.
+func (c cfg) handleOperations(w http.ResponseWriter, r *http.Request) {
+	if c.spansShards(r) {
+		c.writeGathered(w, r, "/operations", r.URL.Query(), listOf("startedAt", true), "failed to get operations")
+		return
+	}
+	base, ok := c.namingOf(w, r)
+	if !ok {
+		return
+	}
+	resp, err := c.httpGet(r.Context(), 0, base+"/operations?"+r.URL.RawQuery)
+	if err != nil {
+		writeUpstreamError(w, "failed to get operations", err)
+		return
+	}
+	defer resp.Body.Close()
+	relay(w, resp)
+}
+
+// idRequest is the body of POST /api/operations/cancel, passed on to the
+// naming service.
+type idRequest struct {
+	ID string `json:"id"`
+}
+
+// handleCancelOperation forwards a cancel to the naming service, whose
+// admin API takes it with the gateway's ADMIN_TOKEN.
+func (c cfg) handleCancelOperation(w http.ResponseWriter, r *http.Request) {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "cannot read body")
+		return
+	}
+	var body idRequest
+	_ = json.Unmarshal(b, &body) // the naming service judges the body
+	req, _ := http.NewRequestWithContext(r.Context(), http.MethodPost, c.namingFor(body.ID)+"/operations/cancel", bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.AdminToken)
+	req.Header.Set(actorHeader, callerOf(r))
+	resp, err := c.httpClient(0).Do(req)
+	if err != nil {
+		writeUpstreamError(w, "cancel failed", err)
+		return
+	}
+	defer resp.Body.Close()
+	relay(w, resp)
+}
+
+// handleHeal asks the naming service to queue one file for repair.
+func (c cfg) handleHeal(w http.ResponseWriter, r *http.Request) {
+	fid := r.URL.Query().Get("fileId")
+	if fid == "" {
+		writeError(w, http.StatusBadRequest, codeMissingParameter, "missing fileId")
+		return
+	}
+	req, _ := http.NewRequestWithContext(r.Context(), http.MethodPost, c.namingFor(fid)+"/heal/"+url.PathEscape(fid), nil)
+	req.Header.Set(actorHeader, callerOf(r))
+	resp, err := c.httpClient(0).Do(req)
+	if err != nil {
+		writeUpstreamError(w, "heal request failed", err)
+		return
+	}
+	defer resp.Body.Close()
+	relay(w, resp)
+}
+
+// handleHealQueue relays the naming service's heal queue; with several
+// shards, every shard's queue joined.
+func (c cfg) handleHealQueue(w http.ResponseWriter, r *http.Request) {
+	if c.spansShards(r) {
+		c.writeGathered(w, r, "/heal-queue", nil, mergeHealQueues, "failed to get heal queue")
+		return
+	}
+	base, ok := c.namingOf(w, r)
+	if !ok {
+		return
+	}
+	resp, err := c.httpGet(r.Context(), 0, base+"/heal-queue")
+	if err != nil {
+		writeUpstreamError(w, "failed to get heal queue", err)
+		return
+	}
+	defer resp.Body.Close()
+	relay(w, resp)
+}
+
+func (c cfg) handleLifecycle(w http.ResponseWriter, r *http.Request) {
+	base, ok := c.namingOf(w, r)
+	if !ok {
+		return
+	}
+	resp, err := c.httpGet(r.Context(), 0, base+"/lifecycle")
+	if err != nil {
+		writeUpstreamError(w, "failed to get lifecycle rules", err)
+		return
+	}
+	defer resp.Body.Close()
+	relay(w, resp)
+}
+
+// handleMetricsHistory relays the naming service's /metrics/history for
+// the dashboard's charts.
+func (c cfg) handleMetricsHistory(w http.ResponseWriter, r *http.Request) {
+	base, ok := c.namingOf(w, r)
+	if !ok {
+		return
+	}
+	resp, err := c.httpGet(r.Context(), 0, base+"/metrics/history?"+r.URL.RawQuery)
+	if err != nil {
+		writeUpstreamError(w, "failed to get metrics history", err)
+		return
+	}
+	defer resp.Body.Close()
+	relay(w, resp)
+}
+
+// handleCapacityForecast relays the naming service's /capacity-forecast
+// with its usage series, which the dashboard charts, unless ?series=false.
+func (c cfg) handleCapacityForecast(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if !q.Has("series") {
+		q.Set("series", "true")
+	}
+	resp, err := c.httpGet(r.Context(), 0, c.namingURL()+"/capacity-forecast?"+q.Encode())
+	if err != nil {
+		writeUpstreamError(w, "failed to get capacity forecast", err)
+		return
+	}
+	defer resp.Body.Close()
+	relay(w, resp)
+}
+
+func (c cfg) handleNodeHealth(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("nodeId")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, codeMissingParameter, "missing nodeId")
+		return
+	}
+	resp, err := c.httpGet(r.Context(), 0, c.namingURL()+"/node-health/"+url.PathEscape(id))
+	if err != nil {
+		writeUpstreamError(w, "failed to get node health", err)
+		return
+	}
+	defer resp.Body.Close()
+	relay(w, resp)
+}
+
+// handleTopology relays the naming service's topology export, which sits
+// behind its admin API.
+func (c cfg) handleTopology(w http.ResponseWriter, r *http.Request) {
+	req, _ := http.NewRequestWithContext(r.Context(), http.MethodGet, c.namingURL()+"/admin/export-topology?"+r.URL.RawQuery, nil)
+	req.Header.Set("Authorization", "Bearer "+c.AdminToken)
+	resp, err := c.httpClient(0).Do(req)
+	if err != nil {
+		writeUpstreamError(w, "failed to export topology", err)
+		return
+	}
+	defer resp.Body.Close()
+	relay(w, resp)
+}
+
+// nodeMaintenanceRequest is the body of POST /api/nodes/maintenance.
+type nodeMaintenanceRequest struct {
+	NodeID  string `json:"nodeId"`
+	Enabled bool   `json:"enabled"`
+}
+
+// handleNodeMaintenance forwards {nodeId, enabled} to the naming service's
+// admin API using the gateway's ADMIN_TOKEN.
+func (c cfg) handleNodeMaintenance(w http.ResponseWriter, r *http.Request) {
+	c.toShards(w, r, http.MethodPost, "/admin/node-maintenance", "maintenance change failed")
+}
+
+// handleSettings relays GET/PUT of the cluster settings to the naming
+// service's admin API using the gateway's ADMIN_TOKEN.
+func (c cfg) handleSettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		c.toShards(w, r, r.Method, "/admin/settings", "settings request failed")
+		return
+	}
+	req, _ := http.NewRequestWithContext(r.Context(), r.Method, c.namingURL()+"/admin/settings", r.Body)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.AdminToken)
+	req.Header.Set(actorHeader, callerOf(r))
+	resp, err := c.httpClient(0).Do(req)
+	if err != nil {
+		writeUpstreamError(w, "settings request failed", err)
+		return
+	}
+	defer resp.Body.Close()
+	relay(w, resp)
+}
+
+func (c cfg) handleSearch(w http.ResponseWriter, r *http.Request) {
+	qfid := r.URL.Query().Get("fileId")
+	qname := r.URL.Query().Get("filename")
+	q := r.URL.Query().Get("q")
+	if q != "" {
+		if qfid == "" {
+			qfid = q
+		}
+		if qname == "" {
+			qname = q
+		}
+	}
+	list, _, _, err := c.listFiles(r.Context())
+	if err != nil {
+		writeUpstreamError(w, "failed to get files", err)
+		return
+	}
+	var files []struct {
+		FileID       string `json:"fileId"`
+		Filename     string `json:"filename"`
+		Size         int64  `json:"size"`
+		State        string `json:"state"`
+		ReplicaCount int    `json:"replicaCount"`
+		CreatedAt    string `json:"createdAt"`
+	}
+	if err := json.Unmarshal(list, &files); err != nil {
+		writeErrorDetail(w, http.StatusBadGateway, codeUpstreamError, "bad response from naming service", err.Error())
+		return
+	}
+	var out []any
+	for _, f := range files {
+		if qfid == "" && qname == "" {
+			out = append(out, f)
+			continue
+		}
+		match := false
+		if qfid != "" && strings.Contains(strings.ToLower(f.FileID), strings.ToLower(qfid)) {
+			match = true
+		}
+		if qname != "" && strings.Contains(strings.ToLower(f.Filename), strings.ToLower(qname)) {
+			match = true
+		}
+		if match {
+			out = append(out, f)
+		}
+	}
+	writeJSON(w, out)
+}
+
+// Exit codes the services use so the process manager can tell failure modes
+// apart: the Go runtime exits 2 on an unrecovered panic and startup.Check
+// exits startup.ExitConfig when the configuration is invalid.
+const (
+	exitPanic  = 2
+	exitConfig = startup.ExitConfig
+)
+
+// stderrTailLines is how much of a child's stderr is kept for /api/system/status.
+const stderrTailLines = 30
+
+// stderrTail keeps the last lines a child wrote to stderr, plus the first
+// panic or fatal-signal line, which a long goroutine dump would otherwise
+// push out.
+type stderrTail struct {
+	mu     sync.Mutex
+	lines  []string
+	part   []byte
+	panic  string
+	status int // child's exit code as reported by `go run`, -1 if not seen
+}
+
+func newStderrTail() *stderrTail { return &stderrTail{status: -1} }
+
+func (t *stderrTail) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.part = append(t.part, p...)
+	for {
+		i := bytes.IndexByte(t.part, '\n')
+		if i < 0 {
+			break
+		}
+		t.line(strings.TrimRight(string(t.part[:i]), "\r"))
+		t.part = t.part[i+1:]
+	}
+	return len(p), nil
+}
+
+func (t *stderrTail) line(l string) {
+	if t.panic == "" && (strings.HasPrefix(l, "panic: ") || strings.HasPrefix(l, "fatal error: ") ||
+		strings.HasPrefix(l, "SIG") && strings.Contains(l, ": ")) {
+		t.panic = l
+	}
+	// `go run` exits 1 whatever the program did and reports the real code here.
+	if rest, ok := strings.CutPrefix(l, "exit status "); ok {
+		if code, err := strconv.Atoi(rest); err == nil {
+			t.status = code
+			return
+		}
+	}
+	t.lines = append(t.lines, l)
+	if len(t.lines) > stderrTailLines {
+		t.lines = t.lines[len(t.lines)-stderrTailLines:]
+	}
+}
+
+// procExit describes how a managed process last ended.
+type procExit struct {
+	State    string    `json:"state"` // "stopped" (by an operator), "exited" (code 0) or "crashed"
+	ExitCode int       `json:"exitCode"`
+	Reason   string    `json:"reason"`
+	At       time.Time `json:"at"`
+	Stderr   []string  `json:"stderr,omitempty"`
+}
+
+// exitOf turns the result of cmd.Wait into a procExit.
+func exitOf(err error, t *stderrTail, stopped bool) *procExit {
+	code, why := 0, ""
+	if ee, ok := err.(*exec.ExitError); ok {
+		code = ee.ExitCode()
+	} else if err != nil {
+		code = -1
+	}
+	if code < 0 && err != nil {
+		why = err.Error() // e.g. "signal: killed"
+	}
+	return exitReport(code, why, t, stopped)
+}
+
+// exitReport classifies an exit from its code, an optional cause for a
+// code of -1, and the stderr tail.
+func exitReport(code int, why string, t *stderrTail, stopped bool) *procExit {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := &procExit{At: time.Now(), ExitCode: code, Stderr: append([]string(nil), t.lines...)}
+	if t.status >= 0 {
+		e.ExitCode = t.status
+	}
+	switch {
+	case stopped:
+		e.State, e.Reason = "stopped", "stopped by user"
+		return e
+	case e.ExitCode == 0:
+		e.State, e.Reason = "exited", "exited cleanly"
+		return e
+	}
+	e.State = "crashed"
+	switch {
+	case t.panic != "":
+		e.Reason = t.panic
+	case e.ExitCode == exitConfig:
+		e.Reason = "invalid configuration"
+		for _, l := range t.lines {
+			if i := strings.Index(l, "config error: "); i >= 0 {
+				e.Reason += ": " + l[i+len("config error: "):]
+				break
+			}
+		}
+	case e.ExitCode == exitPanic:
+		e.Reason = "panic"
+	case e.ExitCode < 0 && why != "":
+		e.Reason = why
+	case len(t.lines) > 0:
+		e.Reason = t.lines[len(t.lines)-1] // usually the log.Fatal message
+	default:
+		e.Reason = fmt.Sprintf("exit status %d", e.ExitCode)
+	}
+	return e
+}
+
+/* ---------------- SYSTEM CONTROL ---------------- */
+
+// service is one process /api/system/* can run: the naming service or a
+// storage node.
+type service struct {
+	Key string   // "naming" or the node ID
+	Dir string   // naming_service or storage_node, beside ui_gateway/
+	Env []string // KEY=value settings for the service
+}
+
+// orchestrator runs services for /api/system/*. The process orchestrator
+// spawns `go run` children of the gateway; the docker and compose ones run
+// the same services as containers from DOCKER_IMAGE.
+type orchestrator interface {
+	start(svc service) error
+	stop(key string) bool
+	running(key string) bool
+	// expectStop marks (or unmarks) a service as being stopped by an
+	// operator, so its exit is not reported as a crash.
+	expectStop(key string, on bool)
+	status(key string) procStatus
+}
+
+// procStatus is one service's entry in /api/system/status.
+type procStatus struct {
+	Managed   bool       `json:"managed"` // started by this gateway and still running
+	PID       int        `json:"pid,omitempty"`
+	StartedAt *time.Time `json:"startedAt,omitempty"`
+	LastExit  *procExit  `json:"lastExit,omitempty"`
+}
+
+// systemNamingURL is where started nodes find the naming service. Every
+// orchestrator puts services on the host network, so this holds for
+// containers too.
+const systemNamingURL = "http://localhost:8000"
+
+// topoNode is one storage node of the local cluster, as listed in the
+// topology file.
+type topoNode struct {
+	NodeID        string `json:"nodeId"`
+	Port          int    `json:"port"`
+	DataDir       string `json:"dataDir"` // relative to storage_node/ (or the container's /data)
+	CapacityBytes int64  `json:"capacityBytes"`
+}
+
+// topologyFile is the on-disk form of SYSTEM_TOPOLOGY:
+//
+//	{"nodes": [{"nodeId": "node-a", "port": 9001, "dataDir": "./data_a", "capacityBytes": 1073741824}]}
+type topologyFile struct {
+	Nodes []topoNode `json:"nodes"`
+}
+
+const defaultNodeCapacity = 1 << 30
+
+func (n topoNode) service() service {
+	return service{Key: n.NodeID, Dir: "storage_node", Env: []string{
+		"NODE_ID=" + n.NodeID, "PORT=" + strconv.Itoa(n.Port), "DATA_DIR=" + n.DataDir,
+		"NAMING_URL=" + systemNamingURL, "CAPACITY_BYTES=" + strconv.FormatInt(n.CapacityBytes, 10),
+	}}
+}
+
+func (n topoNode) healthURL() string { return fmt.Sprintf("http://localhost:%d/health", n.Port) }
+
+// systemCtl maps the system API onto an orchestrator and the node topology.
+// The topology starts from SYSTEM_TOPOLOGY if that file exists, else from
+// SYSTEM_NODES nodes named node-a, node-b, ... on ports 9001 upwards;
+// add-node and remove-node write it back.
+type systemCtl struct {
+	kind string
+	orch orchestrator
+	path string     // topology file; "" keeps changes in memory
+	up   *upstreams // to check on the nodes it starts
+
+	mu   sync.Mutex
+	topo []topoNode
+}
+
+func newSystemCtl(conf Config, up *upstreams) (*systemCtl, error) {
+	s := &systemCtl{kind: conf.Orchestrator, path: conf.TopologyFile, up: up}
+	switch conf.Orchestrator {
+	case "", "process":
+		s.kind, s.orch = "process", newProcOrch()
+	case "docker":
+		s.orch = newDockerOrch(conf.DockerImage, conf.DockerProject)
+	case "compose":
+		s.orch = newComposeOrch(conf.DockerImage, conf.DockerProject)
+	default:
+		return nil, fmt.Errorf("ORCHESTRATOR %q must be process, docker or compose", conf.Orchestrator)
+	}
+	b, err := os.ReadFile(s.path)
+	switch {
+	case s.path != "" && err == nil:
+		var tf topologyFile
+		if err := json.Unmarshal(b, &tf); err != nil {
+			return nil, fmt.Errorf("SYSTEM_TOPOLOGY %s: %v", s.path, err)
+		}
+		for _, n := range tf.Nodes {
+			if _, err := s.add(n); err != nil {
+				return nil, fmt.Errorf("SYSTEM_TOPOLOGY %s: %v", s.path, err)
+			}
+		}
+	case s.path != "" && !os.IsNotExist(err):
+		return nil, fmt.Errorf("SYSTEM_TOPOLOGY %s: %v", s.path, err)
+	default:
+		for range max(conf.SystemNodes, 1) {
+			s.add(topoNode{})
+		}
+	}
+	return s, nil
+}
+
+func systemNodeID(i int) string {
+	if i < 26 {
+		return "node-" + string(rune('a'+i))
+	}
+	return fmt.Sprintf("node-%d", i+1)
+}
+
+// validNodeID keeps IDs usable as file, container and compose service names.
+func validNodeID(id string) bool {
+	if id == "" || id == "naming" || len(id) > 48 {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// add fills in whatever n leaves out (the next free node-x ID, the port
+// after the highest in use, ./data_<x>, 1 GiB), checks it against the
+// existing nodes and appends it. Caller holds s.mu or owns s.
+func (s *systemCtl) add(n topoNode) (topoNode, error) {
+	ids, ports := map[string]bool{}, map[int]bool{}
+	top := 9000
+	for _, o := range s.topo {
+		ids[o.NodeID], ports[o.Port] = true, true
+		top = max(top, o.Port)
+	}
+	for i := 0; n.NodeID == ""; i++ {
+		if id := systemNodeID(i); !ids[id] {
+			n.NodeID = id
+		}
+	}
+	if n.Port == 0 {
+		n.Port = top + 1
+	}
+	if n.DataDir == "" {
+		n.DataDir = "./data_" + strings.TrimPrefix(n.NodeID, "node-")
+	}
+	if n.CapacityBytes == 0 {
+		n.CapacityBytes = defaultNodeCapacity
+	}
+	switch {
+	case !validNodeID(n.NodeID):
+		return n, fmt.Errorf("node ID %q must be lowercase letters, digits, '-' or '_' (and not \"naming\")", n.NodeID)
+	case ids[n.NodeID]:
+		return n, fmt.Errorf("node %s is already in the topology", n.NodeID)
+	case n.Port < 1 || n.Port > 65535 || n.Port == 8000:
+		return n, fmt.Errorf("node %s: port %d is not usable", n.NodeID, n.Port)
+	case ports[n.Port]:
+		return n, fmt.Errorf("node %s: port %d is already taken", n.NodeID, n.Port)
+	case n.CapacityBytes < 0:
+		return n, fmt.Errorf("node %s: capacityBytes must be positive", n.NodeID)
+	}
+	s.topo = append(s.topo, n)
+	return n, nil
+}
+
+// save writes the topology file. Caller holds s.mu.
+func (s *systemCtl) save() error {
+	if s.path == "" {
+		return nil
+	}
+	b, _ := json.MarshalIndent(topologyFile{Nodes: s.topo}, "", "  ")
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// addNode adds n to the topology and saves it.
+func (s *systemCtl) addNode(n topoNode) (topoNode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, err := s.add(n)
+	if err != nil {
+		return n, err
+	}
+	if err := s.save(); err != nil {
+		s.topo = s.topo[:len(s.topo)-1]
+		return n, fmt.Errorf("saving topology: %v", err)
+	}
+	return n, nil
+}
+
+// removeNode drops id from the topology and saves it. The node's data
+// directory is left alone.
+func (s *systemCtl) removeNode(id string) (topoNode, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, n := range s.topo {
+		if n.NodeID != id {
+			continue
+		}
+		old := s.topo
+		s.topo = slices.Delete(slices.Clone(s.topo), i, i+1)
+		if err := s.save(); err != nil {
+			s.topo = old
+			return n, true, fmt.Errorf("saving topology: %v", err)
+		}
+		return n, true, nil
+	}
+	return topoNode{}, false, nil
+}
+
+func (s *systemCtl) nodes() []topoNode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.topo)
+}
+
+func (s *systemCtl) node(id string) (topoNode, bool) {
+	for _, n := range s.nodes() {
+		if n.NodeID == id {
+			return n, true
+		}
+	}
+	return topoNode{}, false
+}
+
+// keys lists the services the system API covers, naming first.
+func (s *systemCtl) keys() []string {
+	keys := []string{"naming"}
+	for _, n := range s.nodes() {
+		keys = append(keys, n.NodeID)
+	}
+	return keys
+}
+
+// startAll starts the naming service and the first n nodes of the
+// topology, skipping any that are already running, and reports which are
+// up afterwards.
+func (s *systemCtl) startAll(n int) map[string]bool {
+	svcs := []service{{Key: "naming", Dir: "naming_service", Env: []string{"ADDR=:8000"}}}
+	for _, node := range s.nodes()[:n] {
+		svcs = append(svcs, node.service())
+	}
+	out := map[string]bool{}
+	for _, svc := range svcs {
+		if !s.orch.running(svc.Key) {
+			if err := s.orch.start(svc); err != nil {
+				log.Printf("system: start %s: %v", svc.Key, err)
+			}
+		}
+		out[svc.Key] = s.orch.running(svc.Key)
+	}
+	return out
+}
+
+func (s *systemCtl) stopAll() map[string]bool {
+	out := map[string]bool{}
+	for _, key := range s.keys() {
+		out[key] = s.orch.stop(key)
+	}
+	return out
+}
+
+// startNode starts a topology node unless it is already up; false for a
+// node that is not in the topology or failed to start.
+func (s *systemCtl) startNode(id string) bool {
+	n, ok := s.node(id)
+	if !ok {
+		return false
+	}
+	if s.orch.running(id) && s.up.ping(n.healthURL()) {
+		return true
+	}
+	time.Sleep(300 * time.Millisecond) // let a node that was just stopped release its port
+	if err := s.orch.start(n.service()); err != nil {
+		log.Printf("system: start %s: %v", id, err)
+		return false
+	}
+	return true
+}
+
+func (s *systemCtl) snapshot() map[string]procStatus {
+	out := map[string]procStatus{}
+	for _, key := range s.keys() {
+		out[key] = s.orch.status(key)
+	}
+	return out
+}
+
+// procOrch runs each service as `go run main.go` in its source directory,
+// logging to logs/<key>.log.
+type procOrch struct {
+	mu       sync.Mutex
+	cmds     map[string]*exec.Cmd
+	started  map[string]time.Time
+	stopping map[*exec.Cmd]bool // set before an operator-initiated stop
+	exits    map[string]*procExit
+}
+
+func newProcOrch() *procOrch {
+	return &procOrch{
+		cmds:     map[string]*exec.Cmd{},
+		started:  map[string]time.Time{},
+		stopping: map[*exec.Cmd]bool{},
+		exits:    map[string]*procExit{},
+	}
+}
+
+func (p *procOrch) running(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.cmds[key] != nil
+}
+
+// start launches svc with stderr captured as well as logged, then watches
+// it until it exits.
+func (p *procOrch) start(svc service) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cmds[svc.Key] != nil {
+		return nil
+	}
+	cmd := exec.Command("go", "run", "main.go")
+	cmd.Dir = filepath.Join("..", svc.Dir)
+	cmd.Env = append(os.Environ(), svc.Env...) // later entries win, so the gateway's own ADDR etc. don't leak
+	os.MkdirAll(filepath.Join("..", "logs"), 0755)
+	f, _ := os.OpenFile(filepath.Join("..", "logs", svc.Key+".log"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	tail := newStderrTail()
+	cmd.Stdout = f
+	cmd.Stderr = io.MultiWriter(f, tail)
+	if f == nil {
+		cmd.Stdout = nil
+		cmd.Stderr = tail
+	}
+	// Killing `go run` can leave the built binary holding stderr open; don't
+	// let that keep Wait (and the exit report) pending forever.
+	cmd.WaitDelay = 2 * time.Second
+	if err := cmd.Start(); err != nil {
+		p.exits[svc.Key] = &procExit{State: "crashed", ExitCode: -1, Reason: "start failed: " + err.Error(), At: time.Now()}
+		if f != nil {
+			f.Close()
+		}
+		return err
+	}
+	p.cmds[svc.Key] = cmd
+	p.started[svc.Key] = time.Now()
+	go func() {
+		err := cmd.Wait()
+		if f != nil {
+			f.Close()
+		}
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		e := exitOf(err, tail, p.stopping[cmd])
+		p.exits[svc.Key] = e
+		delete(p.stopping, cmd)
+		if p.cmds[svc.Key] == cmd {
+			delete(p.cmds, svc.Key)
+		}
+		log.Printf("system: %s %s (exit %d): %s", svc.Key, e.State, e.ExitCode, e.Reason)
+	}()
+	return nil
+}
+
+func (p *procOrch) stop(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cmd := p.cmds[key]
+	if cmd == nil {
+		return false
+	}
+	p.stopping[cmd] = true
+	_ = cmd.Process.Kill()
+	delete(p.cmds, key)
+	return true
+}
+
+func (p *procOrch) expectStop(key string, on bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cmd := p.cmds[key]
+	if cmd == nil {
+		return
+	}
+	if on {
+		p.stopping[cmd] = true
+	} else {
+		delete(p.stopping, cmd)
+	}
+}
+
+func (p *procOrch) status(key string) procStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st := procStatus{LastExit: p.exits[key]}
+	if cmd := p.cmds[key]; cmd != nil {
+		st.Managed = true
+		st.PID = cmd.Process.Pid
+		t := p.started[key]
+		st.StartedAt = &t
+	}
+	return st
+}
+
+// dockerOrch runs each service as a container named <project>-<key> on the
+// host network, with a volume of the same name mounted on the image's
+// working directory so data and metadata survive a restart.
+type dockerOrch struct {
+	image, project string
+
+	mu       sync.Mutex
+	stopping map[string]bool
+}
+
+func newDockerOrch(image, project string) *dockerOrch {
+	return &dockerOrch{image: image, project: project, stopping: map[string]bool{}}
+}
+
+func (d *dockerOrch) container(key string) string { return d.project + "-" + key }
+
+// docker runs the docker CLI and returns its combined output.
+func (d *dockerOrch) docker(args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute) // a first run may pull the image
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "docker", args...).CombinedOutput()
+	if err != nil {
+		return out, fmt.Errorf("docker %s: %v: %s", args[0], err, bytes.TrimSpace(out))
+	}
+	return out, nil
+}
+
+func (d *dockerOrch) start(svc service) error {
+	d.expectStop(svc.Key, false)
+	name := d.container(svc.Key)
+	_, _ = d.docker("rm", "-f", name) // a stopped container from an earlier run
+	args := []string{"run", "-d", "--name", name, "--network", "host",
+		"--label", "projectakhir.project=" + d.project, "-v", name + ":/data"}
+	for _, kv := range svc.Env {
+		args = append(args, "-e", kv)
+	}
+	_, err := d.docker(append(args, d.image, svc.Dir)...)
+	return err
+}
+
+func (d *dockerOrch) stop(key string) bool {
+	if !d.running(key) {
+		return false
+	}
+	d.expectStop(key, true)
+	_, err := d.docker("stop", "-t", "10", d.container(key))
+	return err == nil
+}
+
+func (d *dockerOrch) running(key string) bool {
+	out, err := d.docker("inspect", "-f", "{{.State.Running}}", d.container(key))
+	return err == nil && strings.TrimSpace(string(out)) == "true"
+}
+
+func (d *dockerOrch) expectStop(key string, on bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if on {
+		d.stopping[key] = true
+	} else {
+		delete(d.stopping, key)
+	}
+}
+
+// status reads the container's state from docker, so containers started by
+// an earlier gateway run are reported too.
+func (d *dockerOrch) status(key string) procStatus {
+	name := d.container(key)
+	out, err := d.docker("inspect", "-f", "{{json .State}}", name)
+	if err != nil {
+		return procStatus{} // no such container
+	}
+	var state struct {
+		Running    bool
+		OOMKilled  bool
+		Pid        int
+		ExitCode   int
+		Error      string
+		StartedAt  time.Time
+		FinishedAt time.Time
+	}
+	if json.Unmarshal(out, &state) != nil {
+		return procStatus{}
+	}
+	if state.Running {
+		return procStatus{Managed: true, PID: state.Pid, StartedAt: &state.StartedAt}
+	}
+	if state.FinishedAt.IsZero() || state.FinishedAt.Year() < 2000 {
+		return procStatus{} // created but never started
+	}
+	tail := newStderrTail()
+	logs, _ := d.docker("logs", "--tail", strconv.Itoa(stderrTailLines), name)
+	_, _ = tail.Write(logs)
+	why := state.Error
+	if state.OOMKilled {
+		why = "killed: out of memory"
+	}
+	code := state.ExitCode
+	if why != "" && code == 0 {
+		code = -1
+	}
+	d.mu.Lock()
+	stopped := d.stopping[key]
+	d.mu.Unlock()
+	e := exitReport(code, why, tail, stopped)
+	e.At = state.FinishedAt
+	return procStatus{LastExit: e}
+}
+
+// composeOrch is dockerOrch with the containers declared in a compose file
+// (logs/<project>-compose.yml) and started and stopped through
+// `docker compose`, so the stack can also be managed by hand with
+// `docker compose -p <project> -f ...`. Container and volume names match
+// the docker orchestrator's, so either can pick up the other's data.
+type composeOrch struct {
+	*dockerOrch
+
+	svcMu sync.Mutex
+	svcs  map[string]service
+}
+
+func newComposeOrch(image, project string) *composeOrch {
+	return &composeOrch{dockerOrch: newDockerOrch(image, project), svcs: map[string]service{}}
+}
+
+func (c *composeOrch) file() string {
+	return filepath.Join("..", "logs", c.project+"-compose.yml")
+}
+
+// write regenerates the compose file with every service started so far.
+func (c *composeOrch) write() error {
+	keys := make([]string, 0, len(c.svcs))
+	for k := range c.svcs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Generated by ui_gateway (ORCHESTRATOR=compose); rewritten on every start.\nname: %s\nservices:\n", c.project)
+	for _, k := range keys {
+		svc, name := c.svcs[k], c.container(k)
+		fmt.Fprintf(&b, "  %s:\n    image: %q\n    container_name: %s\n    command: [%q]\n    network_mode: host\n", k, c.image, name, svc.Dir)
+		b.WriteString("    environment:\n")
+		for _, kv := range svc.Env {
+			key, val, _ := strings.Cut(kv, "=")
+			fmt.Fprintf(&b, "      %s: %q\n", key, val)
+		}
+		fmt.Fprintf(&b, "    volumes:\n      - %s:/data\n", name)
+	}
+	b.WriteString("volumes:\n")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "  %s:\n    name: %s\n", c.container(k), c.container(k))
+	}
+	os.MkdirAll(filepath.Dir(c.file()), 0755)
+	return os.WriteFile(c.file(), []byte(b.String()), 0644)
+}
+
+func (c *composeOrch) start(svc service) error {
+	c.svcMu.Lock()
+	c.svcs[svc.Key] = svc
+	err := c.write()
+	c.svcMu.Unlock()
+	if err != nil {
+		return err
+	}
+	c.expectStop(svc.Key, false)
+	_, err = c.docker("compose", "-p", c.project, "-f", c.file(), "up", "-d", "--no-deps", svc.Key)
+	return err
+}
+
+func (c *composeOrch) stop(key string) bool {
+	if !c.running(key) {
+		return false
+	}
+	c.expectStop(key, true)
+	c.svcMu.Lock()
+	_, known := c.svcs[key]
+	c.svcMu.Unlock()
+	if !known {
+		// started by an earlier gateway run, so not in the current file
+		_, err := c.docker("stop", "-t", "10", c.container(key))
+		return err == nil
+	}
+	_, err := c.docker("compose", "-p", c.project, "-f", c.file(), "stop", "-t", "10", key)
+	return err == nil
+}
+
+func (c cfg) handleSystemStart(w http.ResponseWriter, r *http.Request) {
+	n := len(c.sys.nodes())
+	if v := r.URL.Query().Get("nodes"); v != "" {
+		x, err := strconv.Atoi(v)
+		if err != nil || x < 0 || x > n {
+			writeError(w, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("nodes must be between 0 and %d, the size of the topology", n))
+			return
+		}
+		n = x
+	}
+	status := c.sys.startAll(n)
+	writeJSON(w, map[string]any{"started": true, "orchestrator": c.sys.kind, "status": status})
+}
+func (c cfg) handleSystemStop(w http.ResponseWriter, r *http.Request) {
+	c.audit(r, "system-stop", "all services")
+	status := c.sys.stopAll()
+	writeJSON(w, map[string]any{"stopped": true, "status": status})
+}
+func (c cfg) handleSystemStatus(w http.ResponseWriter, r *http.Request) {
+	procs := c.sys.snapshot()
+	nodes := map[string]bool{}
+	for _, n := range c.sys.nodes() {
+		nodes[n.NodeID] = c.ping(n.healthURL()) || procs[n.NodeID].Managed
+	}
+	writeJSON(w, map[string]any{
+		"orchestrator": c.sys.kind,
+		"naming":       c.ping(c.namingURL()+"/metrics") || procs["naming"].Managed,
+		"nodes":        nodes,
+		"topology":     c.sys.nodes(),
+		"processes":    procs,
+	})
+}
+
+// handleAddNode adds a node to the topology and starts it. Every field of
+// the body is optional; see systemCtl.add for the defaults.
+func (c cfg) handleAddNode(w http.ResponseWriter, r *http.Request) {
+	var body topoNode
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, codeInvalidJSON, "bad json")
+		return
+	}
+	n, err := c.sys.addNode(body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	c.audit(r, "system-add-node", n.NodeID)
+	writeJSON(w, map[string]any{"node": n, "started": c.sys.startNode(n.NodeID)})
+}
+
+// handleRemoveNode stops a node (if this gateway runs it) and drops it from
+// the topology. Its data directory is kept; the naming service sees the
+// node go DOWN and heals its replicas elsewhere.
+func (c cfg) handleRemoveNode(w http.ResponseWriter, r *http.Request) {
+	var body nodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.NodeID == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidJSON, "bad json")
+		return
+	}
+	if _, ok := c.sys.node(body.NodeID); !ok {
+		writeError(w, http.StatusNotFound, codeNodeNotFound, "node not in topology")
+		return
+	}
+	c.audit(r, "system-remove-node", body.NodeID)
+	stopped := c.sys.orch.stop(body.NodeID)
+	n, _, err := c.sys.removeNode(body.NodeID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+	writeJSON(w, map[string]any{"nodeId": body.NodeID, "stopped": stopped, "removed": true, "dataDir": n.DataDir})
+}
+
+// ping reports whether url answers at all.
+func (up *upstreams) ping(url string) bool {
+	client := up.httpClient(800 * time.Millisecond)
+	resp, err := client.Get(url)
+	if err != nil {
+		return false
+	}
+	_ = resp.Body.Close()
+	return true
+}
+
+// nodeRequest is the body of the /api/system/*-node calls.
+type nodeRequest struct {
+	NodeID string `json:"nodeId"`
+}
+
+func (c cfg) handleStopNode(w http.ResponseWriter, r *http.Request) {
+	var body nodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.NodeID == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidJSON, "bad json")
+		return
+	}
+	resp, err := c.httpGet(r.Context(), 0, c.namingURL()+"/list-nodes")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "cannot list nodes")
+		return
+	}
+	defer resp.Body.Close()
+	var nodes []struct{ NodeID, URL string }
+	_ = json.NewDecoder(resp.Body).Decode(&nodes)
+	var target string
+	for _, n := range nodes {
+		if n.NodeID == body.NodeID {
+			target = n.URL
+			break
+		}
+	}
+	if target == "" {
+		writeError(w, http.StatusNotFound, codeNodeNotFound, "node not found")
+		return
+	}
+	c.sys.orch.expectStop(body.NodeID, true)
+	req, _ := http.NewRequestWithContext(r.Context(), "POST", strings.TrimRight(target, "/")+"/admin/stop", nil)
+	req.Header.Set("Authorization", "Bearer "+c.AdminToken)
+	req.Header.Set(actorHeader, callerOf(r))
+	res, err := c.httpClient(2 * time.Second).Do(req)
+	if err != nil {
+		c.sys.orch.expectStop(body.NodeID, false)
+		writeErrorDetail(w, http.StatusBadGateway, codeUpstreamError, "shutdown failed", err.Error())
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		c.sys.orch.expectStop(body.NodeID, false)
+		msg, _ := io.ReadAll(res.Body)
+		e := parseError(msg)
+		writeErrorDetail(w, res.StatusCode, e.Code, "node refused to stop: "+e.Message, e.Detail)
+		return
+	}
+	writeJSON(w, map[string]any{"nodeId": body.NodeID, "stopped": true})
+}
+
+func (c cfg) handleStartNode(w http.ResponseWriter, r *http.Request) {
+	var body nodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.NodeID == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidJSON, "bad json")
+		return
+	}
+	ok := c.sys.startNode(body.NodeID)
+	writeJSON(w, map[string]any{"nodeId": body.NodeID, "started": ok})
+}
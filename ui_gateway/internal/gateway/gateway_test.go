@@ -0,0 +1,645 @@
+package gateway
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// shardVector is the table internal/e2e pins naming.ShardOf with; shardOf
+// must route exactly as the naming shards mint, so keep the two in step.
+var shardVector = []struct {
+	id    string
+	count int
+	want  int
+}{
+	{"", 2, 1},
+	{"alice", 3, 2},
+	{"bob", 7, 3},
+	{"report.pdf", 7, 0},
+	{"0c5b2a4e-9f1d-4c3b-8a7e-2d6f1b9e3a10", 2, 0},
+	{"70868dc9-fbbd-bdc0-e198-76f605e85917", 7, 5},
+	{"70868dc9-fbbd-bdc0-e198-76f605e85917", 1, 0},
+}
+
+func TestShardOfVector(t *testing.T) {
+	for _, tc := range shardVector {
+		if got := shardOf(tc.id, tc.count); got != tc.want {
+			t.Errorf("shardOf(%q, %d) = %d, want %d", tc.id, tc.count, got, tc.want)
+		}
+	}
+}
+
+// shardedCfg is a gateway config over two shards, the first with two
+// replicas. Nothing listens on them.
+func shardedCfg() cfg {
+	return cfg{upstreams: newUpstreams(Config{NamingShards: [][]string{
+		{"http://shard0-a:8000", "http://shard0-b:8000/"},
+		{"http://shard1:8000"},
+	}})}
+}
+
+func TestShardRouting(t *testing.T) {
+	c := shardedCfg()
+	// "alice" hashes to shard 1 and "bob" to shard 0 (see shardVector)
+	for _, tc := range []struct {
+		name                    string
+		fileID, parentID, owner string
+		want                    string
+	}{
+		{"new file by owner", "", "", "alice", "http://shard1:8000"},
+		{"new file by another owner", "", "", "bob", "http://shard0-a:8000"},
+		{"new version by fileId", "bob", "", "alice", "http://shard0-a:8000"},
+		{"derived file by parent", "", "bob", "alice", "http://shard0-a:8000"},
+	} {
+		if got := c.namingForNew(tc.fileID, tc.parentID, tc.owner); got != tc.want {
+			t.Errorf("%s: namingForNew = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+	if got := c.namingFor("alice"); got != "http://shard1:8000" {
+		t.Errorf("namingFor(alice) = %s", got)
+	}
+
+	u, _ := url.Parse("http://shard0-b:8000/list-files")
+	if p, i := c.poolOf(u); p != c.shards[0] || i != 1 {
+		t.Errorf("poolOf(%s) = shard pool %p, index %d; want shard 0's, 1", u, p, i)
+	}
+	u, _ = url.Parse("http://node-a:9001/download/x")
+	if p, i := c.poolOf(u); p != c.shards[0] || i != -1 {
+		t.Errorf("poolOf(%s) = index %d, want -1", u, i)
+	}
+}
+
+func TestNamingOf(t *testing.T) {
+	c := shardedCfg()
+	for _, tc := range []struct {
+		query  string
+		want   string
+		status int
+	}{
+		{"", "http://shard0-a:8000", http.StatusOK},
+		{"?shard=1", "http://shard1:8000", http.StatusOK},
+		{"?shard=2", "", http.StatusBadRequest},
+		{"?shard=x", "", http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/api/audit"+tc.query, nil)
+		got, ok := c.namingOf(w, r)
+		if got != tc.want || ok != (tc.status == http.StatusOK) || w.Code != tc.status {
+			t.Errorf("namingOf(%q) = %q, %v, status %d; want %q, status %d", tc.query, got, ok, w.Code, tc.want, tc.status)
+		}
+		if spans := c.spansShards(r); spans != (tc.query == "") {
+			t.Errorf("spansShards(%q) = %v", tc.query, spans)
+		}
+	}
+}
+
+func TestRefuseCrossShard(t *testing.T) {
+	c := shardedCfg()
+	w := httptest.NewRecorder()
+	if c.refuseCrossShard(w, "bob", "bob") || w.Code != http.StatusOK {
+		t.Errorf("a file on its owner's shard was refused: %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	if !c.refuseCrossShard(w, "bob", "alice") || w.Code != http.StatusConflict {
+		t.Errorf("giving a shard 0 file to a shard 1 owner: %d, want 409", w.Code)
+	}
+	var e apiError
+	if err := json.NewDecoder(w.Body).Decode(&e); err != nil || e.Code != codeConflict {
+		t.Errorf("refusal body: %+v, %v", e, err)
+	}
+}
+
+func TestMergeQuotas(t *testing.T) {
+	// alice's home is shard 1, whose limits win; usage adds up
+	all := []json.RawMessage{
+		json.RawMessage(`{"quotas":[{"owner":"alice","maxBytes":1,"maxFiles":1,"usedBytes":10,"usedFiles":1,"default":true},{"owner":"bob","maxBytes":500,"usedBytes":5,"usedFiles":1}]}`),
+		json.RawMessage(`{"quotas":[{"owner":"alice","maxBytes":100,"maxFiles":3,"usedBytes":20,"usedFiles":2}]}`),
+	}
+	got, err := mergeQuotas(url.Values{}, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(got)
+	want := `{"quotas":[{"owner":"alice","maxBytes":100,"maxFiles":3,"usedBytes":30,"usedFiles":3},{"owner":"bob","maxBytes":500,"maxFiles":0,"usedBytes":5,"usedFiles":1}]}`
+	if string(b) != want {
+		t.Errorf("merged quotas:\n got %s\nwant %s", b, want)
+	}
+}
+
+func TestRequiredRole(t *testing.T) {
+	for _, tc := range []struct {
+		method, path string
+		want         role
+	}{
+		{http.MethodPost, "/api/login", rolePublic},
+		{http.MethodGet, "/s/abc", rolePublic},
+		{http.MethodGet, "/login/oidc/callback", rolePublic},
+		{http.MethodGet, "/debug/pprof/", rolePublic},
+		{http.MethodGet, "/", roleViewer},
+		{http.MethodGet, "/api/files", roleViewer},
+		{http.MethodHead, "/api/download", roleViewer},
+		{http.MethodPost, "/api/upload", roleUploader},
+		{http.MethodDelete, "/api/files", roleUploader},
+		{http.MethodGet, "/api/system/status", roleAdmin},
+		{http.MethodGet, "/api/users", roleAdmin},
+		{http.MethodPut, "/api/settings", roleAdmin},
+		{http.MethodPost, "/api/heal", roleAdmin},
+		{http.MethodPost, "/api/operations/cancel", roleAdmin},
+	} {
+		r := httptest.NewRequest(tc.method, tc.path, nil)
+		if got := requiredRole(r); got != tc.want {
+			t.Errorf("%s %s needs %s, want %s", tc.method, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestEnforce(t *testing.T) {
+	a := &accounts{ttl: time.Hour, users: map[string]*account{}, sessions: map[string]*session{}}
+	viewer, _ := a.open("vera", roleViewer, []string{"team"})
+	uploader, _ := a.open("ulla", roleUploader, nil)
+	var seen http.Header
+	h := a.enforce(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { seen = r.Header.Clone() }))
+
+	for _, tc := range []struct {
+		name, method, path, token string
+		status                    int
+	}{
+		{"api without a session", http.MethodGet, "/api/files", "", http.StatusUnauthorized},
+		{"page without a session", http.MethodGet, "/dashboard", "", http.StatusSeeOther},
+		{"public without a session", http.MethodPost, "/api/login", "", http.StatusOK},
+		{"unknown session", http.MethodGet, "/api/files", "nope", http.StatusUnauthorized},
+		{"viewer reads", http.MethodGet, "/api/files", viewer, http.StatusOK},
+		{"viewer uploads", http.MethodPost, "/api/upload", viewer, http.StatusForbidden},
+		{"uploader uploads", http.MethodPost, "/api/upload", uploader, http.StatusOK},
+		{"uploader changes settings", http.MethodPut, "/api/settings", uploader, http.StatusForbidden},
+	} {
+		r := httptest.NewRequest(tc.method, tc.path, nil)
+		r.Header.Set("X-User", "mallory")
+		r.Header.Set("X-Tenant", "someone-else")
+		if tc.token != "" {
+			r.AddCookie(&http.Cookie{Name: sessionCookie, Value: tc.token})
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s: status %d, want %d", tc.name, w.Code, tc.status)
+		}
+	}
+
+	// the session, not the caller's headers, is who is asking
+	r := httptest.NewRequest(http.MethodGet, "/api/files", nil)
+	r.Header.Set("X-User", "mallory")
+	r.Header.Set("X-Tenant", "someone-else")
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: viewer})
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if seen.Get("X-User") != "vera" || seen.Get("X-Tenant") != "" || seen.Get("X-Groups") != "team" {
+		t.Errorf("identity headers after enforce: %v", seen)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dashboard?x=1", nil))
+	if loc := w.Header().Get("Location"); loc != "/login?next="+url.QueryEscape("/dashboard?x=1") {
+		t.Errorf("redirect to %q", loc)
+	}
+
+	var none *accounts
+	w = httptest.NewRecorder()
+	none.enforce(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/settings", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("without accounts: status %d, want 200", w.Code)
+	}
+}
+
+func TestSignTicket(t *testing.T) {
+	secret := []byte("s3cret")
+	tk := uploadTicket{FileID: "f-1", NodeID: "node-a", Version: 2, MaxSize: 1024, Checksum: "sha256:ab", Expires: 1700000000}
+	raw := signTicket(secret, tk)
+
+	// the storage node's checkTicket reads exactly this layout
+	const want = "eyJmaWxlSWQiOiJmLTEiLCJub2RlSWQiOiJub2RlLWEiLCJ2ZXJzaW9uIjoyLCJtYXhTaXplIjoxMDI0LCJjaGVja3N1bSI6InNoYTI1NjphYiIsImV4cCI6MTcwMDAwMDAwMH0" +
+		".1242b29eb3c777d9b2a54490487e03bce745ad52c83dd501a0ffbaa7b7c6988c"
+	if raw != want {
+		t.Errorf("signTicket = %s, want %s", raw, want)
+	}
+
+	payload, sig, ok := strings.Cut(raw, ".")
+	if !ok {
+		t.Fatalf("ticket %q has no signature", raw)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back uploadTicket
+	if err := json.Unmarshal(b, &back); err != nil || back != tk {
+		t.Errorf("payload decodes to %+v, %v", back, err)
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(b)
+	if got, _ := hex.DecodeString(sig); !hmac.Equal(got, mac.Sum(nil)) {
+		t.Error("signature is not the HMAC-SHA256 of the payload")
+	}
+	if other := signTicket([]byte("other"), tk); bytes.Equal([]byte(other), []byte(raw)) {
+		t.Error("a different secret signs the same")
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, want := range map[string]bool{
+		"":                       false,
+		"gzip":                   true,
+		"GZIP":                   true,
+		"gzip, deflate, br":      true,
+		"deflate;q=1, gzip;q=.5": true,
+		"x-gzip":                 true,
+		"*":                      true,
+		"br, *;q=0.1":            true,
+		"identity":               false,
+		"gzip;q=0":               false,
+		"gzip; q=0.000":          false,
+		"gzip;level=9;q=0":       false,
+		"*;q=1, gzip;q=0":        false,
+		"gzip;q=0, *":            false,
+		"*;q=0":                  false,
+		"gzip;q=x":               false,
+		"gzip;q=2":               false,
+	} {
+		if got := acceptsGzip(header); got != want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
+
+// uploadRig is a gateway in front of a fake naming service that hands
+// every upload its nodes, or just the first for a REDUCED file as naming
+// does, with a write quorum, and records the commits it is sent.
+type uploadRig struct {
+	t       *testing.T
+	gw      http.Handler
+	mu      sync.Mutex
+	commits []map[string]any
+}
+
+// newUploadRig starts the fake naming service and one fake storage node
+// per entry of up; a false entry is a node whose uploads fail.
+func newUploadRig(t *testing.T, quorum int, up ...bool) *uploadRig {
+	t.Helper()
+	rig := &uploadRig{t: t}
+	type replica struct{ NodeID, URL string }
+	var nodes []replica
+	for i, ok := range up {
+		node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !ok {
+				http.Error(w, "disk full", http.StatusInsufficientStorage)
+				return
+			}
+			f, _, err := r.FormFile("file")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			n, _ := io.Copy(io.Discard, f)
+			json.NewEncoder(w).Encode(map[string]int64{"storedBytes": n})
+		}))
+		t.Cleanup(node.Close)
+		nodes = append(nodes, replica{fmt.Sprintf("node-%c", 'a'+i), node.URL})
+	}
+	naming := http.NewServeMux()
+	naming.HandleFunc("POST /allocate", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			StorageClass string `json:"storageClass"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		reps := nodes
+		if body.StorageClass == "REDUCED" {
+			reps = nodes[:1]
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"fileId": "f-1", "version": 1, "replicas": reps, "writeQuorum": min(quorum, len(reps)),
+		})
+	})
+	naming.HandleFunc("POST /commit", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		rig.mu.Lock()
+		rig.commits = append(rig.commits, body)
+		rig.mu.Unlock()
+		uploaded, _ := body["uploaded"].([]any)
+		state, met := "AVAILABLE", len(uploaded) >= quorum
+		if !met {
+			state = "ALLOCATED"
+		}
+		json.NewEncoder(w).Encode(map[string]any{"state": state, "writeQuorum": quorum, "quorumMet": met})
+	})
+	ns := httptest.NewServer(naming)
+	t.Cleanup(ns.Close)
+
+	s, err := NewServer(Config{
+		NamingURLs: []string{ns.URL}, ReplicaConcurrency: 4, ReplicaTimeout: 5 * time.Second,
+		TicketSecret: []byte("s3cret"), TicketTTL: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rig.gw = s.ServeMux()
+	return rig
+}
+
+// upload posts a small file to /api/upload with the extra form fields
+// and returns the response.
+func (rig *uploadRig) upload(fields map[string]string) *httptest.ResponseRecorder {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	mw.WriteField("filename", "notes.txt")
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	fw, _ := mw.CreateFormFile("file", "notes.txt")
+	fw.Write([]byte("hello, replicas"))
+	mw.Close()
+	r := httptest.NewRequest(http.MethodPost, "/api/upload", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	rig.gw.ServeHTTP(w, r)
+	return w
+}
+
+// direct sends a direct-upload call as user, "" being an anonymous
+// caller, and returns the response.
+func (rig *uploadRig) direct(user, path string, body any) *httptest.ResponseRecorder {
+	b, _ := json.Marshal(body)
+	r := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(b))
+	if user != "" {
+		r.Header.Set("X-User", user)
+	}
+	w := httptest.NewRecorder()
+	rig.gw.ServeHTTP(w, r)
+	return w
+}
+
+// lastCommit is the last commit naming received.
+func (rig *uploadRig) lastCommit() map[string]any {
+	rig.mu.Lock()
+	defer rig.mu.Unlock()
+	return rig.commits[len(rig.commits)-1]
+}
+
+// firstCommit is the uploaded list of the first commit naming received.
+func (rig *uploadRig) firstCommit() []any {
+	rig.t.Helper()
+	rig.mu.Lock()
+	defer rig.mu.Unlock()
+	if len(rig.commits) == 0 {
+		rig.t.Fatal("nothing was committed")
+	}
+	uploaded, _ := rig.commits[0]["uploaded"].([]any)
+	return uploaded
+}
+
+func TestUploadReducedClass(t *testing.T) {
+	// a quorum of 2 is capped by the one replica a REDUCED file gets
+	rig := newUploadRig(t, 2, true, true)
+	w := rig.upload(map[string]string{"storageClass": "REDUCED"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("REDUCED upload: %d %s", w.Code, w.Body)
+	}
+	if got := rig.firstCommit(); len(got) != 1 || got[0] != "node-a" {
+		t.Errorf("committed %v, want [node-a]", got)
+	}
+}
+
+func TestUploadWriteQuorum(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		quorum int
+		up     []bool
+		status int
+		commit int // replicas in the first commit
+	}{
+		{"quorum of one commits on the first replica", 1, []bool{true, true, true}, http.StatusOK, 1},
+		{"quorum of two rides out a failed node", 2, []bool{false, true, true}, http.StatusOK, 2},
+		{"quorum of three needs every node", 3, []bool{true, true, true}, http.StatusOK, 3},
+		{"quorum of two with one node left", 2, []bool{true, false, false}, http.StatusBadGateway, 0},
+	} {
+		rig := newUploadRig(t, tc.quorum, tc.up...)
+		w := rig.upload(nil)
+		if w.Code != tc.status {
+			t.Errorf("%s: status %d, want %d: %s", tc.name, w.Code, tc.status, w.Body)
+			continue
+		}
+		if tc.status != http.StatusOK {
+			var e apiError
+			if json.NewDecoder(w.Body).Decode(&e); e.Code != codeReplicasTooFew {
+				t.Errorf("%s: error %+v", tc.name, e)
+			}
+			continue
+		}
+		if got := rig.firstCommit(); len(got) != tc.commit {
+			t.Errorf("%s: first commit holds %v, want %d replicas", tc.name, got, tc.commit)
+		}
+	}
+}
+
+func TestUploadCommitQuorum(t *testing.T) {
+	rig := newUploadRig(t, 2, true, true)
+	if w := rig.direct("", "/api/upload/init", uploadInitRequest{Filename: "notes.txt", Size: 5, Checksum: "sha256:ab"}); w.Code != http.StatusOK {
+		t.Fatalf("init: %d %s", w.Code, w.Body)
+	}
+	commit := func(uploaded ...string) *httptest.ResponseRecorder {
+		return rig.direct("", "/api/upload/commit", uploadCommitRequest{FileID: "f-1", Uploaded: uploaded})
+	}
+	if w := commit("node-a"); w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), "required 2") {
+		t.Errorf("commit below the naming quorum: %d %s", w.Code, w.Body)
+	}
+	if w := commit("node-a", "node-b"); w.Code != http.StatusOK {
+		t.Errorf("commit at the naming quorum: %d %s", w.Code, w.Body)
+	}
+}
+
+// shareRig is a gateway over a fake naming service holding three shares:
+// "t-private" on alice's private file, and "t-alice" and "t-bob" on a file
+// of alice's that bob may read. It records the tokens revoked.
+func shareRig(t *testing.T) (http.Handler, *[]string) {
+	t.Helper()
+	files := map[string]string{
+		"private": `{"fileId":"private","owner":"alice"}`,
+		"shared":  `{"fileId":"shared","owner":"alice","acl":[{"subject":"user:bob","permissions":["read"]}]}`,
+	}
+	shares := `{"shares":[
+		{"token":"t-private","fileId":"private","createdBy":"alice@10.0.0.1","createdAt":"2025-01-01T00:00:00Z"},
+		{"token":"t-alice","fileId":"shared","createdBy":"alice@10.0.0.1","createdAt":"2025-01-02T00:00:00Z"},
+		{"token":"t-bob","fileId":"shared","createdBy":"bob@10.0.0.2","createdAt":"2025-01-03T00:00:00Z"}]}`
+	var revoked []string
+	naming := http.NewServeMux()
+	naming.HandleFunc("GET /file-info/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if f, ok := files[r.PathValue("id")]; ok {
+			io.WriteString(w, f)
+			return
+		}
+		http.NotFound(w, r)
+	})
+	naming.HandleFunc("GET /shares", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, shares) })
+	naming.HandleFunc("DELETE /shares/{token}", func(w http.ResponseWriter, r *http.Request) {
+		revoked = append(revoked, r.PathValue("token"))
+		io.WriteString(w, `{"state":"REVOKED"}`)
+	})
+	ns := httptest.NewServer(naming)
+	t.Cleanup(ns.Close)
+	s, err := NewServer(Config{NamingURLs: []string{ns.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.ServeMux(), &revoked
+}
+
+func TestShareVisibility(t *testing.T) {
+	gw, _ := shareRig(t)
+	// list gives each share listed as fileId:token, in createdAt order
+	list := func(user, query string) (int, []string) {
+		r := httptest.NewRequest(http.MethodGet, "/api/share"+query, nil)
+		r.Header.Set("X-User", user)
+		w := httptest.NewRecorder()
+		gw.ServeHTTP(w, r)
+		var body struct {
+			Shares []shareInfo `json:"shares"`
+		}
+		json.NewDecoder(w.Body).Decode(&body)
+		var seen []string
+		for _, s := range body.Shares {
+			seen = append(seen, s.FileID+":"+s.Token)
+		}
+		return w.Code, seen
+	}
+
+	for _, tc := range []struct {
+		user, query string
+		status      int
+		want        []string
+	}{
+		{"bob", "", http.StatusOK, []string{"shared:", "shared:t-bob"}},
+		{"alice", "", http.StatusOK, []string{"private:t-private", "shared:t-alice", "shared:"}},
+		{"bob", "?fileId=shared", http.StatusOK, []string{"shared:", "shared:t-bob"}},
+		{"bob", "?fileId=private", http.StatusForbidden, nil},
+	} {
+		code, seen := list(tc.user, tc.query)
+		if code != tc.status || !slices.Equal(seen, tc.want) {
+			t.Errorf("%s lists%s: %d %v, want %d %v", tc.user, tc.query, code, seen, tc.status, tc.want)
+		}
+	}
+}
+
+func TestShareRevoke(t *testing.T) {
+	gw, revoked := shareRig(t)
+	for _, tc := range []struct {
+		user, token string
+		status      int
+	}{
+		{"bob", "t-private", http.StatusForbidden}, // cannot even read it
+		{"bob", "t-alice", http.StatusForbidden},   // reads the file, but neither made the link nor writes it
+		{"bob", "t-bob", http.StatusOK},            // his own link
+		{"alice", "t-bob", http.StatusOK},          // her file
+		{"mallory", "t-alice", http.StatusForbidden},
+		{"mallory", "t-unknown", http.StatusOK}, // for the naming service to answer
+	} {
+		r := httptest.NewRequest(http.MethodDelete, "/api/share?token="+tc.token, nil)
+		r.Header.Set("X-User", tc.user)
+		w := httptest.NewRecorder()
+		gw.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s revoking %s: %d, want %d: %s", tc.user, tc.token, w.Code, tc.status, w.Body)
+		}
+	}
+	if want := []string{"t-bob", "t-bob", "t-unknown"}; !slices.Equal(*revoked, want) {
+		t.Errorf("revoked %v, want %v", *revoked, want)
+	}
+}
+
+func TestUploadCommitBinding(t *testing.T) {
+	rig := newUploadRig(t, 2, true, true)
+	if w := rig.direct("alice", "/api/upload/init", uploadInitRequest{Filename: "notes.txt", Size: 5, Checksum: "sha256:ab"}); w.Code != http.StatusOK {
+		t.Fatalf("init: %d %s", w.Code, w.Body)
+	}
+
+	for _, tc := range []struct {
+		name, user, path string
+		body             any
+		status           int
+	}{
+		{"another user commits", "bob", "/api/upload/commit", uploadCommitRequest{FileID: "f-1", Uploaded: []string{"node-a", "node-b"}}, http.StatusForbidden},
+		{"another user commits in a batch", "bob", "/api/batch", batchRequest{Commit: []uploadCommitRequest{{FileID: "f-1", Uploaded: []string{"node-a", "node-b"}}}}, http.StatusForbidden},
+		{"an anonymous caller commits", "", "/api/upload/commit", uploadCommitRequest{FileID: "f-1", Uploaded: []string{"node-a", "node-b"}}, http.StatusForbidden},
+		{"nothing was started", "alice", "/api/upload/commit", uploadCommitRequest{FileID: "f-2", Uploaded: []string{"node-a"}}, http.StatusNotFound},
+		{"a node without a ticket", "alice", "/api/upload/commit", uploadCommitRequest{FileID: "f-1", Uploaded: []string{"node-a", "node-x"}}, http.StatusBadGateway},
+	} {
+		if w := rig.direct(tc.user, tc.path, tc.body); w.Code != tc.status {
+			t.Errorf("%s: %d, want %d: %s", tc.name, w.Code, tc.status, w.Body)
+		}
+	}
+	if got := rig.lastCommit(); fmt.Sprint(got["uploaded"]) != "[node-a]" || got["version"] != 1.0 {
+		t.Errorf("naming was sent %v; want node-x dropped and init's version", got)
+	}
+	if w := rig.direct("alice", "/api/upload/commit", uploadCommitRequest{FileID: "f-1", Uploaded: []string{"node-a", "node-b"}}); w.Code != http.StatusOK {
+		t.Errorf("alice commits: %d %s", w.Code, w.Body)
+	}
+}
+
+// TestBatchDryRun checks that /api/batch?dryRun=true relays naming's plan
+// and leaves every blob where it is.
+func TestBatchDryRun(t *testing.T) {
+	var mu sync.Mutex
+	var nodeCalls int
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		nodeCalls++
+		mu.Unlock()
+	}))
+	defer node.Close()
+	var query string
+	naming := http.NewServeMux()
+	naming.HandleFunc("POST /batch", func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		json.NewEncoder(w).Encode(map[string]any{
+			"dryRun": true, "commit": []string{},
+			"delete": map[string]any{"dryRun": true, "files": []string{"f-1"}, "nodes": []string{"node-a"}, "bytes": 5},
+		})
+	})
+	naming.HandleFunc("GET /file-info/{fileId}", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"fileId": "f-1", "replicas": []map[string]string{{"nodeId": "node-a", "url": node.URL}}})
+	})
+	ns := httptest.NewServer(naming)
+	defer ns.Close()
+	s, err := NewServer(Config{NamingURLs: []string{ns.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/batch?dryRun=true", strings.NewReader(`{"delete":["f-1"]}`))
+	w := httptest.NewRecorder()
+	s.ServeMux().ServeHTTP(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"dryRun":true`) {
+		t.Fatalf("dry-run batch: %d %s", w.Code, w.Body)
+	}
+	if query != "dryRun=true" {
+		t.Errorf("naming got /batch?%s, want dryRun=true", query)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if nodeCalls != 0 {
+		t.Errorf("a dry run sent %d requests to the node", nodeCalls)
+	}
+}
@@ -1,636 +1,219 @@
+// Command ui_gateway runs the UI gateway; the gateway itself lives in
+// internal/gateway. All configuration comes from the environment, and the
+// pages are served from the working directory.
 package main
 
 import (
-	"bytes"
-	"crypto/sha256"
-	"encoding/hex"
-	"encoding/json"
-	"fmt"
-	"io"
 	"log"
-	"mime/multipart"
-	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
-	"path/filepath"
+	"slices"
 	"strings"
-	"sync"
 	"time"
-)
-
-type cfg struct {
-	NamingURL string
-	Addr      string
-	sys       *systemProc
-}
 
-func getenv(k, d string) string {
-	if v := os.Getenv(k); v != "" {
-		return v
-	}
-	return d
-}
+	"ui_gateway/internal/gateway"
+	"ui_gateway/internal/startup"
+)
 
 func main() {
-	c := cfg{
-		NamingURL: getenv("NAMING_URL", "http://localhost:8000"),
-		Addr:      getenv("ADDR", ":8080"),
-		sys:       newSystemProc(),
-	}
-
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", serveIndex)
-	mux.HandleFunc("/dashboard", serveDashboard)
-	mux.HandleFunc("/api/upload", c.handleUpload)          // form POST
-	mux.HandleFunc("/api/lookup", c.handleLookup)          // ?fileId=
-	mux.HandleFunc("/api/download", c.handleProxyDownload) // proxy: ?fileId=&nodeUrl=
-	mux.HandleFunc("/api/files", c.handleListFiles)        // GET all files
-	mux.HandleFunc("/api/nodes", c.handleListNodes)        // GET all nodes
-	mux.HandleFunc("/api/metrics", c.handleMetrics)        // GET system metrics
-	mux.HandleFunc("/api/delete", c.handleDeleteFile)      // DELETE file
-	mux.HandleFunc("/api/search", c.handleSearch)          // search files by id/name
-	mux.HandleFunc("/api/system/start", c.handleSystemStart)
-	mux.HandleFunc("/api/system/stop", c.handleSystemStop)
-	mux.HandleFunc("/api/system/status", c.handleSystemStatus)
-	mux.HandleFunc("/api/system/stop-node", c.handleStopNode)
-	mux.HandleFunc("/api/system/start-node", c.handleStartNode)
-
-	log.Printf("UI Gateway running at %s (NAMING_URL=%s)", c.Addr, c.NamingURL)
-	log.Fatal(http.ListenAndServe(c.Addr, logReq(mux)))
-}
-
-func logReq(h http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		h.ServeHTTP(w, r)
-		log.Printf("%s %s %s", r.Method, r.URL.Path, time.Since(start))
-	})
-}
-
-/* ---------------- UI PAGE ---------------- */
-
-func serveIndex(w http.ResponseWriter, r *http.Request) {
-	http.ServeFile(w, r, "index.html")
-}
-
-func serveDashboard(w http.ResponseWriter, r *http.Request) {
-	http.ServeFile(w, r, "dashboard.html")
-}
-
-/* ---------------- API: UPLOAD ---------------- */
-
-type allocateResp struct {
-	FileID   string `json:"fileId"`
-	Replicas []struct {
-		NodeID string `json:"nodeId"`
-		URL    string `json:"url"`
-	} `json:"replicas"`
-}
-
-func (c cfg) handleUpload(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseMultipartForm(64 << 20); err != nil {
-		http.Error(w, "parse form error", http.StatusBadRequest)
-		return
-	}
-	filename := r.FormValue("filename")
-	file, hdr, err := r.FormFile("file")
-	if err != nil || filename == "" {
-		http.Error(w, "missing filename/file", http.StatusBadRequest)
-		return
-	}
-	defer file.Close()
-
-	// read file into memory (for demo). Untuk file besar, lebih baik stream temp file.
-	buf := &bytes.Buffer{}
-	h := sha256.New()
-	size, _ := io.Copy(io.MultiWriter(buf, h), file)
-	checksum := "sha256:" + hex.EncodeToString(h.Sum(nil))
-
-	// 1) allocate
-	payload := map[string]any{
-		"filename":    filename,
-		"size":        size,
-		"checksum":    checksum,
-		"contentType": hdr.Header.Get("Content-Type"),
-	}
-	alloc, err := postJSON[allocateResp](c.NamingURL+"/allocate", payload)
-	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "allocate error", "detail": err.Error()})
-		return
-	}
-
-	// 2) upload to each replica
-	uploadedIDs := make([]string, 0, len(alloc.Replicas))
-	for _, rep := range alloc.Replicas {
-		if err := postMultipart(rep.URL+"/upload", alloc.FileID, filename, buf.Bytes()); err != nil {
-			// skip failed node (client-driven best-effort)
-			continue
-		}
-		uploadedIDs = append(uploadedIDs, rep.NodeID)
-	}
-
-	// <-- INSERT REQUIRED-WRITES CHECK HERE (before commit) -->
-	requiredWrites := 2
-	if len(uploadedIDs) < requiredWrites {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadGateway)
-		_ = json.NewEncoder(w).Encode(map[string]string{
-			"error":  "not enough replicas uploaded",
-			"detail": fmt.Sprintf("uploaded %d, required %d", len(uploadedIDs), requiredWrites),
-		})
-		return
-	}
-	// <-- end check -->
-
-	// 3) commit
-	commitBody := map[string]any{
-		"fileId":   alloc.FileID,
-		"uploaded": uploadedIDs,
-	}
-	var commitResp map[string]any
-	commitResp, _ = postJSON[map[string]any](c.NamingURL+"/commit", commitBody)
-
-	writeJSON(w, map[string]any{
-		"fileId":   alloc.FileID,
-		"filename": filename,
-		"size":     size,
-		"checksum": checksum,
-		"uploaded": uploadedIDs,
-		"commit":   commitResp,
-	})
-}
-
-func postMultipart(url, fileID, filename string, content []byte) error {
-	body := &bytes.Buffer{}
-	w := multipart.NewWriter(body)
-
-	_ = w.WriteField("fileId", fileID)
-	fw, _ := w.CreateFormFile("file", filename)
-	_, _ = fw.Write(content)
-	w.Close()
-
-	req, _ := http.NewRequest("POST", url, body)
-	req.Header.Set("Content-Type", w.FormDataContentType())
-	client := &http.Client{Timeout: 15 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode/100 != 2 {
-		b, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("upload %s failed: %s", url, strings.TrimSpace(string(b)))
-	}
-	return nil
-}
-
-func postJSON[T any](url string, v any) (T, error) {
-	var zero T
-	b, _ := json.Marshal(v)
-	req, _ := http.NewRequest("POST", url, bytes.NewReader(b))
-	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return zero, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode/100 != 2 {
-		x, _ := io.ReadAll(resp.Body)
-		return zero, fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(x)))
-	}
-	dec := json.NewDecoder(resp.Body)
-	if err := dec.Decode(&zero); err != nil {
-		return zero, err
-	}
-	return zero, nil
-}
-
-/* ---------------- API: LOOKUP & DOWNLOAD ---------------- */
-
-func (c cfg) handleLookup(w http.ResponseWriter, r *http.Request) {
-	fid := r.URL.Query().Get("fileId")
-	if fid == "" {
-		http.Error(w, "missing fileId", http.StatusBadRequest)
-		return
-	}
-
-	// panggil naming
-	resp, err := http.Get(c.NamingURL + "/lookup/" + fid)
-	if err != nil {
-		http.Error(w, "lookup error: "+err.Error(), 500)
-		return
-	}
-	defer resp.Body.Close()
-
-	// baca body
-	b, _ := io.ReadAll(resp.Body)
-	// bentuk aslinya pakai "NodeID"/"URL"
-	type in struct {
-		NodeID string `json:"NodeID"`
-		URL    string `json:"URL"`
-	}
-	var arr []in
-	_ = json.Unmarshal(b, &arr)
-
-	// normalisasi jadi "nodeId"/"url"
-	type out struct {
-		NodeId string `json:"nodeId"`
-		Url    string `json:"url"`
-	}
-	outArr := make([]out, 0, len(arr))
-	for _, v := range arr {
-		outArr = append(outArr, out{NodeId: v.NodeID, Url: v.URL})
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	if resp.StatusCode/100 != 2 {
-		w.WriteHeader(resp.StatusCode)
-		w.Write(b) // error dari naming apa adanya
-		return
-	}
-	_ = json.NewEncoder(w).Encode(outArr)
-}
-
-func (c cfg) handleProxyDownload(w http.ResponseWriter, r *http.Request) {
-	fid := r.URL.Query().Get("fileId")
-	nodeURL := r.URL.Query().Get("nodeUrl")
-	if fid == "" || nodeURL == "" {
-		http.Error(w, "missing fileId or nodeUrl", http.StatusBadRequest)
-		return
-	}
-	u := strings.TrimRight(nodeURL, "/") + "/download/" + fid
-	resp, err := http.Get(u)
-	if err != nil {
-		http.Error(w, "download failed: "+err.Error(), 502)
-		return
-	}
-	defer resp.Body.Close()
-
-	// pass through headers
-	for k, vv := range resp.Header {
-		for _, v := range vv {
-			w.Header().Add(k, v)
+	cc := startup.New("ui-gateway")
+	var conf gateway.Config
+	for _, u := range strings.Split(cc.Str("NAMING_URL", "http://localhost:8000"), ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			conf.NamingURLs = append(conf.NamingURLs, u)
 		}
 	}
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
-}
-
-/* ---------------- JSON RESP ---------------- */
-
-func writeJSON(w http.ResponseWriter, v any) {
-	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(v)
-}
-
-/* ---------------- ADMIN API ---------------- */
-
-func (c cfg) handleListFiles(w http.ResponseWriter, r *http.Request) {
-	resp, err := http.Get(c.NamingURL + "/list-files")
-	if err != nil {
-		w.WriteHeader(500)
-		writeJSON(w, map[string]string{"error": "failed to get files"})
-		return
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode/100 != 2 {
-		w.WriteHeader(resp.StatusCode)
-		writeJSON(w, map[string]string{"error": "upstream error"})
-		return
-	}
-	io.Copy(w, resp.Body)
-}
-
-func (c cfg) handleListNodes(w http.ResponseWriter, r *http.Request) {
-	resp, err := http.Get(c.NamingURL + "/list-nodes")
-	if err != nil {
-		w.WriteHeader(500)
-		writeJSON(w, map[string]string{"error": "failed to get nodes"})
-		return
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode/100 != 2 {
-		w.WriteHeader(resp.StatusCode)
-		writeJSON(w, map[string]string{"error": "upstream error"})
-		return
-	}
-	w.Header().Set("Content-Type", "application/json")
-	io.Copy(w, resp.Body)
-}
-
-func (c cfg) handleMetrics(w http.ResponseWriter, r *http.Request) {
-	resp, err := http.Get(c.NamingURL + "/metrics")
-	if err != nil {
-		w.WriteHeader(500)
-		writeJSON(w, map[string]string{"error": "failed to get metrics"})
-		return
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode/100 != 2 {
-		w.WriteHeader(resp.StatusCode)
-		writeJSON(w, map[string]string{"error": "upstream error"})
-		return
-	}
-	w.Header().Set("Content-Type", "application/json")
-	io.Copy(w, resp.Body)
-}
-
-func (c cfg) handleDeleteFile(w http.ResponseWriter, r *http.Request) {
-	var body map[string]string
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		http.Error(w, "bad json", 400)
-		return
-	}
-	fid := body["fileId"]
-	if fid == "" {
-		http.Error(w, "missing fileId", 400)
-		return
-	}
-	lr, err := http.Get(c.NamingURL + "/lookup/" + fid)
-	var replicas []struct{ NodeID, URL string }
-	if err == nil {
-		defer lr.Body.Close()
-		_ = json.NewDecoder(lr.Body).Decode(&replicas)
-	}
-	deletedNodes := []string{}
-	for _, rep := range replicas {
-		reqBody := map[string]string{"fileId": fid}
-		rb, _ := json.Marshal(reqBody)
-		u := strings.TrimRight(rep.URL, "/") + "/delete"
-		cli := &http.Client{Timeout: 2 * time.Second}
-		rr, err := cli.Post(u, "application/json", bytes.NewReader(rb))
-		if err == nil {
-			deletedNodes = append(deletedNodes, rep.NodeID)
-			if rr != nil {
-				rr.Body.Close()
+	// NAMING_SHARDS lists the naming shards in index order, comma-separated,
+	// each as its replicas joined by "|"; it takes over from NAMING_URL.
+	if shards := cc.Str("NAMING_SHARDS", ""); shards != "" {
+		for i, sh := range strings.Split(shards, ",") {
+			var urls []string
+			for _, u := range strings.Split(sh, "|") {
+				if u = strings.TrimSpace(u); u != "" {
+					urls = append(urls, u)
+				}
 			}
+			if len(urls) == 0 {
+				cc.Fail("NAMING_SHARDS lists no URL for shard %d", i)
+			}
+			conf.NamingShards = append(conf.NamingShards, urls)
 		}
 	}
-	nb, _ := json.Marshal(map[string]string{"fileId": fid})
-	dr, err := http.Post(c.NamingURL+"/delete-file", "application/json", bytes.NewReader(nb))
-	if err != nil {
-		http.Error(w, "delete failed", 500)
-		return
-	}
-	defer dr.Body.Close()
-	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(map[string]any{"fileId": fid, "deleted": true, "nodes": deletedNodes})
-}
-
-func (c cfg) handleSearch(w http.ResponseWriter, r *http.Request) {
-	qfid := r.URL.Query().Get("fileId")
-	qname := r.URL.Query().Get("filename")
-	q := r.URL.Query().Get("q")
-	if q != "" {
-		if qfid == "" {
-			qfid = q
-		}
-		if qname == "" {
-			qname = q
-		}
-	}
-	resp, err := http.Get(c.NamingURL + "/list-files")
-	if err != nil {
-		http.Error(w, "failed to get files", 500)
-		return
-	}
-	defer resp.Body.Close()
-	var files []struct {
-		FileID       string `json:"fileId"`
-		Filename     string `json:"filename"`
-		Size         int64  `json:"size"`
-		State        string `json:"state"`
-		ReplicaCount int    `json:"replicaCount"`
-		CreatedAt    string `json:"createdAt"`
-	}
-	dec := json.NewDecoder(resp.Body)
-	if err := dec.Decode(&files); err != nil {
-		http.Error(w, "bad response", 502)
-		return
-	}
-	var out []any
-	for _, f := range files {
-		if qfid == "" && qname == "" {
-			out = append(out, f)
-			continue
+	if len(conf.NamingShards) > 0 {
+		conf.NamingURLs = conf.NamingShards[0]
+	}
+	conf.NamingHealthCheck = cc.Duration("NAMING_HEALTH_INTERVAL", 2*time.Second)
+	addr := cc.Str("ADDR", ":8080")
+	conf.TicketSecret = []byte(cc.Secret("UPLOAD_TICKET_SECRET"))
+	conf.TicketTTL = cc.Duration("UPLOAD_TICKET_TTL", 15*time.Minute)
+	conf.AdminToken = cc.Secret("ADMIN_TOKEN")
+	conf.Debug = cc.Bool("DEBUG_ENDPOINTS", false)
+	if conf.Debug && conf.AdminToken == "" {
+		cc.Fail("DEBUG_ENDPOINTS=true needs ADMIN_TOKEN to be set")
+	}
+	conf.UsersFile = cc.Str("USERS_FILE", "")
+	conf.SessionTTL = cc.Duration("SESSION_TTL", 12*time.Hour)
+	conf.AdminPassword = cc.Secret("AUTH_ADMIN_PASSWORD")
+	if conf.AdminPassword != "" && conf.UsersFile == "" {
+		cc.Fail("AUTH_ADMIN_PASSWORD needs USERS_FILE, the file the admin account is stored in")
+	}
+	conf.OIDC.Issuer = cc.Str("OIDC_ISSUER", "")
+	if conf.OIDC.Issuer != "" {
+		cc.ServiceURL("OIDC_ISSUER", conf.OIDC.Issuer)
+		if conf.OIDC.ClientID = cc.Str("OIDC_CLIENT_ID", ""); conf.OIDC.ClientID == "" {
+			cc.Fail("OIDC_ISSUER needs OIDC_CLIENT_ID, the client registered at the identity provider")
 		}
-		match := false
-		if qfid != "" && strings.Contains(strings.ToLower(f.FileID), strings.ToLower(qfid)) {
-			match = true
+		conf.OIDC.ClientSecret = cc.Secret("OIDC_CLIENT_SECRET")
+		if conf.OIDC.RedirectURL = cc.Str("OIDC_REDIRECT_URL", ""); conf.OIDC.RedirectURL != "" {
+			cc.ServiceURL("OIDC_REDIRECT_URL", conf.OIDC.RedirectURL)
 		}
-		if qname != "" && strings.Contains(strings.ToLower(f.Filename), strings.ToLower(qname)) {
-			match = true
+		conf.OIDC.Scopes = cc.List("OIDC_SCOPES", "openid profile email")
+		if !slices.Contains(conf.OIDC.Scopes, "openid") {
+			cc.Fail("OIDC_SCOPES must include openid")
 		}
-		if match {
-			out = append(out, f)
+		conf.OIDC.Name = cc.Str("OIDC_NAME", "single sign-on")
+		conf.OIDC.UsernameClaim = cc.Str("OIDC_USERNAME_CLAIM", "preferred_username")
+		conf.OIDC.GroupsClaim = cc.Str("OIDC_GROUPS_CLAIM", "groups")
+		conf.OIDC.AdminGroups = cc.List("OIDC_ADMIN_GROUPS", "")
+		conf.OIDC.UploaderGroups = cc.List("OIDC_UPLOADER_GROUPS", "")
+		conf.OIDC.ViewerGroups = cc.List("OIDC_VIEWER_GROUPS", "")
+		if len(conf.OIDC.AdminGroups)+len(conf.OIDC.UploaderGroups)+len(conf.OIDC.ViewerGroups) == 0 {
+			cc.Fail("OIDC_ISSUER needs at least one of OIDC_ADMIN_GROUPS, OIDC_UPLOADER_GROUPS or OIDC_VIEWER_GROUPS, or nobody can sign in")
 		}
 	}
-	writeJSON(w, out)
-}
-
-type systemProc struct {
-	mu     sync.Mutex
-	naming *exec.Cmd
-	nodeA  *exec.Cmd
-	nodeB  *exec.Cmd
-}
-
-func newSystemProc() *systemProc { return &systemProc{} }
-
-func (s *systemProc) isRunning(cmd *exec.Cmd) bool { return cmd != nil && cmd.Process != nil }
-
-func (s *systemProc) startAll() (map[string]bool, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	os.MkdirAll(filepath.Join("..", "logs"), 0755)
-	if s.naming == nil || s.naming.Process == nil {
-		s.naming = exec.Command("go", "run", "main.go")
-		s.naming.Dir = filepath.Join("..", "naming_service")
-		f, _ := os.OpenFile(filepath.Join("..", "logs", "naming.log"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-		s.naming.Stdout = f
-		s.naming.Stderr = f
-		_ = s.naming.Start()
-	}
-	if s.nodeA == nil || s.nodeA.Process == nil {
-		s.nodeA = exec.Command("go", "run", "main.go")
-		s.nodeA.Dir = filepath.Join("..", "storage_node")
-		s.nodeA.Env = append(os.Environ(),
-			"NODE_ID=node-a",
-			"PORT=9001",
-			"DATA_DIR=./data_a",
-			"NAMING_URL=http://localhost:8000",
-			"CAPACITY_BYTES=1073741824",
-		)
-		f, _ := os.OpenFile(filepath.Join("..", "logs", "node-a.log"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-		s.nodeA.Stdout = f
-		s.nodeA.Stderr = f
-		_ = s.nodeA.Start()
-	}
-	if s.nodeB == nil || s.nodeB.Process == nil {
-		s.nodeB = exec.Command("go", "run", "main.go")
-		s.nodeB.Dir = filepath.Join("..", "storage_node")
-		s.nodeB.Env = append(os.Environ(),
-			"NODE_ID=node-b",
-			"PORT=9002",
-			"DATA_DIR=./data_b",
-			"NAMING_URL=http://localhost:8000",
-			"CAPACITY_BYTES=1073741824",
-		)
-		f, _ := os.OpenFile(filepath.Join("..", "logs", "node-b.log"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-		s.nodeB.Stdout = f
-		s.nodeB.Stderr = f
-		_ = s.nodeB.Start()
-	}
-	return map[string]bool{
-		"naming": s.isRunning(s.naming),
-		"nodeA":  s.isRunning(s.nodeA),
-		"nodeB":  s.isRunning(s.nodeB),
-	}, nil
-}
-
-func (s *systemProc) stopAll() map[string]bool {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	stopped := map[string]bool{"naming": false, "nodeA": false, "nodeB": false}
-	if s.naming != nil && s.naming.Process != nil {
-		_ = s.naming.Process.Kill()
-		stopped["naming"] = true
-		s.naming = nil
-	}
-	if s.nodeA != nil && s.nodeA.Process != nil {
-		_ = s.nodeA.Process.Kill()
-		stopped["nodeA"] = true
-		s.nodeA = nil
-	}
-	if s.nodeB != nil && s.nodeB.Process != nil {
-		_ = s.nodeB.Process.Kill()
-		stopped["nodeB"] = true
-		s.nodeB = nil
-	}
-	return stopped
-}
-
-func (s *systemProc) startNode(id string) bool {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	switch id {
-	case "node-a":
-		if (s.nodeA != nil && s.nodeA.Process != nil) && ping("http://localhost:9001/health") {
-			return true
+	conf.CORSOrigins = cc.List("CORS_ALLOWED_ORIGINS", "")
+	for _, o := range conf.CORSOrigins {
+		if u, err := url.Parse(o); o != "*" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") != "") {
+			cc.Fail("CORS_ALLOWED_ORIGINS entry %q must be * or an origin such as https://app.example.com", o)
 		}
-		time.Sleep(300 * time.Millisecond)
-		s.nodeA = exec.Command("go", "run", "main.go")
-		s.nodeA.Dir = filepath.Join("..", "storage_node")
-		s.nodeA.Env = append(os.Environ(),
-			"NODE_ID=node-a", "PORT=9001", "DATA_DIR=./data_a", "NAMING_URL=http://localhost:8000", "CAPACITY_BYTES=1073741824",
-		)
-		f, _ := os.OpenFile(filepath.Join("..", "logs", "node-a.log"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-		s.nodeA.Stdout = f
-		s.nodeA.Stderr = f
-		_ = s.nodeA.Start()
-		return true
-	case "node-b":
-		if (s.nodeB != nil && s.nodeB.Process != nil) && ping("http://localhost:9002/health") {
-			return true
+	}
+	conf.CORSMethods = cc.List("CORS_ALLOWED_METHODS", "GET,POST,PUT,DELETE")
+	conf.CORSHeaders = cc.List("CORS_ALLOWED_HEADERS", "Content-Type,X-API-Key,X-Share-Password,If-None-Match,X-Request-Id")
+	conf.CORSCredentials = cc.Bool("CORS_ALLOW_CREDENTIALS", false)
+	if conf.CORSCredentials && slices.Contains(conf.CORSOrigins, "*") {
+		cc.Fail("CORS_ALLOW_CREDENTIALS cannot be used with CORS_ALLOWED_ORIGINS=*; list the origins")
+	}
+	conf.CORSMaxAge = cc.OptionalDuration("CORS_MAX_AGE", 10*time.Minute)
+	if conf.CSP = cc.Str("CONTENT_SECURITY_POLICY", gateway.DefaultCSP); conf.CSP == "off" {
+		conf.CSP = ""
+	}
+	conf.HSTSMaxAge = cc.OptionalDuration("HSTS_MAX_AGE", 0)
+	conf.RateLimitRPS = cc.OptionalFloat("RATE_LIMIT_RPS", 0)
+	conf.RateLimitBurst = cc.Int("RATE_LIMIT_BURST", 0)
+	conf.MaxConcurrentUploads = cc.Int("MAX_CONCURRENT_UPLOADS", 0)
+	conf.MaxTotalUploads = cc.Int("MAX_TOTAL_UPLOADS", 0)
+	conf.MaxUploadBytes = int64(cc.Int("MAX_UPLOAD_BYTES", 256<<20))
+	conf.MaxRequestBytes = int64(cc.Int("MAX_REQUEST_BYTES", 1<<20))
+	conf.CacheBytes = int64(cc.Int("CACHE_BYTES", 0))
+	conf.CacheMaxFileBytes = int64(cc.Int("CACHE_MAX_FILE_BYTES", 1<<20))
+	conf.CacheDir = cc.Str("CACHE_DIR", "")
+	conf.BatchConcurrency = cc.Int("BATCH_UPLOAD_CONCURRENCY", 4)
+	conf.BatchMaxFiles = cc.Int("BATCH_MAX_FILES", 1000)
+	conf.BatchMaxFileBytes = int64(cc.Int("BATCH_MAX_FILE_BYTES", 256<<20))
+	conf.PreviewSize = cc.Int("PREVIEW_SIZE", 256)
+	conf.PreviewMaxBytes = int64(cc.Int("PREVIEW_MAX_BYTES", 32<<20))
+	conf.AllowedTypes = types(cc, "UPLOAD_ALLOWED_TYPES")
+	conf.BlockedTypes = types(cc, "UPLOAD_BLOCKED_TYPES")
+	conf.ReplicaConcurrency = cc.Int("REPLICA_UPLOAD_CONCURRENCY", 3)
+	conf.ReplicaTimeout = cc.Duration("REPLICA_UPLOAD_TIMEOUT", 15*time.Second)
+	conf.Transport = gateway.TransportConfig{
+		MaxIdleConns:        cc.Int("HTTP_MAX_IDLE_CONNS", 100),
+		MaxIdleConnsPerHost: cc.Int("HTTP_MAX_IDLE_CONNS_PER_HOST", 32),
+		MaxConnsPerHost:     cc.Int("HTTP_MAX_CONNS_PER_HOST", 0),
+		IdleConnTimeout:     cc.Duration("HTTP_IDLE_CONN_TIMEOUT", 90*time.Second),
+		DialTimeout:         cc.Duration("HTTP_DIAL_TIMEOUT", 5*time.Second),
+		KeepAlive:           cc.Duration("HTTP_KEEP_ALIVE", 30*time.Second),
+		TLSHandshakeTimeout: cc.Duration("HTTP_TLS_HANDSHAKE_TIMEOUT", 5*time.Second),
+	}
+	conf.HedgeAfter = cc.OptionalDuration("DOWNLOAD_HEDGE_AFTER", 0)
+	conf.VerifyDownloads = cc.Bool("VERIFY_DOWNLOADS", false)
+	conf.ParallelMinBytes = int64(cc.Int("PARALLEL_DOWNLOAD_MIN_BYTES", 0))
+	conf.ParallelChunk = int64(cc.Int("PARALLEL_DOWNLOAD_CHUNK_BYTES", 4<<20))
+	if conf.ParallelMinBytes > 0 && conf.ParallelChunk < 1 {
+		cc.Fail("PARALLEL_DOWNLOAD_CHUNK_BYTES must be at least 1, got %d", conf.ParallelChunk)
+	}
+	conf.Calls = gateway.CallPolicy{
+		Attempts:   cc.Int("NODE_RETRY_ATTEMPTS", 3),
+		BaseDelay:  cc.Duration("NODE_RETRY_BASE_DELAY", 100*time.Millisecond),
+		MaxDelay:   cc.Duration("NODE_RETRY_MAX_DELAY", 2*time.Second),
+		BreakAfter: cc.Int("NODE_CIRCUIT_BREAK_AFTER", 5),
+		OpenFor:    cc.Duration("NODE_CIRCUIT_OPEN_FOR", 30*time.Second),
+	}
+	if conf.Calls.Attempts < 1 {
+		cc.Fail("NODE_RETRY_ATTEMPTS must be at least 1, got %d", conf.Calls.Attempts)
+	}
+	if conf.ReplicaConcurrency < 1 {
+		cc.Fail("REPLICA_UPLOAD_CONCURRENCY must be at least 1, got %d", conf.ReplicaConcurrency)
+	}
+	if conf.BatchConcurrency < 1 {
+		cc.Fail("BATCH_UPLOAD_CONCURRENCY must be at least 1, got %d", conf.BatchConcurrency)
+	}
+	conf.Orchestrator = cc.Str("ORCHESTRATOR", "process")
+	conf.SystemNodes = cc.Int("SYSTEM_NODES", 2)
+	conf.TopologyFile = cc.Str("SYSTEM_TOPOLOGY", "topology.json")
+	conf.DockerImage = cc.Str("DOCKER_IMAGE", "projectakhir:latest")
+	conf.DockerProject = cc.Str("DOCKER_PROJECT", "projectakhir")
+	switch conf.Orchestrator {
+	case "process":
+	case "docker", "compose":
+		if _, err := exec.LookPath("docker"); err != nil {
+			cc.Fail("ORCHESTRATOR=%s needs the docker CLI on PATH: %v", conf.Orchestrator, err)
 		}
-		time.Sleep(300 * time.Millisecond)
-		s.nodeB = exec.Command("go", "run", "main.go")
-		s.nodeB.Dir = filepath.Join("..", "storage_node")
-		s.nodeB.Env = append(os.Environ(),
-			"NODE_ID=node-b", "PORT=9002", "DATA_DIR=./data_b", "NAMING_URL=http://localhost:8000", "CAPACITY_BYTES=1073741824",
-		)
-		f, _ := os.OpenFile(filepath.Join("..", "logs", "node-b.log"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-		s.nodeB.Stdout = f
-		s.nodeB.Stderr = f
-		_ = s.nodeB.Start()
-		return true
 	default:
-		return false
-	}
-}
-
-func (c cfg) handleSystemStart(w http.ResponseWriter, r *http.Request) {
-	status, _ := c.sys.startAll()
-	writeJSON(w, map[string]any{"started": true, "status": status})
-}
-func (c cfg) handleSystemStop(w http.ResponseWriter, r *http.Request) {
-	status := c.sys.stopAll()
-	writeJSON(w, map[string]any{"stopped": true, "status": status})
-}
-func (c cfg) handleSystemStatus(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, map[string]any{
-		"naming": ping(c.NamingURL+"/metrics") || c.sys.isRunning(c.sys.naming),
-		"nodeA":  ping("http://localhost:9001/health") || c.sys.isRunning(c.sys.nodeA),
-		"nodeB":  ping("http://localhost:9002/health") || c.sys.isRunning(c.sys.nodeB),
-	})
-}
-
-func ping(url string) bool {
-	client := &http.Client{Timeout: 800 * time.Millisecond}
-	resp, err := client.Get(url)
-	if err != nil {
-		return false
+		cc.Fail("ORCHESTRATOR=%q must be process, docker or compose", conf.Orchestrator)
 	}
-	_ = resp.Body.Close()
-	return true
-}
-
-func (c cfg) handleStopNode(w http.ResponseWriter, r *http.Request) {
-	var body struct {
-		NodeID string `json:"nodeId"`
+	if conf.SystemNodes < 1 {
+		cc.Fail("SYSTEM_NODES must be at least 1, got %d", conf.SystemNodes)
 	}
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.NodeID == "" {
-		http.Error(w, "bad json", 400)
-		return
+	if len(conf.NamingURLs) == 0 {
+		cc.Fail("NAMING_URL must list at least one naming service URL")
 	}
-	resp, err := http.Get(c.NamingURL + "/list-nodes")
-	if err != nil {
-		http.Error(w, "cannot list nodes", 500)
-		return
+	for _, u := range conf.NamingURLs {
+		cc.ServiceURL("NAMING_URL", u)
 	}
-	defer resp.Body.Close()
-	var nodes []struct{ NodeID, URL string }
-	_ = json.NewDecoder(resp.Body).Decode(&nodes)
-	var target string
-	for _, n := range nodes {
-		if n.NodeID == body.NodeID {
-			target = n.URL
-			break
+	for _, urls := range conf.NamingShards[min(1, len(conf.NamingShards)):] {
+		for _, u := range urls {
+			cc.ServiceURL("NAMING_SHARDS", u)
 		}
 	}
-	if target == "" {
-		http.Error(w, "node not found", 404)
-		return
+	for _, page := range []string{"index.html", "dashboard.html"} {
+		if _, err := os.Stat(page); err != nil {
+			cc.Fail("%s not found in the working directory; start the gateway from ui_gateway/", page)
+		}
 	}
-	req, _ := http.NewRequest("POST", strings.TrimRight(target, "/")+"/shutdown", nil)
-	res, err := (&http.Client{Timeout: 2 * time.Second}).Do(req)
+	srv := cc.HTTPServer(0, 0)
+	ln := cc.Listen("ADDR", addr)
+	cc.Done()
+
+	gw, err := gateway.NewServer(conf)
 	if err != nil {
-		http.Error(w, "shutdown failed", 502)
-		return
-	}
-	defer res.Body.Close()
-	c.sys.mu.Lock()
-	if body.NodeID == "node-a" {
-		c.sys.nodeA = nil
+		log.Printf("config error: %v", err)
+		os.Exit(startup.ExitConfig)
 	}
-	if body.NodeID == "node-b" {
-		c.sys.nodeB = nil
+	log.Printf("UI Gateway running at %s (NAMING_URL=%s)", addr, strings.Join(conf.NamingURLs, ","))
+	if len(conf.NamingShards) > 1 {
+		log.Printf("Routing the catalog across %d naming shards", len(conf.NamingShards))
 	}
-	c.sys.mu.Unlock()
-	writeJSON(w, map[string]any{"nodeId": body.NodeID, "stopped": true})
+	srv.Handler = gw.Handler()
+	log.Fatal(startup.Serve(srv, ln))
 }
 
-func (c cfg) handleStartNode(w http.ResponseWriter, r *http.Request) {
-	var body struct {
-		NodeID string `json:"nodeId"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.NodeID == "" {
-		http.Error(w, "bad json", 400)
-		return
+/* ---------------- STARTUP CONFIG ---------------- */
+
+// types reads a comma-separated list of MIME types, type/* patterns and, for
+// the block list, the word "executables".
+func types(cc *startup.Check, key string) []string {
+	var out []string
+	for _, t := range strings.Split(cc.Str(key, ""), ",") {
+		if t = strings.TrimSpace(t); t == "" {
+			continue
+		}
+		if t != "executables" && !strings.Contains(t, "/") {
+			cc.Fail("%s entry %q must be a MIME type such as image/png or image/*", key, t)
+			continue
+		}
+		out = append(out, t)
 	}
-	ok := c.sys.startNode(body.NodeID)
-	writeJSON(w, map[string]any{"nodeId": body.NodeID, "started": ok})
+	return out
 }